@@ -0,0 +1,395 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/theMichaelB/sess/pkg/sess"
+	"golang.org/x/sys/unix"
+	"golang.org/x/term"
+)
+
+// terminalSize returns the size of the controlling terminal on stdin, or
+// zeros when stdin is not a terminal.
+func terminalSize() (rows, cols int) {
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		if w, h, err := term.GetSize(int(os.Stdin.Fd())); err == nil {
+			return h, w
+		}
+	}
+	return 0, 0
+}
+
+// stdinHasInput reports whether stdin is somewhere input can come from: a
+// terminal, or a pipe or file to forward to the session. Anything else,
+// such as /dev/null or a supervisor's socket, makes attaches output-only.
+func stdinHasInput() bool {
+	fd := int(os.Stdin.Fd())
+	if term.IsTerminal(fd) {
+		return true
+	}
+	info, err := os.Stdin.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode().IsRegular() || info.Mode()&os.ModeNamedPipe != 0
+}
+
+// maxSize bounds the rows and columns --size takes: more is a typo, and
+// would have programs lay out screens no terminal shows.
+const maxSize = 10000
+
+// parseSize parses a --size value, ROWSxCOLS.
+func parseSize(s string) (rows, cols int, err error) {
+	r, c, ok := strings.Cut(s, "x")
+	if ok {
+		rows, err = strconv.Atoi(r)
+		if err == nil {
+			cols, err = strconv.Atoi(c)
+		}
+	}
+	if !ok || err != nil || rows <= 0 || cols <= 0 || rows > maxSize || cols > maxSize {
+		return 0, 0, fmt.Errorf("invalid size %q: want ROWSxCOLS, each from 1 to %d, e.g. 50x200", s, maxSize)
+	}
+	return rows, cols, nil
+}
+
+// initialSize returns the size a session created to attach with opts
+// starts at: the --size given, else the terminal's.
+func initialSize(opts sess.AttachOptions) (rows, cols int) {
+	if opts.Size != nil {
+		if rows, cols, err := opts.Size(); err == nil {
+			return rows, cols
+		}
+	}
+	return terminalSize()
+}
+
+// initialPixels returns the size in pixels that goes with initialSize: the
+// terminal's, unless --size gave the size in cells.
+func initialPixels(opts sess.AttachOptions) (xpixel, ypixel int) {
+	if opts.Size != nil || !term.IsTerminal(int(os.Stdin.Fd())) {
+		return 0, 0
+	}
+	ws, err := unix.IoctlGetWinsize(int(os.Stdin.Fd()), unix.TIOCGWINSZ)
+	if err != nil {
+		return 0, 0
+	}
+	return int(ws.Xpixel), int(ws.Ypixel)
+}
+
+// attach connects the terminal to a session, wiring SIGWINCH to resizes
+// (unless --size fixed the size) and SIGUSR1 (sent by "sess -x"), SIGINT and
+// SIGTERM to a clean detach. In a cooked attach SIGINT is the user's
+// Ctrl-C, and is passed on instead. A number containing a slash is the
+// socket of a session another user shared.
+func attach(manager *sess.Manager, number string, opts sess.AttachOptions) error {
+	detachOn := []os.Signal{syscall.SIGUSR1, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP}
+	if opts.Cooked {
+		detachOn = []os.Signal{syscall.SIGUSR1, syscall.SIGTERM, syscall.SIGHUP}
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), detachOn...)
+	defer cancel()
+
+	if opts.Cooked {
+		sigint := make(chan os.Signal, 1)
+		signal.Notify(sigint, syscall.SIGINT)
+		defer signal.Stop(sigint)
+		interrupt := make(chan struct{}, 1)
+		opts.Interrupt = interrupt
+		go func() {
+			for {
+				select {
+				case <-sigint:
+					select {
+					case interrupt <- struct{}{}:
+					default:
+					}
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	// A size given with --size stays, whatever the terminal does.
+	if opts.Size != nil {
+		return attachTo(ctx, manager, number, opts)
+	}
+	winch := make(chan os.Signal, 1)
+	signal.Notify(winch, syscall.SIGWINCH)
+	defer signal.Stop(winch)
+
+	resize := make(chan struct{}, 1)
+	go func() {
+		for {
+			select {
+			case <-winch:
+				select {
+				case resize <- struct{}{}:
+				default:
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	opts.Resize = resize
+	return attachTo(ctx, manager, number, opts)
+}
+
+// attachTo attaches to session number, or to the shared session whose
+// socket it names.
+func attachTo(ctx context.Context, manager *sess.Manager, number string, opts sess.AttachOptions) error {
+	if strings.Contains(number, "/") {
+		return manager.AttachShared(ctx, number, opts)
+	}
+	return manager.Attach(ctx, number, opts)
+}
+
+func handleCreate(manager *sess.Manager, create sess.CreateOptions, opts sess.AttachOptions, forceNested bool) error {
+	if err := checkNesting(manager, opts, forceNested); err != nil {
+		return err
+	}
+	if err := applyDefaultCommand(&create); err != nil {
+		return err
+	}
+
+	// Determine initial terminal size to pass to daemon
+	create.Rows, create.Cols = initialSize(opts)
+	create.XPixel, create.YPixel = initialPixels(opts)
+	number, err := manager.Create(create)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Created session %s at %s\n", number, time.Now().Format("2006-01-02 15:04"))
+
+	return attachNew(manager, number, opts, create.Transient)
+}
+
+// handleNew creates a session without attaching to it, for scripts setting
+// sessions up: at the number --at gives, or the next free one.
+func handleNew(manager *sess.Manager, create sess.CreateOptions, opts sess.AttachOptions, args []string) error {
+	fs := flag.NewFlagSet("sess new", flag.ContinueOnError)
+	atFlag := fs.String("at", "", "Number to create the session at")
+	args, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if create.Transient {
+		return withExitCode(exitUsage, fmt.Errorf("a transient session ends when its client leaves; attach to create one"))
+	}
+	create.Command = args
+	if err := applyDefaultCommand(&create); err != nil {
+		return err
+	}
+	if *atFlag != "" {
+		if n, err := strconv.Atoi(*atFlag); err != nil || n < 1 {
+			return withExitCode(exitUsage, fmt.Errorf("invalid session number %q for --at", *atFlag))
+		}
+		create.Number = manager.NormalizeNumber(*atFlag)
+	}
+	create.Rows, create.Cols = initialSize(opts)
+	create.XPixel, create.YPixel = initialPixels(opts)
+	number, err := manager.Create(create)
+	if errors.Is(err, sess.ErrSessionExists) {
+		return withExitCode(exitConflict, fmt.Errorf("session %s already exists", create.Number))
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Created session %s at %s\n", number, time.Now().Format("2006-01-02 15:04"))
+	return nil
+}
+
+// commandArgs returns the command given after "--" on the command line,
+// or nil if there is no "--".
+func commandArgs() []string {
+	rest := flag.Args()
+	if i := len(os.Args) - len(rest) - 1; i >= 1 && os.Args[i] == "--" {
+		return append([]string{}, rest...)
+	}
+	return nil
+}
+
+// applyDefaultCommand makes a session created without a command run the
+// configured default-command, if there is one; otherwise it runs the shell.
+func applyDefaultCommand(create *sess.CreateOptions) error {
+	if len(create.Command) > 0 {
+		return nil
+	}
+	cfg, err := sess.LoadConfig()
+	if err != nil {
+		return fmt.Errorf("failed to read config: %w", err)
+	}
+	if cfg.DefaultCommand != "" {
+		create.Command = sess.ShellCommand(cfg.DefaultCommand)
+	}
+	return nil
+}
+
+// attachNew attaches to a session just created. A transient session is
+// killed once the attach ends; its daemon also ends it by itself should
+// this client die first.
+func attachNew(manager *sess.Manager, number string, opts sess.AttachOptions, transient bool) error {
+	err := attach(manager, number, opts)
+	if transient {
+		if kerr := manager.Kill(number); kerr != nil && !errors.Is(kerr, sess.ErrSessionNotFound) && !errors.Is(kerr, sess.ErrSessionDead) {
+			fmt.Fprintf(os.Stderr, "Warning: failed to kill transient session %s: %v\n", number, kerr)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to attach to new session: %w", err)
+	}
+	return nil
+}
+
+func handleAttach(manager *sess.Manager, number string, opts sess.AttachOptions) error {
+	if s, err := manager.Get(number); err == nil && !opts.Raw {
+		if s.Locked && opts.Force {
+			fmt.Fprintf(os.Stderr, "Warning: session %s is locked; attaching anyway\n", s.Number)
+		}
+		if s.Transient && !opts.ReadOnly {
+			fmt.Fprintf(os.Stderr, "Warning: session %s is transient and ends when you detach\n", s.Number)
+		}
+	}
+	return attach(manager, number, opts)
+}
+
+func handleLast(manager *sess.Manager, opts sess.AttachOptions, forceNested bool) error {
+	warnStaleSession(manager)
+	if cur, ok := manager.InSession(); ok && !forceNested {
+		return withExitCode(exitUsage, fmt.Errorf("Already in session %s; press %s to switch to the previous session", cur, manager.SwitchKeys(cur)))
+	}
+	number, err := manager.Previous()
+	if err != nil {
+		return err
+	}
+	return attach(manager, number, opts)
+}
+
+// warnStaleSession notes an inherited SESS_NUM whose session has ended,
+// which would otherwise look like nesting.
+func warnStaleSession(manager *sess.Manager) {
+	if number, stale := manager.StaleSession(); stale {
+		fmt.Fprintf(os.Stderr, "Warning: ignoring SESS_NUM=%s; that session is no longer running\n", number)
+	}
+}
+
+// checkNesting refuses to start a session inside another unless forced.
+// Inside tmux or screen it warns, or refuses, as the nested-warning
+// setting says.
+func checkNesting(manager *sess.Manager, opts sess.AttachOptions, forceNested bool) error {
+	warnStaleSession(manager)
+	if cur, ok := manager.InSession(); ok && !forceNested {
+		return fmt.Errorf("Cannot create session from within existing session %s (use --force-nested to allow)", cur)
+	}
+	mux, ok := sess.OuterMultiplexer()
+	if !ok {
+		return nil
+	}
+	cfg, err := sess.LoadConfig()
+	if err != nil {
+		return err
+	}
+	switch {
+	case cfg.NestedWarning == sess.NestedOff:
+	case cfg.NestedWarning == sess.NestedError && !forceNested:
+		return fmt.Errorf("Cannot create session from within %s (nested-warning = error; use --force-nested to allow)", mux.Name)
+	default:
+		key := "Ctrl-X"
+		if opts.DetachKey != "" {
+			key = opts.DetachKey
+		}
+		fmt.Fprintf(os.Stderr, "Warning: you are inside %s; %s detaches sess, %s detaches %s\n", mux.Name, key, mux.Detach, mux.Name)
+	}
+	return nil
+}
+
+func handleAttachCreate(manager *sess.Manager, number string, create sess.CreateOptions, opts sess.AttachOptions, forceNested bool) error {
+	number = manager.NormalizeNumber(number)
+
+	if err := checkNesting(manager, opts, forceNested); err != nil {
+		return err
+	}
+
+	if _, err := manager.Get(number); errors.Is(err, sess.ErrSessionRemote) {
+		// Its number is taken, though not from here.
+		return err
+	}
+	if _, err := manager.Get(number); err == nil || errors.Is(err, sess.ErrSessionDead) {
+		err := handleAttach(manager, number, opts)
+		switch {
+		case errors.Is(err, sess.ErrSessionStale):
+			// Its daemon was killed outright; start afresh in its place.
+			if s, err := manager.Get(number); err == nil {
+				if err := manager.Kill(number); err != nil {
+					return err
+				}
+				fmt.Fprintf(os.Stderr, "Session %s's daemon had died; ended its command (pid %d), left without a terminal\n", number, s.PID)
+			} else {
+				fmt.Fprintf(os.Stderr, "Session %s's daemon had died; cleared away what it left\n", number)
+			}
+		case errors.Is(err, sess.ErrSessionDead):
+			// It ended meanwhile.
+		default:
+			return err
+		}
+	}
+
+	if err := applyDefaultCommand(&create); err != nil {
+		return err
+	}
+
+	// Determine initial terminal size to pass to daemon
+	create.Number = number
+	create.Rows, create.Cols = initialSize(opts)
+	create.XPixel, create.YPixel = initialPixels(opts)
+	// Do not write metadata here; the daemon writes authoritative metadata
+	// once the PTY and child shell are started.
+	if _, err := manager.Create(create); err != nil {
+		if errors.Is(err, sess.ErrSessionExists) && waitForSession(manager, number) {
+			// Another sess created it first; attach to theirs.
+			return handleAttach(manager, number, opts)
+		}
+		return err
+	}
+
+	fmt.Printf("Created session %s at %s\n", number, time.Now().Format("2006-01-02 15:04"))
+
+	return attachNew(manager, number, opts, create.Transient)
+}
+
+// waitForSession waits briefly for a session another process is creating
+// to come up, reporting whether it did.
+func waitForSession(manager *sess.Manager, number string) bool {
+	for i := 0; i < 30; i++ {
+		if _, err := manager.Get(number); err == nil {
+			return true
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return false
+}
+
+func handleDetach(manager *sess.Manager) error {
+	// Detach the active client by signaling the client PID recorded
+	// in the current-session file, regardless of where this command runs.
+	if err := manager.DetachCurrent(); err != nil {
+		if errors.Is(err, sess.ErrNotAttached) {
+			return fmt.Errorf("Not attached to any session")
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		in         string
+		rows, cols int
+		ok         bool
+	}{
+		{"50x200", 50, 200, true},
+		{"24x80", 24, 80, true},
+		{"50", 0, 0, false},
+		{"50x", 0, 0, false},
+		{"x200", 0, 0, false},
+		{"0x80", 0, 0, false},
+		{"24x-1", 0, 0, false},
+		{"24X80", 0, 0, false},
+		{"70000x80", 0, 0, false},
+		{"0x0", 0, 0, false},
+		{"10000x10000", 10000, 10000, true},
+		{"24x10001", 0, 0, false},
+	}
+	for _, tt := range tests {
+		rows, cols, err := parseSize(tt.in)
+		if (err == nil) != tt.ok || rows != tt.rows || cols != tt.cols {
+			t.Errorf("parseSize(%q) = %d, %d, %v; want %d, %d, ok %v", tt.in, rows, cols, err, tt.rows, tt.cols, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/theMichaelB/sess/pkg/sess"
+)
+
+func handleDebug(manager *sess.Manager, args []string) error {
+	fs := flag.NewFlagSet("sess debug", flag.ContinueOnError)
+	args, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) > 1 {
+		return withExitCode(exitUsage, fmt.Errorf("usage: sess debug [num]"))
+	}
+	number, err := sessionArg(manager, args)
+	if err != nil {
+		return err
+	}
+	dump, err := manager.Debug(number)
+	if err != nil {
+		return err
+	}
+	fmt.Print(dump)
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/theMichaelB/sess/pkg/sess"
+	"golang.org/x/term"
+)
+
+// handleDoctor finds daemons still running sessions that sess can no
+// longer reach, as after rm -rf ~/.sess, and offers to have each put its
+// socket and metadata back or to kill it. --reregister and --kill do one
+// or the other to all without asking; without a terminal to ask on, and
+// neither, it only lists them, exiting 4 if there are any.
+func handleDoctor(manager *sess.Manager, args []string) error {
+	fs := flag.NewFlagSet("sess doctor", flag.ContinueOnError)
+	reregisterFlag := fs.Bool("reregister", false, "Have every orphaned daemon put its session back")
+	killFlag := fs.Bool("kill", false, "Kill every orphaned daemon and its session")
+	args, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) > 0 || *reregisterFlag && *killFlag {
+		return withExitCode(exitNotFound, fmt.Errorf("usage: sess doctor [--reregister | --kill]"))
+	}
+
+	orphans, err := manager.Orphans()
+	if errors.Is(err, sess.ErrUnsupported) {
+		return fmt.Errorf("cannot look for orphaned daemons here: the processes' arguments cannot be read")
+	}
+	if err != nil {
+		return err
+	}
+	if len(orphans) == 0 {
+		fmt.Println("No orphaned daemons")
+		return nil
+	}
+	ask := !*reregisterFlag && !*killFlag && term.IsTerminal(int(os.Stdin.Fd()))
+
+	failed, left := 0, 0
+	for _, o := range orphans {
+		fmt.Printf("Session %s (daemon pid %d, %s): %s\n", o.Number, o.DaemonPID, truncate(strings.Join(o.Command, " "), 40), o.Problem)
+		action := ""
+		switch {
+		case *reregisterFlag && !o.Taken:
+			action = "r"
+		case *reregisterFlag:
+			fmt.Println("  left running: only killing it can help")
+		case *killFlag:
+			action = "k"
+		case ask:
+			action = askOrphan(o)
+		}
+
+		var err error
+		switch action {
+		case "r":
+			if err = manager.Reregister(o); err == nil {
+				fmt.Printf("  put back as session %s\n", o.Number)
+			}
+		case "k":
+			if err = manager.KillOrphan(o); err == nil {
+				fmt.Printf("  killed\n")
+			}
+		default:
+			left++
+			continue
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			failed++
+		}
+	}
+	switch {
+	case failed > 0:
+		return fmt.Errorf("%d orphaned daemon(s) could not be dealt with", failed)
+	case left > 0 && !ask:
+		return withExitCode(exitConflict, fmt.Errorf("%d orphaned daemon(s) left running; pass --reregister or --kill", left))
+	}
+	return nil
+}
+
+// askOrphan asks what to do with o: "r" to re-register it, "k" to kill
+// it, or "" to leave it be.
+func askOrphan(o sess.Orphan) string {
+	if o.Taken {
+		fmt.Print("  [k]ill or [s]kip? ")
+	} else {
+		fmt.Print("  [r]e-register, [k]ill or [s]kip? ")
+	}
+	var answer string
+	fmt.Scanln(&answer)
+	switch strings.ToLower(answer) {
+	case "r":
+		if !o.Taken {
+			return "r"
+		}
+	case "k":
+		return "k"
+	}
+	return ""
+}
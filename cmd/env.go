@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/theMichaelB/sess/pkg/sess"
+)
+
+func handleSetenv(manager *sess.Manager, args []string) error {
+	fs := flag.NewFlagSet("sess setenv", flag.ContinueOnError)
+	var unset stringList
+	fs.Var(&unset, "unset", "Remove `KEY` from the session (repeatable)")
+	args, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return withExitCode(exitUsage, fmt.Errorf("usage: sess setenv <num> [KEY=value...] [--unset KEY]..."))
+	}
+	number := args[0]
+
+	if len(args) == 1 && len(unset) == 0 {
+		s, err := manager.Get(number)
+		if err != nil {
+			return err
+		}
+		keys := make([]string, 0, len(s.Env))
+		for key := range s.Env {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Printf("%s=%s\n", key, s.Env[key])
+		}
+		for _, key := range s.EnvUnset {
+			fmt.Printf("-%s\n", key)
+		}
+		return nil
+	}
+
+	set := make(map[string]string)
+	for _, kv := range args[1:] {
+		key, value, ok := strings.Cut(kv, "=")
+		if !ok {
+			return withExitCode(exitUsage, fmt.Errorf("expected KEY=value, got %q", kv))
+		}
+		set[key] = value
+	}
+	return manager.SetEnv(number, set, unset)
+}
+
+func handleCwd(manager *sess.Manager, args []string) error {
+	number, err := sessionArg(manager, args)
+	if err != nil {
+		return err
+	}
+
+	cwd, err := manager.Cwd(number)
+	if err != nil {
+		if errors.Is(err, sess.ErrSessionNotFound) || errors.Is(err, sess.ErrSessionDead) {
+			return withExitCode(exitNotFound, err)
+		}
+		return withExitCode(exitUnavailable, err)
+	}
+	fmt.Println(cwd)
+	return nil
+}
+
+func handleEnv(manager *sess.Manager, args []string) error {
+	fs := flag.NewFlagSet("sess env", flag.ContinueOnError)
+	jsonFlag := fs.Bool("json", false, "Print as a JSON object")
+	diffFlag := fs.Bool("diff", false, "Show only differences from this shell's environment")
+	args, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	number, err := sessionArg(manager, args)
+	if err != nil {
+		return err
+	}
+
+	env, err := manager.Env(number)
+	if err != nil {
+		switch {
+		case errors.Is(err, sess.ErrUnsupported):
+			return fmt.Errorf("sess env is not supported on this platform")
+		case errors.Is(err, os.ErrPermission):
+			return fmt.Errorf("%v (is the session owned by another user?)", err)
+		}
+		return err
+	}
+
+	sessionEnv := envMap(env)
+	if !*diffFlag {
+		if *jsonFlag {
+			return printJSON(sessionEnv)
+		}
+		for _, kv := range env {
+			fmt.Println(kv)
+		}
+		return nil
+	}
+
+	localEnv := envMap(os.Environ())
+	diff := envDiff{
+		Added:   map[string]string{},
+		Removed: map[string]string{},
+		Changed: map[string]envChange{},
+	}
+	for k, v := range sessionEnv {
+		lv, ok := localEnv[k]
+		switch {
+		case !ok:
+			diff.Added[k] = v
+		case lv != v:
+			diff.Changed[k] = envChange{Session: v, Local: lv}
+		}
+	}
+	for k, v := range localEnv {
+		if _, ok := sessionEnv[k]; !ok {
+			diff.Removed[k] = v
+		}
+	}
+
+	if *jsonFlag {
+		return printJSON(diff)
+	}
+	for _, k := range sortedKeys(diff.Removed) {
+		fmt.Printf("- %s=%s\n", k, diff.Removed[k])
+	}
+	for _, k := range sortedKeys(diff.Changed) {
+		fmt.Printf("- %s=%s\n+ %s=%s\n", k, diff.Changed[k].Local, k, diff.Changed[k].Session)
+	}
+	for _, k := range sortedKeys(diff.Added) {
+		fmt.Printf("+ %s=%s\n", k, diff.Added[k])
+	}
+	return nil
+}
+
+// envDiff describes a session's environment relative to the local one.
+type envDiff struct {
+	Added   map[string]string    `json:"added"`
+	Removed map[string]string    `json:"removed"`
+	Changed map[string]envChange `json:"changed"`
+}
+
+type envChange struct {
+	Session string `json:"session"`
+	Local   string `json:"local"`
+}
+
+func envMap(env []string) map[string]string {
+	m := make(map[string]string, len(env))
+	for _, kv := range env {
+		k, v, _ := strings.Cut(kv, "=")
+		m[k] = v
+	}
+	return m
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/theMichaelB/sess/pkg/sess"
+	"golang.org/x/term"
+)
+
+func handleClean(manager *sess.Manager, args []string) error {
+	fs := flag.NewFlagSet("sess clean", flag.ContinueOnError)
+	if _, err := parseArgs(fs, args); err != nil {
+		return err
+	}
+	cfg, err := sess.LoadConfig()
+	if err != nil {
+		return err
+	}
+	removed, kept, err := manager.Clean()
+	for _, r := range removed {
+		fmt.Printf("Removed %s session %s\n", r.State, r.Number)
+		if r.State == sess.StateStale && r.Log != "" {
+			fmt.Printf("Kept its log: %s\n", r.Log)
+		}
+		if r.State == sess.StateStale && r.InputLog != "" {
+			fmt.Printf("Kept its input log: %s\n", r.InputLog)
+		}
+	}
+	for _, r := range kept {
+		fmt.Printf("Kept stale session %s: its process (pid %d) is still running; 'sess -k %s' ends it\n", r.Number, r.PID, r.Number)
+	}
+	if err != nil {
+		return err
+	}
+	logs, err := manager.PruneLogs(cfg.LogRetention())
+	for _, path := range logs {
+		fmt.Printf("Removed old log %s\n", path)
+	}
+	if err != nil {
+		return err
+	}
+	if len(removed) == 0 && len(kept) == 0 && len(logs) == 0 {
+		fmt.Println("Nothing to clean")
+	}
+	if used, err := manager.LogUsage(); err == nil && used > 0 {
+		if cfg.LogDiskLimit > 0 {
+			fmt.Printf("Logs use %s of %s (log-disk-limit)\n", formatBytes(uint64(used)), formatBytes(uint64(cfg.LogDiskLimit)))
+		} else {
+			fmt.Printf("Logs use %s\n", formatBytes(uint64(used)))
+		}
+	}
+	return nil
+}
+
+func handleKill(manager *sess.Manager, number string, force, yes bool) error {
+	if number == "" {
+		cur, ok := manager.InSession()
+		if !ok {
+			return fmt.Errorf("%w; give a session number", sess.ErrNotInSession)
+		}
+		// The client attached is most likely the one running this, and
+		// the job in the foreground this very command.
+		number, force, yes = cur, true, true
+	} else {
+		number = manager.NormalizeNumber(number)
+	}
+
+	if !force {
+		if err := checkNotAttached(manager, number); err != nil {
+			return err
+		}
+	}
+	if !yes {
+		if err := confirmKill(manager, number); err != nil {
+			return err
+		}
+	}
+	if err := manager.Kill(number); err != nil {
+		return err
+	}
+
+	fmt.Printf("Killed session %s\n", number)
+	return nil
+}
+
+func handlePurge(manager *sess.Manager, args []string) error {
+	fs := flag.NewFlagSet("sess purge", flag.ContinueOnError)
+	yesFlag := fs.Bool("yes", false, "Don't ask for confirmation")
+	if _, err := parseArgs(fs, args); err != nil {
+		return err
+	}
+
+	if !*yesFlag {
+		if !term.IsTerminal(int(os.Stdin.Fd())) {
+			return withExitCode(exitUsage, fmt.Errorf("refusing to purge without confirmation; pass --yes"))
+		}
+		fmt.Printf("Kill all sessions and remove all sess files in %s? [y/N] ", manager.Dir())
+		var answer string
+		fmt.Scanln(&answer)
+		if answer != "y" && answer != "Y" && answer != "yes" {
+			return fmt.Errorf("purge cancelled")
+		}
+	}
+
+	res, err := manager.Purge()
+	if res != nil {
+		for _, number := range res.Killed {
+			fmt.Printf("Killed session %s\n", number)
+		}
+		for _, path := range res.Removed {
+			fmt.Printf("Removed %s\n", path)
+		}
+		for _, name := range res.Kept {
+			fmt.Printf("Kept %s (not created by sess)\n", filepath.Join(manager.Dir(), name))
+		}
+		if err == nil && len(res.Killed)+len(res.Removed) == 0 {
+			fmt.Println("Nothing to remove")
+		}
+	}
+	return err
+}
+
+// checkNotAttached refuses to kill a session a client is attached to, as
+// its daemon reports; a daemon that cannot be asked has nobody attached.
+func checkNotAttached(manager *sess.Manager, number string) error {
+	st, err := manager.Status(number)
+	if err != nil || len(st.Clients) == 0 {
+		return nil
+	}
+	where := make([]string, len(st.Clients))
+	for i, c := range st.Clients {
+		switch {
+		case c.TTY != "":
+			where[i] = strings.TrimPrefix(c.TTY, "/dev/")
+		case c.PID != 0:
+			where[i] = fmt.Sprintf("pid %d", c.PID)
+		default:
+			where[i] = "no tty"
+		}
+		if c.Mode == sess.ModePeek {
+			where[i] += ", read-only"
+		}
+	}
+	return withExitCode(exitConflict, fmt.Errorf("session %s is currently attached (%s); use --force", number, strings.Join(where, "; ")))
+}
+
+// confirmKill asks before killing a session that is busy running a job
+// rather than sitting at its shell's prompt. Without a terminal to ask on,
+// it refuses.
+func confirmKill(manager *sess.Manager, number string) error {
+	st, err := manager.Status(number)
+	if err != nil || st.Foreground == nil {
+		return nil
+	}
+	job := fmt.Sprintf("process group %d", st.Foreground.PGID)
+	if st.Foreground.Command != "" {
+		job = "'" + truncate(st.Foreground.Command, 40) + "'"
+	}
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return withExitCode(exitConflict, fmt.Errorf("session %s is running %s; use --yes to kill it anyway", number, job))
+	}
+	fmt.Printf("session %s is running %s — kill anyway? [y/N] ", number, job)
+	var answer string
+	fmt.Scanln(&answer)
+	if answer != "y" && answer != "Y" && answer != "yes" {
+		return fmt.Errorf("session %s left running", number)
+	}
+	return nil
+}
+
+func handleKillAll(manager *sess.Manager, force, yes, includeCurrent bool) error {
+	sessions, err := manager.List()
+	if err != nil {
+		return err
+	}
+	if len(sessions) == 0 {
+		fmt.Println("No active sessions")
+		return nil
+	}
+	numbers := make([]string, len(sessions))
+	for i, s := range sessions {
+		numbers[i] = s.Number
+	}
+	var current string
+	if number, ok := manager.InSession(); ok {
+		current = manager.NormalizeNumber(number)
+	}
+	order, skipped := sess.KillOrder(numbers, current, includeCurrent)
+	if skipped {
+		fmt.Printf("Skipped current session %s (use --include-current)\n", current)
+	}
+	var attached, busy int
+	var victims []string
+	killCurrent := false
+	for _, number := range order {
+		if number == current {
+			// Killed last, alone. The client attached to it is most
+			// likely the one running this.
+			killCurrent = true
+			continue
+		}
+		if !force {
+			if err := checkNotAttached(manager, number); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				attached++
+				continue
+			}
+		}
+		if !yes {
+			if err := confirmKill(manager, number); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				busy++
+				continue
+			}
+		}
+		victims = append(victims, number)
+	}
+
+	failed := 0
+	for i, err := range manager.KillEach(victims) {
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			failed++
+			continue
+		}
+		fmt.Printf("Killed session %s\n", victims[i])
+	}
+	if killCurrent {
+		fmt.Printf("Killing current session %s\n", current)
+		if err := manager.Kill(current); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			failed++
+		} else {
+			fmt.Printf("Killed session %s\n", current)
+		}
+	}
+	switch {
+	case attached > 0 && busy > 0:
+		return withExitCode(exitConflict, fmt.Errorf("%d attached and %d busy session(s) left running; use --force and --yes to kill them too", attached, busy))
+	case attached > 0:
+		return withExitCode(exitConflict, fmt.Errorf("%d attached session(s) left running; use --force to kill them too", attached))
+	case busy > 0:
+		return withExitCode(exitConflict, fmt.Errorf("%d busy session(s) left running; use --yes to kill them too", busy))
+	case failed > 0:
+		return fmt.Errorf("%d session(s) could not be killed", failed)
+	}
+	return nil
+}
@@ -0,0 +1,668 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/theMichaelB/sess/pkg/sess"
+)
+
+// noteWidth is how much of a session's note sess ls shows.
+const noteWidth = 20
+
+// titleWidth is how much of a session's window title sess ls shows.
+const titleWidth = 30
+
+// sessionEntry is a session as reported by ls and info.
+type sessionEntry struct {
+	sess.Session
+	State      string            `json:"state"`
+	Exit       *sess.ExitInfo    `json:"exit,omitempty"`
+	Status     string            `json:"status"`
+	Clients    []sess.ClientInfo `json:"clients"`
+	LastOutput *time.Time        `json:"last_output,omitempty"`
+	LastInput  *time.Time        `json:"last_input,omitempty"`
+	LastAttach *time.Time        `json:"last_attach,omitempty"`
+	Resources  *sess.Resources   `json:"resources,omitempty"`
+	Shared     *sess.ShareStatus `json:"shared,omitempty"`
+	Throttled  bool              `json:"throttled,omitempty"`
+	Stopped    bool              `json:"stopped,omitempty"`
+	Expires    *time.Time        `json:"expires,omitempty"`
+	// OOMScoreAdj is the daemon's oom_score_adj.
+	OOMScoreAdj int `json:"oom_score_adj,omitempty"`
+	// Title is the window title the session's programs last set.
+	Title string `json:"title,omitempty"`
+}
+
+// lastIO is the most recent output or input, or the zero time if the
+// daemon reported neither.
+func (e sessionEntry) lastIO() time.Time {
+	var t time.Time
+	for _, p := range []*time.Time{e.LastOutput, e.LastInput} {
+		if p != nil && p.After(t) {
+			t = *p
+		}
+	}
+	return t
+}
+
+// activity is when the session was last used: its most recent output or
+// input, otherwise its most recent attach, otherwise its creation.
+func (e sessionEntry) activity() time.Time {
+	switch {
+	case !e.lastIO().IsZero():
+		return e.lastIO()
+	case e.LastAttach != nil:
+		return *e.LastAttach
+	default:
+		return e.CreatedAt
+	}
+}
+
+// idle formats how long the session has been quiet, or "-" if unknown.
+func (e sessionEntry) idle() string {
+	t := e.lastIO()
+	if t.IsZero() {
+		return "-"
+	}
+	return formatDuration(time.Since(t))
+}
+
+// sortEntries orders entries by the named key; number order is the default.
+func sortEntries(entries []sessionEntry, key string) error {
+	switch key {
+	case "", "number":
+		// ListSessions already returns number order.
+	case "created":
+		sort.SliceStable(entries, func(i, j int) bool {
+			return entries[i].CreatedAt.After(entries[j].CreatedAt)
+		})
+	case "activity":
+		sort.SliceStable(entries, func(i, j int) bool {
+			return entries[i].activity().After(entries[j].activity())
+		})
+	default:
+		return fmt.Errorf("unknown sort key %q (want number, created or activity)", key)
+	}
+	return nil
+}
+
+// timePtr returns nil for the zero time so JSON omits it.
+func timePtr(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// currentSession returns the session considered current: the one this
+// command runs inside, otherwise the one a client is attached to.
+func currentSession(manager *sess.Manager) string {
+	current, ok := manager.InSession()
+	if !ok {
+		current, _ = manager.Current()
+	}
+	return current
+}
+
+// newSessionEntry asks the session's daemon who is connected. If the daemon
+// can't be queried, attachment is inferred from the current-session marker.
+func newSessionEntry(manager *sess.Manager, s sess.Session, current string) sessionEntry {
+	st, err := manager.Status(s.Number)
+	if err != nil {
+		e := sessionEntry{Session: s, State: sess.StateLive, Status: "detached"}
+		if s.Number == current {
+			e.Status = "attached"
+		}
+		return e
+	}
+	return statusEntry(s, st)
+}
+
+// statusEntry describes a live session as its daemon reported it in st.
+func statusEntry(s sess.Session, st *sess.Status) sessionEntry {
+	e := sessionEntry{Session: s, State: sess.StateLive, Status: "detached"}
+	e.Clients = st.Clients
+	e.LastOutput = timePtr(st.LastOutput)
+	e.LastInput = timePtr(st.LastInput)
+	e.LastAttach = timePtr(st.LastAttach)
+	e.Shared = st.Shared
+	e.Throttled = st.Throttled
+	e.Stopped = st.Stopped
+	e.Expires = st.Expires
+	e.OOMScoreAdj = st.OOMScoreAdj
+	e.Title = st.Title
+	attached := 0
+	for _, c := range st.Clients {
+		if c.Mode == sess.ModeAttach {
+			attached++
+		}
+	}
+	switch {
+	case len(st.Clients) == 0:
+	case attached == 0:
+		e.Status = "peeked"
+	default:
+		e.Status = "attached"
+	}
+	if len(st.Clients) > 1 {
+		e.Status = fmt.Sprintf("%s (%d)", e.Status, len(st.Clients))
+	}
+	if e.Expires != nil {
+		e.Status += ", " + formatDuration(time.Until(*e.Expires)) + " left"
+	}
+	return e
+}
+
+// endedSessionEntry describes a session that is no longer running, or that
+// runs on another host.
+func endedSessionEntry(r sess.Record) sessionEntry {
+	e := sessionEntry{Session: r.Session, State: r.State, Exit: r.Exit}
+	if r.State == sess.StateRemote {
+		e.Status = "on " + r.Host
+		return e
+	}
+	if r.Exit == nil {
+		e.Status = "stale (daemon missing)"
+		return e
+	}
+	ago := formatDuration(time.Since(r.Exit.ExitedAt))
+	switch {
+	case r.Exit.Reason == "":
+		e.Status = fmt.Sprintf("exited (%s, %s ago)", exitHow(r.Exit), ago)
+	case r.Exit.Signal == "" && r.Exit.Status == -1:
+		// The daemon died too, so how the command ended is unknown.
+		e.Status = fmt.Sprintf("died (%s, %s ago)", r.Exit.Reason, ago)
+	default:
+		e.Status = fmt.Sprintf("exited (%s, %s, %s ago)", exitHow(r.Exit), r.Exit.Reason, ago)
+	}
+	return e
+}
+
+// exitHow names the signal that ended a command, or its exit status.
+func exitHow(exit *sess.ExitInfo) string {
+	if exit.Signal != "" {
+		return exit.Signal
+	}
+	return fmt.Sprintf("status %d", exit.Status)
+}
+
+// printClients prints a table of connected clients for sess info --clients.
+func printClients(clients []sess.ClientInfo) {
+	if len(clients) == 0 {
+		fmt.Println("No clients connected")
+		return
+	}
+	now := time.Now()
+	fmt.Printf("MODE    PID     TTY           CONNECTED  IDLE       IN        OUT       SOURCE\n")
+	for _, c := range clients {
+		pid := "-"
+		if c.PID != 0 {
+			pid = strconv.Itoa(c.PID)
+		}
+		tty := c.TTY
+		if tty == "" {
+			tty = "-"
+		}
+		source := "local"
+		if c.SSH != "" {
+			source = "ssh " + strings.Fields(c.SSH)[0]
+		}
+		fmt.Printf("%-7s %-7s %-13s %-10s %-10s %-9s %-9s %s\n",
+			c.Mode,
+			pid,
+			strings.TrimPrefix(tty, "/dev/"),
+			formatDuration(now.Sub(c.ConnectedAt)),
+			formatDuration(now.Sub(c.LastActivity)),
+			formatBytes(c.BytesIn),
+			formatBytes(c.BytesOut),
+			source,
+		)
+	}
+}
+
+// describeClient renders a client for sess info.
+func describeClient(c sess.ClientInfo) string {
+	tty := c.TTY
+	if tty == "" {
+		tty = "(no tty)"
+	}
+	desc := fmt.Sprintf("%-6s %s", c.Mode, tty)
+	if c.PID != 0 {
+		desc += fmt.Sprintf(" (pid %d)", c.PID)
+	}
+	if c.User != "" {
+		desc += " user " + c.User
+	}
+	if c.NoResize {
+		desc += " [no-resize]"
+	}
+	if c.Direct {
+		desc += " [direct]"
+	}
+	if c.SSH != "" {
+		// SSH_CONNECTION is "client_ip client_port server_ip server_port".
+		desc += " via ssh from " + strings.Fields(c.SSH)[0]
+	}
+	return desc
+}
+
+// quietList reports whether sess ls was given -q.
+func quietList(args []string) bool {
+	for _, arg := range args {
+		switch arg {
+		case "--":
+			return false
+		case "-q", "--q", "-quiet", "--quiet":
+			return true
+		}
+	}
+	return false
+}
+
+// handleListQuiet prints the numbers of live sessions one per line, and
+// nothing else: not even a header, or a note when there are none.
+func handleListQuiet(args []string) error {
+	fs := flag.NewFlagSet("sess ls -q", flag.ContinueOnError)
+	fs.Bool("q", false, "Print only session numbers")
+	fs.Bool("quiet", false, "Same as -q")
+	rest, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(rest) > 0 {
+		return withExitCode(exitUsage, fmt.Errorf("usage: sess ls -q"))
+	}
+	numbers, err := sess.LiveNumbers()
+	if err != nil {
+		return err
+	}
+	for _, number := range numbers {
+		fmt.Println(number)
+	}
+	return nil
+}
+
+func handleList(manager *sess.Manager, args []string) error {
+	fs := flag.NewFlagSet("sess ls", flag.ContinueOnError)
+	jsonFlag := fs.Bool("json", false, "Print as JSON")
+	sortFlag := fs.String("sort", "number", "Order by number, created or activity (most recent first)")
+	resourcesFlag := fs.Bool("resources", false, "Show CPU and memory use of each session")
+	allFlag := fs.Bool("all", false, "Also show exited and stale sessions")
+	versionsFlag := fs.Bool("versions", false, "Show the version of sess that started each session")
+	if _, err := parseArgs(fs, args); err != nil {
+		return err
+	}
+
+	// Listing never removes anything: stale sessions are only hidden
+	// unless --all, and sess clean deletes them.
+	records, err := manager.ListAll()
+	if err != nil {
+		return err
+	}
+	var sessions []sess.Session
+	var ended []sess.Record
+	hidden := 0
+	remote := map[string]int{}
+	for _, r := range records {
+		switch {
+		case r.State == sess.StateLive:
+			sessions = append(sessions, r.Session)
+		case *allFlag:
+			ended = append(ended, r)
+		case r.State == sess.StateStale:
+			hidden++
+		case r.State == sess.StateRemote:
+			remote[r.Host]++
+		}
+	}
+
+	// Determine current attachment:
+	// - If running inside a session, use SESS_NUM
+	// - Otherwise, read from the current-session file if present
+	current := currentSession(manager)
+
+	entries := make([]sessionEntry, 0, len(sessions)+len(ended))
+	for _, s := range sessions {
+		entries = append(entries, newSessionEntry(manager, s, current))
+	}
+	for _, r := range ended {
+		entries = append(entries, endedSessionEntry(r))
+	}
+	if *allFlag {
+		sort.SliceStable(entries, func(i, j int) bool {
+			return entries[i].Number < entries[j].Number
+		})
+	}
+	if err := sortEntries(entries, *sortFlag); err != nil {
+		return err
+	}
+	if *resourcesFlag {
+		// Measuring costs a sampling interval, so it is opt-in. Where it
+		// is unsupported the columns show "-".
+		usage, err := manager.Resources(sessions)
+		if err != nil && !errors.Is(err, sess.ErrUnsupported) {
+			return err
+		}
+		for i := range entries {
+			if r, ok := usage[entries[i].Number]; ok {
+				entries[i].Resources = &r
+			}
+		}
+	}
+
+	if *jsonFlag {
+		return printJSON(entries)
+	}
+
+	if len(entries) == 0 {
+		fmt.Println("No active sessions")
+		printHiddenStale(hidden)
+		printRemote(remote)
+		return nil
+	}
+
+	statusWidth := 13
+	for _, e := range entries {
+		if len(e.Status) > statusWidth {
+			statusWidth = len(e.Status)
+		}
+	}
+
+	resourceCols := func(cpu, mem string) string {
+		if !*resourcesFlag {
+			return ""
+		}
+		return fmt.Sprintf("%-6s %-9s ", cpu, mem)
+	}
+	versionWidth := len("VERSION")
+	for _, e := range entries {
+		if len(e.Version) > versionWidth {
+			versionWidth = len(e.Version)
+		}
+	}
+	versionCol := func(v string) string {
+		if !*versionsFlag {
+			return ""
+		}
+		if v == "" {
+			v = "-"
+		}
+		return fmt.Sprintf("%-*s ", versionWidth, v)
+	}
+
+	// The TITLE column only appears once a program has set a title.
+	showTitles := false
+	for _, e := range entries {
+		showTitles = showTitles || e.Title != ""
+	}
+	titleCol := func(title string) string {
+		if !showTitles {
+			return ""
+		}
+		if title == "" {
+			title = "-"
+		}
+		return fmt.Sprintf("%-*s ", titleWidth, truncate(title, titleWidth))
+	}
+
+	// The NAME column only appears once sess up has started a session.
+	nameWidth := 0
+	for _, e := range entries {
+		if e.Definition != "" {
+			nameWidth = max(nameWidth, len("NAME"), len(e.Definition))
+		}
+	}
+	nameCol := func(name string) string {
+		if nameWidth == 0 {
+			return ""
+		}
+		if name == "" {
+			name = "-"
+		}
+		return fmt.Sprintf("%-*s ", nameWidth, name)
+	}
+
+	fmt.Printf("SESSION  %-*s IDLE  CREATED              PID     %s%s%s%-*s %sCMD\n", statusWidth, "STATUS", resourceCols("CPU", "MEM"), versionCol("VERSION"), nameCol("NAME"), noteWidth, "NOTE", titleCol("TITLE"))
+	for _, e := range entries {
+		indicator := "  "
+		if e.Number == current {
+			indicator = "* "
+		}
+		note := "-"
+		if e.Note != "" {
+			note = truncate(e.Note, noteWidth)
+		}
+		cpu, mem := "-", "-"
+		if e.Resources != nil {
+			cpu = fmt.Sprintf("%.1f%%", e.Resources.CPU)
+			mem = formatBytes(e.Resources.RSS)
+		}
+		fmt.Printf("%s%3s   %-*s %-5s %-20s %-7d %s%s%s%-*s %s%s\n",
+			indicator,
+			e.Number,
+			statusWidth, e.Status,
+			e.idle(),
+			e.CreatedAt.Format("2006-01-02 15:04"),
+			e.PID,
+			resourceCols(cpu, mem),
+			versionCol(e.Version),
+			nameCol(e.Definition),
+			noteWidth, note,
+			titleCol(e.Title),
+			e.Command,
+		)
+		if e.State != sess.StateLive && e.Log != "" {
+			fmt.Printf("        log: %s\n", e.Log)
+		}
+		if e.State != sess.StateLive && e.InputLog != "" {
+			fmt.Printf("        input log: %s\n", e.InputLog)
+		}
+	}
+
+	if current != "" {
+		fmt.Printf("\n* indicates current session (%s)\n", current)
+	}
+	printHiddenStale(hidden)
+	printRemote(remote)
+	return nil
+}
+
+// printRemote notes the sessions other hosts run, counted by host, which
+// sess ls left out.
+func printRemote(remote map[string]int) {
+	hosts := make([]string, 0, len(remote))
+	for host := range remote {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	for i, host := range hosts {
+		if i == 0 {
+			fmt.Println()
+		}
+		fmt.Println(remoteSummary(host, remote[host]))
+	}
+}
+
+// remoteSummary says that n sessions run on host.
+func remoteSummary(host string, n int) string {
+	if n == 1 {
+		return fmt.Sprintf("1 session on host %s (not attachable from here)", host)
+	}
+	return fmt.Sprintf("%d sessions on host %s (not attachable from here)", n, host)
+}
+
+// printHiddenStale notes stale sessions sess ls left out.
+func printHiddenStale(hidden int) {
+	switch hidden {
+	case 0:
+	case 1:
+		fmt.Println("\n1 stale session hidden (sess ls --all shows it, sess clean removes it)")
+	default:
+		fmt.Printf("\n%d stale sessions hidden (sess ls --all shows them, sess clean removes them)\n", hidden)
+	}
+}
+
+func handleInfo(manager *sess.Manager, args []string) error {
+	fs := flag.NewFlagSet("sess info", flag.ContinueOnError)
+	jsonFlag := fs.Bool("json", false, "Print as JSON")
+	clientsFlag := fs.Bool("clients", false, "Show connected clients in detail")
+	args, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	number, err := sessionArg(manager, args)
+	if err != nil {
+		return err
+	}
+
+	s, err := manager.Get(number)
+	if err != nil {
+		if !errors.Is(err, sess.ErrSessionNotFound) && !errors.Is(err, sess.ErrSessionDead) && !errors.Is(err, sess.ErrSessionRemote) {
+			return err
+		}
+		r, rerr := manager.Record(number)
+		if rerr != nil {
+			return err
+		}
+		return printEndedInfo(endedSessionEntry(*r), *jsonFlag)
+	}
+	e := newSessionEntry(manager, *s, currentSession(manager))
+
+	if *jsonFlag {
+		if *clientsFlag {
+			return printJSON(e.Clients)
+		}
+		return printJSON(e)
+	}
+
+	if *clientsFlag {
+		printClients(e.Clients)
+		return nil
+	}
+
+	fmt.Printf("Session:  %s\n", s.Number)
+	fmt.Printf("Status:   %s\n", e.Status)
+	fmt.Printf("Idle:     %s\n", e.idle())
+	fmt.Printf("Created:  %s\n", s.CreatedAt.Format("2006-01-02 15:04:05"))
+	fmt.Printf("PID:      %d\n", s.PID)
+	if s.DaemonPID != 0 {
+		fmt.Printf("Daemon:   pid %d\n", s.DaemonPID)
+	}
+	if s.Version != "" {
+		v := s.Version
+		if v != version {
+			v += " (this is " + version + ")"
+		}
+		fmt.Printf("Version:  %s\n", v)
+	}
+	fmt.Printf("Command:  %s\n", s.Command)
+	if e.Title != "" {
+		fmt.Printf("Title:    %s\n", e.Title)
+	}
+	if cwd, err := manager.Cwd(number); err == nil {
+		fmt.Printf("Cwd:      %s\n", cwd)
+	}
+	if s.Note != "" {
+		fmt.Printf("Note:     %s\n", s.Note)
+	}
+	if s.Log != "" {
+		fmt.Printf("Log:      %s\n", s.Log)
+	}
+	if s.InputLog != "" {
+		fmt.Printf("Input log: %s\n", s.InputLog)
+	}
+	if s.DetachKey != "" {
+		fmt.Printf("Detach:   %s\n", s.DetachKey)
+	}
+	if s.Termios != "" {
+		fmt.Printf("Termios:  %s\n", s.Termios)
+	}
+	if s.Rlimits != "" {
+		fmt.Printf("Limits:   %s\n", s.Rlimits)
+	}
+	if s.EnvMode != "" {
+		fmt.Printf("Env:      %s\n", describeEnvMode(s.EnvMode))
+	}
+	if s.Definition != "" {
+		fmt.Printf("Defined:  as %s in sessions.toml\n", s.Definition)
+	}
+	if s.Respawn != "" {
+		fmt.Printf("Respawn:  %s\n", s.Respawn)
+	}
+	if s.Locked {
+		fmt.Printf("Locked:   attaches refused until sess unlock %s\n", shortNumber(s.Number))
+	}
+	if s.Transient {
+		fmt.Printf("Transient: ends when its client detaches\n")
+	}
+	if e.Throttled {
+		fmt.Printf("Output:   not read until a client attaches (--throttle-detached)\n")
+	}
+	if e.Stopped {
+		fmt.Printf("Output:   stopped by Ctrl-S; Ctrl-Q resumes it\n")
+	}
+	if e.Expires != nil {
+		fmt.Printf("Expires:  %s (in %s)\n", e.Expires.Format("2006-01-02 15:04:05"), formatDuration(time.Until(*e.Expires)))
+	}
+	if e.OOMScoreAdj < 0 {
+		fmt.Printf("OOM:      daemon protected (oom_score_adj %d)\n", e.OOMScoreAdj)
+	}
+	if e.Shared != nil {
+		fmt.Printf("Shared:   with %s via %s\n", sharedUsers(e.Shared.Users), e.Shared.Socket)
+	}
+	if len(e.Clients) > 0 {
+		fmt.Printf("Clients:\n")
+		for _, c := range e.Clients {
+			fmt.Printf("  %s\n", describeClient(c))
+		}
+	}
+	return nil
+}
+
+// printEndedInfo shows sess info for a session that is no longer running.
+func printEndedInfo(e sessionEntry, asJSON bool) error {
+	if asJSON {
+		return printJSON(e)
+	}
+	fmt.Printf("Session:  %s\n", e.Number)
+	fmt.Printf("Status:   %s\n", e.Status)
+	fmt.Printf("Created:  %s\n", e.CreatedAt.Format("2006-01-02 15:04:05"))
+	if e.Exit != nil {
+		fmt.Printf("Exited:   %s\n", e.Exit.ExitedAt.Format("2006-01-02 15:04:05"))
+		if e.Exit.Reason != "" {
+			fmt.Printf("Reason:   %s\n", e.Exit.Reason)
+		}
+	}
+	fmt.Printf("PID:      %d\n", e.PID)
+	fmt.Printf("Command:  %s\n", e.Command)
+	if e.Note != "" {
+		fmt.Printf("Note:     %s\n", e.Note)
+	}
+	if e.Log != "" {
+		fmt.Printf("Log:      %s\n", e.Log)
+	}
+	if e.InputLog != "" {
+		fmt.Printf("Input log: %s\n", e.InputLog)
+	}
+	return nil
+}
+
+// describeEnvMode says where a session's environment came from, given
+// Session.EnvMode.
+func describeEnvMode(mode string) string {
+	switch {
+	case mode == "copy":
+		return "copied from the creating shell"
+	case mode == "clean":
+		return "clean (PATH, HOME and TERM only)"
+	case strings.HasPrefix(mode, "copy:"):
+		return "copied from the creating shell: " + strings.ReplaceAll(strings.TrimPrefix(mode, "copy:"), ",", ", ") + " only"
+	}
+	return mode
+}
@@ -1,396 +1,594 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
-	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/theMichaelB/sess/pkg/sess"
 	"golang.org/x/term"
-	"github.com/theMichaelB/sess/internal/client"
-	"github.com/theMichaelB/sess/internal/daemon"
-	"github.com/theMichaelB/sess/internal/session"
-	"strconv"
 )
 
 // version follows Semantic Versioning (https://semver.org/)
 // Overridden at build time via: -ldflags "-X main.version=vX.Y.Z"
 var version = "v1.0.0"
 
-func runDaemon(number, socketPath, metaPath, shell string, rows, cols int) {
-	d := daemon.New(number, socketPath, metaPath)
-	if err := d.Start(shell, rows, cols); err != nil {
-		// Surface daemon startup errors to help diagnose issues during attach
-		fmt.Fprintf(os.Stderr, "daemon failed to start: %v\n", err)
-		os.Exit(1)
-	}
-}
-
 func main() {
+	// Sessions record the build that started them, and attaching warns
+	// when that is not this one.
+	sess.Version = version
+
 	// Check for daemon mode first
-	if len(os.Args) >= 6 && os.Args[1] == "--daemon" {
-		rows, cols := 0, 0
-		if len(os.Args) >= 8 {
-			if v, err := strconv.Atoi(os.Args[6]); err == nil {
-				rows = v
-			}
-			if v, err := strconv.Atoi(os.Args[7]); err == nil {
-				cols = v
-			}
+	if sess.IsDaemonInvocation(os.Args[1:]) {
+		if err := sess.RunDaemon(os.Args[1:]); err != nil {
+			// Surface daemon startup errors to help diagnose issues during attach
+			fmt.Fprintf(os.Stderr, "daemon failed to start: %v\n", err)
+			os.Exit(1)
 		}
-		runDaemon(os.Args[2], os.Args[3], os.Args[4], os.Args[5], rows, cols)
 		return
 	}
 
+	if err := run(); err != nil {
+		code, hint := classifyError(err)
+		if !attachEnded(err) {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		}
+		if hint != "" {
+			fmt.Fprintf(os.Stderr, "%s\n", hint)
+		}
+		os.Exit(code)
+	}
+}
+
+// attachEnded reports whether err is how an attachment ended, which the
+// client has already told the user.
+func attachEnded(err error) bool {
+	var ended *sess.ExitError
+	return errors.As(err, &ended) || errors.Is(err, sess.ErrConnectionLost)
+}
+
+// Exit statuses. Errors not given one with withExitCode get one of these
+// from classifyError.
+const (
+	exitFailure     = 1 // anything else
+	exitNotFound    = 2 // no such session (shared with usage errors)
+	exitUsage       = 2 // the command line is wrong
+	exitUnavailable = 3 // the session exists but cannot tell what was asked
+	exitConflict    = 4 // the session exists, is busy, or is the current one
+	exitNoDaemon    = 5 // the session's daemon could not be reached
+)
+
+// classifyError picks the exit status for err and a hint for the user.
+func classifyError(err error) (int, string) {
+	var ee *exitError
+	if errors.As(err, &ee) {
+		return ee.code, ""
+	}
+	var ended *sess.ExitError
+	if errors.As(err, &ended) {
+		// Exit as the session's command did, like ssh.
+		return ended.Code(), ""
+	}
+	switch {
+	case errors.Is(err, sess.ErrSessionDead):
+		return exitNotFound, "Run 'sess clean' to forget it, or 'sess ls' to see the running sessions."
+	case errors.Is(err, sess.ErrSessionNotFound):
+		return exitNotFound, "Run 'sess ls' to see the running sessions."
+	case errors.Is(err, sess.ErrSessionBusy):
+		return exitConflict, "Attach read-only with -r, or detach the other client with 'sess -x'."
+	case errors.Is(err, sess.ErrSessionLocked):
+		return exitConflict, ""
+	case errors.Is(err, sess.ErrNoRawMode):
+		return exitFailure, "Attach with --cooked to use the terminal in line mode, or --no-input to only watch."
+	case errors.Is(err, sess.ErrSessionExists), errors.Is(err, sess.ErrAlreadyAttached), errors.Is(err, sess.ErrInSession):
+		return exitConflict, ""
+	case errors.Is(err, sess.ErrSessionRemote):
+		return exitNoDaemon, "Run sess on that host to reach it."
+	case errors.Is(err, sess.ErrSessionStale), errors.Is(err, sess.ErrConnectionFailed), errors.Is(err, sess.ErrConnectionLost), errors.Is(err, sess.ErrTimeout):
+		return exitNoDaemon, ""
+	}
+	return exitFailure, ""
+}
+
+// exitError carries a specific process exit status for an error.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string { return e.err.Error() }
+
+func (e *exitError) Unwrap() error { return e.err }
+
+func withExitCode(code int, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &exitError{code: code, err: err}
+}
+
+func run() error {
 	var (
-		attachFlag       = flag.String("a", "", "Attach to session by number")
-		attachCreateFlag = flag.String("A", "", "Attach to session or create if not exists")
-		detachFlag       = flag.Bool("x", false, "Detach from current session")
-		killFlag         = flag.String("k", "", "Kill session (current if no number given)")
-		killAllFlag      = flag.Bool("K", false, "Kill all sessions")
-		disableCtrlXFlag = flag.Bool("C", false, "Disable Ctrl-X to detach")
-		disableCtrlXLong = flag.Bool("no-ctrlx", false, "Disable Ctrl-X to detach")
-		versionFlag      = flag.Bool("v", false, "Show version")
-		versionLongFlag  = flag.Bool("version", false, "Show version")
-		helpFlag         = flag.Bool("h", false, "Show help")
-		longHelpFlag     = flag.Bool("help", false, "Show help")
+		attachFlag        = flag.String("a", "", "Attach to session by number, or to a shared session by socket path")
+		attachCreateFlag  = flag.String("A", "", "Attach to session or create if not exists")
+		detachFlag        = flag.Bool("x", false, "Detach from current session")
+		killFlag          = flag.String("k", "", "Kill session (current if no number given)")
+		killAllFlag       = flag.Bool("K", false, "Kill all sessions")
+		includeCurFlag    = flag.Bool("include-current", false, "With -K, also kill the session this runs inside, last")
+		disableCtrlXFlag  = flag.Bool("C", false, "Disable Ctrl-X to detach")
+		disableCtrlXLong  = flag.Bool("no-ctrlx", false, "Disable Ctrl-X to detach")
+		detachKeyFlag     = flag.String("detach-key", "", "Detach key, e.g. C-] or 'C-a d'")
+		keyTimeoutFlag    = flag.Duration("key-timeout", 0, "How long a detach-key prefix waits for its action key")
+		execFlag          = flag.String("exec", "", "Keys to type into the session right after attaching")
+		transientFlag     = flag.Bool("transient", false, "Kill the new session when this client detaches or exits")
+		throttleFlag      = flag.Bool("throttle-detached", false, "Stop reading the new session's output while nobody sees or keeps it")
+		timeoutFlag       = flag.Duration("timeout", 0, "End the new session after this long, e.g. 2h")
+		copyEnvFlag       = flag.Bool("copy-env", false, "Start the new session's command with this shell's environment as it is now")
+		copyEnvOnlyFlag   = flag.String("copy-env-only", "", "Start the new session's command with only these variables of this shell's environment, e.g. PATH,HOME")
+		cleanEnvFlag      = flag.Bool("clean-env", false, "Start the new session's command with only PATH, HOME and TERM")
+		noOOMProtectFlag  = flag.Bool("no-oom-protect", false, "Leave the new session's daemon as likely as its command to be picked by the OOM killer")
+		logFlag           = flag.Bool("log", false, "Record the new session's output to a log kept after it ends")
+		logInputFlag      = flag.Bool("log-input", false, "Record what is typed into the new session, for auditing")
+		recordScriptFlag  = flag.String("record-script", "", "Record the new session's output to this file as script(1) does")
+		recordTimingFlag  = flag.String("record-timing", "", "Record the timing scriptreplay(1) needs for --record-script")
+		termiosFlag       = flag.String("termios", "", "Terminal settings for the new session, e.g. ixon=off,erase=^?")
+		forceNestedFlag   = flag.Bool("force-nested", false, "Allow creating a session from inside another")
+		noResizeFlag      = flag.Bool("no-resize", false, "Leave the session at its current size")
+		noRedrawFlag      = flag.Bool("no-redraw", false, "Don't make the session repaint after attaching")
+		redrawCtrlLFlag   = flag.Bool("redraw-ctrl-l", false, "Also send Ctrl-L to full-screen programs when attaching")
+		detachOnEOFFlag   = flag.Bool("detach-on-eof", false, "Detach when stdin reaches end of file (the default when it is not a terminal)")
+		noScreenResetFlag = flag.Bool("no-screen-reset", false, "Leave the screen as the session left it when it ends or is lost")
+		noAltScreenFlag   = flag.Bool("no-alt-screen", false, "Stay on the current screen when attaching to or detaching from a full-screen program")
+		noInputFlag       = flag.Bool("no-input", false, "Attach output-only, without reading stdin")
+		directFlag        = flag.Bool("direct", false, "Use the session's terminal directly rather than through its daemon")
+		rawFlag           = flag.Bool("raw", false, "Attach as a plain byte pipe for programs such as expect")
+		cookedFlag        = flag.Bool("cooked", false, "Attach in line mode, for terminals that cannot enter raw mode")
+		dropOutputFlag    = flag.Int("drop-output", 0, "Skip output once more than this many KB of it wait for a slow terminal")
+		predictFlag       = flag.Bool("predict", false, "Show keystrokes before the session echoes them, for slow links")
+		predictAfterFlag  = flag.Duration("predict-after", 0, "Show keystrokes before their echo once echoes take this long, e.g. 200ms")
+		sizeFlag          = flag.String("size", "", "Size the session to ROWSxCOLS instead of this terminal")
+		durationFlag      = flag.Duration("duration", 0, "Detach after this long")
+		teeFlag           = flag.String("tee", "", "Also copy session output to this file while attached")
+		teeAppendFlag     = flag.Bool("tee-append", false, "Append to the --tee file instead of truncating it")
+		teeTimestampsFlag = flag.Bool("tee-timestamps", false, "Start each line of the --tee file with when it arrived")
+		forceFlag         = flag.Bool("force", false, "Attach to a locked session, or kill attached ones")
+		yesFlag           = flag.Bool("yes", false, "Kill sessions running a job without asking")
+		readOnlyFlag      = flag.Bool("r", false, "Attach read-only")
+		readOnlyLong      = flag.Bool("read-only", false, "Attach read-only")
+		userFlag          = flag.String("user", "", "As root, act as this user on their sessions")
+		versionFlag       = flag.Bool("v", false, "Show version")
+		versionLongFlag   = flag.Bool("version", false, "Show version")
+		helpFlag          = flag.Bool("h", false, "Show help")
+		longHelpFlag      = flag.Bool("help", false, "Show help")
 	)
+	var rlimitFlags stringList
+	flag.Var(&rlimitFlags, "rlimit", "Resource limit for the new session's command, e.g. nofile=4096 (repeatable)")
 
 	flag.Usage = showUsage
 	flag.Parse()
 
 	if *versionFlag || *versionLongFlag {
 		fmt.Printf("sess %s\n", version)
-		return
+		return nil
 	}
 
 	if *helpFlag || *longHelpFlag {
 		showUsage()
-		return
+		return nil
+	}
+
+	if *userFlag != "" {
+		return becomeUser(*userFlag, len(os.Args)-1-flag.NArg())
+	}
+
+	// sess ls -q is run by shell completion and prompts, so it skips
+	// setting up the manager, which takes the lock and tidies up.
+	if args := flag.Args(); len(args) > 0 && args[0] == "ls" && quietList(args[1:]) {
+		return handleListQuiet(args[1:])
 	}
 
-	manager, err := session.NewManager()
+	manager, err := sess.NewManager()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(1)
+		return err
 	}
+	warnSudo()
 
 	args := flag.Args()
+	command := commandArgs()
+	if command != nil {
+		if *attachFlag != "" || *detachFlag || *killAllFlag || *killFlag != "" {
+			return withExitCode(exitUsage, fmt.Errorf("a command after -- can only be given when creating a session"))
+		}
+		if len(command) == 0 {
+			return withExitCode(exitUsage, fmt.Errorf("no command given after --"))
+		}
+		// The command is not a subcommand, however it is spelled.
+		args = nil
+	}
+	create := sess.CreateOptions{
+		Command:          command,
+		Transient:        *transientFlag,
+		ThrottleDetached: *throttleFlag,
+		Timeout:          *timeoutFlag,
+		Log:              *logFlag,
+		LogInput:         *logInputFlag,
+		RecordScript:     *recordScriptFlag,
+		RecordTiming:     *recordTimingFlag,
+		Termios:          *termiosFlag,
+		Rlimits:          rlimitFlags,
+		NoOOMProtect:     *noOOMProtectFlag,
+		CopyEnv:          *copyEnvFlag,
+		CopyEnvOnly:      strings.FieldsFunc(*copyEnvOnlyFlag, func(r rune) bool { return r == ',' || r == ' ' }),
+		CleanEnv:         *cleanEnvFlag,
+	}
+	if *cleanEnvFlag && (*copyEnvFlag || *copyEnvOnlyFlag != "") {
+		return withExitCode(exitUsage, fmt.Errorf("--clean-env cannot be used with --copy-env or --copy-env-only"))
+	}
+	if create.RecordTiming != "" && create.RecordScript == "" {
+		return withExitCode(exitUsage, fmt.Errorf("--record-timing needs --record-script"))
+	}
+	if *timeoutFlag < 0 {
+		return withExitCode(exitUsage, fmt.Errorf("--timeout takes a duration, e.g. 2h, or 0 for none"))
+	}
+
+	attachOpts := sess.AttachOptions{
+		DisableCtrlX:  *disableCtrlXFlag || *disableCtrlXLong,
+		DetachKey:     *detachKeyFlag,
+		KeyTimeout:    *keyTimeoutFlag,
+		NoResize:      *noResizeFlag,
+		NoRedraw:      *noRedrawFlag,
+		RedrawCtrlL:   *redrawCtrlLFlag,
+		DetachOnEOF:   *detachOnEOFFlag || !term.IsTerminal(int(os.Stdin.Fd())),
+		NoInput:       *noInputFlag || !stdinHasInput(),
+		Duration:      *durationFlag,
+		NoScreenReset: *noScreenResetFlag,
+		NoAltScreen:   *noAltScreenFlag,
+		ReadOnly:      *readOnlyFlag || *readOnlyLong,
+		Force:         *forceFlag,
+		Direct:        *directFlag,
+		Raw:           *rawFlag,
+		Cooked:        *cookedFlag,
+		DropOutput:    *dropOutputFlag << 10,
+		Predict:       *predictFlag,
+		PredictAfter:  *predictAfterFlag,
+	}
+	if *predictAfterFlag < 0 {
+		return withExitCode(exitUsage, fmt.Errorf("--predict-after takes a duration, e.g. 200ms"))
+	}
+	if (*predictFlag || *predictAfterFlag > 0) && (*dropOutputFlag != 0 || *cookedFlag) {
+		return withExitCode(exitUsage, fmt.Errorf("--predict and --predict-after cannot be used with --drop-output or --cooked"))
+	}
+	if *dropOutputFlag < 0 {
+		return withExitCode(exitUsage, fmt.Errorf("--drop-output takes a size in KB, e.g. 16"))
+	}
+	if attachOpts.Raw && attachOpts.Cooked {
+		return withExitCode(exitUsage, fmt.Errorf("--raw and --cooked cannot be used together"))
+	}
+	if attachOpts.Raw {
+		// A raw attach is driven by a program, so stdin is read unless
+		// it asks otherwise.
+		attachOpts.NoInput = *noInputFlag
+		if *attachFlag == "" {
+			return withExitCode(exitUsage, fmt.Errorf("--raw can only be used with -a <num>"))
+		}
+		if *execFlag != "" || *teeFlag != "" || *directFlag || attachOpts.ReadOnly || *dropOutputFlag != 0 {
+			return withExitCode(exitUsage, fmt.Errorf("--raw cannot be used with --exec, --tee, --direct, --read-only or --drop-output"))
+		}
+	}
+	if *sizeFlag != "" {
+		rows, cols, err := parseSize(*sizeFlag)
+		if err != nil {
+			return withExitCode(exitUsage, err)
+		}
+		if attachOpts.NoResize || attachOpts.ReadOnly {
+			return withExitCode(exitUsage, fmt.Errorf("--size cannot be used with --no-resize or --read-only, which leave the session's size alone"))
+		}
+		attachOpts.Size = func() (int, int, error) { return rows, cols, nil }
+	}
+	if *teeFlag != "" {
+		mode := os.O_TRUNC
+		if *teeAppendFlag {
+			mode = os.O_APPEND
+		}
+		f, err := os.OpenFile(*teeFlag, os.O_WRONLY|os.O_CREATE|mode, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		attachOpts.Tee = f
+		attachOpts.TeeTimestamps = *teeTimestampsFlag
+	} else if *teeAppendFlag || *teeTimestampsFlag {
+		return withExitCode(exitUsage, fmt.Errorf("--tee-append and --tee-timestamps need --tee FILE"))
+	}
 
-	disableCtrlX := (*disableCtrlXFlag || *disableCtrlXLong)
+	if attachOpts.ReadOnly && *attachFlag == "" {
+		return fmt.Errorf("--read-only can only be used with -a <num>")
+	}
+	if *execFlag != "" {
+		if attachOpts.ReadOnly {
+			return withExitCode(exitUsage, fmt.Errorf("--exec cannot be used with --read-only"))
+		}
+		exec, err := sess.TranslateKeys([]string{*execFlag})
+		if err != nil {
+			return withExitCode(exitUsage, err)
+		}
+		attachOpts.Exec = exec
+	}
 
 	switch {
 	case *attachFlag != "":
-		handleAttach(manager, *attachFlag, disableCtrlX)
+		return handleAttach(manager, *attachFlag, attachOpts)
 	case *attachCreateFlag != "":
-		handleAttachCreate(manager, *attachCreateFlag, disableCtrlX)
+		return handleAttachCreate(manager, *attachCreateFlag, create, attachOpts, *forceNestedFlag)
 	case *detachFlag:
-		handleDetach(manager)
+		return handleDetach(manager)
 	case *killAllFlag:
-		handleKillAll(manager)
+		return handleKillAll(manager, *forceFlag, *yesFlag, *includeCurFlag)
 	case flag.NFlag() > 0 && (flag.Arg(0) == "-k" || *killFlag != ""):
-		handleKill(manager, *killFlag)
+		return handleKill(manager, *killFlag, *forceFlag, *yesFlag)
+	case len(args) > 0 && (args[0] == "last" || args[0] == "-"):
+		return handleLast(manager, attachOpts, *forceNestedFlag)
 	case len(args) > 0 && args[0] == "ls":
-		handleList(manager)
+		return handleList(manager, args[1:])
+	case len(args) > 0 && args[0] == "info":
+		return handleInfo(manager, args[1:])
+	case len(args) > 0 && args[0] == "monitor":
+		return handleMonitor(manager, attachOpts, args[1:])
+	case len(args) > 0 && args[0] == "stats":
+		return handleStats(manager, args[1:])
+	case len(args) > 0 && args[0] == "debug":
+		return handleDebug(manager, args[1:])
+	case len(args) > 0 && args[0] == "doctor":
+		return handleDoctor(manager, args[1:])
+	case len(args) > 0 && args[0] == "bench":
+		return handleBench(manager, args[1:])
+	case len(args) > 0 && args[0] == "metrics":
+		return handleMetrics(manager, args[1:])
+	case len(args) > 0 && args[0] == "clean":
+		return handleClean(manager, args[1:])
+	case len(args) > 0 && args[0] == "purge":
+		return handlePurge(manager, args[1:])
+	case len(args) > 0 && args[0] == "set":
+		return handleSet(manager, args[1:])
+	case len(args) > 0 && args[0] == "note":
+		return handleNote(manager, args[1:])
+	case len(args) > 0 && (args[0] == "lock" || args[0] == "unlock"):
+		return handleLock(manager, args[0] == "lock", args[1:])
+	case len(args) > 0 && args[0] == "send":
+		return handleSend(manager, args[1:])
+	case len(args) > 0 && args[0] == "broadcast":
+		return handleBroadcast(manager, args[1:])
+	case len(args) > 0 && args[0] == "signal":
+		return handleSignal(manager, args[1:])
+	case len(args) > 0 && args[0] == "setenv":
+		return handleSetenv(manager, args[1:])
+	case len(args) > 0 && args[0] == "trigger":
+		return handleTrigger(manager, args[1:])
+	case len(args) > 0 && args[0] == "watch":
+		return handleWatch(manager, args[1:])
+	case len(args) > 0 && args[0] == "save":
+		return handleSave(manager, args[1:])
+	case len(args) > 0 && args[0] == "share":
+		return handleShare(manager, args[1:])
+	case len(args) > 0 && args[0] == "unshare":
+		return handleUnshare(manager, args[1:])
+	case len(args) > 0 && args[0] == "upgrade":
+		return handleUpgrade(manager, args[1:])
+	case len(args) > 0 && args[0] == "new":
+		return handleNew(manager, create, attachOpts, args[1:])
+	case len(args) > 0 && args[0] == "up":
+		return handleUp(manager, create, args[1:])
+	case len(args) > 0 && args[0] == "down":
+		return handleDown(manager, args[1:])
+	case len(args) > 0 && args[0] == "restore":
+		return handleRestore(manager, args[1:])
+	case len(args) > 0 && args[0] == "foreach":
+		return handleForeach(manager, args[1:])
+	case len(args) > 0 && args[0] == "cwd":
+		return handleCwd(manager, args[1:])
+	case len(args) > 0 && args[0] == "env":
+		return handleEnv(manager, args[1:])
 	default:
-		handleCreate(manager, disableCtrlX)
+		return handleCreate(manager, create, attachOpts, *forceNestedFlag)
 	}
 }
 
-func showUsage() {
-	fmt.Printf(`sess %s - minimal session persistence tool
-
-Usage:
-  sess              Create new session
-  sess ls           List all sessions
-  sess -a <num>     Attach to session
-  sess -A <num>     Attach or create session
-  sess -x           Detach from current session
-  sess -C           Disable Ctrl-X detach (for this attach)
-  sess --no-ctrlx   Same as -C
-  sess -K           Kill all sessions
-  sess -k [num]     Kill session (current if no number)
-  sess -v, --version Show version
-  sess -h, --help   Show this help
-
-Sessions are numbered sequentially (001, 002, etc).
-You can use either 1 or 001 format for session numbers.
-
-Flags:
-  -a <num>           Attach to session
-  -A <num>           Attach or create session
-  -x                 Detach from current session
-  -C, --no-ctrlx     Disable Ctrl-X detach for this attach
-  -k [num]           Kill session by number (or current)
-  -K                 Kill all sessions
-  -v, --version      Show version
-  -h, --help         Show help
-`, version)
-}
-
-func handleCreate(manager *session.Manager, disableCtrlX bool) {
-	if manager.IsInSession() {
-		fmt.Fprintf(os.Stderr, "Error: Cannot create session from within existing session %s\n", manager.CurrentSessionNumber())
-		os.Exit(1)
+// becomeUser runs this command again as user name, with their groups and
+// home directory, so it works on their sessions and whatever it creates is
+// theirs. Only root may. The first nflags arguments are the global flags,
+// from which --user is dropped.
+func becomeUser(name string, nflags int) error {
+	if os.Geteuid() != 0 {
+		return withExitCode(exitUsage, fmt.Errorf("--user can only be used by root"))
 	}
-
-	number, err := manager.NextSessionNumber()
+	u, err := user.Lookup(name)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(1)
+		return withExitCode(exitUsage, fmt.Errorf("unknown user %s", name))
 	}
-
-	socketPath := manager.GetSocketPath(number)
-	metaPath := manager.GetMetaPath(number)
-
-	shell := os.Getenv("SHELL")
-	if shell == "" {
-		shell = "/bin/sh"
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return fmt.Errorf("user %s has no numeric UID", name)
 	}
-
-	// Determine initial terminal size to pass to daemon
-	initRows, initCols := 0, 0
-	if term.IsTerminal(int(os.Stdin.Fd())) {
-		if w, h, err := term.GetSize(int(os.Stdin.Fd())); err == nil {
-			initRows, initCols = h, w
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return fmt.Errorf("user %s has no numeric GID", name)
+	}
+	groups := []int{gid}
+	if ids, err := u.GroupIds(); err == nil {
+		for _, id := range ids {
+			if g, err := strconv.Atoi(id); err == nil && g != gid {
+				groups = append(groups, g)
+			}
 		}
 	}
-	// Fork daemon process (pass initial rows/cols)
-	cmd := exec.Command(os.Args[0], "--daemon", number, socketPath, metaPath, shell, fmt.Sprint(initRows), fmt.Sprint(initCols))
-	cmd.SysProcAttr = &syscall.SysProcAttr{
-		Setsid: true,
+	exe, err := os.Executable()
+	if err != nil {
+		return err
 	}
 
-	if err := cmd.Start(); err != nil {
-		fmt.Fprintf(os.Stderr, "Error: Failed to fork daemon: %v\n", err)
-		os.Exit(1)
+	var args []string
+	for i := 1; i < len(os.Args); i++ {
+		a := os.Args[i]
+		if i <= nflags {
+			if a == "-user" || a == "--user" {
+				i++
+				continue
+			}
+			if strings.HasPrefix(a, "-user=") || strings.HasPrefix(a, "--user=") {
+				continue
+			}
+		}
+		args = append(args, a)
 	}
 
-	// Wait for daemon to be ready
-	for i := 0; i < 20; i++ {
-		if _, err := os.Stat(socketPath); err == nil {
-			break
+	env := []string{"HOME=" + u.HomeDir, "USER=" + u.Username, "LOGNAME=" + u.Username}
+	for _, kv := range os.Environ() {
+		key, _, _ := strings.Cut(kv, "=")
+		switch {
+		case key == "HOME", key == "USER", key == "LOGNAME", key == "MAIL",
+			strings.HasPrefix(key, "XDG_"), strings.HasPrefix(key, "SUDO_"):
+			continue
 		}
-		time.Sleep(100 * time.Millisecond)
+		env = append(env, kv)
 	}
 
-	if err := manager.SetCurrentSession(number); err != nil {
-		fmt.Fprintf(os.Stderr, "Error: Failed to set current session: %v\n", err)
-		os.Exit(1)
+	if err := syscall.Setgroups(groups); err != nil {
+		return fmt.Errorf("setgroups: %w", err)
 	}
-
-	fmt.Printf("Created session %s at %s\n", number, time.Now().Format("2006-01-02 15:04"))
-
-	c := client.New(number, socketPath, disableCtrlX)
-	if err := c.Attach(); err != nil {
-		fmt.Fprintf(os.Stderr, "Error: Failed to attach to new session: %v\n", err)
-		manager.ClearCurrentSession()
-		os.Exit(1)
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("setgid: %w", err)
 	}
-
-	manager.ClearCurrentSession()
-}
-
-func handleList(manager *session.Manager) {
-	sessions, err := manager.ListSessions()
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(1)
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("setuid: %w", err)
 	}
+	return syscall.Exec(exe, append([]string{os.Args[0]}, args...), env)
+}
 
-	if len(sessions) == 0 {
-		fmt.Println("No active sessions")
+// warnSudo points out that sess run through sudo works on root's sessions,
+// not on those of the user who ran sudo, when that user has some.
+func warnSudo() {
+	name := os.Getenv("SUDO_USER")
+	if os.Geteuid() != 0 || name == "" || name == "root" {
 		return
 	}
-
-	// Determine current attachment:
-	// - If running inside a session, use SESS_NUM
-	// - Otherwise, read from the current-session file if present
-	current := ""
-	if manager.IsInSession() {
-		current = manager.CurrentSessionNumber()
-	} else if num, _ := manager.GetCurrentSession(); num != "" {
-		current = num
+	u, err := user.Lookup(name)
+	if err != nil {
+		return
 	}
-
-	fmt.Printf("SESSION  STATUS    CREATED              PID     CMD\n")
-	for _, sess := range sessions {
-		status := "detached"
-		indicator := "  "
-		if sess.Number == current {
-			status = "attached"
-			indicator = "* "
-		}
-		fmt.Printf("%s%3s   %-9s %-20s %-7d %s\n",
-			indicator,
-			sess.Number,
-			status,
-			sess.CreatedAt.Format("2006-01-02 15:04"),
-			sess.PID,
-			sess.Command,
-		)
+	if _, err := os.Stat(filepath.Join(u.HomeDir, ".sess")); err != nil {
+		return
 	}
+	fmt.Fprintf(os.Stderr, "Note: sess is running as root and sees root's sessions; for %s's, use 'sudo sess --user %s ...'\n", name, name)
+}
 
-	if current != "" {
-		fmt.Printf("\n* indicates current session (%s)\n", current)
+// formatDuration renders d compactly using its largest unit: 5s, 3m, 2h, 4d.
+func formatDuration(d time.Duration) string {
+	switch {
+	case d < time.Minute:
+		return fmt.Sprintf("%ds", int(d.Seconds()))
+	case d < time.Hour:
+		return fmt.Sprintf("%dm", int(d.Minutes()))
+	case d < 24*time.Hour:
+		return fmt.Sprintf("%dh", int(d.Hours()))
+	default:
+		return fmt.Sprintf("%dd", int(d.Hours()/24))
 	}
 }
 
-func handleAttach(manager *session.Manager, number string, disableCtrlX bool) {
-	number = manager.NormalizeSessionNumber(number)
-
-	if manager.IsInSession() && manager.CurrentSessionNumber() == number {
-		fmt.Fprintf(os.Stderr, "Error: Already attached to session %s\n", number)
-		os.Exit(1)
+// formatBytes renders n with a binary unit suffix.
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
 	}
-
-	sess, err := manager.GetSession(number)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(1)
+	div, exp := uint64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
 	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
 
-	socketPath := manager.GetSocketPath(number)
-
-	if err := manager.SetCurrentSession(number); err != nil {
-		fmt.Fprintf(os.Stderr, "Error: Failed to set current session: %v\n", err)
-		os.Exit(1)
+// truncate shortens s to at most width runes, marking the cut with "…".
+func truncate(s string, width int) string {
+	r := []rune(s)
+	if len(r) <= width {
+		return s
 	}
+	return string(r[:width-1]) + "…"
+}
 
-	c := client.New(sess.Number, socketPath, disableCtrlX)
-	if err := c.Attach(); err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		manager.ClearCurrentSession()
-		os.Exit(1)
+// plural counts n of noun, as "1 session" or "3 processes".
+func plural(n int, noun string) string {
+	switch {
+	case n == 1:
+		return "1 " + noun
+	case strings.HasSuffix(noun, "s"):
+		return fmt.Sprintf("%d %ses", n, noun)
+	default:
+		return fmt.Sprintf("%d %ss", n, noun)
 	}
-
-	manager.ClearCurrentSession()
 }
 
-func handleAttachCreate(manager *session.Manager, number string, disableCtrlX bool) {
-	number = manager.NormalizeSessionNumber(number)
-
-	if manager.IsInSession() {
-		fmt.Fprintf(os.Stderr, "Error: Cannot create session from within existing session %s\n", manager.CurrentSessionNumber())
-		os.Exit(1)
-	}
-
-	if _, err := manager.GetSession(number); err == nil {
-		handleAttach(manager, number, disableCtrlX)
-		return
+// shortNumber is a session number as it is usually typed: 003 is 3.
+func shortNumber(number string) string {
+	if short := strings.TrimLeft(number, "0"); short != "" {
+		return short
 	}
+	return number
+}
 
-	socketPath := manager.GetSocketPath(number)
-	metaPath := manager.GetMetaPath(number)
+// stringList is a flag that may be repeated.
+type stringList []string
 
-	shell := os.Getenv("SHELL")
-	if shell == "" {
-		shell = "/bin/sh"
-	}
+func (l *stringList) String() string     { return strings.Join(*l, ",") }
+func (l *stringList) Set(s string) error { *l = append(*l, s); return nil }
 
-	// Determine initial terminal size to pass to daemon
-	initRows, initCols := 0, 0
-	if term.IsTerminal(int(os.Stdin.Fd())) {
-		if w, h, err := term.GetSize(int(os.Stdin.Fd())); err == nil {
-			initRows, initCols = h, w
+// parseArgs parses fs from args, allowing flags to follow positional
+// arguments, and returns the positional arguments. Everything after "--" is
+// positional.
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
 		}
-	}
-	// Fork daemon process (pass initial rows/cols)
-	cmd := exec.Command(os.Args[0], "--daemon", number, socketPath, metaPath, shell, fmt.Sprint(initRows), fmt.Sprint(initCols))
-	cmd.SysProcAttr = &syscall.SysProcAttr{
-		Setsid: true,
-	}
-
-	if err := cmd.Start(); err != nil {
-		fmt.Fprintf(os.Stderr, "Error: Failed to fork daemon: %v\n", err)
-		os.Exit(1)
-	}
-
-	// Wait for daemon to be ready
-	for i := 0; i < 20; i++ {
-		if _, err := os.Stat(socketPath); err == nil {
-			break
+		rest := fs.Args()
+		consumed := len(args) - len(rest)
+		if consumed > 0 && args[consumed-1] == "--" {
+			return append(positional, rest...), nil
 		}
-		time.Sleep(100 * time.Millisecond)
-	}
-
-	// Do not write metadata here; the daemon writes authoritative metadata
-	// once the PTY and child shell are started.
-
-	if err := manager.SetCurrentSession(number); err != nil {
-		fmt.Fprintf(os.Stderr, "Error: Failed to set current session: %v\n", err)
-		os.Exit(1)
-	}
-
-	fmt.Printf("Created session %s at %s\n", number, time.Now().Format("2006-01-02 15:04"))
-
-	c := client.New(number, socketPath, disableCtrlX)
-	if err := c.Attach(); err != nil {
-		fmt.Fprintf(os.Stderr, "Error: Failed to attach to new session: %v\n", err)
-		manager.ClearCurrentSession()
-		os.Exit(1)
-	}
-
-	manager.ClearCurrentSession()
-}
-
-func handleDetach(manager *session.Manager) {
-	// Detach the active client by signaling the client PID recorded
-	// in the current-session file, regardless of where this command runs.
-	info, err := manager.GetCurrentSessionInfo()
-	if err != nil || info == nil || info.Number == "" || info.PID == 0 {
-		fmt.Fprintf(os.Stderr, "Error: Not attached to any session\n")
-		os.Exit(1)
-	}
-	if err := syscall.Kill(info.PID, syscall.SIGUSR1); err != nil {
-		if err == syscall.ESRCH {
-			// Stale marker; clear and report
-			_ = manager.ClearCurrentSession()
-			fmt.Fprintf(os.Stderr, "Error: Not attached to any session\n")
-			os.Exit(1)
+		if len(rest) == 0 {
+			return positional, nil
 		}
-		fmt.Fprintf(os.Stderr, "Error: Failed to detach: %v\n", err)
-		os.Exit(1)
+		positional = append(positional, rest[0])
+		args = rest[1:]
 	}
 }
 
-func handleKill(manager *session.Manager, number string) {
-	if number == "" {
-		if !manager.IsInSession() {
-			fmt.Fprintf(os.Stderr, "Error: Not attached to any session\n")
-			os.Exit(1)
-		}
-		number = manager.CurrentSessionNumber()
-	} else {
-		number = manager.NormalizeSessionNumber(number)
+// sessionArg returns the session named by the first positional argument, or
+// the session this command runs inside when there is none.
+func sessionArg(manager *sess.Manager, args []string) (string, error) {
+	if len(args) > 0 {
+		return manager.NormalizeNumber(args[0]), nil
 	}
-
-	if err := manager.KillSession(number); err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(1)
+	cur, ok := manager.InSession()
+	if !ok {
+		return "", withExitCode(exitUsage, fmt.Errorf("Not inside a session; give a session number"))
 	}
-
-	fmt.Printf("Killed session %s\n", number)
+	return cur, nil
 }
 
-func handleKillAll(manager *session.Manager) {
-	sessions, err := manager.ListSessions()
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(1)
-	}
-	if len(sessions) == 0 {
-		fmt.Println("No active sessions")
-		return
-	}
-	for _, s := range sessions {
-		if err := manager.KillSession(s.Number); err != nil {
-			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-			// continue with others
-			continue
-		}
-		fmt.Printf("Killed session %s\n", s.Number)
-	}
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
 }
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/theMichaelB/sess/pkg/sess"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		code int
+	}{
+		{"not found", fmt.Errorf("%w: 004", sess.ErrSessionNotFound), exitNotFound},
+		{"not found, wrapped twice", fmt.Errorf("kill: %w", fmt.Errorf("%w: 004", sess.ErrSessionNotFound)), exitNotFound},
+		{"dead", fmt.Errorf("attach: %w", fmt.Errorf("%w: 004", sess.ErrSessionDead)), exitNotFound},
+		{"busy", fmt.Errorf("%w: 004", sess.ErrSessionBusy), exitConflict},
+		{"exists", fmt.Errorf("create: %w", sess.ErrSessionExists), exitConflict},
+		{"in session", sess.ErrInSession, exitConflict},
+		{"stale", fmt.Errorf("%w: 004", sess.ErrSessionStale), exitNoDaemon},
+		{"remote", fmt.Errorf("%w: 004 is on buildbox", sess.ErrSessionRemote), exitNoDaemon},
+		{"connection failed", fmt.Errorf("status: %w", sess.ErrConnectionFailed), exitNoDaemon},
+		{"connection lost", fmt.Errorf("%w: session 004", sess.ErrConnectionLost), exitNoDaemon},
+		{"timeout", fmt.Errorf("%w: daemon for session 004 did not start", sess.ErrTimeout), exitNoDaemon},
+		{"exit status", fmt.Errorf("attach: %w", &sess.ExitError{Session: "004", Status: 3}), 3},
+		{"signal", &sess.ExitError{Session: "004", Status: -1, Signal: "SIGKILL"}, 137},
+		{"explicit code wins", withExitCode(exitUsage, fmt.Errorf("usage: %w", sess.ErrSessionExists)), 2},
+		{"other", errors.New("disk full"), exitFailure},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code, _ := classifyError(tt.err); code != tt.code {
+				t.Errorf("classifyError(%v) = %d; want %d", tt.err, code, tt.code)
+			}
+		})
+	}
+}
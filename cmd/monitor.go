@@ -0,0 +1,535 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/theMichaelB/sess/pkg/sess"
+	"golang.org/x/sys/unix"
+	"golang.org/x/term"
+)
+
+// monitorInterval is how often sess monitor refreshes.
+const monitorInterval = time.Second
+
+// sparkWidth is how many refreshes of output a row's activity sparkline
+// covers.
+const sparkWidth = 12
+
+// monitorHelp is the footer of sess monitor while nothing else is shown.
+const monitorHelp = "up/down select  enter attach  K kill  p peek  q quit"
+
+// monitorRow is a session as sess monitor shows it.
+type monitorRow struct {
+	Number  string
+	Current bool
+	Status  string
+	Idle    string
+	Size    string
+	Cwd     string
+	Command string
+	// Activity holds the bytes of output written in each refresh,
+	// oldest first.
+	Activity []uint64
+}
+
+// monitor is what sess monitor keeps between refreshes.
+type monitor struct {
+	manager *sess.Manager
+	rows    []monitorRow
+	// output is each session's output count at the last refresh, and
+	// activity what it wrote in each refresh since. Both are keyed by
+	// monitorKey, so a new session under an old number starts afresh.
+	output   map[string]uint64
+	activity map[string][]uint64
+
+	// The full-screen view's state: the selected session and where it
+	// is in the list, the first row shown, whether its output is shown
+	// below the list, the session whose kill awaits confirmation, and a
+	// message for the footer.
+	selected string
+	index    int
+	offset   int
+	peek     bool
+	confirm  string
+	message  string
+
+	fd    int
+	opts  sess.AttachOptions
+	leave func()
+}
+
+func handleMonitor(manager *sess.Manager, opts sess.AttachOptions, args []string) error {
+	fs := flag.NewFlagSet("sess monitor", flag.ContinueOnError)
+	plainFlag := fs.Bool("plain", false, "Print the table every second instead of taking over the screen")
+	args, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) > 0 {
+		return withExitCode(exitUsage, fmt.Errorf("usage: sess monitor [--plain]"))
+	}
+	m := &monitor{
+		manager:  manager,
+		output:   make(map[string]uint64),
+		activity: make(map[string][]uint64),
+		fd:       int(os.Stdin.Fd()),
+		opts:     opts,
+	}
+	if *plainFlag || !fullScreen() {
+		return m.runPlain()
+	}
+	return m.run()
+}
+
+// fullScreen reports whether sess monitor can take over the terminal: stdin
+// and stdout must be one, and one that knows cursor movement.
+func fullScreen() bool {
+	switch os.Getenv("TERM") {
+	case "", "dumb":
+		return false
+	}
+	return term.IsTerminal(int(os.Stdin.Fd())) && term.IsTerminal(int(os.Stdout.Fd()))
+}
+
+// monitorKey tells s apart from sessions before and after it under its
+// number.
+func monitorKey(s sess.Session) string {
+	return s.Number + "@" + strconv.FormatInt(s.CreatedAt.UnixNano(), 10)
+}
+
+// refresh asks every live session's daemon how it is doing. Only a timed
+// refresh samples activity, so that each sample covers an interval.
+func (m *monitor) refresh(sample bool) error {
+	sessions, err := m.manager.List()
+	if err != nil {
+		return err
+	}
+	current := currentSession(m.manager)
+	home, _ := os.UserHomeDir()
+	seen := make(map[string]bool, len(sessions))
+	m.rows = m.rows[:0]
+	for _, s := range sessions {
+		key := monitorKey(s)
+		seen[key] = true
+		row := monitorRow{Number: s.Number, Current: s.Number == current, Size: "-", Command: s.Command}
+		st, err := m.manager.Status(s.Number)
+		if err == nil {
+			e := statusEntry(s, st)
+			row.Status, row.Idle = e.Status, e.idle()
+			if st.Rows > 0 && st.Cols > 0 {
+				row.Size = fmt.Sprintf("%dx%d", st.Rows, st.Cols)
+			}
+			row.Cwd = st.Cwd
+			if prev, ok := m.output[key]; !ok || sample {
+				if ok && st.BytesOut >= prev {
+					history := append(m.activity[key], st.BytesOut-prev)
+					m.activity[key] = history[max(0, len(history)-sparkWidth):]
+				}
+				m.output[key] = st.BytesOut
+			}
+		} else {
+			// As sess ls infers it.
+			row.Status, row.Idle = "detached", "-"
+			if row.Current {
+				row.Status = "attached"
+			}
+		}
+		if row.Cwd == "" {
+			row.Cwd, _ = m.manager.Cwd(s.Number)
+		}
+		row.Cwd = shortenHome(row.Cwd, home)
+		row.Activity = m.activity[key]
+		m.rows = append(m.rows, row)
+	}
+	for key := range m.output {
+		if !seen[key] {
+			delete(m.output, key)
+			delete(m.activity, key)
+		}
+	}
+	m.reselect()
+	return nil
+}
+
+// reselect keeps the selection on the same session across a refresh, or
+// on the row where it was if that session has gone.
+func (m *monitor) reselect() {
+	for i, row := range m.rows {
+		if row.Number == m.selected {
+			m.index = i
+			return
+		}
+	}
+	m.index = min(m.index, len(m.rows)-1)
+	m.selected = ""
+	if m.index >= 0 {
+		m.selected = m.rows[m.index].Number
+	} else {
+		m.index = 0
+	}
+}
+
+// shortenHome writes a path under home with ~.
+func shortenHome(path, home string) string {
+	switch {
+	case path == "":
+		return "-"
+	case home == "" || home == "/":
+		return path
+	case path == home:
+		return "~"
+	case strings.HasPrefix(path, home+string(filepath.Separator)):
+		return "~" + strings.TrimPrefix(path, home)
+	}
+	return path
+}
+
+// sparkBlocks draw a sparkline, from a little output to the most.
+var sparkBlocks = []rune("▁▂▃▄▅▆▇█")
+
+// sparkline draws samples as a sparkline width runes wide, scaled to the
+// largest and ending with the latest; a refresh without output is blank.
+func sparkline(samples []uint64, width int) string {
+	samples = samples[max(0, len(samples)-width):]
+	var peak uint64
+	for _, v := range samples {
+		peak = max(peak, v)
+	}
+	line := []rune(strings.Repeat(" ", width-len(samples)))
+	for _, v := range samples {
+		if v == 0 {
+			line = append(line, ' ')
+			continue
+		}
+		level := (v*uint64(len(sparkBlocks)) + peak - 1) / peak
+		line = append(line, sparkBlocks[level-1])
+	}
+	return string(line)
+}
+
+// formatMonitor renders rows as sess monitor's table, a header line and one
+// per session, each cut to width runes unless width is 0.
+func formatMonitor(rows []monitorRow, width int) []string {
+	statusWidth, cwdWidth := len("STATUS"), len("CWD")
+	for _, row := range rows {
+		statusWidth = max(statusWidth, len(row.Status))
+		cwdWidth = max(cwdWidth, len([]rune(row.Cwd)))
+	}
+	cwdWidth = min(cwdWidth, 30)
+
+	lines := []string{fmt.Sprintf("SESSION %-*s IDLE  SIZE     %-*s %-*s CMD", statusWidth, "STATUS", sparkWidth, "ACTIVITY", cwdWidth, "CWD")}
+	for _, row := range rows {
+		indicator := "  "
+		if row.Current {
+			indicator = "* "
+		}
+		lines = append(lines, fmt.Sprintf("%s%3s   %-*s %-5s %-8s %s %-*s %s",
+			indicator,
+			row.Number,
+			statusWidth, row.Status,
+			row.Idle,
+			row.Size,
+			sparkline(row.Activity, sparkWidth),
+			cwdWidth, truncate(row.Cwd, cwdWidth),
+			row.Command,
+		))
+	}
+	if width > 0 {
+		for i := range lines {
+			lines[i] = truncate(lines[i], width)
+		}
+	}
+	return lines
+}
+
+// runPlain prints the table every refresh, one after another, for a
+// terminal that cannot be redrawn in place or output that is not one.
+func (m *monitor) runPlain() error {
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer cancel()
+	ticker := time.NewTicker(monitorInterval)
+	defer ticker.Stop()
+	for first := true; ; first = false {
+		if err := m.refresh(true); err != nil {
+			return err
+		}
+		if !first {
+			fmt.Println()
+		}
+		fmt.Println(time.Now().Format("2006-01-02 15:04:05"))
+		width := 0
+		if w, _, err := term.GetSize(int(os.Stdout.Fd())); err == nil {
+			width = w
+		}
+		if len(m.rows) == 0 {
+			fmt.Println("No active sessions")
+		} else {
+			fmt.Println(strings.Join(formatMonitor(m.rows, width), "\n"))
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// run shows the full-screen view until q is pressed. It reads keys and
+// watches for resizes between refreshes itself, so that nothing is left
+// reading the terminal while a session is attached from it.
+func (m *monitor) run() error {
+	if err := m.enterScreen(); err != nil {
+		return err
+	}
+	defer func() { m.leave() }()
+
+	winch := make(chan os.Signal, 1)
+	signal.Notify(winch, syscall.SIGWINCH)
+	defer signal.Stop(winch)
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(stop)
+
+	var next time.Time
+	buf := make([]byte, 256)
+	for redraw := true; ; {
+		if !time.Now().Before(next) {
+			if err := m.refresh(true); err != nil {
+				return err
+			}
+			next = time.Now().Add(monitorInterval)
+			redraw = true
+		}
+		select {
+		case <-winch:
+			redraw = true
+		case <-stop:
+			return nil
+		default:
+		}
+		if redraw {
+			m.draw()
+			redraw = false
+		}
+
+		// Wait briefly so that resizes are seen between keys.
+		fds := []unix.PollFd{{Fd: int32(m.fd), Events: unix.POLLIN}}
+		if n, err := unix.Poll(fds, 100); err != nil && !errors.Is(err, unix.EINTR) {
+			return err
+		} else if n == 0 {
+			continue
+		}
+		n, err := os.Stdin.Read(buf)
+		if err != nil {
+			return err
+		}
+		for _, key := range monitorKeys(buf[:n]) {
+			quit, err := m.key(key)
+			if quit || err != nil {
+				return err
+			}
+		}
+		redraw = true
+	}
+}
+
+// enterScreen puts the terminal in raw mode on the alternate screen with
+// the cursor hidden, and sets leave to put it back.
+func (m *monitor) enterScreen() error {
+	state, err := term.MakeRaw(m.fd)
+	if err != nil {
+		return err
+	}
+	os.Stdout.WriteString("\x1b[?1049h\x1b[?25l")
+	m.leave = func() {
+		os.Stdout.WriteString("\x1b[?25h\x1b[?1049l")
+		term.Restore(m.fd, state)
+	}
+	return nil
+}
+
+// monitorKeys splits what the terminal sent into the keys sess monitor
+// knows: printable characters as themselves, and "up", "down", "enter",
+// "esc" and "ctrl-c". Other escape sequences are dropped.
+func monitorKeys(data []byte) []string {
+	var keys []string
+	for len(data) > 0 {
+		switch {
+		case bytes.HasPrefix(data, []byte("\x1b[A")), bytes.HasPrefix(data, []byte("\x1bOA")):
+			keys, data = append(keys, "up"), data[3:]
+		case bytes.HasPrefix(data, []byte("\x1b[B")), bytes.HasPrefix(data, []byte("\x1bOB")):
+			keys, data = append(keys, "down"), data[3:]
+		case bytes.HasPrefix(data, []byte("\x1b[")), bytes.HasPrefix(data, []byte("\x1bO")):
+			// Skip to the sequence's final byte.
+			i := 2
+			for i < len(data) && (data[i] < 0x40 || data[i] > 0x7e) {
+				i++
+			}
+			data = data[min(i+1, len(data)):]
+		default:
+			switch b := data[0]; {
+			case b == '\r' || b == '\n':
+				keys = append(keys, "enter")
+			case b == 0x1b:
+				keys = append(keys, "esc")
+			case b == 0x03:
+				keys = append(keys, "ctrl-c")
+			case b >= 0x20 && b < 0x7f:
+				keys = append(keys, string(b))
+			}
+			data = data[1:]
+		}
+	}
+	return keys
+}
+
+// key acts on a key pressed in the full-screen view, reporting whether
+// it quits the monitor.
+func (m *monitor) key(key string) (quit bool, err error) {
+	if m.confirm != "" {
+		number := m.confirm
+		m.confirm = ""
+		if key != "y" && key != "Y" {
+			m.message = ""
+			return false, nil
+		}
+		if err := m.manager.Kill(number); err != nil {
+			m.message = err.Error()
+		} else {
+			m.message = fmt.Sprintf("Killed session %s", number)
+		}
+		return false, m.refresh(false)
+	}
+	m.message = ""
+	switch key {
+	case "q", "ctrl-c":
+		return true, nil
+	case "up", "k":
+		m.move(-1)
+	case "down", "j":
+		m.move(1)
+	case "p":
+		m.peek = !m.peek
+	case "esc":
+		m.peek = false
+	case "K":
+		if m.selected != "" {
+			m.confirm = m.selected
+			m.message = fmt.Sprintf("Kill session %s? [y/N]", m.selected)
+		}
+	case "enter":
+		if m.selected != "" {
+			return false, m.attach(m.selected)
+		}
+	}
+	return false, nil
+}
+
+// move moves the selection by delta rows, stopping at either end.
+func (m *monitor) move(delta int) {
+	if len(m.rows) == 0 {
+		return
+	}
+	m.index = max(0, min(len(m.rows)-1, m.index+delta))
+	m.selected = m.rows[m.index].Number
+}
+
+// attach hands the terminal to session number until it is detached from,
+// then takes the screen back. Why an attach failed is shown in the footer.
+func (m *monitor) attach(number string) error {
+	m.leave()
+	if err := handleAttach(m.manager, number, m.opts); err != nil && !attachEnded(err) {
+		m.message = err.Error()
+	}
+	if err := m.enterScreen(); err != nil {
+		m.leave = func() {}
+		return err
+	}
+	return m.refresh(false)
+}
+
+// draw redraws the full-screen view in one write: a title, the table with
+// the selected session highlighted, the selected session's last lines of
+// output if peeking, and the footer.
+func (m *monitor) draw() {
+	width, height, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil || width < 1 || height < 1 {
+		width, height = 80, 24
+	}
+	table := formatMonitor(m.rows, width)
+	footer := monitorHelp
+	if m.message != "" {
+		footer = m.message
+	}
+
+	// Rows for the sessions and for the peek pane, between the title and
+	// header above and the footer below; the pane has a line of its own
+	// naming the session.
+	listHeight, paneHeight := height-3, 0
+	if m.peek && m.selected != "" {
+		paneHeight = (height - 4) / 2
+		listHeight = height - 4 - paneHeight
+	}
+	if m.index < m.offset {
+		m.offset = m.index
+	}
+	if listHeight > 0 && m.index >= m.offset+listHeight {
+		m.offset = m.index - listHeight + 1
+	}
+	m.offset = max(0, min(m.offset, len(m.rows)-listHeight))
+
+	lines := []string{
+		"\x1b[1m" + truncate(fmt.Sprintf("sess monitor: %s, %s", plural(len(m.rows), "session"), time.Now().Format("15:04:05")), width) + "\x1b[m",
+		table[0],
+	}
+	if len(m.rows) == 0 {
+		lines = append(lines, "No active sessions")
+	}
+	for i := m.offset; i < len(m.rows) && i < m.offset+listHeight; i++ {
+		line := table[i+1]
+		if i == m.index {
+			line = "\x1b[7m" + line + strings.Repeat(" ", width-len([]rune(line))) + "\x1b[m"
+		}
+		lines = append(lines, line)
+	}
+	if paneHeight > 0 {
+		for len(lines) < 2+listHeight {
+			lines = append(lines, "")
+		}
+		title := "-- session " + m.selected + " "
+		lines = append(lines, truncate(title+strings.Repeat("-", max(0, width-len(title))), width))
+		output, err := m.manager.OutputLines(m.selected, paneHeight)
+		if err != nil {
+			output = []string{err.Error()}
+		}
+		for _, line := range output {
+			lines = append(lines, truncate(line, width))
+		}
+	}
+	for len(lines) < height-1 {
+		lines = append(lines, "")
+	}
+	lines = append(lines[:min(len(lines), height-1)], truncate(footer, width))
+
+	var frame strings.Builder
+	frame.WriteString("\x1b[H")
+	for i, line := range lines {
+		if i > 0 {
+			frame.WriteString("\r\n")
+		}
+		frame.WriteString(line)
+		frame.WriteString("\x1b[K")
+	}
+	os.Stdout.WriteString(frame.String())
+}
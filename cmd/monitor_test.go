@@ -0,0 +1,60 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSparkline(t *testing.T) {
+	for _, tt := range []struct {
+		samples []uint64
+		width   int
+		want    string
+	}{
+		{nil, 4, "    "},
+		{[]uint64{0, 0}, 4, "    "},
+		{[]uint64{8, 1, 0, 4}, 4, "█▁ ▄"},
+		{[]uint64{100, 3}, 2, "█▁"},
+		{[]uint64{7}, 3, "  █"},
+		// Only the latest width samples are drawn, scaled among themselves.
+		{[]uint64{800, 2, 4}, 2, "▄█"},
+	} {
+		if got := sparkline(tt.samples, tt.width); got != tt.want {
+			t.Errorf("sparkline(%v, %d) = %q; want %q", tt.samples, tt.width, got, tt.want)
+		}
+	}
+}
+
+func TestMonitorKeys(t *testing.T) {
+	got := monitorKeys([]byte("j\x1b[A\x1bOB\r\x1b[1;5Cp\x1b\x03K\x7f"))
+	want := []string{"j", "up", "down", "enter", "p", "esc", "ctrl-c", "K"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("monitorKeys = %q; want %q", got, want)
+	}
+}
+
+func TestFormatMonitor(t *testing.T) {
+	rows := []monitorRow{
+		{Number: "001", Current: true, Status: "attached (2)", Idle: "3s", Size: "50x200", Cwd: "~/src/shop", Command: "bash", Activity: []uint64{0, 10, 20}},
+		{Number: "012", Status: "detached", Idle: "-", Size: "-", Cwd: "/srv/" + strings.Repeat("x", 40), Command: "sleep 100"},
+	}
+	want := []string{
+		"SESSION STATUS       IDLE  SIZE     ACTIVITY     CWD                            CMD",
+		"* 001   attached (2) 3s    50x200             ▄█ ~/src/shop                     bash",
+		"  012   detached     -     -                     /srv/xxxxxxxxxxxxxxxxxxxxxxxx… sleep 100",
+	}
+	if got := formatMonitor(rows, 0); !reflect.DeepEqual(got, want) {
+		t.Errorf("formatMonitor =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if got := formatMonitor(rows, 20); got[1] != "* 001   attached (2…" {
+		t.Errorf("formatMonitor cut to 20 columns gave %q", got[1])
+	}
+
+	if got := shortenHome("/home/me/src", "/home/me"); got != "~/src" {
+		t.Errorf("shortenHome = %q; want ~/src", got)
+	}
+	if got := shortenHome("/home/meg", "/home/me"); got != "/home/meg" {
+		t.Errorf("shortenHome = %q; want /home/meg", got)
+	}
+}
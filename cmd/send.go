@@ -0,0 +1,239 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/theMichaelB/sess/pkg/sess"
+)
+
+// keysArg builds the bytes for send and broadcast: key names and escaped
+// text, or the arguments verbatim with --literal.
+func keysArg(args []string, literal bool) ([]byte, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("no keys given")
+	}
+	if literal {
+		return []byte(strings.Join(args, " ")), nil
+	}
+	return sess.TranslateKeys(args)
+}
+
+func handleSend(manager *sess.Manager, args []string) error {
+	fs := flag.NewFlagSet("sess send", flag.ContinueOnError)
+	literalFlag := fs.Bool("l", false, "Send the arguments as literal text")
+	args, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) < 2 {
+		return withExitCode(exitUsage, fmt.Errorf("usage: sess send <num> [-l] <keys...>"))
+	}
+	data, err := keysArg(args[1:], *literalFlag)
+	if err != nil {
+		return err
+	}
+	return manager.Send(args[0], data)
+}
+
+func handleSignal(manager *sess.Manager, args []string) error {
+	fs := flag.NewFlagSet("sess signal", flag.ContinueOnError)
+	shellFlag := fs.Bool("shell", false, "Signal the session's shell instead of its foreground job")
+	args, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) != 2 {
+		return withExitCode(exitUsage, fmt.Errorf("usage: sess signal <num> [--shell] <signal>"))
+	}
+	sig, err := sess.ParseSignal(args[1])
+	if err != nil {
+		return withExitCode(exitUsage, err)
+	}
+	return manager.Signal(args[0], sig, *shellFlag)
+}
+
+func handleBroadcast(manager *sess.Manager, args []string) error {
+	fs := flag.NewFlagSet("sess broadcast", flag.ContinueOnError)
+	allFlag := fs.Bool("all", false, "Send to every session")
+	sessionsFlag := fs.String("sessions", "", "Comma-separated session numbers to send to")
+	literalFlag := fs.Bool("l", false, "Send the arguments as literal text")
+	args, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if *allFlag == (*sessionsFlag != "") {
+		return withExitCode(exitUsage, fmt.Errorf("usage: sess broadcast (--all | --sessions 2,3,5) [-l] <keys...>"))
+	}
+	data, err := keysArg(args, *literalFlag)
+	if err != nil {
+		return err
+	}
+
+	var numbers []string
+	if *allFlag {
+		sessions, err := manager.List()
+		if err != nil {
+			return err
+		}
+		for _, s := range sessions {
+			numbers = append(numbers, s.Number)
+		}
+	} else {
+		for _, n := range strings.Split(*sessionsFlag, ",") {
+			if n = strings.TrimSpace(n); n != "" {
+				numbers = append(numbers, manager.NormalizeNumber(n))
+			}
+		}
+	}
+	if len(numbers) == 0 {
+		return fmt.Errorf("no sessions to send to")
+	}
+
+	failed := 0
+	for _, number := range numbers {
+		if err := manager.Send(number, data); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", number, err)
+			failed++
+			continue
+		}
+		fmt.Printf("%s: sent\n", number)
+	}
+	if failed > 0 {
+		return fmt.Errorf("broadcast failed for %d of %d sessions", failed, len(numbers))
+	}
+	return nil
+}
+
+// foreachPlaceholders are the names sess foreach substitutes.
+var foreachPlaceholders = []string{"num", "pid", "cmd", "cwd", "socket"}
+
+// expandPlaceholders substitutes {name} in each argument of argv. Values are
+// substituted into arguments, never re-split, so no quoting is needed; {{ and
+// }} produce literal braces and unknown names are left as they are. lookup
+// is only called for placeholders that appear.
+func expandPlaceholders(argv []string, lookup func(name string) (string, error)) ([]string, error) {
+	out := make([]string, len(argv))
+	for i, arg := range argv {
+		var b strings.Builder
+		for j := 0; j < len(arg); j++ {
+			switch {
+			case strings.HasPrefix(arg[j:], "{{"):
+				b.WriteByte('{')
+				j++
+				continue
+			case strings.HasPrefix(arg[j:], "}}"):
+				b.WriteByte('}')
+				j++
+				continue
+			case arg[j] != '{':
+				b.WriteByte(arg[j])
+				continue
+			}
+			end := strings.IndexByte(arg[j:], '}')
+			name := ""
+			if end > 0 {
+				name = arg[j+1 : j+end]
+			}
+			known := false
+			for _, p := range foreachPlaceholders {
+				known = known || p == name
+			}
+			if !known {
+				b.WriteByte('{')
+				continue
+			}
+			value, err := lookup(name)
+			if err != nil {
+				return nil, fmt.Errorf("{%s}: %w", name, err)
+			}
+			b.WriteString(value)
+			j += end
+		}
+		out[i] = b.String()
+	}
+	return out, nil
+}
+
+func handleForeach(manager *sess.Manager, args []string) error {
+	fs := flag.NewFlagSet("sess foreach", flag.ContinueOnError)
+	parallelFlag := fs.Bool("parallel", false, "Run the commands concurrently")
+	jobsFlag := fs.Int("jobs", 4, "With --parallel, how many commands run at once")
+	args, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return withExitCode(exitUsage, fmt.Errorf("usage: sess foreach [--parallel] [--jobs N] -- <command...>"))
+	}
+	jobs := 1
+	if *parallelFlag {
+		jobs = *jobsFlag
+		if jobs < 1 {
+			return withExitCode(exitUsage, fmt.Errorf("--jobs must be at least 1"))
+		}
+	}
+
+	sessions, err := manager.List()
+	if err != nil {
+		return err
+	}
+
+	run := func(s sess.Session) error {
+		argv, err := expandPlaceholders(args, func(name string) (string, error) {
+			switch name {
+			case "num":
+				return s.Number, nil
+			case "pid":
+				return strconv.Itoa(s.PID), nil
+			case "cmd":
+				return s.Command, nil
+			case "cwd":
+				return manager.Cwd(s.Number)
+			default: // socket
+				return manager.SocketPath(s.Number), nil
+			}
+		})
+		if err != nil {
+			return err
+		}
+		cmd := exec.Command(argv[0], argv[1:]...)
+		if jobs == 1 {
+			cmd.Stdin = os.Stdin
+		}
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		return cmd.Run()
+	}
+
+	errs := make([]error, len(sessions))
+	sem := make(chan struct{}, jobs)
+	var wg sync.WaitGroup
+	for i, s := range sessions {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int, s sess.Session) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			errs[i] = run(s)
+		}(i, s)
+	}
+	wg.Wait()
+
+	var failed []string
+	for i, err := range errs {
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "session %s: %v\n", sessions[i].Number, err)
+			failed = append(failed, sessions[i].Number)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("command failed for sessions %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
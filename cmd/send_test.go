@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestExpandPlaceholders(t *testing.T) {
+	values := map[string]string{
+		"num":    "003",
+		"pid":    "4242",
+		"cmd":    `vim "my notes.txt" {num}`,
+		"cwd":    "/home/me/work dir",
+		"socket": "/home/me/.sess/session-003.sock",
+	}
+	lookup := func(name string) (string, error) { return values[name], nil }
+
+	tests := []struct {
+		name string
+		argv []string
+		want []string
+	}{
+		{"plain", []string{"echo", "hello"}, []string{"echo", "hello"}},
+		{"whole argument", []string{"kill", "{pid}"}, []string{"kill", "4242"}},
+		{"inside argument", []string{"log-{num}.txt"}, []string{"log-003.txt"}},
+		{"adjacent", []string{"{num}:{pid}"}, []string{"003:4242"}},
+		{"value with spaces stays one argument", []string{"ls", "{cwd}"}, []string{"ls", "/home/me/work dir"}},
+		{"value with quotes and braces is not re-expanded", []string{"echo", "{cmd}"}, []string{"echo", `vim "my notes.txt" {num}`}},
+		{"argument with spaces and quotes", []string{`say "{num}" now`}, []string{`say "003" now`}},
+		{"escaped braces", []string{"{{num}}"}, []string{"{num}"}},
+		{"escaped braces around a placeholder", []string{"{{{num}}}"}, []string{"{003}"}},
+		{"unknown placeholder", []string{"{user}", "{NUM}"}, []string{"{user}", "{NUM}"}},
+		{"empty braces", []string{"{}"}, []string{"{}"}},
+		{"unterminated", []string{"{num", "a{"}, []string{"{num", "a{"}},
+		{"stray closing brace", []string{"a}b"}, []string{"a}b"}},
+		{"shell snippet", []string{"sh", "-c", `awk '{print $1}' {socket}`}, []string{"sh", "-c", `awk '{print $1}' /home/me/.sess/session-003.sock`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := expandPlaceholders(tt.argv, lookup)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expandPlaceholders(%q) = %q; want %q", tt.argv, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpandPlaceholdersLooksUpOnlyWhatAppears(t *testing.T) {
+	var asked []string
+	_, err := expandPlaceholders([]string{"{num}", "{{cwd}}", "{bogus}"}, func(name string) (string, error) {
+		asked = append(asked, name)
+		return "x", nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(asked, []string{"num"}) {
+		t.Errorf("looked up %q; want only num", asked)
+	}
+}
+
+func TestExpandPlaceholdersLookupError(t *testing.T) {
+	gone := errors.New("session is gone")
+	_, err := expandPlaceholders([]string{"cd", "{cwd}"}, func(string) (string, error) { return "", gone })
+	if !errors.Is(err, gone) {
+		t.Errorf("error = %v; want it to wrap %v", err, gone)
+	}
+}
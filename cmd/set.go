@@ -0,0 +1,111 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/theMichaelB/sess/pkg/sess"
+)
+
+func handleNote(manager *sess.Manager, args []string) error {
+	fs := flag.NewFlagSet("sess note", flag.ContinueOnError)
+	clearFlag := fs.Bool("clear", false, "Remove the note")
+	args, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("usage: sess note <num> [text] [--clear]")
+	}
+	number := manager.NormalizeNumber(args[0])
+	text := strings.Join(args[1:], " ")
+
+	switch {
+	case *clearFlag:
+		return manager.SetNote(number, "")
+	case text != "":
+		return manager.SetNote(number, text)
+	}
+
+	s, err := manager.Get(number)
+	if err != nil {
+		return err
+	}
+	if s.Note != "" {
+		fmt.Println(s.Note)
+	}
+	return nil
+}
+
+// handleLock locks or unlocks a session against attaching.
+func handleLock(manager *sess.Manager, lock bool, args []string) error {
+	name := "unlock"
+	if lock {
+		name = "lock"
+	}
+	if len(args) != 1 {
+		return withExitCode(exitUsage, fmt.Errorf("usage: sess %s <num>", name))
+	}
+	number := manager.NormalizeNumber(args[0])
+	if lock {
+		if err := manager.Lock(number); err != nil {
+			return err
+		}
+		fmt.Printf("Locked session %s (sess unlock %s to release)\n", number, shortNumber(number))
+		return nil
+	}
+	if err := manager.Unlock(number); err != nil {
+		return err
+	}
+	fmt.Printf("Unlocked session %s\n", number)
+	return nil
+}
+
+func handleSet(manager *sess.Manager, args []string) error {
+	if len(args) < 2 {
+		return withExitCode(exitUsage, fmt.Errorf("usage: sess set <num> detach-key=<key> | timeout=[+-]<dur>..."))
+	}
+	number := args[0]
+	for _, kv := range args[1:] {
+		key, value, ok := strings.Cut(kv, "=")
+		if !ok {
+			return withExitCode(exitUsage, fmt.Errorf("expected key=value, got %q", kv))
+		}
+		switch key {
+		case "detach-key":
+			if err := manager.SetDetachKey(number, value); err != nil {
+				return err
+			}
+		case "timeout":
+			d, extend, err := parseTimeoutSetting(value)
+			if err != nil {
+				return withExitCode(exitUsage, err)
+			}
+			at, err := manager.SetTimeout(number, d, extend)
+			if err != nil {
+				return err
+			}
+			if at == nil {
+				fmt.Printf("Session %s no longer expires\n", manager.NormalizeNumber(number))
+				break
+			}
+			fmt.Printf("Session %s expires at %s (in %s)\n", manager.NormalizeNumber(number), at.Format("2006-01-02 15:04:05"), formatDuration(time.Until(*at)))
+		default:
+			return withExitCode(exitUsage, fmt.Errorf("unknown setting %q (known: detach-key, timeout)", key))
+		}
+	}
+	return nil
+}
+
+// parseTimeoutSetting parses the value of sess set's timeout: a duration
+// from now, +DUR or -DUR to move the deadline it has, or 0 for none.
+func parseTimeoutSetting(value string) (d time.Duration, extend bool, err error) {
+	extend = strings.HasPrefix(value, "+") || strings.HasPrefix(value, "-")
+	d, err = time.ParseDuration(value)
+	if err != nil || (!extend && d < 0) {
+		return 0, false, fmt.Errorf("invalid timeout %q: want a duration such as 2h, +1h to extend, or 0 for none", value)
+	}
+	return d, extend, nil
+}
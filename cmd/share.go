@@ -0,0 +1,75 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/theMichaelB/sess/pkg/sess"
+)
+
+func handleShare(manager *sess.Manager, args []string) error {
+	fs := flag.NewFlagSet("sess share", flag.ContinueOnError)
+	userFlag := fs.String("user", "", "User to let attach to the session")
+	readOnlyFlag := fs.Bool("read-only", false, "Only let the user attach read-only")
+	socketFlag := fs.String("socket", "", "Where shared users connect (default: under the temporary directory)")
+	args, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) != 1 || *userFlag == "" {
+		return withExitCode(exitUsage, fmt.Errorf("usage: sess share <num> --user NAME [--read-only] [--socket PATH]"))
+	}
+	number := manager.NormalizeNumber(args[0])
+	st, err := manager.Share(number, *userFlag, sess.ShareOptions{ReadOnly: *readOnlyFlag, Socket: *socketFlag})
+	if err != nil {
+		return err
+	}
+
+	access, attachCmd := "read-write", "sess -a "+st.Socket
+	if *readOnlyFlag {
+		access, attachCmd = "read-only", attachCmd+" -r"
+	}
+	fmt.Printf("Shared session %s with %s (%s)\n", number, *userFlag, access)
+	fmt.Printf("They attach with: %s\n", attachCmd)
+	if *socketFlag != "" && st.Socket != *socketFlag {
+		fmt.Fprintf(os.Stderr, "Note: the session is already shared through %s; --socket only applies when it is first shared\n", st.Socket)
+	}
+	return nil
+}
+
+func handleUnshare(manager *sess.Manager, args []string) error {
+	fs := flag.NewFlagSet("sess unshare", flag.ContinueOnError)
+	userFlag := fs.String("user", "", "Only revoke this user's access")
+	args, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) != 1 {
+		return withExitCode(exitUsage, fmt.Errorf("usage: sess unshare <num> [--user NAME]"))
+	}
+	number := manager.NormalizeNumber(args[0])
+	st, err := manager.Unshare(number, *userFlag)
+	if err != nil {
+		return err
+	}
+	if len(st.Users) > 0 {
+		fmt.Printf("Session %s is no longer shared with %s; still shared with %s\n", number, *userFlag, sharedUsers(st.Users))
+		return nil
+	}
+	fmt.Printf("Session %s is no longer shared\n", number)
+	return nil
+}
+
+// sharedUsers lists users a session is shared with: "alice (read-only), bob".
+func sharedUsers(users []sess.SharedUser) string {
+	names := make([]string, len(users))
+	for i, u := range users {
+		names[i] = u.Name
+		if u.ReadOnly {
+			names[i] += " (read-only)"
+		}
+	}
+	return strings.Join(names, ", ")
+}
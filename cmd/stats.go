@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/theMichaelB/sess/pkg/sess"
+)
+
+func handleStats(manager *sess.Manager, args []string) error {
+	fs := flag.NewFlagSet("sess stats", flag.ContinueOnError)
+	jsonFlag := fs.Bool("json", false, "Print as JSON")
+	args, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) > 0 {
+		return withExitCode(exitUsage, fmt.Errorf("usage: sess stats [--json]"))
+	}
+	cfg, err := sess.LoadConfig()
+	if err != nil {
+		return err
+	}
+	st, err := manager.Stats()
+	if err != nil {
+		return err
+	}
+	st.LogLimit = cfg.LogDiskLimit
+	if *jsonFlag {
+		return printJSON(st)
+	}
+	fmt.Println(formatStats(st, time.Now()))
+	return nil
+}
+
+// formatStats renders st as the line sess stats prints.
+func formatStats(st *sess.Stats, now time.Time) string {
+	parts := []string{plural(st.Sessions, "session") + fmt.Sprintf(" (%d attached, %d detached)", st.Attached, st.Detached)}
+	if st.Processes >= 0 {
+		parts = append(parts, plural(st.Processes, "process"))
+	}
+	parts = append(parts, formatBytes(uint64(st.Scrollback))+" scrollback")
+	if st.LogLimit > 0 {
+		parts = append(parts, fmt.Sprintf("%s of %s logs (log-disk-limit)", formatBytes(uint64(st.Logs)), formatBytes(uint64(st.LogLimit))))
+	} else {
+		parts = append(parts, formatBytes(uint64(st.Logs))+" logs")
+	}
+	if st.Oldest != nil {
+		parts = append(parts, "oldest "+formatDuration(now.Sub(*st.Oldest)))
+	}
+	parts = append(parts, fmt.Sprintf("%s using %s", st.Dir, formatBytes(uint64(st.DirSize))))
+	return strings.Join(parts, ", ")
+}
+
+func handleBench(manager *sess.Manager, args []string) error {
+	fs := flag.NewFlagSet("sess bench", flag.ContinueOnError)
+	durationFlag := fs.Duration("duration", 3*time.Second, "How long to measure throughput")
+	samplesFlag := fs.Int("samples", 200, "How many keystrokes to time")
+	jsonFlag := fs.Bool("json", false, "Print as JSON")
+	args, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) > 0 || *durationFlag <= 0 || *samplesFlag <= 0 {
+		return withExitCode(exitUsage, fmt.Errorf("usage: sess bench [--duration DUR] [--samples N] [--json]"))
+	}
+	// Interrupting still kills the benchmark's sessions.
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer cancel()
+	res, err := manager.Bench(ctx, sess.BenchOptions{Duration: *durationFlag, Samples: *samplesFlag})
+	if err != nil {
+		return err
+	}
+	if *jsonFlag {
+		return printJSON(res)
+	}
+	fmt.Print(formatBench(res))
+	return nil
+}
+
+// formatBench renders res as sess bench prints it.
+func formatBench(res *sess.BenchResult) string {
+	us := func(d time.Duration) string { return d.Round(time.Microsecond).String() }
+	var b strings.Builder
+	fmt.Fprintf(&b, "throughput  %.1f MB/s (%.0f MB in %s)\n", res.Throughput, float64(res.Bytes)/1e6, res.Elapsed.Round(10*time.Millisecond))
+	l := res.Latency
+	fmt.Fprintf(&b, "latency     p50 %s, p90 %s, p99 %s, max %s (%s)\n", us(l.P50), us(l.P90), us(l.P99), us(l.Max), plural(l.Samples, "keystroke"))
+	daemon := "unknown"
+	if res.DaemonCPU >= 0 {
+		daemon = res.DaemonCPU.Round(time.Millisecond).String()
+	}
+	fmt.Fprintf(&b, "cpu         daemons %s, client %s\n", daemon, res.ClientCPU.Round(time.Millisecond))
+	return b.String()
+}
+
+func handleMetrics(manager *sess.Manager, args []string) error {
+	fs := flag.NewFlagSet("sess metrics", flag.ContinueOnError)
+	writeFlag := fs.String("write", "", "Write the metrics to this file (replaced whole) instead of printing them")
+	listenFlag := fs.String("listen", "", "Serve the metrics over HTTP on this address, e.g. :9109, until interrupted")
+	args, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) > 0 || (*writeFlag != "" && *listenFlag != "") {
+		return withExitCode(exitUsage, fmt.Errorf("usage: sess metrics [--write FILE | --listen ADDR]"))
+	}
+	switch {
+	case *listenFlag != "":
+		return serveMetrics(manager, *listenFlag)
+	case *writeFlag != "":
+		var buf bytes.Buffer
+		if err := writeMetrics(manager, &buf); err != nil {
+			return err
+		}
+		// The textfile collector may read at any moment, so the file is
+		// replaced in one go rather than rewritten in place.
+		tmpPath := *writeFlag + ".tmp"
+		if err := os.WriteFile(tmpPath, buf.Bytes(), 0644); err != nil {
+			return err
+		}
+		return os.Rename(tmpPath, *writeFlag)
+	default:
+		return writeMetrics(manager, os.Stdout)
+	}
+}
+
+// serveMetrics answers scrapes of /metrics on addr, gathering afresh for
+// each, until interrupted.
+func serveMetrics(manager *sess.Manager, addr string) error {
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer cancel()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		var buf bytes.Buffer
+		if err := writeMetrics(manager, &buf); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Write(buf.Bytes())
+	})
+	srv := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Serving metrics on http://%s/metrics\n", ln.Addr())
+	go func() {
+		<-ctx.Done()
+		shutdown, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		srv.Shutdown(shutdown)
+	}()
+	if err := srv.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// writeMetrics gathers the sessions' metrics and writes them to w in the
+// Prometheus text format.
+func writeMetrics(manager *sess.Manager, w io.Writer) error {
+	metrics, err := manager.Metrics()
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, formatMetrics(metrics))
+	return err
+}
+
+// formatMetrics renders metrics in the Prometheus text exposition format.
+// Sessions whose daemon did not answer are counted as unresponsive and
+// reported down, without the counters they could not give.
+func formatMetrics(metrics []sess.SessionMetrics) string {
+	var b strings.Builder
+	family := func(name, typ, help string) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+	var attached, detached, unresponsive int
+	for _, m := range metrics {
+		switch {
+		case !m.Up:
+			unresponsive++
+		case m.Attached:
+			attached++
+		default:
+			detached++
+		}
+	}
+	family("sess_sessions", "gauge", "Live sessions by state.")
+	fmt.Fprintf(&b, "sess_sessions{state=\"attached\"} %d\n", attached)
+	fmt.Fprintf(&b, "sess_sessions{state=\"detached\"} %d\n", detached)
+	fmt.Fprintf(&b, "sess_sessions{state=\"unresponsive\"} %d\n", unresponsive)
+
+	family("sess_session_up", "gauge", "Whether the session's daemon answered the scrape.")
+	for _, m := range metrics {
+		up := 0
+		if m.Up {
+			up = 1
+		}
+		fmt.Fprintf(&b, "sess_session_up{session=%q} %d\n", m.Number, up)
+	}
+	perSession := func(name, typ, help string, value func(sess.SessionMetrics) string) {
+		family(name, typ, help)
+		for _, m := range metrics {
+			if m.Up {
+				fmt.Fprintf(&b, "%s{session=%q} %s\n", name, m.Number, value(m))
+			}
+		}
+	}
+	perSession("sess_session_bytes_out_total", "counter", "Output written by the session's programs since it started, in bytes.",
+		func(m sess.SessionMetrics) string { return strconv.FormatUint(m.BytesOut, 10) })
+	perSession("sess_session_clients", "gauge", "Clients connected to the session, read-only ones included.",
+		func(m sess.SessionMetrics) string { return strconv.Itoa(m.Clients) })
+	perSession("sess_scrollback_bytes", "gauge", "Output the session's daemon holds in memory, in bytes.",
+		func(m sess.SessionMetrics) string { return strconv.FormatInt(m.Scrollback, 10) })
+	return b.String()
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/theMichaelB/sess/pkg/sess"
+)
+
+func TestFormatStats(t *testing.T) {
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	oldest := now.Add(-50 * time.Hour)
+	st := &sess.Stats{
+		Dir: "/home/me/.sess", DirSize: 3 << 20,
+		Sessions: 3, Attached: 1, Detached: 2,
+		Processes: 7, Scrollback: 512 << 10, Logs: 1536,
+		Oldest: &oldest,
+	}
+	want := "3 sessions (1 attached, 2 detached), 7 processes, 512.0KiB scrollback, 1.5KiB logs, oldest 2d, /home/me/.sess using 3.0MiB"
+	if got := formatStats(st, now); got != want {
+		t.Errorf("formatStats =\n%s\nwant\n%s", got, want)
+	}
+
+	// Nothing running, on a system whose processes can't be counted.
+	st = &sess.Stats{Dir: "/home/me/.sess", Processes: -1}
+	want = "0 sessions (0 attached, 0 detached), 0B scrollback, 0B logs, /home/me/.sess using 0B"
+	if got := formatStats(st, now); got != want {
+		t.Errorf("formatStats =\n%s\nwant\n%s", got, want)
+	}
+
+	// Logs against the log-disk-limit they are pruned to.
+	st.Logs, st.LogLimit = 1536, 2<<30
+	want = "0 sessions (0 attached, 0 detached), 0B scrollback, 1.5KiB of 2.0GiB logs (log-disk-limit), /home/me/.sess using 0B"
+	if got := formatStats(st, now); got != want {
+		t.Errorf("formatStats =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestFormatMetrics(t *testing.T) {
+	got := formatMetrics([]sess.SessionMetrics{
+		{Number: "001", Up: true, Attached: true, Clients: 2, BytesOut: 12345, Scrollback: 4096},
+		{Number: "002", Up: true, BytesOut: 7},
+		{Number: "003"},
+	})
+	want := `# HELP sess_sessions Live sessions by state.
+# TYPE sess_sessions gauge
+sess_sessions{state="attached"} 1
+sess_sessions{state="detached"} 1
+sess_sessions{state="unresponsive"} 1
+# HELP sess_session_up Whether the session's daemon answered the scrape.
+# TYPE sess_session_up gauge
+sess_session_up{session="001"} 1
+sess_session_up{session="002"} 1
+sess_session_up{session="003"} 0
+# HELP sess_session_bytes_out_total Output written by the session's programs since it started, in bytes.
+# TYPE sess_session_bytes_out_total counter
+sess_session_bytes_out_total{session="001"} 12345
+sess_session_bytes_out_total{session="002"} 7
+# HELP sess_session_clients Clients connected to the session, read-only ones included.
+# TYPE sess_session_clients gauge
+sess_session_clients{session="001"} 2
+sess_session_clients{session="002"} 0
+# HELP sess_scrollback_bytes Output the session's daemon holds in memory, in bytes.
+# TYPE sess_scrollback_bytes gauge
+sess_scrollback_bytes{session="001"} 4096
+sess_scrollback_bytes{session="002"} 0
+`
+	if got != want {
+		t.Errorf("formatMetrics =\n%s\nwant\n%s", got, want)
+	}
+}
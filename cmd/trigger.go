@@ -0,0 +1,123 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/theMichaelB/sess/pkg/sess"
+)
+
+const triggerUsage = "usage: sess trigger add <num> --pattern RE --command CMD [--cooldown DUR] | ls [num] [--json] | rm <num> (<id>... | --all)"
+
+func handleTrigger(manager *sess.Manager, args []string) error {
+	if len(args) == 0 {
+		return withExitCode(exitUsage, fmt.Errorf(triggerUsage))
+	}
+	switch args[0] {
+	case "add":
+		return handleTriggerAdd(manager, args[1:])
+	case "ls", "list":
+		return handleTriggerList(manager, args[1:])
+	case "rm", "remove":
+		return handleTriggerRemove(manager, args[1:])
+	}
+	return withExitCode(exitUsage, fmt.Errorf(triggerUsage))
+}
+
+func handleTriggerAdd(manager *sess.Manager, args []string) error {
+	fs := flag.NewFlagSet("sess trigger add", flag.ContinueOnError)
+	patternFlag := fs.String("pattern", "", "Regular expression a line of output must match")
+	commandFlag := fs.String("command", "", "Shell command to run on a match")
+	cooldownFlag := fs.Duration("cooldown", 0, "Least time between runs (default 10s)")
+	args, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) != 1 || *patternFlag == "" || *commandFlag == "" {
+		return withExitCode(exitUsage, fmt.Errorf("usage: sess trigger add <num> --pattern RE --command CMD [--cooldown DUR]"))
+	}
+	if *cooldownFlag < 0 || (*cooldownFlag > 0 && *cooldownFlag < time.Second) {
+		return withExitCode(exitUsage, fmt.Errorf("--cooldown must be at least 1s"))
+	}
+	t, err := manager.AddTrigger(args[0], sess.Trigger{
+		Pattern:  *patternFlag,
+		Command:  *commandFlag,
+		Cooldown: int(cooldownFlag.Round(time.Second) / time.Second),
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Added trigger %d to session %s\n", t.ID, manager.NormalizeNumber(args[0]))
+	return nil
+}
+
+func handleTriggerList(manager *sess.Manager, args []string) error {
+	fs := flag.NewFlagSet("sess trigger ls", flag.ContinueOnError)
+	jsonFlag := fs.Bool("json", false, "Print as JSON")
+	args, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	number, err := sessionArg(manager, args)
+	if err != nil {
+		return err
+	}
+	triggers, err := manager.Triggers(number)
+	if err != nil {
+		return err
+	}
+	if *jsonFlag {
+		if triggers == nil {
+			triggers = []sess.Trigger{}
+		}
+		return printJSON(triggers)
+	}
+	if len(triggers) == 0 {
+		fmt.Printf("Session %s has no triggers\n", number)
+		return nil
+	}
+	fmt.Print(formatTriggers(triggers))
+	return nil
+}
+
+// formatTriggers lays triggers out as a table.
+func formatTriggers(triggers []sess.Trigger) string {
+	width := len("PATTERN")
+	for _, t := range triggers {
+		width = max(width, len(t.Pattern))
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "ID   COOLDOWN  %-*s  COMMAND\n", width, "PATTERN")
+	for _, t := range triggers {
+		cooldown := "10s"
+		if t.Cooldown > 0 {
+			cooldown = (time.Duration(t.Cooldown) * time.Second).String()
+		}
+		fmt.Fprintf(&b, "%-4d %-9s %-*s  %s\n", t.ID, cooldown, width, t.Pattern, t.Command)
+	}
+	return b.String()
+}
+
+func handleTriggerRemove(manager *sess.Manager, args []string) error {
+	fs := flag.NewFlagSet("sess trigger rm", flag.ContinueOnError)
+	allFlag := fs.Bool("all", false, "Remove all the session's triggers")
+	args, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 || (len(args) == 1) != *allFlag {
+		return withExitCode(exitUsage, fmt.Errorf("usage: sess trigger rm <num> (<id>... | --all)"))
+	}
+	var ids []int
+	for _, arg := range args[1:] {
+		id, err := strconv.Atoi(arg)
+		if err != nil || id <= 0 {
+			return withExitCode(exitUsage, fmt.Errorf("invalid trigger id %q", arg))
+		}
+		ids = append(ids, id)
+	}
+	return manager.RemoveTriggers(args[0], ids...)
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/theMichaelB/sess/pkg/sess"
+)
+
+func TestFormatTriggers(t *testing.T) {
+	got := formatTriggers([]sess.Trigger{
+		{ID: 1, Pattern: "BUILD FAILED", Command: "notify-send failed"},
+		{ID: 3, Pattern: "panic:", Command: "true", Cooldown: 90},
+	})
+	want := `ID   COOLDOWN  PATTERN       COMMAND
+1    10s       BUILD FAILED  notify-send failed
+3    1m30s     panic:        true
+`
+	if got != want {
+		t.Errorf("formatTriggers =\n%s\nwant\n%s", got, want)
+	}
+}
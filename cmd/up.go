@@ -0,0 +1,215 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/theMichaelB/sess/pkg/sess"
+	"golang.org/x/term"
+)
+
+func handleUp(manager *sess.Manager, create sess.CreateOptions, args []string) error {
+	fs := flag.NewFlagSet("sess up", flag.ContinueOnError)
+	onlyFlag := fs.String("only", "", "Comma-separated names of the sessions to start")
+	args, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) > 0 {
+		return withExitCode(exitUsage, fmt.Errorf("usage: sess up [--only NAME,...]"))
+	}
+	path, err := sess.DefinitionsPath()
+	if err != nil {
+		return err
+	}
+	defs, err := sess.LoadDefinitions()
+	if errors.Is(err, os.ErrNotExist) {
+		return withExitCode(exitUsage, fmt.Errorf("no sessions are defined: %s does not exist", path))
+	}
+	if err != nil {
+		return err
+	}
+	if *onlyFlag != "" {
+		if defs, err = selectDefinitions(defs, strings.Split(*onlyFlag, ","), path); err != nil {
+			return withExitCode(exitUsage, err)
+		}
+	}
+	if len(defs) == 0 {
+		fmt.Printf("No sessions are defined in %s\n", path)
+		return nil
+	}
+
+	results, err := manager.Up(defs, create)
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for _, r := range results {
+		switch {
+		case r.Err != nil:
+			fmt.Fprintf(os.Stderr, "Error: %s: %v\n", r.Name, r.Err)
+			failed++
+		case r.Created:
+			fmt.Printf("Started %s as session %s\n", r.Name, r.Number)
+		default:
+			fmt.Printf("%s is already running as session %s\n", r.Name, r.Number)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d session(s) could not be started", failed)
+	}
+	return nil
+}
+
+// selectDefinitions returns the definitions named, in file order; a name
+// the file does not define is an error.
+func selectDefinitions(defs []sess.Definition, names []string, path string) ([]sess.Definition, error) {
+	want := make(map[string]bool)
+	for _, name := range names {
+		want[strings.TrimSpace(name)] = true
+	}
+	var picked []sess.Definition
+	for _, def := range defs {
+		if want[def.Name] {
+			picked = append(picked, def)
+			delete(want, def.Name)
+		}
+	}
+	for name := range want {
+		return nil, fmt.Errorf("%s does not define a session named %q", path, name)
+	}
+	return picked, nil
+}
+
+func handleDown(manager *sess.Manager, args []string) error {
+	fs := flag.NewFlagSet("sess down", flag.ContinueOnError)
+	onlyFlag := fs.String("only", "", "Comma-separated names of the sessions to kill")
+	args, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) > 0 {
+		return withExitCode(exitUsage, fmt.Errorf("usage: sess down [--only NAME,...]"))
+	}
+	var names []string
+	if *onlyFlag != "" {
+		for _, name := range strings.Split(*onlyFlag, ",") {
+			names = append(names, strings.TrimSpace(name))
+		}
+	}
+	results, err := manager.Down(names)
+	if err != nil {
+		return err
+	}
+	if len(results) == 0 {
+		fmt.Println("No sessions started by sess up are running")
+		return nil
+	}
+	failed := 0
+	for _, r := range results {
+		if r.Err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s: %v\n", r.Name, r.Err)
+			failed++
+			continue
+		}
+		fmt.Printf("Killed session %s (%s)\n", r.Number, r.Name)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d session(s) could not be killed", failed)
+	}
+	return nil
+}
+
+// handleRestore starts again the sessions lost to a reboot, asking about
+// each one unless --auto is given. Those declined are forgotten.
+func handleRestore(manager *sess.Manager, args []string) error {
+	fs := flag.NewFlagSet("sess restore", flag.ContinueOnError)
+	autoFlag := fs.Bool("auto", false, "Restore every session without asking")
+	args, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) > 0 {
+		return withExitCode(exitUsage, fmt.Errorf("usage: sess restore [--auto]"))
+	}
+	specs, err := manager.RestoreSpecs()
+	if err != nil {
+		return err
+	}
+	if len(specs) == 0 {
+		// Quiet in a login script.
+		if !*autoFlag {
+			fmt.Println("No sessions to restore")
+		}
+		return nil
+	}
+	if !*autoFlag && !term.IsTerminal(int(os.Stdin.Fd())) {
+		return withExitCode(exitUsage, fmt.Errorf("refusing to restore %d session(s) without confirmation; pass --auto", len(specs)))
+	}
+
+	failed := 0
+	for _, spec := range specs {
+		what := truncate(strings.Join(spec.Argv, " "), 40)
+		if !*autoFlag {
+			fmt.Printf("Restore session %s (%s in %s)? [y/N] ", spec.Number, what, spec.Dir)
+			var answer string
+			fmt.Scanln(&answer)
+			if answer != "y" && answer != "Y" && answer != "yes" {
+				if err := manager.DiscardRestore(spec); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: session %s: %v\n", spec.Number, err)
+				}
+				continue
+			}
+		}
+		number, err := manager.Restore(spec)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: session %s: %v\n", spec.Number, err)
+			failed++
+			continue
+		}
+		fmt.Printf("Restored session %s -> %s (%s)\n", spec.Number, number, what)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d session(s) could not be restored", failed)
+	}
+	return nil
+}
+
+func handleSave(manager *sess.Manager, args []string) error {
+	fs := flag.NewFlagSet("sess save", flag.ContinueOnError)
+	linesFlag := fs.Int("lines", 0, "Save only the last N lines")
+	bytesFlag := fs.Int("bytes", 0, "Save only the last N bytes")
+	allFlag := fs.Bool("all", false, "Include output spilled to disk beyond the in-memory scrollback")
+	args, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) < 1 || len(args) > 2 {
+		return withExitCode(exitUsage, fmt.Errorf("usage: sess save <num> [file] [--lines N | --bytes N | --all]"))
+	}
+	opts := sess.ScrollbackOptions{Lines: *linesFlag, Bytes: *bytesFlag, All: *allFlag}
+	if opts.All && (opts.Lines > 0 || opts.Bytes > 0) {
+		return withExitCode(exitUsage, fmt.Errorf("--all cannot be combined with --lines or --bytes"))
+	}
+
+	if len(args) == 1 || args[1] == "-" {
+		_, err := manager.Scrollback(args[0], opts, os.Stdout)
+		return err
+	}
+	f, err := os.OpenFile(args[1], os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	n, err := manager.Scrollback(args[0], opts, f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Saved %s of session %s to %s\n", formatBytes(uint64(n)), manager.NormalizeNumber(args[0]), args[1])
+	return nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/theMichaelB/sess/pkg/sess"
+)
+
+// handleUpgrade has sessions' daemons re-execute this binary, so they run
+// its code from now on without the sessions ending.
+func handleUpgrade(manager *sess.Manager, args []string) error {
+	fs := flag.NewFlagSet("sess upgrade", flag.ContinueOnError)
+	allFlag := fs.Bool("all", false, "Upgrade every session")
+	args, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	var numbers []string
+	switch {
+	case *allFlag && len(args) == 0:
+		sessions, err := manager.List()
+		if err != nil {
+			return err
+		}
+		for _, s := range sessions {
+			numbers = append(numbers, s.Number)
+		}
+		if len(numbers) == 0 {
+			fmt.Println("No active sessions")
+			return nil
+		}
+	case !*allFlag && len(args) == 1:
+		numbers = []string{manager.NormalizeNumber(args[0])}
+	default:
+		return withExitCode(exitUsage, fmt.Errorf("usage: sess upgrade (<num> | --all)"))
+	}
+
+	failed := 0
+	for _, number := range numbers {
+		from := "-"
+		if s, err := manager.Get(number); err == nil && s.Version != "" {
+			from = s.Version
+		}
+		if err := manager.Upgrade(number); err != nil {
+			if len(numbers) == 1 {
+				return err
+			}
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			failed++
+			continue
+		}
+		fmt.Printf("Upgraded session %s (%s -> %s)\n", number, from, version)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d session(s) could not be upgraded", failed)
+	}
+	return nil
+}
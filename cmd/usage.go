@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+)
+
+func showUsage() {
+	fmt.Printf(`sess %s - minimal session persistence tool
+
+Usage:
+  sess              Create new session
+  sess [-A <num>] -- <command...>
+                    Create a session running command instead of the shell
+  sess new [--at <num>] [-- <command...>]
+                    Create a session without attaching, at <num> if given
+                    (failing if it exists); later ones are numbered above it
+  sess ls           List all sessions (--json, --sort activity, --resources,
+                    --versions, --all to include exited and stale sessions;
+                    -q prints only the numbers of live ones, one per line)
+  sess info [num]   Show details of a session (--json, --clients)
+  sess monitor      Full-screen view of all sessions, refreshed every second:
+                    enter attaches, K kills, p peeks at the last screenful,
+                    q quits (--plain prints the table over and over instead)
+  sess set <num> detach-key=<key>
+                    Store a session's detach key (empty value removes it)
+  sess set <num> timeout=<dur>
+                    End a session <dur> from now; +<dur> or -<dur> moves its
+                    timeout, 0 removes it
+  sess note <num> [text]
+                    Show or set a session's note (--clear removes it)
+  sess lock <num>   Refuse attaches to a session until sess unlock <num>
+  sess -a <num>     Attach to session
+  sess -A <num>     Attach or create session
+  sess last, sess - Attach to the previously used session
+  sess -x           Detach from current session
+  sess send <num> <keys...>
+                    Type text or keys (Enter, C-c, ...) into a session
+  sess broadcast (--all | --sessions 2,3) <keys...>
+                    Type the same keys into several sessions
+  sess setenv <num> [KEY=value...] [--unset KEY]
+                    Push variables into a session (lists them without any)
+  sess trigger add <num> --pattern RE --command CMD
+                    Run CMD whenever the session prints a line matching RE
+                    (--cooldown DUR between runs, default 10s)
+  sess trigger ls [num]
+                    List a session's triggers (--json)
+  sess trigger rm <num> (<id>... | --all)
+                    Remove triggers
+  sess watch [num] --pattern RE
+                    Wait until the session prints a line matching RE and
+                    print it (--timeout DUR, --scrollback to match held
+                    output too); exits 124 on timeout, 1 if the session ends
+  sess share <num> --user NAME
+                    Let another user attach (--read-only, --socket PATH);
+                    they attach with sess -a <socket path>
+  sess unshare <num> [--user NAME]
+                    Stop sharing a session (with everyone, or NAME)
+  sess upgrade (<num> | --all)
+                    Have sessions run this sess binary from now on, without
+                    ending them
+  sess up [--only NAME,...]
+                    Start the sessions defined in ~/.config/sess/sessions.toml
+                    that are not running
+  sess down [--only NAME,...]
+                    Kill the sessions sess up started
+  sess restore      Offer to start again, detached, the sessions a reboot
+                    took (--auto: all of them, without asking)
+  sess signal <num> <sig>
+                    Signal a session's foreground job (--shell: its shell)
+  sess save <num> [file]
+                    Write a session's recent output to file or stdout
+                    (--lines N, --bytes N, --all with scrollback-spill)
+  sess foreach [--parallel] -- <command...>
+                    Run a local command once per session; {num}, {pid},
+                    {cmd}, {cwd} and {socket} are replaced in each argument
+  sess cwd [num]    Print a session's working directory
+  sess env [num]    Print a session's environment (--json, --diff)
+  sess -a <num> -r  Attach read-only (alongside any interactive client)
+  sess -C           Disable Ctrl-X detach (for this attach)
+                    While attached, Ctrl-X detaches and Ctrl-X Ctrl-X (or
+                    Ctrl-X -) switches to the previously used session
+  sess --no-ctrlx   Same as -C
+  sess -K           Kill all sessions but the current one (--include-current)
+  sess -k [num]     Kill session (current if no number)
+  sess stats        One line on all sessions: attached and detached, processes,
+                    scrollback, logs, the oldest and the directory (--json)
+  sess bench        Measure output throughput, keystroke latency and CPU use
+                    with two throwaway sessions (--duration, --samples, --json)
+  sess metrics      Print gauges for Prometheus (--write FILE for the
+                    node_exporter textfile collector, --listen :9109 to serve)
+  sess debug [num]  Have a session's daemon dump its state (clients, terminal,
+                    recent control messages, goroutine stacks) to its log, as
+                    SIGUSR2 does, and print the dump
+  sess doctor       Find daemons whose sessions sess can no longer reach, as
+                    after rm -rf ~/.sess, and offer to put each session back or
+                    kill it (--reregister, --kill)
+  sess clean        Remove what exited and stale sessions left behind, and
+                    logs past their retention (log-keep-days/-files)
+  sess purge        Kill all sessions and remove all sess files (--yes)
+  sess -v, --version Show version
+  sess -h, --help   Show this help
+
+Sessions are numbered sequentially (001, 002, etc).
+You can use either 1 or 001 format for session numbers.
+
+New sessions run "default-command = ..." from ~/.config/sess/config through
+the shell when set, and the shell ($SHELL) otherwise.
+
+Exit status: 2 for usage errors and unknown sessions, 3 when sess cwd cannot
+tell the directory, 4 when the session exists or is busy, 5 when its daemon
+cannot be reached, 1 otherwise.
+
+Flags:
+  -a <num>           Attach to session (or <socket> shared by another user)
+  -A <num>           Attach or create session
+  -x                 Detach from current session
+  -C, --no-ctrlx     Disable Ctrl-X detach for this attach
+  --detach-key KEY   Detach with KEY instead of Ctrl-X: one key (C-]) or a
+                     prefix and action ('C-a d'); after the prefix, the
+                     prefix again or '-' switches sessions and '?' lists keys
+  --key-timeout DUR  Send a lone prefix on after DUR (default 1s)
+  --exec KEYS        Type KEYS into the session after attaching, as in
+                     sess send ('tail -f log\n')
+  --no-resize        Keep the session's size instead of resizing it to this
+                     terminal (larger content is clipped)
+  --no-redraw        Don't nudge the session's program to repaint on attach
+  --redraw-ctrl-l    Also send Ctrl-L on attach (never to the shell itself)
+  --detach-on-eof    Detach when stdin ends, e.g. after commands piped in;
+                     the default when stdin is not a terminal
+  --no-screen-reset  When the session ends or its daemon dies while attached,
+                     leave the cursor and screen modes as they were left
+  --no-alt-screen    Don't follow a full-screen program onto the alternate
+                     screen on attach, or leave it on detach
+  --no-input         Attach output-only, e.g. sess -a 3 --duration 5s >
+                     capture.txt; implied when stdin is not a terminal,
+                     pipe or file (such as /dev/null)
+  --direct           Read and write the session's terminal directly, not
+                     through its daemon, for lower latency; falls back to
+                     the relay when the session is logged, shared, keeps
+                     its scrollback or has other clients. Output shown
+                     this way is missing from sess scrollback
+  --drop-output KB   On a terminal too slow to keep up, such as a serial
+                     console, skip the output once more than KB of it
+                     waits, keeping the latest and marking the gap
+  --predict          Show printable keystrokes at once, underlined, before the
+                     session echoes them, as mosh does, for slow links such
+                     as a session running ssh to a distant host. Not on the
+                     alternate screen, nor after Enter until keys echo again
+  --predict-after DUR
+                     Predict only once echoes take DUR or longer, e.g. 200ms
+  --raw              With -a, pass bytes between stdin/stdout and the session
+                     untouched, for expect and pexpect: no terminal modes,
+                     messages, detach key or resizing, other than to
+                     --size. Ends at end of stdin or a signal with status
+                     0, leaving the session running; when the session's
+                     command ends, with its status; 5 when the daemon
+                     drops the connection
+  --cooked           Attach in line mode, for terminals that cannot enter raw
+                     mode (emacs shell buffers, some serial consoles): the
+                     terminal edits and echoes each line, which is sent on
+                     Enter. Ctrl-C is passed on; Ctrl-D on an empty line
+                     detaches
+  --size ROWSxCOLS   Size the session to ROWSxCOLS instead of this terminal,
+                     and keep it so while attached: the terminal's resizes
+                     are not passed on, and detaching leaves it at that
+                     size. Works with --raw and --no-input, for captures
+                     that wrap the same way every time
+  --duration DUR     Detach after DUR, e.g. 30s
+  --tee FILE         Also copy the session's output to FILE while attached
+                     (truncated first, or appended to with --tee-append);
+                     with --tee-timestamps each line starts with its time
+  --transient        Kill a session created by this command when its client
+                     detaches or exits
+  --no-oom-protect   Leave the Linux OOM score of the daemon of a session
+                     created by this command alone; by default it is
+                     lowered (oom-score-adj = -500) so that the OOM killer
+                     picks the program eating the memory, not the session
+  --throttle-detached
+                     While nobody is attached to a session created by this
+                     command and its scrollback is full, stop reading its
+                     output, so a runaway program waits rather than using
+                     CPU for output nobody keeps (recorded sessions are
+                     always read)
+  --timeout DUR      End a session created by this command after DUR, e.g.
+                     2h: its command is sent SIGTERM, then SIGKILL, and
+                     sess ls --all shows it as expired (timeout). 0 (the
+                     default) sets none; sess set <num> timeout=+1h moves it
+  --log              Record a session created by this command's output to
+                     ~/.sess/session-NNN.log, kept after it ends
+  --log-input        Record what is typed into a session created by this
+                     command to ~/.sess/session-NNN.input.log (owner-only,
+                     never pruned); password prompts are left out
+  --record-script FILE
+                     Record a session created by this command to FILE as
+                     script(1) does; with --record-timing TFILE,
+                     scriptreplay TFILE FILE replays it (resizes are not
+                     recorded, as the format cannot express them)
+  --termios SETTINGS Start a session created by this command with these
+                     terminal settings, e.g. ixon=off,erase=^? (flags take
+                     on/off; erase, intr etc. take ^X, ^? or undef)
+  --rlimit NAME=VAL  Start the command of a session created by this command
+                     with this resource limit (repeatable): nofile=4096,
+                     core=0, as=8G, cpu=1h, or soft:hard; names as in
+                     prlimit(1). A limit that cannot be set is an error
+  --copy-env         Start the command of a session created by this command
+                     with this shell's environment as it is now, rather
+                     than whatever the daemon inherited
+  --copy-env-only VARS
+                     The same, with only these variables, e.g. PATH,HOME
+  --clean-env        Start it with only PATH, HOME and TERM
+  --force-nested     Allow creating a session from inside another (or inside
+                     tmux or screen, with nested-warning = error); nested
+                     attaches detach with C-] unless --detach-key is given
+  -r, --read-only    With -a: attach without sending input or resizes
+  --force            Attach to a session of yours even though it is locked;
+                     with -k/-K, kill sessions clients are attached to
+                     (they are told why and disconnected first)
+  --yes              With -k/-K, kill sessions running a job (anything but
+                     their shell at a prompt) without asking; asked on a
+                     terminal, they are otherwise refused
+  --user NAME        As root: run as NAME on NAME's sessions, e.g.
+                     sudo sess --user bob ls
+  -k [num]           Kill session by number (or current)
+  -K                 Kill all sessions except the one this runs inside
+                     (--include-current kills that too, last)
+  -v, --version      Show version
+  -h, --help         Show help
+`, version)
+}
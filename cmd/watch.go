@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os/signal"
+	"regexp"
+	"syscall"
+
+	"github.com/theMichaelB/sess/pkg/sess"
+)
+
+// exitWatchTimeout is sess watch's exit status when its --timeout passes,
+// as timeout(1) exits.
+const exitWatchTimeout = 124
+
+func handleWatch(manager *sess.Manager, args []string) error {
+	fs := flag.NewFlagSet("sess watch", flag.ContinueOnError)
+	patternFlag := fs.String("pattern", "", "Regular expression a line of output must match")
+	timeoutFlag := fs.Duration("timeout", 0, "Give up after this long (default: wait until the session ends)")
+	scrollbackFlag := fs.Bool("scrollback", false, "Also match the output the session already holds")
+	args, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) > 1 || *patternFlag == "" {
+		return withExitCode(exitUsage, fmt.Errorf("usage: sess watch [num] --pattern RE [--timeout DUR] [--scrollback]"))
+	}
+	if *timeoutFlag < 0 {
+		return withExitCode(exitUsage, fmt.Errorf("--timeout must not be negative"))
+	}
+	re, err := regexp.Compile(*patternFlag)
+	if err != nil {
+		return withExitCode(exitUsage, fmt.Errorf("invalid pattern: %v", err))
+	}
+	number, err := sessionArg(manager, args)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer cancel()
+	if *timeoutFlag > 0 {
+		ctx, cancel = context.WithTimeout(ctx, *timeoutFlag)
+		defer cancel()
+	}
+	line, err := manager.Watch(ctx, number, sess.WatchOptions{Pattern: re, Scrollback: *scrollbackFlag})
+	switch {
+	case errors.Is(err, sess.ErrTimeout):
+		return withExitCode(exitWatchTimeout, err)
+	case errors.Is(err, sess.ErrSessionNotFound), errors.Is(err, sess.ErrSessionDead),
+		errors.Is(err, sess.ErrConnectionFailed), errors.Is(err, sess.ErrConnectionLost):
+		return err
+	case err != nil:
+		return withExitCode(exitFailure, err)
+	}
+	fmt.Println(line)
+	return nil
+}
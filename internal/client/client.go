@@ -1,24 +1,47 @@
 package client
 
 import (
+	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
-	"os/signal"
 	"sync"
 	"syscall"
 	"time"
 
+	"github.com/theMichaelB/sess/internal/platform"
+	"github.com/theMichaelB/sess/internal/utils"
+	"github.com/theMichaelB/sess/pkg/protocol"
 	"golang.org/x/sys/unix"
 	"golang.org/x/term"
-	"github.com/theMichaelB/sess/internal/protocol"
 )
 
 const (
 	connectTimeout = 5 * time.Second
 	bufferSize     = 4096
+	// inputChunkSize keeps a base64-encoded INPUT message well inside the
+	// daemon's 4 KiB line limit.
+	inputChunkSize = 2048
+	// switchWindow is how long after a single-key detach key a second press
+	// (or '-') switches to the previous session instead of detaching. Any
+	// other key in the window detaches at once.
+	switchWindow = 500 * time.Millisecond
+	// execDelay is how long Exec waits for the session to draw before it
+	// is typed anyway; execSettle lets a repaint that has begun finish.
+	execDelay  = 500 * time.Millisecond
+	execSettle = 50 * time.Millisecond
+	keyCtrlC   = 0x03
+	keyCtrlX   = 0x18
+	// keepaliveInterval paces the pings that keep the daemon from taking
+	// an attached client that sends nothing for gone.
+	keepaliveInterval = 10 * time.Second
+	// screenReset undoes what a program in the session may have left set
+	// on the terminal: it shows the cursor, leaves the alternate screen,
+	// resets colours and attributes and turns line wrapping back on.
+	screenReset = "\x1b[?25h\x1b[?1049l\x1b[0m\x1b[?7h"
 )
 
 type Winsize struct {
@@ -26,26 +49,188 @@ type Winsize struct {
 	Cols uint16
 }
 
+// Options configures an attach. Stdin and Stdout default to the process's
+// standard streams. When Stdin is a terminal it is put into raw mode for the
+// duration of the attach, unless Cooked.
+type Options struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	// Size reports the current terminal size. When nil and Stdin is a
+	// terminal, the terminal's own size is used. A raw attach applies it
+	// once, if given.
+	Size func() (rows, cols int, err error)
+	// Resize triggers a size refresh (via Size) each time it receives.
+	Resize <-chan struct{}
+	// DisableCtrlX turns off all attach key bindings.
+	DisableCtrlX bool
+	// Keys are the detach (and switch) bindings; zero means DefaultKeys.
+	Keys Keys
+	// KeyTimeout is how long a two-key binding's prefix waits for its
+	// action key; zero means DefaultKeyTimeout.
+	KeyTimeout time.Duration
+	// Quiet suppresses the attach/detach banners.
+	Quiet bool
+	// NoResize leaves the session at its current size: no RESIZE is sent
+	// on attach or when the terminal changes size.
+	NoResize bool
+	// NoRedraw skips asking the session to repaint after attaching.
+	NoRedraw bool
+	// RedrawCtrlL also types Ctrl-L when asking for a repaint, unless the
+	// session's shell itself is in the foreground.
+	RedrawCtrlL bool
+	// ReadOnly attaches as a peek client: output is shown but input
+	// (other than the detach key) and resizes are not sent.
+	ReadOnly bool
+	// DetachOnEOF detaches once Stdin is exhausted, as the detach key
+	// does. Otherwise the attach outlasts its input.
+	DetachOnEOF bool
+	// Cooked leaves a terminal Stdin in its own line mode rather than
+	// raw mode, for terminals that cannot enter raw mode: the terminal
+	// edits and echoes each line and passes it on when Enter is pressed,
+	// ending it with the carriage return Enter sends in raw mode. Bound
+	// keys act once the line holding them is passed on, and end of file
+	// (Ctrl-D on an empty line) detaches.
+	Cooked bool
+	// Predict shows printable keystrokes as they are typed, underlined,
+	// before the session echoes them, for links slow enough to make
+	// typing hard; the echo replaces them. PredictAfter instead shows
+	// them only once keystrokes take at least that long to be echoed,
+	// which is measured as they are typed. Either applies only to a
+	// terminal Stdin in raw mode, outside the alternate screen, and not
+	// with ReadOnly or DropOutput.
+	Predict      bool
+	PredictAfter time.Duration
+	// Interrupt types Ctrl-C into the session each time it receives, for
+	// Cooked attaches, where the terminal turns the key into SIGINT.
+	Interrupt <-chan struct{}
+	// NoInput attaches output-only: Stdin is never read and, if it is a
+	// terminal, left in its current mode. The attach ends by cancelling
+	// its context, Duration, or the session ending.
+	NoInput bool
+	// Duration detaches once the attach has lasted this long; zero means
+	// no limit.
+	Duration time.Duration
+	// Force attaches even if the session is locked; the daemon allows it
+	// only for the session's owner.
+	Force bool
+	// Direct asks the daemon to lend the session's terminal, to read and
+	// write it here rather than have the daemon relay every byte. The
+	// daemon relays as usual when it needs the output itself. Ignored
+	// when ReadOnly.
+	Direct bool
+	// Tee, when set, also receives the session's output, buffered until
+	// the attach ends. If writing to it fails the user is told once and
+	// the attach carries on without it.
+	Tee io.Writer
+	// TeeTimestamps starts each line copied to Tee with the time the
+	// output it begins arrived.
+	TeeTimestamps bool
+	// NoScreenReset leaves the terminal's screen modes as the session left
+	// them. Otherwise, when the attachment ends other than by detaching,
+	// the cursor, alternate screen, attributes and line wrap are reset.
+	NoScreenReset bool
+	// NoAltScreen leaves the terminal on whichever screen it is on when
+	// attaching and detaching. Otherwise the client follows the session
+	// onto the alternate screen when a full-screen program has it there,
+	// and detaching leaves it again, with the cursor shown, so the shell
+	// is back on the screen it was.
+	NoAltScreen bool
+	// Raw attaches as a plain byte pipe for programs driving the session,
+	// such as expect: Stdin is not put into raw mode, nothing is printed,
+	// no keys are bound and no size is sent. Stdin reaching end of file
+	// detaches. Of the other options only ReadOnly, NoInput, Duration,
+	// Force, PID and OnAttach apply.
+	Raw bool
+	// DropOutput, when positive, lets no more than this many bytes of
+	// output wait for a Stdout that cannot keep up, such as a terminal on
+	// a slow serial line: beyond it, all but the latest output is skipped,
+	// which a line on Stdout notes, and the session is asked to repaint.
+	// Tee still gets all of it.
+	DropOutput int
+	// Exec is typed into the session once it has drawn after attaching,
+	// before handing over to the user. Ignored when ReadOnly.
+	Exec []byte
+	// PID is the session's process as its metadata records it; the daemon
+	// answering the socket must report the same one. 0 skips the check.
+	PID int
+	// Version is this build of sess, and DaemonVersion the one the
+	// session's metadata says started it. When both are known and differ,
+	// attaching warns that the session runs other code than this.
+	Version       string
+	DaemonVersion string
+	// OnAttach runs each time a daemon accepts the client, with the number
+	// of the session attached to.
+	OnAttach func(number string)
+	// Previous returns the session to switch to from the current one, and
+	// the PID its metadata records for the daemon to confirm. When set,
+	// pressing the detach key (or prefix) twice, or following it with
+	// '-', switches instead of detaching.
+	Previous func(current string) (number, socketPath string, pid int, err error)
+}
+
 type Client struct {
 	sessionNum   string
 	socketPath   string
+	opts         Options
+	stdinFile    *os.File
+	mu           sync.Mutex // guards sessionNum, conn, rawMode, pty, end and detaching across switches
 	conn         net.Conn
 	rawMode      *protocol.RawMode
+	pty          *directPTY // the session's terminal, if the daemon lent it
+	pixels       bool       // the daemon takes the size in pixels too
+	end          ending
+	detaching    bool // DISCONNECT has been sent
+	keys         Keys
+	keyMu        sync.Mutex // guards armed and armGen
+	armed        bool
+	armGen       int
+	tee          *tee
+	pred         *predictor   // shows keystrokes before their echo, if predicting
+	outQueue     *outputQueue // output waiting for Stdout, if DropOutput is set
+	altMu        sync.Mutex   // serialises writes to alt across switches
+	alt          protocol.AltScreen
 	oldTermState *term.State
+	// savedTermios is oldTermState as the kernel has it, for restoring
+	// while discarding input that arrived in raw mode.
+	savedTermios *unix.Termios
+	nonblocking  bool // stdin was made non-blocking by setupTerminal
+	cleanupOnce  sync.Once
 	winSize      *Winsize
-	disableCtrlX bool
+	output       chan struct{} // closed on the first output after attaching
+	outputOnce   sync.Once
 	done         chan struct{}
 	doneOnce     sync.Once
 	wg           sync.WaitGroup
 }
 
-func New(sessionNum, socketPath string, disableCtrlX bool) *Client {
-	return &Client{
-		sessionNum:   sessionNum,
-		socketPath:   socketPath,
-		disableCtrlX: disableCtrlX,
-		done:         make(chan struct{}),
+func New(sessionNum, socketPath string, opts Options) *Client {
+	if opts.Stdin == nil {
+		opts.Stdin = os.Stdin
+	}
+	if opts.Stdout == nil {
+		opts.Stdout = os.Stdout
+	}
+	c := &Client{
+		sessionNum: sessionNum,
+		socketPath: socketPath,
+		opts:       opts,
+		keys:       opts.Keys,
+		output:     make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	if c.keys.Prefix == 0 {
+		c.keys = DefaultKeys
+	}
+	if f, ok := opts.Stdin.(*os.File); ok {
+		c.stdinFile = f
 	}
+	if opts.Tee != nil {
+		c.tee = newTee(opts.Tee, opts.TeeTimestamps)
+	}
+	if opts.DropOutput > 0 {
+		c.outQueue = newOutputQueue(opts.DropOutput)
+	}
+	return c
 }
 
 func debugf(format string, args ...interface{}) {
@@ -54,97 +239,386 @@ func debugf(format string, args ...interface{}) {
 	}
 }
 
-func (c *Client) Attach() error {
+// Attach connects to the session and relays data until the session ends,
+// the user detaches, or ctx is cancelled (which detaches cleanly). It
+// returns an *ExitError if the session's command ended with a non-zero
+// status or a signal, and an error wrapping utils.ErrConnectionLost if the
+// connection broke without the daemon saying why.
+func (c *Client) Attach(ctx context.Context) error {
+	if c.opts.Raw {
+		return c.attachRaw(ctx)
+	}
 	conn, err := net.DialTimeout("unix", c.socketPath, connectTimeout)
 	if err != nil {
-		return fmt.Errorf("failed to connect to session: %w", err)
+		return fmt.Errorf("%w: %w", utils.ErrConnectionFailed, err)
 	}
-	c.conn = conn
-	c.rawMode = protocol.NewRawMode(conn)
-
-	buffer := make([]byte, 256)
-	conn.SetReadDeadline(time.Now().Add(connectTimeout))
-	n, err := conn.Read(buffer)
+	rm, pty, ready, err := c.handshake(conn, c.sessionNum, c.opts.PID)
 	if err != nil {
 		conn.Close()
-		return fmt.Errorf("failed to read initial response: %w", err)
+		return err
 	}
-
-	response := string(buffer[:n])
-	if response != "READY\n" {
-		conn.Close()
-		return fmt.Errorf("unexpected response: %s", response)
+	if c.sessionNum == "" {
+		c.sessionNum = ready.Session
+	}
+	c.conn = conn
+	c.rawMode = rm
+	c.pty = pty
+	c.pixels = ready.Pixels
+	if c.opts.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.opts.Duration)
+		defer cancel()
 	}
 
 	if err := c.setupTerminal(); err != nil {
 		conn.Close()
-		return fmt.Errorf("failed to setup terminal: %w", err)
+		if pty != nil {
+			pty.f.Close()
+		}
+		return err
+	}
+	if (c.opts.Predict || c.opts.PredictAfter > 0) && c.oldTermState != nil && !c.opts.ReadOnly && c.outQueue == nil {
+		after := c.opts.PredictAfter
+		if c.opts.Predict {
+			after = 0
+		}
+		c.pred = newPredictor(c.opts.Stdout, after)
 	}
 
-	// Send initial terminal size to the daemon so the PTY matches
-	// our current window width/height immediately on attach.
-	c.handleResize()
+	if c.opts.OnAttach != nil {
+		c.opts.OnAttach(c.sessionNum)
+	}
 
-	c.setupSignalHandlers()
-	c.run()
+	// A daemon that did not take the size along with the handshake is
+	// sent it now, so the PTY matches the window straight away.
+	c.followScreen(ready.AltScreen)
+	if !ready.Sized {
+		c.handleResize()
+	}
+	c.requestRedraw()
+	if len(c.opts.Exec) > 0 && !c.opts.ReadOnly {
+		go c.sendExec()
+	}
 
-	return nil
+	c.watch(ctx)
+	return c.run()
 }
 
-func (c *Client) setupTerminal() error {
-	// Check if stdin is a terminal
-	if !term.IsTerminal(int(os.Stdin.Fd())) {
-		return fmt.Errorf("stdin is not a terminal")
+// handshake announces the client on conn and waits for the daemon to
+// accept it, checking that the daemon serves session number and, when pid
+// is not 0, runs the process pid. It returns the connection ready to relay
+// the session, holding any output that arrived along with READY, the
+// session's terminal if the daemon lent it, and how the daemon introduced
+// itself.
+func (c *Client) handshake(conn net.Conn, number string, pid int) (*protocol.RawMode, *directPTY, protocol.ReadyPayload, error) {
+	var ready protocol.ReadyPayload
+	hello := protocol.ConnectPayload{
+		Mode:     protocol.ModeAttach,
+		TTY:      c.ttyName(),
+		SSH:      os.Getenv("SSH_CONNECTION"),
+		NoResize: c.opts.NoResize,
+		Framed:   true,
+		Force:    c.opts.Force,
+		Direct:   c.opts.Direct,
+	}
+	if c.opts.ReadOnly {
+		hello.Mode = protocol.ModePeek
+		hello.Direct = false
+	}
+	size := c.resizePayload()
+	if !c.opts.ReadOnly && !c.opts.NoResize {
+		hello.Size = size
+	}
+	data, err := protocol.EncodeMessage(protocol.MsgConnect, hello)
+	if err != nil {
+		return nil, nil, ready, err
+	}
+	conn.SetWriteDeadline(time.Now().Add(connectTimeout))
+	if _, err := conn.Write(data); err != nil {
+		return nil, nil, ready, fmt.Errorf("%w: failed to send handshake: %v", utils.ErrConnectionFailed, err)
 	}
 
-	oldState, err := term.MakeRaw(int(os.Stdin.Fd()))
+	var line, rest []byte
+	var f *os.File
+	deadline := time.Now().Add(connectTimeout)
+	if uc, ok := conn.(*net.UnixConn); ok && hello.Direct {
+		line, rest, f, err = readRights(uc, deadline)
+	} else {
+		line, rest, err = readLine(conn, deadline)
+	}
 	if err != nil {
-		return err
+		return nil, nil, ready, fmt.Errorf("%w: failed to read initial response: %v", utils.ErrConnectionFailed, err)
+	}
+	if f != nil {
+		// Closed unless the daemon lent it in a READY this client takes.
+		defer func() {
+			if f != nil {
+				f.Close()
+			}
+		}()
 	}
-	c.oldTermState = oldState
 
-	// GetSize returns width, height
-	width, height, err := term.GetSize(int(os.Stdin.Fd()))
+	msg, err := protocol.ParseMessage(line)
 	if err != nil {
-		term.Restore(int(os.Stdin.Fd()), oldState)
-		return err
+		return nil, nil, ready, fmt.Errorf("unexpected response: %s", line)
+	}
+	switch msg.Type {
+	case protocol.MsgReady:
+		if err := msg.Decode(&ready); err != nil {
+			return nil, nil, ready, fmt.Errorf("malformed READY: %w", err)
+		}
+		if err := checkReady(ready, number, pid); err != nil {
+			return nil, nil, ready, err
+		}
+		if ready.Sized {
+			c.winSize = &Winsize{Rows: size.Rows, Cols: size.Cols}
+		}
+		var pty *directPTY
+		if ready.Direct {
+			if f == nil {
+				return nil, nil, ready, fmt.Errorf("session %s lent its terminal but it did not arrive", number)
+			}
+			pty, f = &directPTY{f: f}, nil
+		}
+		rm := c.newRawMode(conn, ready.Framed)
+		rm.Unread(rest)
+		return rm, pty, ready, nil
+	case protocol.MsgError:
+		var e protocol.ErrorPayload
+		msg.Decode(&e)
+		return nil, nil, ready, daemonError(e)
+	default:
+		return nil, nil, ready, fmt.Errorf("unexpected response: %s", msg.Type)
+	}
+}
+
+// readLine reads from conn until deadline for the first line, returning it
+// with its newline and whatever was read past it. A line that does not fit
+// the reader's buffer is an error.
+func readLine(conn net.Conn, deadline time.Time) (line, rest []byte, err error) {
+	conn.SetReadDeadline(deadline)
+	reader := bufio.NewReaderSize(conn, 4096)
+	line, err = reader.ReadSlice('\n')
+	if err != nil {
+		return nil, nil, err
+	}
+	rest, _ = reader.Peek(reader.Buffered())
+	return line, rest, nil
+}
+
+// newRawMode wraps the data connection to a session, unframing its output
+// if the daemon frames it.
+func (c *Client) newRawMode(conn net.Conn, framed bool) *protocol.RawMode {
+	if !framed {
+		return protocol.NewRawMode(conn)
+	}
+	return protocol.NewFramedRawMode(conn, c.handleControl)
+}
+
+// handleControl acts on a control message the daemon sent among the
+// session's output.
+func (c *Client) handleControl(msg *protocol.Message) {
+	switch msg.Type {
+	case protocol.MsgPong:
+		debugf("PONG")
+	case protocol.MsgExit:
+		end := ending{kind: endExited}
+		msg.Decode(&end.exit)
+		c.setEnding(end)
+	case protocol.MsgDetach:
+		var p protocol.DetachPayload
+		msg.Decode(&p)
+		c.setEnding(ending{kind: endRequested, reason: p.Reason})
+	case protocol.MsgFlow:
+		var f protocol.FlowPayload
+		msg.Decode(&f)
+		debugf("FLOW flushed %v, stopped %v", f.Flushed, f.Stopped)
+		if f.Flushed && c.outQueue != nil {
+			// Interrupted output need not be caught up with.
+			c.outQueue.discard()
+		}
+	case protocol.MsgError:
+		var e protocol.ErrorPayload
+		msg.Decode(&e)
+		if c.opts.Raw {
+			// Output is the session's alone.
+			debugf("daemon says: %s", e.Message)
+			break
+		}
+		c.notify("%s", e.Message)
+	default:
+		debugf("ignoring %s from daemon", msg.Type)
+	}
+}
+
+// daemonError turns an ERROR reply into an error, wrapping the sentinel
+// that matches its code.
+func daemonError(e protocol.ErrorPayload) error {
+	switch e.Code {
+	case protocol.ErrCodeBusy:
+		return utils.ErrSessionBusy
+	case protocol.ErrCodeDenied:
+		return fmt.Errorf("%w: %s", utils.ErrPermissionDenied, e.Message)
+	case protocol.ErrCodeLocked:
+		return &refusal{message: e.Message, sentinel: utils.ErrSessionLocked}
+	}
+	return fmt.Errorf("%s", e.Message)
+}
+
+// refusal is an ERROR reply whose message says all there is to say,
+// matching the sentinel for its code.
+type refusal struct {
+	message  string
+	sentinel error
+}
+
+func (r *refusal) Error() string { return r.message }
+func (r *refusal) Unwrap() error { return r.sentinel }
+
+// checkReady verifies the daemon that accepted the client is the one for
+// session number, unless number is empty. A READY without a payload comes
+// from a daemon older than the check and is trusted.
+func checkReady(ready protocol.ReadyPayload, number string, pid int) error {
+	if ready.Version == 0 {
+		return nil
+	}
+	if ready.Version != protocol.Version {
+		return fmt.Errorf("session %s runs protocol version %d, this sess speaks %d; restart the session to use this version", number, ready.Version, protocol.Version)
+	}
+	if number != "" && ready.Session != number {
+		return fmt.Errorf("socket for session %s is served by session %s (daemon pid %d)", number, ready.Session, ready.PID)
+	}
+	if pid != 0 && ready.ChildPID != pid {
+		return fmt.Errorf("session %s metadata names pid %d but its daemon runs pid %d", number, pid, ready.ChildPID)
+	}
+	return nil
+}
+
+// ttyName returns the device name of a terminal stdin, or "".
+func (c *Client) ttyName() string {
+	if !c.isTerminal() {
+		return ""
+	}
+	name, err := platform.TTYName(c.stdinFile.Fd())
+	if err != nil {
+		return ""
+	}
+	return name
+}
+
+// isTerminal reports whether stdin is an interactive terminal.
+func (c *Client) isTerminal() bool {
+	return c.stdinFile != nil && term.IsTerminal(int(c.stdinFile.Fd()))
+}
+
+func (c *Client) setupTerminal() error {
+	if c.opts.NoInput || !c.isTerminal() {
+		// Caller-provided streams, or input we don't take or that comes
+		// from a pipe or file: nothing to configure.
+		return nil
+	}
+
+	fd := int(c.stdinFile.Fd())
+	if !c.opts.Cooked {
+		if err := c.makeRaw(fd); err != nil {
+			return err
+		}
 	}
-	c.winSize = &Winsize{Rows: uint16(height), Cols: uint16(width)}
 
 	// Make stdin non-blocking so signal-triggered detach is immediate
 	// (otherwise readFromStdin could block until the next keystroke).
-	_ = unix.SetNonblock(int(os.Stdin.Fd()), true)
+	_ = unix.SetNonblock(fd, true)
+	c.nonblocking = true
+
+	return nil
+}
 
+// makeRaw puts the terminal on fd into raw mode, keeping its state for
+// restoreTerminal. A terminal that refuses, or takes only part of the
+// change, is put back as it was and an error wrapping utils.ErrNoRawMode
+// says why.
+func (c *Client) makeRaw(fd int) error {
+	saved, err := unix.IoctlGetTermios(fd, platform.IoctlGetTermios)
+	if err != nil {
+		return rawModeError(err)
+	}
+	oldState, err := term.MakeRaw(fd)
+	if err != nil {
+		// tcsetattr may have applied some of the change before failing.
+		unix.IoctlSetTermios(fd, platform.IoctlSetTermios, saved)
+		return rawModeError(err)
+	}
+	got, err := unix.IoctlGetTermios(fd, platform.IoctlGetTermios)
+	if err == nil && got.Lflag&(unix.ICANON|unix.ECHO|unix.ISIG) != 0 {
+		err = errors.New("the terminal kept line editing or echo on")
+	}
+	if err != nil {
+		if unix.IoctlSetTermios(fd, platform.IoctlSetTermios, saved) != nil {
+			term.Restore(fd, oldState)
+		}
+		return rawModeError(err)
+	}
+	c.oldTermState = oldState
+	c.savedTermios = saved
 	return nil
 }
 
+// rawModeError explains err, met putting the terminal into raw mode, in
+// terms of what the user can do about it.
+func rawModeError(err error) error {
+	switch {
+	case errors.Is(err, unix.ENOTTY), errors.Is(err, unix.EINVAL):
+		return fmt.Errorf("%w: stdin does not behave as a terminal: %w", utils.ErrNoRawMode, err)
+	case errors.Is(err, unix.EIO), errors.Is(err, unix.EINTR):
+		return fmt.Errorf("%w: sess is not in the terminal's foreground; bring it there with fg: %w", utils.ErrNoRawMode, err)
+	case errors.Is(err, unix.EPERM), errors.Is(err, unix.EACCES):
+		return fmt.Errorf("%w: not allowed to change the terminal's mode: %w", utils.ErrNoRawMode, err)
+	}
+	return fmt.Errorf("%w: %w", utils.ErrNoRawMode, err)
+}
+
+// restoreTerminal puts the terminal back as setupTerminal found it. Input
+// not yet read, such as keys typed as the connection broke or a terminal's
+// answer to a query from the session, is discarded rather than left for
+// the shell to run.
 func (c *Client) restoreTerminal() {
-	if c.oldTermState != nil {
-		term.Restore(int(os.Stdin.Fd()), c.oldTermState)
+	if !c.nonblocking {
+		// Not a terminal we configured.
+		return
+	}
+	fd := int(c.stdinFile.Fd())
+	if c.savedTermios != nil {
+		if err := unix.IoctlSetTermios(fd, platform.IoctlSetTermiosFlush, c.savedTermios); err != nil {
+			term.Restore(fd, c.oldTermState)
+		}
+	} else if c.oldTermState != nil {
+		term.Restore(fd, c.oldTermState)
 	}
 	// Restore blocking mode on stdin
-	_ = unix.SetNonblock(int(os.Stdin.Fd()), false)
+	_ = unix.SetNonblock(fd, false)
 }
 
-func (c *Client) setupSignalHandlers() {
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGWINCH, syscall.SIGUSR1)
-
+// watch detaches when ctx is cancelled, forwards resize requests and keeps
+// the connection alive.
+func (c *Client) watch(ctx context.Context) {
 	go func() {
+		keepalive := time.NewTicker(keepaliveInterval)
+		defer keepalive.Stop()
 		for {
 			select {
-			case sig := <-sigChan:
-				switch sig {
-				case syscall.SIGINT, syscall.SIGTERM:
-					debugf("got signal %v -> closing", sig)
-					c.closeDone()
-					return
-				case syscall.SIGWINCH:
-					c.handleResize()
-				case syscall.SIGUSR1:
-					debugf("got SIGUSR1 -> detach")
-					c.detach()
-					return
+			case <-ctx.Done():
+				debugf("context done -> detach")
+				c.detach()
+				return
+			case <-c.opts.Resize:
+				c.handleResize()
+			case <-c.opts.Interrupt:
+				c.forward([]byte{keyCtrlC})
+			case <-keepalive.C:
+				// Daemons that don't frame their output would echo
+				// the reply into the session's.
+				if c.session().Framed() {
+					c.SendPing()
 				}
 			case <-c.done:
 				return
@@ -153,31 +627,133 @@ func (c *Client) setupSignalHandlers() {
 	}()
 }
 
-func (c *Client) handleResize() {
+func (c *Client) size() (int, int, error) {
+	if c.opts.Size != nil {
+		return c.opts.Size()
+	}
+	if !c.isTerminal() {
+		return 0, 0, fmt.Errorf("no size available")
+	}
 	// GetSize returns width, height
-	width, height, err := term.GetSize(int(os.Stdin.Fd()))
+	width, height, err := term.GetSize(int(c.stdinFile.Fd()))
+	return height, width, err
+}
+
+// pixelSize returns the terminal's size in pixels, or zeros when it is not
+// known: the terminal does not say, or Size gives the size instead.
+func (c *Client) pixelSize() (x, y int) {
+	if c.opts.Size != nil || !c.isTerminal() {
+		return 0, 0
+	}
+	ws, err := unix.IoctlGetWinsize(int(c.stdinFile.Fd()), unix.TIOCGWINSZ)
 	if err != nil {
+		return 0, 0
+	}
+	return int(ws.Xpixel), int(ws.Ypixel)
+}
+
+// resizePayload returns the size to give the session, or nil if there is
+// none to give.
+func (c *Client) resizePayload() *protocol.ResizePayload {
+	height, width, err := c.size()
+	if err != nil || height <= 0 || width <= 0 {
+		return nil
+	}
+	size := &protocol.ResizePayload{Rows: uint16(height), Cols: uint16(width)}
+	if x, y := c.pixelSize(); x > 0 && y > 0 {
+		size.XPixel, size.YPixel = uint16(x), uint16(y)
+	}
+	return size
+}
+
+func (c *Client) handleResize() {
+	if c.opts.ReadOnly || c.opts.NoResize {
 		return
 	}
-	c.winSize = &Winsize{Rows: uint16(height), Cols: uint16(width)}
+	size := c.resizePayload()
+	if size == nil {
+		return
+	}
+	c.winSize = &Winsize{Rows: size.Rows, Cols: size.Cols}
+	c.mu.Lock()
+	rm, pixels := c.rawMode, c.pixels
+	c.mu.Unlock()
 	// Notify daemon of resize
-	msg := fmt.Sprintf("RESIZE %d %d\n", height, width)
+	height, width := int(size.Rows), int(size.Cols)
+	if x, y := int(size.XPixel), int(size.YPixel); pixels && x > 0 && y > 0 {
+		debugf("sending resize rows=%d cols=%d pixels=%dx%d", height, width, x, y)
+		_ = rm.Write(protocol.ResizePixelsLine(height, width, x, y))
+		return
+	}
 	debugf("sending resize rows=%d cols=%d", height, width)
-	_ = c.rawMode.Write([]byte(msg))
+	_ = rm.Write(protocol.ResizeLine(height, width))
+}
+
+// session returns the connection to the session currently attached to.
+func (c *Client) session() *protocol.RawMode {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rawMode
+}
+
+// terminal returns the terminal of the session currently attached to, if
+// its daemon lent it.
+func (c *Client) terminal() *directPTY {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.pty
+}
+
+// number returns the number of the session currently attached to.
+func (c *Client) number() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sessionNum
 }
 
-func (c *Client) run() {
-	fmt.Printf("Attaching to session %s\r\n", c.sessionNum)
+func (c *Client) run() error {
+	if !c.opts.Quiet {
+		if c.keys != DefaultKeys && !c.opts.DisableCtrlX {
+			fmt.Fprintf(c.opts.Stdout, "Attaching to session %s (detach with %s)\r\n", c.sessionNum, c.keys)
+		} else {
+			fmt.Fprintf(c.opts.Stdout, "Attaching to session %s\r\n", c.sessionNum)
+		}
+	}
+	if v, dv := c.opts.Version, c.opts.DaemonVersion; v != "" && dv != "" && v != dv {
+		fmt.Fprintf(c.opts.Stdout, "Warning: session %s was started by sess %s; this is sess %s\r\n", c.sessionNum, dv, v)
+	}
 
-	c.wg.Add(2)
-	go c.readFromSession()
-	go c.readFromStdin()
+	if c.outQueue != nil {
+		c.wg.Add(1)
+		go c.writeOutput(c.outQueue)
+	}
+	c.wg.Add(1)
+	go c.readFromSession(c.rawMode)
+	c.startPTY(c.pty)
+	switch {
+	case c.opts.NoInput:
+	case c.isTerminal():
+		// Non-blocking terminal reads notice c.done promptly, so the
+		// stdin loop can be waited for.
+		c.wg.Add(1)
+		go func() {
+			defer c.wg.Done()
+			c.readFromStdin()
+		}()
+	default:
+		// An arbitrary reader may block indefinitely; don't wait on it.
+		go c.readFromStdin()
+	}
 
 	c.wg.Wait()
-	c.cleanup()
+	end := c.ending()
+	c.cleanup(end)
+	return end.err(c.number())
 }
 
-func (c *Client) readFromSession() {
+// readFromSession relays output from rm until it fails. Once a switch has
+// replaced rm, its failure no longer ends the attach.
+func (c *Client) readFromSession(rm *protocol.RawMode) {
 	defer c.wg.Done()
 
 	for {
@@ -185,23 +761,79 @@ func (c *Client) readFromSession() {
 		case <-c.done:
 			return
 		default:
-			data, err := c.rawMode.Read()
+			data, err := rm.Read()
 			if err != nil {
+				if rm != c.session() {
+					return
+				}
 				debugf("readFromSession error: %v", err)
+				c.lose(rm)
 				c.closeDone()
 				return
 			}
 
-			if data != nil && len(data) > 0 {
-				os.Stdout.Write(data)
+			if len(data) > 0 {
+				c.show(data)
 			}
 		}
 	}
 }
 
-func (c *Client) readFromStdin() {
-	defer c.wg.Done()
+// startPTY starts reading the session's output from p, if the daemon lent
+// its terminal.
+func (c *Client) startPTY(p *directPTY) {
+	if p != nil && p.start() {
+		c.wg.Add(1)
+		go c.readFromPTY(p)
+	}
+}
+
+// show writes a chunk of the session's output to the terminal.
+func (c *Client) show(data []byte) {
+	switch {
+	case c.outQueue != nil:
+		c.outQueue.push(data)
+	case c.pred != nil:
+		c.pred.output(data)
+	default:
+		c.opts.Stdout.Write(data)
+	}
+	c.altMu.Lock()
+	c.alt.Write(data)
+	c.altMu.Unlock()
+	c.copyToTee(data)
+	c.outputOnce.Do(func() { close(c.output) })
+}
+
+// copyToTee copies session output to opts.Tee, if set.
+func (c *Client) copyToTee(data []byte) {
+	if c.tee == nil {
+		return
+	}
+	if err := c.tee.write(data, time.Now()); err != nil {
+		c.notify("no longer copying output: %v", err)
+	}
+}
+
+// sendExec types opts.Exec once the session has started drawing after the
+// attach, or after execDelay if it stays quiet, so the keys don't land in
+// the middle of a repaint.
+func (c *Client) sendExec() {
+	select {
+	case <-c.output:
+		time.Sleep(execSettle)
+	case <-time.After(execDelay):
+	case <-c.done:
+		return
+	}
+	c.keyMu.Lock()
+	defer c.keyMu.Unlock()
+	if !c.forward(c.opts.Exec) {
+		c.closeDone()
+	}
+}
 
+func (c *Client) readFromStdin() {
 	buffer := make([]byte, 1024)
 	for {
 		// Non-blocking read so we can notice c.done promptly
@@ -211,7 +843,7 @@ func (c *Client) readFromStdin() {
 		default:
 		}
 
-		n, err := os.Stdin.Read(buffer)
+		n, err := c.opts.Stdin.Read(buffer)
 		if err != nil {
 			// EAGAIN/EWOULDBLOCK: no input ready; check done and retry
 			if errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EWOULDBLOCK) {
@@ -222,8 +854,14 @@ func (c *Client) readFromStdin() {
 			if errors.Is(err, syscall.EINTR) {
 				continue
 			}
-			// EOF: no further stdin; stay attached and keep reading from session
+			// EOF: no further stdin; detach if asked to, otherwise stay
+			// attached and keep reading from session
 			if errors.Is(err, io.EOF) {
+				if c.opts.DetachOnEOF || c.opts.Cooked {
+					debugf("stdin EOF -> detach")
+					c.detach()
+					return
+				}
 				debugf("stdin EOF; staying attached")
 				time.Sleep(20 * time.Millisecond)
 				continue
@@ -233,42 +871,444 @@ func (c *Client) readFromStdin() {
 			return
 		}
 
-		if n > 0 {
-			// Ctrl-X (0x18) to detach if pressed alone (unless disabled)
-			if !c.disableCtrlX && n == 1 && buffer[0] == 0x18 {
-				c.detach()
-				return
-			}
-			if err := c.rawMode.Write(buffer[:n]); err != nil {
-				c.closeDone()
-				return
-			}
+		data := buffer[:n]
+		if c.opts.Cooked && n > 0 && data[n-1] == '\n' {
+			data[n-1] = '\r'
+		}
+		if n > 0 && c.handleInput(data) {
+			c.closeDone()
+			return
 		}
 	}
 }
 
 func (c *Client) detach() {
-	c.rawMode.Write([]byte("DISCONNECT\n"))
+	// The daemon may hang up on the DISCONNECT before done is closed;
+	// that is the detach, not a lost connection.
+	c.mu.Lock()
+	c.detaching = true
+	c.mu.Unlock()
+	// The daemon takes its terminal back on the DISCONNECT.
+	if p := c.terminal(); p != nil {
+		p.stop()
+	}
+	c.session().Write(protocol.DisconnectLine)
 	c.closeDone()
 }
 
-func (c *Client) cleanup() {
-	c.restoreTerminal()
+// switchPrevious moves the attach to the session chosen by opts.Previous,
+// keeping the terminal as it is. When the target cannot be reached a short
+// message is shown and the client stays where it is.
+func (c *Client) switchPrevious() {
+	number, socketPath, pid, err := c.opts.Previous(c.number())
+	if err != nil {
+		c.notify("%v", err)
+		return
+	}
+	conn, err := net.DialTimeout("unix", socketPath, connectTimeout)
+	if err != nil {
+		c.notify("session %s is not reachable", number)
+		return
+	}
+	rm, pty, ready, err := c.handshake(conn, number, pid)
+	if err != nil {
+		conn.Close()
+		c.notify("cannot switch to session %s: %v", number, err)
+		return
+	}
+
+	c.mu.Lock()
+	old, oldPTY := c.rawMode, c.pty
+	c.sessionNum, c.conn, c.rawMode, c.pty = number, conn, rm, pty
+	c.pixels = ready.Pixels
+	c.end = ending{}
+	c.mu.Unlock()
 
-	if c.rawMode != nil {
-		c.rawMode.Close()
+	c.wg.Add(1)
+	go c.readFromSession(rm)
+	c.startPTY(pty)
+	if oldPTY != nil {
+		oldPTY.stop()
+	}
+	old.Write(protocol.DisconnectLine)
+	old.Close()
+	if oldPTY != nil {
+		oldPTY.f.Close()
 	}
 
-	fmt.Printf("\r\nDetached from session %s\r\n", c.sessionNum)
+	debugf("switched to session %s", number)
+	if c.opts.OnAttach != nil {
+		c.opts.OnAttach(number)
+	}
+	c.followScreen(ready.AltScreen)
+	c.redraw()
+}
+
+// followScreen puts the terminal on the screen a session just attached to
+// is on, which READY reports as alt.
+func (c *Client) followScreen(alt bool) {
+	c.altMu.Lock()
+	was := c.alt.On()
+	c.alt.Set(alt)
+	c.altMu.Unlock()
+	if c.oldTermState == nil || c.opts.NoAltScreen || alt == was {
+		return
+	}
+	c.clearPredictions()
+	if alt {
+		fmt.Fprint(c.opts.Stdout, protocol.EnterAltScreen)
+	} else {
+		fmt.Fprint(c.opts.Stdout, protocol.LeaveAltScreen)
+	}
+}
+
+// redraw clears the local screen and has the session repaint into it.
+func (c *Client) redraw() {
+	c.clearPredictions()
+	fmt.Fprint(c.opts.Stdout, "\x1b[H\x1b[2J")
+	c.handleResize()
+	c.requestRedraw()
+}
+
+// requestRedraw asks the daemon to nudge the foreground program into
+// repainting, which full-screen programs otherwise only do on their own.
+func (c *Client) requestRedraw() {
+	if c.opts.NoRedraw {
+		return
+	}
+	_ = c.session().Write(protocol.RedrawLine(c.opts.RedrawCtrlL))
+}
+
+// clearPredictions takes back any keystrokes shown before their echo,
+// ahead of writing something other than the session's output.
+func (c *Client) clearPredictions() {
+	if c.pred != nil {
+		c.pred.clear()
+	}
+}
+
+// notify shows a one-line message from sess itself in the attached terminal.
+func (c *Client) notify(format string, args ...interface{}) {
+	c.clearPredictions()
+	fmt.Fprintf(c.opts.Stdout, "\r\n[sess: "+format+"]\r\n", args...)
+}
+
+// cleanup restores the terminal, closes the connection and tells the user
+// how the attachment ended. It runs once, however many ways the attachment
+// ends at the same time.
+func (c *Client) cleanup(end ending) {
+	c.cleanupOnce.Do(func() {
+		c.clearPredictions()
+		c.restoreTerminal()
+
+		if rm := c.session(); rm != nil {
+			rm.Close()
+		}
+		if p := c.terminal(); p != nil {
+			p.f.Close()
+		}
+
+		if c.tee != nil {
+			if err := c.tee.flush(); err != nil {
+				c.notify("output not all copied: %v", err)
+			}
+		}
+
+		// A program in the session that ended, or lost its daemon, never
+		// got to undo what it did to the screen.
+		if end.kind != endDetached && c.oldTermState != nil && !c.opts.NoScreenReset {
+			fmt.Fprint(c.opts.Stdout, screenReset)
+		}
+		// A program left running full-screen would otherwise leave the
+		// shell on its last frame.
+		if end.kind == endDetached && c.oldTermState != nil && !c.opts.NoAltScreen && c.alt.On() {
+			fmt.Fprint(c.opts.Stdout, protocol.LeaveAltScreen+"\x1b[?25h")
+		}
+
+		if !c.opts.Quiet {
+			fmt.Fprintf(c.opts.Stdout, "\r\n%s\r\n", end.banner(c.number()))
+		}
+	})
+}
+
+// setEnding records what the daemon said about closing the connection.
+func (c *Client) setEnding(end ending) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.end = end
+}
+
+// lose records that the connection rm broke, unless the attachment was
+// already ending or the daemon said why it closed. A daemon that does not
+// frame its output cannot say, so its closing is taken as a detach.
+func (c *Client) lose(rm *protocol.RawMode) {
+	select {
+	case <-c.done:
+		return
+	default:
+	}
+	if !rm.Framed() {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.end.kind == endDetached && !c.detaching {
+		c.end.kind = endLost
+	}
+}
+
+// ending returns how the attachment ended.
+func (c *Client) ending() ending {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.end
 }
 
 func (c *Client) SendPing() error {
-	_, err := c.conn.Write([]byte("PING\n"))
-	return err
+	return c.session().Write(protocol.PingLine)
 }
 
 func (c *Client) closeDone() {
 	c.doneOnce.Do(func() {
 		close(c.done)
+		if p := c.terminal(); p != nil {
+			p.drain()
+		}
 	})
 }
+
+// request makes a one-shot control request to the daemon listening on
+// socketPath and returns its reply. An ERROR reply is returned as an error.
+func request(socketPath, msgType string, payload interface{}, timeout time.Duration) (*protocol.Message, error) {
+	conn, err := net.DialTimeout("unix", socketPath, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	pc := protocol.NewConnection(conn)
+	if err := pc.SendMessage(msgType, payload); err != nil {
+		return nil, err
+	}
+	// Read under timeout: pc.ReadMessage would wait its own 5 seconds.
+	msg, err := protocol.ReadMessageFrom(bufio.NewReader(conn))
+	if err != nil {
+		return nil, err
+	}
+	if msg.Type == protocol.MsgError {
+		var e protocol.ErrorPayload
+		msg.Decode(&e)
+		return nil, daemonError(e)
+	}
+	return msg, nil
+}
+
+// SendInput types data into the session listening on socketPath without
+// attaching to it. Long input is sent in several requests so each fits the
+// daemon's message size limit.
+func SendInput(socketPath string, data []byte, timeout time.Duration) error {
+	for len(data) > 0 {
+		chunk := data
+		if len(chunk) > inputChunkSize {
+			chunk = chunk[:inputChunkSize]
+		}
+		data = data[len(chunk):]
+
+		msg, err := request(socketPath, protocol.MsgInput, protocol.InputPayload{Data: chunk}, timeout)
+		if err != nil {
+			return err
+		}
+		if msg.Type != protocol.MsgReady {
+			return fmt.Errorf("unexpected response: %s", msg.Type)
+		}
+	}
+	return nil
+}
+
+// SendSignal has the daemon listening on socketPath deliver sig to the
+// session's foreground job, or to its shell.
+func SendSignal(socketPath string, sig syscall.Signal, shell bool, timeout time.Duration) error {
+	msg, err := request(socketPath, protocol.MsgSignal, protocol.SignalPayload{Signal: int(sig), Shell: shell}, timeout)
+	if err != nil {
+		return err
+	}
+	if msg.Type != protocol.MsgReady {
+		return fmt.Errorf("unexpected response: %s", msg.Type)
+	}
+	return nil
+}
+
+// DetachAll has the daemon listening on socketPath disconnect all its
+// clients, telling them reason.
+func DetachAll(socketPath, reason string, timeout time.Duration) error {
+	msg, err := request(socketPath, protocol.MsgDetach, protocol.DetachPayload{Reason: reason}, timeout)
+	if err != nil {
+		return err
+	}
+	if msg.Type != protocol.MsgReady {
+		return fmt.Errorf("unexpected response: %s", msg.Type)
+	}
+	return nil
+}
+
+// Upgrade has the daemon listening on socketPath hand its session over to
+// the sess binary at exe, which it re-executes in place.
+func Upgrade(socketPath, exe string, timeout time.Duration) error {
+	msg, err := request(socketPath, protocol.MsgUpgrade, protocol.UpgradePayload{Executable: exe}, timeout)
+	if err != nil {
+		if err.Error() == fmt.Sprintf("unknown request %q", protocol.MsgUpgrade) {
+			// A daemon from before upgrades existed.
+			return errors.New("its daemon is too old to be upgraded in place, and runs its old code until the session is restarted")
+		}
+		return err
+	}
+	if msg.Type != protocol.MsgReady {
+		return fmt.Errorf("unexpected response: %s", msg.Type)
+	}
+	return nil
+}
+
+// SendEnv has the daemon listening on socketPath set and unset variables in
+// its own environment.
+func SendEnv(socketPath string, set map[string]string, unset []string, timeout time.Duration) error {
+	msg, err := request(socketPath, protocol.MsgEnv, protocol.EnvPayload{Set: set, Unset: unset}, timeout)
+	if err != nil {
+		return err
+	}
+	if msg.Type != protocol.MsgReady {
+		return fmt.Errorf("unexpected response: %s", msg.Type)
+	}
+	return nil
+}
+
+// SetTriggers gives the daemon listening on socketPath the triggers to
+// watch its session's output for, in place of those it had.
+func SetTriggers(socketPath string, triggers []protocol.Trigger, timeout time.Duration) error {
+	msg, err := request(socketPath, protocol.MsgTriggers, protocol.TriggersPayload{Triggers: triggers}, timeout)
+	if err != nil {
+		return err
+	}
+	if msg.Type != protocol.MsgReady {
+		return fmt.Errorf("unexpected response: %s", msg.Type)
+	}
+	return nil
+}
+
+// SetTimeout changes when the session listening on socketPath expires, as
+// req says, and returns when it now does, nil for never.
+func SetTimeout(socketPath string, req protocol.TimeoutPayload, timeout time.Duration) (*time.Time, error) {
+	msg, err := request(socketPath, protocol.MsgTimeout, req, timeout)
+	if err != nil {
+		return nil, err
+	}
+	var reply protocol.TimeoutReply
+	if msg.Type != protocol.MsgTimeout || msg.Decode(&reply) != nil {
+		return nil, fmt.Errorf("unexpected response: %s", msg.Type)
+	}
+	return reply.Expires, nil
+}
+
+// RequestDump has the daemon listening on socketPath write a dump of its
+// state to its log.
+func RequestDump(socketPath string, timeout time.Duration) error {
+	msg, err := request(socketPath, protocol.MsgDump, nil, timeout)
+	if err != nil {
+		return err
+	}
+	if msg.Type != protocol.MsgReady {
+		return fmt.Errorf("unexpected response: %s", msg.Type)
+	}
+	return nil
+}
+
+// FetchScrollback copies the output req asks for from the session listening
+// on socketPath to w and returns how many bytes it copied. timeout bounds
+// the request and each read of the transfer.
+func FetchScrollback(socketPath string, req protocol.ScrollbackPayload, w io.Writer, timeout time.Duration) (int64, error) {
+	conn, err := net.DialTimeout("unix", socketPath, timeout)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	data, err := protocol.EncodeMessage(protocol.MsgScrollback, req)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := conn.Write(data); err != nil {
+		return 0, err
+	}
+	reader := bufio.NewReader(conn)
+	msg, err := protocol.ReadMessageFrom(reader)
+	if err != nil {
+		return 0, err
+	}
+	switch msg.Type {
+	case protocol.MsgError:
+		var e protocol.ErrorPayload
+		msg.Decode(&e)
+		return 0, daemonError(e)
+	case protocol.MsgScrollback:
+	default:
+		return 0, fmt.Errorf("unexpected response: %s", msg.Type)
+	}
+	var reply protocol.ScrollbackReply
+	if err := msg.Decode(&reply); err != nil {
+		return 0, err
+	}
+
+	n, err := io.CopyN(w, deadlineReader{conn: conn, r: reader, timeout: timeout}, reply.Size)
+	if err == io.EOF {
+		err = fmt.Errorf("session sent %d of %d bytes", n, reply.Size)
+	}
+	return n, err
+}
+
+// deadlineReader reads from r, buffered over conn, giving each read its
+// own deadline.
+type deadlineReader struct {
+	conn    net.Conn
+	r       io.Reader
+	timeout time.Duration
+}
+
+func (d deadlineReader) Read(p []byte) (int, error) {
+	d.conn.SetReadDeadline(time.Now().Add(d.timeout))
+	return d.r.Read(p)
+}
+
+// Share has the daemon listening on socketPath change who its session is
+// shared with, and returns who it is shared with now.
+func Share(socketPath string, req protocol.SharePayload, timeout time.Duration) (*protocol.ShareStatus, error) {
+	msg, err := request(socketPath, protocol.MsgShare, req, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if msg.Type != protocol.MsgShare {
+		return nil, fmt.Errorf("unexpected response: %s", msg.Type)
+	}
+	var st protocol.ShareStatus
+	if err := msg.Decode(&st); err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
+
+// QueryStatus asks the daemon listening on socketPath for its status.
+func QueryStatus(socketPath string, timeout time.Duration) (*protocol.StatusPayload, error) {
+	msg, err := request(socketPath, protocol.MsgStatus, nil, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if msg.Type != protocol.MsgStatus {
+		return nil, fmt.Errorf("unexpected response: %s", msg.Type)
+	}
+
+	var st protocol.StatusPayload
+	if err := msg.Decode(&st); err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
@@ -0,0 +1,541 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/creack/pty"
+	"github.com/theMichaelB/sess/internal/platform"
+	"github.com/theMichaelB/sess/internal/utils"
+	"github.com/theMichaelB/sess/pkg/protocol"
+	"golang.org/x/sys/unix"
+)
+
+// fakeDaemon accepts one client on a temporary socket, answers its CONNECT
+// with reply in a single write and hangs up, as a daemon does once its
+// session has ended.
+func fakeDaemon(t *testing.T, reply []byte) string {
+	t.Helper()
+	socket := filepath.Join(t.TempDir(), "session-001.sock")
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		if _, err := r.ReadSlice('\n'); err != nil {
+			return
+		}
+		conn.Write(reply)
+	}()
+	return socket
+}
+
+func readyMessage(t *testing.T, framed bool) []byte {
+	t.Helper()
+	ready, err := protocol.EncodeMessage(protocol.MsgReady, protocol.ReadyPayload{Session: "001", Version: protocol.Version, Framed: framed})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ready
+}
+
+func dataFrame(data string) []byte {
+	frame := make([]byte, protocol.FrameHeaderSize+len(data))
+	protocol.WriteFrameHeader(frame, protocol.FrameData, len(data))
+	copy(frame[protocol.FrameHeaderSize:], data)
+	return frame
+}
+
+// Output the daemon sends in the same write as READY must reach the
+// terminal, not be parsed as part of the handshake or dropped.
+func TestOutputArrivingWithReady(t *testing.T) {
+	exit, err := protocol.EncodeControlFrame(protocol.MsgExit, protocol.ExitPayload{Status: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		reply []byte
+	}{
+		{"framed", bytes.Join([][]byte{readyMessage(t, true), dataFrame("first output\r\n"), exit}, nil)},
+		{"unframed", append(readyMessage(t, false), "first output\r\n"...)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			socket := fakeDaemon(t, tt.reply)
+			var out bytes.Buffer
+			c := New("001", socket, Options{
+				Stdin:  strings.NewReader(""),
+				Stdout: &out,
+				Size:   func() (int, int, error) { return 24, 80, nil },
+				Quiet:  true,
+			})
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := c.Attach(ctx); err != nil {
+				t.Fatalf("Attach: %v", err)
+			}
+			if ctx.Err() != nil {
+				t.Fatal("Attach did not return when the daemon hung up")
+			}
+			if !strings.Contains(out.String(), "first output") {
+				t.Errorf("output sent with READY was lost; terminal got %q", out.String())
+			}
+		})
+	}
+}
+
+func TestTeeTimestamps(t *testing.T) {
+	var out bytes.Buffer
+	tee := newTee(&out, true)
+	first := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	second := first.Add(1500 * time.Millisecond)
+	tee.write([]byte("one\ntw"), first)
+	tee.write([]byte("o\nthree\n"), second)
+	if err := tee.flush(); err != nil {
+		t.Fatal(err)
+	}
+	want := "2026-01-02T03:04:05.000Z one\n" +
+		"2026-01-02T03:04:05.000Z two\n" +
+		"2026-01-02T03:04:06.500Z three\n"
+	if out.String() != want {
+		t.Errorf("teed %q; want %q", out.String(), want)
+	}
+}
+
+// fullDisk fails every write, as a file on a full disk does.
+type fullDisk struct{}
+
+func (fullDisk) Write([]byte) (int, error) { return 0, errors.New("no space left on device") }
+
+// A tee that cannot be written costs the copy, not the attach.
+func TestTeeFailureKeepsAttach(t *testing.T) {
+	exit, err := protocol.EncodeControlFrame(protocol.MsgExit, protocol.ExitPayload{Status: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	big := strings.Repeat("x", 8192) // more than the tee buffers
+	socket := fakeDaemon(t, bytes.Join([][]byte{readyMessage(t, true), dataFrame(big), dataFrame("after\r\n"), exit}, nil))
+	var out bytes.Buffer
+	c := New("001", socket, Options{
+		Stdin:  strings.NewReader(""),
+		Stdout: &out,
+		Size:   func() (int, int, error) { return 24, 80, nil },
+		Quiet:  true,
+		Tee:    fullDisk{},
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.Attach(ctx); err != nil {
+		t.Fatalf("Attach: %v", err)
+	}
+	if !strings.Contains(out.String(), "after") {
+		t.Error("output stopped when the tee failed")
+	}
+	if n := strings.Count(out.String(), "no space left"); n != 1 {
+		t.Errorf("told about the failure %d times; want once:\n%q", n, out.String())
+	}
+}
+
+// stalledTerminal takes no output until released, as a terminal on a slow
+// line seems to.
+type stalledTerminal struct {
+	release chan struct{}
+	mu      sync.Mutex
+	out     bytes.Buffer
+}
+
+func (s *stalledTerminal) Write(p []byte) (int, error) {
+	<-s.release
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.out.Write(p)
+}
+
+// Output a stalled terminal falls behind on is skipped, leaving the latest.
+func TestDropOutput(t *testing.T) {
+	exit, err := protocol.EncodeControlFrame(protocol.MsgExit, protocol.ExitPayload{Status: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	frames := [][]byte{readyMessage(t, true)}
+	for i := 0; i < 64; i++ {
+		frames = append(frames, dataFrame(strings.Repeat("x", 1023)+"\n"))
+	}
+	frames = append(frames, dataFrame("latest\r\n"), exit)
+	socket := fakeDaemon(t, bytes.Join(frames, nil))
+	term := &stalledTerminal{release: make(chan struct{})}
+	c := New("001", socket, Options{
+		Stdin:      strings.NewReader(""),
+		Stdout:     term,
+		Size:       func() (int, int, error) { return 24, 80, nil },
+		Quiet:      true,
+		NoRedraw:   true,
+		DropOutput: 8 << 10,
+	})
+	time.AfterFunc(100*time.Millisecond, func() { close(term.release) })
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.Attach(ctx); err != nil {
+		t.Fatalf("Attach: %v", err)
+	}
+	out := term.out.String()
+	if !strings.HasSuffix(out, "latest\r\n") {
+		t.Errorf("terminal did not end with the latest output: %q", out[max(0, len(out)-40):])
+	}
+	if !strings.Contains(out, "[sess: skipped ") || len(out) > 16<<10 {
+		t.Errorf("terminal got %d bytes, without a skipped marker or with more than the limit", len(out))
+	}
+}
+
+func TestOutputQueue(t *testing.T) {
+	q := newOutputQueue(10)
+	q.push([]byte("abcd"))
+	q.push([]byte("efgh"))
+	if chunks, skipped := q.take(); len(chunks) != 2 || skipped != 0 {
+		t.Fatalf("take = %q, %d; want both chunks", chunks, skipped)
+	}
+	q.push([]byte("abcd"))
+	q.push([]byte("efgh"))
+	q.push([]byte("ijkl"))
+	chunks, skipped := q.take()
+	if len(chunks) != 1 || string(chunks[0]) != "ijkl" || skipped != 8 {
+		t.Errorf("take = %q, %d; want the latest chunk and 8 skipped", chunks, skipped)
+	}
+	if formatSkipped(230<<10) != "230 KB" || formatSkipped(100) != "100 bytes" {
+		t.Errorf("formatSkipped = %q, %q", formatSkipped(230<<10), formatSkipped(100))
+	}
+}
+
+// A cooked attach leaves the terminal in line mode and passes each line
+// on as Enter would in raw mode, and Ctrl-C as the key.
+func TestCookedAttach(t *testing.T) {
+	ptmx, pts, err := pty.Open()
+	if err != nil {
+		t.Skipf("no pty: %v", err)
+	}
+	defer ptmx.Close()
+	defer pts.Close()
+	// A blocking descriptor, as a shell's stdin is, rather than one Go
+	// polls.
+	fd, err := unix.Open(pts.Name(), unix.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tty := os.NewFile(uintptr(fd), pts.Name())
+	defer tty.Close()
+
+	socket := filepath.Join(t.TempDir(), "session-001.sock")
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	var mu sync.Mutex
+	var got bytes.Buffer
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		if _, err := r.ReadSlice('\n'); err != nil {
+			return
+		}
+		conn.Write(readyMessage(t, false))
+		buf := make([]byte, 1024)
+		for {
+			n, err := r.Read(buf)
+			mu.Lock()
+			got.Write(buf[:n])
+			mu.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	}()
+	received := func(want string) bool {
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			mu.Lock()
+			ok := strings.Contains(got.String(), want)
+			mu.Unlock()
+			if ok {
+				return true
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return false
+	}
+
+	interrupt := make(chan struct{}, 1)
+	c := New("001", socket, Options{
+		Stdin:     tty,
+		Stdout:    io.Discard,
+		Size:      func() (int, int, error) { return 24, 80, nil },
+		Quiet:     true,
+		NoRedraw:  true,
+		Cooked:    true,
+		Interrupt: interrupt,
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	attached := make(chan error, 1)
+	go func() { attached <- c.Attach(ctx) }()
+
+	ptmx.Write([]byte("echo hi\n"))
+	if !received("echo hi\r") {
+		t.Fatalf("daemon got %q; want the line ending in a carriage return", got.String())
+	}
+	termios, err := unix.IoctlGetTermios(int(tty.Fd()), platform.IoctlGetTermios)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if termios.Lflag&unix.ICANON == 0 {
+		t.Error("cooked attach turned off line mode")
+	}
+	interrupt <- struct{}{}
+	if !received("\x03") {
+		t.Errorf("daemon got %q; want Ctrl-C", got.String())
+	}
+	cancel()
+	if err := <-attached; err != nil {
+		t.Errorf("Attach: %v", err)
+	}
+}
+
+func TestRawModeError(t *testing.T) {
+	for _, errno := range []error{unix.ENOTTY, unix.EIO, unix.EPERM, unix.EBADF} {
+		err := rawModeError(errno)
+		if !errors.Is(err, utils.ErrNoRawMode) || !errors.Is(err, errno) {
+			t.Errorf("rawModeError(%v) = %v; want it to wrap ErrNoRawMode and the cause", errno, err)
+		}
+	}
+	if err := rawModeError(unix.EIO); !strings.Contains(err.Error(), "fg") {
+		t.Errorf("a background attach should be told to use fg: %v", err)
+	}
+}
+
+func TestPredictor(t *testing.T) {
+	var out bytes.Buffer
+	p := newPredictor(&out, 0)
+	step := func(name string, fn func(), want string) {
+		t.Helper()
+		out.Reset()
+		fn()
+		if out.String() != want {
+			t.Errorf("%s: terminal got %q; want %q", name, out.String(), want)
+		}
+	}
+
+	// Nothing is shown until a keystroke comes back as typed.
+	step("first key", func() { p.typed([]byte("a"), false) }, "")
+	step("its echo", func() { p.output([]byte("a")) }, "a")
+	step("keys after an echo", func() { p.typed([]byte("bc"), false) },
+		"\x1b7\x1b8\x1b[4mb\x1b8\x1b[1C\x1b[4mc\x1b8")
+	step("one echoed", func() { p.output([]byte("b")) }, "b\x1b7\x1b8\x1b[4mc\x1b8")
+	step("other output", func() { p.output([]byte("X")) }, "\x1b7\x1b8\x1b[X\x1b8X")
+	step("key after other output", func() { p.typed([]byte("d"), false) }, "")
+	step("its echo", func() { p.output([]byte("d")) }, "d")
+
+	// A backspace rubs out the prediction before it, and its echo
+	// counts as expected output.
+	step("rubbed out", func() { p.typed([]byte("xy\x7f"), false) }, "\x1b7\x1b8\x1b[4mx\x1b8")
+	step("echoes", func() { p.output([]byte("xy\b \b")) }, "xy\b \b")
+	if len(p.pending) != 0 || !p.confirmed {
+		t.Errorf("after the echoes: %d pending, confirmed %v", len(p.pending), p.confirmed)
+	}
+
+	// Enter takes the predictions back and stops showing more.
+	step("typed", func() { p.typed([]byte("e"), false) }, "\x1b7\x1b8\x1b[4me\x1b8")
+	step("enter", func() { p.typed([]byte("\r"), false) }, "\x1b7\x1b8\x1b[X\x1b8")
+	step("password", func() { p.typed([]byte("s3cret"), false) }, "")
+
+	// Predicting from a round trip shows nothing until echoes are slow.
+	slow := newPredictor(&out, time.Hour)
+	slow.typed([]byte("a"), false)
+	slow.output([]byte("a"))
+	step("fast link", func() { slow.typed([]byte("b"), false) }, "")
+}
+
+// After Ctrl-X, a second Ctrl-X or '-' switches and any other key
+// confirms the detach; after a two-key binding's prefix, other keys are
+// sent on with it.
+func TestKeysAfter(t *testing.T) {
+	single := DefaultKeys
+	screen, err := ParseKeys("C-a d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		keys Keys
+		b    byte
+		want keyAction
+	}{
+		{single, keyCtrlX, actSwitch},
+		{single, '-', actSwitch},
+		{single, 'l', actDetach},
+		{single, '\r', actDetach},
+		{screen, 'd', actDetach},
+		{screen, 0x01, actSwitch},
+		{screen, 'a', actLiteral},
+		{screen, '?', actHelp},
+		{screen, 'l', actForward},
+	} {
+		if got := tc.keys.after(tc.b); got != tc.want {
+			t.Errorf("%s then %q: got action %d; want %d", tc.keys, tc.b, got, tc.want)
+		}
+	}
+}
+
+// Whether Ctrl-X can switch is looked up without keyMu held, as it reads
+// files and may ask a daemon.
+func TestCanSwitchOutsideKeyLock(t *testing.T) {
+	// Read-only, so the input before Ctrl-X goes nowhere.
+	c := &Client{keys: DefaultKeys, opts: Options{ReadOnly: true}}
+	var asked, locked bool
+	c.opts.Previous = func(string) (string, string, int, error) {
+		asked = true
+		if c.keyMu.TryLock() {
+			c.keyMu.Unlock()
+		} else {
+			locked = true
+		}
+		return "002", "", 0, nil
+	}
+	if c.handleInput([]byte("ls\x18")) {
+		t.Fatal("Ctrl-X detached with a session to switch to")
+	}
+	c.keyMu.Lock()
+	armed := c.armed
+	// Disarmed, so the switch window ends quietly.
+	c.armed = false
+	c.keyMu.Unlock()
+	if !asked || !armed {
+		t.Errorf("asked = %v, armed = %v; want Ctrl-X to wait for a second press", asked, armed)
+	}
+	if locked {
+		t.Error("Previous was called with keyMu held")
+	}
+}
+
+// syncBuffer is a bytes.Buffer several goroutines may write to.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// When the session ends just as a signal detaches, the terminal is put
+// back and the user told how the attachment ended once, not once for each.
+func TestCleanupRunsOnce(t *testing.T) {
+	ptmx, pts, err := pty.Open()
+	if err != nil {
+		t.Skipf("no pty: %v", err)
+	}
+	defer ptmx.Close()
+	defer pts.Close()
+	fd, err := unix.Open(pts.Name(), unix.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tty := os.NewFile(uintptr(fd), pts.Name())
+	defer tty.Close()
+	before, err := unix.IoctlGetTermios(fd, platform.IoctlGetTermios)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exit, err := protocol.EncodeControlFrame(protocol.MsgExit, protocol.ExitPayload{Status: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 20; i++ {
+		socket := filepath.Join(t.TempDir(), "session-001.sock")
+		ln, err := net.Listen("unix", socket)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hangUp := make(chan struct{})
+		go func() {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			if _, err := bufio.NewReader(conn).ReadSlice('\n'); err != nil {
+				return
+			}
+			conn.Write(readyMessage(t, true))
+			<-hangUp
+			conn.Write(exit)
+		}()
+
+		var out syncBuffer
+		c := New("001", socket, Options{
+			Stdin:    tty,
+			Stdout:   &out,
+			Size:     func() (int, int, error) { return 24, 80, nil },
+			NoRedraw: true,
+		})
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		attached := make(chan error, 1)
+		go func() { attached <- c.Attach(ctx) }()
+		for deadline := time.Now().Add(5 * time.Second); !strings.Contains(out.String(), "Attaching to session 001"); {
+			if time.Now().After(deadline) {
+				t.Fatalf("run %d: never attached; terminal got %q", i, out.String())
+			}
+			time.Sleep(time.Millisecond)
+		}
+		// The signal handler cancels the context as the daemon says the
+		// session ended.
+		go cancel()
+		close(hangUp)
+		if err := <-attached; err != nil {
+			t.Errorf("Attach: %v", err)
+		}
+		cancel()
+		ln.Close()
+
+		banners := strings.Count(out.String(), "Session 001 ended") + strings.Count(out.String(), "Detached from session 001")
+		if banners != 1 || strings.Count(out.String(), screenReset) > 1 {
+			t.Fatalf("run %d: terminal got %q; want one banner and at most one reset", i, out.String())
+		}
+		after, err := unix.IoctlGetTermios(fd, platform.IoctlGetTermios)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if after.Lflag != before.Lflag || after.Iflag != before.Iflag || after.Oflag != before.Oflag {
+			t.Fatalf("run %d: the terminal was left as %+v; want %+v", i, after, before)
+		}
+	}
+}
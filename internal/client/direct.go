@@ -0,0 +1,156 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// ptyDrainTimeout bounds how long output is still read from a lent
+// terminal once the attachment is ending, as the daemon does when the
+// command exits.
+const ptyDrainTimeout = 200 * time.Millisecond
+
+// directPTY is the session's terminal as the daemon lent it to a direct
+// attach: output is read from it and input written to it here, and the
+// connection to the daemon carries only control messages.
+type directPTY struct {
+	f        *os.File
+	mu       sync.Mutex // guards stopping and reader
+	stopping bool
+	reader   chan struct{} // closed once readFromPTY returns; nil before it starts
+}
+
+// start reports whether readFromPTY may start reading p, which it may
+// until p is stopped.
+func (p *directPTY) start() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stopping {
+		return false
+	}
+	p.reader = make(chan struct{})
+	return true
+}
+
+// stop ends the reading at once and waits for it to end, so nothing is
+// read from the terminal once the daemon is told it can have it back.
+func (p *directPTY) stop() {
+	p.mu.Lock()
+	p.stopping = true
+	reader := p.reader
+	p.mu.Unlock()
+	p.f.SetReadDeadline(time.Unix(1, 0))
+	if reader != nil {
+		<-reader
+	}
+}
+
+// drain ends the reading after what the session wrote last has been read,
+// or after ptyDrainTimeout if the terminal stays open.
+func (p *directPTY) drain() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stopping {
+		return
+	}
+	p.stopping = true
+	p.f.SetReadDeadline(time.Now().Add(ptyDrainTimeout))
+}
+
+// readFromPTY shows the session's output, read from the lent terminal,
+// until p is stopped or the terminal closes as the session ends. How the
+// attachment ended comes over the connection, as with a relayed attach.
+func (c *Client) readFromPTY(p *directPTY) {
+	defer c.wg.Done()
+	defer close(p.reader)
+
+	buffer := make([]byte, bufferSize)
+	for {
+		n, err := p.f.Read(buffer)
+		if n > 0 {
+			c.show(buffer[:n])
+		}
+		if err != nil {
+			debugf("readFromPTY: %v", err)
+			return
+		}
+	}
+}
+
+// readRights reads from conn until deadline for the first line, as
+// readLine does, also taking the descriptor a daemon lending its terminal
+// sends along with READY. The descriptor is returned as a file, or nil if
+// none came.
+func readRights(conn *net.UnixConn, deadline time.Time) (line, rest []byte, pty *os.File, err error) {
+	conn.SetReadDeadline(deadline)
+	buf := make([]byte, 4096)
+	oob := make([]byte, unix.CmsgSpace(4))
+	n := 0
+	for {
+		if n == len(buf) {
+			err = bufio.ErrBufferFull
+			break
+		}
+		m, oobn, _, _, rerr := conn.ReadMsgUnix(buf[n:], oob)
+		n += m
+		if oobn > 0 {
+			f, ferr := receivedFile(oob[:oobn])
+			if pty == nil {
+				pty = f
+			} else if f != nil {
+				f.Close()
+			}
+			if ferr != nil {
+				err = ferr
+				break
+			}
+		}
+		if i := bytes.IndexByte(buf[:n], '\n'); i >= 0 {
+			return buf[:i+1], buf[i+1 : n], pty, nil
+		}
+		if rerr != nil {
+			err = rerr
+			break
+		}
+	}
+	if pty != nil {
+		pty.Close()
+	}
+	return nil, nil, nil, err
+}
+
+// receivedFile returns the descriptor passed in the control message oob as
+// a file, closing any others.
+func receivedFile(oob []byte) (*os.File, error) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+	var f *os.File
+	for i := range msgs {
+		fds, err := unix.ParseUnixRights(&msgs[i])
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			if f != nil {
+				unix.Close(fd)
+				continue
+			}
+			// The daemon's master is non-blocking, so the file is read
+			// through the runtime poller and its deadlines work.
+			f = os.NewFile(uintptr(fd), "pty")
+		}
+	}
+	if f == nil {
+		return nil, fmt.Errorf("no terminal in the daemon's message")
+	}
+	return f, nil
+}
@@ -0,0 +1,96 @@
+package client
+
+import (
+	"fmt"
+	"sync"
+)
+
+// outputQueue lets the session's output be read as fast as it arrives
+// while a slow terminal writes it out. Once more than limit bytes wait,
+// all but the latest chunk are thrown away and counted, so the terminal
+// catches up with the session rather than falling further behind.
+type outputQueue struct {
+	mu      sync.Mutex
+	chunks  [][]byte
+	size    int
+	limit   int
+	skipped int
+	ready   chan struct{} // signalled when chunks are queued
+}
+
+func newOutputQueue(limit int) *outputQueue {
+	return &outputQueue{limit: limit, ready: make(chan struct{}, 1)}
+}
+
+// push queues a copy of data.
+func (q *outputQueue) push(data []byte) {
+	q.mu.Lock()
+	q.chunks = append(q.chunks, append([]byte(nil), data...))
+	q.size += len(data)
+	if q.size > q.limit && len(q.chunks) > 1 {
+		last := q.chunks[len(q.chunks)-1]
+		q.skipped += q.size - len(last)
+		q.chunks = append(q.chunks[:0], last)
+		q.size = len(last)
+	}
+	q.mu.Unlock()
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// take returns what is queued and how many bytes were thrown away before
+// it, emptying the queue.
+func (q *outputQueue) take() (chunks [][]byte, skipped int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	chunks, skipped = q.chunks, q.skipped
+	q.chunks, q.size, q.skipped = nil, 0, 0
+	return chunks, skipped
+}
+
+// discard throws away what is queued, as the session's terminal did with
+// output not yet written to it.
+func (q *outputQueue) discard() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.chunks, q.size = nil, 0
+}
+
+// writeOutput writes the queued output to Stdout until the attachment
+// ends, then what is left. Skipped output is marked where it was, and the
+// session is asked to repaint what it covered.
+func (c *Client) writeOutput(q *outputQueue) {
+	defer c.wg.Done()
+	for {
+		var last bool
+		select {
+		case <-q.ready:
+		case <-c.done:
+			last = true
+		}
+		chunks, skipped := q.take()
+		if skipped > 0 {
+			fmt.Fprintf(c.opts.Stdout, "\x1b[0m\r\n[sess: skipped %s]\r\n", formatSkipped(skipped))
+			if !last {
+				c.requestRedraw()
+			}
+		}
+		for _, data := range chunks {
+			c.opts.Stdout.Write(data)
+		}
+		if last {
+			return
+		}
+	}
+}
+
+// formatSkipped gives an amount of skipped output in KB, as it is big
+// enough to be worth skipping.
+func formatSkipped(n int) string {
+	if n < 1024 {
+		return fmt.Sprintf("%d bytes", n)
+	}
+	return fmt.Sprintf("%d KB", (n+512)/1024)
+}
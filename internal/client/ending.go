@@ -0,0 +1,87 @@
+package client
+
+import (
+	"fmt"
+
+	"github.com/theMichaelB/sess/internal/utils"
+	"github.com/theMichaelB/sess/pkg/protocol"
+	"golang.org/x/sys/unix"
+)
+
+// How an attachment ended.
+const (
+	// endDetached: the user detached, or the attach was cancelled.
+	endDetached = iota
+	// endExited: the daemon said the session's command ended.
+	endExited
+	// endRequested: the daemon disconnected the client and said why.
+	endRequested
+	// endLost: the connection broke without the daemon saying why.
+	endLost
+)
+
+// ending is how an attachment ended, with what the daemon said about it.
+type ending struct {
+	kind   int
+	exit   protocol.ExitPayload // for endExited
+	reason string               // for endRequested
+}
+
+// banner is the line telling the user how the attachment to session number
+// ended.
+func (e ending) banner(number string) string {
+	switch e.kind {
+	case endExited:
+		return fmt.Sprintf("Session %s ended (%s)", number, describeExit(e.exit))
+	case endRequested:
+		return fmt.Sprintf("Detached from session %s (%s)", number, e.reason)
+	case endLost:
+		return fmt.Sprintf("Connection to session %s lost", number)
+	}
+	return fmt.Sprintf("Detached from session %s", number)
+}
+
+// err is what Attach returns for the ending: nil unless the session's
+// command failed or the connection broke.
+func (e ending) err(number string) error {
+	switch e.kind {
+	case endExited:
+		if e.exit.Status == 0 && e.exit.Signal == "" {
+			return nil
+		}
+		return &ExitError{Session: number, Status: e.exit.Status, Signal: e.exit.Signal}
+	case endLost:
+		return fmt.Errorf("%w: session %s", utils.ErrConnectionLost, number)
+	}
+	return nil
+}
+
+// ExitError is returned by Attach when the session's command ended while
+// attached with a non-zero status or by a signal.
+type ExitError struct {
+	Session string
+	// Status is the exit status, or -1 if a signal ended the command.
+	Status int
+	// Signal names the signal that ended the command, if any.
+	Signal string
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("session %s ended (%s)", e.Session, describeExit(protocol.ExitPayload{Status: e.Status, Signal: e.Signal}))
+}
+
+// Code returns the status a shell would report for the command: its exit
+// status, or 128 plus the number of the signal that ended it.
+func (e *ExitError) Code() int {
+	if e.Signal != "" {
+		return 128 + int(unix.SignalNum(e.Signal))
+	}
+	return e.Status
+}
+
+func describeExit(exit protocol.ExitPayload) string {
+	if exit.Signal != "" {
+		return "signal " + exit.Signal
+	}
+	return fmt.Sprintf("exit %d", exit.Status)
+}
@@ -0,0 +1,387 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultKeyTimeout is how long an armed prefix waits for its action key
+// before being sent to the session as ordinary input.
+const DefaultKeyTimeout = time.Second
+
+// Keys are the attach key bindings: a single detach key such as Ctrl-X, or a
+// prefix followed by an action key as in screen's "C-a d".
+type Keys struct {
+	Prefix byte
+	// Action is the key after Prefix that detaches; 0 for a single-key
+	// binding, where Prefix detaches on its own.
+	Action byte
+}
+
+// DefaultKeys detach with a lone Ctrl-X.
+var DefaultKeys = Keys{Prefix: keyCtrlX}
+
+// ParseKeys parses a binding such as "C-x", "^]" or "C-a d".
+func ParseKeys(spec string) (Keys, error) {
+	fields := strings.Fields(spec)
+	if len(fields) == 0 || len(fields) > 2 {
+		return Keys{}, fmt.Errorf("invalid detach key %q: want one key or a prefix and a key", spec)
+	}
+	var k Keys
+	var err error
+	if k.Prefix, err = parseKey(fields[0]); err != nil {
+		return Keys{}, fmt.Errorf("invalid detach key %q: %w", spec, err)
+	}
+	if len(fields) == 2 {
+		if k.Action, err = parseKey(fields[1]); err != nil {
+			return Keys{}, fmt.Errorf("invalid detach key %q: %w", spec, err)
+		}
+		if k.Action == k.Prefix {
+			return Keys{}, fmt.Errorf("invalid detach key %q: action repeats the prefix", spec)
+		}
+	}
+	return k, nil
+}
+
+// parseKey parses one key: a printable character, or a control key written
+// C-x or ^x.
+func parseKey(s string) (byte, error) {
+	var ctrl string
+	switch {
+	case len(s) == 1 && s[0] > ' ' && s[0] < 0x7f:
+		return s[0], nil
+	case len(s) == 3 && (strings.HasPrefix(s, "C-") || strings.HasPrefix(s, "c-")):
+		ctrl = s[2:]
+	case len(s) == 2 && s[0] == '^':
+		ctrl = s[1:]
+	default:
+		return 0, fmt.Errorf("unrecognised key %q", s)
+	}
+	c := ctrl[0]
+	if c >= 'a' && c <= 'z' {
+		c -= 'a' - 'A'
+	}
+	if c < '@' || c > '_' {
+		return 0, fmt.Errorf("no control key for %q", s)
+	}
+	return c - '@', nil
+}
+
+// String formats the binding the way ParseKeys accepts it.
+func (k Keys) String() string {
+	if k.Action == 0 {
+		return keyName(k.Prefix)
+	}
+	return keyName(k.Prefix) + " " + keyName(k.Action)
+}
+
+// SwitchKeys describes the keys that switch to the previous session: the
+// detach key, or the prefix, pressed twice.
+func (k Keys) SwitchKeys() string {
+	p := keyName(k.Prefix)
+	return p + " " + p
+}
+
+func keyName(b byte) string {
+	if b < ' ' {
+		return "C-" + strings.ToLower(string(rune(b+'@')))
+	}
+	return string(rune(b))
+}
+
+// literal is the action key that sends the prefix itself, as screen's
+// "C-a a"; 0 when the prefix is not a control letter.
+func (k Keys) literal() byte {
+	if k.Prefix >= 1 && k.Prefix <= 26 {
+		return k.Prefix + 'a' - 1
+	}
+	return 0
+}
+
+type keyAction int
+
+const (
+	actForward keyAction = iota // send the prefix and the key
+	actDetach
+	actSwitch
+	actLiteral // send the prefix alone
+	actHelp
+)
+
+// after decides what the key b does when it follows an armed prefix.
+func (k Keys) after(b byte) keyAction {
+	if k.Action == 0 {
+		// Single-key binding: a repeat (or '-') switches, anything else
+		// confirms the detach.
+		if b == k.Prefix || b == '-' {
+			return actSwitch
+		}
+		return actDetach
+	}
+	switch b {
+	case k.Action:
+		return actDetach
+	case k.Prefix, '-':
+		return actSwitch
+	case '?':
+		return actHelp
+	case k.literal():
+		return actLiteral
+	default:
+		return actForward
+	}
+}
+
+// help describes the bindings for the help action.
+func (k Keys) help() string {
+	p := keyName(k.Prefix)
+	s := fmt.Sprintf("%s %s detach, %s %s or %s - previous session", p, keyName(k.Action), p, p, p)
+	if l := k.literal(); l != 0 {
+		s += fmt.Sprintf(", %s %c sends %s", p, l, p)
+	}
+	return s
+}
+
+// handleInput runs terminal input through the key bindings, forwarding
+// everything else to the session. It reports whether the client detached.
+// The prefix and its action may arrive in the same chunk or in separate
+// ones; an armed prefix that times out is handled by prefixExpired. A
+// switch happens without holding keyMu, and input after the switch key
+// goes to the new session. Whether there is a session to switch to is
+// looked up before keyMu is taken, and only when data holds a lone detach
+// key: finding out reads the state directory and may ask a daemon.
+func (c *Client) handleInput(data []byte) bool {
+	if c.opts.DisableCtrlX {
+		return !c.forward(data)
+	}
+	for {
+		canSwitch := c.keys.Action == 0 && bytes.IndexByte(data, c.keys.Prefix) >= 0 && c.canSwitch()
+		rest, act := c.applyKeys(data, canSwitch)
+		switch act {
+		case actDetach:
+			return true
+		case actSwitch:
+			c.switchPrevious()
+			data = rest
+		default:
+			return false
+		}
+	}
+}
+
+// applyKeys handles data up to the first key that detaches or switches,
+// returning that action and the input after it. Otherwise it handles all
+// of data and returns actForward. canSwitch says whether a lone detach key
+// waits for a second press.
+func (c *Client) applyKeys(data []byte, canSwitch bool) ([]byte, keyAction) {
+	c.keyMu.Lock()
+	defer c.keyMu.Unlock()
+
+	out := make([]byte, 0, len(data))
+	flush := func() bool {
+		ok := c.forward(out)
+		out = out[:0]
+		return ok
+	}
+	for i, b := range data {
+		if !c.armed {
+			if b != c.keys.Prefix {
+				out = append(out, b)
+				continue
+			}
+			if !flush() {
+				return nil, actDetach
+			}
+			if c.keys.Action == 0 && !canSwitch {
+				// Nothing a second key could select; detach right away.
+				c.detach()
+				return nil, actDetach
+			}
+			c.arm()
+			continue
+		}
+
+		c.armed = false
+		switch c.keys.after(b) {
+		case actDetach:
+			c.detach()
+			return nil, actDetach
+		case actSwitch:
+			if c.opts.Previous == nil {
+				c.notify("no previous session")
+				continue
+			}
+			if !flush() {
+				return nil, actDetach
+			}
+			return data[i+1:], actSwitch
+		case actHelp:
+			c.notify("%s", c.keys.help())
+		case actLiteral:
+			out = append(out, c.keys.Prefix)
+		default:
+			out = append(out, c.keys.Prefix, b)
+		}
+	}
+	if !flush() {
+		return nil, actDetach
+	}
+	return nil, actForward
+}
+
+// canSwitch reports whether there is a session to switch to. Must not
+// hold keyMu.
+func (c *Client) canSwitch() bool {
+	if c.opts.Previous == nil {
+		return false
+	}
+	_, _, _, err := c.opts.Previous(c.number())
+	return err == nil
+}
+
+// arm starts waiting for the key after the prefix. Must hold keyMu.
+func (c *Client) arm() {
+	c.armed = true
+	c.armGen++
+	gen := c.armGen
+	timeout := c.opts.KeyTimeout
+	if c.keys.Action == 0 {
+		timeout = switchWindow
+	} else if timeout <= 0 {
+		timeout = DefaultKeyTimeout
+	}
+	time.AfterFunc(timeout, func() { c.prefixExpired(gen) })
+}
+
+// prefixExpired handles a prefix left without an action key: a single-key
+// binding detaches, a prefix is sent on to the session after all.
+func (c *Client) prefixExpired(gen int) {
+	c.keyMu.Lock()
+	defer c.keyMu.Unlock()
+	if !c.armed || c.armGen != gen {
+		return
+	}
+	c.armed = false
+	if c.keys.Action == 0 {
+		c.detach()
+		return
+	}
+	if !c.forward([]byte{c.keys.Prefix}) {
+		c.closeDone()
+	}
+}
+
+// forward sends input to the session unless attached read-only, straight
+// to its terminal if the daemon lent it. It reports false if the session
+// connection failed.
+func (c *Client) forward(data []byte) bool {
+	if len(data) == 0 || c.opts.ReadOnly {
+		return true
+	}
+	if c.pred != nil {
+		c.altMu.Lock()
+		alt := c.alt.On()
+		c.altMu.Unlock()
+		c.pred.typed(data, alt)
+	}
+	if p := c.terminal(); p != nil {
+		p.f.SetWriteDeadline(time.Now().Add(1 * time.Second))
+		_, err := p.f.Write(data)
+		return err == nil
+	}
+	return c.session().Write(data) == nil
+}
+
+// namedKeys are the key names TranslateKeys accepts, as in tmux send-keys.
+var namedKeys = map[string]string{
+	"Enter":    "\r",
+	"Tab":      "\t",
+	"Space":    " ",
+	"Escape":   "\x1b",
+	"BSpace":   "\x7f",
+	"Up":       "\x1b[A",
+	"Down":     "\x1b[B",
+	"Right":    "\x1b[C",
+	"Left":     "\x1b[D",
+	"Home":     "\x1b[H",
+	"End":      "\x1b[F",
+	"PageUp":   "\x1b[5~",
+	"PageDown": "\x1b[6~",
+	"Insert":   "\x1b[2~",
+	"Delete":   "\x1b[3~",
+}
+
+// TranslateKeys turns send-keys style arguments into the bytes to type.
+// An argument that names a key ("Enter", "Up", "C-c", "M-x") becomes that
+// key; any other argument is literal text in which the escapes \n, \r, \t,
+// \e, \xHH and \\ are expanded.
+func TranslateKeys(args []string) ([]byte, error) {
+	var out []byte
+	for _, arg := range args {
+		if seq, ok := namedKeys[arg]; ok {
+			out = append(out, seq...)
+			continue
+		}
+		if strings.HasPrefix(arg, "M-") && len(arg) > 2 {
+			key, err := TranslateKeys([]string{arg[2:]})
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, 0x1b)
+			out = append(out, key...)
+			continue
+		}
+		if len(arg) == 3 && strings.HasPrefix(arg, "C-") {
+			if b, err := parseKey(arg); err == nil {
+				out = append(out, b)
+				continue
+			}
+		}
+		text, err := unescape(arg)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, text...)
+	}
+	return out, nil
+}
+
+// unescape expands the backslash escapes TranslateKeys supports.
+func unescape(s string) ([]byte, error) {
+	out := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i == len(s)-1 {
+			out = append(out, s[i])
+			continue
+		}
+		i++
+		switch s[i] {
+		case 'n':
+			out = append(out, '\n')
+		case 'r':
+			out = append(out, '\r')
+		case 't':
+			out = append(out, '\t')
+		case 'e':
+			out = append(out, 0x1b)
+		case '\\':
+			out = append(out, '\\')
+		case 'x':
+			if i+2 >= len(s) {
+				return nil, fmt.Errorf("incomplete \\x escape in %q", s)
+			}
+			b, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+			if err != nil {
+				return nil, fmt.Errorf("bad \\x escape in %q", s)
+			}
+			out = append(out, byte(b))
+			i += 2
+		default:
+			out = append(out, '\\', s[i])
+		}
+	}
+	return out, nil
+}
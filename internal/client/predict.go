@@ -0,0 +1,285 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	// predictStyle marks keystrokes shown before the session echoed them.
+	predictStyle = "\x1b[4m"
+	// predictMinTimeout is the least time a keystroke's echo is waited for
+	// before its prediction is taken back; longer round trips wait four
+	// times as long.
+	predictMinTimeout = time.Second
+	keyBackspace      = 0x7f
+	keyCtrlH          = 0x08
+)
+
+// echoedErases are what terminals' line disciplines and line editors send
+// to rub out the character before the cursor, longest first.
+var echoedErases = [][]byte{[]byte("\b \b"), []byte("\b\x1b[K"), []byte("\b\x1b[P"), []byte("\b")}
+
+// prediction is a keystroke sent to the session and not yet echoed back:
+// a printable character, or an erase of the one before it.
+type prediction struct {
+	key   byte // the character, or 0 for an erase
+	sent  time.Time
+	shown bool // drawn on the terminal
+}
+
+// predictor shows printable keystrokes as they are typed, before the
+// session echoes them, as mosh does, so typing keeps up over a link where
+// each round trip takes long. Predictions are drawn underlined after the
+// cursor, which stays where the session put it, and are replaced as the
+// echoes arrive. Output that is not the echo expected takes all of them
+// back, and nothing more is shown until the echo of a later keystroke
+// arrives, so nothing is shown where keystrokes are not echoed, such as at
+// a password prompt. Keys other than printable ones and backspace, such as
+// Enter, take predictions back the same way. Predictions are not wrapped
+// at the edge of the screen or inserted before text after the cursor; the
+// echo puts such things right.
+//
+// Every write to the terminal while predictions are shown must go through
+// the predictor, which relies on knowing where the cursor is relative to
+// them.
+type predictor struct {
+	mu  sync.Mutex
+	out io.Writer
+	// after is the smoothed round trip from which predictions are shown;
+	// zero shows them whatever the round trip.
+	after     time.Duration
+	rtt       time.Duration // smoothed keystroke round trip, 0 before the first
+	confirmed bool          // an echo has matched since predictions were last taken back
+	pending   []prediction
+	timer     *time.Timer
+}
+
+func newPredictor(out io.Writer, after time.Duration) *predictor {
+	return &predictor{out: out, after: after}
+}
+
+// typed records keys about to be sent to the session, showing those it
+// can. alt says the session is on the alternate screen, where full-screen
+// programs draw as they like and nothing is predicted.
+func (p *predictor) typed(keys []byte, alt bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if alt {
+		p.reset()
+		return
+	}
+	// Redrawn whole, as a backspace may rub out one shown.
+	var buf bytes.Buffer
+	p.eraseTo(&buf)
+	now := time.Now()
+	show := p.showing()
+	for _, b := range keys {
+		switch {
+		case b >= 0x20 && b < 0x7f:
+			p.pending = append(p.pending, prediction{key: b, sent: now, shown: show})
+		case b == keyBackspace || b == keyCtrlH:
+			// Rubbing out what is already echoed is left to the
+			// session.
+			if len(p.pending) > 0 {
+				p.pending = append(p.pending, prediction{sent: now})
+			}
+		default:
+			// Taken back already; the new predictions are not drawn
+			// yet.
+			p.pending = nil
+			p.confirmed = false
+		}
+	}
+	if len(p.pending) > 0 {
+		p.drawTo(&buf)
+		p.arm()
+	}
+	if buf.Len() > 0 {
+		p.out.Write(buf.Bytes())
+	}
+}
+
+// output writes the session's output to the terminal, replacing the
+// predictions it echoes and taking the rest back if it is anything else.
+func (p *predictor) output(data []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.pending) == 0 {
+		p.out.Write(data)
+		return
+	}
+	i := 0
+	now := time.Now()
+	wasShowing := p.showing()
+	for len(p.pending) > 0 && i < len(data) {
+		head := p.pending[0]
+		n := 0
+		if head.key != 0 {
+			if data[i] == head.key {
+				n = 1
+			}
+		} else {
+			for _, erase := range echoedErases {
+				if bytes.HasPrefix(data[i:], erase) {
+					n = len(erase)
+					break
+				}
+			}
+		}
+		if n == 0 {
+			break
+		}
+		i += n
+		p.pending = p.pending[1:]
+		p.confirmed = true
+		p.sample(now.Sub(head.sent))
+	}
+
+	var buf bytes.Buffer
+	if i < len(data) && len(p.pending) > 0 {
+		// Not the echo expected: take the predictions back from where
+		// they are, before the rest of the output moves the cursor.
+		buf.Write(data[:i])
+		p.eraseTo(&buf)
+		p.pending = nil
+		p.confirmed = false
+		buf.Write(data[i:])
+		p.out.Write(buf.Bytes())
+		return
+	}
+	buf.Write(data)
+	if p.showing() {
+		if !wasShowing {
+			for k := range p.pending {
+				p.pending[k].shown = true
+			}
+		}
+		// An echo may have landed on a prediction typed after one that
+		// was rubbed out.
+		p.drawTo(&buf)
+	}
+	p.out.Write(buf.Bytes())
+}
+
+// clear takes back every prediction shown, before something other than
+// the session's output is written to the terminal.
+func (p *predictor) clear() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.reset()
+}
+
+// reset takes the predictions back. Must hold mu.
+func (p *predictor) reset() {
+	if len(p.pending) > 0 {
+		var buf bytes.Buffer
+		if p.eraseTo(&buf); buf.Len() > 0 {
+			p.out.Write(buf.Bytes())
+		}
+	}
+	p.pending = nil
+	p.confirmed = false
+}
+
+// showing reports whether new predictions are drawn. Must hold mu.
+func (p *predictor) showing() bool {
+	return p.confirmed && p.rtt >= p.after
+}
+
+// sample folds a keystroke's round trip into the smoothed one, as TCP
+// does. Must hold mu.
+func (p *predictor) sample(rtt time.Duration) {
+	if p.rtt == 0 {
+		p.rtt = rtt
+		return
+	}
+	p.rtt += (rtt - p.rtt) / 8
+}
+
+// layout returns where each pending character not rubbed out will land,
+// by its index in pending, in cells from the cursor. Must hold mu.
+func (p *predictor) layout() map[int]int {
+	at := make(map[int]int)
+	var stack []int
+	col := 0
+	for i, pr := range p.pending {
+		if pr.key != 0 {
+			at[i] = col
+			stack = append(stack, i)
+			col++
+			continue
+		}
+		col--
+		if len(stack) > 0 {
+			delete(at, stack[len(stack)-1])
+			stack = stack[:len(stack)-1]
+		}
+	}
+	return at
+}
+
+// drawTo draws the shown predictions, leaving the cursor and attributes
+// as they were. Must hold mu.
+func (p *predictor) drawTo(buf *bytes.Buffer) {
+	p.paint(buf, false)
+}
+
+// eraseTo blanks the cells predictions are drawn in. Must hold mu.
+func (p *predictor) eraseTo(buf *bytes.Buffer) {
+	p.paint(buf, true)
+}
+
+func (p *predictor) paint(buf *bytes.Buffer, erase bool) {
+	var cells bytes.Buffer
+	at := p.layout()
+	for i, pr := range p.pending {
+		col, ok := at[i]
+		if !ok || !pr.shown {
+			continue
+		}
+		cells.WriteString("\x1b8" + cursorMove(col))
+		if erase {
+			cells.WriteString("\x1b[X")
+		} else {
+			cells.WriteString(predictStyle)
+			cells.WriteByte(pr.key)
+		}
+	}
+	if cells.Len() > 0 {
+		buf.WriteString("\x1b7")
+		buf.Write(cells.Bytes())
+		buf.WriteString("\x1b8")
+	}
+}
+
+// arm takes the predictions back if the oldest is not echoed in time, as
+// when the session stops echoing. Must hold mu.
+func (p *predictor) arm() {
+	timeout := max(4*p.rtt, predictMinTimeout)
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+	p.timer = time.AfterFunc(timeout, func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if len(p.pending) > 0 && time.Since(p.pending[0].sent) >= timeout {
+			p.reset()
+		}
+	})
+}
+
+// cursorMove is the sequence moving the cursor n cells right, or left if
+// n is negative.
+func cursorMove(n int) string {
+	switch {
+	case n > 0:
+		return fmt.Sprintf("\x1b[%dC", n)
+	case n < 0:
+		return fmt.Sprintf("\x1b[%dD", -n)
+	}
+	return ""
+}
@@ -0,0 +1,146 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/theMichaelB/sess/internal/utils"
+	"github.com/theMichaelB/sess/pkg/protocol"
+)
+
+// rawLeaveTimeout bounds how long a raw attach that is leaving waits for
+// the output still on its way.
+const rawLeaveTimeout = 1 * time.Second
+
+// attachRaw is Attach for Options.Raw: a plain byte pipe between Stdin and
+// Stdout and the session, for programs that drive it. The terminal is left
+// in the mode it is in, nothing is printed, no key is intercepted and the
+// session's size is left alone unless Size gives one. It ends when Stdin reaches end of file (or
+// fails), ctx is cancelled or Duration passes, which all leave the session
+// running and return nil, or when the daemon ends it. The session's
+// command ending returns what Attach would; the daemon disconnecting the
+// client or the connection breaking returns an error wrapping
+// utils.ErrConnectionLost.
+func (c *Client) attachRaw(ctx context.Context) error {
+	c.opts.NoResize = c.opts.Size == nil
+	c.opts.Direct = false
+	conn, err := net.DialTimeout("unix", c.socketPath, connectTimeout)
+	if err != nil {
+		return fmt.Errorf("%w: %w", utils.ErrConnectionFailed, err)
+	}
+	rm, _, ready, err := c.handshake(conn, c.sessionNum, c.opts.PID)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer rm.Close()
+	c.mu.Lock()
+	if c.sessionNum == "" {
+		c.sessionNum = ready.Session
+	}
+	c.conn, c.rawMode, c.pixels = conn, rm, ready.Pixels
+	c.mu.Unlock()
+	if !ready.Sized {
+		// Sent before any input, so it cannot be taken for keystrokes.
+		c.handleResize()
+	}
+	if c.opts.OnAttach != nil {
+		c.opts.OnAttach(c.sessionNum)
+	}
+	if c.opts.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.opts.Duration)
+		defer cancel()
+	}
+
+	// A read of Stdin may block past the attach, so the reader is not
+	// waited for.
+	var lastInput atomic.Int64
+	eof := make(chan struct{})
+	if !c.opts.NoInput {
+		go func() {
+			defer close(eof)
+			buf := make([]byte, bufferSize)
+			for {
+				n, err := c.opts.Stdin.Read(buf)
+				if n > 0 {
+					lastInput.Store(time.Now().UnixNano())
+					if rm.Write(buf[:n]) != nil {
+						return
+					}
+				}
+				if err != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	closed := make(chan error, 1)
+	go func() {
+		for {
+			data, err := rm.Read()
+			if err != nil {
+				closed <- nil
+				return
+			}
+			if len(data) == 0 {
+				continue
+			}
+			if _, err := c.opts.Stdout.Write(data); err != nil {
+				closed <- fmt.Errorf("writing the session's output: %w", err)
+				return
+			}
+		}
+	}()
+
+	keepalive := time.NewTicker(keepaliveInterval)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return c.leaveRaw(conn, closed)
+		case <-eof:
+			return c.leaveRaw(conn, closed)
+		case <-keepalive.C:
+			// Input keeps the daemon from thinking the client gone, and
+			// a PING sent along with it could be taken for keystrokes.
+			if time.Since(time.Unix(0, lastInput.Load())) >= keepaliveInterval {
+				rm.Write(protocol.PingLine)
+			}
+		case err := <-closed:
+			if err != nil {
+				return err
+			}
+			end := c.ending()
+			switch end.kind {
+			case endExited:
+				return end.err(c.sessionNum)
+			case endRequested:
+				return fmt.Errorf("%w: session %s: %s", utils.ErrConnectionLost, c.sessionNum, end.reason)
+			}
+			return fmt.Errorf("%w: session %s", utils.ErrConnectionLost, c.sessionNum)
+		}
+	}
+}
+
+// leaveRaw detaches a raw attach. Rather than DISCONNECT, which input just
+// sent could run into, it shuts its side of the connection, so the daemon
+// takes all the input and then lets the client go; the output written
+// meanwhile is passed on.
+func (c *Client) leaveRaw(conn net.Conn, closed <-chan error) error {
+	if uc, ok := conn.(*net.UnixConn); ok {
+		uc.CloseWrite()
+	} else {
+		conn.Close()
+	}
+	select {
+	case err := <-closed:
+		return err
+	case <-time.After(rawLeaveTimeout):
+		return nil
+	}
+}
@@ -0,0 +1,67 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"sync"
+	"time"
+)
+
+// teeTimeFormat stamps lines of teed output with when they arrived.
+const teeTimeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// tee copies session output to a file as well as the terminal. It is
+// buffered; the first error writing or flushing it stops the copying, so a
+// full disk costs the copy rather than the attach.
+type tee struct {
+	mu         sync.Mutex
+	w          *bufio.Writer
+	timestamps bool
+	midLine    bool // the last chunk ended without a newline
+	err        error
+}
+
+func newTee(w io.Writer, timestamps bool) *tee {
+	return &tee{w: bufio.NewWriter(w), timestamps: timestamps}
+}
+
+// write copies data, received at now. It returns the error that stops the
+// copying, once; after that it does nothing.
+func (t *tee) write(data []byte, now time.Time) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.err != nil {
+		return nil
+	}
+	if !t.timestamps {
+		_, t.err = t.w.Write(data)
+		return t.err
+	}
+	stamp := now.Format(teeTimeFormat) + " "
+	for len(data) > 0 && t.err == nil {
+		line := data
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			line = data[:i+1]
+		}
+		if !t.midLine {
+			t.w.WriteString(stamp)
+		}
+		_, t.err = t.w.Write(line)
+		t.midLine = line[len(line)-1] != '\n'
+		data = data[len(line):]
+	}
+	return t.err
+}
+
+// flush writes out what is buffered, returning the error that stops the
+// copying if this is what hits it.
+func (t *tee) flush() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.err != nil {
+		return nil
+	}
+	t.err = t.w.Flush()
+	return t.err
+}
@@ -0,0 +1,268 @@
+// Package config reads the user's sess settings file.
+package config
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/theMichaelB/sess/internal/session"
+	"golang.org/x/sys/unix"
+)
+
+// Config holds the user's settings.
+type Config struct {
+	// DefaultCommand is run, through the shell, in new sessions that are
+	// not given a command; empty runs the shell itself.
+	DefaultCommand string
+	// LogKeepDays and LogKeepFiles bound the output logs kept from ended
+	// sessions: by age, and by number. Zero means no limit.
+	LogKeepDays  int
+	LogKeepFiles int
+	// LogDiskLimit caps the bytes used by all session logs; the oldest
+	// logs of ended sessions go first. Zero means no limit.
+	LogDiskLimit int64
+	// Scrollback is how many bytes of recent output each session keeps in
+	// memory for sess save; zero keeps none.
+	Scrollback int
+	// ScrollbackSpill appends output beyond Scrollback to a temporary
+	// file, so sess save --all can still retrieve all of it.
+	ScrollbackSpill bool
+	// ScrollbackKeep writes a session's scrollback to disk when it ends,
+	// so sess save still works until sess clean.
+	ScrollbackKeep bool
+	// KillSignals are sent in turn to end a session's command when it is
+	// killed, waiting up to KillGrace after each for it to exit.
+	KillSignals []syscall.Signal
+	KillGrace   time.Duration
+	// NestedWarning says what creating a session inside tmux or screen
+	// does: NestedWarn, NestedError or NestedOff.
+	NestedWarning string
+	// OOMScoreAdj is given to each session's daemon as its Linux
+	// oom_score_adj, leaving the session's command at its own, so the OOM
+	// killer goes for the program using the memory rather than the
+	// daemon. Zero leaves the daemon's alone.
+	OOMScoreAdj int
+	// StateLost says what a session's daemon does when its socket or
+	// metadata is removed while it runs, as by rm -rf ~/.sess:
+	// StateLostRecreate or StateLostExit.
+	StateLost string
+}
+
+// Values of NestedWarning.
+const (
+	// NestedWarn warns, saying which keys detach from what.
+	NestedWarn = "warn"
+	// NestedError refuses, unless the user insists with --force-nested.
+	NestedError = "error"
+	// NestedOff says nothing.
+	NestedOff = "off"
+)
+
+// Values of StateLost.
+const (
+	// StateLostRecreate puts the socket and metadata back, so the
+	// session can be listed and attached to again.
+	StateLostRecreate = "recreate"
+	// StateLostExit ends the session, as killing it would.
+	StateLostExit = "exit"
+)
+
+// Default returns the settings used when the file does not set them.
+func Default() *Config {
+	kill := session.DefaultKillSequence()
+	return &Config{
+		LogKeepDays:   14,
+		LogKeepFiles:  50,
+		Scrollback:    256 << 10,
+		KillSignals:   kill.Signals,
+		KillGrace:     kill.Grace,
+		NestedWarning: NestedWarn,
+		OOMScoreAdj:   -500,
+		StateLost:     StateLostRecreate,
+	}
+}
+
+// LogRetention returns how many logs of ended sessions to keep, and how
+// much disk all session logs may use.
+func (c *Config) LogRetention() session.LogRetention {
+	return session.LogRetention{Days: c.LogKeepDays, Files: c.LogKeepFiles, MaxBytes: c.LogDiskLimit}
+}
+
+// KillSequence returns how to end a session's command.
+func (c *Config) KillSequence() session.KillSequence {
+	return session.KillSequence{Signals: c.KillSignals, Grace: c.KillGrace}
+}
+
+// Path returns where the settings file lives: $XDG_CONFIG_HOME/sess/config,
+// usually ~/.config/sess/config.
+func Path() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "sess", "config"), nil
+}
+
+// Load reads the settings file. A missing file gives the defaults.
+func Load() (*Config, error) {
+	path, err := Path()
+	if err != nil {
+		return Default(), nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return Default(), nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	cfg := Default()
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected key = value", path, n)
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		switch key {
+		case "default-command":
+			cfg.DefaultCommand = value
+		case "log-keep-days", "log-keep-files":
+			v, err := strconv.Atoi(value)
+			if err != nil || v < 0 {
+				return nil, fmt.Errorf("%s:%d: %s must be a number of zero or more", path, n, key)
+			}
+			if key == "log-keep-days" {
+				cfg.LogKeepDays = v
+			} else {
+				cfg.LogKeepFiles = v
+			}
+		case "log-disk-limit":
+			size, err := ParseSize(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %s: %v", path, n, key, err)
+			}
+			cfg.LogDiskLimit = size
+		case "scrollback":
+			size, err := ParseSize(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %s: %v", path, n, key, err)
+			}
+			cfg.Scrollback = int(size)
+		case "scrollback-spill":
+			on, err := parseBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %s: %v", path, n, key, err)
+			}
+			cfg.ScrollbackSpill = on
+		case "scrollback-keep":
+			on, err := parseBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %s: %v", path, n, key, err)
+			}
+			cfg.ScrollbackKeep = on
+		case "kill-signals":
+			sigs, err := parseSignals(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %s: %v", path, n, key, err)
+			}
+			cfg.KillSignals = sigs
+		case "kill-grace":
+			d, err := time.ParseDuration(value)
+			if err != nil || d < 0 {
+				return nil, fmt.Errorf("%s:%d: %s must be a duration such as 500ms or 2s", path, n, key)
+			}
+			cfg.KillGrace = d
+		case "oom-score-adj":
+			v, err := strconv.Atoi(value)
+			if err != nil || v < -1000 || v > 1000 {
+				return nil, fmt.Errorf("%s:%d: %s must be a number from -1000 to 1000", path, n, key)
+			}
+			cfg.OOMScoreAdj = v
+		case "nested-warning":
+			switch value {
+			case NestedWarn, NestedError, NestedOff:
+				cfg.NestedWarning = value
+			default:
+				return nil, fmt.Errorf("%s:%d: %s must be warn, error or off", path, n, key)
+			}
+		case "state-lost":
+			switch value {
+			case StateLostRecreate, StateLostExit:
+				cfg.StateLost = value
+			default:
+				return nil, fmt.Errorf("%s:%d: %s must be recreate or exit", path, n, key)
+			}
+		default:
+			return nil, fmt.Errorf("%s:%d: unknown setting %q", path, n, key)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// ParseSize parses a byte count such as 2GB, 500M or 4096. Suffixes are
+// binary multiples and case-insensitive; a trailing B is optional.
+func ParseSize(s string) (int64, error) {
+	units := []struct {
+		suffix string
+		scale  int64
+	}{{"k", 1 << 10}, {"m", 1 << 20}, {"g", 1 << 30}, {"t", 1 << 40}}
+
+	num := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(s)), "b")
+	scale := int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(num, u.suffix) {
+			num, scale = strings.TrimSuffix(num, u.suffix), u.scale
+			break
+		}
+	}
+	v, err := strconv.ParseFloat(strings.TrimSpace(num), 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid size %q (e.g. 2GB, 500MB)", s)
+	}
+	return int64(v * float64(scale)), nil
+}
+
+// parseSignals parses signal names separated by commas or spaces, such as
+// "HUP, TERM, KILL", with or without the SIG prefix.
+func parseSignals(s string) ([]syscall.Signal, error) {
+	var sigs []syscall.Signal
+	for _, name := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' }) {
+		sig := unix.SignalNum("SIG" + strings.TrimPrefix(strings.ToUpper(name), "SIG"))
+		if sig == 0 {
+			return nil, fmt.Errorf("unknown signal %q", name)
+		}
+		sigs = append(sigs, sig)
+	}
+	if len(sigs) == 0 {
+		return nil, errors.New("expected signal names such as HUP, TERM, KILL")
+	}
+	return sigs, nil
+}
+
+// parseBool parses yes/no, true/false or on/off.
+func parseBool(s string) (bool, error) {
+	switch strings.ToLower(s) {
+	case "yes", "true", "on", "1":
+		return true, nil
+	case "no", "false", "off", "0":
+		return false, nil
+	}
+	return false, fmt.Errorf("expected yes or no, got %q", s)
+}
@@ -0,0 +1,421 @@
+package config
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/theMichaelB/sess/internal/session"
+)
+
+// Definition is a session sessions.toml defines, one per table:
+//
+//	[web]
+//	command = "bin/rails server"          # run through the shell
+//	cwd = "~/src/shop"
+//	env = { RAILS_ENV = "development" }
+//	respawn = "on-failure"                # or "always", or "no"
+//
+//	[worker]
+//	command = ["bundle", "exec", "sidekiq"]
+//
+// Variables may also be given in a [worker.env] table of their own.
+type Definition struct {
+	// Name is the table's name, such as web.
+	Name string
+	// Command is the argv the session runs, when given as an array; Shell
+	// is a command line run through the shell, when given as a string.
+	// With neither the session runs the shell itself.
+	Command []string
+	Shell   string
+	// Dir is the directory the command starts in, made absolute: "~" and
+	// relative paths are taken from the home directory. Empty leaves it
+	// to whoever starts the session.
+	Dir string
+	// Env holds KEY=VALUE variables set for the command, in file order.
+	Env []string
+	// Respawn is session.RespawnAlways or session.RespawnOnFailure, or
+	// empty when the command is not run again.
+	Respawn string
+	// Line is the line of the file the table starts on.
+	Line int
+}
+
+// SessionsPath returns where session definitions live:
+// $XDG_CONFIG_HOME/sess/sessions.toml, usually ~/.config/sess/sessions.toml.
+func SessionsPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "sess", "sessions.toml"), nil
+}
+
+// LoadDefinitions reads the session definitions, in the order the file
+// gives them. A missing file is an error wrapping os.ErrNotExist.
+func LoadDefinitions() ([]Definition, error) {
+	path, err := SessionsPath()
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseDefinitions(f, path)
+}
+
+// ParseDefinitions reads session definitions from r, written in the subset
+// of TOML shown for Definition: tables named with letters, digits, - and _,
+// and string, array-of-string and inline-table values. Errors give path,
+// the line and the table they are in.
+func ParseDefinitions(r io.Reader, path string) ([]Definition, error) {
+	home, _ := os.UserHomeDir()
+	p := defParser{path: path, home: home, scanner: bufio.NewScanner(r), seen: make(map[string]int), defined: make(map[string]int)}
+	if err := p.parse(); err != nil {
+		return nil, err
+	}
+	return p.defs, nil
+}
+
+// defParser holds the state of ParseDefinitions.
+type defParser struct {
+	path    string
+	home    string
+	scanner *bufio.Scanner
+	line    int
+	defs    []Definition
+	seen    map[string]int // table name to its index in defs
+	cur     int            // index in defs of the table being read, or -1
+	inEnv   bool           // reading the [name.env] table of cur
+	set     map[string]bool
+	// defined holds the line of each table's [name] line; a table that
+	// [name.env] alone has started is not in it.
+	defined map[string]int
+}
+
+// errIncomplete is what parseValue returns for an array that goes on past
+// the end of the text it was given.
+var errIncomplete = errors.New("incomplete array")
+
+// errorf returns an error pointing at the current line, and at the table
+// being read.
+func (p *defParser) errorf(format string, args ...interface{}) error {
+	msg := fmt.Sprintf(format, args...)
+	if p.cur >= 0 {
+		msg = fmt.Sprintf("[%s] %s", p.defs[p.cur].Name, msg)
+	}
+	return fmt.Errorf("%s:%d: %s", p.path, p.line, msg)
+}
+
+func (p *defParser) next() (string, bool) {
+	if !p.scanner.Scan() {
+		return "", false
+	}
+	p.line++
+	return p.scanner.Text(), true
+}
+
+func (p *defParser) parse() error {
+	p.cur = -1
+	for {
+		text, ok := p.next()
+		if !ok {
+			break
+		}
+		text = strings.TrimSpace(text)
+		switch {
+		case text == "" || text[0] == '#':
+		case text[0] == '[':
+			if err := p.header(text); err != nil {
+				return err
+			}
+		default:
+			if err := p.keyValue(text); err != nil {
+				return err
+			}
+		}
+	}
+	return p.scanner.Err()
+}
+
+// header starts the table a [name] or [name.env] line names.
+func (p *defParser) header(text string) error {
+	p.cur = -1
+	if strings.HasPrefix(text, "[[") {
+		return p.errorf("arrays of tables are not supported; give each session a [name] table")
+	}
+	end := strings.IndexByte(text, ']')
+	if end < 0 {
+		return p.errorf("expected ] to end the table name")
+	}
+	if rest := strings.TrimSpace(text[end+1:]); rest != "" && rest[0] != '#' {
+		return p.errorf("unexpected %q after the table name", rest)
+	}
+	name := strings.TrimSpace(text[1:end])
+	name, sub, env := strings.Cut(name, ".")
+	if env && strings.TrimSpace(sub) != "env" {
+		return p.errorf("unknown table [%s]; only [%s.env] may follow a session's name", text[1:end], strings.TrimSpace(name))
+	}
+	name = strings.TrimSpace(name)
+	if !bareKey(name) {
+		return p.errorf("invalid session name %q: use letters, digits, - and _", name)
+	}
+	i, ok := p.seen[name]
+	if !ok {
+		p.defs = append(p.defs, Definition{Name: name, Line: p.line})
+		i = len(p.defs) - 1
+		p.seen[name] = i
+	}
+	if !env {
+		if line, ok := p.defined[name]; ok {
+			return p.errorf("[%s] is defined twice, first on line %d", name, line)
+		}
+		p.defined[name] = p.line
+	}
+	p.cur, p.inEnv = i, env
+	if env {
+		if p.defs[i].Env != nil {
+			return p.errorf("env is given twice")
+		}
+		p.defs[i].Env = []string{}
+	} else {
+		p.set = make(map[string]bool)
+	}
+	return nil
+}
+
+// keyValue applies a key = value line, reading on to the lines an array
+// continues onto.
+func (p *defParser) keyValue(text string) error {
+	if p.cur < 0 {
+		return p.errorf("expected a [name] line before settings")
+	}
+	key, text, ok := strings.Cut(text, "=")
+	key = strings.TrimSpace(key)
+	if !ok {
+		return p.errorf("expected key = value")
+	}
+	if !bareKey(key) {
+		return p.errorf("invalid key %q", key)
+	}
+	value, rest, err := parseValue(text)
+	for err == errIncomplete {
+		more, ok := p.next()
+		if !ok {
+			return p.errorf("%s: the array is not closed with ]", key)
+		}
+		text += "\n" + more
+		value, rest, err = parseValue(text)
+	}
+	if err != nil {
+		return p.errorf("%s: %v", key, err)
+	}
+	if rest = strings.TrimSpace(rest); rest != "" && rest[0] != '#' {
+		return p.errorf("%s: unexpected %q after the value", key, rest)
+	}
+
+	def := &p.defs[p.cur]
+	if p.inEnv {
+		s, ok := value.(string)
+		if !ok {
+			return p.errorf("env %s must be a string", key)
+		}
+		def.Env = append(def.Env, key+"="+s)
+		return nil
+	}
+	if p.set[key] {
+		return p.errorf("%s is given twice", key)
+	}
+	p.set[key] = true
+	switch key {
+	case "command":
+		switch v := value.(type) {
+		case string:
+			def.Shell = v
+		case []string:
+			if len(v) == 0 {
+				return p.errorf("command must not be empty")
+			}
+			def.Command = v
+		default:
+			return p.errorf("command must be a string or an array of strings")
+		}
+	case "cwd":
+		s, ok := value.(string)
+		if !ok || s == "" {
+			return p.errorf("cwd must be a directory")
+		}
+		def.Dir = p.directory(s)
+	case "env":
+		vars, ok := value.([][2]string)
+		if !ok {
+			return p.errorf("env must be a table, such as { PORT = \"3000\" }")
+		}
+		if def.Env != nil {
+			return p.errorf("env is given twice")
+		}
+		def.Env = []string{}
+		for _, kv := range vars {
+			def.Env = append(def.Env, kv[0]+"="+kv[1])
+		}
+	case "respawn":
+		s, _ := value.(string)
+		switch s {
+		case "no":
+			def.Respawn = ""
+		case session.RespawnAlways, session.RespawnOnFailure:
+			def.Respawn = s
+		default:
+			return p.errorf("respawn must be \"no\", \"%s\" or \"%s\"", session.RespawnOnFailure, session.RespawnAlways)
+		}
+	default:
+		return p.errorf("unknown setting %q", key)
+	}
+	return nil
+}
+
+// directory makes a cwd setting absolute, from the home directory.
+func (p *defParser) directory(dir string) string {
+	if dir == "~" {
+		return p.home
+	}
+	dir = strings.TrimPrefix(dir, "~/")
+	if filepath.IsAbs(dir) {
+		return filepath.Clean(dir)
+	}
+	return filepath.Join(p.home, dir)
+}
+
+// bareKey reports whether s is a name TOML allows unquoted.
+func bareKey(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// parseValue parses the value s starts with: a string, an array of
+// strings ([]string), or an inline table of strings ([][2]string, in
+// order). It returns the text after it. An array may run over several
+// lines, with comments; errIncomplete asks for more of them.
+func parseValue(s string) (value interface{}, rest string, err error) {
+	s = strings.TrimLeft(s, " \t")
+	switch {
+	case s == "":
+		return nil, "", errors.New("expected a value")
+	case s[0] == '"' || s[0] == '\'':
+		return parseString(s)
+	case s[0] == '[':
+		list := []string{}
+		s = s[1:]
+		for {
+			s = skipSpace(s)
+			switch {
+			case s == "":
+				return nil, "", errIncomplete
+			case s[0] == ']':
+				return list, s[1:], nil
+			}
+			v, after, err := parseString(s)
+			if err != nil {
+				return nil, "", fmt.Errorf("arrays may only hold strings")
+			}
+			list = append(list, v)
+			s = skipSpace(after)
+			switch {
+			case s == "":
+				return nil, "", errIncomplete
+			case s[0] == ',':
+				s = s[1:]
+			case s[0] != ']':
+				return nil, "", fmt.Errorf("expected , or ] in the array")
+			}
+		}
+	case s[0] == '{':
+		var table [][2]string
+		s = strings.TrimLeft(s[1:], " \t")
+		if strings.HasPrefix(s, "}") {
+			return table, s[1:], nil
+		}
+		for {
+			key, after, ok := strings.Cut(s, "=")
+			key = strings.TrimSpace(key)
+			if !ok || !bareKey(key) {
+				return nil, "", fmt.Errorf("expected NAME = \"value\" in the table, all on one line")
+			}
+			v, after, err := parseString(strings.TrimLeft(after, " \t"))
+			if err != nil {
+				return nil, "", fmt.Errorf("%s: %v", key, err)
+			}
+			table = append(table, [2]string{key, v})
+			s = strings.TrimLeft(after, " \t")
+			switch {
+			case strings.HasPrefix(s, "}"):
+				return table, s[1:], nil
+			case strings.HasPrefix(s, ","):
+				s = strings.TrimLeft(s[1:], " \t")
+			default:
+				return nil, "", fmt.Errorf("expected , or } in the table, all on one line")
+			}
+		}
+	}
+	return nil, "", fmt.Errorf("expected a string, such as \"text\"")
+}
+
+// parseString parses the basic ("...") or literal ('...') string s starts
+// with.
+func parseString(s string) (string, string, error) {
+	if strings.HasPrefix(s, `"""`) || strings.HasPrefix(s, "'''") {
+		return "", "", errors.New("multi-line strings are not supported")
+	}
+	switch {
+	case strings.HasPrefix(s, "'"):
+		end := strings.IndexAny(s[1:], "'\n")
+		if end < 0 || s[1+end] != '\'' {
+			return "", "", errors.New("the string is not closed with '")
+		}
+		return s[1 : 1+end], s[end+2:], nil
+	case strings.HasPrefix(s, `"`):
+		for i := 1; i < len(s) && s[i] != '\n'; i++ {
+			switch s[i] {
+			case '\\':
+				i++
+			case '"':
+				v, err := strconv.Unquote(s[:i+1])
+				if err != nil {
+					return "", "", errors.New("invalid escape in the string")
+				}
+				return v, s[i+1:], nil
+			}
+		}
+		return "", "", errors.New("the string is not closed with \"")
+	}
+	return "", "", errors.New("expected a string")
+}
+
+// skipSpace skips white space, line breaks and comments.
+func skipSpace(s string) string {
+	for {
+		s = strings.TrimLeft(s, " \t\r\n")
+		if !strings.HasPrefix(s, "#") {
+			return s
+		}
+		end := strings.IndexByte(s, '\n')
+		if end < 0 {
+			return ""
+		}
+		s = s[end+1:]
+	}
+}
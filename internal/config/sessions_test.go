@@ -0,0 +1,76 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseDefinitions(t *testing.T) {
+	t.Setenv("HOME", "/home/u")
+	defs, err := ParseDefinitions(strings.NewReader(`
+# Development services
+[web]
+command = "bin/rails server -p 3000"   # through the shell
+cwd = "~/src/shop"
+env = { RAILS_ENV = "development", MOTTO = 'say "hi"\n' }
+respawn = "on-failure"
+
+[worker]
+command = [
+  "bundle", "exec",  # comments may go here
+  "sidekiq",
+]
+cwd = "/srv/shop"
+respawn = "no"
+
+[worker.env]
+QUEUE = "default\tlow"
+
+[shell]
+
+[api.env]
+PORT = "8080"
+
+[api]
+command = "bin/api"
+`), "sessions.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Definition{
+		{Name: "web", Shell: "bin/rails server -p 3000", Dir: "/home/u/src/shop", Env: []string{"RAILS_ENV=development", `MOTTO=say "hi"\n`}, Respawn: "on-failure", Line: 3},
+		{Name: "worker", Command: []string{"bundle", "exec", "sidekiq"}, Dir: "/srv/shop", Env: []string{"QUEUE=default\tlow"}, Line: 9},
+		{Name: "shell", Line: 20},
+		{Name: "api", Shell: "bin/api", Env: []string{"PORT=8080"}, Line: 22},
+	}
+	if !reflect.DeepEqual(defs, want) {
+		t.Errorf("ParseDefinitions =\n%+v\nwant\n%+v", defs, want)
+	}
+}
+
+func TestParseDefinitionsErrors(t *testing.T) {
+	for _, tc := range []struct{ file, err string }{
+		{"command = \"x\"", "f:1: expected a [name] line before settings"},
+		{"[web]\ncommand = \"x\"\n[web]", "f:3: [web] is defined twice, first on line 1"},
+		{"[web.env]\nA = \"1\"\n[web]\n[web]", "f:4: [web] is defined twice, first on line 3"},
+		{"[web.env]\nA = \"1\"\n[web]\nenv = { B = \"2\" }", "f:4: [web] env is given twice"},
+		{"[web]\nrespawn = \"sometimes\"", `f:2: [web] respawn must be "no", "on-failure" or "always"`},
+		{"[web]\nport = \"80\"", `f:2: [web] unknown setting "port"`},
+		{"[web]\ncommand = \"x\"\ncommand = \"y\"", "f:3: [web] command is given twice"},
+		{"[web]\ncommand = [\"a\",\n\"b\"", "f:3: [web] command: the array is not closed with ]"},
+		{"[web]\ncommand = [\"a\", 1]", "f:2: [web] command: arrays may only hold strings"},
+		{"[web]\ncommand = \"x", `f:2: [web] command: the string is not closed with "`},
+		{"[web]\ncommand = \"x\" y", `f:2: [web] command: unexpected "y" after the value`},
+		{"[web]\nenv = \"A=1\"", `f:2: [web] env must be a table, such as { PORT = "3000" }`},
+		{"[web]\n[web.env]\nA = 1", `f:3: [web] A: expected a string, such as "text"`},
+		{"[web]\n[web.x]", "f:2: unknown table [web.x]; only [web.env] may follow a session's name"},
+		{"[web,api]", `f:1: invalid session name "web,api": use letters, digits, - and _`},
+		{"[[web]]", "f:1: arrays of tables are not supported; give each session a [name] table"},
+	} {
+		_, err := ParseDefinitions(strings.NewReader(tc.file), "f")
+		if err == nil || err.Error() != tc.err {
+			t.Errorf("ParseDefinitions(%q) = %v; want %s", tc.file, err, tc.err)
+		}
+	}
+}
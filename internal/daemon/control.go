@@ -0,0 +1,119 @@
+package daemon
+
+import (
+	"errors"
+	"strings"
+	"syscall"
+
+	"github.com/theMichaelB/sess/internal/platform"
+	"github.com/theMichaelB/sess/pkg/protocol"
+	"golang.org/x/sys/unix"
+)
+
+// handleControl carries out one control command from cl. It returns false
+// once the client has disconnected.
+func (d *Daemon) handleControl(cl *client, line string) bool {
+	fields := strings.Fields(line)
+	peek := cl.info.Mode == protocol.ModePeek
+	d.controls.add(cl.describe(), line)
+	switch fields[0] {
+	case protocol.MsgDisconnect:
+		d.removeClient(cl.conn)
+		return false
+	case protocol.MsgPing:
+		// Only a framed client can tell a reply from session output.
+		if cl.framed && !d.sendFrame(cl.conn, protocol.MsgPong, nil) {
+			return false
+		}
+	case protocol.MsgResize:
+		if peek || cl.info.NoResize {
+			// Read-only and no-resize clients never change the
+			// session's size.
+			return true
+		}
+		if size, ok := protocol.ResizeArgs(line); ok {
+			d.resize(size)
+		}
+	case protocol.MsgRedraw:
+		d.redraw(len(fields) == 2 && !peek)
+	}
+	return true
+}
+
+// resize applies a client's terminal size, clamped by protocol.ClampSize,
+// to the PTY.
+func (d *Daemon) resize(size protocol.ResizePayload) {
+	ws := &unix.Winsize{Row: size.Rows, Col: size.Cols, Xpixel: size.XPixel, Ypixel: size.YPixel}
+	err := d.masterControl(func(fd int) error {
+		return unix.IoctlSetWinsize(fd, unix.TIOCSWINSZ, ws)
+	})
+	if err != nil {
+		d.debugf("resize to %dx%d: %v", size.Rows, size.Cols, err)
+		return
+	}
+	// Ensure the shell is notified of the change
+	if d.cmd != nil && d.cmd.Process != nil {
+		_ = syscall.Kill(-d.cmd.Process.Pid, syscall.SIGWINCH)
+	}
+	d.debugf("applied resize: %dx%d (%dx%d pixels)", size.Rows, size.Cols, size.XPixel, size.YPixel)
+}
+
+// redraw nudges the foreground program to repaint, as a freshly attached
+// client sees nothing until it does. The foreground process group gets a
+// SIGWINCH even though the size is unchanged; if it cannot be found, the
+// size is jiggled by a row and back, which makes the kernel send one.
+// With ctrlL a Ctrl-L follows, but only when a program other than the
+// shell is in the foreground, as shells clear the screen on Ctrl-L.
+func (d *Daemon) redraw(ctrlL bool) {
+	if d.ptyMaster == nil {
+		return
+	}
+	pgrp, err := d.foregroundGroup()
+	if err != nil {
+		_ = d.masterControl(func(fd int) error {
+			if ws, err := unix.IoctlGetWinsize(fd, unix.TIOCGWINSZ); err == nil && ws.Row > 1 {
+				jiggle := *ws
+				jiggle.Row--
+				_ = unix.IoctlSetWinsize(fd, unix.TIOCSWINSZ, &jiggle)
+				_ = unix.IoctlSetWinsize(fd, unix.TIOCSWINSZ, ws)
+			}
+			return nil
+		})
+		return
+	}
+	_ = syscall.Kill(-pgrp, syscall.SIGWINCH)
+
+	if ctrlL && d.cmd != nil && d.cmd.Process != nil && pgrp != d.cmd.Process.Pid {
+		d.ptyMaster.Write([]byte{0x0c})
+	}
+}
+
+// foregroundJob describes the job in the PTY's foreground, or returns nil
+// when that is the session's command itself, such as its shell at a prompt.
+func (d *Daemon) foregroundJob() *protocol.ForegroundJob {
+	pgrp, err := d.foregroundGroup()
+	if err != nil || d.cmd == nil || d.cmd.Process == nil || pgrp == d.cmd.Process.Pid {
+		return nil
+	}
+	job := &protocol.ForegroundJob{PGID: pgrp}
+	// The leader may have exited, leaving the rest of its group running.
+	job.Command, _ = platform.ProcessCommand(pgrp)
+	return job
+}
+
+// foregroundGroup returns the process group in the PTY's foreground: the
+// job Ctrl-C would reach.
+func (d *Daemon) foregroundGroup() (int, error) {
+	var pgrp int
+	err := d.masterControl(func(fd int) (err error) {
+		pgrp, err = unix.IoctlGetInt(fd, unix.TIOCGPGRP)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	if pgrp <= 0 {
+		return 0, errors.New("no foreground process group")
+	}
+	return pgrp, nil
+}
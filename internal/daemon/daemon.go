@@ -1,122 +1,485 @@
 package daemon
 
 import (
-    "context"
-    "encoding/json"
-    "errors"
-    "fmt"
-    "net"
-    "os"
-    "os/exec"
-    "os/signal"
-    "path/filepath"
-    "strconv"
-    "strings"
-    "sync"
-    "syscall"
-    "time"
-
-    ptylib "github.com/creack/pty"
-    "golang.org/x/sys/unix"
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	ptylib "github.com/creack/pty"
+	"github.com/theMichaelB/sess/internal/linescan"
+	"github.com/theMichaelB/sess/internal/platform"
+	"github.com/theMichaelB/sess/internal/session"
+	"github.com/theMichaelB/sess/internal/utils"
+	"github.com/theMichaelB/sess/pkg/protocol"
+	"golang.org/x/sys/unix"
 )
 
 const (
 	connectionTimeout = 30 * time.Second
-	readTimeout       = 100 * time.Millisecond
+	handshakeTimeout  = 5 * time.Second
+	// ptyDrainTimeout bounds how long output is still relayed after the
+	// command exits, should something it started keep the terminal open.
+	ptyDrainTimeout = 200 * time.Millisecond
 )
 
+// Config describes the session a Daemon serves.
+type Config struct {
+	SessionNum string
+	// SocketPath is where the daemon listens. It is ignored when Listener
+	// is set, except that it is still removed on shutdown if non-empty.
+	SocketPath string
+	// MetaPath is where session metadata is written; empty skips metadata.
+	MetaPath string
+	// Command is the child to run on the PTY. Its stdio and SysProcAttr are
+	// overwritten. When nil, Argv is used.
+	Command *exec.Cmd
+	Argv    []string
+	// Rows and Cols set the initial PTY size when both are positive, and
+	// XPixel and YPixel its size in pixels along with them.
+	Rows, Cols     int
+	XPixel, YPixel int
+	// Listener overrides the unix socket listener (e.g. for tests).
+	Listener net.Listener
+	// Log receives diagnostics; nil discards them.
+	Log io.Writer
+	// Ready, if set, is called once the daemon is accepting connections.
+	// An error aborts the daemon.
+	Ready func() error
+	// ShutdownOnDisconnect ends the session when an interactive client
+	// leaves, however it left (detach, exit, or a dropped connection).
+	ShutdownOnDisconnect bool
+	// OutputLog, if set, is the file the session's output is recorded to.
+	// It is kept when the session ends, renamed to include the exit time.
+	OutputLog string
+	// LogRetention limits the preserved logs kept next to OutputLog. It is
+	// applied when the session ends.
+	LogRetention session.LogRetention
+	// Scrollback is how many bytes of recent output the daemon keeps in
+	// memory for SCROLLBACK requests; zero keeps none.
+	Scrollback int
+	// ScrollbackSpill appends output that no longer fits in Scrollback to
+	// a temporary file, so the whole history can still be retrieved.
+	ScrollbackSpill bool
+	// ScrollbackKeep writes the scrollback, spilled history included,
+	// next to the metadata when the session ends.
+	ScrollbackKeep bool
+	// ThrottleDetached stops reading output that would only be thrown
+	// away, so a program flooding a detached session is held up by its
+	// terminal rather than kept running; see throttled.
+	ThrottleDetached bool
+	// InputLog, if set, is the file input typed into the session is
+	// recorded to, except at password prompts. It is kept when the
+	// session ends, like OutputLog, but never pruned.
+	InputLog string
+	// ScriptTypescript, if set, is a file the session's output is
+	// recorded to as script(1) would, for scriptreplay(1). ScriptTiming,
+	// if also set, receives the timing to replay it with.
+	ScriptTypescript string
+	ScriptTiming     string
+	// Env, when not nil, is the command's environment instead of the
+	// daemon's own, and EnvMode says where it came from, for the
+	// metadata. The SESS_ variables are added either way.
+	Env     []string
+	EnvMode string
+	// Termios is applied to the PTY before the command starts, over the
+	// usual defaults.
+	Termios Termios
+	// Rlimits are the command's resource limits. Executable, the sess
+	// binary, applies them as the helper ExecLimited before executing
+	// the command; a limit that cannot be set keeps the session from
+	// starting.
+	Rlimits    Rlimits
+	Executable string
+	// OOMScoreAdj, when not zero, is given to the daemon's oom_score_adj
+	// once the command has started, so the command keeps the score it
+	// would have had. A negative one keeps the kernel's OOM killer from
+	// picking the small daemon, and with it the whole session, over the
+	// program actually eating the memory. Failing to set it is logged
+	// and otherwise ignored.
+	OOMScoreAdj int
+	// Kill is how the command is ended if it is still running when the
+	// session shuts down; the zero value is session.DefaultKillSequence.
+	Kill session.KillSequence
+	// Timeout, if positive, ends the session that long after it starts,
+	// whatever its command is doing: the command is sent SIGTERM and,
+	// after Kill's grace period, SIGKILL, and its tombstone gives
+	// session.ReasonExpired. A TIMEOUT request moves or removes it.
+	Timeout time.Duration
+	// Respawn, session.RespawnAlways or session.RespawnOnFailure, has the
+	// command run again when it exits, or only when it fails, through the
+	// sess binary at Executable as the helper Respawn. Definition names
+	// the sessions.toml entry the session was started from. Both are
+	// recorded in its metadata.
+	Respawn    string
+	Definition string
+	// Version is the build of sess that started the session, recorded in
+	// its metadata.
+	Version string
+	// ExitOnStateLost ends the session when its socket or metadata is
+	// removed while it runs, instead of putting them back; see
+	// keepState.
+	ExitOnStateLost bool
+	// UpgradeArgs lets the session be upgraded in place. It checks that
+	// the sess binary at exe can take the session over and returns the
+	// arguments to run it with, handing it the session's state on
+	// descriptor fd. Without it UPGRADE requests are refused.
+	UpgradeArgs func(exe string, fd int) ([]string, error)
+	// Resume, if set, holds the state an upgrading daemon handed over:
+	// Run takes that session over instead of starting one, and most of
+	// the settings above that describe a new session are ignored.
+	Resume *os.File
+}
+
 type Daemon struct {
 	sessionNum  string
 	socketPath  string
 	metaPath    string
+	cfg         Config
+	log         io.Writer
 	cmd         *exec.Cmd
+	exited      chan struct{}
+	ptyDone     chan struct{} // closed when handlePTY returns
 	ptyMaster   *os.File
 	ptySlave    *os.File
+	outputLog   *os.File // written only by handlePTY
+	inputLog    *inputLog
+	script      *scriptRecorder // written only by handlePTY
+	scrollback  *scrollback
 	listener    net.Listener
 	clients     map[net.Conn]*client
 	clientMutex sync.RWMutex
-	ctx         context.Context
-	cancel      context.CancelFunc
-	wg          sync.WaitGroup
+	// clientList is a snapshot of clients for the output path, replaced
+	// under clientMutex whenever clients changes, so broadcasting takes
+	// no lock.
+	clientList atomic.Pointer[[]*client]
+	// failed collects the clients a broadcast could not write to; only
+	// handlePTY uses it.
+	failed []net.Conn
+	// clientsChanged wakes monitorClients when clients join or leave.
+	clientsChanged chan struct{}
+	// ptyWake wakes handlePTY while it is not reading, and parked is set
+	// meanwhile; see parkPTY.
+	ptyWake chan struct{}
+	parked  atomic.Bool
+	// Activity timestamps (unix nanoseconds, 0 = never).
+	lastOutput atomic.Int64
+	lastInput  atomic.Int64
+	lastAttach atomic.Int64
+	// bytesOut counts the output read from the session's terminal.
+	bytesOut atomic.Uint64
+	// packet is set if handlePTY reads the terminal in packet mode, each
+	// read starting with a status byte; see startPacketMode. stopped
+	// follows whether its output is stopped, as by Ctrl-S.
+	packet  bool
+	stopped atomic.Bool
+	// triggers are matched against the output's lines, which lines
+	// (only used by handlePTY) puts together; nil when there are none.
+	triggers atomic.Pointer[[]*trigger]
+	lines    linescan.Scanner
+	// oomSet is set once protectFromOOM has moved the daemon's score from
+	// oomInherited, which the command keeps; commands the daemon runs
+	// later are given oomInherited back.
+	oomSet       bool
+	oomInherited int
+	// altScreen follows whether the session is on the alternate screen,
+	// for clients attaching; handlePTY feeds it.
+	altScreen protocol.AltScreen
+	// title is the window title the session's programs last set;
+	// handlePTY feeds it.
+	title protocol.Title
+	// cwd is the directory the session's shell last announced by OSC 7;
+	// handlePTY feeds it.
+	cwd protocol.Cwd
+	// queries finds terminal queries in the output, replies holds the
+	// answers to a chunk's (both only used by handlePTY), and answering is
+	// set while they are being written; see answerQueries.
+	queries   queryScanner
+	replies   []byte
+	answering atomic.Bool
+	// shareMu guards the share list and the shared socket. It is never
+	// held while taking clientMutex.
+	shareMu        sync.Mutex
+	shared         map[int]protocol.SharedUser
+	sharedListener net.Listener
+	sharedSocket   string
+	shareClosed    bool // set by cleanup; no socket is opened after
+	// upgradeMu is held while the session is handed over to a new
+	// binary, and by waitChild while it reaps the command, so the command
+	// is either reaped here or handed over, never both.
+	upgradeMu sync.Mutex
+	// upgrading is set while the session is being handed over; the
+	// goroutines reading its descriptors stop at the deadline that pauses
+	// them rather than treating it as an error.
+	upgrading atomic.Bool
+	// direct is the terminal while it is lent to a direct client, and
+	// until handlePTY has taken it back.
+	direct atomic.Pointer[directPTY]
+	// io counts the goroutines reading the session's descriptors: the
+	// listeners, the PTY and each client.
+	io sync.WaitGroup
+	// timeoutMu guards deadline, when the session expires (zero for
+	// never), and expiry, the timer ending it then; expired is set once
+	// it has.
+	timeoutMu sync.Mutex
+	deadline  time.Time
+	expiry    *time.Timer
+	expired   atomic.Bool
+	// panicked names where the daemon first panicked, if it did.
+	panicked atomic.Pointer[string]
+	// controls holds the latest control messages, for dumps, and dumps
+	// receives the SIGUSR2 asking for one.
+	controls controlHistory
+	dumps    chan os.Signal
+	// ending is set once the daemon has signalled the command to end it.
+	ending atomic.Bool
+	// stateLost is set once the session's socket or metadata is gone for
+	// good, and what is in the state directory no longer the session's;
+	// see keepState.
+	stateLost atomic.Bool
+	// stateMu guards state, what keepState knows of the session's state,
+	// nil until guardState has looked. recheck receives the SIGUSR1 sess
+	// doctor sends to have the state put back.
+	stateMu sync.Mutex
+	state   *stateFiles
+	recheck chan os.Signal
+	// parent is the context Run was given, cancelled when the daemon
+	// itself is told to shut down.
+	parent context.Context
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
 }
 
 type client struct {
 	conn         net.Conn
+	reader       *bufio.Reader
+	info         protocol.ClientInfo
+	connectedAt  time.Time
+	peerPID      int
+	uid          int
+	owner        bool
 	lastActivity time.Time
+	// framed clients get output and control replies as protocol frames;
+	// others get raw output and no replies.
+	framed bool
+	// direct is set if the client has the session's terminal.
+	direct *directPTY
+	// Byte counters are updated from the I/O loops without the client lock.
+	bytesIn  atomic.Uint64
+	bytesOut atomic.Uint64
+}
+
+// describe names the client in the input log: "attach (pid 123)", with the
+// user if the session is shared with them.
+func (c *client) describe() string {
+	desc := fmt.Sprintf("%s (pid %d)", c.info.Mode, c.peerPID)
+	if c.info.User != "" {
+		desc += " user " + c.info.User
+	}
+	return desc
 }
 
-func debugf(format string, args ...interface{}) {
+func (d *Daemon) debugf(format string, args ...interface{}) {
 	if os.Getenv("SESS_DEBUG") == "1" {
-		fmt.Fprintf(os.Stderr, "[sess-daemon] "+format+"\n", args...)
+		fmt.Fprintf(d.log, "[sess-daemon] "+format+"\n", args...)
+	}
+}
+
+// recoverPanic is deferred first thing in each daemon goroutine. A panic is
+// logged with its stack and shuts the session down through the usual path,
+// so the shell is stopped and the socket and metadata are removed rather
+// than left behind by a crashed process; the tombstone says where the
+// first panic was.
+func (d *Daemon) recoverPanic(component string) {
+	if r := recover(); r != nil {
+		fmt.Fprint(d.log, "daemon: ", utils.PanicMessage(component, r))
+		d.panicked.CompareAndSwap(nil, &component)
+		d.cancel()
 	}
 }
 
-type Metadata struct {
-	SessionNum string    `json:"session_num"`
-	CreatedAt  time.Time `json:"created_at"`
-	PID        int       `json:"pid"`
-	Command    string    `json:"command"`
+// dropOnPanic takes recoverPanic's place in the goroutines serving a single
+// connection, whose panics most likely come of what the client sent: the
+// panic is logged with its stack as usual, but only conn is dropped, and
+// the session and its other clients carry on.
+func (d *Daemon) dropOnPanic(component string, conn net.Conn) {
+	if r := recover(); r != nil {
+		fmt.Fprint(d.log, "daemon: ", utils.PanicMessage(component, r))
+		d.removeClient(conn)
+		conn.Close()
+	}
 }
 
-func New(sessionNum, socketPath, metaPath string) *Daemon {
-	ctx, cancel := context.WithCancel(context.Background())
-	return &Daemon{
-		sessionNum: sessionNum,
-		socketPath: socketPath,
-		metaPath:   metaPath,
+// Metadata is the on-disk session record the daemon publishes.
+type Metadata = session.Session
+
+func New(cfg Config) *Daemon {
+	log := cfg.Log
+	if log == nil {
+		log = io.Discard
+	}
+	d := &Daemon{
+		sessionNum: cfg.SessionNum,
+		socketPath: cfg.SocketPath,
+		metaPath:   cfg.MetaPath,
+		cfg:        cfg,
+		log:        log,
+		exited:     make(chan struct{}),
+		ptyDone:    make(chan struct{}),
 		clients:    make(map[net.Conn]*client),
-		ctx:        ctx,
-		cancel:     cancel,
+		shared:     make(map[int]protocol.SharedUser),
+
+		clientsChanged: make(chan struct{}, 1),
+		ptyWake:        make(chan struct{}, 1),
+	}
+	d.cwd.Host, _ = os.Hostname()
+	return d
+}
+
+// Run starts the child on a fresh PTY and serves clients until the child
+// exits or ctx is cancelled. It returns the child's exit status; the error
+// is non-nil if setup failed or ctx ended the session. A cause ctx is
+// cancelled with (see context.WithCancelCause) is what attached clients are
+// told as the reason.
+func (d *Daemon) Run(ctx context.Context) (int, error) {
+	d.parent = ctx
+	d.ctx, d.cancel = context.WithCancel(ctx)
+	defer d.cancel()
+	// SIGUSR1 and SIGUSR2 are caught from the start, so that one sent as
+	// soon as the session exists does not kill the daemon.
+	d.dumps = make(chan os.Signal, 1)
+	signal.Notify(d.dumps, syscall.SIGUSR2)
+	defer signal.Stop(d.dumps)
+	d.recheck = make(chan os.Signal, 1)
+	signal.Notify(d.recheck, syscall.SIGUSR1)
+	defer signal.Stop(d.recheck)
+
+	if d.cfg.Resume != nil {
+		if err := d.resume(d.cfg.Resume); err != nil {
+			fmt.Fprintf(d.log, "daemon: failed to take over the session: %v\n", err)
+			return -1, fmt.Errorf("failed to take over the session: %w", err)
+		}
+	} else if err := d.start(); err != nil {
+		return -1, err
+	} else if d.cfg.Timeout > 0 {
+		d.setDeadline(time.Now().Add(d.cfg.Timeout))
+	}
+	defer d.setDeadline(time.Time{})
+
+	d.run()
+
+	<-d.exited
+	status := d.cmd.ProcessState.ExitCode()
+	if err := ctx.Err(); err != nil {
+		return status, err
 	}
+	return status, nil
 }
 
-func (d *Daemon) Start(shell string, initialRows, initialCols int) error {
+// start sets up a new session: it starts the command on a fresh PTY and
+// listens for clients.
+func (d *Daemon) start() error {
+	if d.cfg.Listener == nil && socketAnswers(d.socketPath) {
+		// Another daemon serves this number; leave its files alone.
+		fmt.Fprintf(d.log, "daemon: session %s already exists\n", d.sessionNum)
+		return fmt.Errorf("%w: session %s", utils.ErrSessionExists, d.sessionNum)
+	}
+
 	ptmx, pts, err := d.openPTY()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "daemon: failed to open PTY: %v\n", err)
+		fmt.Fprintf(d.log, "daemon: failed to open PTY: %v\n", err)
 		return fmt.Errorf("failed to open PTY: %w", err)
 	}
 	d.ptyMaster = ptmx
 	d.ptySlave = pts
 
 	// Apply initial size if provided
-	if initialRows > 0 && initialCols > 0 {
-		_ = ptylib.Setsize(pts, &ptylib.Winsize{Rows: uint16(initialRows), Cols: uint16(initialCols)})
+	if d.cfg.Rows > 0 && d.cfg.Cols > 0 {
+		_ = ptylib.Setsize(pts, &ptylib.Winsize{Rows: uint16(d.cfg.Rows), Cols: uint16(d.cfg.Cols), X: uint16(d.cfg.XPixel), Y: uint16(d.cfg.YPixel)})
+	}
+
+	if err := d.cfg.Termios.apply(pts); err != nil {
+		ptmx.Close()
+		pts.Close()
+		fmt.Fprintf(d.log, "daemon: failed to set terminal modes: %v\n", err)
+		return fmt.Errorf("failed to set terminal modes: %w", err)
 	}
 
-	if err := d.startShell(shell, pts); err != nil {
+	if err := d.startCommand(pts); err != nil {
 		ptmx.Close()
 		pts.Close()
-		fmt.Fprintf(os.Stderr, "daemon: failed to start shell: %v\n", err)
-		return fmt.Errorf("failed to start shell: %w", err)
+		fmt.Fprintf(d.log, "daemon: failed to start command: %v\n", err)
+		return fmt.Errorf("failed to start command: %w", err)
+	}
+	// The command has its own descriptors for the terminal. Letting go
+	// of ours means the master reports EIO once they are all closed.
+	pts.Close()
+	d.ptySlave = nil
+	go d.waitChild()
+	d.protectFromOOM()
+
+	if err := d.openScrollback(); err != nil {
+		d.cleanup()
+		fmt.Fprintf(d.log, "daemon: failed to set up scrollback: %v\n", err)
+		return fmt.Errorf("failed to set up scrollback: %w", err)
 	}
 
-	if err := d.writeMetadata(shell); err != nil {
+	if err := d.openOutputLog(); err != nil {
 		d.cleanup()
-		fmt.Fprintf(os.Stderr, "daemon: failed to write metadata: %v\n", err)
-		return fmt.Errorf("failed to write metadata: %w", err)
+		fmt.Fprintf(d.log, "daemon: failed to open output log: %v\n", err)
+		return fmt.Errorf("failed to open output log: %w", err)
 	}
 
-	if err := d.startListener(); err != nil {
+	if err := d.openInputLog(); err != nil {
 		d.cleanup()
-		fmt.Fprintf(os.Stderr, "daemon: failed to start listener: %v\n", err)
-		return fmt.Errorf("failed to start listener: %w", err)
+		fmt.Fprintf(d.log, "daemon: failed to open input log: %v\n", err)
+		return fmt.Errorf("failed to open input log: %w", err)
 	}
 
-	// Now detach from terminal
-	if err := d.detachFromTerminal(); err != nil {
+	if err := d.openScript(); err != nil {
 		d.cleanup()
-		fmt.Fprintf(os.Stderr, "daemon: failed to detach: %v\n", err)
-		return fmt.Errorf("failed to detach: %w", err)
+		fmt.Fprintf(d.log, "daemon: failed to open script recording: %v\n", err)
+		return fmt.Errorf("failed to open script recording: %w", err)
 	}
 
-	d.setupSignalHandlers()
-	d.run()
+	if err := d.writeMetadata(); err != nil {
+		d.cleanup()
+		fmt.Fprintf(d.log, "daemon: failed to write metadata: %v\n", err)
+		return fmt.Errorf("failed to write metadata: %w", err)
+	}
 
+	if err := d.startListener(); err != nil {
+		d.cleanup()
+		fmt.Fprintf(d.log, "daemon: failed to start listener: %v\n", err)
+		return fmt.Errorf("failed to start listener: %w", err)
+	}
+
+	if d.cfg.Ready != nil {
+		if err := d.cfg.Ready(); err != nil {
+			d.cleanup()
+			fmt.Fprintf(d.log, "daemon: ready hook failed: %v\n", err)
+			return err
+		}
+	}
 	return nil
 }
 
-func (d *Daemon) detachFromTerminal() error {
+// DetachStdio starts a new session and points stdin, stdout and stderr at
+// /dev/null so the daemon no longer holds the invoking terminal.
+func DetachStdio() error {
 	// Try to create new session, ignore error if already session leader
 	syscall.Setsid()
 
@@ -145,16 +508,65 @@ func (d *Daemon) openPTY() (*os.File, *os.File, error) {
 	if err != nil {
 		return nil, nil, err
 	}
-	if err := setNonBlocking(ptmx); err != nil {
+	master, err := pollable(ptmx)
+	if err != nil {
 		ptmx.Close()
 		pts.Close()
 		return nil, nil, err
 	}
-	return ptmx, pts, nil
+	d.startPacketMode(master)
+	return master, pts, nil
+}
+
+// pollable returns f as a file the runtime's poller waits on, so reading
+// it blocks a goroutine rather than a thread and Close interrupts the
+// read. Taking a file's Fd puts it in blocking mode for good, which the
+// PTY helper does while opening the master, so f is replaced by a
+// non-blocking duplicate and closed.
+func pollable(f *os.File) (*os.File, error) {
+	fd, err := unix.FcntlInt(f.Fd(), unix.F_DUPFD_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.SetNonblock(fd, true); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	name := f.Name()
+	f.Close()
+	return os.NewFile(uintptr(fd), name), nil
+}
+
+// masterControl runs fn on the PTY master's descriptor without taking it
+// out of non-blocking mode, as Fd would.
+func (d *Daemon) masterControl(fn func(fd int) error) error {
+	if d.ptyMaster == nil {
+		return errors.New("no terminal")
+	}
+	return fileControl(d.ptyMaster, fn)
+}
+
+// fileControl runs fn on f's descriptor, leaving it in the mode it is in.
+func fileControl(f *os.File, fn func(fd int) error) error {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var ferr error
+	if err := rc.Control(func(fd uintptr) { ferr = fn(int(fd)) }); err != nil {
+		return err
+	}
+	return ferr
 }
 
-func (d *Daemon) startShell(shell string, pts *os.File) error {
-	d.cmd = exec.Command(shell)
+func (d *Daemon) startCommand(pts *os.File) error {
+	d.cmd = d.cfg.Command
+	if d.cmd == nil {
+		if len(d.cfg.Argv) == 0 {
+			return fmt.Errorf("no command given")
+		}
+		d.cmd = exec.Command(d.cfg.Argv[0], d.cfg.Argv[1:]...)
+	}
 	d.cmd.Stdin = pts
 	d.cmd.Stdout = pts
 	d.cmd.Stderr = pts
@@ -164,37 +576,135 @@ func (d *Daemon) startShell(shell string, pts *os.File) error {
 		// Use child's stdin (fd 0) as controlling TTY
 		Ctty: 0,
 	}
-	d.cmd.Env = append(os.Environ(), fmt.Sprintf("SESS_NUM=%s", d.sessionNum))
-
-	if err := d.cmd.Start(); err != nil {
-		return err
+	if d.cmd.Env == nil {
+		d.cmd.Env = d.cfg.Env
+	}
+	if d.cmd.Env == nil {
+		d.cmd.Env = os.Environ()
+	}
+	d.cmd.Env = append(d.cmd.Env,
+		fmt.Sprintf("SESS_NUM=%s", d.sessionNum),
+		fmt.Sprintf("SESS_SOCKET=%s", d.socketPath),
+		fmt.Sprintf("SESS_ENV=%s", session.EnvFilePath(d.metaPath)),
+	)
+
+	// The respawn helper runs under the limits, so they apply to each
+	// run of the command.
+	var restore func()
+	if d.cfg.Respawn != "" {
+		var err error
+		if restore, err = respawnCommand(d.cmd, d.cfg.Executable, d.cfg.Respawn); err != nil {
+			return err
+		}
 	}
+	var started func() error
+	if len(d.cfg.Rlimits) > 0 {
+		var err error
+		if started, err = d.cfg.Rlimits.limitCommand(d.cmd, d.cfg.Executable); err != nil {
+			return err
+		}
+	}
+	err := d.cmd.Start()
+	if started != nil {
+		if serr := started(); err == nil {
+			err = serr
+		}
+	}
+	if restore != nil {
+		restore()
+	}
+	return err
+}
 
-	return nil
+// waitChild reaps the child and ends the session when it exits. A child
+// that exits while the session is being upgraded is left for the new
+// binary to reap.
+func (d *Daemon) waitChild() {
+	defer d.recoverPanic("waitChild")
+	// Run waits for exited, so it is closed even if Wait panics.
+	defer close(d.exited)
+	awaitExit(d.cmd.Process.Pid)
+	d.upgradeMu.Lock()
+	d.cmd.ProcessState, _ = d.cmd.Process.Wait()
+	d.upgradeMu.Unlock()
+	d.cancel()
 }
 
-func (d *Daemon) writeMetadata(shell string) error {
-	meta := Metadata{
-		SessionNum: d.sessionNum,
-		CreatedAt:  time.Now(),
-		PID:        d.cmd.Process.Pid,
-		Command:    shell,
+// endCommand ends the command as cfg.Kill says, unless it has exited,
+// moving on as soon as it has.
+func (d *Daemon) endCommand() {
+	seq := d.cfg.Kill.OrDefault()
+	if d.expired.Load() {
+		seq = expirySequence(seq)
 	}
-
-	data, err := json.MarshalIndent(meta, "", "  ")
-	if err != nil {
-		return err
+	for _, sig := range seq.Signals {
+		select {
+		case <-d.exited:
+			return
+		default:
+		}
+		d.ending.Store(true)
+		syscall.Kill(-d.cmd.Process.Pid, sig)
+		timer := time.NewTimer(seq.Grace)
+		select {
+		case <-d.exited:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
 	}
+}
 
-	tmpPath := d.metaPath + ".tmp"
-	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
-		return err
+func (d *Daemon) writeMetadata() error {
+	if d.metaPath == "" {
+		return nil
 	}
+	return session.WriteMetadata(d.metaPath, &Metadata{
+		Number:    d.sessionNum,
+		CreatedAt: time.Now(),
+		PID:       d.cmd.Process.Pid,
+		Command:   strings.Join(d.cmd.Args, " "),
+		DaemonPID: os.Getpid(),
+		Version:   d.cfg.Version,
+		Transient: d.cfg.ShutdownOnDisconnect,
+		Log:       d.cfg.OutputLog,
+		InputLog:  d.cfg.InputLog,
+		Termios:   d.cfg.Termios.String(),
+		Rlimits:   d.cfg.Rlimits.String(),
+		EnvMode:   d.cfg.EnvMode,
+
+		Definition: d.cfg.Definition,
+		Respawn:    d.cfg.Respawn,
+		Socket:     d.movedSocket(),
+		Host:       hostname(),
+	})
+}
+
+// hostname returns the name of the machine, or "" if it has none.
+func hostname() string {
+	name, _ := os.Hostname()
+	return name
+}
 
-	return os.Rename(tmpPath, d.metaPath)
+// movedSocket returns the socket path to record in the metadata: the one
+// the daemon listens on, if that is not beside the metadata.
+func (d *Daemon) movedSocket() string {
+	if d.socketPath == "" || filepath.Dir(d.socketPath) == filepath.Dir(d.metaPath) {
+		return ""
+	}
+	return d.socketPath
 }
 
 func (d *Daemon) startListener() error {
+	if d.cfg.Listener != nil {
+		d.listener = d.cfg.Listener
+		return nil
+	}
+
+	// Only replace a socket nothing answers on, never a live daemon's.
+	if socketAnswers(d.socketPath) {
+		return fmt.Errorf("%w: session %s", utils.ErrSessionExists, d.sessionNum)
+	}
 	os.Remove(d.socketPath)
 
 	listener, err := net.Listen("unix", d.socketPath)
@@ -211,244 +721,931 @@ func (d *Daemon) startListener() error {
 	return nil
 }
 
-func (d *Daemon) setupSignalHandlers() {
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGCHLD, syscall.SIGTERM, syscall.SIGINT)
-
-	go func() {
-		for {
-			select {
-			case sig := <-sigChan:
-				switch sig {
-				case syscall.SIGCHLD:
-					var status syscall.WaitStatus
-					_, err := syscall.Wait4(d.cmd.Process.Pid, &status, syscall.WNOHANG, nil)
-					if err == nil && (status.Exited() || status.Signaled()) {
-						d.cancel()
-					}
-				case syscall.SIGTERM, syscall.SIGINT:
-					d.cancel()
-				}
-			case <-d.ctx.Done():
-				return
-			}
-		}
-	}()
+// socketAnswers reports whether a daemon accepts connections on path.
+func socketAnswers(path string) bool {
+	conn, err := net.DialTimeout("unix", path, 200*time.Millisecond)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
 }
 
 func (d *Daemon) run() {
-	d.wg.Add(3)
-	go d.acceptConnections()
+	d.wg.Add(5)
+	d.io.Add(2)
+	go d.acceptConnections(d.listener, false)
 	go d.handlePTY()
 	go d.monitorClients()
+	go d.heartbeat()
+	go d.dumpOnSignal()
 
 	<-d.ctx.Done()
+	select {
+	case <-d.exited:
+		d.drainPTY()
+	default:
+	}
+	// What is at the state's paths may be another session's by now,
+	// and is not cleaned up then.
+	d.checkStateTaken()
+	// Read the metadata before cleanup removes it: CLI commands may have
+	// added to it since the daemon wrote it.
+	var last Metadata
+	haveMeta := d.metaPath != "" && !d.stateLost.Load() && readMetadata(d.metaPath, &last)
 	d.cleanup()
 	d.wg.Wait()
+	if d.metaPath != "" && !d.stateLost.Load() {
+		d.keepScrollback(session.ScrollbackPath(d.metaPath))
+	}
+	if d.scrollback != nil {
+		d.scrollback.Close()
+	}
+	if path := d.preserveLog(); path != "" {
+		last.Log = path
+	}
+	if path := d.closeInputLog(); path != "" {
+		last.InputLog = path
+	}
+	d.closeScript()
+	if haveMeta {
+		d.writeTombstone(&last)
+	}
+	d.dropRestoreSpec()
+}
+
+// openScrollback sets up the in-memory scrollback and its spill file.
+func (d *Daemon) openScrollback() error {
+	if d.cfg.Scrollback <= 0 {
+		return nil
+	}
+	var spill *os.File
+	if d.cfg.ScrollbackSpill {
+		f, err := newSpillFile(d.sessionNum)
+		if err != nil {
+			return err
+		}
+		spill = f
+	}
+	d.scrollback = newScrollback(d.cfg.Scrollback, spill)
+	return nil
+}
+
+// keepScrollback writes the scrollback to path for sess save to find once
+// the session has ended, or removes what an earlier session with the same
+// number left there if this one keeps none.
+func (d *Daemon) keepScrollback(path string) {
+	if !d.cfg.ScrollbackKeep || d.scrollback == nil {
+		os.Remove(path)
+		return
+	}
+	spilled, held, err := d.scrollback.Snapshot(0, 0, true)
+	if err != nil {
+		// The spilled history has a hole in it; keep what is in memory.
+		fmt.Fprintf(d.log, "daemon: %v\n", err)
+		spilled, held, _ = d.scrollback.Snapshot(0, 0, false)
+	}
+
+	tmpPath := path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		fmt.Fprintf(d.log, "daemon: failed to keep scrollback: %v\n", err)
+		return
+	}
+	if spilled != nil {
+		_, err = io.Copy(f, spilled)
+	}
+	if err == nil {
+		_, err = f.Write(held)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		fmt.Fprintf(d.log, "daemon: failed to keep scrollback: %v\n", err)
+	}
+}
+
+// handleScrollback answers a SCROLLBACK request with the output asked for,
+// sent raw after the reply line.
+func (d *Daemon) handleScrollback(conn net.Conn, msg *protocol.Message) {
+	var req protocol.ScrollbackPayload
+	if err := msg.Decode(&req); err != nil {
+		d.sendError(conn, "malformed SCROLLBACK")
+		return
+	}
+	if d.scrollback == nil {
+		d.sendError(conn, "session keeps no scrollback")
+		return
+	}
+	spilled, held, err := d.scrollback.Snapshot(req.Bytes, req.Lines, req.All)
+	if err != nil {
+		d.sendError(conn, err.Error())
+		return
+	}
+	size := int64(len(held))
+	if spilled != nil {
+		size += spilled.Size()
+	}
+	d.sendMessage(conn, protocol.MsgScrollback, protocol.ScrollbackReply{Size: size})
+
+	// The spilled history may be large: allow time per chunk rather than
+	// for the whole transfer.
+	w := deadlineWriter{conn: conn, timeout: 5 * time.Second}
+	if spilled != nil {
+		if _, err := io.Copy(w, spilled); err != nil {
+			d.debugf("scrollback: %v", err)
+			return
+		}
+	}
+	w.Write(held)
 }
 
-func (d *Daemon) acceptConnections() {
+// deadlineWriter writes to conn, giving each write its own deadline.
+type deadlineWriter struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (w deadlineWriter) Write(p []byte) (int, error) {
+	w.conn.SetWriteDeadline(time.Now().Add(w.timeout))
+	return w.conn.Write(p)
+}
+
+// openOutputLog starts recording the session's output. A log left at the
+// same path by an earlier session that never preserved it (its daemon was
+// killed) is preserved first, stamped with when it was last written. Older
+// logs are then pruned so the new one starts within the disk limit.
+func (d *Daemon) openOutputLog() error {
+	if d.cfg.OutputLog == "" {
+		return nil
+	}
+	if info, err := os.Stat(d.cfg.OutputLog); err == nil {
+		if _, err := session.PreserveLog(d.cfg.OutputLog, info.ModTime()); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(d.cfg.OutputLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	d.outputLog = f
+	if _, err := session.PruneLogs(filepath.Dir(d.cfg.OutputLog), d.cfg.LogRetention); err != nil {
+		fmt.Fprintf(d.log, "daemon: failed to prune logs: %v\n", err)
+	}
+	return nil
+}
+
+// recordOutput appends PTY output to the output log. If writing fails the
+// session carries on unrecorded.
+func (d *Daemon) recordOutput(data []byte) {
+	if d.outputLog == nil {
+		return
+	}
+	if _, err := d.outputLog.Write(data); err != nil {
+		fmt.Fprintf(d.log, "daemon: output log: %v; no longer recording\n", err)
+		d.outputLog.Close()
+		d.outputLog = nil
+	}
+}
+
+// preserveLog closes the output log and renames it with the exit time so it
+// outlives the session, then prunes older logs. It returns the preserved
+// path, or "" if the session kept no log.
+func (d *Daemon) preserveLog() string {
+	if d.cfg.OutputLog == "" {
+		return ""
+	}
+	if d.outputLog != nil {
+		d.outputLog.Close()
+		d.outputLog = nil
+	}
+	if d.stateLost.Load() {
+		return ""
+	}
+	path, err := session.PreserveLog(d.cfg.OutputLog, time.Now())
+	if err != nil {
+		fmt.Fprintf(d.log, "daemon: failed to preserve output log: %v\n", err)
+		return ""
+	}
+	if _, err := session.PruneLogs(filepath.Dir(path), d.cfg.LogRetention); err != nil {
+		fmt.Fprintf(d.log, "daemon: failed to prune logs: %v\n", err)
+	}
+	return path
+}
+
+// writeTombstone records how the session's command ended, for sess ls --all.
+func (d *Daemon) writeTombstone(s *Metadata) {
+	select {
+	case <-d.exited:
+	case <-time.After(2 * time.Second):
+		return
+	}
+	exit := d.exitInfo()
+	if d.expired.Load() {
+		exit.Reason = session.ReasonExpired
+	}
+	if where := d.panicked.Load(); where != nil {
+		exit.Reason = "daemon panicked in " + *where
+	}
+	if err := session.WriteTombstone(session.TombstonePath(d.metaPath), &session.Tombstone{Session: *s, Exit: exit}); err != nil {
+		fmt.Fprintf(d.log, "daemon: failed to write tombstone: %v\n", err)
+	}
+}
+
+// dropRestoreSpec removes the session's restore spec, unless the session
+// was lost rather than ended: the daemon was told to shut down by a signal,
+// or the command was killed by SIGTERM, SIGHUP or SIGKILL without the
+// daemon sending it. A shutdown does both, and the spec then lets sess
+// restore start the session again after the reboot. A command ended by
+// Ctrl-C was ended by its user.
+func (d *Daemon) dropRestoreSpec() {
+	if d.metaPath == "" || d.parent.Err() != nil || d.stateLost.Load() {
+		return
+	}
+	select {
+	case <-d.exited:
+	default:
+		return
+	}
+	if d.cmd.ProcessState == nil {
+		return
+	}
+	if ws, ok := d.cmd.ProcessState.Sys().(syscall.WaitStatus); ok && ws.Signaled() && !d.ending.Load() {
+		switch ws.Signal() {
+		case syscall.SIGTERM, syscall.SIGHUP, syscall.SIGKILL:
+			return
+		}
+	}
+	os.Remove(session.RestoreSpecPath(d.metaPath))
+}
+
+// exitInfo describes how the session's command ended. It may only be
+// called once d.exited is closed.
+func (d *Daemon) exitInfo() session.ExitInfo {
+	exit := session.ExitInfo{ExitedAt: time.Now(), Status: d.cmd.ProcessState.ExitCode()}
+	if ws, ok := d.cmd.ProcessState.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		exit.Signal = unix.SignalName(ws.Signal())
+		if ws.Signal() == syscall.SIGKILL && platform.OOMKilled(d.cmd.Process.Pid) {
+			exit.Reason = session.ReasonOOM
+		}
+	}
+	return exit
+}
+
+// readMetadata decodes the metadata at path into s, reporting success.
+func readMetadata(path string, s *Metadata) bool {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	return json.Unmarshal(data, s) == nil
+}
+
+// locked reports whether the session's metadata says it is locked. It is
+// read afresh for each attach, since sess lock changes it on disk.
+func (d *Daemon) locked() bool {
+	var m Metadata
+	return d.metaPath != "" && readMetadata(d.metaPath, &m) && m.Locked
+}
+
+// acceptConnections blocks in Accept until listener is closed, so an idle
+// daemon does not wake up to poll for shutdown. viaShared marks the socket
+// other users connect to.
+func (d *Daemon) acceptConnections(listener net.Listener, viaShared bool) {
 	defer d.wg.Done()
+	defer d.io.Done()
+	defer d.recoverPanic("acceptConnections")
 
 	for {
-		select {
-		case <-d.ctx.Done():
-			return
-		default:
-			d.listener.(*net.UnixListener).SetDeadline(time.Now().Add(1 * time.Second))
-			conn, err := d.listener.Accept()
-			if err != nil {
-				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-					continue
-				}
-				continue
+		conn, err := listener.Accept()
+		if err != nil {
+			if d.ctx.Err() != nil || errors.Is(err, net.ErrClosed) || d.paused(err) {
+				return
+			}
+			// Out of file descriptors and the like: back off rather
+			// than spin.
+			d.debugf("accept: %v", err)
+			select {
+			case <-d.ctx.Done():
+				return
+			case <-time.After(100 * time.Millisecond):
 			}
+			continue
+		}
+
+		go d.handleNewConnection(conn, viaShared)
+	}
+}
 
-			d.handleNewConnection(conn)
+// handleNewConnection reads the client's opening message and either
+// answers a one-shot query or registers an attaching client. Users other
+// than the owner may only attach, as far as the share list allows.
+func (d *Daemon) handleNewConnection(conn net.Conn, viaShared bool) {
+	defer d.dropOnPanic("handleNewConnection", conn)
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	msg, err := protocol.ReadMessageFrom(reader)
+	if err != nil {
+		d.debugf("handshake failed: %v", err)
+		conn.Close()
+		return
+	}
+
+	p := identify(conn, viaShared)
+	if !p.owner {
+		if _, err := d.shareAllows(p.uid, protocol.ModePeek); err != nil {
+			d.debugf("refused uid %d: %v", p.uid, err)
+			d.deny(conn, err)
+			return
+		}
+		if msg.Type != protocol.MsgConnect {
+			d.deny(conn, fmt.Errorf("users session %s is shared with may only attach", d.sessionNum))
+			return
 		}
 	}
+
+	d.controls.add(fmt.Sprintf("request (pid %d)", p.pid), msg.Type)
+	d.touchHeartbeat()
+	d.keepState(false)
+	switch msg.Type {
+	case protocol.MsgStatus:
+		d.sendMessage(conn, protocol.MsgStatus, d.status())
+		conn.Close()
+	case protocol.MsgInput:
+		d.handleInput(conn, msg)
+		conn.Close()
+	case protocol.MsgSignal:
+		d.handleSignal(conn, msg)
+		conn.Close()
+	case protocol.MsgEnv:
+		d.handleEnv(conn, msg)
+		conn.Close()
+	case protocol.MsgDetach:
+		d.handleDetach(conn, msg)
+		conn.Close()
+	case protocol.MsgScrollback:
+		d.handleScrollback(conn, msg)
+		conn.Close()
+	case protocol.MsgShare:
+		d.handleShare(conn, msg)
+		conn.Close()
+	case protocol.MsgUpgrade:
+		d.handleUpgrade(conn, msg)
+		conn.Close()
+	case protocol.MsgTriggers:
+		d.handleTriggers(conn, msg)
+		conn.Close()
+	case protocol.MsgTimeout:
+		d.handleTimeout(conn, msg)
+		conn.Close()
+	case protocol.MsgDump:
+		d.writeDump()
+		d.sendMessage(conn, protocol.MsgReady, nil)
+		conn.Close()
+	case protocol.MsgConnect:
+		var hello protocol.ConnectPayload
+		if err := msg.Decode(&hello); err != nil {
+			d.sendError(conn, "malformed CONNECT")
+			conn.Close()
+			return
+		}
+		if d.locked() && !(hello.Force && p.owner) {
+			d.sendMessage(conn, protocol.MsgError, protocol.ErrorPayload{
+				Message: utils.LockedError(d.sessionNum).Error(),
+				Code:    protocol.ErrCodeLocked,
+			})
+			conn.Close()
+			return
+		}
+		d.addClient(conn, reader, hello, p)
+	default:
+		d.sendError(conn, fmt.Sprintf("unknown request %q", msg.Type))
+		conn.Close()
+	}
+}
+
+// handleEnv applies a one-shot ENV request to the daemon's environment and
+// acknowledges with READY. The running shell is not affected; it reads the
+// session's env file instead.
+func (d *Daemon) handleEnv(conn net.Conn, msg *protocol.Message) {
+	var env protocol.EnvPayload
+	if err := msg.Decode(&env); err != nil {
+		d.sendError(conn, "malformed ENV")
+		return
+	}
+	for key, value := range env.Set {
+		if err := os.Setenv(key, value); err != nil {
+			d.sendError(conn, fmt.Sprintf("setenv %s: %v", key, err))
+			return
+		}
+	}
+	for _, key := range env.Unset {
+		os.Unsetenv(key)
+	}
+	d.sendMessage(conn, protocol.MsgReady, nil)
+}
+
+// handleDetach disconnects every client, telling them the reason a
+// one-shot DETACH request gives, and acknowledges with READY once they
+// are gone.
+func (d *Daemon) handleDetach(conn net.Conn, msg *protocol.Message) {
+	var req protocol.DetachPayload
+	if err := msg.Decode(&req); err != nil {
+		d.sendError(conn, "malformed DETACH")
+		return
+	}
+	d.clientMutex.RLock()
+	clients := make([]*client, 0, len(d.clients))
+	for _, c := range d.clients {
+		clients = append(clients, c)
+	}
+	d.clientMutex.RUnlock()
+	for _, c := range clients {
+		d.detachClient(c, req.Reason)
+	}
+	d.sendMessage(conn, protocol.MsgReady, nil)
 }
 
-func (d *Daemon) handleNewConnection(conn net.Conn) {
+// handleInput types the bytes of a one-shot INPUT request into the session
+// and acknowledges with READY.
+func (d *Daemon) handleInput(conn net.Conn, msg *protocol.Message) {
+	var in protocol.InputPayload
+	if err := msg.Decode(&in); err != nil {
+		d.sendError(conn, "malformed INPUT")
+		return
+	}
+	d.lastInput.Store(time.Now().UnixNano())
+	if d.inputLog != nil {
+		pid, _ := platform.PeerCred(conn)
+		d.recordInput(fmt.Sprintf("send (pid %d)", pid), in.Data)
+	}
+	if _, err := d.ptyMaster.Write(in.Data); err != nil {
+		d.sendError(conn, fmt.Sprintf("write failed: %v", err))
+		return
+	}
+	d.sendMessage(conn, protocol.MsgReady, nil)
+}
+
+func (d *Daemon) addClient(conn net.Conn, reader *bufio.Reader, hello protocol.ConnectPayload, p peer) {
 	d.clientMutex.Lock()
 	defer d.clientMutex.Unlock()
 
-	if len(d.clients) > 0 {
-		conn.Write([]byte("ERROR: Session already has an active connection\n"))
+	if hello.Mode != protocol.ModePeek {
+		hello.Mode = protocol.ModeAttach
+	}
+	// Checked again under clientMutex, so a client cannot slip in past a
+	// revocation that is disconnecting the others.
+	var shared protocol.SharedUser
+	if !p.owner {
+		var err error
+		if shared, err = d.shareAllows(p.uid, hello.Mode); err != nil {
+			d.deny(conn, err)
+			return
+		}
+	}
+
+	if d.upgrading.Load() {
+		d.sendError(conn, fmt.Sprintf("session %s is being upgraded; try again", d.sessionNum))
 		conn.Close()
 		return
 	}
 
+	if hello.Mode == protocol.ModePeek && d.direct.Load() != nil {
+		d.sendError(conn, fmt.Sprintf("session %s is attached directly, so there is no output to peek at", d.sessionNum))
+		conn.Close()
+		return
+	}
+
+	if hello.Mode == protocol.ModeAttach {
+		for _, c := range d.clients {
+			if c.info.Mode == protocol.ModeAttach {
+				d.sendMessage(conn, protocol.MsgError, protocol.ErrorPayload{
+					Message: "Session already has an active connection",
+					Code:    protocol.ErrCodeBusy,
+				})
+				conn.Close()
+				return
+			}
+		}
+	}
+
 	// Do not toggle nonblocking on the net.Conn; deadlines are used instead.
 
-	d.clients[conn] = &client{
+	now := time.Now()
+	c := &client{
 		conn:         conn,
-		lastActivity: time.Now(),
+		reader:       reader,
+		info:         protocol.ClientInfo{Mode: hello.Mode, TTY: hello.TTY, SSH: hello.SSH, NoResize: hello.NoResize, User: shared.Name},
+		connectedAt:  now,
+		peerPID:      p.pid,
+		uid:          p.uid,
+		owner:        p.owner,
+		lastActivity: now,
+		framed:       hello.Framed,
+	}
+	direct := hello.Direct && d.lendPTY(c)
+	d.clients[conn] = c
+	d.refreshClientList()
+	if hello.Mode == protocol.ModeAttach {
+		d.lastAttach.Store(now.UnixNano())
+	}
+
+	ready := d.readyPayload()
+	ready.Framed = c.framed
+	if hello.Size != nil && hello.Mode == protocol.ModeAttach && !hello.NoResize {
+		if size, ok := protocol.ClampSize(*hello.Size); ok {
+			d.resize(size)
+			ready.Sized = true
+		}
+	}
+	if direct {
+		ready.Direct = true
+		if err := d.sendDirect(conn, ready); err != nil {
+			// The read loop finds the connection broken and takes the
+			// terminal back.
+			d.debugf("lending the terminal: %v", err)
+		}
+	} else {
+		d.sendMessage(conn, protocol.MsgReady, ready)
+	}
+	d.debugf("%s client connected (pid %d, tty %q, direct %v); sent READY", hello.Mode, c.peerPID, hello.TTY, direct)
+
+	// Start per-connection reader to minimize input latency. Its read
+	// blocks until the client sends something; cleanup closes the
+	// connection to end it, and an upgrade sets a deadline to pause it.
+	conn.SetReadDeadline(time.Time{})
+	d.io.Add(1)
+	go d.clientReadLoop(c)
+}
+
+// readyPayload identifies the daemon to an accepted client.
+func (d *Daemon) readyPayload() protocol.ReadyPayload {
+	ready := protocol.ReadyPayload{
+		Session:   d.sessionNum,
+		PID:       os.Getpid(),
+		Version:   protocol.Version,
+		AltScreen: d.altScreen.On(),
+		Pixels:    true,
+	}
+	if d.cmd != nil && d.cmd.Process != nil {
+		ready.ChildPID = d.cmd.Process.Pid
+	}
+	return ready
+}
+
+func (d *Daemon) sendMessage(conn net.Conn, msgType string, payload interface{}) {
+	data, err := protocol.EncodeMessage(msgType, payload)
+	if err != nil {
+		d.debugf("encode %s: %v", msgType, err)
+		return
 	}
+	conn.SetWriteDeadline(time.Now().Add(1 * time.Second))
+	conn.Write(data)
+}
 
-	conn.Write([]byte("READY\n"))
-	debugf("client connected; sent READY")
+// sendFrame sends a message to a framed client as a control frame and
+// reports whether it was written in full. A client that got only part of a
+// frame can no longer find the frames that follow, so it is dropped.
+func (d *Daemon) sendFrame(conn net.Conn, msgType string, payload interface{}) bool {
+	frame, err := protocol.EncodeControlFrame(msgType, payload)
+	if err != nil {
+		d.debugf("encode %s: %v", msgType, err)
+		return true
+	}
+	conn.SetWriteDeadline(time.Now().Add(1 * time.Second))
+	if n, err := conn.Write(frame); err != nil {
+		d.debugf("send %s: wrote %d of %d bytes: %v", msgType, n, len(frame), err)
+		d.removeClient(conn)
+		return false
+	}
+	return true
+}
 
-	// Start per-connection reader to minimize input latency
-	go d.clientReadLoop(conn)
+func (d *Daemon) sendError(conn net.Conn, message string) {
+	d.sendMessage(conn, protocol.MsgError, protocol.ErrorPayload{Message: message})
 }
 
 // clientReadLoop continuously reads from the client socket and forwards
-// control/data to the PTY with low latency.
-func (d *Daemon) clientReadLoop(conn net.Conn) {
+// control/data to the PTY with low latency. Input from peek clients is
+// never forwarded.
+func (d *Daemon) clientReadLoop(cl *client) {
+	defer d.io.Done()
+	defer d.dropOnPanic("clientReadLoop", cl.conn)
+	conn, reader := cl.conn, cl.reader
+	peek := cl.info.Mode == protocol.ModePeek
 	buffer := make([]byte, 4096)
 	for {
-		select {
-		case <-d.ctx.Done():
-			return
-		default:
-			conn.SetReadDeadline(time.Now().Add(readTimeout))
-			n, err := conn.Read(buffer)
-			if err != nil {
-				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-					continue
-				}
+		n, err := reader.Read(buffer)
+		if err != nil {
+			if !d.paused(err) {
 				d.removeClient(conn)
-				return
 			}
-			if n > 0 {
-				d.clientMutex.Lock()
-				if c, ok := d.clients[conn]; ok {
-					c.lastActivity = time.Now()
-				}
-				d.clientMutex.Unlock()
-
-				s := string(buffer[:n])
-				switch {
-				case s == "DISCONNECT\n":
-					d.removeClient(conn)
+			return
+		}
+		if n == 0 {
+			continue
+		}
+		cl.bytesIn.Add(uint64(n))
+		d.clientMutex.Lock()
+		cl.lastActivity = time.Now()
+		d.clientMutex.Unlock()
+
+		if cmds := protocol.ControlCommands(buffer[:n]); cmds != nil {
+			for _, cmd := range cmds {
+				if !d.handleControl(cl, cmd) {
 					return
-				case s == "PING\n":
-					conn.SetWriteDeadline(time.Now().Add(1 * time.Second))
-					conn.Write([]byte("PONG\n"))
-				case strings.HasPrefix(s, "RESIZE "):
-					var r, c int
-					fields := strings.Fields(s)
-					if len(fields) >= 3 {
-						r, _ = strconv.Atoi(fields[1])
-						c, _ = strconv.Atoi(fields[2])
-						// Apply size using pty helper on slave/master
-						if d.ptySlave != nil {
-							_ = ptylib.Setsize(d.ptySlave, &ptylib.Winsize{Rows: uint16(r), Cols: uint16(c)})
-						}
-						if d.ptyMaster != nil {
-							_ = ptylib.Setsize(d.ptyMaster, &ptylib.Winsize{Rows: uint16(r), Cols: uint16(c)})
-						}
-						// Ensure the shell is notified of the change
-						if d.cmd != nil && d.cmd.Process != nil {
-							_ = syscall.Kill(-d.cmd.Process.Pid, syscall.SIGWINCH)
-						}
-						// Best-effort verify via slave winsize
-						if d.ptySlave != nil {
-							if cur, err := unix.IoctlGetWinsize(int(d.ptySlave.Fd()), unix.TIOCGWINSZ); err == nil {
-								debugf("applied resize: req=%dx%d, got=%dx%d", r, c, cur.Row, cur.Col)
-							}
-						}
-					}
-				default:
-					d.ptyMaster.Write(buffer[:n])
 				}
 			}
+			continue
+		}
+		if peek {
+			// Read-only: drop keystrokes.
+			continue
+		}
+		d.lastInput.Store(time.Now().UnixNano())
+		if d.inputLog != nil {
+			d.recordInput(cl.describe(), buffer[:n])
 		}
+		d.ptyMaster.Write(buffer[:n])
 	}
 }
 
 func (d *Daemon) handlePTY() {
 	defer d.wg.Done()
-
-	buffer := make([]byte, 4096)
+	defer d.io.Done()
+	defer close(d.ptyDone)
+	defer d.recoverPanic("handlePTY")
+
+	// Output is read in after room for a frame header, so framed clients
+	// get the chunk as one write without copying it. In packet mode the
+	// status byte is read into the header's last byte, which the header
+	// then overwrites.
+	frame := make([]byte, protocol.FrameHeaderSize+4096)
+	buffer := frame[protocol.FrameHeaderSize:]
+	flood := floodMeter{since: time.Now()}
+	// The master is read through the runtime poller, so an idle session
+	// costs no wakeups; cleanup closes it to end the loop.
 	for {
-		select {
-		case <-d.ctx.Done():
-			return
-		default:
-			n, err := d.ptyMaster.Read(buffer)
-			if err != nil {
-				if errors.Is(err, syscall.EAGAIN) {
-					time.Sleep(10 * time.Millisecond)
-					continue
-				}
-				return
+		var n int
+		var err error
+		if d.packet {
+			n, err = d.ptyMaster.Read(frame[protocol.FrameHeaderSize-1:])
+		} else {
+			n, err = d.ptyMaster.Read(buffer)
+		}
+		if err != nil {
+			if d.handBack(err) {
+				continue
 			}
-
-			if n > 0 {
-				d.broadcastToClients(buffer[:n])
+			return
+		}
+		if d.packet && n > 0 {
+			// A status other than zero comes alone, without output.
+			if status := frame[protocol.FrameHeaderSize-1]; status != 0 {
+				d.flow(status)
+				continue
 			}
+			n--
+		}
+		if n == 0 {
+			continue
+		}
+		d.lastOutput.Store(time.Now().UnixNano())
+		d.bytesOut.Add(uint64(n))
+		protocol.WriteFrameHeader(frame, protocol.FrameData, n)
+		d.broadcastToClients(frame[:protocol.FrameHeaderSize+n])
+		d.altScreen.Write(buffer[:n])
+		d.title.Write(buffer[:n])
+		d.cwd.Write(buffer[:n])
+		d.answerQueries(buffer[:n])
+		d.recordOutput(buffer[:n])
+		d.recordScript(buffer[:n])
+		d.matchTriggers(buffer[:n])
+		if d.scrollback != nil {
+			d.scrollback.Write(buffer[:n])
+		}
+		if flood.add(n) && d.throttled() {
+			d.parkPTY()
 		}
 	}
 }
 
-func (d *Daemon) broadcastToClients(data []byte) {
-	d.clientMutex.RLock()
-	defer d.clientMutex.RUnlock()
+// drainPTY waits for handlePTY to relay what the command wrote just before
+// it exited, so clients see all of it before they are told it ended. The
+// daemon holds no descriptor for the terminal's slave side, so the master
+// reads EIO once the command and whatever it left running are gone.
+func (d *Daemon) drainPTY() {
+	d.ptyMaster.SetReadDeadline(time.Now().Add(ptyDrainTimeout))
+	<-d.ptyDone
+}
 
-	for conn := range d.clients {
-		conn.SetWriteDeadline(time.Now().Add(1 * time.Second))
-		if _, err := conn.Write(data); err != nil {
-			go d.removeClient(conn)
+// broadcastToClients writes a chunk of output, given as a data frame, to
+// every client: whole to framed clients, without its header to the rest. It
+// runs for every chunk the PTY produces, so it works from the client
+// snapshot and allocates nothing; clients that fail are dropped once the
+// chunk is out.
+func (d *Daemon) broadcastToClients(frame []byte) {
+	list := d.clientList.Load()
+	if list == nil {
+		return
+	}
+	deadline := time.Now().Add(1 * time.Second)
+	failed := d.failed[:0]
+	for _, c := range *list {
+		data := frame[protocol.FrameHeaderSize:]
+		if c.framed {
+			data = frame
+		}
+		c.conn.SetWriteDeadline(deadline)
+		n, err := c.conn.Write(data)
+		c.bytesOut.Add(uint64(n))
+		if err != nil {
+			failed = append(failed, c.conn)
 		}
 	}
+	for _, conn := range failed {
+		d.removeClient(conn)
+	}
+	d.failed = failed[:0]
+}
+
+// refreshClientList publishes a new snapshot of clients. The caller holds
+// clientMutex for writing.
+func (d *Daemon) refreshClientList() {
+	list := make([]*client, 0, len(d.clients))
+	for _, c := range d.clients {
+		list = append(list, c)
+	}
+	d.clientList.Store(&list)
+
+	select {
+	case d.clientsChanged <- struct{}{}:
+	default:
+	}
+	d.wakePTY()
 }
 
+// monitorClients drops interactive clients that have gone quiet. Its ticker
+// only runs while an interactive client is connected, so a detached
+// session has no periodic wakeups.
 func (d *Daemon) monitorClients() {
 	defer d.wg.Done()
+	defer d.recoverPanic("monitorClients")
 
-	ticker := time.NewTicker(1 * time.Second)
-	defer ticker.Stop()
+	var ticker *time.Ticker
+	var tick <-chan time.Time
+	defer func() {
+		if ticker != nil {
+			ticker.Stop()
+		}
+	}()
 
 	for {
 		select {
 		case <-d.ctx.Done():
 			return
-		case <-ticker.C:
+		case <-d.clientsChanged:
+			watching := d.hasInteractiveClient()
+			switch {
+			case watching && ticker == nil:
+				ticker = time.NewTicker(1 * time.Second)
+				tick = ticker.C
+			case !watching && ticker != nil:
+				ticker.Stop()
+				ticker, tick = nil, nil
+			}
+		case <-tick:
 			d.checkClientTimeouts()
 		}
 	}
 }
 
-func (d *Daemon) checkClientTimeouts() {
-	d.clientMutex.Lock()
-	defer d.clientMutex.Unlock()
+// hasInteractiveClient reports whether a non-peek client is connected.
+func (d *Daemon) hasInteractiveClient() bool {
+	list := d.clientList.Load()
+	if list == nil {
+		return false
+	}
+	for _, c := range *list {
+		if c.info.Mode != protocol.ModePeek {
+			return true
+		}
+	}
+	return false
+}
 
+func (d *Daemon) checkClientTimeouts() {
+	var idle []*client
+	d.clientMutex.RLock()
 	now := time.Now()
-	for conn, client := range d.clients {
+	for _, client := range d.clients {
+		// Peek clients never send anything, so idleness says nothing.
+		if client.info.Mode == protocol.ModePeek {
+			continue
+		}
 		if now.Sub(client.lastActivity) > connectionTimeout {
-			go d.removeClient(conn)
+			idle = append(idle, client)
 		}
 	}
+	d.clientMutex.RUnlock()
+
+	for _, c := range idle {
+		d.detachClient(c, fmt.Sprintf("nothing heard from the client for %s", connectionTimeout))
+	}
+}
+
+// farewell returns the control frame telling clients why the daemon is
+// closing their connections: EXIT if the session's command ended, else
+// DETACH.
+func (d *Daemon) farewell() []byte {
+	var frame []byte
+	select {
+	case <-d.exited:
+		exit := d.exitInfo()
+		frame, _ = protocol.EncodeControlFrame(protocol.MsgExit, protocol.ExitPayload{Status: exit.Status, Signal: exit.Signal})
+	default:
+		reason, _ := d.shutdownReason()
+		frame, _ = protocol.EncodeControlFrame(protocol.MsgDetach, protocol.DetachPayload{Reason: reason})
+	}
+	return frame
+}
+
+// shutdownReason says why the session is shutting down: the cause Run's
+// context was cancelled with, if it was given one.
+func (d *Daemon) shutdownReason() (reason string, given bool) {
+	if d.expired.Load() {
+		return expiredReason, true
+	}
+	if d.stateLost.Load() {
+		return stateLostReason, true
+	}
+	cause := context.Cause(d.ctx)
+	if cause == nil || errors.Is(cause, context.Canceled) {
+		return "the session is shutting down", false
+	}
+	return cause.Error(), true
+}
+
+// detachClient disconnects c while the session goes on, telling it why if
+// it can tell a control message from output.
+func (d *Daemon) detachClient(c *client, reason string) {
+	d.debugf("detaching %s: %s", c.describe(), reason)
+	if c.framed {
+		d.sendFrame(c.conn, protocol.MsgDetach, protocol.DetachPayload{Reason: reason})
+	}
+	d.removeClient(c.conn)
 }
 
 func (d *Daemon) removeClient(conn net.Conn) {
 	d.clientMutex.Lock()
 	defer d.clientMutex.Unlock()
 
-	if _, ok := d.clients[conn]; ok {
+	if c, ok := d.clients[conn]; ok {
 		conn.Close()
 		delete(d.clients, conn)
+		d.refreshClientList()
+		if c.direct != nil {
+			close(c.direct.done)
+		}
+		if d.cfg.ShutdownOnDisconnect && c.info.Mode == protocol.ModeAttach {
+			d.debugf("interactive client left; shutting down transient session")
+			d.cancel()
+		}
 	}
 }
 
 func (d *Daemon) cleanup() {
+	farewell := d.farewell()
 	d.clientMutex.Lock()
-	for conn := range d.clients {
+	deadline := time.Now().Add(1 * time.Second)
+	for conn, c := range d.clients {
+		if c.framed && farewell != nil {
+			conn.SetWriteDeadline(deadline)
+			conn.Write(farewell)
+		}
 		conn.Close()
 	}
 	d.clients = make(map[net.Conn]*client)
+	d.refreshClientList()
 	d.clientMutex.Unlock()
 
+	d.upgradeMu.Lock()
 	if d.listener != nil {
 		d.listener.Close()
 	}
+	d.upgradeMu.Unlock()
+	d.shareMu.Lock()
+	d.shareClosed = true
+	d.closeSharedSocket()
+	d.shareMu.Unlock()
 
 	if d.cmd != nil && d.cmd.Process != nil {
-		d.cmd.Process.Signal(syscall.SIGTERM)
-		time.Sleep(1 * time.Second)
-		d.cmd.Process.Kill()
+		d.endCommand()
 	}
 
 	if d.ptyMaster != nil {
@@ -458,27 +1655,18 @@ func (d *Daemon) cleanup() {
 		d.ptySlave.Close()
 	}
 
-	os.Remove(d.socketPath)
-	os.Remove(d.metaPath)
-	os.Remove(filepath.Join(filepath.Dir(d.metaPath), ".current_session"))
-}
-
-func setNonBlocking(file interface{}) error {
-	var fd int
-	switch f := file.(type) {
-	case *os.File:
-		fd = int(f.Fd())
-	case net.Conn:
-		if unixConn, ok := f.(*net.UnixConn); ok {
-			file, _ := unixConn.File()
-			fd = int(file.Fd())
-			defer file.Close()
-		} else {
-			return fmt.Errorf("unsupported connection type")
-		}
-	default:
-		return fmt.Errorf("unsupported file type")
+	if d.stateLost.Load() {
+		// Another session may have the socket's and metadata's
+		// paths by now.
+		return
+	}
+	if d.socketPath != "" {
+		os.Remove(d.socketPath)
+	}
+	if d.metaPath != "" {
+		os.Remove(d.metaPath)
+		os.Remove(session.EnvFilePath(d.metaPath))
+		os.Remove(session.HeartbeatPath(d.metaPath))
+		os.Remove(filepath.Join(filepath.Dir(d.metaPath), ".current_session"))
 	}
-
-	return unix.SetNonblock(fd, true)
 }
@@ -0,0 +1,702 @@
+package daemon
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/theMichaelB/sess/internal/platform"
+	"github.com/theMichaelB/sess/internal/session"
+	"github.com/theMichaelB/sess/pkg/protocol"
+	"golang.org/x/sys/unix"
+)
+
+// testSession is a daemon served in-process on a temporary socket.
+type testSession struct {
+	d      *Daemon
+	socket string
+	cancel context.CancelFunc
+	// cancelCause shuts the session down giving a reason.
+	cancelCause context.CancelCauseFunc
+	done        chan struct{}
+	status      int
+	err         error
+}
+
+// startDaemon runs cmd as a session on a socket in a temporary directory.
+func startDaemon(t testing.TB, cmd *exec.Cmd) *testSession {
+	t.Helper()
+	return startDaemonConfig(t, Config{Command: cmd})
+}
+
+// startDaemonConfig is startDaemon for a daemon configured as cfg, which
+// need not say where it listens or what size its terminal is.
+func startDaemonConfig(t testing.TB, cfg Config) *testSession {
+	t.Helper()
+	socket := filepath.Join(t.TempDir(), "session-001.sock")
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.SessionNum = "001"
+	cfg.SocketPath = socket
+	cfg.Listener = ln
+	cfg.Rows, cfg.Cols = 24, 80
+	ctx, cancel := context.WithCancelCause(context.Background())
+	s := &testSession{
+		d:           New(cfg),
+		socket:      socket,
+		cancel:      func() { cancel(nil) },
+		cancelCause: cancel,
+		done:        make(chan struct{}),
+	}
+	go func() {
+		s.status, s.err = s.d.Run(ctx)
+		close(s.done)
+	}()
+	t.Cleanup(func() {
+		s.cancel()
+		s.wait(t)
+	})
+	return s
+}
+
+// wait waits for Run to return.
+func (s *testSession) wait(t testing.TB) {
+	t.Helper()
+	select {
+	case <-s.done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("daemon did not shut down")
+	}
+}
+
+// testClient is a framed attach client.
+type testClient struct {
+	conn net.Conn
+	rm   *protocol.RawMode
+
+	mu      sync.Mutex
+	out     bytes.Buffer
+	control []*protocol.Message
+}
+
+// attach connects to s as a framed interactive client.
+func attach(t testing.TB, s *testSession) *testClient {
+	t.Helper()
+	conn, err := net.Dial("unix", s.socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	hello, err := protocol.EncodeMessage(protocol.MsgConnect, protocol.ConnectPayload{Mode: protocol.ModeAttach, Framed: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(hello); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	msg, err := protocol.ReadMessageFrom(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ready protocol.ReadyPayload
+	if msg.Type != protocol.MsgReady || msg.Decode(&ready) != nil || !ready.Framed {
+		t.Fatalf("handshake: got %s %s", msg.Type, msg.Payload)
+	}
+	c := &testClient{conn: conn}
+	c.rm = protocol.NewFramedRawMode(conn, func(m *protocol.Message) {
+		c.mu.Lock()
+		c.control = append(c.control, m)
+		c.mu.Unlock()
+	})
+	rest, _ := r.Peek(r.Buffered())
+	c.rm.Unread(rest)
+	return c
+}
+
+// readUntil relays output until it contains want or the connection ends,
+// and reports whether want was seen.
+func (c *testClient) readUntil(want string, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		data, err := c.rm.Read()
+		c.mu.Lock()
+		c.out.Write(data)
+		seen := bytes.Contains(c.out.Bytes(), []byte(want))
+		c.mu.Unlock()
+		if seen {
+			return true
+		}
+		if err != nil {
+			return false
+		}
+	}
+	return false
+}
+
+// drain relays output until the daemon closes the connection.
+func (c *testClient) drain(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		data, err := c.rm.Read()
+		c.mu.Lock()
+		c.out.Write(data)
+		c.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// controlMessage returns the first control message of type msgType
+// received so far.
+func (c *testClient) controlMessage(msgType string) *protocol.Message {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, m := range c.control {
+		if m.Type == msgType {
+			return m
+		}
+	}
+	return nil
+}
+
+func TestDaemonRelaysInputAndShutsDownOnCancel(t *testing.T) {
+	s := startDaemon(t, exec.Command("cat"))
+	c := attach(t, s)
+
+	if err := c.rm.Write([]byte("hello daemon\n")); err != nil {
+		t.Fatal(err)
+	}
+	if !c.readUntil("hello daemon", 5*time.Second) {
+		t.Fatalf("input never came back; output %q", c.out.String())
+	}
+
+	s.cancel()
+	s.wait(t)
+	if s.err == nil {
+		t.Error("Run returned no error after its context was cancelled")
+	}
+	c.drain(2 * time.Second)
+	m := c.controlMessage(protocol.MsgDetach)
+	if m == nil {
+		t.Fatal("client was not told the daemon is shutting down")
+	}
+	if _, err := net.Dial("unix", s.socket); err == nil {
+		t.Error("socket still accepts connections after shutdown")
+	}
+}
+
+// Clients are told the reason the session was shut down with.
+func TestDaemonShutdownReason(t *testing.T) {
+	s := startDaemon(t, exec.Command("cat"))
+	c := attach(t, s)
+
+	s.cancelCause(errors.New("the session is shutting down on SIGTERM"))
+	s.wait(t)
+	c.drain(2 * time.Second)
+	m := c.controlMessage(protocol.MsgDetach)
+	if m == nil {
+		t.Fatal("client was not told the daemon is shutting down")
+	}
+	var p protocol.DetachPayload
+	if err := m.Decode(&p); err != nil || p.Reason != "the session is shutting down on SIGTERM" {
+		t.Errorf("DETACH = %+v, %v", p, err)
+	}
+}
+
+func TestDaemonReportsExitWithLastOutput(t *testing.T) {
+	s := startDaemon(t, exec.Command("sh", "-c", "read x; echo got-$x; exit 7"))
+	c := attach(t, s)
+
+	if err := c.rm.Write([]byte("it\n")); err != nil {
+		t.Fatal(err)
+	}
+	s.wait(t)
+	if s.status != 7 || s.err != nil {
+		t.Errorf("Run = %d, %v; want 7, nil", s.status, s.err)
+	}
+	if !c.readUntil("got-it", 2*time.Second) {
+		t.Errorf("last output lost; got %q", c.out.String())
+	}
+	c.drain(time.Second)
+	m := c.controlMessage(protocol.MsgExit)
+	if m == nil {
+		t.Fatal("no EXIT message")
+	}
+	var exit protocol.ExitPayload
+	if err := m.Decode(&exit); err != nil || exit.Status != 7 {
+		t.Errorf("EXIT = %+v, %v; want status 7", exit, err)
+	}
+}
+
+// shortConn accepts only the first half of each write.
+type shortConn struct {
+	net.Conn
+}
+
+func (c shortConn) Write(p []byte) (int, error) {
+	return len(p) / 2, errors.New("short write")
+}
+
+func (c shortConn) SetWriteDeadline(time.Time) error { return nil }
+
+func TestShortControlFrameDropsClient(t *testing.T) {
+	d := New(Config{SessionNum: "001"})
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	conn := shortConn{c1}
+	cl := &client{conn: conn, framed: true, info: protocol.ClientInfo{Mode: protocol.ModeAttach}}
+	d.clients[conn] = cl
+
+	if d.handleControl(cl, protocol.MsgPing) {
+		t.Error("handleControl kept reading from a client it sent half a PONG")
+	}
+	if _, ok := d.clients[conn]; ok {
+		t.Error("client that got half a frame is still attached")
+	}
+}
+
+// discardConn is a client connection that accepts every write.
+type discardConn struct {
+	net.Conn
+}
+
+func (discardConn) Write(p []byte) (int, error)      { return len(p), nil }
+func (discardConn) SetWriteDeadline(time.Time) error { return nil }
+
+func BenchmarkBroadcastToClients(b *testing.B) {
+	for _, clients := range []int{1, 4} {
+		b.Run(fmt.Sprintf("%dclients", clients), func(b *testing.B) {
+			d := New(Config{SessionNum: "001"})
+			for i := 0; i < clients; i++ {
+				conn := &discardConn{}
+				d.clients[conn] = &client{conn: conn, framed: i%2 == 0}
+			}
+			d.refreshClientList()
+			// Built the way handlePTY builds each chunk.
+			frame := make([]byte, protocol.FrameHeaderSize+4096)
+			protocol.WriteFrameHeader(frame, protocol.FrameData, 4096)
+			b.SetBytes(int64(len(frame)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				d.broadcastToClients(frame)
+			}
+		})
+	}
+}
+
+// connect sends hello and returns the daemon's first reply.
+func connect(t *testing.T, s *testSession, hello protocol.ConnectPayload) *protocol.Message {
+	t.Helper()
+	conn, err := net.Dial("unix", s.socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	data, err := protocol.EncodeMessage(protocol.MsgConnect, hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	msg, err := protocol.ReadMessageFrom(bufio.NewReader(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+// A lock in the metadata must stop attaches made straight to the socket,
+// read-only ones too, unless the owner forces it.
+func TestDaemonRefusesLockedSession(t *testing.T) {
+	meta := filepath.Join(t.TempDir(), "session-001.meta")
+	s := startDaemonConfig(t, Config{Command: exec.Command("cat"), MetaPath: meta})
+	// The daemon writes the metadata before it takes connections.
+	if msg := connect(t, s, protocol.ConnectPayload{Mode: protocol.ModePeek}); msg.Type != protocol.MsgReady {
+		t.Fatalf("unlocked: got %s %s", msg.Type, msg.Payload)
+	}
+	if err := session.UpdateMetadata(meta, func(m *session.Session) error {
+		m.Locked = true
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, mode := range []string{protocol.ModeAttach, protocol.ModePeek} {
+		msg := connect(t, s, protocol.ConnectPayload{Mode: mode})
+		var e protocol.ErrorPayload
+		if msg.Type != protocol.MsgError || msg.Decode(&e) != nil || e.Code != protocol.ErrCodeLocked {
+			t.Fatalf("%s while locked: got %s %s", mode, msg.Type, msg.Payload)
+		}
+		if want := "session 001 is locked (sess unlock 1 to release)"; e.Message != want {
+			t.Errorf("refusal %q; want %q", e.Message, want)
+		}
+	}
+	if msg := connect(t, s, protocol.ConnectPayload{Mode: protocol.ModeAttach, Force: true}); msg.Type != protocol.MsgReady {
+		t.Errorf("forced by the owner: got %s %s", msg.Type, msg.Payload)
+	}
+}
+
+// The heartbeat file is written when the daemon starts, touched when a
+// client connects and removed when the daemon shuts down.
+func TestDaemonHeartbeat(t *testing.T) {
+	meta := filepath.Join(t.TempDir(), "session-001.meta")
+	s := startDaemonConfig(t, Config{Command: exec.Command("cat"), MetaPath: meta})
+	path := session.HeartbeatPath(meta)
+	var hb session.Heartbeat
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		data, err := os.ReadFile(path)
+		if err == nil && json.Unmarshal(data, &hb) == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no heartbeat written: %v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if hb.DaemonPID != os.Getpid() {
+		t.Errorf("heartbeat = %+v; want this process's pid", hb)
+	}
+
+	longAgo := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(path, longAgo, longAgo); err != nil {
+		t.Fatal(err)
+	}
+	if msg := connect(t, s, protocol.ConnectPayload{Mode: protocol.ModePeek}); msg.Type != protocol.MsgReady {
+		t.Fatalf("connect: got %s %s", msg.Type, msg.Payload)
+	}
+	if info, err := os.Stat(path); err != nil || info.ModTime().Before(time.Now().Add(-time.Minute)) {
+		t.Errorf("heartbeat not touched by a connection: %v", err)
+	}
+
+	s.cancel()
+	s.wait(t)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("heartbeat left behind: %v", err)
+	}
+}
+
+// A one-shot DETACH request tells every client why it is being
+// disconnected, and answers once they are gone.
+func TestDaemonDetachAll(t *testing.T) {
+	s := startDaemon(t, exec.Command("cat"))
+	c := attach(t, s)
+
+	conn, err := net.Dial("unix", s.socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	req, err := protocol.EncodeMessage(protocol.MsgDetach, protocol.DetachPayload{Reason: "the session is being killed"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if msg, err := protocol.ReadMessageFrom(bufio.NewReader(conn)); err != nil || msg.Type != protocol.MsgReady {
+		t.Fatalf("DETACH answered %v, %v; want READY", msg, err)
+	}
+
+	c.drain(2 * time.Second)
+	m := c.controlMessage(protocol.MsgDetach)
+	if m == nil {
+		t.Fatal("client was not told it was detached")
+	}
+	var p protocol.DetachPayload
+	if err := m.Decode(&p); err != nil || p.Reason != "the session is being killed" {
+		t.Errorf("DETACH = %+v, %v", p, err)
+	}
+	if st := s.d.status(); len(st.Clients) != 0 {
+		t.Errorf("%d clients still connected", len(st.Clients))
+	}
+}
+
+// STATUS reports a job started from the shell while it holds the
+// terminal, and nothing while the shell is back at its prompt.
+func TestStatusReportsForegroundJob(t *testing.T) {
+	s := startDaemon(t, exec.Command("sh"))
+	c := attach(t, s)
+
+	if fg := s.d.status().Foreground; fg != nil {
+		t.Errorf("idle shell reports foreground job %+v", fg)
+	}
+	if err := c.rm.Write([]byte("sleep 30\n")); err != nil {
+		t.Fatal(err)
+	}
+	var fg *protocol.ForegroundJob
+	for deadline := time.Now().Add(5 * time.Second); fg == nil && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		fg = s.d.status().Foreground
+	}
+	if fg == nil {
+		t.Fatal("no foreground job reported while sleep runs")
+	}
+	if _, err := platform.ProcessCommand(os.Getpid()); err == nil && fg.Command != "sleep 30" {
+		t.Errorf("foreground command = %q; want \"sleep 30\"", fg.Command)
+	}
+}
+
+// An interactive bash ignores SIGTERM; the hangup it gets first when the
+// session is shut down lets it save its history on the way out.
+func TestShutdownHangsUpShell(t *testing.T) {
+	bash, err := exec.LookPath("bash")
+	if err != nil {
+		t.Skip("no bash")
+	}
+	histfile := filepath.Join(t.TempDir(), "history")
+	cmd := exec.Command(bash, "--norc", "--noprofile", "-i")
+	cmd.Env = append(os.Environ(), "HISTFILE="+histfile, "PS1=$ ")
+	s := startDaemon(t, cmd)
+	c := attach(t, s)
+
+	if err := c.rm.Write([]byte("echo hung-up\n")); err != nil {
+		t.Fatal(err)
+	}
+	// Not the echo of the line typed, which ends the same way.
+	if !c.readUntil("\rhung-up\r\n", 5*time.Second) {
+		t.Fatalf("bash never ran the command; output %q", c.out.String())
+	}
+	start := time.Now()
+	s.cancel()
+	s.wait(t)
+	if elapsed := time.Since(start); elapsed > 1900*time.Millisecond {
+		t.Errorf("shutdown took %v; bash should have gone on the hangup", elapsed)
+	}
+	data, err := os.ReadFile(histfile)
+	if err != nil || !strings.Contains(string(data), "echo hung-up") {
+		t.Errorf("history = %q, %v; want it to hold the command", data, err)
+	}
+}
+
+// Ctrl-S, Ctrl-Q and the flush Ctrl-C brings reach framed clients as FLOW
+// frames, and the output around them has no status bytes.
+func TestDaemonReportsFlowControl(t *testing.T) {
+	s := startDaemon(t, exec.Command("sh", "-c", `trap "" INT; exec cat`))
+	c := attach(t, s)
+
+	stopped := func(want bool) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); s.d.status().Stopped != want; {
+			if time.Now().After(deadline) {
+				t.Fatalf("status never reported stopped %v", want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	c.rm.Write([]byte{0x13})
+	stopped(true)
+	c.rm.Write([]byte{0x11})
+	stopped(false)
+	c.rm.Write([]byte{0x03})
+	if err := c.rm.Write([]byte("done\n")); err != nil {
+		t.Fatal(err)
+	}
+	if !c.readUntil("done\r\ndone\r\n", 5*time.Second) {
+		t.Fatalf("output = %q", c.out.String())
+	}
+	if bytes.ContainsRune(c.out.Bytes(), 0) {
+		t.Errorf("output has status bytes: %q", c.out.String())
+	}
+
+	var flows []protocol.FlowPayload
+	c.mu.Lock()
+	for _, m := range c.control {
+		var f protocol.FlowPayload
+		if m.Type == protocol.MsgFlow && m.Decode(&f) == nil {
+			flows = append(flows, f)
+		}
+	}
+	c.mu.Unlock()
+	want := []protocol.FlowPayload{{Stopped: true}, {}, {Flushed: true}}
+	if fmt.Sprint(flows) != fmt.Sprint(want) {
+		t.Errorf("FLOW frames = %+v; want %+v", flows, want)
+	}
+}
+
+// The size in pixels reaches the terminal with the size in cells, and a
+// client that sends only cells leaves it unknown.
+func TestResizeAppliesPixels(t *testing.T) {
+	s := startDaemonConfig(t, Config{Command: exec.Command("cat"), XPixel: 640, YPixel: 384})
+	c := attach(t, s)
+
+	winsize := func() *unix.Winsize {
+		var ws *unix.Winsize
+		err := s.d.masterControl(func(fd int) (err error) {
+			ws, err = unix.IoctlGetWinsize(fd, unix.TIOCGWINSZ)
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ws
+	}
+	if ws := winsize(); ws.Row != 24 || ws.Col != 80 || ws.Xpixel != 640 || ws.Ypixel != 384 {
+		t.Errorf("initial size = %+v; want 24x80, 640x384 pixels", ws)
+	}
+	for _, tc := range []struct {
+		line []byte
+		want unix.Winsize
+	}{
+		{protocol.ResizePixelsLine(40, 120, 1200, 800), unix.Winsize{Row: 40, Col: 120, Xpixel: 1200, Ypixel: 800}},
+		{protocol.ResizeLine(30, 100), unix.Winsize{Row: 30, Col: 100}},
+		// No rows is ignored, and more than a terminal may have clamped.
+		{protocol.ResizeLine(0, 90), unix.Winsize{Row: 30, Col: 100}},
+		{protocol.ResizeLine(65535, 200), unix.Winsize{Row: protocol.MaxTerminalSize, Col: 200}},
+	} {
+		if err := c.rm.Write(tc.line); err != nil {
+			t.Fatal(err)
+		}
+		var ws *unix.Winsize
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if ws = winsize(); *ws == tc.want {
+				break
+			}
+		}
+		if *ws != tc.want {
+			t.Errorf("after %q size = %+v; want %+v", tc.line, ws, tc.want)
+		}
+	}
+}
+
+// Requests that are malformed, oversized or unknown cost only their own
+// connection: the daemon answers or drops them and an attached client
+// carries on.
+func TestDaemonDropsMalformedRequests(t *testing.T) {
+	s := startDaemon(t, exec.Command("cat"))
+	c := attach(t, s)
+
+	for _, req := range []string{
+		"not json\n",
+		strings.Repeat("x", 64<<10) + "\n",
+		`{"type":"CONNECT","payload":"attach"}` + "\n",
+		`{"type":"WHATEVER"}` + "\n",
+	} {
+		conn, err := net.Dial("unix", s.socket)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write([]byte(req))
+		if req[0] != '{' {
+			// Nothing is answered; the connection is just closed, or
+			// reset when what was sent is left unread.
+			if _, err := io.Copy(io.Discard, conn); errors.Is(err, os.ErrDeadlineExceeded) {
+				t.Errorf("%.20q: the connection was kept open", req)
+			}
+		} else if msg, err := protocol.ReadMessageFrom(bufio.NewReader(conn)); err != nil {
+			t.Errorf("%.20q: %v", req, err)
+		} else if msg.Type != protocol.MsgError {
+			t.Errorf("%.20q answered %s", req, msg.Type)
+		}
+		conn.Close()
+	}
+
+	if err := c.rm.Write([]byte("still here\n")); err != nil {
+		t.Fatal(err)
+	}
+	if !c.readUntil("still here", 5*time.Second) {
+		t.Errorf("the attached client stopped working; got %q", c.out.String())
+	}
+}
+
+// panicLog is a daemon log that panics when a dump is written to it,
+// injecting a panic into whichever goroutine writes one.
+type panicLog struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (l *panicLog) Write(p []byte) (int, error) {
+	if bytes.HasPrefix(p, []byte(DumpHeader)) {
+		panic("injected")
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.buf.Write(p)
+}
+
+func (l *panicLog) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.buf.String()
+}
+
+// A panic serving one connection drops only that connection. One anywhere
+// else shuts the session down as usual: clients are told, the socket and
+// metadata are removed and the tombstone says where it panicked.
+func TestDaemonRecoversPanics(t *testing.T) {
+	meta := filepath.Join(t.TempDir(), "session-001.meta")
+	log := &panicLog{}
+	s := startDaemonConfig(t, Config{Command: exec.Command("cat"), MetaPath: meta, Log: log})
+	c := attach(t, s)
+
+	conn, err := net.Dial("unix", s.socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	req, err := protocol.EncodeMessage(protocol.MsgDump, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if msg, err := protocol.ReadMessageFrom(bufio.NewReader(conn)); err == nil {
+		t.Fatalf("DUMP answered %s despite the panic", msg.Type)
+	} else if errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("the connection that panicked was kept open")
+	}
+	if !strings.Contains(log.String(), "Panic in handleNewConnection: injected") {
+		t.Errorf("panic not logged; log:\n%s", log)
+	}
+	if err := c.rm.Write([]byte("still here\n")); err != nil {
+		t.Fatal(err)
+	}
+	if !c.readUntil("still here", 5*time.Second) {
+		t.Fatalf("the attached client was dropped too; got %q", c.out.String())
+	}
+
+	// SIGUSR2 has dumpOnSignal write a dump.
+	if err := unix.Kill(os.Getpid(), unix.SIGUSR2); err != nil {
+		t.Fatal(err)
+	}
+	s.wait(t)
+	c.drain(2 * time.Second)
+	if c.controlMessage(protocol.MsgDetach) == nil {
+		t.Error("client was not told the session ended")
+	}
+	for _, path := range []string{s.socket, meta} {
+		if _, err := os.Lstat(path); !os.IsNotExist(err) {
+			t.Errorf("%s left behind: %v", path, err)
+		}
+	}
+	var tomb session.Tombstone
+	data, err := os.ReadFile(session.TombstonePath(meta))
+	if err != nil || json.Unmarshal(data, &tomb) != nil || tomb.Exit.Reason != "daemon panicked in dumpOnSignal" {
+		t.Errorf("tombstone %s: %+v, %v", data, tomb.Exit, err)
+	}
+}
@@ -0,0 +1,142 @@
+package daemon
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/theMichaelB/sess/pkg/protocol"
+)
+
+// lendTimeout bounds how long lending the terminal waits for handlePTY to
+// stop reading it.
+const lendTimeout = 1 * time.Second
+
+// directPTY is the session's terminal lent to a direct client, which reads
+// the output from the PTY master itself and types into it, dtach-style,
+// while handlePTY stops reading. It is lent only while nothing else needs
+// the output: no logs or script are kept, nothing spills or is kept from
+// the scrollback, no other client is connected and the session is not
+// shared. Output the client reads never reaches the daemon, so the
+// scrollback and the last-output time miss it.
+type directPTY struct {
+	// yielded is closed by handlePTY once it has stopped reading.
+	yielded chan struct{}
+	// done is closed when the client leaves, for handlePTY to read again.
+	done chan struct{}
+}
+
+// lendPTY lends the terminal to c, which asked for it, if nothing else
+// needs its output, and reports whether it did. handlePTY is stopped by a
+// read deadline in the past and waits in handBack until c leaves. The
+// caller holds clientMutex and has not added c to clients yet. With no
+// clients handlePTY only needs the lock to drop one that just failed, so
+// if it does not stop soon the loan is called off and c is relayed to.
+func (d *Daemon) lendPTY(c *client) bool {
+	if reason := d.directRefusal(c); reason != "" {
+		d.debugf("relaying to %s rather than lending the terminal: %s", c.describe(), reason)
+		return false
+	}
+	p := &directPTY{yielded: make(chan struct{}), done: make(chan struct{})}
+	d.direct.Store(p)
+	d.ptyMaster.SetReadDeadline(time.Unix(1, 0))
+	d.wakePTY()
+	select {
+	case <-p.yielded:
+		c.direct = p
+		c.info.Direct = true
+		return true
+	case <-d.ptyDone:
+		// The terminal has closed; the session is ending anyway.
+		d.direct.Store(nil)
+		return false
+	case <-time.After(lendTimeout):
+		close(p.done)
+		return false
+	}
+}
+
+// directRefusal says why the terminal cannot be lent to c, or returns "".
+// The caller holds clientMutex.
+func (d *Daemon) directRefusal(c *client) string {
+	switch {
+	case c.info.Mode != protocol.ModeAttach || !c.framed || !c.owner:
+		return "only the owner's framed attach can have it"
+	case d.direct.Load() != nil:
+		return "the terminal is still with the last client"
+	case len(d.clients) > 0:
+		return "other clients are connected"
+	case d.outputLog != nil || d.inputLog != nil || d.script != nil:
+		return "the session is logged"
+	case d.cfg.ScrollbackSpill || d.cfg.ScrollbackKeep:
+		return "the session's scrollback is kept"
+	}
+	if _, ok := c.conn.(*net.UnixConn); !ok {
+		return "the connection cannot carry it"
+	}
+	d.shareMu.Lock()
+	shared := len(d.shared) > 0
+	d.shareMu.Unlock()
+	if shared {
+		return "the session is shared"
+	}
+	return ""
+}
+
+// sendDirect sends a direct client READY with the PTY master attached.
+func (d *Daemon) sendDirect(conn net.Conn, ready protocol.ReadyPayload) error {
+	data, err := protocol.EncodeMessage(protocol.MsgReady, ready)
+	if err != nil {
+		return err
+	}
+	conn.SetWriteDeadline(time.Now().Add(1 * time.Second))
+	return d.masterControl(func(fd int) error {
+		_, _, err := conn.(*net.UnixConn).WriteMsgUnix(data, syscall.UnixRights(fd), nil)
+		return err
+	})
+}
+
+// handBack is called by handlePTY when its read failed with err. If the
+// failure is the deadline that lends the terminal to a direct client, it
+// waits for the client to leave and reports whether to read again: not if
+// the session is ending meanwhile, when the client has had the last of the
+// command's output.
+func (d *Daemon) handBack(err error) bool {
+	p := d.direct.Load()
+	if p == nil || !errors.Is(err, os.ErrDeadlineExceeded) {
+		return false
+	}
+	// The client reads the terminal as it is, without status bytes.
+	d.setPacketMode(false)
+	close(p.yielded)
+	select {
+	case <-p.done:
+	case <-d.ctx.Done():
+		return false
+	}
+	d.setPacketMode(true)
+	// Cleared before checking the context, so a deadline drainPTY sets
+	// once it is done is not lost.
+	d.ptyMaster.SetReadDeadline(time.Time{})
+	if d.ctx.Err() != nil {
+		return false
+	}
+	d.direct.Store(nil)
+	return true
+}
+
+// holdTerminal keeps the terminal from being lent while the session is
+// upgraded, failing if it is lent now: the new binary could not take back
+// a terminal a client is using.
+func (d *Daemon) holdTerminal() error {
+	d.clientMutex.Lock()
+	defer d.clientMutex.Unlock()
+	if d.direct.Load() != nil {
+		return errors.New("a client is using the session's terminal directly; detach it first")
+	}
+	// addClient checks upgrading under clientMutex before lending.
+	d.upgrading.Store(true)
+	return nil
+}
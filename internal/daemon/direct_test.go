@@ -0,0 +1,198 @@
+package daemon
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/theMichaelB/sess/pkg/protocol"
+)
+
+// attachDirect connects to s as a framed interactive client asking for
+// the session's terminal, and returns the terminal if the daemon lent it.
+func attachDirect(t testing.TB, s *testSession) (*testClient, *os.File) {
+	t.Helper()
+	conn, err := net.Dial("unix", s.socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	hello, err := protocol.EncodeMessage(protocol.MsgConnect, protocol.ConnectPayload{Mode: protocol.ModeAttach, Framed: true, Direct: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(hello); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 4096)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	n, oobn, _, _, err := conn.(*net.UnixConn).ReadMsgUnix(buf, oob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	line, rest, ok := bytes.Cut(buf[:n], []byte("\n"))
+	if !ok {
+		t.Fatalf("handshake: got %q", buf[:n])
+	}
+	msg, err := protocol.ParseMessage(append(line, '\n'))
+	var ready protocol.ReadyPayload
+	if err != nil || msg.Type != protocol.MsgReady || msg.Decode(&ready) != nil {
+		t.Fatalf("handshake: got %q", buf[:n])
+	}
+	var pty *os.File
+	if oobn > 0 {
+		msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+		if err != nil || len(msgs) != 1 {
+			t.Fatalf("control message %v, %v", msgs, err)
+		}
+		fds, err := syscall.ParseUnixRights(&msgs[0])
+		if err != nil || len(fds) != 1 {
+			t.Fatalf("rights %v, %v", fds, err)
+		}
+		pty = os.NewFile(uintptr(fds[0]), "pty")
+		t.Cleanup(func() { pty.Close() })
+	}
+	if ready.Direct != (pty != nil) {
+		t.Fatalf("READY says direct %v; terminal sent: %v", ready.Direct, pty != nil)
+	}
+	c := &testClient{conn: conn}
+	c.rm = protocol.NewFramedRawMode(conn, func(m *protocol.Message) {
+		c.mu.Lock()
+		c.control = append(c.control, m)
+		c.mu.Unlock()
+	})
+	c.rm.Unread(rest)
+	return c, pty
+}
+
+// readPTYUntil reads f until what was read contains want, and reports
+// whether it did before timeout.
+func readPTYUntil(f *os.File, want string, timeout time.Duration) (string, bool) {
+	f.SetReadDeadline(time.Now().Add(timeout))
+	defer f.SetReadDeadline(time.Time{})
+	var out bytes.Buffer
+	buf := make([]byte, 4096)
+	for !strings.Contains(out.String(), want) {
+		n, err := f.Read(buf)
+		out.Write(buf[:n])
+		if err != nil {
+			return out.String(), false
+		}
+	}
+	return out.String(), true
+}
+
+// A direct client has the terminal to itself: nobody can peek meanwhile,
+// and once it leaves the daemon relays again.
+func TestDirectAttachLendsTerminal(t *testing.T) {
+	s := startDaemon(t, exec.Command("cat"))
+	c, pty := attachDirect(t, s)
+	if pty == nil {
+		t.Fatal("terminal not lent to the only client of a session keeping nothing")
+	}
+	if _, err := pty.Write([]byte("typed directly\n")); err != nil {
+		t.Fatal(err)
+	}
+	if out, ok := readPTYUntil(pty, "typed directly\r\ntyped directly", 5*time.Second); !ok {
+		t.Fatalf("output of direct input = %q", out)
+	}
+
+	st := s.d.status()
+	if len(st.Clients) != 1 || !st.Clients[0].Direct {
+		t.Errorf("status clients = %+v; want the direct one", st.Clients)
+	}
+	peek, err := net.Dial("unix", s.socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peek.Close()
+	hello, _ := protocol.EncodeMessage(protocol.MsgConnect, protocol.ConnectPayload{Mode: protocol.ModePeek, Framed: true})
+	peek.Write(hello)
+	peek.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if msg, err := protocol.ReadMessageFrom(bufio.NewReader(peek)); err != nil || msg.Type != protocol.MsgError {
+		t.Errorf("peek while the terminal is lent got %v, %v; want an error", msg, err)
+	}
+	if msg := requestUpgrade(t, s, "/bin/true"); msg.Type != protocol.MsgError {
+		t.Errorf("upgrade while the terminal is lent got %s", msg.Type)
+	}
+
+	c.rm.Write([]byte("DISCONNECT\n"))
+	c.drain(2 * time.Second)
+	r := attach(t, s)
+	if err := r.rm.Write([]byte("relayed again\n")); err != nil {
+		t.Fatal(err)
+	}
+	if !r.readUntil("relayed again\r\nrelayed again", 5*time.Second) {
+		t.Fatalf("output after the direct client left = %q", r.out.String())
+	}
+}
+
+// While the session is logged the daemon keeps the terminal and relays.
+func TestDirectAttachFallsBackToRelay(t *testing.T) {
+	s := startDaemonConfig(t, Config{
+		Command:   exec.Command("cat"),
+		OutputLog: filepath.Join(t.TempDir(), "session.log"),
+	})
+	c, pty := attachDirect(t, s)
+	if pty != nil {
+		t.Fatal("terminal lent although the session is logged")
+	}
+	if err := c.rm.Write([]byte("relayed\n")); err != nil {
+		t.Fatal(err)
+	}
+	if !c.readUntil("relayed\r\nrelayed", 5*time.Second) {
+		t.Fatalf("output = %q", c.out.String())
+	}
+}
+
+// BenchmarkEcho measures the round trip of a keystroke a program in the
+// session echoes, relayed through the daemon and through the terminal lent
+// to a direct client.
+func BenchmarkEcho(b *testing.B) {
+	echo := func() *exec.Cmd { return exec.Command("sh", "-c", "stty raw -echo && exec cat") }
+	b.Run("relay", func(b *testing.B) {
+		s := startDaemon(b, echo())
+		c := attach(b, s)
+		c.conn.SetReadDeadline(time.Time{})
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if err := c.rm.Write([]byte("x")); err != nil {
+				b.Fatal(err)
+			}
+			for {
+				data, err := c.rm.Read()
+				if err != nil {
+					b.Fatal(err)
+				}
+				if len(data) > 0 {
+					break
+				}
+			}
+		}
+	})
+	b.Run("direct", func(b *testing.B) {
+		s := startDaemon(b, echo())
+		_, pty := attachDirect(b, s)
+		if pty == nil {
+			b.Fatal("terminal not lent")
+		}
+		buf := make([]byte, 4096)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := pty.Write([]byte("x")); err != nil {
+				b.Fatal(err)
+			}
+			if _, err := pty.Read(buf); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,238 @@
+package daemon
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// DumpHeader starts and DumpEnd ends each dump of a daemon's state in its
+// log, so the latest can be found there.
+const (
+	DumpHeader = "=== sess daemon state"
+	DumpEnd    = "=== end of state ==="
+)
+
+// dumpControls is how many of the latest control messages a dump lists.
+const dumpControls = 16
+
+// controlEntry is a control message or request the daemon acted on.
+type controlEntry struct {
+	at   time.Time
+	from string
+	line string
+}
+
+// controlHistory keeps the latest control messages for dumps. It has a
+// lock of its own, so recording one never waits on a wedged client.
+type controlHistory struct {
+	mu      sync.Mutex
+	entries [dumpControls]controlEntry
+	next    int // where the next entry goes
+	n       int // entries held
+}
+
+func (h *controlHistory) add(from, line string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.entries[h.next] = controlEntry{at: time.Now(), from: from, line: line}
+	h.next = (h.next + 1) % dumpControls
+	h.n = min(h.n+1, dumpControls)
+}
+
+// list returns the entries held, oldest first.
+func (h *controlHistory) list() []controlEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	list := make([]controlEntry, 0, h.n)
+	for i := h.n; i > 0; i-- {
+		list = append(list, h.entries[(h.next-i+dumpControls)%dumpControls])
+	}
+	return list
+}
+
+// dumpOnSignal writes a dump to the log whenever the daemon gets SIGUSR2,
+// until it shuts down.
+func (d *Daemon) dumpOnSignal() {
+	defer d.wg.Done()
+	defer d.recoverPanic("dumpOnSignal")
+	for {
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-d.dumps:
+			d.writeDump()
+		}
+	}
+}
+
+// writeDump writes a dump of the daemon's state to its log in one piece.
+func (d *Daemon) writeDump() {
+	var buf bytes.Buffer
+	d.dump(&buf, time.Now())
+	d.log.Write(buf.Bytes())
+}
+
+// dump describes the daemon's state for debugging one that has stopped
+// responding: its command, terminal, scrollback and clients, the latest
+// control messages and the stacks of all its goroutines. It is written
+// while the daemon may be stuck holding its locks, so it takes none it
+// could wait on; what such a lock guards is left out, and the lock is
+// reported held.
+func (d *Daemon) dump(w io.Writer, now time.Time) {
+	fmt.Fprintf(w, "%s of session %s at %s ===\n", DumpHeader, d.sessionNum, now.Format(time.RFC3339))
+	fmt.Fprintf(w, "daemon:     pid %d", os.Getpid())
+	if d.cfg.Version != "" {
+		fmt.Fprintf(w, ", sess %s", d.cfg.Version)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintf(w, "command:    %s\n", d.commandState())
+	fmt.Fprintf(w, "terminal:   %s\n", d.terminalState())
+	if d.scrollback == nil {
+		fmt.Fprintln(w, "scrollback: none")
+	} else {
+		fmt.Fprintf(w, "scrollback: %s\n", d.scrollback.usage())
+	}
+	fmt.Fprintf(w, "activity:   output %s, input %s, attach %s, %d bytes out\n",
+		ago(d.lastOutput.Load(), now), ago(d.lastInput.Load(), now), ago(d.lastAttach.Load(), now), d.bytesOut.Load())
+
+	// The client list is a snapshot taken without the lock; only the
+	// activity times need it.
+	var clients []*client
+	if list := d.clientList.Load(); list != nil {
+		clients = *list
+	}
+	locked := d.clientMutex.TryRLock()
+	if locked {
+		defer d.clientMutex.RUnlock()
+	}
+	fmt.Fprintf(w, "clients:    %d", len(clients))
+	if !locked {
+		fmt.Fprint(w, " (client lock held)")
+	}
+	fmt.Fprintln(w)
+	for _, c := range clients {
+		fmt.Fprintf(w, "  %s", c.describe())
+		if c.info.TTY != "" {
+			fmt.Fprintf(w, " on %s", c.info.TTY)
+		}
+		if c.framed {
+			fmt.Fprint(w, ", framed")
+		}
+		if c.direct != nil {
+			fmt.Fprint(w, ", direct")
+		}
+		fmt.Fprintf(w, ", connected %s", c.connectedAt.Format(time.RFC3339))
+		if locked && !c.lastActivity.IsZero() {
+			fmt.Fprintf(w, ", last active %s", ago(c.lastActivity.UnixNano(), now))
+		}
+		fmt.Fprintf(w, ", %d bytes in, %d bytes out\n", c.bytesIn.Load(), c.bytesOut.Load())
+	}
+
+	controls := d.controls.list()
+	fmt.Fprintf(w, "control messages, oldest first: %d\n", len(controls))
+	for _, e := range controls {
+		fmt.Fprintf(w, "  %s %s: %s\n", e.at.Format("15:04:05.000"), e.from, e.line)
+	}
+
+	fmt.Fprintln(w, "goroutines:")
+	w.Write(stacks())
+	fmt.Fprintln(w, DumpEnd)
+}
+
+// commandState describes the session's command: its pid, and how it
+// ended if it has.
+func (d *Daemon) commandState() string {
+	if d.cmd == nil || d.cmd.Process == nil {
+		return "not started"
+	}
+	state := fmt.Sprintf("pid %d, ", d.cmd.Process.Pid)
+	select {
+	case <-d.exited:
+		if d.cmd.ProcessState != nil {
+			return state + d.cmd.ProcessState.String()
+		}
+		return state + "exited"
+	default:
+	}
+	state += "running"
+	if job := d.foregroundJob(); job != nil {
+		state += fmt.Sprintf(", foreground job %d %s", job.PGID, job.Command)
+	}
+	return state
+}
+
+// terminalState describes the PTY's master side and how handlePTY is
+// reading it.
+func (d *Daemon) terminalState() string {
+	var parts []string
+	err := d.masterControl(func(fd int) error {
+		parts = append(parts, fmt.Sprintf("fd %d", fd))
+		if flags, err := unix.FcntlInt(uintptr(fd), unix.F_GETFL, 0); err == nil && flags&unix.O_NONBLOCK != 0 {
+			parts = append(parts, "non-blocking")
+		}
+		if ws, err := unix.IoctlGetWinsize(fd, unix.TIOCGWINSZ); err == nil {
+			parts = append(parts, fmt.Sprintf("%dx%d", ws.Row, ws.Col))
+		}
+		return nil
+	})
+	if err != nil {
+		return err.Error()
+	}
+	if d.packet {
+		parts = append(parts, "packet mode")
+	}
+	if d.stopped.Load() {
+		parts = append(parts, "output stopped")
+	}
+	if d.parked.Load() {
+		parts = append(parts, "reading parked")
+	}
+	if d.direct.Load() != nil {
+		parts = append(parts, "lent to a direct client")
+	}
+	return strings.Join(parts, ", ")
+}
+
+// usage describes how much the scrollback holds, if its lock is free.
+func (s *scrollback) usage() string {
+	if !s.mu.TryLock() {
+		return "lock held"
+	}
+	defer s.mu.Unlock()
+	usage := fmt.Sprintf("%d of %d bytes held", s.size, len(s.buf))
+	if s.spill != nil {
+		usage += fmt.Sprintf(", %d spilled", s.spilled)
+	}
+	if s.spillErr != nil {
+		usage += fmt.Sprintf(" (spilling stopped: %v)", s.spillErr)
+	}
+	return usage
+}
+
+// ago renders a stored timestamp relative to now.
+func ago(ns int64, now time.Time) string {
+	if ns <= 0 {
+		return "never"
+	}
+	return now.Sub(time.Unix(0, ns)).Round(time.Millisecond).String() + " ago"
+}
+
+// stacks returns the stacks of all goroutines.
+func stacks() []byte {
+	buf := make([]byte, 64<<10)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			return buf[:n]
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
@@ -0,0 +1,114 @@
+package daemon
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/theMichaelB/sess/pkg/protocol"
+)
+
+// A DUMP request, like SIGUSR2, writes the daemon's state to its log:
+// the client attached, the control messages it sent and the goroutines.
+func TestDump(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "daemon.out")
+	log, err := os.Create(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	s := startDaemonConfig(t, Config{Command: exec.Command("cat"), Log: log, Scrollback: 1024})
+	c := attach(t, s)
+	if err := c.rm.Write(protocol.ResizeLine(30, 100)); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for s.d.status().Rows != 30 {
+		if time.Now().After(deadline) {
+			t.Fatal("the resize was not applied")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	conn, err := net.Dial("unix", s.socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	req, err := protocol.EncodeMessage(protocol.MsgDump, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if msg, err := protocol.ReadMessageFrom(bufio.NewReader(conn)); err != nil || msg.Type != protocol.MsgReady {
+		t.Fatalf("DUMP answered %v, %v; want READY", msg, err)
+	}
+	data, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dump := string(data)
+	for _, want := range []string{
+		DumpHeader + " of session 001",
+		"command:    pid ",
+		"30x100",
+		"scrollback: 0 of 1024 bytes held",
+		"clients:    1\n  attach (pid ",
+		": RESIZE 30 100\n",
+		": DUMP\n",
+		"goroutine ",
+		"(*Daemon).handlePTY",
+		DumpEnd + "\n",
+	} {
+		if !strings.Contains(dump, want) {
+			t.Errorf("the dump lacks %q:\n%s", want, dump)
+		}
+	}
+
+	if err := syscall.Kill(os.Getpid(), syscall.SIGUSR2); err != nil {
+		t.Fatal(err)
+	}
+	deadline = time.Now().Add(5 * time.Second)
+	for {
+		data, err := os.ReadFile(logPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Count(string(data), DumpEnd) == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no dump on SIGUSR2:\n%s", data[len(dump):])
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestControlHistory(t *testing.T) {
+	var h controlHistory
+	if got := h.list(); len(got) != 0 {
+		t.Errorf("an empty history lists %d entries", len(got))
+	}
+	for i := 0; i < dumpControls+3; i++ {
+		h.add("client", strings.Repeat("x", i))
+	}
+	got := h.list()
+	if len(got) != dumpControls {
+		t.Fatalf("the history holds %d entries; want %d", len(got), dumpControls)
+	}
+	// The oldest three were pushed out.
+	for i, e := range got {
+		if len(e.line) != i+3 {
+			t.Errorf("entry %d is %q; want %d x's", i, e.line, i+3)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package daemon
+
+import (
+	"os"
+	"time"
+
+	"github.com/theMichaelB/sess/internal/platform"
+	"github.com/theMichaelB/sess/pkg/protocol"
+)
+
+// startPacketMode puts master, the session's terminal, into packet mode,
+// so handlePTY learns when its output is flushed, stopped or started.
+// Where that fails the output is read as it is, without those events.
+func (d *Daemon) startPacketMode(master *os.File) {
+	err := fileControl(master, func(fd int) error { return platform.SetPacketMode(fd, true) })
+	if err != nil {
+		d.debugf("not using packet mode: %v", err)
+		return
+	}
+	d.packet = true
+}
+
+// setPacketMode turns packet mode on or off while handlePTY is not
+// reading, if the daemon uses it: off while a direct client or a new
+// binary reads the terminal, which know nothing of status bytes, and on
+// again before handlePTY reads it.
+func (d *Daemon) setPacketMode(on bool) {
+	if !d.packet {
+		return
+	}
+	if err := d.masterControl(func(fd int) error { return platform.SetPacketMode(fd, on) }); err != nil {
+		d.debugf("packet mode %v: %v", on, err)
+	}
+}
+
+// flow acts on a packet-mode status byte, telling framed clients of a
+// flush and of output stopping or starting. Other events are of no
+// interest to clients.
+func (d *Daemon) flow(status byte) {
+	var p protocol.FlowPayload
+	switch {
+	case status&platform.PacketStop != 0:
+		d.stopped.Store(true)
+	case status&platform.PacketStart != 0:
+		d.stopped.Store(false)
+	case status&platform.PacketFlushWrite == 0:
+		return
+	}
+	p.Flushed = status&platform.PacketFlushWrite != 0
+	p.Stopped = d.stopped.Load()
+	d.debugf("terminal output: flushed %v, stopped %v", p.Flushed, p.Stopped)
+	d.broadcastControl(protocol.MsgFlow, p)
+}
+
+// broadcastControl sends a message to every framed client as a control
+// frame, from handlePTY so it stays in order with the output. Clients that
+// fail are dropped, as by broadcastToClients.
+func (d *Daemon) broadcastControl(msgType string, payload interface{}) {
+	list := d.clientList.Load()
+	if list == nil {
+		return
+	}
+	frame, err := protocol.EncodeControlFrame(msgType, payload)
+	if err != nil {
+		d.debugf("encode %s: %v", msgType, err)
+		return
+	}
+	deadline := time.Now().Add(1 * time.Second)
+	failed := d.failed[:0]
+	for _, c := range *list {
+		if !c.framed {
+			continue
+		}
+		c.conn.SetWriteDeadline(deadline)
+		if _, err := c.conn.Write(frame); err != nil {
+			failed = append(failed, c.conn)
+		}
+	}
+	for _, conn := range failed {
+		d.removeClient(conn)
+	}
+	d.failed = failed[:0]
+}
@@ -0,0 +1,43 @@
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+
+	"github.com/theMichaelB/sess/internal/session"
+)
+
+// heartbeat writes the session's heartbeat file (see session.Heartbeat),
+// which cleanup removes, and then keeps the rest of the session's state
+// with guardState until the daemon shuts down. Nothing here runs on a
+// timer: an idle daemon is not woken to touch the file, touchHeartbeat
+// does that when something connects.
+func (d *Daemon) heartbeat() {
+	defer d.wg.Done()
+	defer d.recoverPanic("heartbeat")
+	if d.metaPath == "" {
+		return
+	}
+	if err := session.WriteHeartbeat(session.HeartbeatPath(d.metaPath)); err != nil {
+		fmt.Fprintf(d.log, "daemon: failed to write heartbeat: %v\n", err)
+		return
+	}
+	d.guardState()
+}
+
+// touchHeartbeat marks the daemon as seen alive now, so a crash is dated
+// no earlier than the last time a client talked to it. A heartbeat file
+// that is gone stays gone: cleanup may have removed it.
+func (d *Daemon) touchHeartbeat() {
+	if d.metaPath == "" || d.stateLost.Load() {
+		return
+	}
+	now := time.Now()
+	err := os.Chtimes(session.HeartbeatPath(d.metaPath), now, now)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		d.debugf("heartbeat: %v", err)
+	}
+}
@@ -0,0 +1,115 @@
+package daemon
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/theMichaelB/sess/internal/platform"
+	"github.com/theMichaelB/sess/internal/session"
+	"golang.org/x/sys/unix"
+)
+
+// inputLog records what is typed into the session, for auditing. Each
+// input is one line: when, where it came from, and the bytes as a quoted
+// string, so control keys show and a line is never split. Clients and
+// one-shot requests write to it concurrently.
+type inputLog struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+// openInputLog creates the input log if the session keeps one. Like the
+// output log, one left behind by an earlier session is preserved first.
+// The file is readable by the owner only: it holds everything typed.
+func (d *Daemon) openInputLog() error {
+	path := d.cfg.InputLog
+	if path == "" {
+		return nil
+	}
+	if info, err := os.Stat(path); err == nil {
+		if _, err := session.PreserveLog(path, info.ModTime()); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(f, "# SENSITIVE: input typed into sess session %s from %s on, except at password prompts.\n",
+		d.sessionNum, time.Now().Format(time.RFC3339))
+	d.inputLog = &inputLog{f: f}
+	return nil
+}
+
+// recordInput logs data typed into the session by source. Input read while
+// the terminal is at a password prompt is left out; a line records that
+// something was typed. If writing fails the session carries on unrecorded.
+func (d *Daemon) recordInput(source string, data []byte) {
+	l := d.inputLog
+	if l == nil {
+		return
+	}
+	hidden := d.readingPassword()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return
+	}
+	now := time.Now().Format("2006-01-02T15:04:05.000Z07:00")
+	var err error
+	if hidden {
+		_, err = fmt.Fprintf(l.f, "%s %s [not logged: echo off]\n", now, source)
+	} else {
+		_, err = fmt.Fprintf(l.f, "%s %s %q\n", now, source, data)
+	}
+	if err != nil {
+		fmt.Fprintf(d.log, "daemon: input log: %v; no longer recording\n", err)
+		l.f.Close()
+		l.f = nil
+	}
+}
+
+// closeInputLog stops recording and preserves the log under a name with
+// the exit time, like the output log. It is kept regardless of the output
+// logs' retention. It returns the preserved path, or "".
+func (d *Daemon) closeInputLog() string {
+	l := d.inputLog
+	if l == nil {
+		return ""
+	}
+	l.mu.Lock()
+	if l.f != nil {
+		l.f.Close()
+		l.f = nil
+	}
+	l.mu.Unlock()
+	if d.stateLost.Load() {
+		return ""
+	}
+	path, err := session.PreserveLog(d.cfg.InputLog, time.Now())
+	if err != nil {
+		fmt.Fprintf(d.log, "daemon: failed to preserve input log: %v\n", err)
+		return ""
+	}
+	return path
+}
+
+// readingPassword reports whether the session's terminal reads lines
+// without echoing them, as programs do to prompt for a password. Line
+// editors such as readline and full-screen programs turn echo off as well,
+// but they also leave canonical mode, so what is typed into them is still
+// logged.
+func (d *Daemon) readingPassword() bool {
+	var t *unix.Termios
+	err := d.masterControl(func(fd int) (err error) {
+		t, err = unix.IoctlGetTermios(fd, platform.IoctlGetTermios)
+		return err
+	})
+	if err != nil {
+		return false
+	}
+	return t.Lflag&unix.ECHO == 0 && t.Lflag&unix.ICANON != 0
+}
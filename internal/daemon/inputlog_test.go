@@ -0,0 +1,78 @@
+package daemon
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/theMichaelB/sess/pkg/protocol"
+)
+
+// What an attached client types and what sess send and sess broadcast
+// send, each a one-shot INPUT, are all logged with their source; what is
+// typed at a password prompt is not.
+func TestInputLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "session-001.input.log")
+	s := startDaemonConfig(t, Config{
+		Command: exec.Command("sh", "-c", `for i in 1 2 3; do read line; echo "got $line"; done
+stty -echo; echo PROMPT; read secret; stty echo; echo "got secret"; sleep 5`),
+		InputLog: path,
+	})
+	c := attach(t, s)
+
+	typeKeys(t, c, "typed\n", "got typed")
+	for _, in := range []string{"sent", "everyone"} {
+		if msg := request(t, s, protocol.MsgInput, protocol.InputPayload{Data: []byte(in + "\n")}); msg.Type != protocol.MsgReady {
+			t.Fatalf("INPUT %q: got %s %s", in, msg.Type, msg.Payload)
+		}
+		if !c.readUntil("got "+in, 5*time.Second) {
+			t.Fatalf("%q never reached the command; output %q", in, c.out.String())
+		}
+	}
+	if !c.readUntil("PROMPT", 5*time.Second) {
+		t.Fatalf("no prompt; output %q", c.out.String())
+	}
+	typeKeys(t, c, "hunter2\n", "got secret")
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := string(data)
+	if info, err := os.Stat(path); err != nil {
+		t.Error(err)
+	} else if info.Mode().Perm() != 0600 {
+		t.Errorf("input log mode %v; want 0600", info.Mode().Perm())
+	}
+	if !strings.HasPrefix(log, "# SENSITIVE: input typed into sess session 001 from ") {
+		t.Errorf("input log has no warning first:\n%s", log)
+	}
+	for _, want := range []string{
+		fmt.Sprintf(` attach (pid %d) "typed\n"`, os.Getpid()),
+		fmt.Sprintf(` send (pid %d) "sent\n"`, os.Getpid()),
+		fmt.Sprintf(` send (pid %d) "everyone\n"`, os.Getpid()),
+		fmt.Sprintf(" attach (pid %d) [not logged: echo off]\n", os.Getpid()),
+	} {
+		if !strings.Contains(log, want) {
+			t.Errorf("input log lacks %q:\n%s", want, log)
+		}
+	}
+	if strings.Contains(log, "hunter2") {
+		t.Errorf("input log holds what was typed with echo off:\n%s", log)
+	}
+}
+
+// typeKeys has c type keys and waits for the command to answer with want.
+func typeKeys(t *testing.T, c *testClient, keys, want string) {
+	t.Helper()
+	if err := c.rm.Write([]byte(keys)); err != nil {
+		t.Fatal(err)
+	}
+	if !c.readUntil(want, 5*time.Second) {
+		t.Fatalf("%q never reached the command; output %q", keys, c.out.String())
+	}
+}
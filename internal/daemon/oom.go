@@ -0,0 +1,48 @@
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/theMichaelB/sess/internal/platform"
+)
+
+// protectFromOOM gives the daemon the OOM score adjustment cfg asks for.
+// It is called once the command has started, which keeps the score it
+// inherited, so that of the session's processes the OOM killer picks the
+// one using the memory. Unprivileged users may not lower the score on
+// many systems; the session runs unprotected then.
+func (d *Daemon) protectFromOOM() {
+	adj := d.cfg.OOMScoreAdj
+	if adj == 0 || !platform.OOMScoreAdjSupported {
+		return
+	}
+	inherited, err := platform.OOMScoreAdj()
+	if err != nil {
+		fmt.Fprintf(d.log, "daemon: failed to read oom_score_adj, so the daemon is not protected from the OOM killer: %v\n", err)
+		return
+	}
+	if err := platform.SetOOMScoreAdj(adj); err != nil {
+		if errors.Is(err, os.ErrPermission) && os.Geteuid() != 0 {
+			d.debugf("no OOM protection: oom_score_adj %d needs CAP_SYS_RESOURCE: %v", adj, err)
+			return
+		}
+		fmt.Fprintf(d.log, "daemon: failed to set oom_score_adj to %d, so the OOM killer may pick the daemon: %v\n", adj, err)
+		return
+	}
+	d.oomSet, d.oomInherited = true, inherited
+	d.debugf("oom_score_adj set to %d", adj)
+}
+
+// unprotected returns the shell command line that runs command with the
+// score the daemon inherited, as the session's command has, rather than
+// the one protectFromOOM gave the daemon: a trigger command eating the
+// memory must not leave the OOM killer the session to pick. The shell sets
+// it before running anything, so nothing command starts escapes it.
+func (d *Daemon) unprotected(command string) string {
+	if !d.oomSet {
+		return command
+	}
+	return fmt.Sprintf("echo %d >/proc/self/oom_score_adj 2>/dev/null\n%s", d.oomInherited, command)
+}
@@ -0,0 +1,84 @@
+package daemon
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/theMichaelB/sess/internal/platform"
+	"github.com/theMichaelB/sess/pkg/protocol"
+)
+
+// The daemon takes the adjustment; the command keeps the score it had.
+// Lowering the score needs privilege, so the test raises it, which changes
+// the test process's own score for good.
+func TestOOMScoreAdj(t *testing.T) {
+	if !platform.OOMScoreAdjSupported {
+		t.Skip("no oom_score_adj here")
+	}
+	before, err := platform.OOMScoreAdj()
+	if err != nil {
+		t.Skip(err)
+	}
+	adj := min(before+100, 1000)
+	out := filepath.Join(t.TempDir(), "out")
+	s := startDaemonConfig(t, Config{
+		Command:     exec.Command("sh", "-c", "sleep 0.2; cat /proc/self/oom_score_adj > "+out+"; sleep 5"),
+		OOMScoreAdj: adj,
+	})
+	var data []byte
+	deadline := time.Now().Add(5 * time.Second)
+	for len(data) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the command did not report its score")
+		}
+		time.Sleep(10 * time.Millisecond)
+		data, _ = os.ReadFile(out)
+	}
+	if got := s.d.status().OOMScoreAdj; got != adj {
+		t.Errorf("daemon's oom_score_adj = %d; want %d", got, adj)
+	}
+	if got, _ := strconv.Atoi(strings.TrimSpace(string(data))); got != before {
+		t.Errorf("command's oom_score_adj = %d; want the %d it started with", got, before)
+	}
+}
+
+// Commands the daemon runs once it has its adjustment, such as triggers',
+// are given back the score the session's command has.
+func TestOOMScoreAdjTrigger(t *testing.T) {
+	if !platform.OOMScoreAdjSupported {
+		t.Skip("no oom_score_adj here")
+	}
+	before, err := platform.OOMScoreAdj()
+	if err != nil {
+		t.Skip(err)
+	}
+	out := filepath.Join(t.TempDir(), "out")
+	s := startDaemonConfig(t, Config{
+		Command:     exec.Command("sh", "-c", "sleep 0.2; echo FIRE; sleep 5"),
+		OOMScoreAdj: min(before+100, 1000),
+	})
+	if err := s.d.setTriggers([]protocol.Trigger{{
+		ID:      1,
+		Pattern: "FIRE",
+		Command: "cat /proc/self/oom_score_adj > " + out,
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	var data []byte
+	deadline := time.Now().Add(5 * time.Second)
+	for len(data) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the trigger did not report its score")
+		}
+		time.Sleep(10 * time.Millisecond)
+		data, _ = os.ReadFile(out)
+	}
+	if got, _ := strconv.Atoi(strings.TrimSpace(string(data))); got != before {
+		t.Errorf("trigger's oom_score_adj = %d; want the %d the command has", got, before)
+	}
+}
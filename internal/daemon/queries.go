@@ -0,0 +1,191 @@
+package daemon
+
+import (
+	"bytes"
+
+	"github.com/theMichaelB/sess/pkg/protocol"
+)
+
+// Replies to the queries a program may send its terminal, given for it
+// while nobody's terminal can: those of a VT220 showing light text on a
+// black background with the cursor in its corner.
+const (
+	replyDA1    = "\x1b[?62;22c"
+	replyDA2    = "\x1b[>1;10;0c"
+	replyStatus = "\x1b[0n"
+	replyCursor = "\x1b[1;1R"
+	replyFg     = "rgb:ffff/ffff/ffff"
+	replyBg     = "rgb:0000/0000/0000"
+)
+
+// queryScanner finds terminal queries in a session's output: device
+// attributes (CSI c, CSI > c), device status and cursor position (CSI 5n,
+// CSI 6n) and the xterm colour queries (OSC 10 and 11 with "?"). Queries
+// split across chunks are found.
+type queryScanner struct {
+	state byte
+	// seq is the sequence so far after its introducer: the parameters
+	// of a CSI, the text of an OSC. Sequences too long for it are not
+	// queries and are skipped.
+	seq  [16]byte
+	n    int
+	skip bool
+}
+
+const (
+	queryIdle = iota
+	queryEscape
+	queryCSI
+	queryOSC
+	queryOSCEscape // ESC within an OSC, which ST ends
+)
+
+// scan reads a chunk of output and appends the replies to the queries it
+// completes to replies.
+func (q *queryScanner) scan(p []byte, replies []byte) []byte {
+	for i := 0; i < len(p); i++ {
+		if q.state == queryIdle {
+			j := bytes.IndexByte(p[i:], 0x1b)
+			if j < 0 {
+				break
+			}
+			i += j
+			q.state = queryEscape
+			continue
+		}
+		b := p[i]
+		switch q.state {
+		case queryEscape:
+			q.n, q.skip = 0, false
+			switch b {
+			case '[':
+				q.state = queryCSI
+			case ']':
+				q.state = queryOSC
+			default:
+				q.restart(b)
+			}
+		case queryCSI:
+			switch {
+			case b >= 0x30 && b <= 0x3f: // parameter bytes
+				q.add(b)
+			case b >= 0x20 && b <= 0x2f: // intermediates: no query of ours
+				q.skip = true
+			case b >= 0x40 && b <= 0x7e:
+				if !q.skip {
+					replies = append(replies, csiReply(string(q.seq[:q.n]), b)...)
+				}
+				q.state = queryIdle
+			default:
+				q.restart(b)
+			}
+		case queryOSC:
+			switch b {
+			case 0x07:
+				replies = q.oscReply(replies, "\a")
+				q.state = queryIdle
+			case 0x1b:
+				q.state = queryOSCEscape
+			default:
+				q.add(b)
+			}
+		case queryOSCEscape:
+			if b == '\\' {
+				replies = q.oscReply(replies, "\x1b\\")
+				q.state = queryIdle
+			} else {
+				q.restart(b)
+			}
+		}
+	}
+	return replies
+}
+
+// add appends b to the sequence, or marks it too long to be a query.
+func (q *queryScanner) add(b byte) {
+	if q.n == len(q.seq) {
+		q.skip = true
+		return
+	}
+	q.seq[q.n] = b
+	q.n++
+}
+
+// restart abandons the sequence being read at b, which may begin another.
+func (q *queryScanner) restart(b byte) {
+	q.state = queryIdle
+	if b == 0x1b {
+		q.state = queryEscape
+	}
+}
+
+// csiReply is the answer to the CSI sequence with params and final byte,
+// or "" if it is not a query answered.
+func csiReply(params string, final byte) string {
+	switch {
+	case final == 'c' && (params == "" || params == "0"):
+		return replyDA1
+	case final == 'c' && (params == ">" || params == ">0"):
+		return replyDA2
+	case final == 'n' && params == "5":
+		return replyStatus
+	case final == 'n' && params == "6":
+		return replyCursor
+	}
+	return ""
+}
+
+// oscReply appends the answer to the OSC sequence read, if it is a colour
+// query, ended as the query was.
+func (q *queryScanner) oscReply(replies []byte, st string) []byte {
+	if q.skip {
+		return replies
+	}
+	var color string
+	switch string(q.seq[:q.n]) {
+	case "10;?":
+		color = replyFg
+	case "11;?":
+		color = replyBg
+	default:
+		return replies
+	}
+	replies = append(replies, "\x1b]"...)
+	replies = append(replies, q.seq[:2]...)
+	replies = append(replies, ';')
+	replies = append(replies, color...)
+	return append(replies, st...)
+}
+
+// answerQueries answers the terminal queries in a chunk of output while no
+// client's terminal can: with nobody attached, or only peek clients, whose
+// input is dropped. A program probing its terminal in a detached session
+// otherwise waits for a reply that never comes. handlePTY calls it for
+// every chunk.
+func (d *Daemon) answerQueries(p []byte) {
+	d.replies = d.queries.scan(p, d.replies[:0])
+	if len(d.replies) == 0 {
+		return
+	}
+	if list := d.clientList.Load(); list != nil {
+		for _, c := range *list {
+			if c.info.Mode != protocol.ModePeek {
+				return
+			}
+		}
+	}
+	// A program that asks but stops reading its input must not hold up
+	// the output, so the reply is written aside, and later ones dropped
+	// while it is stuck.
+	if !d.answering.CompareAndSwap(false, true) {
+		d.debugf("dropping replies to terminal queries: %q", d.replies)
+		return
+	}
+	reply := bytes.Clone(d.replies)
+	go func() {
+		defer d.answering.Store(false)
+		if _, err := d.ptyMaster.Write(reply); err != nil {
+			d.debugf("reply to terminal queries: %v", err)
+		}
+	}()
+}
@@ -0,0 +1,77 @@
+package daemon
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestQueryScanner(t *testing.T) {
+	var q queryScanner
+	for _, tc := range []struct {
+		chunks []string
+		want   string
+	}{
+		{[]string{"plain \x1b[1m output\r\n"}, ""},
+		{[]string{"\x1b[c", "\x1b[0c"}, replyDA1 + replyDA1},
+		{[]string{"\x1b[>c"}, replyDA2},
+		{[]string{"\x1b[5n\x1b[6n"}, replyStatus + replyCursor},
+		{[]string{"\x1b[", "6", "n"}, replyCursor},
+		{[]string{"\x1b]11;?\a"}, "\x1b]11;" + replyBg + "\a"},
+		{[]string{"\x1b]10;?\x1b", "\\"}, "\x1b]10;" + replyFg + "\x1b\\"},
+		// Not queries: a window title, a colour being set, other CSIs.
+		{[]string{"\x1b]0;title\a\x1b]11;#000000\a\x1b[2J\x1b[?25h\x1b[1 q"}, ""},
+		// An escape abandoning a sequence starts the next.
+		{[]string{"\x1b[12\x1b[c"}, replyDA1},
+	} {
+		var got []byte
+		for _, chunk := range tc.chunks {
+			got = q.scan([]byte(chunk), got)
+		}
+		if string(got) != tc.want {
+			t.Errorf("replies to %q = %q; want %q", tc.chunks, got, tc.want)
+		}
+	}
+}
+
+// readFileUntil waits for the file at path to hold want, and returns what
+// it holds.
+func readFileUntil(path, want string, timeout time.Duration) string {
+	deadline := time.Now().Add(timeout)
+	for {
+		data, _ := os.ReadFile(path)
+		if string(data) == want || time.Now().After(deadline) {
+			return string(data)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// The daemon answers a detached program's queries, and leaves them to the
+// terminal of a client attached.
+func TestDaemonAnswersQueriesWhileDetached(t *testing.T) {
+	dir := t.TempDir()
+	detached, attached := filepath.Join(dir, "detached"), filepath.Join(dir, "attached")
+	s := startDaemon(t, exec.Command("sh", "-c",
+		"stty raw -echo; printf '\\033[6n'; head -c 6 >"+detached+
+			"; head -c 1 >/dev/null; printf '\\033[c'; head -c 1 >"+attached+"; exec cat"))
+	if got := readFileUntil(detached, replyCursor, 5*time.Second); got != replyCursor {
+		t.Fatalf("detached program read %q; want %q", got, replyCursor)
+	}
+
+	c := attach(t, s)
+	if err := c.rm.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if !c.readUntil("\x1b[c", 5*time.Second) {
+		t.Fatalf("query not relayed; output %q", c.out.String())
+	}
+	if err := c.rm.Write([]byte("Z")); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFileUntil(attached, "Z", 5*time.Second); got != "Z" {
+		t.Errorf("attached program read %q; want the client's answer", got)
+	}
+}
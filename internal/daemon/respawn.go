@@ -0,0 +1,123 @@
+package daemon
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/theMichaelB/sess/internal/session"
+	"golang.org/x/sys/unix"
+)
+
+// RespawnFlag starts the helper that runs a session's command again when
+// it exits; see Respawn.
+const RespawnFlag = "--respawn"
+
+const (
+	// respawnDelay is how long the helper waits before running the command
+	// again, doubled each time it exits within respawnSteady of starting,
+	// up to respawnMaxDelay, so a command failing at once does not spin.
+	respawnDelay    = time.Second
+	respawnMaxDelay = time.Minute
+	respawnSteady   = 10 * time.Second
+)
+
+// respawnCommand has cmd run through the sess binary helper, which runs it
+// again as policy says whenever it exits. The returned function puts cmd's
+// Path and Args back to the command's own once it has started.
+func respawnCommand(cmd *exec.Cmd, helper, policy string) (restore func(), err error) {
+	if helper == "" {
+		return nil, errors.New("respawning a command needs the sess binary to run it")
+	}
+	path, args := cmd.Path, cmd.Args
+	cmd.Path = helper
+	cmd.Args = append([]string{helper, RespawnFlag, "-policy", policy, "-path", path, "--"}, args...)
+	return func() { cmd.Path, cmd.Args = path, args }, nil
+}
+
+// Respawn is the helper a daemon runs its session's command through when
+// the command is to be respawned, given args (os.Args[1:]). It runs the
+// command on the session's terminal, in the helper's process group, and
+// again when it exits, or only when it fails, until the session ends it with
+// SIGHUP or SIGTERM: the helper passes the signal on and, once the command
+// has exited, dies of it too. Ctrl-C and Ctrl-\ typed at the terminal are
+// left to the command, which is run again if they end it.
+func Respawn(args []string) error {
+	fs := flag.NewFlagSet("sess respawn", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	policy := fs.String("policy", "", "always or on-failure")
+	path := fs.String("path", "", "program to run")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if *path == "" || fs.NArg() == 0 {
+		return errors.New("no command to run")
+	}
+	if *policy != session.RespawnAlways && *policy != session.RespawnOnFailure {
+		return fmt.Errorf("unknown respawn policy %q", *policy)
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGHUP, syscall.SIGTERM)
+	// Caught rather than ignored, so the command does not inherit them
+	// ignored.
+	signal.Notify(make(chan os.Signal, 1), syscall.SIGINT, syscall.SIGQUIT)
+
+	name := filepath.Base(fs.Arg(0))
+	delay := respawnDelay
+	for {
+		cmd := &exec.Cmd{Path: *path, Args: fs.Args(), Stdin: os.Stdin, Stdout: os.Stdout, Stderr: os.Stderr}
+		began := time.Now()
+		if err := cmd.Start(); err != nil {
+			return fmt.Errorf("running %s: %w", *path, err)
+		}
+		exited := make(chan struct{})
+		go func() {
+			cmd.Wait()
+			close(exited)
+		}()
+		select {
+		case sig := <-stop:
+			cmd.Process.Signal(sig)
+			<-exited
+			return dieOf(sig)
+		case <-exited:
+		}
+		if *policy == session.RespawnOnFailure && cmd.ProcessState.Success() {
+			return nil
+		}
+		if time.Since(began) >= respawnSteady {
+			delay = respawnDelay
+		}
+		fmt.Fprintf(os.Stderr, "\r\n[sess: %s %s; running it again in %s]\r\n", name, describeExit(cmd.ProcessState), delay)
+		select {
+		case sig := <-stop:
+			return dieOf(sig)
+		case <-time.After(delay):
+		}
+		delay = min(2*delay, respawnMaxDelay)
+	}
+}
+
+// dieOf ends the helper with sig, as the command it stood for was.
+func dieOf(sig os.Signal) error {
+	signal.Reset(sig)
+	syscall.Kill(os.Getpid(), sig.(syscall.Signal))
+	// Not reached unless the signal is blocked.
+	return fmt.Errorf("ended by %s", unix.SignalName(sig.(syscall.Signal)))
+}
+
+// describeExit says how a command ended, as "exited with status 1".
+func describeExit(st *os.ProcessState) string {
+	if ws, ok := st.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return "was killed by " + unix.SignalName(ws.Signal())
+	}
+	return fmt.Sprintf("exited with status %d", st.ExitCode())
+}
@@ -0,0 +1,226 @@
+package daemon
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/theMichaelB/sess/internal/config"
+	"github.com/theMichaelB/sess/internal/platform"
+	"golang.org/x/sys/unix"
+)
+
+// ExecLimitedFlag starts the helper that applies a session's resource
+// limits to its command; see ExecLimited.
+const ExecLimitedFlag = "--exec-limited"
+
+// Rlimit is a resource limit for a session's command, written like
+// "nofile=4096" for both the soft and the hard limit, or "nofile=1024:4096"
+// for each.
+type Rlimit struct {
+	Name       string
+	Soft, Hard uint64
+	spec       string
+}
+
+// Rlimits are the resource limits a session's command starts with,
+// written like "nofile=4096,core=0,as=8G".
+type Rlimits []Rlimit
+
+// Resource limits measured in bytes, which take sizes such as 8G, and in
+// time, which take seconds or durations such as 1h. The rest are counts.
+var (
+	rlimitBytes = map[string]bool{"as": true, "core": true, "data": true, "fsize": true, "memlock": true, "msgqueue": true, "rss": true, "stack": true}
+	rlimitTimes = map[string]time.Duration{"cpu": time.Second, "rttime": time.Microsecond}
+)
+
+// ParseRlimits parses resource limits, given one per spec or several
+// separated by commas. Names are those of platform.Rlimits; a value is a
+// number, "unlimited", or soft:hard. A name given twice keeps the last.
+func ParseRlimits(specs ...string) (Rlimits, error) {
+	var r Rlimits
+	for _, spec := range specs {
+		for _, item := range strings.Split(spec, ",") {
+			item = strings.TrimSpace(item)
+			if item == "" {
+				continue
+			}
+			l, err := parseRlimit(item)
+			if err != nil {
+				return nil, err
+			}
+			r = withoutRlimit(r, l.Name)
+			r = append(r, l)
+		}
+	}
+	return r, nil
+}
+
+// withoutRlimit removes the limit named name from r.
+func withoutRlimit(r Rlimits, name string) Rlimits {
+	out := r[:0]
+	for _, l := range r {
+		if l.Name != name {
+			out = append(out, l)
+		}
+	}
+	return out
+}
+
+func parseRlimit(item string) (Rlimit, error) {
+	name, value, ok := strings.Cut(item, "=")
+	if !ok {
+		return Rlimit{}, fmt.Errorf("resource limit %q: want name=value", item)
+	}
+	l := Rlimit{Name: strings.ToLower(strings.TrimSpace(name)), spec: strings.TrimSpace(value)}
+	if _, ok := platform.Rlimits[l.Name]; !ok {
+		return Rlimit{}, fmt.Errorf("unknown resource limit %q (known: %s)", name, rlimitNames())
+	}
+	soft, hard, split := strings.Cut(l.spec, ":")
+	var err error
+	if l.Soft, err = parseRlimitValue(l.Name, soft); err != nil {
+		return Rlimit{}, fmt.Errorf("resource limit %q: %w", item, err)
+	}
+	l.Hard = l.Soft
+	if split {
+		if l.Hard, err = parseRlimitValue(l.Name, hard); err != nil {
+			return Rlimit{}, fmt.Errorf("resource limit %q: %w", item, err)
+		}
+		if l.Soft > l.Hard {
+			return Rlimit{}, fmt.Errorf("resource limit %q: the soft limit is above the hard one", item)
+		}
+	}
+	return l, nil
+}
+
+func parseRlimitValue(name, s string) (uint64, error) {
+	s = strings.TrimSpace(s)
+	switch {
+	case s == "unlimited" || s == "infinity":
+		return platform.RlimInfinity, nil
+	case rlimitBytes[name]:
+		n, err := config.ParseSize(s)
+		if err != nil {
+			return 0, err
+		}
+		return uint64(n), nil
+	case rlimitTimes[name] != 0:
+		if n, err := strconv.ParseUint(s, 10, 64); err == nil {
+			return n, nil
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil || d < 0 {
+			return 0, fmt.Errorf("invalid time %q (e.g. 60, 1h)", s)
+		}
+		return uint64(d / rlimitTimes[name]), nil
+	}
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil || n == math.MaxUint64 {
+		return 0, fmt.Errorf("invalid number %q", s)
+	}
+	return n, nil
+}
+
+func rlimitNames() string {
+	names := make([]string, 0, len(platform.Rlimits))
+	for name := range platform.Rlimits {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+func (r Rlimits) String() string {
+	items := make([]string, len(r))
+	for i, l := range r {
+		items[i] = l.Name + "=" + l.spec
+	}
+	return strings.Join(items, ",")
+}
+
+// apply sets the limits on this process.
+func (r Rlimits) apply() error {
+	for _, l := range r {
+		if err := platform.Setrlimit(platform.Rlimits[l.Name], l.Soft, l.Hard); err != nil {
+			if errors.Is(err, syscall.EPERM) && os.Geteuid() != 0 {
+				err = fmt.Errorf("%w (only root may raise a hard limit)", err)
+			}
+			return fmt.Errorf("setting %s=%s: %w", l.Name, l.spec, err)
+		}
+	}
+	return nil
+}
+
+// limitCommand has cmd run through the sess binary helper, which applies
+// r to itself and then executes the command. The helper reports a
+// failure on descriptor 3; the returned function waits for it to succeed
+// or fail once cmd has started, and puts cmd's Path and Args back to the
+// command's own.
+func (r Rlimits) limitCommand(cmd *exec.Cmd, helper string) (started func() error, err error) {
+	if helper == "" {
+		return nil, errors.New("resource limits need the sess binary to set them")
+	}
+	report, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	path, args := cmd.Path, cmd.Args
+	cmd.Path = helper
+	cmd.Args = append([]string{helper, ExecLimitedFlag, "-rlimits", r.String(), "-path", path, "--"}, args...)
+	cmd.ExtraFiles = []*os.File{w}
+	return func() error {
+		w.Close()
+		defer report.Close()
+		cmd.Path, cmd.Args = path, args
+		msg, _ := io.ReadAll(report)
+		if len(msg) > 0 {
+			cmd.Wait()
+			return errors.New(strings.TrimSpace(string(msg)))
+		}
+		return nil
+	}, nil
+}
+
+// ExecLimited is the helper a daemon runs its session's command through
+// when the session has resource limits, given args (os.Args[1:]): it
+// applies them and executes the command in its place. It only returns if
+// that fails, having told the daemon why.
+func ExecLimited(args []string) error {
+	// Closed by the exec, which is how the daemon learns it happened.
+	report := os.NewFile(3, "report")
+	unix.CloseOnExec(3)
+	fail := func(err error) error {
+		fmt.Fprintln(report, err)
+		return err
+	}
+	fs := flag.NewFlagSet("sess exec-limited", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	spec := fs.String("rlimits", "", "resource limits to apply")
+	path := fs.String("path", "", "program to execute")
+	if err := fs.Parse(args[1:]); err != nil {
+		return fail(err)
+	}
+	if *path == "" || fs.NArg() == 0 {
+		return fail(errors.New("no command to execute"))
+	}
+	r, err := ParseRlimits(*spec)
+	if err != nil {
+		return fail(err)
+	}
+	if err := r.apply(); err != nil {
+		return fail(err)
+	}
+	if err := syscall.Exec(*path, fs.Args(), os.Environ()); err != nil {
+		return fail(fmt.Errorf("executing %s: %w", *path, err))
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package daemon
+
+import (
+	"testing"
+
+	"github.com/theMichaelB/sess/internal/platform"
+)
+
+func TestParseRlimits(t *testing.T) {
+	tests := []struct {
+		specs []string
+		want  string // as String writes it; "" with ok false for an error
+		ok    bool
+	}{
+		{nil, "", true},
+		{[]string{"nofile=4096", "core=0,as=8G"}, "nofile=4096,core=0,as=8G", true},
+		{[]string{" NOFILE = 1024:4096 "}, "nofile=1024:4096", true},
+		{[]string{"nofile=1024", "nofile=2048"}, "nofile=2048", true},
+		{[]string{"cpu=1h,stack=unlimited"}, "cpu=1h,stack=unlimited", true},
+		{[]string{"nofile"}, "", false},
+		{[]string{"nofile=lots"}, "", false},
+		{[]string{"nofile=4G"}, "", false},
+		{[]string{"nofile=4096:1024"}, "", false},
+		{[]string{"cpu=soon"}, "", false},
+		{[]string{"bogus=1"}, "", false},
+	}
+	for _, tt := range tests {
+		got, err := ParseRlimits(tt.specs...)
+		if (err == nil) != tt.ok || got.String() != tt.want {
+			t.Errorf("ParseRlimits(%q) = %q, %v; want %q, ok %v", tt.specs, got.String(), err, tt.want, tt.ok)
+		}
+	}
+
+	r, err := ParseRlimits("as=8G,cpu=1h,nofile=1024:4096,core=unlimited")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Rlimit{
+		{Name: "as", Soft: 8 << 30, Hard: 8 << 30},
+		{Name: "cpu", Soft: 3600, Hard: 3600},
+		{Name: "nofile", Soft: 1024, Hard: 4096},
+		{Name: "core", Soft: platform.RlimInfinity, Hard: platform.RlimInfinity},
+	}
+	for i, l := range r {
+		if l.Name != want[i].Name || l.Soft != want[i].Soft || l.Hard != want[i].Hard {
+			t.Errorf("limit %d = %s %d:%d; want %s %d:%d", i, l.Name, l.Soft, l.Hard, want[i].Name, want[i].Soft, want[i].Hard)
+		}
+	}
+}
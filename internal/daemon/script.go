@@ -0,0 +1,91 @@
+package daemon
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// scriptTimeFormat is how script(1) dates its header and trailer lines.
+const scriptTimeFormat = "2006-01-02 15:04:05-07:00"
+
+// scriptRecorder records the session's output as script(1) does: the raw
+// output in a typescript and, optionally, a timing file of "<delay>
+// <bytes>" lines that scriptreplay(1) replays it with. The format has no
+// way to say the terminal was resized, so resizes go unrecorded. It is
+// written only by handlePTY, then closed once that has returned.
+type scriptRecorder struct {
+	typescript *os.File
+	timing     *os.File // nil when no timing is kept
+	last       time.Time
+}
+
+// openScript starts the script recording if the session keeps one. Both
+// files are created afresh, as script does without -a.
+func (d *Daemon) openScript() error {
+	if d.cfg.ScriptTypescript == "" {
+		return nil
+	}
+	ts, err := os.OpenFile(d.cfg.ScriptTypescript, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	r := &scriptRecorder{typescript: ts}
+	if d.cfg.ScriptTiming != "" {
+		if r.timing, err = os.OpenFile(d.cfg.ScriptTiming, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600); err != nil {
+			ts.Close()
+			return err
+		}
+	}
+	// scriptreplay skips the typescript's first line, whatever it says.
+	r.last = time.Now()
+	info := fmt.Sprintf("COMMAND=%q", strings.Join(d.cfg.Argv, " "))
+	if d.cfg.Rows > 0 && d.cfg.Cols > 0 {
+		info += fmt.Sprintf(" COLUMNS=\"%d\" LINES=\"%d\"", d.cfg.Cols, d.cfg.Rows)
+	}
+	if _, err := fmt.Fprintf(ts, "Script started on %s [%s]\n", r.last.Format(scriptTimeFormat), info); err != nil {
+		r.close()
+		return err
+	}
+	d.script = r
+	return nil
+}
+
+// recordScript appends a chunk of output to the script recording. If
+// writing fails the session carries on unrecorded.
+func (d *Daemon) recordScript(data []byte) {
+	r := d.script
+	if r == nil {
+		return
+	}
+	now := time.Now()
+	_, err := r.typescript.Write(data)
+	if err == nil && r.timing != nil {
+		_, err = fmt.Fprintf(r.timing, "%.6f %d\n", now.Sub(r.last).Seconds(), len(data))
+	}
+	r.last = now
+	if err != nil {
+		fmt.Fprintf(d.log, "daemon: script recording: %v; no longer recording\n", err)
+		r.close()
+		d.script = nil
+	}
+}
+
+// closeScript ends the script recording with script's trailer line.
+func (d *Daemon) closeScript() {
+	r := d.script
+	if r == nil {
+		return
+	}
+	fmt.Fprintf(r.typescript, "\nScript done on %s\n", time.Now().Format(scriptTimeFormat))
+	r.close()
+	d.script = nil
+}
+
+func (r *scriptRecorder) close() {
+	r.typescript.Close()
+	if r.timing != nil {
+		r.timing.Close()
+	}
+}
@@ -0,0 +1,65 @@
+package daemon
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// The typescript and timing must be what scriptreplay expects: a header
+// line it skips, then output whose length the timing lines add up to.
+func TestScriptRecording(t *testing.T) {
+	dir := t.TempDir()
+	typescript := filepath.Join(dir, "out.typescript")
+	timing := filepath.Join(dir, "out.timing")
+	s := startDaemonConfig(t, Config{
+		Command:          exec.Command("sh", "-c", "echo one; sleep 0.2; echo two"),
+		ScriptTypescript: typescript,
+		ScriptTiming:     timing,
+	})
+	s.wait(t)
+
+	ts, err := os.ReadFile(typescript)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, rest, _ := bytes.Cut(ts, []byte("\n"))
+	if !bytes.HasPrefix(header, []byte("Script started on ")) {
+		t.Errorf("header %q; want it to start %q", header, "Script started on ")
+	}
+	i := bytes.LastIndex(rest, []byte("\nScript done on "))
+	if i < 0 {
+		t.Fatalf("no trailer in %q", rest)
+	}
+	output := rest[:i]
+	if !bytes.Contains(output, []byte("one")) || !bytes.Contains(output, []byte("two")) {
+		t.Errorf("output %q; want both lines", output)
+	}
+
+	f, err := os.Open(timing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	total, lines := 0, 0
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var delay float64
+		var n int
+		if _, err := fmt.Sscanf(sc.Text(), "%f %d", &delay, &n); err != nil || delay < 0 || n <= 0 {
+			t.Fatalf("timing line %q: %v", sc.Text(), err)
+		}
+		total += n
+		lines++
+	}
+	if total != len(output) {
+		t.Errorf("timing covers %d bytes; typescript holds %d", total, len(output))
+	}
+	if lines < 2 {
+		t.Errorf("%d timing lines; want one per chunk, at least 2", lines)
+	}
+}
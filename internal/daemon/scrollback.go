@@ -0,0 +1,185 @@
+package daemon
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// scrollback keeps the most recent session output in a fixed-size ring, so
+// a runaway program cannot grow the daemon's memory. With a spill file,
+// bytes pushed out of the ring are appended to it instead of being lost.
+// Writing allocates nothing; the buffer is allocated once, up front.
+type scrollback struct {
+	mu    sync.Mutex
+	buf   []byte
+	start int // index of the oldest byte
+	size  int // bytes held, at most len(buf)
+
+	spill    *os.File
+	spilled  int64 // bytes written to spill
+	spillErr error // why spilling stopped, if it did
+}
+
+// newScrollback returns a scrollback holding up to capacity bytes. spill,
+// if non-nil, receives what overflows the ring; the scrollback owns it.
+func newScrollback(capacity int, spill *os.File) *scrollback {
+	return &scrollback{buf: make([]byte, capacity), spill: spill}
+}
+
+// newSpillFile creates the anonymous temporary file a scrollback spills to.
+// It is unlinked at once, so it goes away with the daemon however it ends.
+func newSpillFile(session string) (*os.File, error) {
+	f, err := os.CreateTemp("", fmt.Sprintf("sess-%s-scrollback-*", session))
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(f.Name())
+	return f, nil
+}
+
+// Write appends p, evicting (or spilling) the oldest bytes as needed.
+func (s *scrollback) Write(p []byte) (int, error) {
+	n := len(p)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := len(s.buf)
+	if c == 0 {
+		s.spillBytes(p)
+		return n, nil
+	}
+	if len(p) >= c {
+		s.spillOldest(s.size)
+		s.spillBytes(p[:len(p)-c])
+		copy(s.buf, p[len(p)-c:])
+		s.start, s.size = 0, c
+		return n, nil
+	}
+	if over := s.size + len(p) - c; over > 0 {
+		s.spillOldest(over)
+		s.start = (s.start + over) % c
+		s.size -= over
+	}
+	end := (s.start + s.size) % c
+	k := copy(s.buf[end:], p)
+	copy(s.buf, p[k:])
+	s.size += len(p)
+	return n, nil
+}
+
+// spillOldest appends the oldest n bytes of the ring to the spill file.
+func (s *scrollback) spillOldest(n int) {
+	if s.spill == nil || n == 0 {
+		return
+	}
+	first := s.buf[s.start:min(s.start+n, len(s.buf))]
+	s.spillBytes(first)
+	s.spillBytes(s.buf[:n-len(first)])
+}
+
+// spillBytes appends p to the spill file. A failed write stops spilling
+// for good, since the history on disk would have a hole in it.
+func (s *scrollback) spillBytes(p []byte) {
+	if s.spill == nil || len(p) == 0 {
+		return
+	}
+	n, err := s.spill.Write(p)
+	s.spilled += int64(n)
+	if err != nil {
+		s.spillErr = err
+		s.spill.Close()
+		s.spill = nil
+	}
+}
+
+// at returns the i'th oldest byte held.
+func (s *scrollback) at(i int) byte {
+	return s.buf[(s.start+i)%len(s.buf)]
+}
+
+// saturated reports whether more output would only push out what the
+// scrollback holds: the ring is full and nothing is spilled.
+func (s *scrollback) saturated() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size == len(s.buf) && s.spill == nil
+}
+
+// Len returns the number of bytes held in memory.
+func (s *scrollback) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size
+}
+
+// tailLines returns how many of the newest bytes make up the last n lines.
+// A final newline ends the last line rather than starting an empty one.
+func (s *scrollback) tailLines(n int) int {
+	end := s.size
+	if end > 0 && s.at(end-1) == '\n' {
+		end--
+	}
+	i := end
+	for lines := 0; i > 0; i-- {
+		if s.at(i-1) == '\n' {
+			lines++
+			if lines == n {
+				break
+			}
+		}
+	}
+	return s.size - i
+}
+
+// tail copies the newest n bytes held.
+func (s *scrollback) tail(n int) []byte {
+	n = min(n, s.size)
+	if n == 0 {
+		return nil
+	}
+	out := make([]byte, n)
+	from := (s.start + s.size - n) % len(s.buf)
+	k := copy(out, s.buf[from:min(from+n, len(s.buf))])
+	copy(out[k:], s.buf)
+	return out
+}
+
+// Snapshot returns the newest bytes held: the last lines lines if lines is
+// positive, else the last bytes bytes if that is positive, else all of
+// them. With all set, the spilled history is returned too, as a reader
+// over the spill file's contents so far.
+func (s *scrollback) Snapshot(bytes, lines int, all bool) (spilled *io.SectionReader, held []byte, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if all {
+		if s.spillErr != nil {
+			return nil, nil, fmt.Errorf("scrollback spill failed, history is incomplete: %w", s.spillErr)
+		}
+		if s.spill != nil {
+			spilled = io.NewSectionReader(s.spill, 0, s.spilled)
+		}
+		return spilled, s.tail(s.size), nil
+	}
+
+	n := s.size
+	switch {
+	case lines > 0:
+		n = s.tailLines(lines)
+	case bytes > 0:
+		n = min(bytes, s.size)
+	}
+	return nil, s.tail(n), nil
+}
+
+// Close releases the spill file.
+func (s *scrollback) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.spill != nil {
+		s.spill.Close()
+		s.spill = nil
+	}
+}
@@ -0,0 +1,130 @@
+package daemon
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// held returns everything s holds in memory.
+func held(t *testing.T, s *scrollback) string {
+	t.Helper()
+	_, data, err := s.Snapshot(0, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestScrollbackWraparound(t *testing.T) {
+	tests := []struct {
+		name   string
+		writes []string
+		want   string
+	}{
+		{"fits", []string{"abc", "de"}, "abcde"},
+		{"exactly full", []string{"abcd", "efgh"}, "abcdefgh"},
+		{"evicts oldest", []string{"abcdef", "ghij"}, "cdefghij"},
+		{"wraps repeatedly", []string{"abc", "def", "ghi", "jkl", "mno"}, "hijklmno"},
+		{"write larger than buffer", []string{"ab", "0123456789"}, "23456789"},
+		{"single bytes", strings.Split("abcdefghijk", ""), "defghijk"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newScrollback(8, nil)
+			for _, w := range tt.writes {
+				if n, err := s.Write([]byte(w)); n != len(w) || err != nil {
+					t.Fatalf("Write(%q) = %d, %v", w, n, err)
+				}
+			}
+			if got := held(t, s); got != tt.want {
+				t.Errorf("held %q; want %q", got, tt.want)
+			}
+			if s.Len() != len(tt.want) {
+				t.Errorf("Len() = %d; want %d", s.Len(), len(tt.want))
+			}
+		})
+	}
+}
+
+func TestScrollbackSnapshotTail(t *testing.T) {
+	s := newScrollback(16, nil)
+	// Wrapped: the ring holds "two\nthree\nfour\n" from an offset.
+	s.Write([]byte("zero\none\n"))
+	s.Write([]byte("two\nthree\nfour\n"))
+
+	tests := []struct {
+		name         string
+		bytes, lines int
+		want         string
+	}{
+		{"everything", 0, 0, "\ntwo\nthree\nfour\n"},
+		{"last line", 0, 1, "four\n"},
+		{"last two lines across the wrap", 0, 2, "three\nfour\n"},
+		{"more lines than held", 0, 10, "\ntwo\nthree\nfour\n"},
+		{"last bytes", 5, 0, "four\n"},
+		{"more bytes than held", 100, 0, "\ntwo\nthree\nfour\n"},
+		{"lines win over bytes", 3, 1, "four\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, got, err := s.Snapshot(tt.bytes, tt.lines, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("Snapshot(%d, %d) = %q; want %q", tt.bytes, tt.lines, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScrollbackUnterminatedLastLine(t *testing.T) {
+	s := newScrollback(64, nil)
+	s.Write([]byte("a\nb\n$ "))
+	if _, got, _ := s.Snapshot(0, 2, false); string(got) != "b\n$ " {
+		t.Errorf("last 2 lines = %q; want %q", got, "b\n$ ")
+	}
+}
+
+func TestScrollbackSpill(t *testing.T) {
+	spill, err := os.Create(filepath.Join(t.TempDir(), "spill"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newScrollback(4, spill)
+	defer s.Close()
+	s.Write([]byte("abc"))
+	s.Write([]byte("defg"))
+	s.Write([]byte("0123456789"))
+
+	spilled, got, err := s.Snapshot(0, 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var all bytes.Buffer
+	io.Copy(&all, spilled)
+	all.Write(got)
+	if all.String() != "abcdefg0123456789" {
+		t.Errorf("whole history %q; want %q", all.String(), "abcdefg0123456789")
+	}
+}
+
+func BenchmarkScrollbackWrite(b *testing.B) {
+	for _, size := range []int{64, 4096, 64 << 10} {
+		b.Run(fmt.Sprintf("%dB", size), func(b *testing.B) {
+			s := newScrollback(256<<10, nil)
+			chunk := bytes.Repeat([]byte("output line\n"), size/12+1)[:size]
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				s.Write(chunk)
+			}
+		})
+	}
+}
@@ -0,0 +1,218 @@
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+
+	"github.com/theMichaelB/sess/internal/platform"
+	"github.com/theMichaelB/sess/pkg/protocol"
+)
+
+// peer is who is on the other end of a connection.
+type peer struct {
+	pid int
+	uid int
+	// owner peers may do anything; others are limited to what the
+	// session's share list allows.
+	owner bool
+}
+
+// peerCred is platform.PeerCred; tests pass for other users through it.
+var peerCred = platform.PeerCred
+
+// identify looks up the peer on conn, which was accepted on the shared
+// socket if viaShared is set. The session's owner is trusted, and so is
+// root, which can reach the session regardless. A peer whose credentials
+// are unknown is trusted on the private socket, whose directory only the
+// owner can enter, and on the shared socket is nobody.
+func identify(conn net.Conn, viaShared bool) peer {
+	pid, uid := peerCred(conn)
+	owner := uid == os.Getuid() || uid == 0 || (uid < 0 && !viaShared)
+	return peer{pid: pid, uid: uid, owner: owner}
+}
+
+// shareAllows returns the share list entry that lets uid connect in mode.
+func (d *Daemon) shareAllows(uid int, mode string) (protocol.SharedUser, error) {
+	d.shareMu.Lock()
+	u, ok := d.shared[uid]
+	d.shareMu.Unlock()
+	if !ok {
+		return u, fmt.Errorf("session %s is not shared with you", d.sessionNum)
+	}
+	if u.ReadOnly && mode != protocol.ModePeek {
+		return u, fmt.Errorf("session %s is shared with you read-only; attach with -r", d.sessionNum)
+	}
+	return u, nil
+}
+
+// deny refuses a request from a peer the share list does not admit.
+func (d *Daemon) deny(conn net.Conn, err error) {
+	d.sendMessage(conn, protocol.MsgError, protocol.ErrorPayload{
+		Message: err.Error(),
+		Code:    protocol.ErrCodeDenied,
+	})
+	conn.Close()
+}
+
+// handleShare applies a one-shot SHARE request to the share list and
+// replies with the result. The shared socket is opened when the first user
+// is granted access and removed when the last one is revoked; clients the
+// new list no longer admits are disconnected.
+func (d *Daemon) handleShare(conn net.Conn, msg *protocol.Message) {
+	var req protocol.SharePayload
+	if err := msg.Decode(&req); err != nil {
+		d.sendError(conn, "malformed SHARE")
+		return
+	}
+	if len(req.Grant) > 0 && !platform.PeerCredSupported {
+		// Without peer credentials the shared socket could tell no one
+		// apart, so it would let nobody in.
+		d.sendError(conn, "cannot share: peer credentials are not supported on this platform")
+		return
+	}
+
+	d.shareMu.Lock()
+	if len(req.Grant) > 0 && d.sharedListener == nil {
+		if err := d.openSharedSocket(req.Socket); err != nil {
+			d.shareMu.Unlock()
+			d.sendError(conn, fmt.Sprintf("cannot share: %v", err))
+			return
+		}
+	}
+	if req.RevokeAll {
+		d.shared = make(map[int]protocol.SharedUser)
+	}
+	for _, uid := range req.Revoke {
+		delete(d.shared, uid)
+	}
+	for _, u := range req.Grant {
+		d.shared[u.UID] = u
+	}
+	if len(d.shared) == 0 {
+		d.closeSharedSocket()
+	}
+	d.shareMu.Unlock()
+
+	d.dropUnshared()
+	reply := d.shareStatus()
+	if reply == nil {
+		reply = &protocol.ShareStatus{}
+	}
+	d.debugf("shared with %d users", len(reply.Users))
+	d.sendMessage(conn, protocol.MsgShare, reply)
+}
+
+// shareStatus returns who the session is shared with, or nil.
+func (d *Daemon) shareStatus() *protocol.ShareStatus {
+	d.shareMu.Lock()
+	defer d.shareMu.Unlock()
+	if len(d.shared) == 0 {
+		return nil
+	}
+	st := &protocol.ShareStatus{Socket: d.sharedSocket}
+	for _, u := range d.shared {
+		st.Users = append(st.Users, u)
+	}
+	sort.Slice(st.Users, func(i, j int) bool { return st.Users[i].Name < st.Users[j].Name })
+	return st
+}
+
+// dropUnshared disconnects other users' clients that the share list no
+// longer admits.
+func (d *Daemon) dropUnshared() {
+	var gone []*client
+	d.clientMutex.RLock()
+	for _, c := range d.clients {
+		if c.owner {
+			continue
+		}
+		if _, err := d.shareAllows(c.uid, c.info.Mode); err != nil {
+			gone = append(gone, c)
+		}
+	}
+	d.clientMutex.RUnlock()
+
+	for _, c := range gone {
+		d.detachClient(c, "the session is no longer shared with you")
+	}
+}
+
+// openSharedSocket listens where shared users connect: at path, or in a
+// directory of the owner's shared sessions under the temporary directory.
+// The socket's mode lets any user connect, since a file mode cannot name
+// one other user; who gets in is decided by the share list alone. The
+// caller holds shareMu.
+func (d *Daemon) openSharedSocket(path string) error {
+	if d.shareClosed {
+		return errors.New("session is ending")
+	}
+	if d.upgrading.Load() {
+		return errors.New("session is being upgraded")
+	}
+	if path == "" {
+		dir := filepath.Join(os.TempDir(), fmt.Sprintf("sess-%d", os.Getuid()))
+		if err := sharedDir(dir); err != nil {
+			return err
+		}
+		path = filepath.Join(dir, "session-"+d.sessionNum+".sock")
+	}
+	if socketAnswers(path) {
+		return fmt.Errorf("%s is in use", path)
+	}
+	// Only ever replace a leftover socket, never some other file.
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return fmt.Errorf("%s exists and is not a socket", path)
+		}
+		os.Remove(path)
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(path, 0666); err != nil {
+		listener.Close()
+		os.Remove(path)
+		return err
+	}
+	d.sharedListener, d.sharedSocket = listener, path
+	d.wg.Add(1)
+	d.io.Add(1)
+	go d.acceptConnections(listener, true)
+	return nil
+}
+
+// closeSharedSocket stops listening for shared users. The caller holds
+// shareMu.
+func (d *Daemon) closeSharedSocket() {
+	if d.sharedListener == nil {
+		return
+	}
+	d.sharedListener.Close()
+	os.Remove(d.sharedSocket)
+	d.sharedListener, d.sharedSocket = nil, ""
+}
+
+// sharedDir makes dir ready to hold shared sockets: a directory of ours
+// that others may enter but not list or write to. One that exists must
+// already be ours, so nobody can plant it for us in a shared /tmp.
+func sharedDir(dir string) error {
+	if err := os.Mkdir(dir, 0711); err != nil && !os.IsExist(err) {
+		return err
+	}
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !info.IsDir() || (ok && int(st.Uid) != os.Getuid()) {
+		return fmt.Errorf("%s is not a directory owned by you", dir)
+	}
+	return os.Chmod(dir, 0711)
+}
@@ -0,0 +1,140 @@
+package daemon
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"os/exec"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/theMichaelB/sess/internal/platform"
+	"github.com/theMichaelB/sess/pkg/protocol"
+)
+
+// stranger has connections made while it is set come from another user,
+// whose UID it returns.
+func stranger(t *testing.T) (uid int, set func(bool)) {
+	uid = os.Getuid() + 1000
+	var on atomic.Bool
+	peerCred = func(conn net.Conn) (int, int) {
+		pid, u := platform.PeerCred(conn)
+		if on.Load() {
+			u = uid
+		}
+		return pid, u
+	}
+	t.Cleanup(func() { peerCred = platform.PeerCred })
+	return uid, on.Store
+}
+
+// share puts u on the session's share list.
+func share(s *testSession, u protocol.SharedUser) {
+	s.d.shareMu.Lock()
+	s.d.shared[u.UID] = u
+	s.d.shareMu.Unlock()
+}
+
+// request sends a one-shot request and returns the daemon's reply.
+func request(t *testing.T, s *testSession, msgType string, payload interface{}) *protocol.Message {
+	t.Helper()
+	conn, err := net.Dial("unix", s.socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	data, err := protocol.EncodeMessage(msgType, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	msg, err := protocol.ReadMessageFrom(bufio.NewReader(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+// denied fails t unless msg refuses a peer the share list does not admit,
+// saying want.
+func denied(t *testing.T, what string, msg *protocol.Message, want string) {
+	t.Helper()
+	var e protocol.ErrorPayload
+	if msg.Type != protocol.MsgError || msg.Decode(&e) != nil || e.Code != protocol.ErrCodeDenied {
+		t.Fatalf("%s: got %s %s; want it denied", what, msg.Type, msg.Payload)
+	}
+	if e.Message != want {
+		t.Errorf("%s: refusal %q; want %q", what, e.Message, want)
+	}
+}
+
+// Another user gets nowhere unless the session is shared with them, then
+// only as far as the share allows, and may only ever attach.
+func TestShareAdmitsOnlyWhatIsShared(t *testing.T) {
+	uid, asStranger := stranger(t)
+	s := startDaemon(t, exec.Command("cat"))
+	asStranger(true)
+
+	denied(t, "not shared", connect(t, s, protocol.ConnectPayload{Mode: protocol.ModePeek}),
+		"session 001 is not shared with you")
+
+	share(s, protocol.SharedUser{UID: uid, Name: "other", ReadOnly: true})
+	if msg := connect(t, s, protocol.ConnectPayload{Mode: protocol.ModePeek}); msg.Type != protocol.MsgReady {
+		t.Errorf("peek when shared read-only: got %s %s", msg.Type, msg.Payload)
+	}
+	denied(t, "attach when shared read-only", connect(t, s, protocol.ConnectPayload{Mode: protocol.ModeAttach}),
+		"session 001 is shared with you read-only; attach with -r")
+
+	share(s, protocol.SharedUser{UID: uid, Name: "other"})
+	for _, req := range []struct {
+		msgType string
+		payload interface{}
+	}{
+		{protocol.MsgStatus, nil},
+		{protocol.MsgDetach, protocol.DetachPayload{Reason: "because"}},
+		{protocol.MsgShare, protocol.SharePayload{RevokeAll: true}},
+	} {
+		denied(t, req.msgType, request(t, s, req.msgType, req.payload),
+			"users session 001 is shared with may only attach")
+	}
+	if st := s.d.shareStatus(); st == nil || len(st.Users) != 1 {
+		t.Errorf("share list after a stranger's SHARE: %+v", st)
+	}
+
+	asStranger(false)
+	if msg := request(t, s, protocol.MsgStatus, nil); msg.Type != protocol.MsgStatus {
+		t.Errorf("STATUS from the owner: got %s %s", msg.Type, msg.Payload)
+	}
+}
+
+// Revoking a share disconnects that user's clients, telling them why, and
+// leaves the owner's connected.
+func TestUnshareDropsAttachedClients(t *testing.T) {
+	uid, asStranger := stranger(t)
+	s := startDaemon(t, exec.Command("cat"))
+	if msg := connect(t, s, protocol.ConnectPayload{Mode: protocol.ModePeek}); msg.Type != protocol.MsgReady {
+		t.Fatalf("owner's peek: got %s %s", msg.Type, msg.Payload)
+	}
+	share(s, protocol.SharedUser{UID: uid, Name: "other"})
+	asStranger(true)
+	other := attach(t, s)
+	asStranger(false)
+
+	if msg := request(t, s, protocol.MsgShare, protocol.SharePayload{Revoke: []int{uid}}); msg.Type != protocol.MsgShare {
+		t.Fatalf("SHARE: got %s %s", msg.Type, msg.Payload)
+	}
+	other.drain(2 * time.Second)
+	m := other.controlMessage(protocol.MsgDetach)
+	var p protocol.DetachPayload
+	if m == nil || m.Decode(&p) != nil || p.Reason != "the session is no longer shared with you" {
+		t.Errorf("the unshared client was not detached: %v", m)
+	}
+
+	if st := s.d.status(); len(st.Clients) != 1 || st.Clients[0].Mode != protocol.ModePeek {
+		t.Errorf("%d clients connected; want only the owner's", len(st.Clients))
+	}
+}
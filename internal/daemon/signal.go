@@ -0,0 +1,47 @@
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/theMichaelB/sess/pkg/protocol"
+)
+
+// handleSignal delivers the signal of a one-shot SIGNAL request, as typing
+// the matching key would: to the foreground process group of the PTY, or to
+// the shell when the request asks for it. It acknowledges with READY.
+func (d *Daemon) handleSignal(conn net.Conn, msg *protocol.Message) {
+	var req protocol.SignalPayload
+	if err := msg.Decode(&req); err != nil || req.Signal <= 0 {
+		d.sendError(conn, "malformed SIGNAL")
+		return
+	}
+	sig := syscall.Signal(req.Signal)
+
+	var err error
+	if req.Shell {
+		if d.cmd == nil || d.cmd.Process == nil {
+			d.sendError(conn, "session has no shell")
+			return
+		}
+		pid := d.cmd.Process.Pid
+		if err = syscall.Kill(pid, sig); errors.Is(err, syscall.ESRCH) {
+			err = fmt.Errorf("shell (pid %d) has exited", pid)
+		}
+	} else {
+		var pgrp int
+		if pgrp, err = d.foregroundGroup(); err != nil {
+			err = fmt.Errorf("no foreground job: %v", err)
+		} else if err = syscall.Kill(-pgrp, sig); errors.Is(err, syscall.ESRCH) {
+			err = fmt.Errorf("foreground job (process group %d) has exited", pgrp)
+		}
+	}
+	if err != nil {
+		d.sendError(conn, err.Error())
+		return
+	}
+	d.debugf("sent %v (shell=%v)", sig, req.Shell)
+	d.sendMessage(conn, protocol.MsgReady, nil)
+}
@@ -0,0 +1,263 @@
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/theMichaelB/sess/internal/platform"
+	"github.com/theMichaelB/sess/internal/session"
+	"github.com/theMichaelB/sess/internal/utils"
+)
+
+// stateSettle is how long keepState waits after the watch on the state
+// directory saw something change before looking, for an rm -rf to
+// finish. It is short: a sess run right after may take the session's
+// number otherwise.
+const stateSettle = 100 * time.Millisecond
+
+// stateLostReason is what clients are told when a session ends because its
+// state was removed.
+const stateLostReason = "the session's state directory was removed"
+
+// stateFiles is what keepState knows of the session's state.
+type stateFiles struct {
+	// meta is the metadata as last read, to be put back as it was. The
+	// watch sees it rewritten, so it misses little of what sess commands
+	// add.
+	meta Metadata
+	// socket is the socket listened on, nil if it is not checked.
+	socket os.FileInfo
+}
+
+// guardState keeps the session's state with keepState until the daemon
+// shuts down: whenever the watch on the state directory sees it change,
+// and when sess doctor asks with SIGUSR1. Nothing wakes it otherwise;
+// where the directory cannot be watched, each connection has keepState
+// look too.
+func (d *Daemon) guardState() {
+	st := &stateFiles{}
+	readMetadata(d.metaPath, &st.meta)
+	if d.socketPath != "" {
+		st.socket, _ = os.Lstat(d.socketPath)
+	}
+	d.stateMu.Lock()
+	d.state = st
+	d.stateMu.Unlock()
+
+	changed, unwatch := d.watchState()
+	defer func() { unwatch() }()
+	for {
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-d.recheck:
+			fmt.Fprintln(d.log, "daemon: asked to put back the session's state")
+			d.keepState(true)
+		case <-changed:
+			unwatch()
+			select {
+			case <-d.ctx.Done():
+				return
+			case <-time.After(stateSettle):
+			}
+			d.keepState(false)
+			changed, unwatch = d.watchState()
+		}
+	}
+}
+
+// keepState checks that the session's metadata and socket are still where
+// sess looks for them. Should someone remove the state directory while the
+// session runs, nothing could list the session or attach to it again, and
+// its command would run on unreachable; keepState puts them back, or with
+// Config.ExitOnStateLost ends the session, unless reregister says sess
+// doctor asked for them back. A session whose number has been taken by
+// another since cannot have its socket or metadata back, and is ended
+// either way.
+func (d *Daemon) keepState(reregister bool) {
+	d.stateMu.Lock()
+	defer d.stateMu.Unlock()
+	st := d.state
+	if st == nil || d.ctx.Err() != nil {
+		return
+	}
+	if why := d.stateTaken(st); why != "" {
+		d.loseState(why)
+		return
+	}
+	_, err := os.Lstat(d.metaPath)
+	metaGone := errors.Is(err, fs.ErrNotExist)
+	socketGone := false
+	if st.socket != nil {
+		_, err := os.Lstat(d.socketPath)
+		socketGone = errors.Is(err, fs.ErrNotExist)
+	}
+
+	var gone []string
+	if metaGone {
+		gone = append(gone, "metadata")
+	}
+	if socketGone {
+		gone = append(gone, "socket")
+	}
+	if len(gone) == 0 {
+		return
+	}
+	what := strings.Join(gone, " and ")
+	if d.cfg.ExitOnStateLost && !reregister {
+		d.loseState("the session's " + what + " was removed")
+		return
+	}
+	fmt.Fprintf(d.log, "daemon: the session's %s was removed; putting it back\n", what)
+	if err := os.MkdirAll(filepath.Dir(d.metaPath), 0700); err != nil {
+		fmt.Fprintf(d.log, "daemon: %v\n", err)
+		return
+	}
+	// The socket goes first, so the metadata never names a session
+	// nothing answers for.
+	if socketGone {
+		info, err := d.relisten()
+		if err != nil {
+			fmt.Fprintf(d.log, "daemon: failed to listen on %s again: %v\n", d.socketPath, err)
+			return
+		}
+		st.socket = info
+	}
+	if metaGone {
+		var err error
+		if st.meta.Number != "" {
+			err = session.WriteMetadata(d.metaPath, &st.meta)
+		} else {
+			err = d.writeMetadata()
+		}
+		if err != nil {
+			fmt.Fprintf(d.log, "daemon: failed to write metadata: %v\n", err)
+			return
+		}
+		// Without it, the session could not be told from a crashed
+		// one's should the daemon die.
+		if err := session.WriteHeartbeat(session.HeartbeatPath(d.metaPath)); err != nil {
+			fmt.Fprintf(d.log, "daemon: failed to write heartbeat: %v\n", err)
+		}
+	}
+}
+
+// stateTaken returns why the session's metadata or socket belongs to
+// another session now, or "" if neither does, refreshing st's metadata as
+// it goes. Must hold stateMu.
+func (d *Daemon) stateTaken(st *stateFiles) string {
+	var meta Metadata
+	if readMetadata(d.metaPath, &meta) {
+		if meta.DaemonPID != os.Getpid() {
+			return d.metaPath + " belongs to another session now"
+		}
+		st.meta = meta
+	}
+	if st.socket != nil {
+		info, err := os.Lstat(d.socketPath)
+		if err == nil && !os.SameFile(info, st.socket) {
+			return d.socketPath + " belongs to another session now"
+		}
+	}
+	return ""
+}
+
+// checkStateTaken leaves the session's state to whatever holds its paths
+// now if that is another session, as the daemon shuts down, so cleanup
+// does not remove the other session's files.
+func (d *Daemon) checkStateTaken() {
+	d.stateMu.Lock()
+	defer d.stateMu.Unlock()
+	if d.state == nil || d.stateLost.Load() {
+		return
+	}
+	if why := d.stateTaken(d.state); why != "" {
+		d.loseState(why)
+	}
+}
+
+// relisten listens on the session's socket again, in place of the one that
+// was removed, and returns the new socket.
+func (d *Daemon) relisten() (os.FileInfo, error) {
+	if err := os.MkdirAll(filepath.Dir(d.socketPath), 0700); err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("unix", d.socketPath)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Lstat(d.socketPath)
+	if err == nil {
+		err = os.Chmod(d.socketPath, 0600)
+	}
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	// Taken as upgrade takes it, which hands the listener over.
+	d.upgradeMu.Lock()
+	defer d.upgradeMu.Unlock()
+	if d.ctx.Err() != nil {
+		listener.Close()
+		return nil, d.ctx.Err()
+	}
+	// The old socket's path is the new one's now.
+	keepSocketFile(d.listener)
+	d.listener.Close()
+	d.listener = listener
+	d.wg.Add(1)
+	d.io.Add(1)
+	go d.acceptConnections(listener, false)
+	return info, nil
+}
+
+// loseState ends the session, leaving what is in the state directory to
+// whatever put it there: the session's own files are gone, and its number
+// may be another session's by now.
+func (d *Daemon) loseState(why string) {
+	fmt.Fprintf(d.log, "daemon: %s; ending the session\n", why)
+	d.upgradeMu.Lock()
+	d.stateLost.Store(true)
+	keepSocketFile(d.listener)
+	d.upgradeMu.Unlock()
+	d.cancel()
+}
+
+// keepSocketFile has closing l leave its socket file alone.
+func keepSocketFile(l net.Listener) {
+	if ul, ok := l.(*net.UnixListener); ok {
+		ul.SetUnlinkOnClose(false)
+	}
+}
+
+// watchState returns a channel that receives once the session's metadata
+// or socket is removed, or the metadata rewritten, and a function to stop
+// watching. Where that cannot be watched the channel is nil.
+func (d *Daemon) watchState() (<-chan struct{}, func()) {
+	paths := []string{d.metaPath}
+	if d.socketPath != "" {
+		paths = append(paths, d.socketPath)
+	}
+	w, err := platform.WatchFiles(paths...)
+	if err != nil {
+		if !errors.Is(err, utils.ErrUnsupported) {
+			d.debugf("cannot watch the state directory: %v", err)
+		}
+		return nil, func() {}
+	}
+	changed := make(chan struct{}, 1)
+	go func() {
+		defer d.recoverPanic("watchState")
+		if w.Wait() == nil {
+			changed <- struct{}{}
+		}
+	}()
+	return changed, func() { w.Close() }
+}
@@ -0,0 +1,162 @@
+package daemon
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/theMichaelB/sess/internal/platform"
+	"github.com/theMichaelB/sess/internal/session"
+	"github.com/theMichaelB/sess/pkg/protocol"
+)
+
+// startWithState starts a session as startDaemonConfig does, with its
+// metadata in a directory of its own, and returns the metadata's path.
+// Without a watch on that directory the daemon does not look at it, so
+// the test is skipped there.
+func startWithState(t *testing.T, cfg Config) (*testSession, string) {
+	t.Helper()
+	if w, err := platform.WatchFiles(filepath.Join(t.TempDir(), "x")); err != nil {
+		t.Skipf("cannot watch files here: %v", err)
+	} else {
+		w.Close()
+	}
+	cfg.Command = exec.Command("cat")
+	cfg.MetaPath = filepath.Join(t.TempDir(), "state", "session-001.meta")
+	if err := os.Mkdir(filepath.Dir(cfg.MetaPath), 0700); err != nil {
+		t.Fatal(err)
+	}
+	s := startDaemonConfig(t, cfg)
+	// Once a client is in, the heartbeat is running too.
+	if msg := connect(t, s, protocol.ConnectPayload{Mode: protocol.ModePeek}); msg.Type != protocol.MsgReady {
+		t.Fatalf("connect: got %s %s", msg.Type, msg.Payload)
+	}
+	return s, cfg.MetaPath
+}
+
+func waitUntil(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// Removing the state directory from under a session has its daemon put
+// the socket and metadata back, the metadata as sess commands last left
+// it, and the session carries on.
+func TestStateDirectoryRemoved(t *testing.T) {
+	s, meta := startWithState(t, Config{})
+	c := attach(t, s)
+	waitUntil(t, "the heartbeat", func() bool {
+		_, err := os.Stat(session.HeartbeatPath(meta))
+		return err == nil
+	})
+	if err := session.UpdateMetadata(meta, func(m *session.Session) error {
+		m.Note = "kept"
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * stateSettle)
+
+	if err := os.RemoveAll(filepath.Dir(meta)); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(s.socket); err != nil {
+		t.Fatal(err)
+	}
+	waitUntil(t, "the socket and metadata to be back", func() bool {
+		_, err := os.Stat(meta)
+		return err == nil && socketAnswers(s.socket)
+	})
+	var m Metadata
+	if !readMetadata(meta, &m) || m.Note != "kept" || m.DaemonPID != os.Getpid() {
+		t.Errorf("metadata put back as %+v", m)
+	}
+	if msg := connect(t, s, protocol.ConnectPayload{Mode: protocol.ModePeek}); msg.Type != protocol.MsgReady {
+		t.Errorf("connect after: got %s %s", msg.Type, msg.Payload)
+	}
+	// The client attached all along is still served.
+	if err := c.rm.Write([]byte("still here\n")); err != nil {
+		t.Fatal(err)
+	}
+	if !c.readUntil("still here", 5*time.Second) {
+		t.Errorf("output = %q", c.out.String())
+	}
+}
+
+// With ExitOnStateLost the session ends instead, telling its client why.
+func TestStateDirectoryRemovedExits(t *testing.T) {
+	s, meta := startWithState(t, Config{ExitOnStateLost: true})
+	c := attach(t, s)
+	if err := os.RemoveAll(filepath.Dir(meta)); err != nil {
+		t.Fatal(err)
+	}
+	s.wait(t)
+	c.drain(2 * time.Second)
+	var p protocol.DetachPayload
+	if m := c.controlMessage(protocol.MsgDetach); m == nil || m.Decode(&p) != nil || p.Reason != stateLostReason {
+		t.Errorf("client told %+v; want %q", p, stateLostReason)
+	}
+	if _, err := os.Stat(filepath.Dir(meta)); !os.IsNotExist(err) {
+		t.Errorf("the state directory was made again: %v", err)
+	}
+}
+
+// A session whose number was taken by another in the meantime ends, and
+// leaves the other session's files alone.
+func TestStateTakenByAnotherSession(t *testing.T) {
+	s, meta := startWithState(t, Config{})
+	if err := os.RemoveAll(filepath.Dir(meta)); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Dir(meta), 0700); err != nil {
+		t.Fatal(err)
+	}
+	other := &Metadata{Number: "001", DaemonPID: os.Getpid() + 1}
+	if err := session.WriteMetadata(meta, other); err != nil {
+		t.Fatal(err)
+	}
+	s.wait(t)
+	var m Metadata
+	if !readMetadata(meta, &m) || m.DaemonPID != other.DaemonPID {
+		t.Errorf("the other session's metadata is now %+v", m)
+	}
+	if _, err := os.Stat(session.TombstonePath(meta)); !os.IsNotExist(err) {
+		t.Errorf("a tombstone was written over the other session's: %v", err)
+	}
+}
+
+// SIGUSR1, which sess doctor sends, has the daemon look at its state
+// again rather than killing it.
+func TestStateRecheckSignal(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "daemon.out")
+	log, err := os.Create(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	s, meta := startWithState(t, Config{Log: log})
+	waitUntil(t, "the heartbeat", func() bool {
+		_, err := os.Stat(session.HeartbeatPath(meta))
+		return err == nil
+	})
+	if err := syscall.Kill(os.Getpid(), syscall.SIGUSR1); err != nil {
+		t.Fatal(err)
+	}
+	waitUntil(t, "the daemon to look", func() bool {
+		data, _ := os.ReadFile(logPath)
+		return strings.Contains(string(data), "asked to put back")
+	})
+	if msg := connect(t, s, protocol.ConnectPayload{Mode: protocol.ModePeek}); msg.Type != protocol.MsgReady {
+		t.Errorf("connect after: got %s %s", msg.Type, msg.Payload)
+	}
+}
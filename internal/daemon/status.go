@@ -0,0 +1,67 @@
+package daemon
+
+import (
+	"os"
+	"time"
+
+	"github.com/theMichaelB/sess/internal/platform"
+	"github.com/theMichaelB/sess/pkg/protocol"
+	"golang.org/x/sys/unix"
+)
+
+// status snapshots the daemon's state for a STATUS query.
+func (d *Daemon) status() protocol.StatusPayload {
+	shared := d.shareStatus()
+	foreground := d.foregroundJob()
+	var size *unix.Winsize
+	_ = d.masterControl(func(fd int) (err error) {
+		size, err = unix.IoctlGetWinsize(fd, unix.TIOCGWINSZ)
+		return err
+	})
+	d.clientMutex.RLock()
+	defer d.clientMutex.RUnlock()
+
+	st := protocol.StatusPayload{
+		Session:    d.sessionNum,
+		PID:        os.Getpid(),
+		Clients:    make([]protocol.ClientInfo, 0, len(d.clients)),
+		LastOutput: unixNanoTime(d.lastOutput.Load()),
+		LastInput:  unixNanoTime(d.lastInput.Load()),
+		LastAttach: unixNanoTime(d.lastAttach.Load()),
+		Shared:     shared,
+		Foreground: foreground,
+		Throttled:  d.parked.Load(),
+		Stopped:    d.stopped.Load(),
+		BytesOut:   d.bytesOut.Load(),
+		Title:      d.title.Get(),
+		Cwd:        d.cwd.Get(),
+		Expires:    d.expires(),
+	}
+	if adj, err := platform.OOMScoreAdj(); err == nil {
+		st.OOMScoreAdj = adj
+	}
+	if d.scrollback != nil {
+		st.Scrollback = d.scrollback.Len()
+	}
+	if size != nil {
+		st.Rows, st.Cols = int(size.Row), int(size.Col)
+	}
+	for _, c := range d.clients {
+		info := c.info
+		info.PID = c.peerPID
+		info.ConnectedAt = c.connectedAt
+		info.LastActivity = c.lastActivity
+		info.BytesIn = c.bytesIn.Load()
+		info.BytesOut = c.bytesOut.Load()
+		st.Clients = append(st.Clients, info)
+	}
+	return st
+}
+
+// unixNanoTime converts a stored timestamp, mapping 0 to the zero time.
+func unixNanoTime(ns int64) time.Time {
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
@@ -0,0 +1,175 @@
+package daemon
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/theMichaelB/sess/internal/platform"
+)
+
+// termiosFlag is a terminal mode bit that can be turned on or off.
+type termiosFlag struct {
+	field byte // 'i', 'o' or 'l': input, output or local modes
+	bit   uint64
+}
+
+var termiosFlags = map[string]termiosFlag{
+	"ixon":    {'i', unix.IXON},
+	"ixoff":   {'i', unix.IXOFF},
+	"ixany":   {'i', unix.IXANY},
+	"icrnl":   {'i', unix.ICRNL},
+	"inlcr":   {'i', unix.INLCR},
+	"igncr":   {'i', unix.IGNCR},
+	"istrip":  {'i', unix.ISTRIP},
+	"opost":   {'o', unix.OPOST},
+	"onlcr":   {'o', unix.ONLCR},
+	"echo":    {'l', unix.ECHO},
+	"echoe":   {'l', unix.ECHOE},
+	"echok":   {'l', unix.ECHOK},
+	"echoctl": {'l', unix.ECHOCTL},
+	"icanon":  {'l', unix.ICANON},
+	"isig":    {'l', unix.ISIG},
+	"iexten":  {'l', unix.IEXTEN},
+}
+
+// termiosChars are the special characters, by their index in Cc.
+var termiosChars = map[string]int{
+	"intr":   unix.VINTR,
+	"quit":   unix.VQUIT,
+	"erase":  unix.VERASE,
+	"kill":   unix.VKILL,
+	"eof":    unix.VEOF,
+	"start":  unix.VSTART,
+	"stop":   unix.VSTOP,
+	"susp":   unix.VSUSP,
+	"werase": unix.VWERASE,
+	"lnext":  unix.VLNEXT,
+}
+
+// TermiosSetting is one terminal setting a session starts with.
+type TermiosSetting struct {
+	Key, Value string
+	on         bool // for flags
+	char       byte // for special characters
+}
+
+// Termios is a list of terminal settings applied to a session's PTY
+// before its command starts, written like "ixon=off,erase=^?".
+type Termios []TermiosSetting
+
+// ParseTermios parses comma-separated key=value terminal settings. Flags
+// (ixon, icrnl, echo, ...) take on or off; special characters (erase,
+// intr, ...) take a character, ^X for a control key, ^? for DEL, or
+// undef to disable it. Unknown keys are an error.
+func ParseTermios(spec string) (Termios, error) {
+	var t Termios
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("termios setting %q: want key=value", item)
+		}
+		s := TermiosSetting{Key: strings.ToLower(key), Value: value}
+		if _, ok := termiosFlags[s.Key]; ok {
+			switch value {
+			case "on":
+				s.on = true
+			case "off":
+			default:
+				return nil, fmt.Errorf("termios setting %q: %s is on or off", item, s.Key)
+			}
+		} else if _, ok := termiosChars[s.Key]; ok {
+			c, err := parseControlChar(value)
+			if err != nil {
+				return nil, fmt.Errorf("termios setting %q: %w", item, err)
+			}
+			s.char = c
+		} else {
+			return nil, fmt.Errorf("unknown termios setting %q (known: %s)", key, termiosKeys())
+		}
+		t = append(t, s)
+	}
+	return t, nil
+}
+
+// parseControlChar parses a special character's value as stty shows it.
+func parseControlChar(v string) (byte, error) {
+	switch {
+	case v == "undef" || v == "^-":
+		return platform.VDisable, nil
+	case v == "^?":
+		return 0x7f, nil
+	case len(v) == 2 && v[0] == '^' && v[1] >= '@' && v[1] <= '_':
+		return v[1] - '@', nil
+	case len(v) == 2 && v[0] == '^' && v[1] >= 'a' && v[1] <= 'z':
+		return v[1] - 'a' + 1, nil
+	case len(v) == 1:
+		return v[0], nil
+	}
+	return 0, fmt.Errorf("want a character, ^X, ^? or undef, not %q", v)
+}
+
+// termiosKeys lists the settings ParseTermios knows.
+func termiosKeys() string {
+	var keys []string
+	for k := range termiosFlags {
+		keys = append(keys, k)
+	}
+	for k := range termiosChars {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, ", ")
+}
+
+// String writes t as ParseTermios reads it.
+func (t Termios) String() string {
+	items := make([]string, len(t))
+	for i, s := range t {
+		items[i] = s.Key + "=" + s.Value
+	}
+	return strings.Join(items, ",")
+}
+
+// apply changes the terminal f's settings as t says, leaving the rest as
+// they are.
+func (t Termios) apply(f *os.File) error {
+	if len(t) == 0 {
+		return nil
+	}
+	fd := int(f.Fd())
+	tio, err := unix.IoctlGetTermios(fd, platform.IoctlGetTermios)
+	if err != nil {
+		return err
+	}
+	for _, s := range t {
+		if flag, ok := termiosFlags[s.Key]; ok {
+			switch flag.field {
+			case 'i':
+				tio.Iflag = setFlag(tio.Iflag, flag.bit, s.on)
+			case 'o':
+				tio.Oflag = setFlag(tio.Oflag, flag.bit, s.on)
+			case 'l':
+				tio.Lflag = setFlag(tio.Lflag, flag.bit, s.on)
+			}
+			continue
+		}
+		tio.Cc[termiosChars[s.Key]] = s.char
+	}
+	return unix.IoctlSetTermios(fd, platform.IoctlSetTermios, tio)
+}
+
+// setFlag returns flags with bit set or cleared.
+func setFlag[T uint32 | uint64](flags T, bit uint64, on bool) T {
+	if on {
+		return flags | T(bit)
+	}
+	return flags &^ T(bit)
+}
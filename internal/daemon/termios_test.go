@@ -0,0 +1,66 @@
+package daemon
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/theMichaelB/sess/internal/platform"
+)
+
+func TestParseTermios(t *testing.T) {
+	tests := []struct {
+		spec string
+		want string // as String writes it; "" with ok false for an error
+		ok   bool
+	}{
+		{"", "", true},
+		{"ixon=off,erase=^?", "ixon=off,erase=^?", true},
+		{" IXON=on , intr=^c ", "ixon=on,intr=^c", true},
+		{"erase=^H,susp=undef,eof=^-,kill=x", "erase=^H,susp=undef,eof=^-,kill=x", true},
+		{"ixon", "", false},
+		{"ixon=no", "", false},
+		{"erase=^1", "", false},
+		{"erase=ab", "", false},
+		{"baud=9600", "", false},
+	}
+	for _, tt := range tests {
+		got, err := ParseTermios(tt.spec)
+		if (err == nil) != tt.ok || got.String() != tt.want {
+			t.Errorf("ParseTermios(%q) = %q, %v; want %q, ok %v", tt.spec, got.String(), err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestParseControlChar(t *testing.T) {
+	for v, want := range map[string]byte{"^?": 0x7f, "^H": 8, "^h": 8, "^[": 0x1b, "^@": 0, "x": 'x', "undef": platform.VDisable} {
+		if got, err := parseControlChar(v); err != nil || got != want {
+			t.Errorf("parseControlChar(%q) = %#x, %v; want %#x", v, got, err, want)
+		}
+	}
+}
+
+// The command must start with the settings already in place.
+func TestTermiosAppliedBeforeCommand(t *testing.T) {
+	termios, err := ParseTermios("ixon=off,erase=^H")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := startDaemonConfig(t, Config{
+		Command: exec.Command("sh", "-c", "stty -a; sleep 5"),
+		Termios: termios,
+	})
+	c := attach(t, s)
+	if !c.readUntil("erase", 2*time.Second) {
+		t.Fatalf("no stty output; got %q", c.out.String())
+	}
+	c.drain(200 * time.Millisecond)
+	out := c.out.String()
+	if !strings.Contains(out, "-ixon") {
+		t.Errorf("ixon still on:\n%s", out)
+	}
+	if !strings.Contains(out, "erase = ^H") {
+		t.Errorf("erase is not ^H:\n%s", out)
+	}
+}
@@ -0,0 +1,71 @@
+package daemon
+
+import "time"
+
+// With ThrottleDetached, the daemon stops reading a session's output once
+// it is only being thrown away: no client is connected to see it, nothing
+// records it, and the scrollback is full, so more would only push out
+// what it holds. The kernel's terminal buffer then fills and the program
+// writing blocks, rather than the daemon copying a runaway program's output
+// to nowhere. Reading starts again as soon as a client connects.
+//
+// handlePTY only stops amid a flood, throttleBytes of output within
+// throttleWindow; a program that writes a little and waits for an answer,
+// such as a terminal query, is still read.
+const (
+	throttleBytes  = 64 << 10
+	throttleWindow = 1 * time.Second
+)
+
+// floodMeter measures the output handlePTY reads in throttleBytes steps.
+type floodMeter struct {
+	n     int
+	since time.Time
+}
+
+// add counts n bytes of output, and reports whether they complete a step
+// that took less than throttleWindow.
+func (m *floodMeter) add(n int) bool {
+	m.n += n
+	if m.n < throttleBytes {
+		return false
+	}
+	flood := time.Since(m.since) < throttleWindow
+	m.n, m.since = 0, time.Now()
+	return flood
+}
+
+// throttled reports whether handlePTY should stop reading for now.
+func (d *Daemon) throttled() bool {
+	if !d.cfg.ThrottleDetached || d.ctx.Err() != nil || d.upgrading.Load() || d.direct.Load() != nil {
+		return false
+	}
+	if list := d.clientList.Load(); list != nil && len(*list) > 0 {
+		return false
+	}
+	if d.outputLog != nil || d.script != nil {
+		return false
+	}
+	return d.scrollback == nil || d.scrollback.saturated()
+}
+
+// parkPTY waits until something may need the output: a client came or
+// went, the terminal is to be lent or the session handed over, or the
+// session is ending, when whatever is left is read out.
+func (d *Daemon) parkPTY() {
+	d.debugf("detached and nothing keeps the output; pausing reads")
+	d.parked.Store(true)
+	defer d.parked.Store(false)
+	select {
+	case <-d.ptyWake:
+	case <-d.ctx.Done():
+	}
+}
+
+// wakePTY has handlePTY check again whether to read.
+func (d *Daemon) wakePTY() {
+	select {
+	case d.ptyWake <- struct{}{}:
+	default:
+	}
+}
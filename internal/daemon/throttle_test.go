@@ -0,0 +1,36 @@
+package daemon
+
+import (
+	"os/exec"
+	"testing"
+	"time"
+)
+
+// A flood nobody sees is left unread until a client attaches.
+func TestThrottleDetached(t *testing.T) {
+	s := startDaemonConfig(t, Config{
+		Command:          exec.Command("yes"),
+		Scrollback:       1024,
+		ThrottleDetached: true,
+	})
+	deadline := time.Now().Add(5 * time.Second)
+	for !s.d.parked.Load() {
+		if time.Now().After(deadline) {
+			t.Fatal("output still read with nobody attached and the scrollback full")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	last := s.d.lastOutput.Load()
+	time.Sleep(100 * time.Millisecond)
+	if s.d.lastOutput.Load() != last {
+		t.Error("output read while throttled")
+	}
+
+	c := attach(t, s)
+	if !c.readUntil("y\r\ny\r\ny", 5*time.Second) {
+		t.Fatalf("no output after attaching; got %q", c.out.String())
+	}
+	if s.d.status().Throttled {
+		t.Error("throttled with a client attached")
+	}
+}
@@ -0,0 +1,87 @@
+package daemon
+
+import (
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/theMichaelB/sess/internal/session"
+	"github.com/theMichaelB/sess/pkg/protocol"
+)
+
+// expiredReason is what clients are told when the session's timeout ends
+// it.
+const expiredReason = "the session's timeout expired"
+
+// setDeadline has the session expire at t, or never if t is zero,
+// replacing any deadline it had.
+func (d *Daemon) setDeadline(t time.Time) {
+	d.timeoutMu.Lock()
+	defer d.timeoutMu.Unlock()
+	if d.expiry != nil {
+		d.expiry.Stop()
+		d.expiry = nil
+	}
+	d.deadline = t
+	if t.IsZero() {
+		return
+	}
+	d.expiry = time.AfterFunc(time.Until(t), d.expire)
+}
+
+// expires returns when the session expires, or nil if it does not.
+func (d *Daemon) expires() *time.Time {
+	d.timeoutMu.Lock()
+	defer d.timeoutMu.Unlock()
+	if d.deadline.IsZero() {
+		return nil
+	}
+	t := d.deadline
+	return &t
+}
+
+// expire ends the session once its deadline has passed. The command is
+// sent SIGTERM and, if still running after the grace period, SIGKILL;
+// see endCommand.
+func (d *Daemon) expire() {
+	d.timeoutMu.Lock()
+	due := !d.deadline.IsZero() && !time.Now().Before(d.deadline)
+	d.timeoutMu.Unlock()
+	if !due {
+		// Moved while the timer fired.
+		return
+	}
+	d.debugf("timeout expired; ending the session")
+	d.expired.Store(true)
+	d.cancel()
+}
+
+// expirySequence is how an expired session's command is ended: asked to
+// stop, then killed after the grace period of seq.
+func expirySequence(seq session.KillSequence) session.KillSequence {
+	return session.KillSequence{Signals: []syscall.Signal{syscall.SIGTERM, syscall.SIGKILL}, Grace: seq.Grace}
+}
+
+// handleTimeout applies a one-shot TIMEOUT request and answers with when
+// the session now expires.
+func (d *Daemon) handleTimeout(conn net.Conn, msg *protocol.Message) {
+	var req protocol.TimeoutPayload
+	if err := msg.Decode(&req); err != nil {
+		d.sendError(conn, "malformed TIMEOUT")
+		return
+	}
+	var t time.Time
+	switch {
+	case req.Extend:
+		t = time.Now()
+		if at := d.expires(); at != nil {
+			t = *at
+		}
+		t = t.Add(req.Timeout)
+	case req.Timeout > 0:
+		t = time.Now().Add(req.Timeout)
+	}
+	d.setDeadline(t)
+	d.debugf("session expires at %v", t)
+	d.sendMessage(conn, protocol.MsgTimeout, protocol.TimeoutReply{Expires: d.expires()})
+}
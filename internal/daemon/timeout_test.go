@@ -0,0 +1,99 @@
+package daemon
+
+import (
+	"bufio"
+	"net"
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/theMichaelB/sess/internal/session"
+	"github.com/theMichaelB/sess/pkg/protocol"
+)
+
+// requestTimeout sends s a TIMEOUT request and returns when the session
+// then expires.
+func requestTimeout(t *testing.T, s *testSession, req protocol.TimeoutPayload) *time.Time {
+	t.Helper()
+	conn, err := net.Dial("unix", s.socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	data, err := protocol.EncodeMessage(protocol.MsgTimeout, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	msg, err := protocol.ReadMessageFrom(bufio.NewReader(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reply protocol.TimeoutReply
+	if msg.Type != protocol.MsgTimeout || msg.Decode(&reply) != nil {
+		t.Fatalf("TIMEOUT answered %s %s", msg.Type, msg.Payload)
+	}
+	return reply.Expires
+}
+
+// A session whose timeout expires has its command ended, SIGKILL
+// following the SIGTERM it ignores, and its client told why.
+func TestTimeoutEndsSession(t *testing.T) {
+	s := startDaemonConfig(t, Config{
+		Command: exec.Command("sh", "-c", `trap "" TERM; sleep 0.2; echo started; exec sleep 30`),
+		Timeout: time.Second,
+		Kill:    session.KillSequence{Signals: []syscall.Signal{syscall.SIGHUP}, Grace: 100 * time.Millisecond},
+	})
+	c := attach(t, s)
+	if !c.readUntil("started", 5*time.Second) {
+		t.Fatalf("output = %q", c.out.String())
+	}
+	if at := s.d.status().Expires; at == nil || time.Until(*at) > time.Second {
+		t.Errorf("status expires at %v; want within a second", at)
+	}
+	s.wait(t)
+	c.drain(2 * time.Second)
+	if m := c.controlMessage(protocol.MsgDetach); m == nil {
+		t.Error("client was not told the session expired")
+	} else {
+		var p protocol.DetachPayload
+		if err := m.Decode(&p); err != nil || p.Reason != expiredReason {
+			t.Errorf("DETACH = %+v, %v; want %q", p, err, expiredReason)
+		}
+	}
+	if exit := s.d.exitInfo(); exit.Signal != "SIGKILL" {
+		t.Errorf("command ended by %+v; want SIGKILL", exit)
+	}
+}
+
+// TIMEOUT requests set, extend and remove the session's timeout.
+func TestTimeoutRequest(t *testing.T) {
+	s := startDaemonConfig(t, Config{Command: exec.Command("cat"), Timeout: time.Hour})
+	attach(t, s)
+
+	near := func(at *time.Time, want time.Duration) bool {
+		return at != nil && time.Until(*at) > want-time.Minute && time.Until(*at) <= want
+	}
+	if at := s.d.status().Expires; !near(at, time.Hour) {
+		t.Errorf("status expires at %v; want in an hour", at)
+	}
+	if at := requestTimeout(t, s, protocol.TimeoutPayload{Timeout: time.Hour, Extend: true}); !near(at, 2*time.Hour) {
+		t.Errorf("extended expiry %v; want in two hours", at)
+	}
+	if at := requestTimeout(t, s, protocol.TimeoutPayload{Timeout: 30 * time.Minute}); !near(at, 30*time.Minute) {
+		t.Errorf("expiry set to %v; want in 30 minutes", at)
+	}
+	if at := requestTimeout(t, s, protocol.TimeoutPayload{}); at != nil {
+		t.Errorf("expiry after removing the timeout %v; want none", at)
+	}
+	if at := s.d.status().Expires; at != nil {
+		t.Errorf("status expires at %v after removing the timeout", at)
+	}
+	if at := requestTimeout(t, s, protocol.TimeoutPayload{Timeout: time.Minute, Extend: true}); !near(at, time.Minute) {
+		t.Errorf("extending no timeout gives %v; want in a minute", at)
+	}
+}
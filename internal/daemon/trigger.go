@@ -0,0 +1,154 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"regexp"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/theMichaelB/sess/pkg/protocol"
+)
+
+const (
+	// triggerCooldown is how long a trigger that ran waits before it can
+	// run again, unless it sets its own.
+	triggerCooldown = 10 * time.Second
+	// triggerTimeout is how long a trigger's command may run before its
+	// process group is killed.
+	triggerTimeout = time.Minute
+)
+
+// trigger is a protocol.Trigger ready to match.
+type trigger struct {
+	protocol.Trigger
+	re *regexp.Regexp
+	// last is when the trigger last ran, in Unix nanoseconds. It is
+	// carried over when the triggers are replaced.
+	last *atomic.Int64
+}
+
+// compileTriggers prepares list for matching, keeping when the triggers
+// that are already set last ran.
+func compileTriggers(list []protocol.Trigger, old []*trigger) ([]*trigger, error) {
+	var out []*trigger
+	for _, t := range list {
+		re, err := regexp.Compile(t.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("trigger %d: %v", t.ID, err)
+		}
+		ct := &trigger{Trigger: t, re: re, last: new(atomic.Int64)}
+		for _, o := range old {
+			if o.ID == t.ID {
+				ct.last = o.last
+			}
+		}
+		out = append(out, ct)
+	}
+	return out, nil
+}
+
+// setTriggers replaces the triggers the session's output is matched
+// against.
+func (d *Daemon) setTriggers(list []protocol.Trigger) error {
+	var old []*trigger
+	if p := d.triggers.Load(); p != nil {
+		old = *p
+	}
+	ts, err := compileTriggers(list, old)
+	if err != nil {
+		return err
+	}
+	if len(ts) == 0 {
+		d.triggers.Store(nil)
+	} else {
+		d.triggers.Store(&ts)
+	}
+	return nil
+}
+
+// handleTriggers applies a one-shot TRIGGERS request and acknowledges with
+// READY.
+func (d *Daemon) handleTriggers(conn net.Conn, msg *protocol.Message) {
+	var req protocol.TriggersPayload
+	if err := msg.Decode(&req); err != nil {
+		d.sendError(conn, "malformed TRIGGERS")
+		return
+	}
+	if err := d.setTriggers(req.Triggers); err != nil {
+		d.sendError(conn, err.Error())
+		return
+	}
+	d.debugf("watching for %d triggers", len(req.Triggers))
+	d.sendMessage(conn, protocol.MsgReady, nil)
+}
+
+// restoreTriggers takes up the triggers the session's metadata lists, for
+// a daemon taking over a session.
+func (d *Daemon) restoreTriggers() {
+	var m Metadata
+	if d.metaPath == "" || !readMetadata(d.metaPath, &m) {
+		return
+	}
+	if err := d.setTriggers(m.Triggers); err != nil {
+		fmt.Fprintf(d.log, "daemon: failed to restore triggers: %v\n", err)
+	}
+}
+
+// matchTriggers runs the triggers on the lines a chunk of output
+// completes. It is called from handlePTY only, which owns d.lines.
+func (d *Daemon) matchTriggers(p []byte) {
+	ts := d.triggers.Load()
+	if ts == nil {
+		return
+	}
+	d.lines.Write(p, func(line []byte) {
+		for _, t := range *ts {
+			if t.re.Match(line) {
+				d.fireTrigger(t, line)
+			}
+		}
+	})
+}
+
+// fireTrigger runs t's command for line, unless it ran within its
+// cooldown. The command runs through the shell, in a session of its own
+// with no terminal and with the OOM score the session's command has, and
+// is killed along with whatever it started if it outlasts triggerTimeout.
+func (d *Daemon) fireTrigger(t *trigger, line []byte) {
+	cooldown := triggerCooldown
+	if t.Cooldown > 0 {
+		cooldown = time.Duration(t.Cooldown) * time.Second
+	}
+	now := time.Now()
+	if last := t.last.Load(); last != 0 && now.Sub(time.Unix(0, last)) < cooldown {
+		return
+	}
+	t.last.Store(now.UnixNano())
+
+	ctx, cancel := context.WithTimeout(context.Background(), triggerTimeout)
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", d.unprotected(t.Command))
+	cmd.Env = append(os.Environ(),
+		"SESS_NUM="+d.sessionNum,
+		"SESS_TRIGGER_PATTERN="+t.Pattern,
+		"SESS_TRIGGER_LINE="+string(line),
+	)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	cmd.Cancel = func() error { return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL) }
+	if err := cmd.Start(); err != nil {
+		cancel()
+		fmt.Fprintf(d.log, "daemon: trigger %d: %v\n", t.ID, err)
+		return
+	}
+	d.debugf("trigger %d matched %q; running pid %d", t.ID, line, cmd.Process.Pid)
+	go func() {
+		defer cancel()
+		if err := cmd.Wait(); err != nil {
+			fmt.Fprintf(d.log, "daemon: trigger %d: %v\n", t.ID, err)
+		}
+	}()
+}
@@ -0,0 +1,52 @@
+package daemon
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/theMichaelB/sess/pkg/protocol"
+)
+
+// A trigger runs once for matching output within its cooldown, with the
+// line it matched.
+func TestTrigger(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+	s := startDaemonConfig(t, Config{
+		Command: exec.Command("sh", "-c", `sleep 0.2
+printf '\033[31mBUILD\033[0m FAILED: one\n'
+printf 'BUILD FAILED: two\n'
+sleep 5`),
+	})
+	if err := s.d.setTriggers([]protocol.Trigger{{
+		ID:      1,
+		Pattern: "BUILD FAILED",
+		Command: `echo "$SESS_TRIGGER_LINE" >> ` + out,
+	}}); err != nil {
+		t.Fatal(err)
+	}
+
+	var data []byte
+	deadline := time.Now().Add(5 * time.Second)
+	for len(data) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("trigger did not run")
+		}
+		time.Sleep(10 * time.Millisecond)
+		data, _ = os.ReadFile(out)
+	}
+	time.Sleep(200 * time.Millisecond)
+	data, _ = os.ReadFile(out)
+	if got := string(data); got != "BUILD FAILED: one\n" {
+		t.Errorf("trigger wrote %q, want one run for the first line", got)
+	}
+}
+
+func TestSetTriggersInvalid(t *testing.T) {
+	d := New(Config{})
+	if err := d.setTriggers([]protocol.Trigger{{ID: 1, Pattern: "(", Command: "true"}}); err == nil {
+		t.Error("invalid pattern accepted")
+	}
+}
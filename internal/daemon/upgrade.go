@@ -0,0 +1,545 @@
+package daemon
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"github.com/theMichaelB/sess/internal/session"
+	"github.com/theMichaelB/sess/pkg/protocol"
+	"golang.org/x/sys/unix"
+)
+
+// UpgradeFormat is the revision of the state a daemon hands over when its
+// session is upgraded. A binary only takes over a session whose state is
+// in the format it reads.
+const UpgradeFormat = 1
+
+// upgradeState is what an upgrading daemon hands the binary it re-executes.
+// The descriptors it names are left open across the exec; -1 means none.
+type upgradeState struct {
+	Format   int      `json:"format"`
+	ChildPID int      `json:"child_pid"`
+	Command  []string `json:"command"`
+	PTY      int      `json:"pty"`
+	Listener int      `json:"listener"`
+	// Reply is the connection the upgrade was requested on, answered
+	// once the new binary serves the session.
+	Reply   int             `json:"reply"`
+	Clients []upgradeClient `json:"clients"`
+
+	LastOutput int64  `json:"last_output"`
+	LastInput  int64  `json:"last_input"`
+	LastAttach int64  `json:"last_attach"`
+	AltScreen  bool   `json:"alt_screen,omitempty"`
+	Title      string `json:"title,omitempty"`
+	Cwd        string `json:"cwd,omitempty"`
+	BytesOut   uint64 `json:"bytes_out"`
+	Stopped    bool   `json:"stopped,omitempty"`
+	// Expires is when the session expires, if it does.
+	Expires *time.Time `json:"expires,omitempty"`
+	// OOMInherited is the OOM score the session's command has, if the
+	// daemon's differs; see protectFromOOM.
+	OOMInherited *int `json:"oom_inherited,omitempty"`
+
+	Scrollback []byte `json:"scrollback,omitempty"`
+	Spill      int    `json:"spill"`
+	Spilled    int64  `json:"spilled"`
+	SpillErr   string `json:"spill_error,omitempty"`
+
+	OutputLog  int       `json:"output_log"`
+	InputLog   int       `json:"input_log"`
+	Typescript int       `json:"typescript"`
+	Timing     int       `json:"timing"`
+	ScriptLast time.Time `json:"script_last"`
+
+	Shared         []protocol.SharedUser `json:"shared,omitempty"`
+	SharedListener int                   `json:"shared_listener"`
+	SharedSocket   string                `json:"shared_socket,omitempty"`
+}
+
+// upgradeClient is a connected client, handed over with its connection.
+type upgradeClient struct {
+	Conn         int                 `json:"conn"`
+	Info         protocol.ClientInfo `json:"info"`
+	ConnectedAt  time.Time           `json:"connected_at"`
+	LastActivity time.Time           `json:"last_activity"`
+	PeerPID      int                 `json:"peer_pid"`
+	UID          int                 `json:"uid"`
+	Owner        bool                `json:"owner"`
+	Framed       bool                `json:"framed"`
+}
+
+// handleUpgrade hands the session over to the sess binary an UPGRADE
+// request names. The reply comes from the new binary once it serves the
+// session, or from this one if the session stayed here.
+func (d *Daemon) handleUpgrade(conn net.Conn, msg *protocol.Message) {
+	var req protocol.UpgradePayload
+	if err := msg.Decode(&req); err != nil || req.Executable == "" {
+		d.sendError(conn, "malformed UPGRADE")
+		return
+	}
+	if !canUpgrade || d.cfg.UpgradeArgs == nil {
+		d.sendError(conn, fmt.Sprintf("session %s cannot be upgraded in place", d.sessionNum))
+		return
+	}
+	if err := d.upgrade(conn, req.Executable); err != nil {
+		fmt.Fprintf(d.log, "daemon: upgrade to %s failed: %v\n", req.Executable, err)
+		d.sendError(conn, fmt.Sprintf("upgrade failed: %v", err))
+	}
+}
+
+// upgrade re-executes exe in this process to take the session over. The
+// process stays the command's parent, and the descriptors the session
+// needs stay open across the exec; the rest of its state goes in an
+// unlinked file the new binary reads. Clients stay connected and see the
+// session pause while the new binary starts. upgrade only returns if the
+// session stays with this binary, which carries on as before.
+func (d *Daemon) upgrade(conn net.Conn, exe string) error {
+	d.upgradeMu.Lock()
+	defer d.upgradeMu.Unlock()
+	select {
+	case <-d.exited:
+		return errors.New("the session has ended")
+	default:
+	}
+	if d.ctx.Err() != nil {
+		return errors.New("the session is ending")
+	}
+	if !pausable(d.listener) {
+		return errors.New("the session's listener cannot be handed over")
+	}
+
+	stateFile, err := os.CreateTemp("", fmt.Sprintf("sess-%s-upgrade-*", d.sessionNum))
+	if err != nil {
+		return err
+	}
+	os.Remove(stateFile.Name())
+	defer stateFile.Close()
+	var h handoff
+	defer h.close()
+	stateFD := h.file(stateFile)
+	if h.err != nil {
+		return h.err
+	}
+	args, err := d.cfg.UpgradeArgs(exe, stateFD)
+	if err != nil {
+		return err
+	}
+
+	if err := d.holdTerminal(); err != nil {
+		return err
+	}
+	d.pause()
+	defer d.unpause()
+	// The terminal is handed over as a new session's would be, in case
+	// the new binary does not use packet mode.
+	d.setPacketMode(false)
+	defer d.setPacketMode(true)
+	d.clientMutex.Lock()
+	defer d.clientMutex.Unlock()
+	d.shareMu.Lock()
+	defer d.shareMu.Unlock()
+
+	st := d.upgradeState(&h, conn)
+	if h.err != nil {
+		return h.err
+	}
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	if _, err := stateFile.Write(data); err != nil {
+		return err
+	}
+	// The new binary reads through a duplicate, which shares the offset.
+	if _, err := stateFile.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	d.debugf("handing session %s over to %s", d.sessionNum, exe)
+	err = syscall.Exec(exe, append([]string{exe}, args...), os.Environ())
+	return fmt.Errorf("exec %s: %w", exe, err)
+}
+
+// pausable reports whether l can be paused and handed over.
+func pausable(l net.Listener) bool {
+	_, ok := l.(interface {
+		SetDeadline(time.Time) error
+		syscall.Conn
+	})
+	return ok
+}
+
+// setListenerDeadline sets the deadline of a listener that is pausable.
+func setListenerDeadline(l net.Listener, t time.Time) {
+	if dl, ok := l.(interface{ SetDeadline(time.Time) error }); ok {
+		dl.SetDeadline(t)
+	}
+}
+
+// paused reports whether a reader stopped on err because the session is
+// being handed over, rather than because something went wrong.
+func (d *Daemon) paused(err error) bool {
+	return d.upgrading.Load() && errors.Is(err, os.ErrDeadlineExceeded)
+}
+
+// pause stops the goroutines reading the session's descriptors, so nothing
+// is read that the new binary would miss: each read is given a deadline in
+// the past, at which they stop while upgrading is set.
+func (d *Daemon) pause() {
+	d.upgrading.Store(true)
+	past := time.Unix(1, 0)
+	setListenerDeadline(d.listener, past)
+	d.ptyMaster.SetReadDeadline(past)
+	d.wakePTY()
+	// Taken in this order, as addClient does; both check upgrading
+	// before starting another reader.
+	d.clientMutex.RLock()
+	for conn := range d.clients {
+		conn.SetReadDeadline(past)
+	}
+	d.shareMu.Lock()
+	if d.sharedListener != nil {
+		setListenerDeadline(d.sharedListener, past)
+	}
+	d.shareMu.Unlock()
+	d.clientMutex.RUnlock()
+	d.io.Wait()
+}
+
+// unpause restarts what pause stopped, when the session stays here after
+// all. A session shutting down meanwhile is left stopped.
+func (d *Daemon) unpause() {
+	if d.ctx.Err() != nil {
+		d.upgrading.Store(false)
+		return
+	}
+	d.ptyMaster.SetReadDeadline(time.Time{})
+	setListenerDeadline(d.listener, time.Time{})
+	d.ptyDone = make(chan struct{})
+	d.wg.Add(2)
+	d.io.Add(2)
+	go d.acceptConnections(d.listener, false)
+	go d.handlePTY()
+
+	d.clientMutex.Lock()
+	defer d.clientMutex.Unlock()
+	d.shareMu.Lock()
+	if d.sharedListener != nil {
+		setListenerDeadline(d.sharedListener, time.Time{})
+		d.wg.Add(1)
+		d.io.Add(1)
+		go d.acceptConnections(d.sharedListener, true)
+	}
+	d.shareMu.Unlock()
+	for conn, c := range d.clients {
+		conn.SetReadDeadline(time.Time{})
+		d.io.Add(1)
+		go d.clientReadLoop(c)
+	}
+	d.upgrading.Store(false)
+}
+
+// upgradeState gathers what the new binary needs, adding the descriptors
+// to h. The session is paused, and the caller holds clientMutex and
+// shareMu.
+func (d *Daemon) upgradeState(h *handoff, reply net.Conn) *upgradeState {
+	st := &upgradeState{
+		Format:         UpgradeFormat,
+		ChildPID:       d.cmd.Process.Pid,
+		Command:        d.cmd.Args,
+		PTY:            h.file(d.ptyMaster),
+		Listener:       h.listener(d.listener),
+		Reply:          h.conn(reply),
+		LastOutput:     d.lastOutput.Load(),
+		LastInput:      d.lastInput.Load(),
+		LastAttach:     d.lastAttach.Load(),
+		AltScreen:      d.altScreen.On(),
+		Title:          d.title.Get(),
+		Cwd:            d.cwd.Get(),
+		BytesOut:       d.bytesOut.Load(),
+		Stopped:        d.stopped.Load(),
+		Expires:        d.expires(),
+		Spill:          -1,
+		OutputLog:      h.file(d.outputLog),
+		InputLog:       -1,
+		Typescript:     -1,
+		Timing:         -1,
+		SharedListener: h.listener(d.sharedListener),
+		SharedSocket:   d.sharedSocket,
+	}
+	if d.oomSet {
+		inherited := d.oomInherited
+		st.OOMInherited = &inherited
+	}
+	for _, c := range d.clients {
+		st.Clients = append(st.Clients, upgradeClient{
+			Conn:         h.conn(c.conn),
+			Info:         c.info,
+			ConnectedAt:  c.connectedAt,
+			LastActivity: c.lastActivity,
+			PeerPID:      c.peerPID,
+			UID:          c.uid,
+			Owner:        c.owner,
+			Framed:       c.framed,
+		})
+	}
+	for _, u := range d.shared {
+		st.Shared = append(st.Shared, u)
+	}
+	if s := d.scrollback; s != nil {
+		s.mu.Lock()
+		st.Scrollback = s.tail(s.size)
+		st.Spill = h.file(s.spill)
+		st.Spilled = s.spilled
+		if s.spillErr != nil {
+			st.SpillErr = s.spillErr.Error()
+		}
+		s.mu.Unlock()
+	}
+	if l := d.inputLog; l != nil {
+		l.mu.Lock()
+		st.InputLog = h.file(l.f)
+		l.mu.Unlock()
+	}
+	if r := d.script; r != nil {
+		st.Typescript = h.file(r.typescript)
+		st.Timing = h.file(r.timing)
+		st.ScriptLast = r.last
+	}
+	return st
+}
+
+// handoff collects the descriptors an upgrade leaves open across the
+// exec: duplicates of the session's own, without close-on-exec. The
+// first error making one is kept.
+type handoff struct {
+	fds []int
+	err error
+}
+
+// add duplicates c's descriptor and returns the duplicate's number.
+func (h *handoff) add(c syscall.Conn) int {
+	if h.err != nil {
+		return -1
+	}
+	rc, err := c.SyscallConn()
+	if err != nil {
+		h.err = err
+		return -1
+	}
+	fd := -1
+	cerr := rc.Control(func(f uintptr) {
+		// Above the standard descriptors, which the exec keeps anyway.
+		fd, err = unix.FcntlInt(f, unix.F_DUPFD, 3)
+	})
+	if cerr != nil {
+		err = cerr
+	}
+	if err != nil {
+		h.err = err
+		return -1
+	}
+	h.fds = append(h.fds, fd)
+	return fd
+}
+
+// file adds f's descriptor, or returns -1 if f is nil.
+func (h *handoff) file(f *os.File) int {
+	if f == nil {
+		return -1
+	}
+	return h.add(f)
+}
+
+// conn adds c's descriptor.
+func (h *handoff) conn(c net.Conn) int {
+	sc, ok := c.(syscall.Conn)
+	if !ok {
+		if h.err == nil {
+			h.err = fmt.Errorf("cannot hand over a %T", c)
+		}
+		return -1
+	}
+	return h.add(sc)
+}
+
+// listener adds l's descriptor, or returns -1 if l is nil.
+func (h *handoff) listener(l net.Listener) int {
+	if l == nil {
+		return -1
+	}
+	sc, ok := l.(syscall.Conn)
+	if !ok {
+		if h.err == nil {
+			h.err = fmt.Errorf("cannot hand over a %T", l)
+		}
+		return -1
+	}
+	return h.add(sc)
+}
+
+// close closes the duplicates, once the exec has failed.
+func (h *handoff) close() {
+	for _, fd := range h.fds {
+		unix.Close(fd)
+	}
+	h.fds = nil
+}
+
+// resume takes over the session whose state an upgrading daemon left in f,
+// with the descriptors it names open.
+func (d *Daemon) resume(f *os.File) error {
+	var st upgradeState
+	err := json.NewDecoder(f).Decode(&st)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("reading the session's state: %w", err)
+	}
+	if st.Format != UpgradeFormat {
+		return fmt.Errorf("the session's state is in format %d, not %d", st.Format, UpgradeFormat)
+	}
+
+	if d.ptyMaster, err = pollable(inheritedFile(st.PTY, "ptmx")); err != nil {
+		return err
+	}
+	d.startPacketMode(d.ptyMaster)
+	d.stopped.Store(st.Stopped)
+	if st.Expires != nil {
+		d.setDeadline(*st.Expires)
+	}
+	if st.OOMInherited != nil {
+		d.oomSet, d.oomInherited = true, *st.OOMInherited
+	}
+	proc, err := os.FindProcess(st.ChildPID)
+	if err != nil {
+		return err
+	}
+	d.cmd = &exec.Cmd{Path: st.Command[0], Args: st.Command, Process: proc}
+	go d.waitChild()
+	if d.listener, err = inheritedListener(st.Listener); err != nil {
+		return err
+	}
+
+	spill := inheritedFile(st.Spill, "scrollback-spill")
+	if d.cfg.Scrollback > 0 || spill != nil {
+		d.scrollback = newScrollback(max(d.cfg.Scrollback, 0), spill)
+		d.scrollback.spilled = st.Spilled
+		if st.SpillErr != "" {
+			d.scrollback.spillErr = errors.New(st.SpillErr)
+		}
+		d.scrollback.Write(st.Scrollback)
+	}
+	d.outputLog = inheritedFile(st.OutputLog, d.cfg.OutputLog)
+	if d.cfg.InputLog != "" {
+		d.inputLog = &inputLog{f: inheritedFile(st.InputLog, d.cfg.InputLog)}
+	}
+	if st.Typescript >= 0 {
+		d.script = &scriptRecorder{
+			typescript: inheritedFile(st.Typescript, d.cfg.ScriptTypescript),
+			timing:     inheritedFile(st.Timing, d.cfg.ScriptTiming),
+			last:       st.ScriptLast,
+		}
+	}
+	d.lastOutput.Store(st.LastOutput)
+	d.lastInput.Store(st.LastInput)
+	d.lastAttach.Store(st.LastAttach)
+	d.altScreen.Set(st.AltScreen)
+	d.title.Set(st.Title)
+	d.cwd.Set(st.Cwd)
+	d.bytesOut.Store(st.BytesOut)
+
+	for _, u := range st.Shared {
+		d.shared[u.UID] = u
+	}
+	if st.SharedListener >= 0 {
+		if d.sharedListener, err = inheritedListener(st.SharedListener); err != nil {
+			return err
+		}
+		d.sharedSocket = st.SharedSocket
+		d.wg.Add(1)
+		d.io.Add(1)
+		go d.acceptConnections(d.sharedListener, true)
+	}
+
+	d.clientMutex.Lock()
+	for _, uc := range st.Clients {
+		conn, err := inheritedConn(uc.Conn)
+		if err != nil {
+			fmt.Fprintf(d.log, "daemon: lost a %s client in the upgrade: %v\n", uc.Info.Mode, err)
+			continue
+		}
+		c := &client{
+			conn:         conn,
+			reader:       bufio.NewReader(conn),
+			info:         uc.Info,
+			connectedAt:  uc.ConnectedAt,
+			peerPID:      uc.PeerPID,
+			uid:          uc.UID,
+			owner:        uc.Owner,
+			lastActivity: uc.LastActivity,
+			framed:       uc.Framed,
+		}
+		d.clients[conn] = c
+		d.io.Add(1)
+		go d.clientReadLoop(c)
+	}
+	d.refreshClientList()
+	d.clientMutex.Unlock()
+
+	if err := d.recordVersion(); err != nil {
+		fmt.Fprintf(d.log, "daemon: failed to record the new version: %v\n", err)
+	}
+	d.restoreTriggers()
+	if reply, err := inheritedConn(st.Reply); err == nil {
+		d.sendMessage(reply, protocol.MsgReady, d.readyPayload())
+		reply.Close()
+	}
+	d.debugf("took over session %s (pid %d, %d clients)", d.sessionNum, st.ChildPID, len(st.Clients))
+	return nil
+}
+
+// recordVersion updates the session's metadata to name the binary that
+// serves it now.
+func (d *Daemon) recordVersion() error {
+	if d.metaPath == "" {
+		return nil
+	}
+	var m Metadata
+	if !readMetadata(d.metaPath, &m) {
+		return errors.New("cannot read the session's metadata")
+	}
+	m.Version = d.cfg.Version
+	return session.WriteMetadata(d.metaPath, &m)
+}
+
+// inheritedFile returns a descriptor an upgrade left open as a file, or nil
+// for -1. It is made close-on-exec again.
+func inheritedFile(fd int, name string) *os.File {
+	if fd < 0 {
+		return nil
+	}
+	unix.CloseOnExec(fd)
+	return os.NewFile(uintptr(fd), name)
+}
+
+// inheritedListener returns a listening socket an upgrade left open.
+func inheritedListener(fd int) (net.Listener, error) {
+	f := inheritedFile(fd, "listener")
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+// inheritedConn returns a connection an upgrade left open.
+func inheritedConn(fd int) (net.Conn, error) {
+	f := inheritedFile(fd, "conn")
+	defer f.Close()
+	return net.FileConn(f)
+}
@@ -0,0 +1,14 @@
+package daemon
+
+import "golang.org/x/sys/unix"
+
+// canUpgrade is set where waitChild can wait for the command to exit
+// without reaping it, which upgrading relies on.
+const canUpgrade = true
+
+// awaitExit blocks until the child pid has exited, leaving it to be reaped.
+func awaitExit(pid int) {
+	var info unix.Siginfo
+	for unix.Waitid(unix.P_PID, pid, &info, unix.WEXITED|unix.WNOWAIT, nil) == unix.EINTR {
+	}
+}
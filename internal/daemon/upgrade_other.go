@@ -0,0 +1,9 @@
+//go:build !linux
+
+package daemon
+
+// canUpgrade is unset: sessions are not upgraded in place on this platform.
+const canUpgrade = false
+
+// awaitExit returns at once; waitChild reaps the child when it exits.
+func awaitExit(pid int) {}
@@ -0,0 +1,76 @@
+package daemon
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/theMichaelB/sess/pkg/protocol"
+)
+
+// requestUpgrade asks s to upgrade to exe and returns the reply.
+func requestUpgrade(t *testing.T, s *testSession, exe string) *protocol.Message {
+	t.Helper()
+	conn, err := net.Dial("unix", s.socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	req, err := protocol.EncodeMessage(protocol.MsgUpgrade, protocol.UpgradePayload{Executable: exe})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	msg, err := protocol.ReadMessageFrom(bufio.NewReader(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+// An upgrade that fails, before or at the exec, leaves the session as it
+// was, its client still attached and relaying.
+func TestFailedUpgradeCarriesOn(t *testing.T) {
+	if !canUpgrade {
+		t.Skip("sessions are upgraded in place on Linux only")
+	}
+	s := startDaemonConfig(t, Config{
+		Command: exec.Command("cat"),
+		UpgradeArgs: func(exe string, fd int) ([]string, error) {
+			if strings.HasSuffix(exe, "old") {
+				return nil, errors.New("too old")
+			}
+			return nil, nil
+		},
+	})
+	c := attach(t, s)
+
+	for _, tc := range []struct{ exe, want string }{
+		{"/nonexistent/old", "too old"},
+		{"/nonexistent/sess", "no such file"},
+	} {
+		msg := requestUpgrade(t, s, tc.exe)
+		var e protocol.ErrorPayload
+		if msg.Type != protocol.MsgError || msg.Decode(&e) != nil || !strings.Contains(e.Message, tc.want) {
+			t.Fatalf("upgrade to %s answered %s %s; want an error saying %q", tc.exe, msg.Type, msg.Payload, tc.want)
+		}
+
+		line := "still here after " + tc.exe + "\n"
+		if err := c.rm.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+		if !c.readUntil(line[:len(line)-1], 5*time.Second) {
+			t.Fatalf("session stopped relaying after a failed upgrade; output %q", c.out.String())
+		}
+	}
+	if st := s.d.status(); len(st.Clients) != 1 {
+		t.Errorf("%d clients after failed upgrades; want the one attached", len(st.Clients))
+	}
+}
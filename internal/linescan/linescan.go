@@ -0,0 +1,106 @@
+// Package linescan turns what a program writes to its terminal into lines
+// of plain text, for matching patterns against: escape sequences (CSI, OSC
+// and two-byte ones) and other control characters are taken out, tabs
+// become spaces, and lines end at newlines. Sequences and lines split
+// across the chunks output arrives in are put back together.
+package linescan
+
+import "bytes"
+
+// MaxLine bounds the line a Scanner keeps; a longer one is handed over in
+// pieces of this size.
+const MaxLine = 4096
+
+// A Scanner splits output into lines. Its zero value is ready to use.
+type Scanner struct {
+	state byte
+	line  []byte
+}
+
+const (
+	textPlain = iota
+	textEscape
+	textCSI
+	textOSC
+	textOSCEscape // ESC within an OSC, which ST ends
+)
+
+// Write scans p, calling emit with each line it completes, without its
+// newline. emit must not keep the line.
+func (s *Scanner) Write(p []byte, emit func(line []byte)) {
+	for len(p) > 0 {
+		if s.state == textPlain {
+			// Copy the run of printable text up to the next control
+			// character at once.
+			i := bytes.IndexFunc(p, func(r rune) bool { return r < 0x20 || r == 0x7f })
+			if i < 0 {
+				i = len(p)
+			}
+			s.add(p[:i], emit)
+			p = p[i:]
+			if len(p) == 0 {
+				return
+			}
+		}
+		b := p[0]
+		p = p[1:]
+		switch s.state {
+		case textPlain:
+			switch b {
+			case '\n':
+				emit(s.line)
+				s.line = s.line[:0]
+			case '\t':
+				s.add([]byte{' '}, emit)
+			case 0x1b:
+				s.state = textEscape
+			}
+		case textEscape:
+			switch b {
+			case '[':
+				s.state = textCSI
+			case ']', 'P', '_', '^': // OSC, and strings ended the same way
+				s.state = textOSC
+			default:
+				s.state = textPlain
+			}
+		case textCSI:
+			if b >= 0x40 && b <= 0x7e {
+				s.state = textPlain
+			}
+		case textOSC:
+			switch b {
+			case 0x07:
+				s.state = textPlain
+			case 0x1b:
+				s.state = textOSCEscape
+			}
+		case textOSCEscape:
+			if b == '\\' {
+				s.state = textPlain
+			} else {
+				s.state = textOSC
+			}
+		}
+	}
+}
+
+// Pending returns the text of the line the output has got to, which no
+// newline has ended yet, such as a prompt. It is valid until the next
+// Write.
+func (s *Scanner) Pending() []byte {
+	return s.line
+}
+
+// add appends text to the line, handing over a line grown to MaxLine.
+func (s *Scanner) add(text []byte, emit func(line []byte)) {
+	for len(text) > 0 {
+		n := min(len(text), MaxLine-len(s.line))
+		s.line = append(s.line, text[:n]...)
+		text = text[n:]
+		if len(s.line) == MaxLine {
+			emit(s.line)
+			s.line = s.line[:0]
+		}
+	}
+}
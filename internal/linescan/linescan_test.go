@@ -0,0 +1,55 @@
+package linescan
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLineScanner(t *testing.T) {
+	long := strings.Repeat("x", MaxLine+10)
+	tests := []struct {
+		name   string
+		chunks []string
+		want   []string
+	}{
+		{"plain", []string{"one\ntwo\n"}, []string{"one", "two"}},
+		{"carriage return", []string{"one\r\n"}, []string{"one"}},
+		{"tab", []string{"a\tb\n"}, []string{"a b"}},
+		{"csi", []string{"\x1b[1;31mBUILD\x1b[0m FAILED\n"}, []string{"BUILD FAILED"}},
+		{"split line", []string{"BUILD F", "AILED\n"}, []string{"BUILD FAILED"}},
+		{"split escape", []string{"BUILD\x1b[", "1m FAILED\n"}, []string{"BUILD FAILED"}},
+		{"osc bel", []string{"\x1b]0;title\x07ok\n"}, []string{"ok"}},
+		{"osc st", []string{"\x1b]0;ti", "tle\x1b", "\\ok\n"}, []string{"ok"}},
+		{"two-byte escape", []string{"\x1b=ok\n"}, []string{"ok"}},
+		{"long line", []string{long + "\n"}, []string{long[:MaxLine], long[MaxLine:]}},
+		{"unfinished", []string{"one\ntwo"}, []string{"one"}},
+		{"unfinished escape", []string{"one\x1b[3"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var s Scanner
+			var got []string
+			for _, c := range tt.chunks {
+				s.Write([]byte(c), func(line []byte) { got = append(got, string(line)) })
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPending(t *testing.T) {
+	var s Scanner
+	emit := func([]byte) {}
+	s.Write([]byte("done\n\x1b[1mPass"), emit)
+	s.Write([]byte("word\x1b[0m: "), emit)
+	if got := string(s.Pending()); got != "Password: " {
+		t.Errorf("Pending = %q, want %q", got, "Password: ")
+	}
+	s.Write([]byte("\n"), emit)
+	if got := s.Pending(); len(got) != 0 {
+		t.Errorf("Pending = %q after the line ended", got)
+	}
+}
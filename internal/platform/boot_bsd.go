@@ -0,0 +1,19 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+
+package platform
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// BootID returns a string that identifies the current boot of the
+// machine and changes when it reboots: the boot time, to the microsecond.
+func BootID() (string, error) {
+	tv, err := unix.SysctlTimeval("kern.boottime")
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d.%06d", tv.Sec, tv.Usec), nil
+}
@@ -0,0 +1,16 @@
+package platform
+
+import (
+	"os"
+	"strings"
+)
+
+// BootID returns a string that identifies the current boot of the
+// machine and changes when it reboots.
+func BootID() (string, error) {
+	data, err := os.ReadFile("/proc/sys/kernel/random/boot_id")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
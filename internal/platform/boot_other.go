@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+
+package platform
+
+import "github.com/theMichaelB/sess/internal/utils"
+
+// BootID returns utils.ErrUnsupported.
+func BootID() (string, error) {
+	return "", utils.ErrUnsupported
+}
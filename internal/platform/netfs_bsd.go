@@ -0,0 +1,20 @@
+//go:build darwin || dragonfly || freebsd
+
+package platform
+
+import "golang.org/x/sys/unix"
+
+// NetworkFS reports whether path is on a filesystem served over the
+// network, such as NFS, which other machines may see too. It reports
+// false when that cannot be told.
+func NetworkFS(path string) bool {
+	var st unix.Statfs_t
+	if unix.Statfs(path, &st) != nil {
+		return false
+	}
+	switch unix.ByteSliceToString(st.Fstypename[:]) {
+	case "nfs", "smbfs", "afpfs", "webdav":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,32 @@
+package platform
+
+import "golang.org/x/sys/unix"
+
+// networkMagics are the statfs(2) magic numbers of filesystems served over
+// the network.
+var networkMagics = []uint32{
+	unix.NFS_SUPER_MAGIC,
+	unix.SMB_SUPER_MAGIC,
+	unix.SMB2_SUPER_MAGIC,
+	unix.CIFS_SUPER_MAGIC,
+	unix.AFS_SUPER_MAGIC,
+	unix.CEPH_SUPER_MAGIC,
+	unix.CODA_SUPER_MAGIC,
+	unix.V9FS_MAGIC,
+}
+
+// NetworkFS reports whether path is on a filesystem served over the
+// network, such as NFS, which other machines may see too. It reports
+// false when that cannot be told.
+func NetworkFS(path string) bool {
+	var st unix.Statfs_t
+	if unix.Statfs(path, &st) != nil {
+		return false
+	}
+	for _, magic := range networkMagics {
+		if uint32(st.Type) == magic {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !openbsd
+
+package platform
+
+// NetworkFS reports whether path is on a filesystem served over the
+// network. It cannot be told here, so it reports false.
+func NetworkFS(path string) bool {
+	return false
+}
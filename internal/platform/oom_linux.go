@@ -0,0 +1,67 @@
+package platform
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// OOMScoreAdjSupported reports whether SetOOMScoreAdj can steer the
+// kernel's OOM killer.
+const OOMScoreAdjSupported = true
+
+// SetOOMScoreAdj sets this process's oom_score_adj, from -1000 (never
+// picked by the OOM killer) to 1000 (picked first). Processes it starts
+// afterwards inherit it. Lowering it below where a privileged process
+// last left it takes CAP_SYS_RESOURCE.
+func SetOOMScoreAdj(adj int) error {
+	return os.WriteFile("/proc/self/oom_score_adj", []byte(strconv.Itoa(adj)), 0)
+}
+
+// OOMScoreAdj returns this process's oom_score_adj.
+func OOMScoreAdj() (int, error) {
+	data, err := os.ReadFile("/proc/self/oom_score_adj")
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+// OOMKilled reports whether the kernel log says the OOM killer killed pid
+// since boot. It is best effort: reading the log may be restricted
+// (kernel.dmesg_restrict), and old messages may have been overwritten.
+func OOMKilled(pid int) bool {
+	fd, err := unix.Open("/dev/kmsg", unix.O_RDONLY|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return false
+	}
+	defer unix.Close(fd)
+
+	// "Out of memory: Killed process 1234 (sess) ..." and, on newer
+	// kernels, "oom-kill:constraint=...,pid=1234,...".
+	killed := []byte(fmt.Sprintf("Killed process %d (", pid))
+	task := []byte(fmt.Sprintf(",pid=%d,", pid))
+	buf := make([]byte, 8192)
+	for {
+		// Each read returns one record.
+		n, err := unix.Read(fd, buf)
+		if err == unix.EPIPE {
+			// The record was overwritten while being read.
+			continue
+		}
+		if err != nil || n <= 0 {
+			return false
+		}
+		record := buf[:n]
+		if i := bytes.IndexByte(record, ';'); i >= 0 {
+			record = record[i+1:]
+		}
+		if bytes.Contains(record, killed) || (bytes.HasPrefix(record, []byte("oom-kill:")) && bytes.Contains(record, task)) {
+			return true
+		}
+	}
+}
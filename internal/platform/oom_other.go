@@ -0,0 +1,24 @@
+//go:build !linux
+
+package platform
+
+import "github.com/theMichaelB/sess/internal/utils"
+
+// OOMScoreAdjSupported reports whether SetOOMScoreAdj can steer the
+// kernel's OOM killer.
+const OOMScoreAdjSupported = false
+
+// SetOOMScoreAdj returns utils.ErrUnsupported.
+func SetOOMScoreAdj(adj int) error {
+	return utils.ErrUnsupported
+}
+
+// OOMScoreAdj returns utils.ErrUnsupported.
+func OOMScoreAdj() (int, error) {
+	return 0, utils.ErrUnsupported
+}
+
+// OOMKilled reports false: there is no kernel log to ask.
+func OOMKilled(pid int) bool {
+	return false
+}
@@ -0,0 +1,25 @@
+package platform
+
+import "golang.org/x/sys/unix"
+
+// Status bits a PTY master in packet mode starts each read with, the same
+// on every system that has it. A read with any of them set carries no
+// data.
+const (
+	PacketFlushRead  = 0x01 // the terminal discarded its unread input
+	PacketFlushWrite = 0x02 // the terminal discarded its unwritten output
+	PacketStop       = 0x04 // output was stopped, as by Ctrl-S
+	PacketStart      = 0x08 // output was started again, as by Ctrl-Q
+)
+
+// SetPacketMode turns packet mode (TIOCPKT) on the PTY master fd on or
+// off. In packet mode each read of the master starts with a status byte:
+// zero before the terminal's output, otherwise the Packet bits for what
+// happened to it.
+func SetPacketMode(fd int, on bool) error {
+	v := 0
+	if on {
+		v = 1
+	}
+	return unix.IoctlSetPointerInt(fd, unix.TIOCPKT, v)
+}
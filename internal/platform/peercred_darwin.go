@@ -0,0 +1,27 @@
+package platform
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// PeerCredSupported reports whether PeerCred can tell who is on the other
+// end of a connection.
+const PeerCredSupported = true
+
+// PeerCred returns the PID and UID of the process on the other end of a
+// unix socket connection, from LOCAL_PEERPID and LOCAL_PEERCRED. The PID
+// is 0 and the UID -1 if they can't be determined.
+func PeerCred(conn net.Conn) (pid, uid int) {
+	pid, uid = 0, -1
+	control(conn, func(fd int) {
+		if cred, err := unix.GetsockoptXucred(fd, unix.SOL_LOCAL, unix.LOCAL_PEERCRED); err == nil {
+			uid = int(cred.Uid)
+		}
+		if p, err := unix.GetsockoptInt(fd, unix.SOL_LOCAL, unix.LOCAL_PEERPID); err == nil {
+			pid = p
+		}
+	})
+	return pid, uid
+}
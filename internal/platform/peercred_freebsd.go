@@ -0,0 +1,24 @@
+package platform
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// PeerCredSupported reports whether PeerCred can tell who is on the other
+// end of a connection.
+const PeerCredSupported = true
+
+// PeerCred returns the PID and UID of the process on the other end of a
+// unix socket connection. LOCAL_PEERCRED gives the UID only, so the PID is
+// 0; the UID is -1 if it can't be determined.
+func PeerCred(conn net.Conn) (pid, uid int) {
+	uid = -1
+	control(conn, func(fd int) {
+		if cred, err := unix.GetsockoptXucred(fd, unix.SOL_LOCAL, unix.LOCAL_PEERCRED); err == nil {
+			uid = int(cred.Uid)
+		}
+	})
+	return 0, uid
+}
@@ -0,0 +1,24 @@
+package platform
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// PeerCredSupported reports whether PeerCred can tell who is on the other
+// end of a connection.
+const PeerCredSupported = true
+
+// PeerCred returns the PID and UID of the process on the other end of a
+// unix socket connection. The PID is 0 and the UID -1 if they can't be
+// determined.
+func PeerCred(conn net.Conn) (pid, uid int) {
+	pid, uid = 0, -1
+	control(conn, func(fd int) {
+		if cred, err := unix.GetsockoptUcred(fd, unix.SOL_SOCKET, unix.SO_PEERCRED); err == nil {
+			pid, uid = int(cred.Pid), int(cred.Uid)
+		}
+	})
+	return pid, uid
+}
@@ -0,0 +1,36 @@
+// Package platform holds what sess does differently from one operating
+// system to another: the terminal attribute ioctls, who is on the other end
+// of a unix socket, and inspecting other processes. Linux has all of it;
+// macOS asks the kernel through sysctl and proc_info(2) for all but other
+// processes' CPU and memory use. Elsewhere the process inspection that
+// needs /proc returns utils.ErrUnsupported, and callers show what they can
+// without it.
+//
+// Starting the session's command needs no shim: Go's SysProcAttr takes
+// Ctty as a descriptor in the child on every unix, and the BSDs make it the
+// controlling terminal with TIOCSCTTY as Linux does.
+package platform
+
+import (
+	"errors"
+	"syscall"
+)
+
+// ProcStat is the part of a process's kernel statistics that resource
+// reporting needs.
+type ProcStat struct {
+	PPID     int
+	CPUTicks uint64 // user and system time, in ClockTicks
+	RSSPages uint64
+}
+
+// ProcessAlive reports whether pid exists. A process of another user, which
+// may not be signalled, still counts.
+func ProcessAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// RlimInfinity stands for no limit in Setrlimit and Getrlimit, whatever
+// the system calls it.
+const RlimInfinity = ^uint64(0)
@@ -0,0 +1,79 @@
+package platform
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/theMichaelB/sess/internal/utils"
+)
+
+func TestProcess(t *testing.T) {
+	pid := os.Getpid()
+	if !ProcessAlive(pid) || ProcessZombie(pid) {
+		t.Error("ProcessAlive or ProcessZombie is wrong about this process")
+	}
+	// PID 1 belongs to root, and may not be signalled by others.
+	if !ProcessAlive(1) {
+		t.Error("ProcessAlive(1) = false")
+	}
+
+	wd, _ := os.Getwd()
+	if cwd, err := ProcessCwd(pid); !errors.Is(err, utils.ErrUnsupported) && (err != nil || cwd != wd) {
+		t.Errorf("ProcessCwd = %q, %v; want %q", cwd, err, wd)
+	}
+	if cmd, err := ProcessCommand(pid); !errors.Is(err, utils.ErrUnsupported) && (err != nil || !strings.Contains(cmd, filepath.Base(os.Args[0]))) {
+		t.Errorf("ProcessCommand = %q, %v; want this test binary", cmd, err)
+	}
+	if env, err := ProcessEnv(pid); !errors.Is(err, utils.ErrUnsupported) && (err != nil || len(env) == 0) {
+		t.Errorf("ProcessEnv = %d entries, %v", len(env), err)
+	}
+	if start, err := ProcessStartTime(pid); !errors.Is(err, utils.ErrUnsupported) && (err != nil || time.Since(start) > time.Hour || time.Until(start) > 2*time.Second) {
+		t.Errorf("ProcessStartTime = %v, %v; want about now", start, err)
+	}
+
+	stats, err := ReadProcStats()
+	if errors.Is(err, utils.ErrUnsupported) {
+		return
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st, ok := stats[pid]; !ok || st.PPID != os.Getppid() || st.RSSPages == 0 {
+		t.Errorf("ReadProcStats has %+v for this process", st)
+	}
+}
+
+func TestPeerCred(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "s.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	c, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	pid, uid := PeerCred(conn)
+	if !PeerCredSupported {
+		if pid != 0 || uid != -1 {
+			t.Errorf("PeerCred = %d, %d; want 0, -1", pid, uid)
+		}
+		return
+	}
+	if uid != os.Getuid() || (pid != 0 && pid != os.Getpid()) {
+		t.Errorf("PeerCred = %d, %d; want %d, %d", pid, uid, os.Getpid(), os.Getuid())
+	}
+}
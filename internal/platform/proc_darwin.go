@@ -0,0 +1,157 @@
+package platform
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/theMichaelB/sess/internal/utils"
+	"golang.org/x/sys/unix"
+)
+
+// ClockTicks is the unit of ProcStat's CPU times.
+const ClockTicks = 100
+
+// sZomb is the process state of a zombie, SZOMB in <sys/proc.h>.
+const sZomb = 5
+
+// proc_info(2) call and flavor for a process's current and root
+// directories, from <sys/proc_info.h>.
+const (
+	procInfoCallPIDInfo  = 2
+	procPIDVnodePathInfo = 9
+	// vnodeInfoSize is the size of the struct vnode_info that comes
+	// before each path in struct proc_vnodepathinfo.
+	vnodeInfoSize = 152
+)
+
+// ProcessCwd returns the current working directory of pid, as libproc's
+// proc_pidinfo(PROC_PIDVNODEPATHINFO) does.
+func ProcessCwd(pid int) (string, error) {
+	// struct proc_vnodepathinfo: the current directory, then the root,
+	// each a vnode_info followed by a MAXPATHLEN path.
+	var buf [2 * (vnodeInfoSize + unix.PathMax)]byte
+	n, _, errno := syscall.Syscall6(unix.SYS_PROC_INFO, procInfoCallPIDInfo, uintptr(pid), procPIDVnodePathInfo, 0,
+		uintptr(unsafe.Pointer(&buf[0])), uintptr(len(buf)))
+	if errno != 0 {
+		return "", errno
+	}
+	if int(n) < vnodeInfoSize+unix.PathMax {
+		return "", errors.New("short proc_info reply")
+	}
+	return cString(buf[vnodeInfoSize : vnodeInfoSize+unix.PathMax]), nil
+}
+
+// procArgs returns pid's arguments and environment from kern.procargs2,
+// which the kernel gives for the caller's own processes: argc, the
+// executable's path, then the arguments and environment, each ended by a
+// NUL.
+func procArgs(pid int) (argv, env []string, err error) {
+	data, err := unix.SysctlRaw("kern.procargs2", pid)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(data) < 4 {
+		return nil, nil, errors.New("short kern.procargs2 reply")
+	}
+	argc := int(binary.LittleEndian.Uint32(data))
+	data = data[4:]
+	// The executable's path is padded with NULs.
+	if i := bytes.IndexByte(data, 0); i >= 0 {
+		data = bytes.TrimLeft(data[i:], "\x00")
+	}
+	for _, s := range bytes.Split(data, []byte{0}) {
+		switch {
+		case len(argv) < argc:
+			argv = append(argv, string(s))
+		case len(s) == 0:
+			return argv, env, nil
+		default:
+			env = append(env, string(s))
+		}
+	}
+	return argv, env, nil
+}
+
+// ProcessEnv returns the environment of pid as KEY=VALUE entries.
+func ProcessEnv(pid int) ([]string, error) {
+	_, env, err := procArgs(pid)
+	return env, err
+}
+
+// ProcessCommand returns pid's command line, its arguments joined by
+// spaces.
+func ProcessCommand(pid int) (string, error) {
+	argv, _, err := procArgs(pid)
+	if err != nil {
+		return "", err
+	}
+	return strings.Join(argv, " "), nil
+}
+
+// ProcessArgs returns pid's arguments, the program first.
+func ProcessArgs(pid int) ([]string, error) {
+	argv, _, err := procArgs(pid)
+	return argv, err
+}
+
+// Processes returns the PIDs of this user's processes; kern.procargs2
+// gives the arguments of no others.
+func Processes() ([]int, error) {
+	procs, err := unix.SysctlKinfoProcSlice("kern.proc.uid", unix.Getuid())
+	if err != nil {
+		return nil, err
+	}
+	pids := make([]int, len(procs))
+	for i := range procs {
+		pids[i] = int(procs[i].Proc.P_pid)
+	}
+	return pids, nil
+}
+
+// ProcessZombie reports whether pid has exited but is still waiting to be
+// reaped, as a daemon orphaned to a slow launchd can for a while.
+func ProcessZombie(pid int) bool {
+	kp, err := unix.SysctlKinfoProc("kern.proc.pid", pid)
+	return err == nil && kp.Proc.P_pid == int32(pid) && kp.Proc.P_stat == sZomb
+}
+
+// ProcessStartTime returns when pid started.
+func ProcessStartTime(pid int) (time.Time, error) {
+	kp, err := unix.SysctlKinfoProc("kern.proc.pid", pid)
+	if err != nil {
+		return time.Time{}, err
+	}
+	// A PID that is not in use gives a zeroed record.
+	if kp.Proc.P_pid != int32(pid) {
+		return time.Time{}, syscall.ESRCH
+	}
+	return time.Unix(kp.Proc.P_starttime.Unix()), nil
+}
+
+// ReadProcStats returns utils.ErrUnsupported: the CPU and memory use of
+// other processes need task_info, which takes a Mach port.
+func ReadProcStats() (map[int]ProcStat, error) {
+	return nil, utils.ErrUnsupported
+}
+
+// TTYName returns the name of the terminal open on fd in this process.
+func TTYName(fd uintptr) (string, error) {
+	var buf [unix.PathMax]byte
+	if _, _, errno := syscall.Syscall(unix.SYS_FCNTL, fd, unix.F_GETPATH, uintptr(unsafe.Pointer(&buf[0]))); errno != 0 {
+		return "", errno
+	}
+	return cString(buf[:]), nil
+}
+
+// cString returns the NUL-terminated string at the start of b.
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
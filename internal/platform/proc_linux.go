@@ -0,0 +1,164 @@
+package platform
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ClockTicks is the kernel's USER_HZ, the unit of CPU times in /proc. It is
+// 100 on every Linux architecture sess runs on.
+const ClockTicks = 100
+
+// ProcessCwd returns the current working directory of pid.
+func ProcessCwd(pid int) (string, error) {
+	return os.Readlink(fmt.Sprintf("/proc/%d/cwd", pid))
+}
+
+// ProcessEnv returns the environment of pid as KEY=VALUE entries.
+func ProcessEnv(pid int) ([]string, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/environ", pid))
+	if err != nil {
+		return nil, err
+	}
+
+	var env []string
+	for _, entry := range bytes.Split(data, []byte{0}) {
+		if len(entry) > 0 {
+			env = append(env, string(entry))
+		}
+	}
+	return env, nil
+}
+
+// ProcessZombie reports whether pid has exited but is still waiting to be
+// reaped, as a daemon orphaned to a slow init can for a while.
+func ProcessZombie(pid int) bool {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return false
+	}
+	// The state follows the parenthesised command name.
+	i := bytes.LastIndexByte(data, ')')
+	return i >= 0 && i+2 < len(data) && data[i+2] == 'Z'
+}
+
+// ProcessCommand returns pid's command line, its arguments joined by
+// spaces.
+func ProcessCommand(pid int) (string, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return "", err
+	}
+	data = bytes.TrimRight(data, "\x00")
+	return string(bytes.ReplaceAll(data, []byte{0}, []byte{' '})), nil
+}
+
+// ProcessArgs returns pid's arguments, the program first.
+func ProcessArgs(pid int) ([]string, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return nil, err
+	}
+	data = bytes.TrimRight(data, "\x00")
+	if len(data) == 0 {
+		return nil, nil
+	}
+	return strings.Split(string(data), "\x00"), nil
+}
+
+// Processes returns the PIDs of every process.
+func Processes() ([]int, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+	var pids []int
+	for _, e := range entries {
+		if pid, err := strconv.Atoi(e.Name()); err == nil {
+			pids = append(pids, pid)
+		}
+	}
+	return pids, nil
+}
+
+// ReadProcStats reads the stat line of every process, keyed by PID.
+// Processes that exit mid-scan are skipped.
+func ReadProcStats() (map[int]ProcStat, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+	stats := make(map[int]ProcStat, len(entries))
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		fields, err := statFields(pid)
+		if err != nil || len(fields) < 22 {
+			continue
+		}
+		ppid, _ := strconv.Atoi(fields[1])
+		utime, _ := strconv.ParseUint(fields[11], 10, 64)
+		stime, _ := strconv.ParseUint(fields[12], 10, 64)
+		rss, _ := strconv.ParseUint(fields[21], 10, 64)
+		stats[pid] = ProcStat{PPID: ppid, CPUTicks: utime + stime, RSSPages: rss}
+	}
+	return stats, nil
+}
+
+// ProcessStartTime returns when pid started, from its start time in
+// /proc/<pid>/stat (ticks since boot) and the boot time in /proc/stat.
+func ProcessStartTime(pid int) (time.Time, error) {
+	fields, err := statFields(pid)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if len(fields) < 20 {
+		return time.Time{}, fmt.Errorf("malformed stat for pid %d", pid)
+	}
+	ticks, err := strconv.ParseUint(fields[19], 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	stat, err := os.ReadFile("/proc/stat")
+	if err != nil {
+		return time.Time{}, err
+	}
+	for _, line := range strings.Split(string(stat), "\n") {
+		if v, ok := strings.CutPrefix(line, "btime "); ok {
+			boot, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+			if err != nil {
+				return time.Time{}, err
+			}
+			start := time.Unix(boot, 0).Add(time.Duration(ticks) * time.Second / ClockTicks)
+			return start, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("no boot time in /proc/stat")
+}
+
+// statFields returns the fields of /proc/<pid>/stat after the command
+// name, which is parenthesised and may contain spaces, so fields are
+// counted from the last ')'. The first is the process's state.
+func statFields(pid int) ([]string, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return nil, err
+	}
+	end := bytes.LastIndexByte(data, ')')
+	if end < 0 {
+		return nil, fmt.Errorf("malformed stat for pid %d", pid)
+	}
+	return strings.Fields(string(data[end+1:])), nil
+}
+
+// TTYName returns the name of the terminal open on fd in this process.
+func TTYName(fd uintptr) (string, error) {
+	return os.Readlink(fmt.Sprintf("/proc/self/fd/%d", fd))
+}
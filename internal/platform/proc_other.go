@@ -0,0 +1,58 @@
+//go:build !linux && !darwin
+
+package platform
+
+import (
+	"time"
+
+	"github.com/theMichaelB/sess/internal/utils"
+)
+
+// ClockTicks is the unit of ProcStat's CPU times.
+const ClockTicks = 100
+
+// ProcessCwd returns utils.ErrUnsupported.
+func ProcessCwd(pid int) (string, error) {
+	return "", utils.ErrUnsupported
+}
+
+// ProcessEnv returns utils.ErrUnsupported.
+func ProcessEnv(pid int) ([]string, error) {
+	return nil, utils.ErrUnsupported
+}
+
+// ProcessZombie reports false: a zombie cannot be told from a live
+// process here.
+func ProcessZombie(pid int) bool {
+	return false
+}
+
+// ProcessCommand returns utils.ErrUnsupported.
+func ProcessCommand(pid int) (string, error) {
+	return "", utils.ErrUnsupported
+}
+
+// ProcessArgs returns utils.ErrUnsupported.
+func ProcessArgs(pid int) ([]string, error) {
+	return nil, utils.ErrUnsupported
+}
+
+// Processes returns utils.ErrUnsupported.
+func Processes() ([]int, error) {
+	return nil, utils.ErrUnsupported
+}
+
+// ReadProcStats returns utils.ErrUnsupported.
+func ReadProcStats() (map[int]ProcStat, error) {
+	return nil, utils.ErrUnsupported
+}
+
+// ProcessStartTime returns utils.ErrUnsupported.
+func ProcessStartTime(pid int) (time.Time, error) {
+	return time.Time{}, utils.ErrUnsupported
+}
+
+// TTYName returns utils.ErrUnsupported.
+func TTYName(fd uintptr) (string, error) {
+	return "", utils.ErrUnsupported
+}
@@ -0,0 +1,55 @@
+package platform
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Rlimits maps the resource limits a session's command can be given, named
+// as prlimit(1) names them, to their resources.
+var Rlimits = map[string]int{
+	"as":      unix.RLIMIT_AS,
+	"core":    unix.RLIMIT_CORE,
+	"cpu":     unix.RLIMIT_CPU,
+	"data":    unix.RLIMIT_DATA,
+	"fsize":   unix.RLIMIT_FSIZE,
+	"memlock": unix.RLIMIT_MEMLOCK,
+	"nofile":  unix.RLIMIT_NOFILE,
+	"nproc":   unix.RLIMIT_NPROC,
+	"rss":     unix.RLIMIT_RSS,
+	"stack":   unix.RLIMIT_STACK,
+}
+
+// Setrlimit sets a resource limit of this process and what it runs. It
+// goes through package syscall, so that starting or executing a program
+// afterwards keeps a RLIMIT_NOFILE set here rather than restoring the one
+// the process started with.
+func Setrlimit(resource int, soft, hard uint64) error {
+	return syscall.Setrlimit(resource, &syscall.Rlimit{Cur: toRlim(soft), Max: toRlim(hard)})
+}
+
+// Getrlimit returns a resource limit of this process.
+func Getrlimit(resource int) (soft, hard uint64, err error) {
+	var lim syscall.Rlimit
+	if err := syscall.Getrlimit(resource, &lim); err != nil {
+		return 0, 0, err
+	}
+	return fromRlim(lim.Cur), fromRlim(lim.Max), nil
+}
+
+// toRlim and fromRlim convert limits, RlimInfinity standing for the
+// system's RLIM_INFINITY.
+func toRlim(v uint64) uint64 {
+	if v >= unix.RLIM_INFINITY {
+		return unix.RLIM_INFINITY
+	}
+	return uint64(v)
+}
+
+func fromRlim(v uint64) uint64 {
+	if v == unix.RLIM_INFINITY {
+		return RlimInfinity
+	}
+	return uint64(v)
+}
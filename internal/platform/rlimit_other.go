@@ -0,0 +1,18 @@
+//go:build !linux && !darwin && !freebsd && !openbsd
+
+package platform
+
+import "github.com/theMichaelB/sess/internal/utils"
+
+// Rlimits is empty: sess sets no resource limits on this platform.
+var Rlimits = map[string]int{}
+
+// Setrlimit returns utils.ErrUnsupported.
+func Setrlimit(resource int, soft, hard uint64) error {
+	return utils.ErrUnsupported
+}
+
+// Getrlimit returns utils.ErrUnsupported.
+func Getrlimit(resource int) (soft, hard uint64, err error) {
+	return 0, 0, utils.ErrUnsupported
+}
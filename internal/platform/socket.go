@@ -0,0 +1,26 @@
+package platform
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// MaxSocketPath is the longest path a unix socket can be bound to or dialled
+// at: sun_path holds 108 bytes on Linux and 104 on the BSDs and macOS, one
+// of which goes to the terminating NUL.
+const MaxSocketPath = len(unix.RawSockaddrUnix{}.Path) - 1
+
+// control runs fn on the descriptor of a unix socket connection, and not
+// at all for other connections.
+func control(conn net.Conn, fn func(fd int)) {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return
+	}
+	raw.Control(func(fd uintptr) { fn(int(fd)) })
+}
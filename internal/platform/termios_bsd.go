@@ -0,0 +1,16 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+
+package platform
+
+import "golang.org/x/sys/unix"
+
+// Terminal attribute ioctls: read, set, and set after discarding unread
+// input.
+const (
+	IoctlGetTermios      = unix.TIOCGETA
+	IoctlSetTermios      = unix.TIOCSETA
+	IoctlSetTermiosFlush = unix.TIOCSETAF
+)
+
+// VDisable turns a special character off.
+const VDisable = 0xff
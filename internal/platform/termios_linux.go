@@ -0,0 +1,14 @@
+package platform
+
+import "golang.org/x/sys/unix"
+
+// Terminal attribute ioctls: read, set, and set after discarding unread
+// input.
+const (
+	IoctlGetTermios      = unix.TCGETS
+	IoctlSetTermios      = unix.TCSETS
+	IoctlSetTermiosFlush = unix.TCSETSF
+)
+
+// VDisable turns a special character off.
+const VDisable = 0
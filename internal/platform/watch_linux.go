@@ -0,0 +1,73 @@
+package platform
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// FileWatch waits for files to change; see WatchFiles.
+type FileWatch struct {
+	f *os.File
+	// names are the paths' names, by the watch on their directory.
+	names map[int32]map[string]bool
+}
+
+// WatchFiles watches for any of paths to be removed, renamed away or
+// replaced by a rename, or for a directory holding one to go. On Linux it
+// uses inotify; elsewhere it returns utils.ErrUnsupported, and callers
+// look for themselves now and then.
+func WatchFiles(paths ...string) (*FileWatch, error) {
+	fd, err := unix.InotifyInit1(unix.IN_NONBLOCK | unix.IN_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	// Non-blocking, the descriptor goes through the runtime's poller,
+	// so Close interrupts a Wait.
+	w := &FileWatch{f: os.NewFile(uintptr(fd), "inotify"), names: make(map[int32]map[string]bool)}
+	for _, path := range paths {
+		wd, err := unix.InotifyAddWatch(fd, filepath.Dir(path),
+			unix.IN_DELETE|unix.IN_MOVED_FROM|unix.IN_MOVED_TO|unix.IN_DELETE_SELF|unix.IN_MOVE_SELF|unix.IN_ONLYDIR)
+		if err != nil {
+			w.Close()
+			return nil, err
+		}
+		if w.names[int32(wd)] == nil {
+			w.names[int32(wd)] = make(map[string]bool)
+		}
+		w.names[int32(wd)][filepath.Base(path)] = true
+	}
+	return w, nil
+}
+
+// Wait blocks until one of the paths changes as WatchFiles says, and
+// returns nil then. It returns an error once the watch is closed.
+func (w *FileWatch) Wait() error {
+	buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+	for {
+		n, err := w.f.Read(buf)
+		if err != nil {
+			return err
+		}
+		for off := 0; off+unix.SizeofInotifyEvent <= n; {
+			wd := int32(binary.NativeEndian.Uint32(buf[off:]))
+			mask := binary.NativeEndian.Uint32(buf[off+4:])
+			size := int(binary.NativeEndian.Uint32(buf[off+12:]))
+			name := buf[off+unix.SizeofInotifyEvent : min(off+unix.SizeofInotifyEvent+size, n)]
+			off += unix.SizeofInotifyEvent + size
+			// IN_IGNORED follows the watch's directory going away.
+			if mask&(unix.IN_DELETE_SELF|unix.IN_MOVE_SELF|unix.IN_IGNORED) != 0 ||
+				w.names[wd][strings.TrimRight(string(name), "\x00")] {
+				return nil
+			}
+		}
+	}
+}
+
+// Close stops the watch.
+func (w *FileWatch) Close() error {
+	return w.f.Close()
+}
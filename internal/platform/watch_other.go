@@ -0,0 +1,24 @@
+//go:build !linux
+
+package platform
+
+import "github.com/theMichaelB/sess/internal/utils"
+
+// FileWatch waits for files to change; see WatchFiles.
+type FileWatch struct{}
+
+// WatchFiles returns utils.ErrUnsupported: callers look for themselves now
+// and then.
+func WatchFiles(paths ...string) (*FileWatch, error) {
+	return nil, utils.ErrUnsupported
+}
+
+// Wait returns utils.ErrUnsupported.
+func (w *FileWatch) Wait() error {
+	return utils.ErrUnsupported
+}
+
+// Close does nothing.
+func (w *FileWatch) Close() error {
+	return nil
+}
@@ -0,0 +1,202 @@
+package session
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/theMichaelB/sess/internal/platform"
+	"github.com/theMichaelB/sess/internal/utils"
+)
+
+// Reasons a session ended without its daemon ending it, as recorded in
+// ExitInfo.Reason.
+const (
+	ReasonRebooted = "machine rebooted"
+	ReasonOOM      = "OOM-killed"
+	ReasonCrashed  = "daemon crashed"
+)
+
+// Heartbeat is the state file a daemon keeps while it serves a session and
+// removes when it shuts down cleanly. It touches the file whenever a client
+// connects, never on a timer, so its modification time is when the daemon
+// was last seen alive. One left behind by a dead daemon is how sess learns
+// the session died, and roughly when.
+type Heartbeat struct {
+	DaemonPID int       `json:"daemon_pid"`
+	StartedAt time.Time `json:"started_at"`
+	// BootID identifies the boot the daemon ran in; see platform.BootID.
+	BootID string `json:"boot_id,omitempty"`
+}
+
+// HeartbeatPath returns the heartbeat file kept next to the metadata at
+// metaPath.
+func HeartbeatPath(metaPath string) string {
+	return strings.TrimSuffix(metaPath, ".meta") + ".alive"
+}
+
+// WriteHeartbeat records at path that this process serves the session.
+func WriteHeartbeat(path string) error {
+	hb := Heartbeat{DaemonPID: os.Getpid(), StartedAt: time.Now()}
+	hb.BootID, _ = platform.BootID()
+	data, err := json.Marshal(&hb)
+	if err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// buryOrphan turns the session whose heartbeat is at path into a tombstone
+// if its daemon died without shutting down: the daemon and the command are
+// gone and nothing listens on the socket. The tombstone says when the
+// daemon was last seen and, as best it can, why it died. A command that
+// outlived its daemon is left alone, as a stale session.
+func (m *Manager) buryOrphan(path string) {
+	var hb Heartbeat
+	if !readJSON(path, &hb) {
+		return
+	}
+	// Another host's daemon, which cannot be judged from here.
+	if m.metaRemote(strings.TrimSuffix(path, ".alive") + ".meta") {
+		return
+	}
+	bootID, _ := platform.BootID()
+	rebooted := hb.BootID != "" && bootID != "" && hb.BootID != bootID
+	if !rebooted && m.processAliveSince(hb.DaemonPID, hb.StartedAt) && !platform.ProcessZombie(hb.DaemonPID) {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	lock, err := m.acquireLock()
+	if err != nil {
+		return
+	}
+	defer lock.Release()
+
+	// Check again under the lock: another sess may have got here first.
+	var again Heartbeat
+	info, err := os.Stat(path)
+	if err != nil || !readJSON(path, &again) || again.DaemonPID != hb.DaemonPID || !again.StartedAt.Equal(hb.StartedAt) {
+		return
+	}
+	base := strings.TrimSuffix(path, ".alive")
+	metaPath := base + ".meta"
+	if !socketGone(m.socketPath(metaPath)) {
+		return
+	}
+	var s Session
+	if readJSON(metaPath, &s) {
+		if !rebooted && m.sessionAlive(&s) {
+			return
+		}
+		exit := ExitInfo{ExitedAt: info.ModTime(), Status: -1, Reason: crashReason(&hb, rebooted)}
+		if bury(metaPath, m.socketPath(metaPath), &s, exit) != nil {
+			return
+		}
+	}
+	os.Remove(path)
+}
+
+// bury replaces the files of session s, whose daemon died, with a
+// tombstone recording exit, preserving its logs first; socketPath is where
+// its daemon listened. The heartbeat is left to the caller. Must hold the
+// lock.
+func bury(metaPath, socketPath string, s *Session, exit ExitInfo) error {
+	preserveLogs(metaPath, s)
+	if err := WriteTombstone(TombstonePath(metaPath), &Tombstone{Session: *s, Exit: exit}); err != nil {
+		return err
+	}
+	os.Remove(socketPath)
+	os.Remove(EnvFilePath(metaPath))
+	os.Remove(metaPath)
+	return nil
+}
+
+// ReapStale looks into session number once connecting to its socket has
+// been refused, or its command found dead, and returns an error wrapping utils.ErrSessionStale if its
+// daemon has died: its socket refuses connections or is gone, and the
+// daemon's process, judged by PID and start time, is not running. The
+// session is then turned into a tombstone, as sweeping does with a crashed
+// daemon's, unless its command outlived the daemon: that is left alone,
+// and the error says so. It returns nil if the daemon is still there.
+func (m *Manager) ReapStale(number string) error {
+	metaPath := m.GetMetaPath(number)
+	var s Session
+	if !readJSON(metaPath, &s) || !m.daemonGone(&s) {
+		return nil
+	}
+	if m.sessionAlive(&s) && !platform.ProcessZombie(s.PID) {
+		return fmt.Errorf("%w: %s refuses connections, and its command (pid %d) runs on without a terminal; sess -k %s ends it", utils.ErrSessionStale, number, s.PID, strings.TrimLeft(number, "0"))
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	lock, err := m.acquireLock()
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	// Check again under the lock: another sess may have got here first,
+	// or a new session may have taken the number.
+	var again Session
+	if !readJSON(metaPath, &again) || again.PID != s.PID || !again.CreatedAt.Equal(s.CreatedAt) || !m.daemonGone(&again) {
+		return fmt.Errorf("%w: %s", utils.ErrSessionStale, number)
+	}
+	exit := ExitInfo{ExitedAt: time.Now(), Status: -1, Reason: ReasonCrashed}
+	heartbeat := HeartbeatPath(metaPath)
+	var hb Heartbeat
+	if info, err := os.Stat(heartbeat); err == nil && readJSON(heartbeat, &hb) {
+		bootID, _ := platform.BootID()
+		exit.ExitedAt = info.ModTime()
+		exit.Reason = crashReason(&hb, hb.BootID != "" && bootID != "" && hb.BootID != bootID)
+	}
+	if err := bury(metaPath, m.socketPath(metaPath), &again, exit); err != nil {
+		return err
+	}
+	os.Remove(heartbeat)
+	return fmt.Errorf("%w: %s refuses connections, and what it left has been cleared away; sess ls --all shows how it ended", utils.ErrSessionStale, number)
+}
+
+// daemonGone reports whether the daemon of session s has died: nothing
+// listens on its socket and its process is not running, or is a zombie
+// nobody has reaped.
+func (m *Manager) daemonGone(s *Session) bool {
+	if !socketGone(m.GetSocketPath(s.Number)) {
+		return false
+	}
+	return s.DaemonPID == 0 || !m.processAliveSince(s.DaemonPID, s.CreatedAt) || platform.ProcessZombie(s.DaemonPID)
+}
+
+// crashReason guesses why the daemon behind hb died.
+func crashReason(hb *Heartbeat, rebooted bool) string {
+	switch {
+	case rebooted:
+		return ReasonRebooted
+	case platform.OOMKilled(hb.DaemonPID):
+		return ReasonOOM
+	}
+	return ReasonCrashed
+}
+
+// preserveLogs keeps the output and input logs of a session whose daemon
+// never got to, pointing s at the preserved copies.
+func preserveLogs(metaPath string, s *Session) {
+	if info, err := os.Stat(LogPath(metaPath)); err == nil {
+		if path, err := PreserveLog(LogPath(metaPath), info.ModTime()); err == nil {
+			s.Log = path
+		}
+	}
+	if info, err := os.Stat(InputLogPath(metaPath)); err == nil {
+		if path, err := PreserveLog(InputLogPath(metaPath), info.ModTime()); err == nil {
+			s.InputLog = path
+		}
+	}
+}
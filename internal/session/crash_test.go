@@ -0,0 +1,74 @@
+package session
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/theMichaelB/sess/internal/platform"
+)
+
+// A session whose daemon died is turned into a tombstone saying why, unless
+// the daemon or the command is still running.
+func TestBuryOrphan(t *testing.T) {
+	m := newTestManager(t)
+	gone := exec.Command("true")
+	if err := gone.Run(); err != nil {
+		t.Fatal(err)
+	}
+	dead := gone.Process.Pid
+	bootID, _ := platform.BootID()
+	lastSeen := time.Now().Add(-time.Hour).Truncate(time.Second)
+
+	orphan := func(number string, pid int, hb Heartbeat) {
+		t.Helper()
+		metaPath := m.GetMetaPath(number)
+		if err := WriteMetadata(metaPath, &Session{Number: number, PID: pid, CreatedAt: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+		data, _ := json.Marshal(&hb)
+		path := HeartbeatPath(metaPath)
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(path, lastSeen, lastSeen)
+	}
+	orphan("001", dead, Heartbeat{DaemonPID: dead, StartedAt: time.Now(), BootID: bootID})
+	os.WriteFile(LogPath(m.GetMetaPath("001")), []byte("output\n"), 0600)
+	// Its daemon is alive, or the command outlived it.
+	orphan("002", dead, Heartbeat{DaemonPID: os.Getpid(), StartedAt: time.Now(), BootID: bootID})
+	orphan("003", os.Getpid(), Heartbeat{DaemonPID: dead, StartedAt: time.Now(), BootID: bootID})
+	if bootID != "" {
+		orphan("004", os.Getpid(), Heartbeat{DaemonPID: os.Getpid(), StartedAt: time.Now(), BootID: "an earlier boot"})
+	}
+	m.sweep()
+
+	records, err := m.ListAllSessions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]Record{}
+	for _, r := range records {
+		got[r.Number] = r
+	}
+	if r := got["001"]; r.State != StateExited || r.Exit.Reason != ReasonCrashed || !r.Exit.ExitedAt.Equal(lastSeen) || r.Log == "" {
+		t.Errorf("session 001 = %+v, %+v; want a tombstone from when the crashed daemon was last seen, with its log", r, r.Exit)
+	}
+	for _, number := range []string{"002", "003"} {
+		if r := got[number]; r.State == StateExited {
+			t.Errorf("session %s buried with %+v", number, r.Exit)
+		}
+	}
+	if bootID != "" {
+		if r := got["004"]; r.State != StateExited || r.Exit.Reason != ReasonRebooted {
+			t.Errorf("session 004 = %+v; want a tombstone saying the machine rebooted", r)
+		}
+	}
+	for _, path := range []string{m.GetMetaPath("001"), HeartbeatPath(m.GetMetaPath("001"))} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s left behind", path)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package session
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// EnvFilePath returns the env file kept next to the metadata at metaPath.
+// It holds the variables pushed with SetEnv as a script a shell can source.
+func EnvFilePath(metaPath string) string {
+	return strings.TrimSuffix(metaPath, ".meta") + ".env"
+}
+
+// SetEnv records variables pushed into a session: set are exported, unset
+// are removed. The metadata keeps the record and the env file is rewritten
+// from it, so shells in the session can pick the changes up.
+func (m *Manager) SetEnv(number string, set map[string]string, unset []string) error {
+	for key := range set {
+		if !validEnvKey(key) {
+			return fmt.Errorf("invalid variable name %q", key)
+		}
+	}
+	for _, key := range unset {
+		if !validEnvKey(key) {
+			return fmt.Errorf("invalid variable name %q", key)
+		}
+	}
+
+	var s Session
+	err := m.updateSession(number, func(meta *Session) error {
+		for key, value := range set {
+			if meta.Env == nil {
+				meta.Env = make(map[string]string)
+			}
+			meta.Env[key] = value
+			meta.EnvUnset = removeString(meta.EnvUnset, key)
+		}
+		for _, key := range unset {
+			delete(meta.Env, key)
+			if !containsString(meta.EnvUnset, key) {
+				meta.EnvUnset = append(meta.EnvUnset, key)
+			}
+		}
+		sort.Strings(meta.EnvUnset)
+		s = *meta
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return writeEnvFile(EnvFilePath(m.GetMetaPath(number)), &s)
+}
+
+// writeEnvFile renders the session's pushed variables as sh commands.
+func writeEnvFile(path string, s *Session) error {
+	var b strings.Builder
+	b.WriteString("# Written by sess setenv; source it to pick up pushed variables.\n")
+	keys := make([]string, 0, len(s.Env))
+	for key := range s.Env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(&b, "export %s=%s\n", key, shellQuote(s.Env[key]))
+	}
+	for _, key := range s.EnvUnset {
+		fmt.Fprintf(&b, "unset %s\n", key)
+	}
+
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, []byte(b.String()), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// validEnvKey reports whether key is a name sh accepts for a variable, as
+// it is written into the env file unquoted.
+func validEnvKey(key string) bool {
+	if key == "" {
+		return false
+	}
+	for i, c := range key {
+		switch {
+		case c == '_', c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z':
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// shellQuote quotes s for sh.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func removeString(list []string, s string) []string {
+	out := list[:0]
+	for _, v := range list {
+		if v != s {
+			out = append(out, v)
+		}
+	}
+	return out
+}
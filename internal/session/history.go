@@ -0,0 +1,112 @@
+package session
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	historyFile  = ".history"
+	historyLimit = 3
+)
+
+// HistoryEntry records when a session was last attached to.
+type HistoryEntry struct {
+	Number     string    `json:"number"`
+	AttachedAt time.Time `json:"attached_at"`
+}
+
+// RecordAttach moves number to the front of the attach history.
+func (m *Manager) RecordAttach(number string) error {
+	lock, err := m.acquireLock()
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	entries := []HistoryEntry{{Number: number, AttachedAt: time.Now()}}
+	for _, e := range m.readHistoryUnsafe() {
+		if e.Number != number {
+			entries = append(entries, e)
+		}
+	}
+	return m.writeHistoryUnsafe(m.pruneHistory(entries))
+}
+
+// History returns the recently attached live sessions, most recent first.
+// Entries for sessions that have ended are dropped from the file.
+func (m *Manager) History() ([]HistoryEntry, error) {
+	lock, err := m.acquireLock()
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Release()
+
+	entries := m.readHistoryUnsafe()
+	live := m.pruneHistory(entries)
+	if len(live) != len(entries) {
+		if err := m.writeHistoryUnsafe(live); err != nil {
+			return nil, err
+		}
+	}
+	return live, nil
+}
+
+// pruneHistory drops dead sessions and caps the history length.
+func (m *Manager) pruneHistory(entries []HistoryEntry) []HistoryEntry {
+	live := make([]HistoryEntry, 0, len(entries))
+	for _, e := range entries {
+		if len(live) == historyLimit {
+			break
+		}
+		if m.sessionAliveUnsafe(e.Number) {
+			live = append(live, e)
+		}
+	}
+	return live
+}
+
+// sessionAliveUnsafe reports whether a session's metadata names a live
+// process. Unlike GetSession it never removes files, so it is safe to call
+// with the lock held.
+func (m *Manager) sessionAliveUnsafe(number string) bool {
+	data, err := os.ReadFile(m.GetMetaPath(number))
+	if err != nil {
+		return false
+	}
+	var s Session
+	if err := json.Unmarshal(data, &s); err != nil {
+		return false
+	}
+	return m.isProcessAlive(s.PID)
+}
+
+func (m *Manager) readHistoryUnsafe() []HistoryEntry {
+	data, err := os.ReadFile(filepath.Join(m.baseDir, historyFile))
+	if err != nil {
+		return nil
+	}
+	var entries []HistoryEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		// A corrupt history is not worth failing over; start afresh.
+		return nil
+	}
+	return entries
+}
+
+func (m *Manager) writeHistoryUnsafe(entries []HistoryEntry) error {
+	path := filepath.Join(m.baseDir, historyFile)
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
@@ -0,0 +1,32 @@
+package session
+
+import (
+	"syscall"
+	"time"
+)
+
+// KillSequence is how a session's command is ended: each signal in turn,
+// sent to its process group, giving it Grace to exit before the next.
+type KillSequence struct {
+	Signals []syscall.Signal
+	Grace   time.Duration
+}
+
+// DefaultKillSequence hangs up on the command first, as a terminal going
+// away would, so shells run their logout handling: saving history,
+// ~/.bash_logout, hanging up their jobs. Interactive shells ignore
+// SIGTERM, which leaves SIGKILL for those that ignore the hangup too.
+func DefaultKillSequence() KillSequence {
+	return KillSequence{
+		Signals: []syscall.Signal{syscall.SIGHUP, syscall.SIGTERM, syscall.SIGKILL},
+		Grace:   time.Second,
+	}
+}
+
+// OrDefault returns k, or DefaultKillSequence if k has no signals.
+func (k KillSequence) OrDefault() KillSequence {
+	if len(k.Signals) == 0 {
+		return DefaultKillSequence()
+	}
+	return k
+}
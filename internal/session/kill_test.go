@@ -0,0 +1,90 @@
+package session
+
+import (
+	"bufio"
+	"errors"
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/theMichaelB/sess/internal/utils"
+)
+
+// newTestManager returns a Manager keeping its sessions in a temporary
+// home directory.
+func newTestManager(t *testing.T) *Manager {
+	t.Helper()
+	t.Setenv("HOME", t.TempDir())
+	m, err := NewManager()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// startCommand starts argv in a process group of its own, as the daemon
+// starts a session's command, and records it as session 001 once it has
+// written a line, or exited.
+func startCommand(t *testing.T, m *Manager, argv ...string) *exec.Cmd {
+	t.Helper()
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	bufio.NewReader(stdout).ReadString('\n')
+	t.Cleanup(func() {
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		cmd.Wait()
+	})
+	if err := WriteMetadata(m.GetMetaPath("001"), &Session{Number: "001", PID: cmd.Process.Pid}); err != nil {
+		t.Fatal(err)
+	}
+	return cmd
+}
+
+func TestKillSessionRefusedToDie(t *testing.T) {
+	m := newTestManager(t)
+	startCommand(t, m, "sh", "-c", `trap "" TERM; echo ready; while :; do sleep 0.1; done`)
+
+	seq := KillSequence{Signals: []syscall.Signal{syscall.SIGTERM}, Grace: 100 * time.Millisecond}
+	err := m.KillSession("001", seq)
+	if !errors.Is(err, utils.ErrKillFailed) {
+		t.Fatalf("KillSession = %v; want ErrKillFailed", err)
+	}
+	if _, err := m.GetSession("001"); err != nil {
+		t.Errorf("session that survived was forgotten: %v", err)
+	}
+}
+
+func TestKillSessionAlreadyDead(t *testing.T) {
+	m := newTestManager(t)
+	cmd := startCommand(t, m, "true")
+	cmd.Wait()
+
+	if err := m.KillSession("001", KillSequence{}); !errors.Is(err, utils.ErrSessionDead) {
+		t.Fatalf("KillSession = %v; want ErrSessionDead", err)
+	}
+}
+
+// Ending a session clears the current-session marker only if it names that
+// session.
+func TestClearCurrentSessionIf(t *testing.T) {
+	m := newTestManager(t)
+	if err := m.SetCurrentSession("002"); err != nil {
+		t.Fatal(err)
+	}
+	m.clearCurrentSessionIf("001")
+	if info, err := m.readCurrentSessionInfo(); err != nil || info == nil || info.Number != "002" {
+		t.Fatalf("marker = %+v, %v after clearing another session's", info, err)
+	}
+	m.clearCurrentSessionIf("002")
+	if info, err := m.readCurrentSessionInfo(); err != nil || info != nil {
+		t.Errorf("marker = %+v, %v; want it removed", info, err)
+	}
+}
@@ -0,0 +1,210 @@
+package session
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// preservedLogTime is the exit timestamp in the name of a preserved log.
+const preservedLogTime = "20060102T150405"
+
+// outputLogPattern matches the names of output logs, running and preserved.
+// Input logs share the directory but are never pruned or counted against
+// the output logs' disk limit.
+var outputLogPattern = regexp.MustCompile(`^session-\d{3,}(\.exited-\d{8}T\d{6})?\.log$`)
+
+// outputLogs returns the output logs among paths.
+func outputLogs(paths []string) []string {
+	var logs []string
+	for _, p := range paths {
+		if outputLogPattern.MatchString(filepath.Base(p)) {
+			logs = append(logs, p)
+		}
+	}
+	return logs
+}
+
+// LogRetention bounds the preserved logs of ended sessions. A zero field
+// imposes no limit.
+type LogRetention struct {
+	// Days removes logs of sessions that ended longer ago than this.
+	Days int
+	// Files keeps only this many of the most recent logs.
+	Files int
+	// MaxBytes caps the disk used by all session logs, running sessions'
+	// included; the oldest preserved logs are removed to stay under it.
+	MaxBytes int64
+}
+
+// LogPath returns where the session with the metadata at metaPath records
+// its output while it runs.
+func LogPath(metaPath string) string {
+	return strings.TrimSuffix(metaPath, ".meta") + ".log"
+}
+
+// InputLogPath returns where the session with the metadata at metaPath
+// records what is typed into it, when it does.
+func InputLogPath(metaPath string) string {
+	return strings.TrimSuffix(metaPath, ".meta") + ".input.log"
+}
+
+// DaemonLogPath returns where the daemon of the session with the metadata
+// at metaPath reports its own errors once it no longer has a terminal.
+func DaemonLogPath(metaPath string) string {
+	return strings.TrimSuffix(metaPath, ".meta") + ".daemon.out"
+}
+
+// PreserveLog renames the log at path so it outlives its session and its
+// number can be reused: session-003.log becomes
+// session-003.exited-20240705T121205.log for a session that ended at, and
+// session-003.input.log becomes session-003.input.exited-20240705T121205.log.
+// It returns the new path.
+func PreserveLog(path string, at time.Time) (string, error) {
+	preserved := strings.TrimSuffix(path, ".log") + ".exited-" + at.Format(preservedLogTime) + ".log"
+	if err := os.Rename(path, preserved); err != nil {
+		return "", err
+	}
+	return preserved, nil
+}
+
+// PreservedLogs returns the preserved logs in dir, most recent first.
+func PreservedLogs(dir string) ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "session-*.exited-*.log"))
+	if err != nil {
+		return nil, err
+	}
+	paths = outputLogs(paths)
+	mtimes := make(map[string]time.Time, len(paths))
+	for _, p := range paths {
+		if info, err := os.Stat(p); err == nil {
+			mtimes[p] = info.ModTime()
+		}
+	}
+	sort.SliceStable(paths, func(i, j int) bool {
+		return mtimes[paths[i]].After(mtimes[paths[j]])
+	})
+	return paths, nil
+}
+
+// PruneLogs removes the preserved logs in dir that keep no longer allows:
+// those older than keep.Days, then all but the newest keep.Files, then the
+// oldest until all logs fit in keep.MaxBytes. Logs of running sessions are
+// never touched, so they may still exceed the cap on their own. It returns
+// the paths it removed.
+//
+// Several daemons may prune at once. Logs are only ever renamed into the
+// preserved set whole, and a log that disappears mid-scan is skipped.
+func PruneLogs(dir string, keep LogRetention) ([]string, error) {
+	paths, err := PreservedLogs(dir)
+	if err != nil {
+		return nil, err
+	}
+	cutoff := time.Now().AddDate(0, 0, -keep.Days)
+
+	var removed []string
+	remove := func(p string) error {
+		if err := os.Remove(p); err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		removed = append(removed, p)
+		return nil
+	}
+
+	var kept []string
+	for i, p := range paths {
+		expired := keep.Files > 0 && i >= keep.Files
+		if keep.Days > 0 {
+			if info, err := os.Stat(p); err == nil && info.ModTime().Before(cutoff) {
+				expired = true
+			}
+		}
+		if !expired {
+			kept = append(kept, p)
+			continue
+		}
+		if err := remove(p); err != nil {
+			return removed, err
+		}
+	}
+
+	if keep.MaxBytes <= 0 {
+		return removed, nil
+	}
+	used, err := LogUsage(dir)
+	if err != nil {
+		return removed, err
+	}
+	for i := len(kept) - 1; i >= 0 && used > keep.MaxBytes; i-- {
+		info, err := os.Stat(kept[i])
+		if err != nil {
+			continue
+		}
+		if err := remove(kept[i]); err != nil {
+			return removed, err
+		}
+		used -= info.Size()
+	}
+	return removed, nil
+}
+
+// LogUsage returns the bytes used by the output logs in dir, running and
+// preserved.
+func LogUsage(dir string) (int64, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "session-*.log"))
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, p := range outputLogs(paths) {
+		if info, err := os.Stat(p); err == nil {
+			total += info.Size()
+		}
+	}
+	return total, nil
+}
+
+// DirUsage returns the bytes used by the files under dir, as du would
+// count them apart from directories themselves.
+func DirUsage(dir string) (int64, error) {
+	var total int64
+	err := filepath.WalkDir(dir, func(path string, e fs.DirEntry, err error) error {
+		if err != nil {
+			// A file removed meanwhile is not an error.
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if e.Type().IsRegular() {
+			if info, err := e.Info(); err == nil {
+				total += info.Size()
+			}
+		}
+		return nil
+	})
+	return total, err
+}
+
+// PruneLogs applies keep to the preserved logs in the manager's directory.
+func (m *Manager) PruneLogs(keep LogRetention) ([]string, error) {
+	return PruneLogs(m.baseDir, keep)
+}
+
+// LogUsage returns the bytes used by output logs in the manager's
+// directory.
+func (m *Manager) LogUsage() (int64, error) {
+	return LogUsage(m.baseDir)
+}
+
+// DiskUsage returns the bytes used by the files in the manager's directory.
+func (m *Manager) DiskUsage() (int64, error) {
+	return DirUsage(m.baseDir)
+}
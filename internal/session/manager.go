@@ -1,16 +1,23 @@
 package session
 
 import (
-    "encoding/json"
-    "fmt"
-    "os"
-    "path/filepath"
-    "sort"
-    "strconv"
-    "strings"
-    "sync"
-    "syscall"
-    "time"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/theMichaelB/sess/internal/platform"
+	"github.com/theMichaelB/sess/internal/utils"
+	"github.com/theMichaelB/sess/pkg/protocol"
+	"golang.org/x/sys/unix"
 )
 
 const (
@@ -23,6 +30,13 @@ const (
 
 type Manager struct {
 	baseDir string
+	// socketDir is where the daemons' sockets go: baseDir, unless that
+	// will not do (see socketDir).
+	socketDir string
+	// network is set when baseDir is on a network filesystem, which
+	// other hosts may share; host is this one's name.
+	network bool
+	host    string
 	mu      sync.Mutex
 }
 
@@ -31,8 +45,60 @@ type Session struct {
 	CreatedAt time.Time `json:"created_at"`
 	PID       int       `json:"pid"`
 	Command   string    `json:"command"`
+	Note      string    `json:"note,omitempty"`
+	// DetachKey is the session's preferred detach key, used when an
+	// attach does not name one.
+	DetachKey string `json:"detach_key,omitempty"`
+	// Transient sessions end when their interactive client leaves.
+	Transient bool `json:"transient,omitempty"`
+	// Env and EnvUnset are the variables pushed into the session with
+	// sess setenv, set and removed respectively.
+	Env      map[string]string `json:"env,omitempty"`
+	EnvUnset []string          `json:"env_unset,omitempty"`
+	// Log is the file the session's output is recorded to, if any. Once
+	// the session ends it names the preserved copy.
+	Log string `json:"log,omitempty"`
+	// InputLog is the file what is typed into the session is recorded to,
+	// if any; like Log, it names the preserved copy once the session ends.
+	InputLog string `json:"input_log,omitempty"`
+	// Termios lists the terminal settings the session started with over
+	// the defaults, as given to sess --termios.
+	Termios string `json:"termios,omitempty"`
+	// Rlimits lists the resource limits the session's command started
+	// with, as given to sess --rlimit.
+	Rlimits string `json:"rlimits,omitempty"`
+	// EnvMode is where the command's environment came from: "copy" of
+	// the creating client's, "copy:VAR,..." of only those variables of
+	// it, or "clean". Empty when it inherited the daemon's.
+	EnvMode string `json:"env_mode,omitempty"`
+	// Locked sessions refuse attaches until unlocked; see SetLocked.
+	Locked bool `json:"locked,omitempty"`
+	// DaemonPID is the process serving the session; PID is its command.
+	DaemonPID int `json:"daemon_pid,omitempty"`
+	// Version is the build of sess that started the session, if known.
+	Version string `json:"version,omitempty"`
+	// Triggers run commands when the session prints lines matching their
+	// patterns; the daemon is given them whenever they change.
+	Triggers []protocol.Trigger `json:"triggers,omitempty"`
+	// Definition names the entry of sessions.toml sess up started the
+	// session from, if it did; Respawn is the policy the entry gave its
+	// command (RespawnOnFailure or RespawnAlways, or empty for none).
+	Definition string `json:"definition,omitempty"`
+	Respawn    string `json:"respawn,omitempty"`
+	// Socket is where the daemon listens, recorded when that is not in
+	// the state directory.
+	Socket string `json:"socket,omitempty"`
+	// Host is the name of the machine the session runs on.
+	Host string `json:"host,omitempty"`
 }
 
+// Respawn policies for a session's command: run it again whenever it
+// exits, or only when it fails.
+const (
+	RespawnAlways    = "always"
+	RespawnOnFailure = "on-failure"
+)
+
 type LockFile struct {
 	file *os.File
 }
@@ -50,17 +116,72 @@ func NewManager() (*Manager, error) {
 	}
 
 	baseDir := filepath.Join(homeDir, sessionDir)
+	if err := checkOwnership(homeDir, baseDir); err != nil {
+		return nil, err
+	}
 	if err := os.MkdirAll(baseDir, 0700); err != nil {
 		return nil, fmt.Errorf("failed to create session directory: %w", err)
 	}
 
-	return &Manager{
-		baseDir: baseDir,
-	}, nil
+	network := platform.NetworkFS(baseDir)
+	sockDir, err := socketDir(baseDir, network)
+	if err != nil {
+		return nil, err
+	}
+
+	host, _ := os.Hostname()
+	m := &Manager{
+		baseDir:   baseDir,
+		socketDir: sockDir,
+		network:   network,
+		host:      host,
+	}
+	m.sweep()
+	return m, nil
+}
+
+// statFile is os.Stat; tests give files other owners through it.
+var statFile = os.Stat
+
+// checkOwnership refuses a state directory that belongs to another user,
+// which is what sudo with the invoking user's HOME leads to: files created
+// there would belong to root and get in the user's way. For the same
+// reason root never creates one in a home directory that is not its own.
+func checkOwnership(homeDir, baseDir string) error {
+	euid := os.Geteuid()
+	dir := baseDir
+	info, err := statFile(baseDir)
+	if os.IsNotExist(err) && euid == 0 {
+		dir = homeDir
+		info, err = statFile(homeDir)
+	}
+	if err != nil {
+		// MkdirAll reports anything that matters.
+		return nil
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || int(st.Uid) == euid {
+		return nil
+	}
+	return fmt.Errorf("%w: %s belongs to %s, not to the user sess runs as (%s); as root, use 'sess --user %s ...' to manage their sessions",
+		utils.ErrPermissionDenied, dir, userName(int(st.Uid)), userName(euid), userName(int(st.Uid)))
+}
+
+// userName returns the login name of uid, or the number if it has none.
+func userName(uid int) string {
+	if u, err := user.LookupId(strconv.Itoa(uid)); err == nil {
+		return u.Username
+	}
+	return strconv.Itoa(uid)
 }
 
 func (m *Manager) acquireLock() (*LockFile, error) {
-	lockPath := filepath.Join(m.baseDir, lockFile)
+	return acquireLock(m.baseDir)
+}
+
+// acquireLock takes the lock file in dir, waiting up to lockTimeout.
+func acquireLock(dir string) (*LockFile, error) {
+	lockPath := filepath.Join(dir, lockFile)
 
 	file, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
 	if err != nil {
@@ -102,20 +223,7 @@ func (m *Manager) NextSessionNumber() (string, error) {
 	}
 	defer lock.Release()
 
-	sessions, err := m.listSessionsUnsafe()
-	if err != nil {
-		return "", err
-	}
-
-	maxNum := 0
-	for _, session := range sessions {
-		num, err := strconv.Atoi(session.Number)
-		if err == nil && num > maxNum {
-			maxNum = num
-		}
-	}
-
-	return fmt.Sprintf("%03d", maxNum+1), nil
+	return m.nextFreeNumberUnsafe()
 }
 
 func (m *Manager) CreateSession(number, socketPath, metaPath, shell string) error {
@@ -154,7 +262,7 @@ func (m *Manager) GetSession(number string) (*Session, error) {
 	data, err := os.ReadFile(metaPath)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return nil, fmt.Errorf("session %s does not exist", number)
+			return nil, fmt.Errorf("%w: %s", utils.ErrSessionNotFound, number)
 		}
 		return nil, err
 	}
@@ -163,10 +271,15 @@ func (m *Manager) GetSession(number string) (*Session, error) {
 	if err := json.Unmarshal(data, &session); err != nil {
 		return nil, err
 	}
+	if m.remote(&session) {
+		return nil, fmt.Errorf("%w: %s is on %s", utils.ErrSessionRemote, number, session.Host)
+	}
 
-	if !m.isProcessAlive(session.PID) {
-		m.cleanupSession(number)
-		return nil, fmt.Errorf("session %s is dead", number)
+	// Dead sessions are reported, not removed: deleting their files is
+	// left to Clean, which double-checks first. A PID reused since the
+	// session started does not count as it.
+	if !m.sessionAlive(&session) {
+		return nil, fmt.Errorf("%w: %s", utils.ErrSessionDead, number)
 	}
 
 	return &session, nil
@@ -185,6 +298,43 @@ func (m *Manager) ListSessions() ([]Session, error) {
 	return m.listSessionsUnsafe()
 }
 
+// LiveNumbers lists the numbers of sessions whose command is running. It
+// reads only the process ID and host from each metadata file, takes no
+// lock and creates or removes nothing, which suits shell completion and
+// prompts.
+func LiveNumbers() ([]string, error) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get home directory: %w", err)
+	}
+	baseDir := filepath.Join(homeDir, sessionDir)
+	matches, err := filepath.Glob(filepath.Join(baseDir, "session-*.meta"))
+	if err != nil {
+		return nil, err
+	}
+	network := len(matches) > 0 && platform.NetworkFS(baseDir)
+	host, _ := os.Hostname()
+
+	var numbers []string
+	for _, metaPath := range matches {
+		data, err := os.ReadFile(metaPath)
+		if err != nil {
+			continue
+		}
+		var meta struct {
+			PID  int    `json:"pid"`
+			Host string `json:"host"`
+		}
+		if json.Unmarshal(data, &meta) != nil || meta.PID <= 0 || (network && meta.Host != "" && meta.Host != host) || !platform.ProcessAlive(meta.PID) {
+			continue
+		}
+		name := filepath.Base(metaPath)
+		numbers = append(numbers, name[len("session-"):len(name)-len(".meta")])
+	}
+	sort.Strings(numbers)
+	return numbers, nil
+}
+
 func (m *Manager) listSessionsUnsafe() ([]Session, error) {
 	pattern := filepath.Join(m.baseDir, "session-*.meta")
 	matches, err := filepath.Glob(pattern)
@@ -204,11 +354,9 @@ func (m *Manager) listSessionsUnsafe() ([]Session, error) {
 			continue
 		}
 
-		if !m.isProcessAlive(session.PID) {
-			base := filepath.Base(metaPath)
-			number := strings.TrimPrefix(base, "session-")
-			number = strings.TrimSuffix(number, ".meta")
-			m.cleanupSession(number)
+		// Sessions that look dead are skipped but left in place; see
+		// ListAllSessions and Clean. So are other hosts' sessions.
+		if m.remote(&session) || !m.isProcessAlive(session.PID) {
 			continue
 		}
 
@@ -222,31 +370,91 @@ func (m *Manager) listSessionsUnsafe() ([]Session, error) {
 	return sessions, nil
 }
 
-func (m *Manager) KillSession(number string) error {
+// KillSession ends a session's command as seq says, waits for its daemon
+// to follow, and only then removes the files the daemon left. It fails with
+// ErrSessionDead if the command had gone already, ErrKillFailed if the
+// command or the daemon outlives every signal, and ErrCleanupFailed if
+// files could not be removed.
+func (m *Manager) KillSession(number string, seq KillSequence) error {
 	session, err := m.GetSession(number)
 	if err != nil {
 		return err
 	}
 
-	if err := syscall.Kill(session.PID, syscall.SIGTERM); err != nil {
-		if err == syscall.ESRCH {
-			m.cleanupSession(number)
-			return fmt.Errorf("session %s is already dead", number)
+	seq = seq.OrDefault()
+	switch err := m.endProcess(session.PID, true, seq); {
+	case err == errAlreadyGone:
+		// It ended on its own; its daemon is tidying up after it.
+		return fmt.Errorf("%w: %s", utils.ErrSessionDead, number)
+	case err != nil:
+		return fmt.Errorf("session %s: command (pid %d): %w", number, session.PID, err)
+	}
+
+	// The daemon shuts down once the command has gone. One that does not,
+	// or that older metadata does not name, could still be writing files.
+	if session.DaemonPID != 0 && !m.waitForExit(session.DaemonPID, seq.Grace) {
+		daemonSeq := KillSequence{Signals: []syscall.Signal{syscall.SIGTERM, syscall.SIGKILL}, Grace: seq.Grace}
+		if err := m.endProcess(session.DaemonPID, false, daemonSeq); err != nil && err != errAlreadyGone {
+			return fmt.Errorf("session %s: daemon (pid %d): %w", number, session.DaemonPID, err)
 		}
-		return err
 	}
 
-	time.Sleep(1 * time.Second)
+	if err := m.cleanupSession(number); err != nil {
+		return fmt.Errorf("%w: session %s: %v", utils.ErrCleanupFailed, number, err)
+	}
+	return nil
+}
+
+// errAlreadyGone is endProcess finding nothing to signal.
+var errAlreadyGone = errors.New("already gone")
 
-	if m.isProcessAlive(session.PID) {
-		syscall.Kill(session.PID, syscall.SIGKILL)
+// endProcess sends seq's signals to pid, or to its process group, until it
+// has gone. It fails with errAlreadyGone if there was nothing to signal,
+// and with ErrKillFailed if pid outlives the last signal.
+func (m *Manager) endProcess(pid int, group bool, seq KillSequence) error {
+	target := pid
+	if group {
+		target = -pid
 	}
+	for i, sig := range seq.Signals {
+		if err := syscall.Kill(target, sig); err != nil {
+			if err != syscall.ESRCH {
+				return err
+			}
+			if i == 0 {
+				return errAlreadyGone
+			}
+			return nil
+		}
+		if m.waitForExit(pid, seq.Grace) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: still running after %s", utils.ErrKillFailed, signalNames(seq.Signals))
+}
 
-	m.cleanupSession(number)
-	return nil
+// signalNames lists sigs as "SIGHUP, SIGTERM and SIGKILL".
+func signalNames(sigs []syscall.Signal) string {
+	names := make([]string, len(sigs))
+	for i, sig := range sigs {
+		names[i] = unix.SignalName(sig)
+	}
+	if len(names) == 1 {
+		return names[0]
+	}
+	return strings.Join(names[:len(names)-1], ", ") + " and " + names[len(names)-1]
 }
 
 func (m *Manager) SetCurrentSession(number string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	lock, err := m.acquireLock()
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
 	currentPath := filepath.Join(m.baseDir, currentFile)
 	tmpPath := currentPath + ".tmp"
 
@@ -324,36 +532,84 @@ func (m *Manager) ClearCurrentSession() error {
 }
 
 func (m *Manager) GetSocketPath(number string) string {
-	return filepath.Join(m.baseDir, fmt.Sprintf("session-%s.sock", number))
+	return m.socketPath(m.GetMetaPath(number))
 }
 
 func (m *Manager) GetMetaPath(number string) string {
 	return filepath.Join(m.baseDir, fmt.Sprintf("session-%s.meta", number))
 }
 
-func (m *Manager) IsInSession() bool {
-	return os.Getenv("SESS_NUM") != ""
+// EnvSession returns the session the environment (SESS_NUM, SESS_SOCKET)
+// claims the process runs inside, with its socket path. A session from
+// another sess directory (another user, or another host reached over SSH)
+// is not reported. The claim is not verified; the session may be gone.
+func (m *Manager) EnvSession() (number, socketPath string, ok bool) {
+	number = os.Getenv("SESS_NUM")
+	if number == "" {
+		return "", "", false
+	}
+	socketPath = os.Getenv("SESS_SOCKET")
+	if socketPath == "" {
+		// Sessions started before SESS_SOCKET was exported.
+		socketPath = m.GetSocketPath(m.NormalizeSessionNumber(number))
+	}
+	if filepath.Dir(socketPath) != m.socketDir && socketPath != m.GetSocketPath(m.NormalizeSessionNumber(number)) {
+		return "", "", false
+	}
+	return number, socketPath, true
 }
 
-func (m *Manager) CurrentSessionNumber() string {
-	return os.Getenv("SESS_NUM")
+func (m *Manager) isProcessAlive(pid int) bool {
+	return platform.ProcessAlive(pid)
 }
 
-func (m *Manager) isProcessAlive(pid int) bool {
-	err := syscall.Kill(pid, 0)
-	return err == nil
+// waitForExitInterval is how often waitForExit looks.
+const waitForExitInterval = 5 * time.Millisecond
+
+// waitForExit waits up to timeout for pid to go, and reports whether it
+// did. A process that is not our child cannot be waited for, so it polls;
+// one that has exited but not been reaped counts as gone.
+func (m *Manager) waitForExit(pid int, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for m.isProcessAlive(pid) && !platform.ProcessZombie(pid) {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(waitForExitInterval)
+	}
+	return true
 }
 
-func (m *Manager) cleanupSession(number string) {
-	socketPath := m.GetSocketPath(number)
+// cleanupSession removes what a session's daemon would have on its way
+// out, returning the first file that could not be.
+func (m *Manager) cleanupSession(number string) error {
 	metaPath := m.GetMetaPath(number)
+	var first error
+	for _, path := range []string{m.GetSocketPath(number), metaPath, EnvFilePath(metaPath), HeartbeatPath(metaPath), RestoreSpecPath(metaPath)} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) && first == nil {
+			first = err
+		}
+	}
 
-	os.Remove(socketPath)
-	os.Remove(metaPath)
+	m.clearCurrentSessionIf(number)
+	return first
+}
 
-	current, _ := m.GetCurrentSession()
-	if current == number {
-		m.ClearCurrentSession()
+// clearCurrentSessionIf removes the current-session marker if it names
+// number. The check and the removal happen under the lock, so kills running
+// side by side cannot remove a marker another session has just written.
+func (m *Manager) clearCurrentSessionIf(number string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	lock, err := m.acquireLock()
+	if err != nil {
+		return
+	}
+	defer lock.Release()
+
+	if info, err := m.readCurrentSessionInfo(); err == nil && info != nil && info.Number == number {
+		os.Remove(filepath.Join(m.baseDir, currentFile))
 	}
 }
 
@@ -365,3 +621,115 @@ func (m *Manager) NormalizeSessionNumber(number string) string {
 	}
 	return fmt.Sprintf("%03d", num)
 }
+
+// SessionCwd returns the current working directory of the session's shell.
+func (m *Manager) SessionCwd(number string) (string, error) {
+	session, err := m.GetSession(number)
+	if err != nil {
+		return "", err
+	}
+
+	cwd, err := platform.ProcessCwd(session.PID)
+	if err != nil {
+		return "", fmt.Errorf("failed to determine cwd of session %s: %w", number, err)
+	}
+	return cwd, nil
+}
+
+// SessionEnv returns the environment of the session's shell as KEY=VALUE
+// entries.
+func (m *Manager) SessionEnv(number string) ([]string, error) {
+	session, err := m.GetSession(number)
+	if err != nil {
+		return nil, err
+	}
+
+	env, err := platform.ProcessEnv(session.PID)
+	if err != nil {
+		if os.IsPermission(err) {
+			return nil, fmt.Errorf("cannot read environment of session %s (pid %d): %w", number, session.PID, os.ErrPermission)
+		}
+		return nil, fmt.Errorf("cannot read environment of session %s: %w", number, err)
+	}
+	return env, nil
+}
+
+// Resources is the CPU and memory use of a session's process tree.
+type Resources struct {
+	// RSS is the resident memory of the shell and its descendants, in bytes.
+	RSS uint64 `json:"rss"`
+	// CPU is the tree's CPU use over the sampling interval, in percent of
+	// one core.
+	CPU float64 `json:"cpu"`
+	// Processes counts the shell and its descendants.
+	Processes int `json:"processes"`
+}
+
+// SessionResources samples the process trees of sessions twice, interval
+// apart, and returns their usage keyed by session number. It fails with
+// utils.ErrUnsupported where /proc is not available.
+func (m *Manager) SessionResources(sessions []Session, interval time.Duration) (map[string]Resources, error) {
+	before, err := platform.ReadProcStats()
+	if err != nil {
+		return nil, err
+	}
+	time.Sleep(interval)
+	after, err := platform.ReadProcStats()
+	if err != nil {
+		return nil, err
+	}
+
+	page := uint64(os.Getpagesize())
+	usage := make(map[string]Resources, len(sessions))
+	for _, s := range sessions {
+		cpu0, _, _ := treeUsage(before, s.PID)
+		cpu1, rss, procs := treeUsage(after, s.PID)
+		r := Resources{RSS: rss * page, Processes: procs}
+		// Processes that exit between samples can make the sum shrink.
+		if cpu1 > cpu0 {
+			r.CPU = float64(cpu1-cpu0) / platform.ClockTicks / interval.Seconds() * 100
+		}
+		usage[s.Number] = r
+	}
+	return usage, nil
+}
+
+// SetNote stores a free-form note in the session's metadata; an empty note
+// removes it.
+func (m *Manager) SetNote(number, note string) error {
+	return m.updateSession(number, func(s *Session) error {
+		s.Note = note
+		return nil
+	})
+}
+
+// SetDetachKey stores the session's preferred detach key; an empty key
+// removes it. The key is not validated here.
+func (m *Manager) SetDetachKey(number, key string) error {
+	return m.updateSession(number, func(s *Session) error {
+		s.DetachKey = key
+		return nil
+	})
+}
+
+// SetLocked locks or unlocks the session. The daemon checks the lock on
+// every attach.
+func (m *Manager) SetLocked(number string, locked bool) error {
+	return m.updateSession(number, func(s *Session) error {
+		s.Locked = locked
+		return nil
+	})
+}
+
+// updateSession applies fn to a live session's metadata.
+func (m *Manager) updateSession(number string, fn func(*Session) error) error {
+	if _, err := m.GetSession(number); err != nil {
+		return err
+	}
+
+	err := UpdateMetadata(m.GetMetaPath(number), fn)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%w: %s", utils.ErrSessionNotFound, number)
+	}
+	return err
+}
@@ -0,0 +1,60 @@
+package session
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/theMichaelB/sess/internal/utils"
+)
+
+// ownedBy is a file's information as if uid owned it.
+type ownedBy struct {
+	os.FileInfo
+	uid int
+}
+
+func (f ownedBy) Sys() interface{} { return &syscall.Stat_t{Uid: uint32(f.uid)} }
+
+// A state directory, or as root a home directory to create one in, that
+// belongs to another user is refused; one of the user's own is not.
+func TestCheckOwnership(t *testing.T) {
+	home := t.TempDir()
+	base := filepath.Join(home, sessionDir)
+	other := os.Geteuid() + 1000
+	owners := map[string]int{}
+	statFile = func(path string) (os.FileInfo, error) {
+		info, err := os.Stat(path)
+		if uid, ok := owners[path]; ok && err == nil {
+			return ownedBy{info, uid}, nil
+		}
+		return info, err
+	}
+	t.Cleanup(func() { statFile = os.Stat })
+
+	// Without a state directory, only root looks at the home directory.
+	owners[home] = other
+	err := checkOwnership(home, base)
+	if os.Geteuid() == 0 {
+		if !errors.Is(err, utils.ErrPermissionDenied) || !strings.Contains(err.Error(), home+" belongs to ") {
+			t.Errorf("root in another user's home: %v; want it refused", err)
+		}
+	} else if err != nil {
+		t.Errorf("no state directory yet: %v", err)
+	}
+
+	if err := os.Mkdir(base, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkOwnership(home, base); err != nil {
+		t.Errorf("the user's own state directory: %v", err)
+	}
+	owners[base] = other
+	err = checkOwnership(home, base)
+	if !errors.Is(err, utils.ErrPermissionDenied) || !strings.Contains(err.Error(), base+" belongs to ") {
+		t.Errorf("another user's state directory: %v; want it refused", err)
+	}
+}
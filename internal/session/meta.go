@@ -0,0 +1,60 @@
+package session
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+// WriteMetadata replaces the metadata file at path with s. The write is
+// atomic and made under the directory lock.
+func WriteMetadata(path string, s *Session) error {
+	lock, err := acquireLock(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	return writeMetadataUnsafe(path, s)
+}
+
+// UpdateMetadata applies fn to the metadata stored at path and writes the
+// result back. The read-modify-write runs under the directory lock so the
+// daemon and CLI commands never clobber each other's fields. It fails with
+// an os.ErrNotExist error when there is no metadata file.
+func UpdateMetadata(path string, fn func(*Session) error) error {
+	lock, err := acquireLock(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var s Session
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	if err := fn(&s); err != nil {
+		return err
+	}
+
+	return writeMetadataUnsafe(path, &s)
+}
+
+func writeMetadataUnsafe(path string, s *Session) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
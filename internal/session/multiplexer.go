@@ -0,0 +1,92 @@
+package session
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// multiplexerDialTimeout bounds the liveness probe of a tmux server.
+const multiplexerDialTimeout = 200 * time.Millisecond
+
+// Multiplexer is a terminal multiplexer the process runs inside.
+type Multiplexer struct {
+	// Name is "tmux" or "screen".
+	Name string
+	// Detach is the keys that detach from it, as its users know them.
+	Detach string
+}
+
+// EnvMultiplexer returns the tmux or screen session the environment ($TMUX,
+// $STY) says the process runs inside. Like a session named by SESS_NUM,
+// the claim is only trusted if it holds up: $TMUX must name a socket a tmux
+// server accepts connections on, and $STY a screen whose socket is there
+// and whose process still runs. Variables left behind by a multiplexer
+// that has since exited are ignored.
+func EnvMultiplexer() (Multiplexer, bool) {
+	if v := os.Getenv("TMUX"); v != "" {
+		// socket_path,server_pid,session_index
+		socket, _, _ := strings.Cut(v, ",")
+		if socket != "" && tmuxAnswers(socket) {
+			return Multiplexer{Name: "tmux", Detach: "prefix d"}, true
+		}
+	}
+	if sty := os.Getenv("STY"); sty != "" && screenRuns(sty) {
+		return Multiplexer{Name: "screen", Detach: "C-a d"}, true
+	}
+	return Multiplexer{}, false
+}
+
+// tmuxAnswers reports whether a tmux server accepts connections on socket.
+func tmuxAnswers(socket string) bool {
+	conn, err := net.DialTimeout("unix", socket, multiplexerDialTimeout)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// screenRuns reports whether the screen session sty ("pid.tty.host") is
+// still running: its process is alive and its socket is where screen keeps
+// them.
+func screenRuns(sty string) bool {
+	pidStr, _, _ := strings.Cut(sty, ".")
+	pid, err := strconv.Atoi(pidStr)
+	if err != nil || pid <= 0 {
+		return false
+	}
+	if err := syscall.Kill(pid, 0); err != nil && !errors.Is(err, syscall.EPERM) {
+		return false
+	}
+	for _, dir := range screenDirs() {
+		if _, err := os.Lstat(filepath.Join(dir, sty)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// screenDirs lists where screen may keep the user's sockets, depending on
+// how it was built and configured.
+func screenDirs() []string {
+	if dir := os.Getenv("SCREENDIR"); dir != "" {
+		return []string{dir}
+	}
+	user := os.Getenv("USER")
+	dirs := []string{
+		"/run/screen/S-" + user,
+		"/var/run/screen/S-" + user,
+		"/tmp/screens/S-" + user,
+		"/tmp/uscreens/S-" + user,
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		dirs = append(dirs, filepath.Join(home, ".screen"))
+	}
+	return dirs
+}
@@ -0,0 +1,49 @@
+package session
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEnvMultiplexer(t *testing.T) {
+	dir := t.TempDir()
+	socket := filepath.Join(dir, "default")
+	t.Setenv("STY", "")
+
+	// A $TMUX left behind by a server that has gone.
+	t.Setenv("TMUX", socket+",4242,0")
+	if mux, ok := EnvMultiplexer(); ok {
+		t.Errorf("EnvMultiplexer = %+v with no tmux server", mux)
+	}
+
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	if mux, ok := EnvMultiplexer(); !ok || mux.Name != "tmux" {
+		t.Errorf("EnvMultiplexer = %+v, %v inside a live tmux", mux, ok)
+	}
+
+	// screen: the process and its socket must both be there.
+	t.Setenv("TMUX", "")
+	t.Setenv("SCREENDIR", dir)
+	sty := fmt.Sprintf("%d.pts-0.host", os.Getpid())
+	t.Setenv("STY", sty)
+	if mux, ok := EnvMultiplexer(); ok {
+		t.Errorf("EnvMultiplexer = %+v with no screen socket", mux)
+	}
+	if err := os.WriteFile(filepath.Join(dir, sty), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if mux, ok := EnvMultiplexer(); !ok || mux.Name != "screen" {
+		t.Errorf("EnvMultiplexer = %+v, %v inside a live screen", mux, ok)
+	}
+	t.Setenv("STY", "999999999.pts-0.host")
+	if mux, ok := EnvMultiplexer(); ok {
+		t.Errorf("EnvMultiplexer = %+v for a screen whose process is gone", mux)
+	}
+}
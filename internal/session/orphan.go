@@ -0,0 +1,172 @@
+package session
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/theMichaelB/sess/internal/platform"
+)
+
+// daemonArg is the argument that marks a sess process as a daemon.
+const daemonArg = "--daemon"
+
+// orphanGrace is how long a daemon has after starting to write its
+// metadata before FindOrphans counts it missing. Tests shorten it.
+var orphanGrace = 5 * time.Second
+
+// Orphan is a daemon running one of this directory's sessions that sess
+// can no longer reach: its metadata or socket is gone, as after the state
+// directory was removed, or is another session's now.
+type Orphan struct {
+	DaemonPID  int
+	Number     string
+	SocketPath string
+	MetaPath   string
+	// Command is what the session runs, as the daemon was told.
+	Command []string
+	// Problem says what is wrong, as "its metadata and socket are gone".
+	Problem string
+	// Taken is set when another session has the number now; the orphan
+	// can only be killed then.
+	Taken bool
+}
+
+// FindOrphans scans the running processes for daemons of this directory's
+// sessions, known by their --daemon arguments, and returns those sess can
+// no longer reach, ordered by number. It fails with utils.ErrUnsupported
+// where the processes' arguments cannot be read.
+func (m *Manager) FindOrphans() ([]Orphan, error) {
+	pids, err := platform.Processes()
+	if err != nil {
+		return nil, err
+	}
+	var orphans []Orphan
+	for _, pid := range pids {
+		if pid == os.Getpid() || syscall.Kill(pid, 0) != nil || platform.ProcessZombie(pid) {
+			continue
+		}
+		argv, err := platform.ProcessArgs(pid)
+		if err != nil {
+			continue
+		}
+		o, ok := parseDaemonArgs(argv)
+		if !ok || filepath.Clean(filepath.Dir(o.MetaPath)) != filepath.Clean(m.baseDir) {
+			continue
+		}
+		if start, err := platform.ProcessStartTime(pid); err == nil && time.Since(start) < orphanGrace {
+			continue
+		}
+		o.DaemonPID = pid
+		if m.diagnoseOrphan(&o) {
+			orphans = append(orphans, o)
+		}
+	}
+	sort.Slice(orphans, func(i, j int) bool { return orphans[i].Number < orphans[j].Number })
+	return orphans, nil
+}
+
+// parseDaemonArgs reads the session a daemon serves from its arguments:
+// those after --daemon, up to the "--" before the command.
+func parseDaemonArgs(argv []string) (Orphan, bool) {
+	var o Orphan
+	i := 1
+	for i < len(argv) && argv[i] != daemonArg {
+		i++
+	}
+	if i == len(argv) {
+		return o, false
+	}
+	for i++; i < len(argv); i++ {
+		if argv[i] == "--" {
+			o.Command = argv[i+1:]
+			break
+		}
+		if i+1 == len(argv) {
+			break
+		}
+		switch argv[i] {
+		case "-num":
+			o.Number = argv[i+1]
+		case "-socket":
+			o.SocketPath = argv[i+1]
+		case "-meta":
+			o.MetaPath = argv[i+1]
+		default:
+			continue
+		}
+		i++
+	}
+	return o, o.Number != "" && o.MetaPath != "" && o.SocketPath != ""
+}
+
+// diagnoseOrphan fills in what is wrong with the daemon o describes, and
+// reports whether anything is.
+func (m *Manager) diagnoseOrphan(o *Orphan) bool {
+	var s Session
+	if readJSON(o.MetaPath, &s) && s.DaemonPID != 0 && s.DaemonPID != o.DaemonPID {
+		o.Taken = true
+		o.Problem = fmt.Sprintf("session %s is another daemon's (pid %d) now", o.Number, s.DaemonPID)
+		return true
+	}
+	var gone []string
+	if _, err := os.Lstat(o.MetaPath); os.IsNotExist(err) {
+		gone = append(gone, "metadata")
+	}
+	if _, err := os.Lstat(o.SocketPath); os.IsNotExist(err) {
+		gone = append(gone, "socket")
+	}
+	switch len(gone) {
+	case 0:
+		return false
+	case 1:
+		o.Problem = "its " + gone[0] + " is gone"
+	default:
+		o.Problem = "its " + strings.Join(gone, " and ") + " are gone"
+	}
+	return true
+}
+
+// Reregister has the daemon of o put its socket and metadata back, with
+// the SIGUSR1 it answers by doing so, and waits up to timeout for sess to
+// reach the session again. A daemon whose number is taken cannot, and one
+// from a sess that predates SIGUSR1 would end instead, as the signal's
+// default has it.
+func (m *Manager) Reregister(o Orphan, timeout time.Duration) error {
+	if o.Taken {
+		return fmt.Errorf("session %s: %s; it can only be killed", o.Number, o.Problem)
+	}
+	if err := syscall.Kill(o.DaemonPID, syscall.SIGUSR1); err != nil {
+		return fmt.Errorf("session %s: daemon (pid %d): %w", o.Number, o.DaemonPID, err)
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		var s Session
+		if readJSON(o.MetaPath, &s) && s.DaemonPID == o.DaemonPID && !socketGone(o.SocketPath) {
+			return nil
+		}
+		if !m.isProcessAlive(o.DaemonPID) {
+			return fmt.Errorf("session %s: daemon (pid %d) ended", o.Number, o.DaemonPID)
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("session %s: daemon (pid %d) did not put its state back; its log may say why", o.Number, o.DaemonPID)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// KillOrphan ends the daemon of o, which ends its session's command in
+// turn, SIGTERM first and then, grace later, SIGKILL. A daemon ending
+// leaves alone files that another session now has.
+func (m *Manager) KillOrphan(o Orphan, grace time.Duration) error {
+	seq := KillSequence{Signals: []syscall.Signal{syscall.SIGTERM, syscall.SIGKILL}, Grace: grace}
+	if err := m.endProcess(o.DaemonPID, false, seq); err != nil && !errors.Is(err, errAlreadyGone) {
+		return fmt.Errorf("session %s: daemon (pid %d): %w", o.Number, o.DaemonPID, err)
+	}
+	return nil
+}
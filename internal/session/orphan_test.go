@@ -0,0 +1,95 @@
+package session
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/theMichaelB/sess/internal/utils"
+)
+
+func TestParseDaemonArgs(t *testing.T) {
+	argv := []string{"/usr/bin/sess", "--daemon", "-num", "003", "-socket", "/s/session-003.sock",
+		"-meta", "/s/session-003.meta", "-rows", "24", "-transient", "--", "bash", "-num", "1"}
+	o, ok := parseDaemonArgs(argv)
+	want := Orphan{Number: "003", SocketPath: "/s/session-003.sock", MetaPath: "/s/session-003.meta", Command: []string{"bash", "-num", "1"}}
+	if !ok || !reflect.DeepEqual(o, want) {
+		t.Errorf("parseDaemonArgs = %+v, %v; want %+v", o, ok, want)
+	}
+	for _, argv := range [][]string{
+		{"/usr/bin/sess", "ls"},
+		{"/usr/bin/sess", "--daemon", "-num", "003"},
+		{"vim", "--", "--daemon", "-num"},
+	} {
+		if o, ok := parseDaemonArgs(argv); ok {
+			t.Errorf("parseDaemonArgs(%q) = %+v; want no daemon", argv, o)
+		}
+	}
+}
+
+// Daemons of this directory's sessions whose metadata and socket are gone,
+// or another session's, are found by their arguments, and can be killed.
+func TestFindOrphans(t *testing.T) {
+	m := newTestManager(t)
+	orphanGrace = 0
+	t.Cleanup(func() { orphanGrace = 5 * time.Second })
+	fakeDaemon := func(number string) *exec.Cmd {
+		t.Helper()
+		// sh waits on sleep, and keeps the rest as its arguments.
+		cmd := exec.Command("sh", "-c", "sleep 30; exit 0", "sess", "--daemon", "-num", number,
+			"-socket", m.GetSocketPath(number), "-meta", m.GetMetaPath(number), "--", "bash")
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			cmd.Process.Kill()
+			cmd.Wait()
+		})
+		return cmd
+	}
+	gone := fakeDaemon("001")
+	taken := fakeDaemon("002")
+	if err := WriteMetadata(m.GetMetaPath("002"), &Session{Number: "002", DaemonPID: os.Getpid()}); err != nil {
+		t.Fatal(err)
+	}
+
+	var orphans []Orphan
+	var err error
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		orphans, err = m.FindOrphans()
+		if errors.Is(err, utils.ErrUnsupported) {
+			t.Skip("processes' arguments cannot be read here")
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Until sh has started, its arguments are the test binary's.
+		if len(orphans) == 2 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if len(orphans) != 2 {
+		t.Fatalf("FindOrphans = %+v; want sessions 001 and 002", orphans)
+	}
+	if o := orphans[0]; o.Number != "001" || o.DaemonPID != gone.Process.Pid || o.Taken || o.Problem != "its metadata and socket are gone" || !reflect.DeepEqual(o.Command, []string{"bash"}) {
+		t.Errorf("session 001 = %+v", o)
+	}
+	if o := orphans[1]; o.Number != "002" || o.DaemonPID != taken.Process.Pid || !o.Taken {
+		t.Errorf("session 002 = %+v; want it taken by another daemon", o)
+	}
+	if err := m.Reregister(orphans[1], time.Second); err == nil {
+		t.Error("Reregister put back a session whose number is taken")
+	}
+
+	if err := m.KillOrphan(orphans[0], time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if m.isProcessAlive(gone.Process.Pid) && !m.waitForExit(gone.Process.Pid, time.Second) {
+		t.Error("the orphaned daemon was not killed")
+	}
+}
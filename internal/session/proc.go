@@ -0,0 +1,25 @@
+package session
+
+import "github.com/theMichaelB/sess/internal/platform"
+
+// treeUsage sums CPU ticks and resident pages over root and its descendants.
+func treeUsage(stats map[int]platform.ProcStat, root int) (cpuTicks, rssPages uint64, procs int) {
+	children := make(map[int][]int)
+	for pid, st := range stats {
+		children[st.PPID] = append(children[st.PPID], pid)
+	}
+	queue := []int{root}
+	for len(queue) > 0 {
+		pid := queue[0]
+		queue = queue[1:]
+		st, ok := stats[pid]
+		if !ok {
+			continue
+		}
+		cpuTicks += st.CPUTicks
+		rssPages += st.RSSPages
+		procs++
+		queue = append(queue, children[pid]...)
+	}
+	return cpuTicks, rssPages, procs
+}
@@ -0,0 +1,75 @@
+package session
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+)
+
+// ownedFilePattern matches the names of files sess creates in its directory,
+// including the temporary files of its atomic writes.
+var ownedFilePattern = regexp.MustCompile(`^(session-\d{3,}\.(sock|meta|alive|claim|env|exit|restore|restoring|scrollback|daemon\.out|log|exited-\d{8}T\d{6}\.log|input\.log|input\.exited-\d{8}T\d{6}\.log)|\.current_session|\.history|\.lock)(\.tmp)?$`)
+
+// ownedFile reports whether name is a file sess creates in its directory.
+func ownedFile(name string) bool {
+	return ownedFilePattern.MatchString(name)
+}
+
+// Dir returns the directory the manager keeps its state in.
+func (m *Manager) Dir() string {
+	return m.baseDir
+}
+
+// Purge removes every file sess owns from the base directory, and the
+// directory itself once it is empty, along with the socket directory when
+// sockets are kept apart. It does not stop sessions; kill them
+// first. Files sess does not recognise are left alone and returned in kept.
+func (m *Manager) Purge() (removed, kept []string, err error) {
+	lock, err := m.acquireLock()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	entries, err := os.ReadDir(m.baseDir)
+	if err != nil {
+		lock.Release()
+		return nil, nil, err
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if name == lockFile {
+			continue
+		}
+		if e.IsDir() || !ownedFile(name) {
+			kept = append(kept, name)
+			continue
+		}
+		path := filepath.Join(m.baseDir, name)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			lock.Release()
+			return removed, kept, err
+		}
+		removed = append(removed, path)
+	}
+	if m.socketDir != m.baseDir {
+		sockets, _ := filepath.Glob(filepath.Join(m.socketDir, "session-*.sock"))
+		for _, path := range sockets {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				lock.Release()
+				return removed, kept, err
+			}
+			removed = append(removed, path)
+		}
+		os.Remove(m.socketDir)
+	}
+	lock.Release()
+
+	if len(kept) == 0 {
+		// Fails harmlessly if something was created meanwhile.
+		os.Remove(m.baseDir)
+	}
+	sort.Strings(removed)
+	sort.Strings(kept)
+	return removed, kept, nil
+}
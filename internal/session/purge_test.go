@@ -0,0 +1,64 @@
+package session
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Purge removes the files sess owns and nothing else: what it does not
+// recognise, and any directory, is kept and reported, and the base
+// directory stays while they are in it.
+func TestPurge(t *testing.T) {
+	m := newTestManager(t)
+	dir := m.Dir()
+	owned := []string{"session-001.meta", "session-001.alive", "session-001.exited-20260101T000000.log", "session-002.exit", ".history", "session-003.env.tmp"}
+	for _, name := range append(owned, "notes.txt", "session-001.meta.bak") {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Named like a file sess owns, but a directory, which it never makes.
+	if err := os.Mkdir(filepath.Join(dir, "session-004.log"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, kept, err := m.Purge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want []string
+	for _, name := range []string{".history", "session-001.alive", "session-001.exited-20260101T000000.log", "session-001.meta", "session-002.exit", "session-003.env.tmp"} {
+		want = append(want, filepath.Join(dir, name))
+	}
+	if !reflect.DeepEqual(removed, want) {
+		t.Errorf("removed %q; want %q", removed, want)
+	}
+	if want := []string{"notes.txt", "session-001.meta.bak", "session-004.log"}; !reflect.DeepEqual(kept, want) {
+		t.Errorf("kept %q; want %q", kept, want)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("the base directory was removed with files in it: %v", err)
+	}
+	var left []string
+	for _, e := range entries {
+		left = append(left, e.Name())
+	}
+	if !reflect.DeepEqual(left, kept) {
+		t.Errorf("left %q in the base directory; want only what was kept", left)
+	}
+
+	for _, name := range kept {
+		if err := os.RemoveAll(filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, kept, err := m.Purge(); err != nil || len(kept) != 0 {
+		t.Fatalf("Purge = %q, %v", kept, err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("the empty base directory was left: %v", err)
+	}
+}
@@ -0,0 +1,48 @@
+package session
+
+import (
+	"path/filepath"
+	"strconv"
+)
+
+// remote reports whether session s runs on another host, which happens
+// when the state directory is on a network filesystem several machines
+// mount. Its process IDs mean nothing here and its socket cannot be
+// reached from here, so it is neither used nor judged dead.
+func (m *Manager) remote(s *Session) bool {
+	return m.network && s.Host != "" && s.Host != m.host
+}
+
+// metaRemote reports whether the metadata at path is of a session another
+// host runs.
+func (m *Manager) metaRemote(path string) bool {
+	var s Session
+	return m.network && readJSON(path, &s) && m.remote(&s)
+}
+
+// remoteSpec reports whether the restore spec was written on another host,
+// as remote judges sessions.
+func (m *Manager) remoteSpec(spec *RestoreSpec) bool {
+	return m.network && spec.Host != "" && spec.Host != m.host
+}
+
+// maxRemoteNumberUnsafe returns the highest number of a session another
+// host runs, or 0; those numbers are not free here either. Must hold the
+// lock.
+func (m *Manager) maxRemoteNumberUnsafe() int {
+	if !m.network {
+		return 0
+	}
+	metas, _ := filepath.Glob(filepath.Join(m.baseDir, "session-*.meta"))
+	maxNum := 0
+	for _, metaPath := range metas {
+		var s Session
+		if !readJSON(metaPath, &s) || !m.remote(&s) {
+			continue
+		}
+		if num, err := strconv.Atoi(s.Number); err == nil && num > maxNum {
+			maxNum = num
+		}
+	}
+	return maxNum
+}
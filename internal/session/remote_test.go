@@ -0,0 +1,72 @@
+package session
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/theMichaelB/sess/internal/utils"
+)
+
+// On a state directory other hosts share, their sessions are left alone:
+// not listed as running, not buried and not given out again.
+func TestRemoteSessions(t *testing.T) {
+	m := newTestManager(t)
+	m.network = true
+	gone := exec.Command("true")
+	if err := gone.Run(); err != nil {
+		t.Fatal(err)
+	}
+	dead := gone.Process.Pid
+
+	// A session whose PIDs, read on this host, are those of a dead
+	// daemon: sweeping would bury it if it were this host's.
+	metaPath := m.GetMetaPath("004")
+	if err := WriteMetadata(metaPath, &Session{Number: "004", PID: dead, DaemonPID: dead, CreatedAt: time.Now(), Host: "buildbox"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteHeartbeat(HeartbeatPath(metaPath)); err != nil {
+		t.Fatal(err)
+	}
+	m.sweep()
+	if _, err := os.Stat(HeartbeatPath(metaPath)); err != nil {
+		t.Errorf("another host's session was buried: %v", err)
+	}
+
+	if _, err := m.GetSession("004"); !errors.Is(err, utils.ErrSessionRemote) {
+		t.Errorf("GetSession = %v; want ErrSessionRemote", err)
+	}
+	if sessions, err := m.ListSessions(); err != nil || len(sessions) != 0 {
+		t.Errorf("ListSessions = %+v, %v; want none", sessions, err)
+	}
+	records, err := m.ListAllSessions()
+	if err != nil || len(records) != 1 || records[0].State != StateRemote {
+		t.Errorf("ListAllSessions = %+v, %v; want session 004 remote", records, err)
+	}
+	if _, kept, err := m.Clean(); err != nil || len(kept) != 0 {
+		t.Errorf("Clean = %v, %v", kept, err)
+	}
+	if _, err := os.Stat(metaPath); err != nil {
+		t.Errorf("sess clean removed another host's session: %v", err)
+	}
+
+	if _, err := m.ReserveSession("004"); !errors.Is(err, utils.ErrSessionExists) {
+		t.Errorf("reserving 004 = %v; want ErrSessionExists", err)
+	}
+	number, err := m.ReserveSession("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.ReleaseReservation(number)
+	if number != "005" {
+		t.Errorf("reserved %s; want 005", number)
+	}
+
+	// On a local directory, the host is not looked at.
+	m.network = false
+	if _, err := m.GetSession("004"); !errors.Is(err, utils.ErrSessionDead) {
+		t.Errorf("GetSession on a local directory = %v; want ErrSessionDead", err)
+	}
+}
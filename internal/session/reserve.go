@@ -0,0 +1,116 @@
+package session
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/theMichaelB/sess/internal/utils"
+)
+
+// claimTimeout bounds how long a reservation holds a number whose creator
+// is still alive but never started a daemon.
+const claimTimeout = 30 * time.Second
+
+// claim records who reserved a session number and when.
+type claim struct {
+	PID       int       `json:"pid"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (m *Manager) claimPath(number string) string {
+	return filepath.Join(m.baseDir, fmt.Sprintf(sessionPattern+".claim", number))
+}
+
+// ReserveSession claims a session number for a daemon about to be started,
+// so that concurrent creators never race for the same number. An empty
+// number reserves the next free one. It fails with utils.ErrSessionExists
+// if the number is live or already reserved. The claim is dropped by
+// ReleaseReservation once the daemon is up (or failed to start).
+func (m *Manager) ReserveSession(number string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	lock, err := m.acquireLock()
+	if err != nil {
+		return "", err
+	}
+	defer lock.Release()
+
+	if number == "" {
+		next, err := m.nextFreeNumberUnsafe()
+		if err != nil {
+			return "", err
+		}
+		number = next
+	} else if m.metaAlive(m.GetMetaPath(number)) || m.claimAlive(number) {
+		return "", fmt.Errorf("%w: %s", utils.ErrSessionExists, number)
+	}
+
+	data, err := json.Marshal(claim{PID: os.Getpid(), CreatedAt: time.Now()})
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(m.claimPath(number), data, 0600); err != nil {
+		return "", err
+	}
+	return number, nil
+}
+
+// ReleaseReservation drops the claim ReserveSession made on number.
+func (m *Manager) ReleaseReservation(number string) {
+	os.Remove(m.claimPath(number))
+}
+
+// claimAlive reports whether number is reserved by a live creator.
+func (m *Manager) claimAlive(number string) bool {
+	data, err := os.ReadFile(m.claimPath(number))
+	if err != nil {
+		return false
+	}
+	var c claim
+	if err := json.Unmarshal(data, &c); err != nil {
+		return false
+	}
+	return time.Since(c.CreatedAt) < claimTimeout && m.isProcessAlive(c.PID)
+}
+
+// nextFreeNumberUnsafe returns one past the highest live or reserved
+// session number, or that of a session awaiting sess restore or running on
+// another host. Must hold the lock.
+func (m *Manager) nextFreeNumberUnsafe() (string, error) {
+	sessions, err := m.listSessionsUnsafe()
+	if err != nil {
+		return "", err
+	}
+
+	maxNum := m.maxRemoteNumberUnsafe()
+	for _, session := range sessions {
+		num, err := strconv.Atoi(session.Number)
+		if err == nil && num > maxNum {
+			maxNum = num
+		}
+	}
+
+	claims, _ := filepath.Glob(filepath.Join(m.baseDir, "session-*.claim"))
+	for _, path := range claims {
+		number := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), "session-"), ".claim")
+		num, err := strconv.Atoi(number)
+		if err == nil && num > maxNum && m.claimAlive(number) {
+			maxNum = num
+		}
+	}
+
+	// Numbers of sessions lost to a reboot are held for sess restore.
+	for _, number := range m.lostNumbersUnsafe() {
+		if num, err := strconv.Atoi(number); err == nil && num > maxNum {
+			maxNum = num
+		}
+	}
+
+	return fmt.Sprintf("%03d", maxNum+1), nil
+}
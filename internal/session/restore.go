@@ -0,0 +1,177 @@
+package session
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/theMichaelB/sess/internal/platform"
+)
+
+// RestoreSpec is how a session was created, kept so that sess restore can
+// create it again once a reboot or a crash has taken it. The manager writes
+// one when it creates a session, and it is removed when the session is
+// killed or its command ends by itself; only a session lost with its
+// machine leaves it behind.
+type RestoreSpec struct {
+	Number    string    `json:"session_num"`
+	CreatedAt time.Time `json:"created_at"`
+	// BootID identifies the boot the session was created in; see
+	// platform.BootID.
+	BootID string   `json:"boot_id,omitempty"`
+	Argv   []string `json:"argv"`
+	Dir    string   `json:"dir,omitempty"`
+	// Env holds the KEY=VALUE variables given on top of the environment
+	// the command started with, and EnvMode how that was chosen, as in
+	// Session.EnvMode. Variables pushed later with setenv are not kept.
+	Env     []string `json:"env,omitempty"`
+	EnvMode string   `json:"env_mode,omitempty"`
+	Rows    int      `json:"rows,omitempty"`
+	Cols    int      `json:"cols,omitempty"`
+
+	Log              bool          `json:"log,omitempty"`
+	LogInput         bool          `json:"log_input,omitempty"`
+	Termios          string        `json:"termios,omitempty"`
+	Rlimits          []string      `json:"rlimits,omitempty"`
+	NoOOMProtect     bool          `json:"no_oom_protect,omitempty"`
+	ThrottleDetached bool          `json:"throttle_detached,omitempty"`
+	Timeout          time.Duration `json:"timeout,omitempty"`
+	Respawn          string        `json:"respawn,omitempty"`
+	Definition       string        `json:"definition,omitempty"`
+	// Host is the machine the spec was written on; only that one
+	// restores it.
+	Host string `json:"host,omitempty"`
+}
+
+// RestoreSpecPath returns the restore spec kept next to the metadata at
+// metaPath.
+func RestoreSpecPath(metaPath string) string {
+	return strings.TrimSuffix(metaPath, ".meta") + ".restore"
+}
+
+// WriteRestoreSpec records spec at path, readable only by the owner: the
+// variables in it may be secrets. It fills in the host if spec has none.
+func WriteRestoreSpec(path string, spec *RestoreSpec) error {
+	if spec.Host == "" {
+		spec.Host, _ = os.Hostname()
+	}
+	data, err := json.MarshalIndent(spec, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// RestoreSpecs returns the sessions lost to a reboot, oldest number first:
+// those whose restore spec was written in an earlier boot. Specs left from
+// this boot by sessions no longer running are removed, as those sessions
+// were not lost with the machine. Where the boot cannot be told, every spec
+// of a session not running counts as lost.
+func (m *Manager) RestoreSpecs() ([]RestoreSpec, error) {
+	paths, err := filepath.Glob(filepath.Join(m.baseDir, "session-*.restore"))
+	if err != nil {
+		return nil, err
+	}
+	boot, _ := platform.BootID()
+	var specs []RestoreSpec
+	for _, path := range paths {
+		var spec RestoreSpec
+		if !readJSON(path, &spec) || spec.Number == "" || m.remoteSpec(&spec) {
+			continue
+		}
+		if !lostSpec(&spec, boot) {
+			if m.specRunning(path, &spec) {
+				continue
+			}
+			if boot != "" {
+				os.Remove(path)
+				continue
+			}
+		}
+		specs = append(specs, spec)
+	}
+	sort.Slice(specs, func(i, j int) bool { return specs[i].Number < specs[j].Number })
+	return specs, nil
+}
+
+// lostSpec reports whether spec was written in a boot before boot, the
+// current one.
+func lostSpec(spec *RestoreSpec, boot string) bool {
+	return boot != "" && spec.BootID != "" && spec.BootID != boot
+}
+
+// specRunning reports whether the session the restore spec at path was
+// written for is still running.
+func (m *Manager) specRunning(path string, spec *RestoreSpec) bool {
+	metaPath := strings.TrimSuffix(path, ".restore") + ".meta"
+	var s Session
+	return readJSON(metaPath, &s) && s.CreatedAt.Equal(spec.CreatedAt) && m.isProcessAlive(s.PID)
+}
+
+// lostNumbersUnsafe returns the numbers of sessions lost to a reboot, which
+// are kept free for sess restore to give back, here or on the host that
+// wrote their spec. Must hold the lock.
+func (m *Manager) lostNumbersUnsafe() []string {
+	boot, _ := platform.BootID()
+	if boot == "" {
+		return nil
+	}
+	paths, _ := filepath.Glob(filepath.Join(m.baseDir, "session-*.restore"))
+	var numbers []string
+	for _, path := range paths {
+		var spec RestoreSpec
+		if readJSON(path, &spec) && (lostSpec(&spec, boot) || m.remoteSpec(&spec)) {
+			numbers = append(numbers, spec.Number)
+		}
+	}
+	return numbers
+}
+
+// TakeRestoreSpec claims the restore spec of session number, written for
+// the session created at createdAt, so that of two restores running at
+// once only one starts the session again: the spec is moved aside until
+// release is called, which removes it if the session was restored and puts
+// it back otherwise. It fails with an error wrapping os.ErrNotExist if the
+// spec is gone or has been replaced.
+func (m *Manager) TakeRestoreSpec(number string, createdAt time.Time) (release func(restored bool), err error) {
+	path := RestoreSpecPath(m.GetMetaPath(number))
+	taken := strings.TrimSuffix(path, ".restore") + ".restoring"
+	if err := os.Rename(path, taken); err != nil {
+		return nil, err
+	}
+	var spec RestoreSpec
+	if !readJSON(taken, &spec) || !spec.CreatedAt.Equal(createdAt) {
+		os.Rename(taken, path)
+		return nil, fmt.Errorf("%w: the restore spec of session %s has been replaced", os.ErrNotExist, number)
+	}
+	return func(restored bool) {
+		if restored {
+			os.Remove(taken)
+		} else {
+			os.Rename(taken, path)
+		}
+	}, nil
+}
+
+// DropRestoreSpec removes the restore spec of session number, if it was
+// written for the session created at createdAt; a session since created
+// under the number keeps its own.
+func (m *Manager) DropRestoreSpec(number string, createdAt time.Time) error {
+	path := RestoreSpecPath(m.GetMetaPath(number))
+	var spec RestoreSpec
+	if !readJSON(path, &spec) || !spec.CreatedAt.Equal(createdAt) {
+		return nil
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package session
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strings"
+)
+
+// ScrollbackPath returns where the session with the metadata at metaPath
+// leaves its scrollback when it ends, if it keeps it.
+func ScrollbackPath(metaPath string) string {
+	return strings.TrimSuffix(metaPath, ".meta") + ".scrollback"
+}
+
+// tailBlock is how much of a file CopyTail reads at a time when looking
+// for line breaks from the end.
+const tailBlock = 64 << 10
+
+// CopyTail writes the end of the file at path to w: its last lastLines
+// lines if that is positive, else its last lastBytes bytes if that is
+// positive, else all of it. A final newline ends the last line rather than
+// starting an empty one. It returns how many bytes it wrote.
+func CopyTail(w io.Writer, path string, lastBytes, lastLines int) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := info.Size()
+
+	from := int64(0)
+	switch {
+	case lastLines > 0:
+		from, err = lineStart(f, size, lastLines)
+		if err != nil {
+			return 0, err
+		}
+	case lastBytes > 0 && int64(lastBytes) < size:
+		from = size - int64(lastBytes)
+	}
+	return io.Copy(w, io.NewSectionReader(f, from, size-from))
+}
+
+// lineStart returns the offset at which the last n lines of f begin.
+func lineStart(f *os.File, size int64, n int) (int64, error) {
+	end := size
+	if end > 0 {
+		var last [1]byte
+		if _, err := f.ReadAt(last[:], end-1); err != nil {
+			return 0, err
+		}
+		if last[0] == '\n' {
+			end--
+		}
+	}
+	buf := make([]byte, tailBlock)
+	for pos := end; pos > 0; {
+		start := max(pos-tailBlock, 0)
+		block := buf[:pos-start]
+		if _, err := f.ReadAt(block, start); err != nil {
+			return 0, err
+		}
+		for i := len(block); i > 0; {
+			i = bytes.LastIndexByte(block[:i], '\n')
+			if i < 0 {
+				break
+			}
+			if n--; n == 0 {
+				return start + int64(i) + 1, nil
+			}
+		}
+		pos = start
+	}
+	return 0, nil
+}
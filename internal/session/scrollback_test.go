@@ -0,0 +1,45 @@
+package session
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCopyTail(t *testing.T) {
+	// Long enough that line breaks are found across read blocks.
+	long := strings.Repeat("x", tailBlock+10)
+	tests := []struct {
+		name         string
+		content      string
+		bytes, lines int
+		want         string
+	}{
+		{"all", "a\nb\nc\n", 0, 0, "a\nb\nc\n"},
+		{"last lines", "a\nb\nc\n", 0, 2, "b\nc\n"},
+		{"last line unterminated", "a\nb\nc", 0, 2, "b\nc"},
+		{"more lines than held", "a\nb\n", 0, 5, "a\nb\n"},
+		{"lines win over bytes", "a\nb\nc\n", 1, 1, "c\n"},
+		{"last bytes", "a\nb\nc\n", 4, 0, "b\nc\n"},
+		{"more bytes than held", "abc", 10, 0, "abc"},
+		{"empty", "", 0, 3, ""},
+		{"line across blocks", "a\n" + long + "\nb\n", 0, 2, long + "\nb\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "session-001.scrollback")
+			if err := os.WriteFile(path, []byte(tt.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			var out strings.Builder
+			n, err := CopyTail(&out, path, tt.bytes, tt.lines)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if out.String() != tt.want || n != int64(len(tt.want)) {
+				t.Errorf("CopyTail(bytes %d, lines %d) = %q, %d; want %q", tt.bytes, tt.lines, out.String(), n, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package session
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/theMichaelB/sess/internal/platform"
+)
+
+// longestSocketName is the longest socket name socketDir makes room for;
+// session numbers have never needed more than five digits.
+const longestSocketName = "session-99999.sock"
+
+// socketDir returns the directory the sockets of the sessions kept in
+// baseDir go in. That is baseDir itself unless it is on a network
+// filesystem (network), where sockets are unreliable and other machines
+// would see them, or a socket path there would be longer than a unix
+// socket address holds, as under a deep home directory. The sockets then
+// go in a directory of their own under $TMPDIR/sess-<uid>, named after
+// baseDir so that two state directories never share one.
+func socketDir(baseDir string, network bool) (string, error) {
+	var why string
+	switch {
+	case network:
+		why = baseDir + " is on a network filesystem"
+	case len(filepath.Join(baseDir, longestSocketName)) > platform.MaxSocketPath:
+		why = "socket paths in " + baseDir + " would be too long"
+	default:
+		return baseDir, nil
+	}
+	sum := sha256.Sum256([]byte(baseDir))
+	parent := filepath.Join(os.TempDir(), fmt.Sprintf("sess-%d", os.Getuid()))
+	dir := filepath.Join(parent, hex.EncodeToString(sum[:8]))
+	if len(filepath.Join(dir, longestSocketName)) > platform.MaxSocketPath {
+		return "", fmt.Errorf("%s, and socket paths in %s would be longer than the %d bytes a unix socket path may have; set TMPDIR to a shorter directory",
+			why, dir, platform.MaxSocketPath)
+	}
+	// The parent is where shared sockets go too; it is made as
+	// sess share makes it, so that either may come first.
+	if err := ownDir(parent, 0711); err != nil {
+		return "", fmt.Errorf("%s, and %w", why, err)
+	}
+	if err := ownDir(dir, 0700); err != nil {
+		return "", fmt.Errorf("%s, and %w", why, err)
+	}
+	return dir, nil
+}
+
+// ownDir makes dir with mode perm if it is missing. One that exists must
+// be a directory of ours, so that nobody can plant it for us in a shared
+// /tmp.
+func ownDir(dir string, perm os.FileMode) error {
+	if err := os.Mkdir(dir, perm); err != nil && !os.IsExist(err) {
+		return fmt.Errorf("cannot create %s: %w", dir, err)
+	}
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !info.IsDir() || (ok && int(st.Uid) != os.Getuid()) {
+		return fmt.Errorf("%s is not a directory owned by you", dir)
+	}
+	if info.Mode().Perm()&^perm != 0 {
+		return os.Chmod(dir, perm)
+	}
+	return nil
+}
+
+// socketPath returns the socket of the session whose metadata is at
+// metaPath. A daemon listening outside the state directory records its
+// socket in the metadata, which is believed first: where the socket
+// directory is depends on TMPDIR, which the sess started the daemon may
+// have seen differently.
+func (m *Manager) socketPath(metaPath string) string {
+	if m.socketDir != m.baseDir {
+		var s Session
+		if readJSON(metaPath, &s) && s.Socket != "" {
+			return s.Socket
+		}
+	}
+	return filepath.Join(m.socketDir, strings.TrimSuffix(filepath.Base(metaPath), ".meta")+".sock")
+}
@@ -0,0 +1,110 @@
+package session
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// staleTmpAge is how old a leftover temporary file must be before the
+	// sweep removes it; atomic writes finish in well under a second.
+	staleTmpAge = time.Minute
+	// staleLockAge is how long the lock may be held before it is taken to
+	// belong to a process that died holding it.
+	staleLockAge = time.Minute
+	// sweepDialTimeout bounds the liveness probe of an orphaned socket.
+	sweepDialTimeout = 100 * time.Millisecond
+)
+
+// sweep removes leftovers of unclean shutdowns (a crash, a SIGKILLed daemon)
+// from the base directory and the socket directory: sockets nothing listens on whose session is gone,
+// stale temporary files, and a lock abandoned by a dead process. Sessions
+// whose daemon died are turned into tombstones saying why (see buryOrphan).
+// It only touches files sess owns and errs towards leaving things in place;
+// what a dead session leaves stays for sess ls --all until sess clean.
+func (m *Manager) sweep() {
+	entries, err := os.ReadDir(m.baseDir)
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !ownedFile(name) {
+			continue
+		}
+		path := filepath.Join(m.baseDir, name)
+		switch {
+		case strings.HasSuffix(name, ".tmp"), strings.HasSuffix(name, ".claim"), name == lockFile:
+			limit := staleTmpAge
+			if name == lockFile {
+				limit = staleLockAge
+			}
+			if info, err := e.Info(); err == nil && now.Sub(info.ModTime()) > limit {
+				os.Remove(path)
+			}
+		case strings.HasSuffix(name, ".sock"):
+			m.sweepSocket(path)
+		case strings.HasSuffix(name, ".alive"):
+			m.buryOrphan(path)
+		}
+	}
+	if m.socketDir == m.baseDir {
+		return
+	}
+	sockets, _ := filepath.Glob(filepath.Join(m.socketDir, "session-*.sock"))
+	for _, path := range sockets {
+		m.sweepSocket(path)
+	}
+}
+
+// sweepSocket removes the socket at path if nothing listens on it and its
+// session is gone.
+func (m *Manager) sweepSocket(path string) {
+	meta := filepath.Join(m.baseDir, strings.TrimSuffix(filepath.Base(path), ".sock")+".meta")
+	if m.metaAlive(meta) || !socketRefuses(path) {
+		return
+	}
+	os.Remove(path)
+}
+
+// metaAlive reports whether the metadata at path names a live process,
+// one that has not reused the session's PID since, or a session of another
+// host, which is taken to be alive.
+func (m *Manager) metaAlive(path string) bool {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	var s Session
+	if err := json.Unmarshal(data, &s); err != nil {
+		return false
+	}
+	return m.remote(&s) || m.sessionAlive(&s)
+}
+
+// socketRefuses reports whether connecting to the socket at path is refused,
+// meaning no daemon is listening on it.
+func socketRefuses(path string) bool {
+	conn, err := net.DialTimeout("unix", path, sweepDialTimeout)
+	if err == nil {
+		conn.Close()
+		return false
+	}
+	return errors.Is(err, syscall.ECONNREFUSED)
+}
+
+// socketGone reports whether no daemon can be listening at path: the socket
+// is missing or refuses connections.
+func socketGone(path string) bool {
+	if _, err := os.Lstat(path); os.IsNotExist(err) {
+		return true
+	}
+	return socketRefuses(path)
+}
@@ -0,0 +1,97 @@
+package session
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// The sweep removes what dead sessions and interrupted writes left behind,
+// and leaves live sessions, recent writes and files it does not know be.
+func TestSweep(t *testing.T) {
+	m := newTestManager(t)
+	gone := exec.Command("true")
+	if err := gone.Run(); err != nil {
+		t.Fatal(err)
+	}
+	dead := gone.Process.Pid
+
+	// staleSocket leaves a socket file at path that nothing listens on.
+	staleSocket := func(path string) {
+		t.Helper()
+		ln, err := net.Listen("unix", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ln.(*net.UnixListener).SetUnlinkOnClose(false)
+		ln.Close()
+	}
+	write := func(name string, age time.Duration) string {
+		t.Helper()
+		path := filepath.Join(m.Dir(), name)
+		if err := os.WriteFile(path, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+		then := time.Now().Add(-age)
+		os.Chtimes(path, then, then)
+		return path
+	}
+
+	// A socket with no metadata, and one whose session is gone.
+	staleSocket(m.GetSocketPath("001"))
+	staleSocket(m.GetSocketPath("002"))
+	if err := WriteMetadata(m.GetMetaPath("002"), &Session{Number: "002", PID: dead, DaemonPID: dead, CreatedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	// A session whose daemon died, heartbeat and all.
+	staleSocket(m.GetSocketPath("003"))
+	if err := WriteMetadata(m.GetMetaPath("003"), &Session{Number: "003", PID: dead, DaemonPID: dead, CreatedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := json.Marshal(&Heartbeat{DaemonPID: dead, StartedAt: time.Now()})
+	if err := os.WriteFile(HeartbeatPath(m.GetMetaPath("003")), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	oldTmp := write("session-004.meta.tmp", 2*staleTmpAge)
+
+	// A live session, a daemon still starting up, a write under way and
+	// a file sess does not own.
+	ln, err := net.Listen("unix", m.GetSocketPath("005"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	if err := WriteMetadata(m.GetMetaPath("005"), &Session{Number: "005", PID: os.Getpid(), DaemonPID: os.Getpid(), CreatedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteHeartbeat(HeartbeatPath(m.GetMetaPath("005"))); err != nil {
+		t.Fatal(err)
+	}
+	starting, err := net.Listen("unix", m.GetSocketPath("006"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer starting.Close()
+	newTmp := write("session-007.meta.tmp", 0)
+	other := write("session-008.sock.bak", 2*staleTmpAge)
+
+	m.sweep()
+
+	for _, path := range []string{m.GetSocketPath("001"), m.GetSocketPath("002"), m.GetSocketPath("003"), m.GetMetaPath("003"), oldTmp} {
+		if _, err := os.Lstat(path); !os.IsNotExist(err) {
+			t.Errorf("%s left behind: %v", path, err)
+		}
+	}
+	for _, path := range []string{m.GetSocketPath("005"), m.GetMetaPath("005"), HeartbeatPath(m.GetMetaPath("005")), m.GetSocketPath("006"), newTmp, other} {
+		if _, err := os.Lstat(path); err != nil {
+			t.Errorf("%s removed: %v", path, err)
+		}
+	}
+	if s, err := m.GetSession("005"); err != nil || s.Number != "005" {
+		t.Errorf("GetSession(005) = %+v, %v; want the live session", s, err)
+	}
+}
@@ -0,0 +1,295 @@
+package session
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/theMichaelB/sess/internal/platform"
+	"github.com/theMichaelB/sess/internal/utils"
+)
+
+// States of a Record.
+const (
+	// StateLive sessions are running.
+	StateLive = "live"
+	// StateExited sessions ended and left a tombstone.
+	StateExited = "exited"
+	// StateStale sessions left metadata behind but their process or
+	// daemon is gone.
+	StateStale = "stale"
+	// StateRemote sessions run on another host sharing the state
+	// directory over a network filesystem, and cannot be reached from
+	// here.
+	StateRemote = "remote"
+)
+
+// ExitInfo is how a session's command ended.
+type ExitInfo struct {
+	ExitedAt time.Time `json:"exited_at"`
+	// Status is the exit status, or -1 if a signal ended the command or
+	// how it ended is unknown.
+	Status int `json:"status"`
+	// Signal names the signal that ended the command, if any.
+	Signal string `json:"signal,omitempty"`
+	// Reason says why the session ended when that was not up to its
+	// command: the OOM killer, a daemon panic, a crash, a reboot or its
+	// timeout (ReasonExpired).
+	Reason string `json:"reason,omitempty"`
+}
+
+// ReasonExpired is the Reason of a session its daemon ended because its
+// timeout was up.
+const ReasonExpired = "expired (timeout)"
+
+// Tombstone is what the daemon leaves behind when its session ends: the
+// session's last metadata and how its command ended.
+type Tombstone struct {
+	Session
+	Exit ExitInfo `json:"exit"`
+}
+
+// Record is a session as sess ls --all sees it: live, or ended and leaving
+// a trace behind.
+type Record struct {
+	Session
+	State string `json:"state"`
+	// Exit is set for exited sessions.
+	Exit *ExitInfo `json:"exit,omitempty"`
+}
+
+// TombstonePath returns the tombstone kept next to the metadata at metaPath.
+func TombstonePath(metaPath string) string {
+	return strings.TrimSuffix(metaPath, ".meta") + ".exit"
+}
+
+// WriteTombstone records an ended session at path. Variables pushed with
+// SetEnv are left out: they may be secrets and the tombstone outlives the
+// session.
+func WriteTombstone(path string, t *Tombstone) error {
+	record := *t
+	record.Env, record.EnvUnset = nil, nil
+	data, err := json.MarshalIndent(&record, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// ListAllSessions returns live sessions together with exited ones (from
+// tombstones) and stale ones (metadata whose process or daemon is gone),
+// ordered by number with the live session first. Unlike ListSessions it
+// removes nothing.
+func (m *Manager) ListAllSessions() ([]Record, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	lock, err := m.acquireLock()
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Release()
+
+	var records []Record
+	metas, err := filepath.Glob(filepath.Join(m.baseDir, "session-*.meta"))
+	if err != nil {
+		return nil, err
+	}
+	for _, metaPath := range metas {
+		var s Session
+		if !readJSON(metaPath, &s) {
+			continue
+		}
+		state := StateLive
+		switch {
+		case m.remote(&s):
+			state = StateRemote
+		case !m.sessionAlive(&s) || socketGone(m.socketPath(metaPath)):
+			state = StateStale
+		}
+		records = append(records, Record{Session: s, State: state})
+	}
+
+	tombstones, err := filepath.Glob(filepath.Join(m.baseDir, "session-*.exit"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range tombstones {
+		var t Tombstone
+		if !readJSON(path, &t) {
+			continue
+		}
+		exit := t.Exit
+		records = append(records, Record{Session: t.Session, State: StateExited, Exit: &exit})
+	}
+
+	sort.SliceStable(records, func(i, j int) bool {
+		if records[i].Number != records[j].Number {
+			return records[i].Number < records[j].Number
+		}
+		return records[i].State == StateLive && records[j].State != StateLive
+	})
+	return records, nil
+}
+
+// SessionRecord returns the record for number: the live session if there is
+// one, otherwise what is left of an ended one. It removes nothing.
+func (m *Manager) SessionRecord(number string) (*Record, error) {
+	records, err := m.ListAllSessions()
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range records {
+		if r.Number == number {
+			return &r, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", utils.ErrSessionNotFound, number)
+}
+
+// Clean removes what ended sessions left behind: tombstones, and the files
+// of stale sessions. Before removing a stale session it checks again, under
+// the lock, that the metadata is unchanged, its daemon socket is gone and
+// its process is dead or is no longer the session's shell. A stale session
+// whose shell is still running without a daemon is kept and returned in
+// kept; killing it removes it. The output and input logs of a removed stale
+// session are preserved, as its daemon would have done.
+func (m *Manager) Clean() (removed, kept []Record, err error) {
+	records, err := m.ListAllSessions()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	lock, err := m.acquireLock()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer lock.Release()
+
+	for _, r := range records {
+		metaPath := m.GetMetaPath(r.Number)
+		switch r.State {
+		case StateExited:
+			if err := os.Remove(TombstonePath(metaPath)); err != nil && !os.IsNotExist(err) {
+				return removed, kept, err
+			}
+			os.Remove(DaemonLogPath(metaPath))
+			os.Remove(ScrollbackPath(metaPath))
+		case StateStale:
+			var s Session
+			if !readJSON(metaPath, &s) || s.PID != r.PID || !s.CreatedAt.Equal(r.CreatedAt) {
+				// Gone already, or the number was reused meanwhile.
+				continue
+			}
+			socketPath := m.GetSocketPath(r.Number)
+			if !socketGone(socketPath) {
+				continue
+			}
+			if m.sessionAlive(&s) {
+				kept = append(kept, r)
+				continue
+			}
+			os.Remove(socketPath)
+			os.Remove(EnvFilePath(metaPath))
+			os.Remove(DaemonLogPath(metaPath))
+			if err := os.Remove(metaPath); err != nil && !os.IsNotExist(err) {
+				return removed, kept, err
+			}
+			os.Remove(HeartbeatPath(metaPath))
+			// The daemon never got to preserve its output log.
+			preserveLogs(metaPath, &r.Session)
+		default:
+			continue
+		}
+		removed = append(removed, r)
+	}
+
+	// Output and input logs whose session left no metadata (it was
+	// killed along with its daemon) are preserved too. A session being
+	// created holds a claim until its metadata exists.
+	logs, err := filepath.Glob(filepath.Join(m.baseDir, "session-*.log"))
+	if err != nil {
+		return removed, kept, err
+	}
+	for _, path := range logs {
+		if strings.Contains(filepath.Base(path), ".exited-") {
+			continue
+		}
+		base := strings.TrimSuffix(strings.TrimSuffix(path, ".log"), ".input")
+		if _, err := os.Stat(base + ".meta"); err == nil {
+			continue
+		}
+		if _, err := os.Stat(base + ".claim"); err == nil {
+			continue
+		}
+		if info, err := os.Stat(path); err == nil {
+			PreserveLog(path, info.ModTime())
+		}
+	}
+
+	// So are the logs of daemons that failed to start.
+	daemonLogs, err := filepath.Glob(filepath.Join(m.baseDir, "session-*.daemon.out"))
+	if err != nil {
+		return removed, kept, err
+	}
+	for _, path := range daemonLogs {
+		base := strings.TrimSuffix(path, ".daemon.out")
+		if _, err := os.Stat(base + ".meta"); err == nil {
+			continue
+		}
+		if _, err := os.Stat(base + ".claim"); err == nil {
+			continue
+		}
+		os.Remove(path)
+	}
+	return removed, kept, nil
+}
+
+// pidReuseSlack is how much later than its session's creation a process may
+// have started and still be taken for the session's shell. The daemon
+// records the creation time right after starting the shell, and boot time
+// is only known to the second.
+const pidReuseSlack = 5 * time.Second
+
+// sessionAlive reports whether the session's process is running. A live
+// process that started well after the session was created has reused the
+// PID and does not count. Where start times are unavailable, a live PID is
+// trusted.
+func (m *Manager) sessionAlive(s *Session) bool {
+	return m.processAliveSince(s.PID, s.CreatedAt)
+}
+
+// processAliveSince reports whether pid is running and is the process that
+// was running at since, as sessionAlive judges it.
+func (m *Manager) processAliveSince(pid int, since time.Time) bool {
+	if !m.isProcessAlive(pid) {
+		return false
+	}
+	if since.IsZero() {
+		return true
+	}
+	start, err := platform.ProcessStartTime(pid)
+	if err != nil {
+		return true
+	}
+	return !start.After(since.Add(pidReuseSlack))
+}
+
+// readJSON decodes the JSON file at path into v, reporting success.
+func readJSON(path string, v interface{}) bool {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	return json.Unmarshal(data, v) == nil
+}
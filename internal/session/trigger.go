@@ -0,0 +1,67 @@
+package session
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/theMichaelB/sess/pkg/protocol"
+)
+
+// AddTrigger stores a trigger in the session's metadata, numbered after
+// the highest there, and returns it with the session's triggers now.
+func (m *Manager) AddTrigger(number string, t protocol.Trigger) (protocol.Trigger, []protocol.Trigger, error) {
+	if t.Pattern == "" || t.Command == "" {
+		return t, nil, fmt.Errorf("a trigger needs a pattern and a command")
+	}
+	if _, err := regexp.Compile(t.Pattern); err != nil {
+		return t, nil, fmt.Errorf("invalid pattern: %v", err)
+	}
+	if t.Cooldown < 0 {
+		return t, nil, fmt.Errorf("invalid cooldown %ds", t.Cooldown)
+	}
+
+	var list []protocol.Trigger
+	err := m.updateSession(number, func(meta *Session) error {
+		t.ID = 1
+		for _, o := range meta.Triggers {
+			if o.ID >= t.ID {
+				t.ID = o.ID + 1
+			}
+		}
+		meta.Triggers = append(meta.Triggers, t)
+		list = meta.Triggers
+		return nil
+	})
+	return t, list, err
+}
+
+// RemoveTriggers takes the triggers numbered ids out of the session's
+// metadata, or all of them when there are no ids, and returns those left.
+func (m *Manager) RemoveTriggers(number string, ids []int) ([]protocol.Trigger, error) {
+	var list []protocol.Trigger
+	err := m.updateSession(number, func(meta *Session) error {
+		remove := make(map[int]bool, len(ids))
+		for _, id := range ids {
+			remove[id] = true
+		}
+		for _, id := range ids {
+			found := false
+			for _, t := range meta.Triggers {
+				found = found || t.ID == id
+			}
+			if !found {
+				return fmt.Errorf("session %s has no trigger %d", number, id)
+			}
+		}
+		kept := meta.Triggers[:0]
+		for _, t := range meta.Triggers {
+			if len(ids) > 0 && !remove[t.ID] {
+				kept = append(kept, t)
+			}
+		}
+		meta.Triggers = kept
+		list = kept
+		return nil
+	})
+	return list, err
+}
@@ -4,6 +4,8 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"runtime/debug"
+	"strings"
 	"syscall"
 )
 
@@ -11,13 +13,39 @@ var (
 	ErrSessionExists    = errors.New("session already exists")
 	ErrSessionNotFound  = errors.New("session not found")
 	ErrSessionDead      = errors.New("session is dead")
+	ErrSessionStale     = errors.New("session's daemon is gone")
+	ErrSessionRemote    = errors.New("session runs on another host")
+	ErrKillFailed       = errors.New("session survived being killed")
+	ErrCleanupFailed    = errors.New("session files left behind")
 	ErrAlreadyAttached  = errors.New("already attached to this session")
+	ErrSessionBusy      = errors.New("session already has an active connection")
+	ErrSessionLocked    = errors.New("session is locked")
 	ErrNotInSession     = errors.New("not in a session")
+	ErrNotAttached      = errors.New("not attached to any session")
 	ErrInSession        = errors.New("already in a session")
 	ErrConnectionFailed = errors.New("connection failed")
+	ErrConnectionLost   = errors.New("connection lost")
 	ErrTimeout          = errors.New("operation timed out")
+	ErrUnsupported      = errors.New("not supported on this platform")
+	ErrPermissionDenied = errors.New("permission denied")
+	ErrNoRawMode        = errors.New("cannot put the terminal into raw mode")
 )
 
+// LockedError is the error refusing an attach to locked session number.
+// It matches ErrSessionLocked.
+func LockedError(number string) error {
+	short := strings.TrimLeft(number, "0")
+	if short == "" {
+		short = number
+	}
+	return &lockedError{fmt.Sprintf("session %s is locked (sess unlock %s to release)", number, short)}
+}
+
+type lockedError struct{ message string }
+
+func (e *lockedError) Error() string { return e.message }
+func (e *lockedError) Unwrap() error { return ErrSessionLocked }
+
 func IsRecoverable(err error) bool {
 	if err == nil {
 		return true
@@ -84,11 +112,18 @@ func (r *SafeRunner) Run(fn func() error) error {
 
 func HandlePanic(component string) {
 	if r := recover(); r != nil {
-		fmt.Fprintf(os.Stderr, "Panic in %s: %v\n", component, r)
+		fmt.Fprint(os.Stderr, PanicMessage(component, r))
 		os.Exit(1)
 	}
 }
 
+// PanicMessage describes a recovered panic value r, with the stack of the
+// panicking goroutine when called from the deferred function that
+// recovered it.
+func PanicMessage(component string, r interface{}) string {
+	return fmt.Sprintf("Panic in %s: %v\n%s", component, r, debug.Stack())
+}
+
 func FileExists(path string) bool {
 	_, err := os.Stat(path)
 	return err == nil
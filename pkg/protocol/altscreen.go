@@ -0,0 +1,105 @@
+package protocol
+
+import (
+	"bytes"
+	"sync/atomic"
+)
+
+// Sequences that switch a terminal to its alternate screen and back, as
+// full-screen programs send them (smcup and rmcup in terminfo).
+const (
+	EnterAltScreen = "\x1b[?1049h"
+	LeaveAltScreen = "\x1b[?1049l"
+)
+
+// AltScreen follows a session's output to tell whether a program has
+// switched the terminal to the alternate screen: by DEC private modes 1049,
+// 1047 or 47, set or reset. Sequences split across writes are followed.
+// Write is called by one goroutine at a time; On may be called by any.
+type AltScreen struct {
+	on atomic.Bool
+	// Where the parser is in a sequence: after ESC, after ESC [, or among
+	// the parameters after ESC [ ?.
+	state byte
+	param int
+	alt   bool // an earlier parameter of this sequence is an alternate screen mode
+}
+
+const (
+	altIdle = iota
+	altEscape
+	altCSI
+	altPrivate
+)
+
+// On reports whether the output so far leaves the alternate screen shown.
+func (a *AltScreen) On() bool {
+	return a.on.Load()
+}
+
+// Set records that the alternate screen is shown, or not, as known from
+// elsewhere.
+func (a *AltScreen) Set(on bool) {
+	a.on.Store(on)
+}
+
+// Write follows a chunk of output. It allocates nothing, and skips to the
+// next escape character when not within a sequence.
+func (a *AltScreen) Write(p []byte) {
+	for i := 0; i < len(p); i++ {
+		if a.state == altIdle {
+			j := bytes.IndexByte(p[i:], 0x1b)
+			if j < 0 {
+				return
+			}
+			i += j
+			a.state = altEscape
+			continue
+		}
+		b := p[i]
+		switch a.state {
+		case altEscape:
+			if b == '[' {
+				a.state = altCSI
+			} else {
+				a.restart(b)
+			}
+		case altCSI:
+			if b == '?' {
+				a.state, a.param, a.alt = altPrivate, 0, false
+			} else {
+				a.restart(b)
+			}
+		case altPrivate:
+			switch {
+			case b >= '0' && b <= '9':
+				if a.param < 100000 {
+					a.param = a.param*10 + int(b-'0')
+				}
+			case b == ';':
+				a.alt = a.alt || altMode(a.param)
+				a.param = 0
+			case b == 'h' || b == 'l':
+				if a.alt || altMode(a.param) {
+					a.on.Store(b == 'h')
+				}
+				a.state = altIdle
+			default:
+				a.restart(b)
+			}
+		}
+	}
+}
+
+// restart abandons the sequence being read at b, which may begin another.
+func (a *AltScreen) restart(b byte) {
+	a.state = altIdle
+	if b == 0x1b {
+		a.state = altEscape
+	}
+}
+
+// altMode reports whether DEC private mode n switches screens.
+func altMode(n int) bool {
+	return n == 1049 || n == 1047 || n == 47
+}
@@ -0,0 +1,113 @@
+package protocol
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Control lines without arguments, as a client writes them after READY.
+var (
+	PingLine       = []byte(MsgPing + "\n")
+	DisconnectLine = []byte(MsgDisconnect + "\n")
+)
+
+// ResizeLine is the control line telling the daemon the client's terminal
+// is rows by cols.
+func ResizeLine(rows, cols int) []byte {
+	return []byte(MsgResize + " " + strconv.Itoa(rows) + " " + strconv.Itoa(cols) + "\n")
+}
+
+// ResizePixelsLine is ResizeLine also giving the terminal's size in
+// pixels, xpixel wide and ypixel high, which programs drawing images with
+// sixel or the kitty graphics protocol size them by. Only a daemon whose
+// READY sets Pixels takes it; others would type it into the session.
+func ResizePixelsLine(rows, cols, xpixel, ypixel int) []byte {
+	return []byte(MsgResize + " " + strconv.Itoa(rows) + " " + strconv.Itoa(cols) + " " +
+		strconv.Itoa(xpixel) + " " + strconv.Itoa(ypixel) + "\n")
+}
+
+// RedrawLine is the control line asking for a repaint; with ctrlL, a
+// program other than the shell in the foreground is also sent a Ctrl-L.
+func RedrawLine(ctrlL bool) []byte {
+	if ctrlL {
+		return []byte(MsgRedraw + " ctrl-l\n")
+	}
+	return []byte(MsgRedraw + "\n")
+}
+
+// MaxTerminalSize is the most rows or columns a daemon gives its
+// terminal; a client asking for more gets this many. Programs in the
+// session size their buffers by the terminal, so a hostile or confused
+// client must not be able to make it arbitrarily large.
+const MaxTerminalSize = 10000
+
+// ClampSize returns size with its rows and columns limited to
+// MaxTerminalSize. ok is false if size has no rows or no columns, which a
+// daemon ignores.
+func ClampSize(size ResizePayload) (clamped ResizePayload, ok bool) {
+	if size.Rows == 0 || size.Cols == 0 {
+		return size, false
+	}
+	size.Rows = min(size.Rows, MaxTerminalSize)
+	size.Cols = min(size.Cols, MaxTerminalSize)
+	return size, true
+}
+
+// ResizeArgs returns the size a RESIZE command line, as ControlCommands
+// returns it, asks for, clamped as ClampSize does. ok is false if line is
+// not a RESIZE or asks for no rows or no columns.
+func ResizeArgs(line string) (size ResizePayload, ok bool) {
+	fields := strings.Fields(line)
+	if !isControlCommand(line) || fields[0] != MsgResize {
+		return ResizePayload{}, false
+	}
+	// A client that does not send the size in pixels leaves it unknown.
+	var n [4]uint16
+	for i, f := range fields[1:] {
+		v, _ := strconv.ParseUint(f, 10, 16)
+		n[i] = uint16(v)
+	}
+	return ClampSize(ResizePayload{Rows: n[0], Cols: n[1], XPixel: n[2], YPixel: n[3]})
+}
+
+// ControlCommands splits a read into the in-band command lines a client
+// sends on its data connection (DISCONNECT, PING, RESIZE, REDRAW). A read
+// not made up entirely of well-formed commands is keystrokes, and nil is
+// returned. Accepting several lines lets commands sent back to back (a
+// RESIZE followed by a REDRAW) survive arriving in one read.
+func ControlCommands(data []byte) []string {
+	if len(data) == 0 || data[len(data)-1] != '\n' {
+		return nil
+	}
+	lines := strings.Split(string(data[:len(data)-1]), "\n")
+	for _, line := range lines {
+		if !isControlCommand(line) {
+			return nil
+		}
+	}
+	return lines
+}
+
+func isControlCommand(line string) bool {
+	fields := strings.Fields(line)
+	if len(fields) == 0 || strings.Join(fields, " ") != line {
+		return false
+	}
+	switch fields[0] {
+	case MsgDisconnect, MsgPing:
+		return len(fields) == 1
+	case MsgResize:
+		if len(fields) != 3 && len(fields) != 5 {
+			return false
+		}
+		for _, f := range fields[1:] {
+			if _, err := strconv.ParseUint(f, 10, 16); err != nil {
+				return false
+			}
+		}
+		return true
+	case MsgRedraw:
+		return len(fields) == 1 || (len(fields) == 2 && fields[1] == "ctrl-l")
+	}
+	return false
+}
@@ -0,0 +1,66 @@
+package protocol
+
+import (
+	"net/url"
+	"path"
+	"strings"
+	"sync/atomic"
+)
+
+// maxCwdURL bounds the OSC 7 URL Cwd reads; a longer one is ignored.
+const maxCwdURL = 8192
+
+// Cwd follows a session's output for the working directory its shell
+// announces by OSC 7, a file URL such as file://host/home/me, as shells
+// set up for it do at each prompt. Malformed URLs are ignored; one naming
+// another host than Host, from a shell reached over ssh, makes the
+// directory unknown again. Write is called by one goroutine at a time; Get
+// may be called by any.
+type Cwd struct {
+	// Host is this machine's name. When empty any host is taken to be
+	// this one.
+	Host string
+	cwd  atomic.Pointer[string]
+	osc  oscScanner
+}
+
+// Get returns the directory the shell last announced, or "" if it has
+// announced none or was elsewhere.
+func (c *Cwd) Get() string {
+	if p := c.cwd.Load(); p != nil {
+		return *p
+	}
+	return ""
+}
+
+// Set records the directory, as known from elsewhere.
+func (c *Cwd) Set(dir string) {
+	c.cwd.Store(&dir)
+}
+
+// Write follows a chunk of output. It allocates only for a URL it has
+// read.
+func (c *Cwd) Write(p []byte) {
+	c.osc.write(p, maxCwdURL, func(ps int) bool { return ps == 7 }, func(text []byte, cut bool) {
+		if cut {
+			return
+		}
+		if dir, ok := c.parse(string(text)); ok {
+			c.Set(dir)
+		}
+	})
+}
+
+// parse returns the directory an OSC 7 URL names, "" if it is on another
+// host, and false if the URL is malformed.
+func (c *Cwd) parse(s string) (string, bool) {
+	u, err := url.Parse(s)
+	if err != nil || u.Scheme != "file" || u.Opaque != "" || !path.IsAbs(u.Path) {
+		return "", false
+	}
+	switch host := u.Hostname(); {
+	case host == "", host == "localhost", c.Host == "", strings.EqualFold(host, c.Host):
+		return path.Clean(u.Path), true
+	}
+	return "", true
+}
@@ -0,0 +1,81 @@
+// Package protocol is the wire protocol between sess clients and the
+// daemons serving sessions. It is the supported surface for programs that
+// talk to a daemon themselves, such as other attach tools; its package
+// protocoltest checks a daemon against it and fakes one for client tests.
+//
+// # Transport
+//
+// Each session's daemon listens on a unix socket, ~/.sess/session-NNN.sock,
+// or under $TMPDIR/sess-<uid> when that path is too long for a socket (see
+// sess.Manager.SocketPath). Only the session's owner and root are let
+// in, unless the session is shared. A connection carries one request: the
+// client opens it with a message, and the daemon either answers and closes
+// it or, for CONNECT, keeps it as an attached client.
+//
+// # Messages
+//
+// A message is a JSON object on one line, {"type": ..., "payload": ...},
+// ended by a newline; EncodeMessage and ReadMessageFrom write and read
+// them. The payload's type depends on the message type, and the Msg
+// constants document which. A daemon refuses a request with ERROR, whose
+// ErrorPayload says why and, for refusals a client may act on, carries an
+// ErrCode.
+//
+// One-shot requests and their replies:
+//
+//	STATUS                  -> STATUS (StatusPayload)
+//	INPUT (InputPayload)    -> READY
+//	SIGNAL (SignalPayload)  -> READY
+//	ENV (EnvPayload)        -> READY
+//	DETACH (DetachPayload)  -> READY, after disconnecting every client
+//	SCROLLBACK (ScrollbackPayload) -> SCROLLBACK (ScrollbackReply), then its bytes
+//	SHARE (SharePayload)    -> SHARE (ShareStatus)
+//	UPGRADE (UpgradePayload) -> READY once the new binary serves the session
+//	TRIGGERS (TriggersPayload) -> READY
+//	TIMEOUT (TimeoutPayload) -> TIMEOUT (TimeoutReply)
+//	DUMP                    -> READY, once the daemon has written a dump of
+//	                           its state to its log, as on SIGUSR2
+//
+// # Attaching
+//
+// A client attaches by sending CONNECT with a ConnectPayload. The daemon
+// answers READY with a ReadyPayload, or ERROR: ErrCodeBusy when another
+// interactive client is attached, ErrCodeLocked, or ErrCodeDenied. A
+// session has at most one ModeAttach client and any number of ModePeek
+// ones. Handshake does this for a client.
+//
+// After READY the connection carries the session. What the client writes
+// is typed into the session, except writes made up wholly of control
+// lines, which the daemon acts on instead (see ControlCommands):
+//
+//	RESIZE rows cols   the client's terminal size (ResizeLine), followed
+//	                   by its width and height in pixels if READY set
+//	                   Pixels (ResizePixelsLine)
+//	REDRAW [ctrl-l]    ask the foreground program to repaint (RedrawLine)
+//	PING               answered by a PONG control frame, if framed
+//	DISCONNECT         detach
+//
+// A write is taken as control lines only if all of it is, so a client
+// sends each on its own and keystrokes never end in one by accident. Peek
+// clients' keystrokes, and their RESIZE, are dropped. A RESIZE, like the
+// size in CONNECT, is ignored if it has no rows or no columns and
+// clamped to MaxTerminalSize of each.
+//
+// What the daemon writes after READY is the session's output. A client
+// that set ConnectPayload.Framed, and whose READY confirms it, gets it
+// in frames instead (see WriteFrameHeader and ReadFrame): data frames of
+// output, and control frames each holding one message: PONG, EXIT
+// (ExitPayload) when the session's command has ended, DETACH
+// (DetachPayload) when the daemon disconnects the client for another
+// reason, FLOW (FlowPayload) when the terminal's output is flushed,
+// stopped or started, and ERROR for notices. A client may ignore FLOW.
+// Unframed clients learn of these only by the connection closing, if at
+// all.
+//
+// # Versions
+//
+// READY carries Version, which changes when clients and daemons of
+// different builds could misread each other. Fields are only ever added
+// to payloads, and omitted when empty, so a client ignores what it does
+// not know and a daemon treats a missing field as its zero value.
+package protocol
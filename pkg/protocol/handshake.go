@@ -0,0 +1,53 @@
+package protocol
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Handshake attaches a client on conn: it sends CONNECT with hello and
+// waits up to timeout for the daemon to answer. It returns how the daemon
+// introduced itself and a reader positioned at the session's output, which
+// may hold some already; read it with ReadFrame if the READY says Framed.
+// A refusal is returned as an *ErrorPayload. A Direct attach takes the
+// session's terminal from READY's ancillary data, which Handshake does not
+// read, so it is refused.
+func Handshake(conn net.Conn, hello ConnectPayload, timeout time.Duration) (*ReadyPayload, *bufio.Reader, error) {
+	if hello.Direct {
+		return nil, nil, errors.New("direct attach is not supported by Handshake")
+	}
+	data, err := EncodeMessage(MsgConnect, hello)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+	if _, err := conn.Write(data); err != nil {
+		return nil, nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	msg, err := ReadMessageFrom(reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch msg.Type {
+	case MsgReady:
+		var ready ReadyPayload
+		if err := msg.Decode(&ready); err != nil {
+			return nil, nil, fmt.Errorf("malformed READY: %w", err)
+		}
+		return &ready, reader, nil
+	case MsgError:
+		e := &ErrorPayload{}
+		if err := msg.Decode(e); err != nil {
+			return nil, nil, fmt.Errorf("malformed ERROR: %w", err)
+		}
+		return nil, nil, e
+	default:
+		return nil, nil, fmt.Errorf("unexpected response: %s", msg.Type)
+	}
+}
@@ -0,0 +1,114 @@
+package protocol
+
+import "bytes"
+
+// oscScanner follows output for operating system commands, ESC ] Ps ; Pt
+// ended by BEL or ST, as programs send them to set the window title or
+// announce their directory. Sequences split across writes are followed, and
+// control characters in Pt are dropped.
+type oscScanner struct {
+	// Where the parser is: after ESC, in Ps, in the Pt of a wanted OSC, in
+	// an OSC of another kind, or after an ESC within one of the last two.
+	state byte
+	param int
+	text  []byte
+	cut   bool // text was longer than the limit and cut short
+}
+
+const (
+	oscIdle = iota
+	oscEscape
+	oscParam
+	oscText
+	oscTextEscape
+	oscOther
+	oscOtherEscape
+)
+
+// write follows a chunk of output, calling done with the Pt of each OSC
+// whose Ps want accepts, at most limit bytes of it, and whether it was cut
+// short. It skips to the next escape character when not within a sequence
+// and allocates nothing.
+func (o *oscScanner) write(p []byte, limit int, want func(ps int) bool, done func(text []byte, cut bool)) {
+	for i := 0; i < len(p); i++ {
+		if o.state == oscIdle {
+			j := bytes.IndexByte(p[i:], 0x1b)
+			if j < 0 {
+				return
+			}
+			i += j
+			o.state = oscEscape
+			continue
+		}
+		b := p[i]
+		switch o.state {
+		case oscEscape:
+			if b == ']' {
+				o.state, o.param = oscParam, 0
+			} else {
+				o.restart(b)
+			}
+		case oscParam:
+			switch {
+			case b >= '0' && b <= '9':
+				if o.param < 1000 {
+					o.param = o.param*10 + int(b-'0')
+				}
+			case b == ';' && want(o.param):
+				o.state, o.text, o.cut = oscText, o.text[:0], false
+			default:
+				o.other(b)
+			}
+		case oscText:
+			switch {
+			case b == 0x07:
+				o.state = oscIdle
+				done(o.text, o.cut)
+			case b == 0x1b:
+				o.state = oscTextEscape
+			case b == 0x18 || b == 0x1a: // CAN and SUB cancel the sequence
+				o.state = oscIdle
+			case b < 0x20 || b == 0x7f:
+			case len(o.text) < limit:
+				o.text = append(o.text, b)
+			default:
+				o.cut = true
+			}
+		case oscTextEscape:
+			if b == '\\' {
+				o.state = oscIdle
+				done(o.text, o.cut)
+			} else {
+				o.restart(b)
+			}
+		case oscOther:
+			o.other(b)
+		case oscOtherEscape:
+			if b == '\\' {
+				o.state = oscIdle
+			} else {
+				o.restart(b)
+			}
+		}
+	}
+}
+
+// other follows b within an OSC that is not wanted.
+func (o *oscScanner) other(b byte) {
+	switch b {
+	case 0x07, 0x18, 0x1a:
+		o.state = oscIdle
+	case 0x1b:
+		o.state = oscOtherEscape
+	default:
+		o.state = oscOther
+	}
+}
+
+// restart abandons the sequence being read at b, which may begin another.
+func (o *oscScanner) restart(b byte) {
+	o.state = oscIdle
+	if b == 0x1b {
+		o.state = oscEscape
+	}
+}
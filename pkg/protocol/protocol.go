@@ -0,0 +1,645 @@
+package protocol
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	MsgConnect    = "CONNECT"
+	MsgReady      = "READY"
+	MsgData       = "DATA"
+	MsgResize     = "RESIZE"
+	MsgDisconnect = "DISCONNECT"
+	MsgPing       = "PING"
+	MsgPong       = "PONG"
+	MsgError      = "ERROR"
+	MsgStatus     = "STATUS"
+	MsgInput      = "INPUT"
+	MsgRedraw     = "REDRAW"
+	MsgSignal     = "SIGNAL"
+	MsgEnv        = "ENV"
+	MsgScrollback = "SCROLLBACK"
+	MsgShare      = "SHARE"
+	MsgExit       = "EXIT"
+	MsgDetach     = "DETACH"
+	MsgUpgrade    = "UPGRADE"
+	MsgTriggers   = "TRIGGERS"
+	MsgFlow       = "FLOW"
+	MsgTimeout    = "TIMEOUT"
+	MsgDump       = "DUMP"
+)
+
+// Version is the protocol revision a daemon announces in READY. It changes
+// when clients and daemons of different builds could misread each other.
+const Version = 1
+
+// Connection modes a client declares in its CONNECT message.
+const (
+	// ModeAttach is an interactive client; a session has at most one.
+	ModeAttach = "attach"
+	// ModePeek is a read-only client that only receives output.
+	ModePeek = "peek"
+)
+
+type Message struct {
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+type ResizePayload struct {
+	Rows uint16 `json:"rows"`
+	Cols uint16 `json:"cols"`
+	// XPixel and YPixel are the size in pixels, zero if unknown.
+	XPixel uint16 `json:"xpixel,omitempty"`
+	YPixel uint16 `json:"ypixel,omitempty"`
+}
+
+type ErrorPayload struct {
+	Message string `json:"message"`
+	// Code classifies errors a client may act on; empty for others.
+	Code string `json:"code,omitempty"`
+}
+
+// Error returns the daemon's message, so an ERROR reply can be returned as
+// an error.
+func (e *ErrorPayload) Error() string {
+	return e.Message
+}
+
+// Error codes carried in ErrorPayload.Code.
+const (
+	// ErrCodeBusy refuses an attach because another client is attached.
+	ErrCodeBusy = "busy"
+	// ErrCodeDenied refuses a peer the session's owner has not shared it
+	// with, or a request its share does not allow.
+	ErrCodeDenied = "denied"
+	// ErrCodeLocked refuses an attach because the session is locked.
+	ErrCodeLocked = "locked"
+)
+
+// ConnectPayload opens every attach: the client's mode and where it runs.
+type ConnectPayload struct {
+	Mode string `json:"mode"`
+	TTY  string `json:"tty,omitempty"`
+	// SSH is the client's SSH_CONNECTION, when it runs over SSH.
+	SSH string `json:"ssh,omitempty"`
+	// NoResize clients leave the session at its size; they never
+	// contribute a terminal size.
+	NoResize bool `json:"no_resize,omitempty"`
+	// Framed asks the daemon to frame what it sends after READY; see
+	// WriteFrameHeader.
+	Framed bool `json:"framed,omitempty"`
+	// Force attaches to a locked session. Only the session's owner may.
+	Force bool `json:"force,omitempty"`
+	// Direct asks for the session's terminal itself, to read and write
+	// without the daemon relaying; see ReadyPayload.Direct.
+	Direct bool `json:"direct,omitempty"`
+	// Size is the size to give the session, applied as an attach client
+	// that may resize it is accepted, so that the output after READY is
+	// already laid out for it; see ReadyPayload.Sized.
+	Size *ResizePayload `json:"size,omitempty"`
+}
+
+// ReadyPayload accepts an attach and says who the client reached, so it can
+// check the socket belongs to the session it meant. Daemons predating it
+// send READY without a payload.
+type ReadyPayload struct {
+	Session string `json:"session"`
+	// PID is the daemon's; ChildPID is the session's command, the PID its
+	// metadata records.
+	PID      int `json:"pid"`
+	ChildPID int `json:"child_pid"`
+	Version  int `json:"version"`
+	// Framed confirms the daemon frames its output for this client.
+	// Daemons that don't support it send raw output.
+	Framed bool `json:"framed,omitempty"`
+	// Direct grants a Direct request: READY arrives with the session's PTY
+	// master attached as SCM_RIGHTS. The client reads the session's output
+	// from it and types into it; the connection carries only control
+	// messages until the client leaves, when the daemon takes the
+	// terminal back. A daemon that needs the output itself, for logs or
+	// other clients, leaves Direct unset and relays as usual.
+	Direct bool `json:"direct,omitempty"`
+	// AltScreen says a full-screen program has the session on the
+	// alternate screen, so a client coming back switches its terminal to
+	// it before asking for a redraw. Output that went to a direct client
+	// is not followed; the daemon goes by what it last relayed.
+	AltScreen bool `json:"alt_screen,omitempty"`
+	// Pixels says the daemon takes the terminal's size in pixels as well
+	// as in cells; see ResizePixelsLine. Clients of daemons without it
+	// send RESIZE with rows and cols only.
+	Pixels bool `json:"pixels,omitempty"`
+	// Sized says the daemon applied ConnectPayload.Size. Clients of
+	// daemons without it send a RESIZE once accepted instead.
+	Sized bool `json:"sized,omitempty"`
+}
+
+// ExitPayload tells attached clients the session's command ended, just
+// before the daemon closes their connections.
+type ExitPayload struct {
+	// Status is the exit status, or -1 if a signal ended the command.
+	Status int `json:"status"`
+	// Signal names the signal that ended the command, if any.
+	Signal string `json:"signal,omitempty"`
+}
+
+// DetachPayload tells a client the daemon is disconnecting it while the
+// session goes on, or is going away for another reason than its command
+// ending. Sent as a one-shot request, it asks the daemon to disconnect
+// every client with that reason.
+type DetachPayload struct {
+	Reason string `json:"reason"`
+}
+
+// FlowPayload tells a framed client what happened to the output on the
+// session's terminal, as the terminal reports it: Flushed when output not
+// yet written was thrown away, as on Ctrl-C, so the client may throw away
+// what it has not shown either; Stopped while output is held by Ctrl-S,
+// until a FLOW without it says Ctrl-Q let it go again.
+type FlowPayload struct {
+	Flushed bool `json:"flushed,omitempty"`
+	Stopped bool `json:"stopped,omitempty"`
+}
+
+// UpgradePayload asks a daemon to hand its session over to the sess binary
+// at Executable, re-executing it in place. The daemon answers READY once
+// the new binary serves the session, or ERROR if it is still the old one.
+type UpgradePayload struct {
+	Executable string `json:"executable"`
+}
+
+// InputPayload carries bytes to type into a session without attaching.
+type InputPayload struct {
+	Data []byte `json:"data"`
+}
+
+// SignalPayload asks the daemon to signal the session's foreground job, or
+// its shell when Shell is set.
+type SignalPayload struct {
+	Signal int  `json:"signal"`
+	Shell  bool `json:"shell,omitempty"`
+}
+
+// EnvPayload changes the daemon's own environment, which programs it starts
+// from then on inherit.
+type EnvPayload struct {
+	Set   map[string]string `json:"set,omitempty"`
+	Unset []string          `json:"unset,omitempty"`
+}
+
+// Trigger runs Command when the session prints a line matching Pattern, a
+// regular expression in Go's syntax, matched against the output with its
+// escape sequences and other control characters taken out. Having run, it
+// waits Cooldown seconds before it can run again; zero means the daemon's
+// default.
+type Trigger struct {
+	ID       int    `json:"id"`
+	Pattern  string `json:"pattern"`
+	Command  string `json:"command"`
+	Cooldown int    `json:"cooldown,omitempty"`
+}
+
+// TriggersPayload replaces the triggers a daemon watches its session's
+// output for.
+type TriggersPayload struct {
+	Triggers []Trigger `json:"triggers,omitempty"`
+}
+
+// ScrollbackPayload asks for the session's recent output: its last Lines
+// lines, else its last Bytes bytes, else all the daemon holds in memory.
+// All adds the history spilled to disk beyond the in-memory cap.
+type ScrollbackPayload struct {
+	Bytes int  `json:"bytes,omitempty"`
+	Lines int  `json:"lines,omitempty"`
+	All   bool `json:"all,omitempty"`
+}
+
+// ScrollbackReply answers a SCROLLBACK request. Size raw bytes of output
+// follow the message line.
+type ScrollbackReply struct {
+	Size int64 `json:"size"`
+}
+
+// TimeoutPayload changes when a session expires, when its daemon ends it
+// as its command's time is up: Timeout from now, or with Extend, Timeout
+// later than it would have (from now if it had no timeout). A Timeout of
+// zero without Extend takes the timeout away.
+type TimeoutPayload struct {
+	Timeout time.Duration `json:"timeout_ns,omitempty"`
+	Extend  bool          `json:"extend,omitempty"`
+}
+
+// TimeoutReply answers a TIMEOUT request with when the session now
+// expires, nil if it does not.
+type TimeoutReply struct {
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// SharedUser is another user a session is shared with.
+type SharedUser struct {
+	UID  int    `json:"uid"`
+	Name string `json:"name"`
+	// ReadOnly users may only attach read-only.
+	ReadOnly bool `json:"read_only,omitempty"`
+}
+
+// SharePayload changes who a session is shared with. Grants replace any
+// earlier grant to the same user. Socket names where shared users connect;
+// it is only used when the first user is granted, and the daemon picks a
+// place when it is empty.
+type SharePayload struct {
+	Grant     []SharedUser `json:"grant,omitempty"`
+	Revoke    []int        `json:"revoke,omitempty"`
+	RevokeAll bool         `json:"revoke_all,omitempty"`
+	Socket    string       `json:"socket,omitempty"`
+}
+
+// ShareStatus is who a session is shared with and the socket they use. It
+// answers a SHARE request and is part of a status reply.
+type ShareStatus struct {
+	Users  []SharedUser `json:"users,omitempty"`
+	Socket string       `json:"socket,omitempty"`
+}
+
+// ClientInfo describes a connected client in a status reply.
+type ClientInfo struct {
+	Mode string `json:"mode"`
+	TTY  string `json:"tty,omitempty"`
+	SSH  string `json:"ssh,omitempty"`
+	// NoResize is set for clients that leave the session's size alone.
+	NoResize bool `json:"no_resize,omitempty"`
+	// PID is the peer process as reported by the kernel (0 if unknown).
+	PID int `json:"pid,omitempty"`
+	// User names the peer's user when it is not the session's owner.
+	User string `json:"user,omitempty"`
+	// Direct is set for a client using the session's terminal directly;
+	// its byte counts cover only what went through the daemon.
+	Direct       bool      `json:"direct,omitempty"`
+	ConnectedAt  time.Time `json:"connected_at"`
+	LastActivity time.Time `json:"last_activity"`
+	BytesIn      uint64    `json:"bytes_in"`
+	BytesOut     uint64    `json:"bytes_out"`
+}
+
+// StatusPayload answers a STATUS request.
+type StatusPayload struct {
+	Session string       `json:"session"`
+	PID     int          `json:"pid"`
+	Clients []ClientInfo `json:"clients"`
+	// LastOutput, LastInput and LastAttach are zero if there has been none.
+	LastOutput time.Time `json:"last_output"`
+	LastInput  time.Time `json:"last_input"`
+	LastAttach time.Time `json:"last_attach"`
+	// Scrollback is how many bytes of output the daemon holds in memory.
+	Scrollback int `json:"scrollback"`
+	// Shared is set while the session is shared with other users.
+	Shared *ShareStatus `json:"shared,omitempty"`
+	// Foreground is set while a job other than the session's command
+	// holds its terminal, e.g. a program started from its shell.
+	Foreground *ForegroundJob `json:"foreground,omitempty"`
+	// Throttled is set while the daemon has stopped reading the session's
+	// output, which nobody would see or keep; the program writing it is
+	// held up until a client attaches.
+	Throttled bool `json:"throttled,omitempty"`
+	// Stopped is set while the session's output is stopped, as by Ctrl-S;
+	// its programs are held up writing until Ctrl-Q.
+	Stopped bool `json:"stopped,omitempty"`
+	// BytesOut counts the output the session's programs have written to
+	// its terminal since it started.
+	BytesOut uint64 `json:"bytes_out"`
+	// OOMScoreAdj is the daemon's oom_score_adj on Linux, negative when
+	// it keeps the OOM killer off itself; see sess's oom-score-adj
+	// setting. Zero elsewhere.
+	OOMScoreAdj int `json:"oom_score_adj,omitempty"`
+	// Title is the window title the session's programs last set, if
+	// any; see Title.
+	Title string `json:"title,omitempty"`
+	// Cwd is the working directory the session's shell last announced by
+	// OSC 7, if it has; see Cwd.
+	Cwd string `json:"cwd,omitempty"`
+	// Expires is when the daemon ends the session as its timeout is up,
+	// if it has one; see TimeoutPayload.
+	Expires *time.Time `json:"expires,omitempty"`
+	// Rows and Cols are the size of the session's terminal, zero if the
+	// daemon cannot tell.
+	Rows int `json:"rows,omitempty"`
+	Cols int `json:"cols,omitempty"`
+}
+
+// ForegroundJob is the job in a session's terminal foreground.
+type ForegroundJob struct {
+	PGID int `json:"pgid"`
+	// Command is the process group leader's command line, if known.
+	Command string `json:"command,omitempty"`
+}
+
+// EncodeMessage renders a message as a single JSON line.
+func EncodeMessage(msgType string, payload interface{}) ([]byte, error) {
+	msg := Message{Type: msgType}
+
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal payload: %w", err)
+		}
+		msg.Payload = data
+	}
+
+	data, err := json.Marshal(&msg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode message: %w", err)
+	}
+	return append(data, '\n'), nil
+}
+
+// ParseMessage decodes a single JSON message line.
+func ParseMessage(line []byte) (*Message, error) {
+	var msg Message
+	if err := json.Unmarshal(line, &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// ReadMessageFrom reads one message line from r. Lines longer than r's
+// buffer are rejected rather than accumulated.
+func ReadMessageFrom(r *bufio.Reader) (*Message, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		return nil, err
+	}
+	return ParseMessage(line)
+}
+
+// Decode unmarshals the message payload into v.
+func (m *Message) Decode(v interface{}) error {
+	if len(m.Payload) == 0 {
+		return nil
+	}
+	return json.Unmarshal(m.Payload, v)
+}
+
+type Connection struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+}
+
+func NewConnection(conn net.Conn) *Connection {
+	return &Connection{
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+		writer: bufio.NewWriter(conn),
+	}
+}
+
+func (c *Connection) SendMessage(msgType string, payload interface{}) error {
+	data, err := EncodeMessage(msgType, payload)
+	if err != nil {
+		return err
+	}
+
+	if _, err := c.writer.Write(data); err != nil {
+		return err
+	}
+	return c.writer.Flush()
+}
+
+func (c *Connection) ReadMessage() (*Message, error) {
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	return ReadMessageFrom(c.reader)
+}
+
+func (c *Connection) SendRaw(data []byte) error {
+	c.conn.SetWriteDeadline(time.Now().Add(1 * time.Second))
+	_, err := c.conn.Write(data)
+	return err
+}
+
+func (c *Connection) ReadRaw(buffer []byte) (int, error) {
+	c.conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	return c.conn.Read(buffer)
+}
+
+func (c *Connection) Close() error {
+	return c.conn.Close()
+}
+
+func (c *Connection) SetRaw() error {
+	if f, ok := c.conn.(*net.UnixConn); ok {
+		file, err := f.File()
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+	}
+	return nil
+}
+
+// After READY, a daemon sends a framed client a sequence of frames, so
+// replies such as PONG cannot be mistaken for terminal output. A frame is a
+// one-byte kind, the payload length as a big-endian uint32, and the payload.
+const (
+	FrameHeaderSize = 5
+	// FrameData carries session output.
+	FrameData byte = 'D'
+	// FrameControl carries one encoded Message.
+	FrameControl byte = 'C'
+
+	// maxFrameSize bounds a frame's payload; larger lengths mean the
+	// stream is corrupt.
+	maxFrameSize = 1 << 20
+)
+
+// WriteFrameHeader fills buf[:FrameHeaderSize] with the header of a frame
+// of kind whose payload is n bytes, so a payload read into the rest of buf
+// can be sent as one write.
+func WriteFrameHeader(buf []byte, kind byte, n int) {
+	buf[0] = kind
+	binary.BigEndian.PutUint32(buf[1:FrameHeaderSize], uint32(n))
+}
+
+// EncodeControlFrame renders msgType and payload as a control frame.
+func EncodeControlFrame(msgType string, payload interface{}) ([]byte, error) {
+	msg, err := EncodeMessage(msgType, payload)
+	if err != nil {
+		return nil, err
+	}
+	frame := make([]byte, FrameHeaderSize+len(msg))
+	WriteFrameHeader(frame, FrameControl, len(msg))
+	copy(frame[FrameHeaderSize:], msg)
+	return frame, nil
+}
+
+// ReadFrame reads one frame from r and returns its kind and payload: for
+// FrameData, session output; for FrameControl, a message for ParseMessage.
+func ReadFrame(r io.Reader) (kind byte, payload []byte, err error) {
+	var header [FrameHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(header[1:])
+	if n > maxFrameSize {
+		return 0, nil, fmt.Errorf("corrupt frame (%d bytes)", n)
+	}
+	if header[0] != FrameData && header[0] != FrameControl {
+		return 0, nil, fmt.Errorf("corrupt frame (kind %q)", header[0])
+	}
+	payload = make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, nil, err
+	}
+	return header[0], payload, nil
+}
+
+// writeTimeout bounds how long a RawMode write may block on a daemon that
+// has stopped reading. The deadline is armed coarsely, so a write fails
+// after between half and all of it.
+const writeTimeout = 1 * time.Second
+
+type RawMode struct {
+	conn   net.Conn
+	buffer []byte
+	// writeDeadline is the write deadline last armed on conn, in unix
+	// nanoseconds. Writes come from several goroutines.
+	writeDeadline atomic.Int64
+
+	// For framed connections: bytes read but not yet parsed into whole
+	// frames, the output collected from them, and where control frames go.
+	framed    bool
+	pending   []byte
+	out       []byte
+	onControl func(*Message)
+
+	// unread is session output read along with the handshake, returned by
+	// the first Read.
+	unread []byte
+}
+
+func NewRawMode(conn net.Conn) *RawMode {
+	return &RawMode{
+		conn:   conn,
+		buffer: make([]byte, 4096),
+	}
+}
+
+// NewFramedRawMode is NewRawMode for a daemon that frames its output. Read
+// returns only session output; control frames are passed to onControl.
+func NewFramedRawMode(conn net.Conn, onControl func(*Message)) *RawMode {
+	r := NewRawMode(conn)
+	r.framed = true
+	r.onControl = onControl
+	return r
+}
+
+// Write sends data to the daemon in full. Keystrokes come through here one
+// or a few bytes at a time, so the write deadline is only moved on when
+// less than half of writeTimeout is left of it, not for every write.
+func (r *RawMode) Write(data []byte) error {
+	now := time.Now()
+	if deadline := r.writeDeadline.Load(); now.UnixNano() > deadline-int64(writeTimeout/2) {
+		next := now.Add(writeTimeout)
+		r.conn.SetWriteDeadline(next)
+		r.writeDeadline.Store(next.UnixNano())
+	}
+
+	// A net.Conn writes everything or fails; other writers may stop
+	// short without saying why, and are given the rest while they make
+	// progress.
+	for len(data) > 0 {
+		n, err := r.conn.Write(data)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return io.ErrShortWrite
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+// Unread hands back output that was read from the connection before r took
+// it over, such as what arrived in the same read as READY.
+func (r *RawMode) Unread(data []byte) {
+	r.unread = append(r.unread, data...)
+}
+
+// Framed reports whether the daemon frames its output, and so can send
+// control messages among it.
+func (r *RawMode) Framed() bool {
+	return r.framed
+}
+
+func (r *RawMode) Read() ([]byte, error) {
+	if len(r.unread) > 0 {
+		data := r.unread
+		r.unread = nil
+		if r.framed {
+			return r.unframe(data)
+		}
+		return data, nil
+	}
+
+	r.conn.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	n, err := r.conn.Read(r.buffer)
+	if err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	if r.framed {
+		return r.unframe(r.buffer[:n])
+	}
+	return r.buffer[:n], nil
+}
+
+// unframe adds data to what has been read so far and returns the output of
+// the frames now complete, handing control frames to onControl. A partial
+// frame waits for the next read.
+func (r *RawMode) unframe(data []byte) ([]byte, error) {
+	r.pending = append(r.pending, data...)
+	r.out = r.out[:0]
+	p := r.pending
+	for len(p) >= FrameHeaderSize {
+		n := int(binary.BigEndian.Uint32(p[1:FrameHeaderSize]))
+		if n > maxFrameSize {
+			return nil, fmt.Errorf("corrupt frame (%d bytes)", n)
+		}
+		if len(p) < FrameHeaderSize+n {
+			break
+		}
+		payload := p[FrameHeaderSize : FrameHeaderSize+n]
+		switch p[0] {
+		case FrameData:
+			r.out = append(r.out, payload...)
+		case FrameControl:
+			msg, err := ParseMessage(payload)
+			if err == nil && r.onControl != nil {
+				r.onControl(msg)
+			}
+		default:
+			return nil, fmt.Errorf("corrupt frame (kind %q)", p[0])
+		}
+		p = p[FrameHeaderSize+n:]
+	}
+	r.pending = append(r.pending[:0], p...)
+	return r.out, nil
+}
+
+func (r *RawMode) Close() error {
+	return r.conn.Close()
+}
@@ -0,0 +1,305 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dribbleConn takes at most limit bytes per write, without an error, and
+// counts the write deadlines set on it.
+type dribbleConn struct {
+	net.Conn
+	limit     int
+	written   bytes.Buffer
+	deadlines int
+}
+
+func (c *dribbleConn) Write(p []byte) (int, error) {
+	if len(p) > c.limit {
+		p = p[:c.limit]
+	}
+	return c.written.Write(p)
+}
+
+func (c *dribbleConn) SetWriteDeadline(time.Time) error {
+	c.deadlines++
+	return nil
+}
+
+func TestRawModeWriteFinishesShortWrites(t *testing.T) {
+	conn := &dribbleConn{limit: 3}
+	r := NewRawMode(conn)
+	if err := r.Write([]byte("RESIZE 24 80\n")); err != nil {
+		t.Fatal(err)
+	}
+	if got := conn.written.String(); got != "RESIZE 24 80\n" {
+		t.Errorf("wrote %q", got)
+	}
+
+	// A writer that makes no progress fails rather than spinning.
+	conn.limit = 0
+	if err := r.Write([]byte("x")); !errors.Is(err, io.ErrShortWrite) {
+		t.Errorf("Write to a stuck writer = %v; want io.ErrShortWrite", err)
+	}
+}
+
+// Keystrokes written in quick succession share one write deadline.
+func TestRawModeWriteArmsDeadlineCoarsely(t *testing.T) {
+	conn := &dribbleConn{limit: 4096}
+	r := NewRawMode(conn)
+	for i := 0; i < 100; i++ {
+		if err := r.Write([]byte("k")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if conn.deadlines != 1 {
+		t.Errorf("%d write deadlines set for 100 quick writes; want 1", conn.deadlines)
+	}
+
+	// Once less than half the timeout is left, the next write moves it on.
+	r.writeDeadline.Store(time.Now().Add(writeTimeout / 4).UnixNano())
+	r.Write([]byte("k"))
+	if conn.deadlines != 2 {
+		t.Errorf("deadline not moved on when about to expire (%d set)", conn.deadlines)
+	}
+}
+
+func TestAltScreen(t *testing.T) {
+	var a AltScreen
+	steps := []struct {
+		out string
+		on  bool
+	}{
+		{"plain output\r\n", false},
+		{"\x1b[?1049h\x1b[H\x1b[2J", true},
+		{"\x1b[?25l\x1b[1;1H", true},
+		{"\x1b[?1049l", false},
+		// Split across writes.
+		{"\x1b[?10", false},
+		{"49", false},
+		{"h", true},
+		// Among other modes, and the older forms.
+		{"\x1b[?1;47l", false},
+		{"\x1b[?1047h", true},
+		// An escape abandoning a sequence starts the next.
+		{"\x1b[\x1b[?1049l", false},
+	}
+	for _, s := range steps {
+		a.Write([]byte(s.out))
+		if a.On() != s.on {
+			t.Errorf("after %q On() = %v; want %v", s.out, a.On(), s.on)
+		}
+	}
+}
+
+func TestTitle(t *testing.T) {
+	var title Title
+	long := strings.Repeat("é", MaxTitle)
+	steps := []struct {
+		out  string
+		want string
+	}{
+		{"plain output\r\n", ""},
+		{"\x1b]0;user@host: ~\x07$ ", "user@host: ~"},
+		{"\x1b]2;vim main.go\x1b\\", "vim main.go"},
+		// Split across writes, and among other output.
+		{"\x1b[1mbold\x1b[0m\x1b]", "vim main.go"},
+		{"2;ma", "vim main.go"},
+		{"ke\x07", "make"},
+		// Other OSCs, and a title abandoned or cancelled, change nothing.
+		{"\x1b]7;file://host/tmp\x07\x1b]52;c;aGk=\x1b\\", "make"},
+		{"\x1b]2;half\x1b[0m\x1b]2;cancelled\x18", "make"},
+		// Control characters are dropped, and a long title is cut short
+		// without splitting a character.
+		{"\x1b]1;a\tb\x07", "ab"},
+		{"\x1b]2;a" + long + "\x07", "a" + long[:MaxTitle-2]},
+		{"\x1b]0;\x07", ""},
+	}
+	for _, s := range steps {
+		title.Write([]byte(s.out))
+		if got := title.Get(); got != s.want {
+			t.Errorf("after %q Get() = %q; want %q", s.out, got, s.want)
+		}
+	}
+}
+
+func TestCwd(t *testing.T) {
+	c := Cwd{Host: "box"}
+	steps := []struct {
+		out  string
+		want string
+	}{
+		{"\x1b]0;title\x07$ ", ""},
+		{"\x1b]7;file://box/home/me\x07", "/home/me"},
+		{"\x1b]7;file:///tmp/a%20b/\x1b\\", "/tmp/a b"},
+		// Split across writes.
+		{"\x1b]7;file://local", "/tmp/a b"},
+		{"host/srv\x07", "/srv"},
+		// Malformed URLs are ignored.
+		{"\x1b]7;/etc\x07\x1b]7;file://box/%zz\x07\x1b]7;http://box/x\x07\x1b]7;file:relative\x07", "/srv"},
+		{"\x1b]7;file://box/" + strings.Repeat("d", maxCwdURL) + "\x07", "/srv"},
+		// Another host's directory is not the session's.
+		{"\x1b]7;file://elsewhere/home/me\x07", ""},
+	}
+	for _, s := range steps {
+		c.Write([]byte(s.out))
+		if got := c.Get(); got != s.want {
+			t.Errorf("after %q Get() = %q; want %q", s.out, got, s.want)
+		}
+	}
+}
+
+func TestControlCommands(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want []string
+	}{
+		{string(ResizeLine(24, 80)), []string{"RESIZE 24 80"}},
+		{"RESIZE 24 80\nREDRAW ctrl-l\n", []string{"RESIZE 24 80", "REDRAW ctrl-l"}},
+		{string(ResizePixelsLine(24, 80, 800, 480)), []string{"RESIZE 24 80 800 480"}},
+		{"PING\n", []string{"PING"}},
+		// Keystrokes that merely look like commands.
+		{"RESIZE 24 80", nil},
+		{"ls\nPING\n", nil},
+		{"RESIZE 24 eighty\n", nil},
+		{"RESIZE 24 80 800\n", nil},
+		{"RESIZE 24 80 800 70000\n", nil},
+		{"PING  \n", nil},
+		{"\n", nil},
+	} {
+		got := ControlCommands([]byte(tc.in))
+		if len(got) != len(tc.want) {
+			t.Errorf("ControlCommands(%q) = %q; want %q", tc.in, got, tc.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tc.want[i] {
+				t.Errorf("ControlCommands(%q) = %q; want %q", tc.in, got, tc.want)
+			}
+		}
+	}
+}
+
+func TestResizeArgs(t *testing.T) {
+	for _, tc := range []struct {
+		line string
+		want ResizePayload
+		ok   bool
+	}{
+		{"RESIZE 24 80", ResizePayload{Rows: 24, Cols: 80}, true},
+		{"RESIZE 24 80 800 480", ResizePayload{Rows: 24, Cols: 80, XPixel: 800, YPixel: 480}, true},
+		{"RESIZE 65535 20000", ResizePayload{Rows: MaxTerminalSize, Cols: MaxTerminalSize}, true},
+		{"RESIZE 0 80", ResizePayload{}, false},
+		{"RESIZE 99999999 99999999", ResizePayload{}, false},
+		{"PING", ResizePayload{}, false},
+	} {
+		got, ok := ResizeArgs(tc.line)
+		if ok != tc.ok || (ok && got != tc.want) {
+			t.Errorf("ResizeArgs(%q) = %+v, %v; want %+v, %v", tc.line, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+// FuzzControlCommands feeds a daemon's parsing of in-band commands what a
+// client might send: nothing may panic, and a size taken from a RESIZE is
+// always one a daemon applies.
+func FuzzControlCommands(f *testing.F) {
+	for _, seed := range []string{"RESIZE 24 80\n", "RESIZE 24 80 800 480\nREDRAW ctrl-l\n", "PING\nDISCONNECT\n", "RESIZE 65535 0\n", "RESIZE  1 1\n", "ls\n"} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, line := range ControlCommands(data) {
+			size, ok := ResizeArgs(line)
+			if ok && (size.Rows < 1 || size.Rows > MaxTerminalSize || size.Cols < 1 || size.Cols > MaxTerminalSize) {
+				t.Errorf("ResizeArgs(%q) = %+v", line, size)
+			}
+		}
+	})
+}
+
+// FuzzReadMessage feeds the reading of an opening request malformed lines:
+// they must be refused, not panic.
+func FuzzReadMessage(f *testing.F) {
+	for _, seed := range []string{`{"type":"CONNECT","payload":{"mode":"attach","size":{"rows":24,"cols":80}}}` + "\n", `{"type":"CONNECT","payload":"x"}` + "\n", "{\n", `{"type":7}` + "\n"} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg, err := ReadMessageFrom(bufio.NewReader(bytes.NewReader(data)))
+		if err != nil {
+			return
+		}
+		var hello ConnectPayload
+		if msg.Decode(&hello) == nil && hello.Size != nil {
+			ClampSize(*hello.Size)
+		}
+	})
+}
+
+// FuzzFrames feeds both readers of framed output corrupt streams: they
+// must fail or stop, never panic or buffer more than a frame.
+func FuzzFrames(f *testing.F) {
+	control, _ := EncodeControlFrame(MsgPong, nil)
+	data := make([]byte, FrameHeaderSize+2)
+	WriteFrameHeader(data, FrameData, 2)
+	copy(data[FrameHeaderSize:], "hi")
+	f.Add(append(data, control...), 3)
+	f.Add([]byte{'D', 0xff, 0xff, 0xff, 0xff}, 0)
+	f.Add([]byte{'C', 0, 0, 0, 4, '{', '}', '\n', 'x'}, 7)
+	f.Fuzz(func(t *testing.T, data []byte, split int) {
+		r := bytes.NewReader(data)
+		for {
+			_, payload, err := ReadFrame(r)
+			if err != nil {
+				break
+			}
+			if len(payload) > maxFrameSize {
+				t.Fatalf("ReadFrame returned %d bytes", len(payload))
+			}
+		}
+
+		rm := &RawMode{framed: true, onControl: func(*Message) {}}
+		split = min(max(split, 0), len(data))
+		for _, chunk := range [][]byte{data[:split], data[split:]} {
+			if _, err := rm.unframe(chunk); err != nil {
+				return
+			}
+			if len(rm.pending) > FrameHeaderSize+maxFrameSize {
+				t.Fatalf("%d bytes pending", len(rm.pending))
+			}
+		}
+	})
+}
+
+func TestReadFrame(t *testing.T) {
+	control, err := EncodeControlFrame(MsgPong, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, FrameHeaderSize+2)
+	WriteFrameHeader(data, FrameData, 2)
+	copy(data[FrameHeaderSize:], "hi")
+	r := bytes.NewReader(append(data, control...))
+
+	if kind, payload, err := ReadFrame(r); err != nil || kind != FrameData || string(payload) != "hi" {
+		t.Errorf("ReadFrame = %q, %q, %v; want the data frame", kind, payload, err)
+	}
+	kind, payload, err := ReadFrame(r)
+	if err != nil || kind != FrameControl {
+		t.Fatalf("ReadFrame = %q, %q, %v; want the control frame", kind, payload, err)
+	}
+	if msg, err := ParseMessage(payload); err != nil || msg.Type != MsgPong {
+		t.Errorf("control frame %q; want PONG", payload)
+	}
+	if _, _, err := ReadFrame(r); err != io.EOF {
+		t.Errorf("ReadFrame at the end = %v; want io.EOF", err)
+	}
+	if _, _, err := ReadFrame(bytes.NewReader(data[:4])); err != io.ErrUnexpectedEOF {
+		t.Errorf("ReadFrame of a cut header = %v; want io.ErrUnexpectedEOF", err)
+	}
+}
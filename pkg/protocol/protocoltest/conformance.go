@@ -0,0 +1,281 @@
+package protocoltest
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/theMichaelB/sess/pkg/protocol"
+)
+
+// timeout bounds each exchange with the daemon under test.
+const timeout = 2 * time.Second
+
+// Conformance checks that the daemon listening on socket speaks the
+// protocol: its one-shot requests, the attach handshake in either mode,
+// the control lines and frames, and its refusals. The session must have no
+// client attached; it is attached to and detached from, but nothing is
+// typed into it and its size is left alone.
+func Conformance(t *testing.T, socket string) {
+	var session string
+	t.Run("Status", func(t *testing.T) {
+		var st protocol.StatusPayload
+		decode(t, request(t, socket, protocol.MsgStatus, nil), protocol.MsgStatus, &st)
+		if st.Session == "" || st.PID <= 0 {
+			t.Errorf("STATUS names session %q, pid %d", st.Session, st.PID)
+		}
+		if len(st.Clients) != 0 {
+			t.Fatalf("session has %d clients; Conformance needs none", len(st.Clients))
+		}
+		session = st.Session
+	})
+
+	t.Run("UnknownRequest", func(t *testing.T) {
+		expectError(t, request(t, socket, "NO-SUCH-REQUEST", nil))
+	})
+
+	t.Run("MalformedConnect", func(t *testing.T) {
+		expectError(t, request(t, socket, protocol.MsgConnect, "not a ConnectPayload"))
+	})
+
+	t.Run("Input", func(t *testing.T) {
+		decode(t, request(t, socket, protocol.MsgInput, protocol.InputPayload{}), protocol.MsgReady, nil)
+	})
+
+	t.Run("Scrollback", func(t *testing.T) {
+		conn := dial(t, socket)
+		send(t, conn, protocol.MsgScrollback, protocol.ScrollbackPayload{Bytes: 16})
+		reader := bufio.NewReader(conn)
+		msg, err := protocol.ReadMessageFrom(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type == protocol.MsgError {
+			// A session may keep no scrollback.
+			return
+		}
+		var reply protocol.ScrollbackReply
+		decode(t, msg, protocol.MsgScrollback, &reply)
+		if reply.Size < 0 || reply.Size > 16 {
+			t.Fatalf("SCROLLBACK of 16 bytes announces %d", reply.Size)
+		}
+		rest, err := io.ReadAll(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int64(len(rest)) != reply.Size {
+			t.Errorf("SCROLLBACK announced %d bytes and sent %d", reply.Size, len(rest))
+		}
+	})
+
+	t.Run("Attach", func(t *testing.T) {
+		conn, ready, reader := attach(t, socket, protocol.ConnectPayload{Mode: protocol.ModeAttach, Framed: true})
+		if ready.Session != session || ready.Version != protocol.Version || ready.PID <= 0 || !ready.Framed {
+			t.Errorf("READY = %+v; want session %q, version %d, framed", ready, session, protocol.Version)
+		}
+		expectClients(t, socket, protocol.ModeAttach)
+
+		t.Run("Busy", func(t *testing.T) {
+			c, err := net.DialTimeout("unix", socket, timeout)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			_, _, err = protocol.Handshake(c, protocol.ConnectPayload{Mode: protocol.ModeAttach}, timeout)
+			var e *protocol.ErrorPayload
+			if !errors.As(err, &e) || e.Code != protocol.ErrCodeBusy {
+				t.Errorf("second attach: %v; want an ERROR coded %q", err, protocol.ErrCodeBusy)
+			}
+		})
+
+		t.Run("Peek", func(t *testing.T) {
+			peek, ready, _ := attach(t, socket, protocol.ConnectPayload{Mode: protocol.ModePeek})
+			if ready.Framed {
+				t.Error("READY says framed to a client that did not ask")
+			}
+			expectClients(t, socket, protocol.ModeAttach, protocol.ModePeek)
+			write(t, peek, protocol.DisconnectLine)
+			expectClosed(t, peek)
+			expectClients(t, socket, protocol.ModeAttach)
+		})
+
+		t.Run("Ping", func(t *testing.T) {
+			write(t, conn, protocol.PingLine)
+			readControl(t, conn, reader, protocol.MsgPong)
+		})
+
+		t.Run("Detach", func(t *testing.T) {
+			decode(t, request(t, socket, protocol.MsgDetach, protocol.DetachPayload{Reason: "conformance"}), protocol.MsgReady, nil)
+			var p protocol.DetachPayload
+			decode(t, readControl(t, conn, reader, protocol.MsgDetach), protocol.MsgDetach, &p)
+			if p.Reason != "conformance" {
+				t.Errorf("DETACH reason %q; want %q", p.Reason, "conformance")
+			}
+			expectClosed(t, conn)
+			expectClients(t, socket)
+		})
+	})
+
+	t.Run("Disconnect", func(t *testing.T) {
+		conn, _, _ := attach(t, socket, protocol.ConnectPayload{Mode: protocol.ModeAttach})
+		write(t, conn, protocol.DisconnectLine)
+		expectClosed(t, conn)
+		expectClients(t, socket)
+	})
+}
+
+// dial connects to socket for the rest of the test.
+func dial(t *testing.T, socket string) net.Conn {
+	t.Helper()
+	conn, err := net.DialTimeout("unix", socket, timeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(timeout))
+	return conn
+}
+
+// send writes one message to conn.
+func send(t *testing.T, conn net.Conn, msgType string, payload interface{}) {
+	t.Helper()
+	data, err := protocol.EncodeMessage(msgType, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write(t, conn, data)
+}
+
+func write(t *testing.T, conn net.Conn, data []byte) {
+	t.Helper()
+	conn.SetWriteDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// request makes a one-shot request and returns the reply.
+func request(t *testing.T, socket, msgType string, payload interface{}) *protocol.Message {
+	t.Helper()
+	conn := dial(t, socket)
+	send(t, conn, msgType, payload)
+	msg, err := protocol.ReadMessageFrom(bufio.NewReader(conn))
+	if err != nil {
+		t.Fatalf("reply to %s: %v", msgType, err)
+	}
+	return msg
+}
+
+// decode checks msg is of type want and decodes its payload into v, if v
+// is not nil.
+func decode(t *testing.T, msg *protocol.Message, want string, v interface{}) {
+	t.Helper()
+	if msg.Type != want {
+		t.Fatalf("got %s %s; want %s", msg.Type, msg.Payload, want)
+	}
+	if v != nil {
+		if err := json.Unmarshal(msg.Payload, v); err != nil {
+			t.Fatalf("malformed %s: %v", msg.Type, err)
+		}
+	}
+}
+
+// expectError checks msg is an ERROR saying why.
+func expectError(t *testing.T, msg *protocol.Message) {
+	t.Helper()
+	var e protocol.ErrorPayload
+	decode(t, msg, protocol.MsgError, &e)
+	if e.Message == "" {
+		t.Error("ERROR without a message")
+	}
+}
+
+// attach opens a client connection with hello, for the rest of the test.
+func attach(t *testing.T, socket string, hello protocol.ConnectPayload) (net.Conn, *protocol.ReadyPayload, *bufio.Reader) {
+	t.Helper()
+	conn, err := net.DialTimeout("unix", socket, timeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	ready, reader, err := protocol.Handshake(conn, hello, timeout)
+	if err != nil {
+		t.Fatalf("attach: %v", err)
+	}
+	return conn, ready, reader
+}
+
+// readControl reads frames until a control frame, which must hold a
+// message of type want, skipping the session's output.
+func readControl(t *testing.T, conn net.Conn, reader *bufio.Reader, want string) *protocol.Message {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	for {
+		kind, payload, err := protocol.ReadFrame(reader)
+		if err != nil {
+			t.Fatalf("waiting for %s: %v", want, err)
+		}
+		if kind != protocol.FrameControl {
+			continue
+		}
+		msg, err := protocol.ParseMessage(payload)
+		if err != nil {
+			t.Fatalf("malformed control frame %q: %v", payload, err)
+		}
+		if msg.Type != want {
+			t.Fatalf("got %s; want %s", msg.Type, want)
+		}
+		return msg
+	}
+}
+
+// expectClosed checks the daemon closes conn, reading past any output.
+func expectClosed(t *testing.T, conn net.Conn) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	if _, err := io.Copy(io.Discard, conn); err != nil {
+		t.Errorf("connection not closed: %v", err)
+	}
+}
+
+// expectClients waits for STATUS to list clients of exactly the modes
+// given, in any order.
+func expectClients(t *testing.T, socket string, modes ...string) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for {
+		var st protocol.StatusPayload
+		decode(t, request(t, socket, protocol.MsgStatus, nil), protocol.MsgStatus, &st)
+		got := map[string]int{}
+		for _, c := range st.Clients {
+			got[c.Mode]++
+		}
+		want := map[string]int{}
+		for _, m := range modes {
+			want[m]++
+		}
+		if len(st.Clients) == len(modes) && sameCounts(got, want) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("STATUS lists clients %v; want %v", got, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func sameCounts(a, b map[string]int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, n := range a {
+		if b[k] != n {
+			return false
+		}
+	}
+	return true
+}
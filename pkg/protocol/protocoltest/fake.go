@@ -0,0 +1,472 @@
+// Package protocoltest helps test programs that speak the sess protocol:
+// FakeDaemon stands in for a session's daemon, and Conformance checks a
+// daemon, real or fake, against the protocol.
+package protocoltest
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/theMichaelB/sess/pkg/protocol"
+)
+
+// writeTimeout bounds a write to a client that has stopped reading.
+const writeTimeout = 1 * time.Second
+
+// FakeDaemon serves the sess protocol on a unix socket as a session's
+// daemon does, with no terminal or program behind it: a test writes the
+// session's output with Output and looks at what clients typed and asked
+// for with Input, Size and Redraws. It handles the attach handshake, the
+// control lines and frames, and the one-shot STATUS, INPUT, DETACH and
+// SCROLLBACK requests; SIGNAL and ENV are acknowledged and ignored, and
+// SHARE and UPGRADE refused.
+type FakeDaemon struct {
+	// Session is the number the fake answers for, and ChildPID the
+	// process it reports running the session's command.
+	Session  string
+	ChildPID int
+
+	dir    string
+	socket string
+	ln     net.Listener
+	wg     sync.WaitGroup
+
+	mu         sync.Mutex
+	conns      map[net.Conn]bool // every open connection
+	clients    map[net.Conn]*fakeClient
+	closed     bool
+	input      []byte
+	output     []byte
+	bytesOut   uint64
+	rows, cols int
+	redraws    int
+	lastOutput time.Time
+	lastInput  time.Time
+	lastAttach time.Time
+}
+
+// fakeClient is a client attached to a FakeDaemon.
+type fakeClient struct {
+	conn   net.Conn
+	info   protocol.ClientInfo
+	framed bool
+}
+
+// NewFakeDaemon starts a fake daemon for session, listening until the test
+// ends or Close is called.
+func NewFakeDaemon(tb testing.TB, session string) *FakeDaemon {
+	tb.Helper()
+	// Not tb.TempDir: a unix socket's path must stay short.
+	dir, err := os.MkdirTemp("", "sess-fake-")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	socket := filepath.Join(dir, "session-"+session+".sock")
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		os.RemoveAll(dir)
+		tb.Fatal(err)
+	}
+	f := &FakeDaemon{
+		Session:  session,
+		ChildPID: os.Getpid(),
+		dir:      dir,
+		socket:   socket,
+		ln:       ln,
+		conns:    make(map[net.Conn]bool),
+		clients:  make(map[net.Conn]*fakeClient),
+	}
+	f.wg.Add(1)
+	go f.accept()
+	tb.Cleanup(f.Close)
+	return f
+}
+
+// Socket returns the path clients connect to.
+func (f *FakeDaemon) Socket() string {
+	return f.socket
+}
+
+// Close disconnects every client, stops listening and removes the socket.
+func (f *FakeDaemon) Close() {
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		return
+	}
+	f.closed = true
+	f.ln.Close()
+	for conn := range f.conns {
+		conn.Close()
+	}
+	f.clients = make(map[net.Conn]*fakeClient)
+	f.mu.Unlock()
+	f.wg.Wait()
+	os.RemoveAll(f.dir)
+}
+
+// Output sends p to the attached clients as the session's output, and
+// keeps it for SCROLLBACK requests.
+func (f *FakeDaemon) Output(p []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.output = append(f.output, p...)
+	f.bytesOut += uint64(len(p))
+	f.lastOutput = time.Now()
+	frame := make([]byte, protocol.FrameHeaderSize+len(p))
+	protocol.WriteFrameHeader(frame, protocol.FrameData, len(p))
+	copy(frame[protocol.FrameHeaderSize:], p)
+	for conn, c := range f.clients {
+		data := frame[protocol.FrameHeaderSize:]
+		if c.framed {
+			data = frame
+		}
+		conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		if _, err := conn.Write(data); err != nil {
+			f.removeLocked(conn)
+		}
+	}
+}
+
+// Exit ends the session as its command exiting with status would: framed
+// clients are told, and all are disconnected.
+func (f *FakeDaemon) Exit(status int) {
+	f.farewell(protocol.MsgExit, protocol.ExitPayload{Status: status})
+}
+
+// Detach disconnects every client, telling framed ones reason.
+func (f *FakeDaemon) Detach(reason string) {
+	f.farewell(protocol.MsgDetach, protocol.DetachPayload{Reason: reason})
+}
+
+// Input returns what has been typed into the session so far, by attached
+// clients and INPUT requests.
+func (f *FakeDaemon) Input() []byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return bytes.Clone(f.input)
+}
+
+// Size returns the size clients last gave the session, 0 by 0 if none has.
+func (f *FakeDaemon) Size() (rows, cols int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.rows, f.cols
+}
+
+// Redraws counts the REDRAW requests received.
+func (f *FakeDaemon) Redraws() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.redraws
+}
+
+// Clients describes the clients attached.
+func (f *FakeDaemon) Clients() []protocol.ClientInfo {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	infos := make([]protocol.ClientInfo, 0, len(f.clients))
+	for _, c := range f.clients {
+		infos = append(infos, c.info)
+	}
+	return infos
+}
+
+func (f *FakeDaemon) accept() {
+	defer f.wg.Done()
+	for {
+		conn, err := f.ln.Accept()
+		if err != nil {
+			return
+		}
+		f.mu.Lock()
+		if f.closed {
+			f.mu.Unlock()
+			conn.Close()
+			return
+		}
+		f.conns[conn] = true
+		f.wg.Add(1)
+		f.mu.Unlock()
+		go f.serve(conn)
+	}
+}
+
+// serve reads a connection's opening message and answers it, or keeps the
+// connection as an attached client.
+func (f *FakeDaemon) serve(conn net.Conn) {
+	defer f.wg.Done()
+	defer func() {
+		f.mu.Lock()
+		delete(f.conns, conn)
+		f.mu.Unlock()
+	}()
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	msg, err := protocol.ReadMessageFrom(reader)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	if msg.Type == protocol.MsgConnect {
+		var hello protocol.ConnectPayload
+		if err := msg.Decode(&hello); err != nil {
+			f.reply(conn, protocol.MsgError, protocol.ErrorPayload{Message: "malformed CONNECT"})
+			conn.Close()
+			return
+		}
+		if c := f.attach(conn, hello); c != nil {
+			conn.SetReadDeadline(time.Time{})
+			f.readClient(c, reader)
+		}
+		return
+	}
+	defer conn.Close()
+	switch msg.Type {
+	case protocol.MsgStatus:
+		f.reply(conn, protocol.MsgStatus, f.status())
+	case protocol.MsgInput:
+		var in protocol.InputPayload
+		if err := msg.Decode(&in); err != nil {
+			f.reply(conn, protocol.MsgError, protocol.ErrorPayload{Message: "malformed INPUT"})
+			return
+		}
+		f.mu.Lock()
+		f.input = append(f.input, in.Data...)
+		f.lastInput = time.Now()
+		f.mu.Unlock()
+		f.reply(conn, protocol.MsgReady, nil)
+	case protocol.MsgDetach:
+		var req protocol.DetachPayload
+		if err := msg.Decode(&req); err != nil {
+			f.reply(conn, protocol.MsgError, protocol.ErrorPayload{Message: "malformed DETACH"})
+			return
+		}
+		f.Detach(req.Reason)
+		f.reply(conn, protocol.MsgReady, nil)
+	case protocol.MsgScrollback:
+		var req protocol.ScrollbackPayload
+		if err := msg.Decode(&req); err != nil {
+			f.reply(conn, protocol.MsgError, protocol.ErrorPayload{Message: "malformed SCROLLBACK"})
+			return
+		}
+		held := f.scrollback(req)
+		f.reply(conn, protocol.MsgScrollback, protocol.ScrollbackReply{Size: int64(len(held))})
+		conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		conn.Write(held)
+	case protocol.MsgSignal, protocol.MsgEnv:
+		f.reply(conn, protocol.MsgReady, nil)
+	case protocol.MsgShare, protocol.MsgUpgrade:
+		f.reply(conn, protocol.MsgError, protocol.ErrorPayload{Message: msg.Type + " is not supported by FakeDaemon"})
+	default:
+		f.reply(conn, protocol.MsgError, protocol.ErrorPayload{Message: fmt.Sprintf("unknown request %q", msg.Type)})
+	}
+}
+
+// attach registers a client and sends it READY, or refuses it. It returns
+// nil if refused.
+func (f *FakeDaemon) attach(conn net.Conn, hello protocol.ConnectPayload) *fakeClient {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if hello.Mode != protocol.ModePeek {
+		hello.Mode = protocol.ModeAttach
+	}
+	if hello.Mode == protocol.ModeAttach {
+		for _, c := range f.clients {
+			if c.info.Mode == protocol.ModeAttach {
+				f.reply(conn, protocol.MsgError, protocol.ErrorPayload{
+					Message: "Session already has an active connection",
+					Code:    protocol.ErrCodeBusy,
+				})
+				conn.Close()
+				return nil
+			}
+		}
+	}
+	now := time.Now()
+	c := &fakeClient{
+		conn: conn,
+		info: protocol.ClientInfo{
+			Mode:         hello.Mode,
+			TTY:          hello.TTY,
+			SSH:          hello.SSH,
+			NoResize:     hello.NoResize,
+			ConnectedAt:  now,
+			LastActivity: now,
+		},
+		framed: hello.Framed,
+	}
+	f.clients[conn] = c
+	if hello.Mode == protocol.ModeAttach {
+		f.lastAttach = now
+	}
+	// A fake has no terminal to lend, so Direct is never granted.
+	f.reply(conn, protocol.MsgReady, protocol.ReadyPayload{
+		Session:  f.Session,
+		PID:      os.Getpid(),
+		ChildPID: f.ChildPID,
+		Version:  protocol.Version,
+		Framed:   hello.Framed,
+	})
+	return c
+}
+
+// readClient takes an attached client's keystrokes and control lines
+// until it leaves.
+func (f *FakeDaemon) readClient(c *fakeClient, reader *bufio.Reader) {
+	buffer := make([]byte, 4096)
+	for {
+		n, err := reader.Read(buffer)
+		if err != nil {
+			f.remove(c.conn)
+			return
+		}
+		f.mu.Lock()
+		c.info.LastActivity = time.Now()
+		c.info.BytesIn += uint64(n)
+		f.mu.Unlock()
+		if cmds := protocol.ControlCommands(buffer[:n]); cmds != nil {
+			for _, cmd := range cmds {
+				if !f.control(c, cmd) {
+					return
+				}
+			}
+			continue
+		}
+		if c.info.Mode == protocol.ModePeek {
+			continue
+		}
+		f.mu.Lock()
+		f.input = append(f.input, buffer[:n]...)
+		f.lastInput = time.Now()
+		f.mu.Unlock()
+	}
+}
+
+// control carries out a control line from c, returning false once c has
+// disconnected.
+func (f *FakeDaemon) control(c *fakeClient, line string) bool {
+	fields := strings.Fields(line)
+	switch fields[0] {
+	case protocol.MsgDisconnect:
+		f.remove(c.conn)
+		return false
+	case protocol.MsgPing:
+		if c.framed {
+			frame, _ := protocol.EncodeControlFrame(protocol.MsgPong, nil)
+			f.mu.Lock()
+			c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			_, err := c.conn.Write(frame)
+			f.mu.Unlock()
+			if err != nil {
+				f.remove(c.conn)
+				return false
+			}
+		}
+	case protocol.MsgResize:
+		if c.info.Mode == protocol.ModePeek || c.info.NoResize {
+			return true
+		}
+		rows, _ := strconv.Atoi(fields[1])
+		cols, _ := strconv.Atoi(fields[2])
+		f.mu.Lock()
+		f.rows, f.cols = rows, cols
+		f.mu.Unlock()
+	case protocol.MsgRedraw:
+		f.mu.Lock()
+		f.redraws++
+		f.mu.Unlock()
+	}
+	return true
+}
+
+// farewell sends a control message to the framed clients and disconnects
+// every client.
+func (f *FakeDaemon) farewell(msgType string, payload interface{}) {
+	frame, _ := protocol.EncodeControlFrame(msgType, payload)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for conn, c := range f.clients {
+		if c.framed {
+			conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			conn.Write(frame)
+		}
+		f.removeLocked(conn)
+	}
+}
+
+func (f *FakeDaemon) remove(conn net.Conn) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.removeLocked(conn)
+}
+
+func (f *FakeDaemon) removeLocked(conn net.Conn) {
+	conn.Close()
+	delete(f.clients, conn)
+}
+
+// status is the fake's answer to STATUS.
+func (f *FakeDaemon) status() protocol.StatusPayload {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	st := protocol.StatusPayload{
+		Session:    f.Session,
+		PID:        os.Getpid(),
+		Clients:    make([]protocol.ClientInfo, 0, len(f.clients)),
+		LastOutput: f.lastOutput,
+		LastInput:  f.lastInput,
+		LastAttach: f.lastAttach,
+		Scrollback: len(f.output),
+		BytesOut:   f.bytesOut,
+	}
+	for _, c := range f.clients {
+		st.Clients = append(st.Clients, c.info)
+	}
+	return st
+}
+
+// scrollback is the output a SCROLLBACK request asks for: its last lines,
+// else its last bytes, else all of it.
+func (f *FakeDaemon) scrollback(req protocol.ScrollbackPayload) []byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	held := f.output
+	switch {
+	case req.Lines > 0:
+		end := len(held)
+		if end > 0 && held[end-1] == '\n' {
+			end--
+		}
+		for i, lines := end-1, 0; i >= 0; i-- {
+			if held[i] == '\n' {
+				if lines++; lines == req.Lines {
+					held = held[i+1:]
+					break
+				}
+			}
+		}
+	case req.Bytes > 0 && req.Bytes < len(held):
+		held = held[len(held)-req.Bytes:]
+	}
+	return bytes.Clone(held)
+}
+
+// reply writes one message to conn.
+func (f *FakeDaemon) reply(conn net.Conn, msgType string, payload interface{}) {
+	data, err := protocol.EncodeMessage(msgType, payload)
+	if err != nil {
+		return
+	}
+	conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	conn.Write(data)
+}
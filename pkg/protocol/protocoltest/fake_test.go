@@ -0,0 +1,108 @@
+package protocoltest
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/theMichaelB/sess/pkg/protocol"
+)
+
+func TestFakeDaemonConformance(t *testing.T) {
+	f := NewFakeDaemon(t, "001")
+	f.Output([]byte("$ "))
+	Conformance(t, f.Socket())
+}
+
+func TestFakeDaemon(t *testing.T) {
+	f := NewFakeDaemon(t, "007")
+	conn, err := net.Dial("unix", f.Socket())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ready, reader, err := protocol.Handshake(conn, protocol.ConnectPayload{Mode: protocol.ModeAttach, Framed: true}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ready.Session != "007" || !ready.Framed {
+		t.Errorf("READY = %+v", ready)
+	}
+
+	f.Output([]byte("hello\r\n"))
+	kind, payload, err := protocol.ReadFrame(reader)
+	if err != nil || kind != protocol.FrameData || string(payload) != "hello\r\n" {
+		t.Fatalf("ReadFrame = %q, %q, %v; want the output", kind, payload, err)
+	}
+
+	// Keystrokes, then control lines, which may share a read.
+	conn.Write([]byte("ls\r"))
+	waitFor(t, func() bool { return bytes.Equal(f.Input(), []byte("ls\r")) })
+	conn.Write(protocol.ResizeLine(40, 120))
+	conn.Write(protocol.RedrawLine(false))
+	waitFor(t, func() bool {
+		rows, cols := f.Size()
+		return rows == 40 && cols == 120 && f.Redraws() == 1
+	})
+
+	f.Exit(3)
+	kind, payload, err = protocol.ReadFrame(reader)
+	if err != nil || kind != protocol.FrameControl {
+		t.Fatalf("ReadFrame = %q, %q, %v; want EXIT", kind, payload, err)
+	}
+	var exit protocol.ExitPayload
+	if msg, err := protocol.ParseMessage(payload); err != nil || msg.Type != protocol.MsgExit || msg.Decode(&exit) != nil || exit.Status != 3 {
+		t.Errorf("control frame %q; want EXIT with status 3", payload)
+	}
+	if len(f.Clients()) != 0 {
+		t.Errorf("clients %+v left after EXIT", f.Clients())
+	}
+}
+
+func TestFakeDaemonScrollback(t *testing.T) {
+	f := NewFakeDaemon(t, "001")
+	f.Output([]byte("one\ntwo\nthree\n"))
+	for _, tc := range []struct {
+		req  protocol.ScrollbackPayload
+		want string
+	}{
+		{protocol.ScrollbackPayload{}, "one\ntwo\nthree\n"},
+		{protocol.ScrollbackPayload{Lines: 2}, "two\nthree\n"},
+		{protocol.ScrollbackPayload{Bytes: 3}, "ee\n"},
+	} {
+		conn, err := net.Dial("unix", f.Socket())
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := protocol.EncodeMessage(protocol.MsgScrollback, tc.req)
+		conn.Write(data)
+		reader := bufio.NewReader(conn)
+		var reply protocol.ScrollbackReply
+		msg, err := protocol.ReadMessageFrom(reader)
+		if err != nil || msg.Decode(&reply) != nil {
+			t.Fatalf("SCROLLBACK %+v: %v", tc.req, err)
+		}
+		held := make([]byte, reply.Size)
+		if _, err := io.ReadFull(reader, held); err != nil {
+			t.Fatal(err)
+		}
+		if string(held) != tc.want {
+			t.Errorf("SCROLLBACK %+v = %q; want %q", tc.req, held, tc.want)
+		}
+		conn.Close()
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
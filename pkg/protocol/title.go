@@ -0,0 +1,41 @@
+package protocol
+
+import (
+	"strings"
+	"sync/atomic"
+)
+
+// MaxTitle bounds the window title Title keeps, in bytes; a longer one is
+// cut short.
+const MaxTitle = 256
+
+// Title follows a session's output for the window title its programs set,
+// as shells do in their prompts: by OSC 0, 1 or 2. A title cut short in
+// the middle of a character loses it. The output itself is left alone, so
+// an attached terminal sets the title too. Write is called by one
+// goroutine at a time; Get may be called by any.
+type Title struct {
+	title atomic.Pointer[string]
+	osc   oscScanner
+}
+
+// Get returns the title the output last set, if any.
+func (t *Title) Get() string {
+	if p := t.title.Load(); p != nil {
+		return *p
+	}
+	return ""
+}
+
+// Set records the title, as known from elsewhere.
+func (t *Title) Set(title string) {
+	t.title.Store(&title)
+}
+
+// Write follows a chunk of output. It allocates only for a title it has
+// read.
+func (t *Title) Write(p []byte) {
+	t.osc.write(p, MaxTitle, func(ps int) bool { return ps <= 2 }, func(text []byte, _ bool) {
+		t.Set(strings.ToValidUTF8(string(text), ""))
+	})
+}
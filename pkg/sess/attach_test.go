@@ -0,0 +1,412 @@
+package sess_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/creack/pty"
+	"github.com/theMichaelB/sess/pkg/sess"
+)
+
+func TestAttachDetachOnEOF(t *testing.T) {
+	m := newManager(t)
+	num, err := m.Create(sess.CreateOptions{Shell: "/bin/sh", Rows: 24, Cols: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Kill(num)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = m.Attach(ctx, num, sess.AttachOptions{
+		Stdin:       strings.NewReader("touch /dev/null\n"),
+		Stdout:      &strings.Builder{},
+		Size:        func() (int, int, error) { return 24, 80, nil },
+		Quiet:       true,
+		DetachOnEOF: true,
+	})
+	if err != nil {
+		t.Fatalf("Attach = %v; want a clean detach", err)
+	}
+	if ctx.Err() != nil {
+		t.Fatal("Attach did not detach at end of input")
+	}
+	if _, err := m.Get(num); err != nil {
+		t.Errorf("session did not outlive the detach: %v", err)
+	}
+}
+
+// unreadable fails the test if anything reads it.
+type unreadable struct{ t *testing.T }
+
+func (r unreadable) Read([]byte) (int, error) {
+	r.t.Error("NoInput attach read its stdin")
+	return 0, io.EOF
+}
+
+func TestAttachNoInputDuration(t *testing.T) {
+	m := newManager(t)
+	num, err := m.Create(sess.CreateOptions{Shell: "/bin/sh", Rows: 24, Cols: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Kill(num)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	err = m.Attach(ctx, num, sess.AttachOptions{
+		Stdin:    unreadable{t},
+		Stdout:   io.Discard,
+		Size:     func() (int, int, error) { return 24, 80, nil },
+		Quiet:    true,
+		NoInput:  true,
+		Duration: 300 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("Attach = %v; want a clean detach", err)
+	}
+	if ctx.Err() != nil {
+		t.Fatal("Attach outlasted its duration")
+	}
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Errorf("Attach returned after %s, before its duration", elapsed)
+	}
+	if _, err := m.Get(num); err != nil {
+		t.Errorf("session did not outlive the detach: %v", err)
+	}
+}
+
+func TestAttachLockedSession(t *testing.T) {
+	m := newManager(t)
+	num, err := m.Create(sess.CreateOptions{Shell: "/bin/sh", Rows: 24, Cols: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Kill(num)
+	if err := m.Lock(num); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := sess.AttachOptions{
+		Stdin:    strings.NewReader(""),
+		Stdout:   io.Discard,
+		Quiet:    true,
+		NoInput:  true,
+		Duration: 100 * time.Millisecond,
+	}
+	err = m.Attach(context.Background(), num, opts)
+	if !errors.Is(err, sess.ErrSessionLocked) {
+		t.Fatalf("Attach to a locked session = %v; want ErrSessionLocked", err)
+	}
+	if want := "session " + num + " is locked (sess unlock"; !strings.HasPrefix(err.Error(), want) {
+		t.Errorf("error %q; want it to start %q", err, want)
+	}
+
+	opts.Force = true
+	if err := m.Attach(context.Background(), num, opts); err != nil {
+		t.Errorf("forced Attach = %v", err)
+	}
+	if err := m.Unlock(num); err != nil {
+		t.Fatal(err)
+	}
+	opts.Force = false
+	if err := m.Attach(context.Background(), num, opts); err != nil {
+		t.Errorf("Attach after Unlock = %v", err)
+	}
+
+	// Locking does not stop a kill.
+	if err := m.Lock(num); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Kill(num); err != nil {
+		t.Errorf("Kill of a locked session = %v", err)
+	}
+}
+
+func TestAttachWarnsOfVersionMismatch(t *testing.T) {
+	defer func(v string) { sess.Version = v }(sess.Version)
+	sess.Version = "v1.0.0"
+	m := newManager(t)
+	num, err := m.Create(sess.CreateOptions{Shell: "/bin/sh", Rows: 24, Cols: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Kill(num)
+	s, err := m.Get(num)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Version != "v1.0.0" {
+		t.Errorf("session records version %q; want v1.0.0", s.Version)
+	}
+
+	for _, tc := range []struct {
+		version string
+		warn    bool
+	}{
+		{"v1.0.0", false},
+		{"v1.1.0", true},
+	} {
+		sess.Version = tc.version
+		var out strings.Builder
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err := m.Attach(ctx, num, sess.AttachOptions{
+			Stdin:    unreadable{t},
+			Stdout:   &out,
+			Size:     func() (int, int, error) { return 24, 80, nil },
+			Quiet:    true,
+			NoInput:  true,
+			Duration: 50 * time.Millisecond,
+		})
+		cancel()
+		if err != nil {
+			t.Fatalf("Attach = %v; want a clean detach", err)
+		}
+		want := "session " + num + " was started by sess v1.0.0; this is sess v1.1.0"
+		if got := strings.Contains(out.String(), want); got != tc.warn {
+			t.Errorf("attaching with %s: warned = %v; want %v (output %q)", tc.version, got, tc.warn, out.String())
+		}
+	}
+}
+
+// Attaching to a session on the alternate screen switches the terminal to
+// it, and detaching switches back.
+func TestAttachFollowsAltScreen(t *testing.T) {
+	m := newManager(t)
+	num, err := m.Create(sess.CreateOptions{Shell: "/bin/sh", Rows: 24, Cols: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Kill(num)
+	if err := m.Send(num, []byte("printf '\\033[?1049h'; echo alt-$((6*7))\n")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the session to switch screens", func() bool {
+		var scrollback strings.Builder
+		m.Scrollback(num, sess.ScrollbackOptions{}, &scrollback)
+		return strings.Contains(scrollback.String(), "alt-42")
+	})
+
+	// The client only touches the screen of a terminal. Like os.Stdin,
+	// it is handed over in blocking mode.
+	ptmx, tty, err := pty.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ptmx.Close()
+	defer tty.Close()
+	// A file of its own: two files on one descriptor would each close it,
+	// the second time perhaps after it was reused.
+	fd, err := syscall.Dup(int(tty.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdin := os.NewFile(uintptr(fd), tty.Name())
+	defer stdin.Close()
+	var out syncBuffer
+	err = m.Attach(context.Background(), num, sess.AttachOptions{
+		Stdin:    stdin,
+		Stdout:   &out,
+		Size:     func() (int, int, error) { return 24, 80, nil },
+		Quiet:    true,
+		Duration: 300 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := out.String()
+	if !strings.HasPrefix(got, "\x1b[?1049h") {
+		t.Errorf("attach output %q does not start on the alternate screen", got)
+	}
+	if !strings.HasSuffix(got, "\x1b[?1049l\x1b[?25h") {
+		t.Errorf("detach output %q does not leave the alternate screen", got)
+	}
+}
+
+// A direct attach types into and reads from the session's terminal itself,
+// and the daemon relays again once it has detached.
+func TestAttachDirect(t *testing.T) {
+	m := newManager(t)
+	num, err := m.Create(sess.CreateOptions{Shell: "/bin/sh", Rows: 24, Cols: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Kill(num)
+
+	stdin, typing := io.Pipe()
+	defer typing.Close()
+	var out syncBuffer
+	attached := make(chan error, 1)
+	go func() {
+		attached <- m.Attach(context.Background(), num, sess.AttachOptions{
+			Stdin:       stdin,
+			Stdout:      &out,
+			Size:        func() (int, int, error) { return 24, 80, nil },
+			Quiet:       true,
+			DetachOnEOF: true,
+			Direct:      true,
+		})
+	}()
+	waitFor(t, "the client to attach", func() bool {
+		st, err := m.Status(num)
+		return err == nil && len(st.Clients) == 1
+	})
+	st, err := m.Status(num)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !st.Clients[0].Direct {
+		t.Errorf("client %+v not attached directly", st.Clients[0])
+	}
+	if _, err := typing.Write([]byte("echo direct-$((6*7))\n")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "output of direct input", func() bool { return strings.Contains(out.String(), "direct-42") })
+
+	typing.Close()
+	select {
+	case err := <-attached:
+		if err != nil {
+			t.Errorf("Attach = %v; want a clean detach", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("attach did not end")
+	}
+
+	// The daemon has the terminal back: what the session prints now
+	// reaches its scrollback.
+	if err := m.Send(num, []byte("echo relayed-$((6*7))\n")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "output in the scrollback", func() bool {
+		var scrollback strings.Builder
+		m.Scrollback(num, sess.ScrollbackOptions{}, &scrollback)
+		return strings.Contains(scrollback.String(), "relayed-42")
+	})
+}
+
+// A session that ends while attached directly reports its exit as usual,
+// after the last of its output.
+func TestAttachDirectSessionExit(t *testing.T) {
+	m := newManager(t)
+	num, err := m.Create(sess.CreateOptions{Shell: "/bin/sh", Rows: 24, Cols: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Kill(num)
+
+	var out syncBuffer
+	err = m.Attach(context.Background(), num, sess.AttachOptions{
+		Stdin:  strings.NewReader("echo last-$((6*7)); exit 3\n"),
+		Stdout: &out,
+		Size:   func() (int, int, error) { return 24, 80, nil },
+		Quiet:  true,
+		Direct: true,
+	})
+	var exit *sess.ExitError
+	if !errors.As(err, &exit) || exit.Status != 3 {
+		t.Errorf("Attach = %v; want exit status 3", err)
+	}
+	if !strings.Contains(out.String(), "last-42") {
+		t.Errorf("last output lost: %q", out.String())
+	}
+}
+
+// A raw attach is a plain pipe: what goes in comes out as the session
+// writes it, without banners, and end of input leaves the session running.
+func TestAttachRaw(t *testing.T) {
+	m := newManager(t)
+	num, err := m.Create(sess.CreateOptions{Command: []string{"sh", "-c", "stty -echo; while read line; do echo \"got $line\"; done"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Kill(num)
+
+	in, feed := io.Pipe()
+	out := &syncBuffer{}
+	done := make(chan error, 1)
+	go func() {
+		done <- m.Attach(context.Background(), num, sess.AttachOptions{Stdin: in, Stdout: out, Raw: true})
+	}()
+	// Typed in two writes, as a driving program might.
+	feed.Write([]byte("hel"))
+	feed.Write([]byte("lo\n"))
+	waitFor(t, "the session's answer", func() bool { return strings.Contains(out.String(), "got hello") })
+	feed.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Attach = %v at end of input; want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Attach did not end with its input")
+	}
+	if got := out.String(); strings.Contains(got, "Attaching") || strings.Contains(got, "Detached") || strings.Contains(got, "\x1b") {
+		t.Errorf("raw output %q has more than the session wrote", got)
+	}
+	if _, err := m.Get(num); err != nil {
+		t.Errorf("session did not outlive the attach: %v", err)
+	}
+
+	// The session's command ending is reported as for other attaches.
+	in, feed = io.Pipe()
+	go func() {
+		done <- m.Attach(context.Background(), num, sess.AttachOptions{Stdin: in, Stdout: io.Discard, Raw: true})
+	}()
+	feed.Write([]byte{4}) // Ctrl-D: read sees end of file and sh exits
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Attach = %v as the session ends with status 0; want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Attach did not end with the session")
+	}
+}
+
+// A size given to an attach is applied, raw or not, and stays once the
+// client has gone; a raw attach without one leaves the size alone.
+func TestAttachSize(t *testing.T) {
+	m := newManager(t)
+	num, err := m.Create(sess.CreateOptions{Command: []string{"sleep", "60"}, Rows: 24, Cols: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Kill(num)
+
+	for _, tt := range []struct {
+		raw        bool
+		rows, cols int
+	}{
+		{false, 30, 100},
+		{true, 33, 111},
+		{true, 0, 0},
+	} {
+		opts := sess.AttachOptions{Stdin: unreadable{t}, Stdout: io.Discard, Quiet: true, NoInput: true, Raw: tt.raw, Duration: 200 * time.Millisecond}
+		if tt.rows > 0 {
+			rows, cols := tt.rows, tt.cols
+			opts.Size = func() (int, int, error) { return rows, cols, nil }
+		}
+		if err := m.Attach(context.Background(), num, opts); err != nil {
+			t.Fatalf("Attach(raw %v, %dx%d) = %v", tt.raw, tt.rows, tt.cols, err)
+		}
+		st, err := m.Status(num)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := [2]int{tt.rows, tt.cols}
+		if tt.rows == 0 {
+			want = [2]int{33, 111}
+		}
+		if got := [2]int{st.Rows, st.Cols}; got != want {
+			t.Errorf("after Attach(raw %v, %dx%d) the session is %dx%d; want %dx%d", tt.raw, tt.rows, tt.cols, got[0], got[1], want[0], want[1])
+		}
+	}
+}
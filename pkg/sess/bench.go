@@ -0,0 +1,280 @@
+package sess
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/theMichaelB/sess/internal/platform"
+)
+
+const (
+	// benchWarmup is output not counted towards throughput, covering the
+	// scrollback sent on attaching and the generator getting going.
+	benchWarmup = 200 * time.Millisecond
+	// benchEchoTimeout bounds the wait for one keystroke's echo.
+	benchEchoTimeout = 5 * time.Second
+	// benchLine is what the throughput session prints over and over, a
+	// line filling an 80-column row.
+	benchLine = "the quick brown fox jumps over the lazy dog 0123456789 abcdefghijklmnopqrstuvwx"
+)
+
+// BenchOptions configures Bench. Zero values use the defaults.
+type BenchOptions struct {
+	// Duration is how long throughput is measured; 3 seconds by default.
+	Duration time.Duration
+	// Samples is how many keystrokes are timed; 200 by default.
+	Samples int
+}
+
+// BenchResult is what Bench measured.
+type BenchResult struct {
+	// Bytes is the output a client received from a session printing as
+	// fast as it can over Elapsed, and Throughput the rate in MB (10^6
+	// bytes) per second.
+	Bytes      int64         `json:"bytes"`
+	Elapsed    time.Duration `json:"elapsed_ns"`
+	Throughput float64       `json:"throughput_mb_s"`
+	// Latency is how long keystrokes took to come back from a session
+	// running cat, from being sent to their echo arriving.
+	Latency Latency `json:"latency"`
+	// DaemonCPU is the CPU time the sessions' daemons used, or -1 where
+	// other processes' CPU time cannot be read; ClientCPU is this
+	// process's, which attached to them.
+	DaemonCPU time.Duration `json:"daemon_cpu_ns"`
+	ClientCPU time.Duration `json:"client_cpu_ns"`
+}
+
+// Latency summarises a set of round-trip times.
+type Latency struct {
+	Samples int           `json:"samples"`
+	P50     time.Duration `json:"p50_ns"`
+	P90     time.Duration `json:"p90_ns"`
+	P99     time.Duration `json:"p99_ns"`
+	Max     time.Duration `json:"max_ns"`
+}
+
+// Bench measures how fast sessions relay output and keystrokes on this
+// machine, with this build of sess. It creates two sessions, one printing
+// lines as fast as it can and one running cat, attaches to each as a
+// headless raw client and kills both when done, whatever happens.
+// Cancelling ctx stops it early with ctx's error.
+func (m *Manager) Bench(ctx context.Context, opts BenchOptions) (*BenchResult, error) {
+	if opts.Duration <= 0 {
+		opts.Duration = 3 * time.Second
+	}
+	if opts.Samples <= 0 {
+		opts.Samples = 200
+	}
+
+	clientBefore := clientCPU()
+	var daemons []int
+	start := func(command string) (string, error) {
+		number, err := m.Create(CreateOptions{Command: ShellCommand(command), Rows: 24, Cols: 80})
+		if err != nil {
+			return "", err
+		}
+		if s, err := m.Get(number); err == nil {
+			daemons = append(daemons, s.DaemonPID)
+		}
+		return number, nil
+	}
+
+	res := &BenchResult{}
+	out, err := start("exec yes '" + benchLine + "'")
+	if err != nil {
+		return nil, err
+	}
+	defer m.Kill(out)
+	if err := m.benchThroughput(ctx, out, opts.Duration, res); err != nil {
+		return nil, err
+	}
+
+	echo, err := start("stty raw -echo && echo ready && exec cat")
+	if err != nil {
+		return nil, err
+	}
+	defer m.Kill(echo)
+	if res.Latency, err = m.benchLatency(ctx, echo, opts.Samples); err != nil {
+		return nil, err
+	}
+
+	res.DaemonCPU = daemonCPU(daemons)
+	res.ClientCPU = clientCPU() - clientBefore
+	return res, nil
+}
+
+// benchThroughput attaches output-only to session number for d after a
+// warm-up, counting what arrives.
+func (m *Manager) benchThroughput(ctx context.Context, number string, d time.Duration, res *BenchResult) error {
+	attachCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var counter byteCounter
+	attached := make(chan error, 1)
+	go func() {
+		attached <- m.Attach(attachCtx, number, AttachOptions{Stdout: &counter, Raw: true, NoInput: true})
+	}()
+
+	var first int64
+	var began time.Time
+	for _, wait := range []time.Duration{benchWarmup, d} {
+		select {
+		case <-time.After(wait):
+		case err := <-attached:
+			return benchEnded(ctx, err)
+		}
+		if began.IsZero() {
+			first, began = counter.n.Load(), time.Now()
+		}
+	}
+	res.Bytes, res.Elapsed = counter.n.Load()-first, time.Since(began)
+	res.Throughput = float64(res.Bytes) / 1e6 / res.Elapsed.Seconds()
+	cancel()
+	<-attached
+	return ctx.Err()
+}
+
+// benchLatency types single keystrokes into session number, which echoes
+// them, timing each round trip.
+func (m *Manager) benchLatency(ctx context.Context, number string, samples int) (Latency, error) {
+	// Keystrokes typed before cat has the terminal in raw mode would be
+	// held for a whole line.
+	for deadline := time.Now().Add(benchEchoTimeout); ; {
+		var shown bytes.Buffer
+		if _, err := m.Scrollback(number, ScrollbackOptions{}, &shown); err == nil && bytes.Contains(shown.Bytes(), []byte("ready")) {
+			break
+		}
+		if time.Now().After(deadline) {
+			return Latency{}, fmt.Errorf("%w: session %s did not start cat", ErrTimeout, number)
+		}
+		select {
+		case <-ctx.Done():
+			return Latency{}, ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	attachCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	in, typed := io.Pipe()
+	defer typed.Close()
+	echoes := &echoWriter{arrived: make(chan struct{}, 1)}
+	attached := make(chan error, 1)
+	go func() {
+		attached <- m.Attach(attachCtx, number, AttachOptions{Stdin: in, Stdout: echoes, Raw: true})
+	}()
+
+	wait := func() error {
+		select {
+		case <-echoes.arrived:
+			return nil
+		case err := <-attached:
+			return benchEnded(ctx, err)
+		case <-time.After(benchEchoTimeout):
+			return fmt.Errorf("%w: no echo from session %s", ErrTimeout, number)
+		}
+	}
+	times := make([]time.Duration, 0, samples)
+	for i := 0; i < samples; i++ {
+		sent := time.Now()
+		if _, err := typed.Write([]byte{'a' + byte(i%26)}); err != nil {
+			return Latency{}, benchEnded(ctx, err)
+		}
+		for echoes.take() == "" {
+			if err := wait(); err != nil {
+				return Latency{}, err
+			}
+		}
+		times = append(times, time.Since(sent))
+	}
+	typed.Close()
+	<-attached
+	return latencyOf(times), ctx.Err()
+}
+
+// benchEnded is the error for an attach that ended before Bench was done
+// with it.
+func benchEnded(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err == nil {
+		err = errors.New("attach ended early")
+	}
+	return fmt.Errorf("benchmark session: %w", err)
+}
+
+// latencyOf summarises times, which it sorts.
+func latencyOf(times []time.Duration) Latency {
+	if len(times) == 0 {
+		return Latency{}
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+	at := func(pct int) time.Duration { return times[(len(times)-1)*pct/100] }
+	return Latency{Samples: len(times), P50: at(50), P90: at(90), P99: at(99), Max: times[len(times)-1]}
+}
+
+// daemonCPU returns the CPU time the daemons have used, or -1 where it
+// cannot be read.
+func daemonCPU(daemons []int) time.Duration {
+	stats, err := platform.ReadProcStats()
+	if err != nil {
+		return -1
+	}
+	var ticks uint64
+	for _, pid := range daemons {
+		ticks += stats[pid].CPUTicks
+	}
+	return time.Duration(ticks) * time.Second / platform.ClockTicks
+}
+
+// clientCPU returns the CPU time this process has used.
+func clientCPU() time.Duration {
+	var ru syscall.Rusage
+	if syscall.Getrusage(syscall.RUSAGE_SELF, &ru) != nil {
+		return 0
+	}
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+}
+
+// byteCounter counts and discards what is written to it.
+type byteCounter struct{ n atomic.Int64 }
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	c.n.Add(int64(len(p)))
+	return len(p), nil
+}
+
+// echoWriter keeps what is written to it until taken, signalling each
+// write on arrived.
+type echoWriter struct {
+	mu      sync.Mutex
+	buf     bytes.Buffer
+	arrived chan struct{}
+}
+
+func (w *echoWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	w.buf.Write(p)
+	w.mu.Unlock()
+	select {
+	case w.arrived <- struct{}{}:
+	default:
+	}
+	return len(p), nil
+}
+
+func (w *echoWriter) take() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	s := w.buf.String()
+	w.buf.Reset()
+	return s
+}
@@ -0,0 +1,34 @@
+package sess_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/theMichaelB/sess/pkg/sess"
+)
+
+func TestBench(t *testing.T) {
+	m := newManager(t)
+	before, err := m.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := m.Bench(context.Background(), sess.BenchOptions{Duration: 200 * time.Millisecond, Samples: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Bytes <= 0 || res.Throughput <= 0 {
+		t.Errorf("no output measured: %+v", res)
+	}
+	if l := res.Latency; l.Samples != 10 || l.P50 <= 0 || l.P50 > l.P99 || l.P99 > l.Max {
+		t.Errorf("latency = %+v; want 10 ordered samples", l)
+	}
+	after, err := m.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) != len(before) {
+		t.Errorf("bench left %d sessions behind", len(after)-len(before))
+	}
+}
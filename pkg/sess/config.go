@@ -0,0 +1,25 @@
+package sess
+
+import "github.com/theMichaelB/sess/internal/config"
+
+// Config holds the user's settings from the sess config file.
+type Config = config.Config
+
+// Values of Config.NestedWarning.
+const (
+	NestedWarn  = config.NestedWarn
+	NestedError = config.NestedError
+	NestedOff   = config.NestedOff
+)
+
+// LoadConfig reads the user's config file ($XDG_CONFIG_HOME/sess/config,
+// usually ~/.config/sess/config). A missing file gives the defaults.
+func LoadConfig() (*Config, error) {
+	return config.Load()
+}
+
+// ShellCommand returns the argv that runs line through the shell a new
+// session would otherwise start.
+func ShellCommand(line string) []string {
+	return []string{defaultShell(""), "-c", line}
+}
@@ -0,0 +1,234 @@
+package sess_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/theMichaelB/sess/pkg/sess"
+)
+
+// createConcurrently runs n Creates at once, each through its own Manager
+// as separate sess processes would, and returns their results.
+func createConcurrently(t *testing.T, n int, opts sess.CreateOptions) ([]string, []error) {
+	t.Helper()
+	numbers := make([]string, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i := 0; i < n; i++ {
+		m := newManager(t)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			numbers[i], errs[i] = m.Create(opts)
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+	return numbers, errs
+}
+
+// assertNoClaims fails if a reservation outlived the Creates that made it.
+func assertNoClaims(t *testing.T) {
+	t.Helper()
+	home, _ := os.UserHomeDir()
+	claims, err := filepath.Glob(filepath.Join(home, ".sess", "*.claim"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(claims) != 0 {
+		t.Errorf("orphaned claims: %q", claims)
+	}
+}
+
+func TestConcurrentCreateNumbersAreUnique(t *testing.T) {
+	const n = 8
+	m := newManager(t)
+	numbers, errs := createConcurrently(t, n, sess.CreateOptions{Command: []string{"sleep", "60"}})
+	seen := make(map[string]bool)
+	for i, num := range numbers {
+		if errs[i] != nil {
+			t.Errorf("create %d: %v", i, errs[i])
+			continue
+		}
+		defer m.Kill(num)
+		if seen[num] {
+			t.Errorf("session %s created twice", num)
+		}
+		seen[num] = true
+	}
+
+	sessions, err := m.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != n {
+		t.Errorf("List() has %d sessions; want %d", len(sessions), n)
+	}
+	assertNoClaims(t)
+}
+
+func TestConcurrentCreateSameNumber(t *testing.T) {
+	const n = 8
+	m := newManager(t)
+	numbers, errs := createConcurrently(t, n, sess.CreateOptions{Number: "050", Command: []string{"sleep", "60"}})
+	created := 0
+	for i, err := range errs {
+		switch {
+		case err == nil:
+			created++
+			defer m.Kill(numbers[i])
+		case !errors.Is(err, sess.ErrSessionExists):
+			t.Errorf("create %d: %v; want ErrSessionExists", i, err)
+		}
+	}
+	if created != 1 {
+		t.Errorf("%d creates of session 050 succeeded; want 1", created)
+	}
+	assertNoClaims(t)
+}
+
+func TestCreateRlimits(t *testing.T) {
+	m := newManager(t)
+	num, err := m.Create(sess.CreateOptions{
+		Command: []string{"sh", "-c", "echo limits $(ulimit -Sn) $(ulimit -Hn) $(ulimit -c); sleep 60"},
+		Rlimits: []string{"nofile=100:200", "core=0"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Kill(num)
+	var out strings.Builder
+	waitFor(t, "the session's limits", func() bool {
+		out.Reset()
+		m.Scrollback(num, sess.ScrollbackOptions{}, &out)
+		return strings.Contains(out.String(), "limits ")
+	})
+	if !strings.Contains(out.String(), "limits 100 200 0") {
+		t.Errorf("session reported %q; want nofile 100:200 and core 0", out.String())
+	}
+	s, err := m.Get(num)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Rlimits != "nofile=100:200,core=0" {
+		t.Errorf("metadata records limits %q", s.Rlimits)
+	}
+	if s.Command != "sh -c echo limits $(ulimit -Sn) $(ulimit -Hn) $(ulimit -c); sleep 60" {
+		t.Errorf("metadata records the command as %q", s.Command)
+	}
+}
+
+// A limit that cannot be set stops the session starting, rather than
+// leaving its command unlimited.
+func TestCreateRlimitFails(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("relies on Linux capping nofile")
+	}
+	m := newManager(t)
+	num, err := m.Create(sess.CreateOptions{Command: []string{"sleep", "60"}, Rlimits: []string{"nofile=unlimited"}})
+	if err == nil {
+		m.Kill(num)
+		t.Fatal("Create succeeded with a limit the system refuses")
+	}
+	if !strings.Contains(err.Error(), "setting nofile=unlimited") {
+		t.Errorf("Create = %v; want it to name the limit", err)
+	}
+	assertNoClaims(t)
+}
+
+// The command starts with the environment asked for, with the SESS_
+// variables on top, and the metadata says which.
+func TestCreateEnv(t *testing.T) {
+	m := newManager(t)
+	t.Setenv("SESS_TEST_SECRET", "hunter2")
+	t.Setenv("SESS_TEST_TOKEN", "x y")
+	for _, tc := range []struct {
+		opts    sess.CreateOptions
+		mode    string
+		has     []string
+		hasNone []string
+	}{
+		{sess.CreateOptions{CopyEnv: true}, "copy", []string{"SESS_TEST_SECRET=hunter2", "SESS_TEST_TOKEN=x y", "SESS_NUM="}, nil},
+		{sess.CreateOptions{CopyEnvOnly: []string{"SESS_TEST_TOKEN", "UNSET_ONE"}}, "copy:SESS_TEST_TOKEN,UNSET_ONE", []string{"SESS_TEST_TOKEN=x y", "SESS_NUM="}, []string{"SESS_TEST_SECRET=", "HOME=", "UNSET_ONE"}},
+		{sess.CreateOptions{CleanEnv: true}, "clean", []string{"HOME=", "PATH=", "SESS_NUM="}, []string{"SESS_TEST_TOKEN="}},
+	} {
+		tc.opts.Command = []string{"/bin/sh", "-c", "/usr/bin/env; echo end of env; sleep 60"}
+		num, err := m.Create(tc.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer m.Kill(num)
+		var out strings.Builder
+		waitFor(t, "the session's environment", func() bool {
+			out.Reset()
+			m.Scrollback(num, sess.ScrollbackOptions{}, &out)
+			return strings.Contains(out.String(), "end of env")
+		})
+		lines := strings.Split(strings.ReplaceAll(out.String(), "\r", ""), "\n")
+		hasLine := func(prefix string) bool {
+			for _, l := range lines {
+				if strings.HasPrefix(l, prefix) {
+					return true
+				}
+			}
+			return false
+		}
+		for _, v := range tc.has {
+			if !hasLine(v) {
+				t.Errorf("%s: no %s in the session's environment", tc.mode, v)
+			}
+		}
+		for _, v := range tc.hasNone {
+			if hasLine(v) {
+				t.Errorf("%s: %s in the session's environment", tc.mode, v)
+			}
+		}
+		s, err := m.Get(num)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.EnvMode != tc.mode {
+			t.Errorf("metadata records the environment as %q; want %q", s.EnvMode, tc.mode)
+		}
+	}
+
+	if _, err := m.Create(sess.CreateOptions{CleanEnv: true, CopyEnv: true}); err == nil {
+		t.Error("Create accepted a clean environment that is also copied")
+	}
+}
+
+// A session created at a number takes it, and later ones are numbered
+// above it.
+func TestCreateAtNumber(t *testing.T) {
+	m := newManager(t)
+	num, err := m.Create(sess.CreateOptions{Number: "700", Command: []string{"sleep", "60"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Kill(num)
+	if num != "700" {
+		t.Errorf("created %s; want 700", num)
+	}
+	next, err := m.Create(sess.CreateOptions{Command: []string{"sleep", "60"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Kill(next)
+	if next != "701" {
+		t.Errorf("the next session is %s; want 701", next)
+	}
+	for _, number := range []string{"0", "-3", "abc", "7x"} {
+		if num, err := m.Create(sess.CreateOptions{Number: number, Command: []string{"sleep", "60"}}); err == nil {
+			m.Kill(num)
+			t.Errorf("Create at %q made session %s", number, num)
+		}
+	}
+	assertNoClaims(t)
+}
@@ -0,0 +1,370 @@
+package sess
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/theMichaelB/sess/internal/config"
+	"github.com/theMichaelB/sess/internal/daemon"
+	"github.com/theMichaelB/sess/internal/session"
+	"golang.org/x/sys/unix"
+)
+
+const daemonFlag = "--daemon"
+
+// daemonSpec carries everything Create hands to the daemon process.
+type daemonSpec struct {
+	version    string
+	number     string
+	socketPath string
+	metaPath   string
+	rows, cols int
+	xpixel     int // the initial size in pixels, if known
+	ypixel     int
+	transient  bool
+	throttle   bool
+	timeout    time.Duration
+	log        bool
+	logInput   bool
+	script     string
+	timing     string
+	termios    string
+	rlimits    string
+	noOOM      bool
+	respawn    string
+	definition string
+	// envFD is the descriptor the command's environment is read from,
+	// NUL-separated, or 0 to inherit the daemon's; envMode describes it.
+	envFD   int
+	envMode string
+	argv    []string
+	// resume is the descriptor an upgrading daemon hands its session's
+	// state over on, or 0 for a new session.
+	resume int
+	// upgradeFormat asks only for the upgrade format this binary reads.
+	upgradeFormat bool
+}
+
+// args encodes the spec as the daemon's command line (after the program).
+func (s daemonSpec) args() []string {
+	args := []string{daemonFlag,
+		"-num", s.number,
+		"-socket", s.socketPath,
+		"-meta", s.metaPath,
+		"-rows", strconv.Itoa(s.rows),
+		"-cols", strconv.Itoa(s.cols),
+	}
+	if s.xpixel > 0 && s.ypixel > 0 {
+		args = append(args, "-xpixel", strconv.Itoa(s.xpixel), "-ypixel", strconv.Itoa(s.ypixel))
+	}
+	if s.transient {
+		args = append(args, "-transient")
+	}
+	if s.throttle {
+		args = append(args, "-throttle-detached")
+	}
+	if s.timeout > 0 {
+		args = append(args, "-timeout", s.timeout.String())
+	}
+	if s.log {
+		args = append(args, "-log")
+	}
+	if s.logInput {
+		args = append(args, "-log-input")
+	}
+	if s.script != "" {
+		args = append(args, "-record-script", s.script)
+	}
+	if s.timing != "" {
+		args = append(args, "-record-timing", s.timing)
+	}
+	if s.termios != "" {
+		args = append(args, "-termios", s.termios)
+	}
+	if s.rlimits != "" {
+		args = append(args, "-rlimits", s.rlimits)
+	}
+	if s.noOOM {
+		args = append(args, "-no-oom-protect")
+	}
+	if s.respawn != "" {
+		args = append(args, "-respawn", s.respawn)
+	}
+	if s.definition != "" {
+		args = append(args, "-definition", s.definition)
+	}
+	if s.envFD > 0 {
+		args = append(args, "-env-fd", strconv.Itoa(s.envFD), "-env-mode", s.envMode)
+	}
+	if s.version != "" {
+		args = append(args, "-sess-version", s.version)
+	}
+	if s.resume > 0 {
+		args = append(args, "-resume", strconv.Itoa(s.resume))
+	}
+	args = append(args, "--")
+	return append(args, s.argv...)
+}
+
+func parseDaemonSpec(args []string) (daemonSpec, error) {
+	var s daemonSpec
+	fs := flag.NewFlagSet("sess daemon", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.StringVar(&s.number, "num", "", "session number")
+	fs.StringVar(&s.socketPath, "socket", "", "socket path")
+	fs.StringVar(&s.metaPath, "meta", "", "metadata path")
+	fs.IntVar(&s.rows, "rows", 0, "initial rows")
+	fs.IntVar(&s.cols, "cols", 0, "initial columns")
+	fs.IntVar(&s.xpixel, "xpixel", 0, "initial width in pixels")
+	fs.IntVar(&s.ypixel, "ypixel", 0, "initial height in pixels")
+	fs.BoolVar(&s.transient, "transient", false, "end when the interactive client leaves")
+	fs.BoolVar(&s.throttle, "throttle-detached", false, "stop reading output nobody sees or keeps")
+	fs.DurationVar(&s.timeout, "timeout", 0, "end the session after this long")
+	fs.BoolVar(&s.log, "log", false, "record output next to the metadata")
+	fs.BoolVar(&s.logInput, "log-input", false, "record input next to the metadata")
+	fs.StringVar(&s.script, "record-script", "", "record output as a script(1) typescript")
+	fs.StringVar(&s.timing, "record-timing", "", "record script(1) timing")
+	fs.StringVar(&s.termios, "termios", "", "terminal settings to start with")
+	fs.StringVar(&s.rlimits, "rlimits", "", "resource limits for the command")
+	fs.BoolVar(&s.noOOM, "no-oom-protect", false, "leave the daemon's OOM score alone")
+	fs.StringVar(&s.respawn, "respawn", "", "run the command again when it exits: always or on-failure")
+	fs.StringVar(&s.definition, "definition", "", "sessions.toml entry the session was started from")
+	fs.IntVar(&s.envFD, "env-fd", 0, "descriptor to read the command's environment from")
+	fs.StringVar(&s.envMode, "env-mode", "", "where the command's environment came from")
+	fs.StringVar(&s.version, "sess-version", "", "build of sess that started the session")
+	fs.IntVar(&s.resume, "resume", 0, "descriptor to read an upgrading session's state from")
+	fs.BoolVar(&s.upgradeFormat, "upgrade-format", false, "print the upgrade format this binary reads")
+	if err := fs.Parse(args[1:]); err != nil {
+		return s, err
+	}
+	if s.upgradeFormat {
+		return s, nil
+	}
+	s.argv = fs.Args()
+	if s.number == "" || s.socketPath == "" || len(s.argv) == 0 {
+		return s, fmt.Errorf("incomplete daemon arguments")
+	}
+	return s, nil
+}
+
+// IsDaemonInvocation reports whether args (os.Args[1:]) request daemon mode,
+// or one of the helpers a daemon starts its command through.
+func IsDaemonInvocation(args []string) bool {
+	return len(args) > 0 && (args[0] == daemonFlag || args[0] == daemon.ExecLimitedFlag || args[0] == daemon.RespawnFlag)
+}
+
+// RunDaemon serves a session as requested by args (os.Args[1:]). It detaches
+// from the invoking terminal once ready and returns when the session ends.
+// SIGTERM and SIGINT shut the session down, telling attached clients so. A
+// daemon being upgraded runs it again to take its session over, and one
+// whose session has resource limits, or respawns its command, runs it as
+// the helper that does so.
+func RunDaemon(args []string) error {
+	switch args[0] {
+	case daemon.ExecLimitedFlag:
+		return daemon.ExecLimited(args)
+	case daemon.RespawnFlag:
+		return daemon.Respawn(args)
+	}
+	spec, err := parseDaemonSpec(args)
+	if err != nil {
+		return err
+	}
+	if spec.upgradeFormat {
+		fmt.Println(daemon.UpgradeFormat)
+		return nil
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(sigs)
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	go func() {
+		select {
+		case sig := <-sigs:
+			cancel(fmt.Errorf("the session is shutting down on %s", unix.SignalName(sig.(syscall.Signal))))
+		case <-ctx.Done():
+		}
+	}()
+
+	var outputLog, inputLog string
+	if spec.log {
+		outputLog = session.LogPath(spec.metaPath)
+	}
+	if spec.logInput {
+		inputLog = session.InputLogPath(spec.metaPath)
+	}
+	termios, err := daemon.ParseTermios(spec.termios)
+	if err != nil {
+		return err
+	}
+	rlimits, err := daemon.ParseRlimits(spec.rlimits)
+	if err != nil {
+		return err
+	}
+	var env []string
+	if spec.envFD > 0 && spec.resume == 0 {
+		if env, err = readEnv(spec.envFD); err != nil {
+			return fmt.Errorf("reading the session's environment: %w", err)
+		}
+	}
+	exe, _ := os.Executable()
+	cfg, err := config.Load()
+	if err != nil {
+		// A broken config file must not take the session down with it.
+		cfg = config.Default()
+	}
+	oomScoreAdj := cfg.OOMScoreAdj
+	if spec.noOOM {
+		oomScoreAdj = 0
+	}
+
+	// Once ready, the daemon's stderr is /dev/null opened for reading; its
+	// errors and debug output go to a log next to the metadata first. An
+	// upgraded daemon adds to the log of the one it took over from.
+	var log io.Writer = os.Stderr
+	if spec.metaPath != "" {
+		logPath := session.DaemonLogPath(spec.metaPath)
+		mode := os.O_TRUNC
+		if spec.resume > 0 {
+			mode = 0
+		}
+		if f, err := os.OpenFile(logPath, os.O_WRONLY|os.O_CREATE|mode|os.O_APPEND, 0600); err == nil {
+			defer removeIfEmpty(f, logPath)
+			log = io.MultiWriter(f, os.Stderr)
+		}
+	}
+
+	dcfg := daemon.Config{
+		SessionNum: spec.number,
+		SocketPath: spec.socketPath,
+		MetaPath:   spec.metaPath,
+		Argv:       spec.argv,
+		Rows:       spec.rows,
+		Cols:       spec.cols,
+		XPixel:     spec.xpixel,
+		YPixel:     spec.ypixel,
+		Log:        log,
+		Ready:      daemon.DetachStdio,
+
+		ShutdownOnDisconnect: spec.transient,
+		OutputLog:            outputLog,
+		LogRetention:         cfg.LogRetention(),
+		Scrollback:           cfg.Scrollback,
+		ScrollbackSpill:      cfg.ScrollbackSpill,
+		ScrollbackKeep:       cfg.ScrollbackKeep,
+		ThrottleDetached:     spec.throttle,
+		InputLog:             inputLog,
+		ScriptTypescript:     spec.script,
+		ScriptTiming:         spec.timing,
+		Env:                  env,
+		EnvMode:              spec.envMode,
+		Termios:              termios,
+		Rlimits:              rlimits,
+		Executable:           exe,
+		OOMScoreAdj:          oomScoreAdj,
+		Kill:                 cfg.KillSequence(),
+		Timeout:              spec.timeout,
+		Respawn:              spec.respawn,
+		Definition:           spec.definition,
+		Version:              spec.version,
+		ExitOnStateLost:      cfg.StateLost == config.StateLostExit,
+		UpgradeArgs: func(exe string, fd int) ([]string, error) {
+			if err := checkUpgrade(exe); err != nil {
+				return nil, err
+			}
+			next := spec
+			next.resume = fd
+			next.envFD = 0
+			return next.args(), nil
+		},
+	}
+	if spec.resume > 0 {
+		// The session is now served by this build, already detached.
+		dcfg.Resume = os.NewFile(uintptr(spec.resume), "upgrade-state")
+		dcfg.Version = Version
+		dcfg.Ready = nil
+	}
+	d := daemon.New(dcfg)
+	if _, err := d.Run(ctx); err != nil && ctx.Err() == nil {
+		return err
+	}
+	return nil
+}
+
+// checkUpgrade makes sure the sess binary at exe can take a session over
+// from this one, by asking it which upgrade format it reads. Binaries from
+// before sessions could be upgraded do not know the question.
+func checkUpgrade(exe string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, exe, daemonFlag, "-upgrade-format").Output()
+	if err != nil {
+		return fmt.Errorf("%s cannot take sessions over: %v", exe, err)
+	}
+	if strings.TrimSpace(string(out)) != strconv.Itoa(daemon.UpgradeFormat) {
+		return fmt.Errorf("%s does not read upgrade format %d", exe, daemon.UpgradeFormat)
+	}
+	return nil
+}
+
+// removeIfEmpty closes the daemon log f and removes it from path if the
+// daemon had nothing to say, unless path is another daemon's log by now.
+func removeIfEmpty(f *os.File, path string) {
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || info.Size() > 0 {
+		return
+	}
+	if cur, err := os.Stat(path); err == nil && os.SameFile(info, cur) {
+		os.Remove(path)
+	}
+}
+
+// readEnv reads the environment Create hands the daemon on fd: KEY=VALUE
+// entries separated by NULs, as writeEnv writes them. It is never nil.
+func readEnv(fd int) ([]string, error) {
+	f := os.NewFile(uintptr(fd), "env")
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	env := []string{}
+	for _, entry := range strings.Split(string(data), "\x00") {
+		if entry != "" {
+			env = append(env, entry)
+		}
+	}
+	return env, nil
+}
+
+// writeEnv writes env to a temporary file for the daemon to read with
+// readEnv, returning it open and rewound. The file is removed at once, so
+// the variables, which may be secrets, are left nowhere once it is closed.
+func writeEnv(env []string) (*os.File, error) {
+	f, err := os.CreateTemp("", "sess-env-*")
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(f.Name())
+	if _, err := f.WriteString(strings.Join(env, "\x00")); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
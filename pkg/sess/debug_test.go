@@ -0,0 +1,35 @@
+package sess_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/theMichaelB/sess/pkg/sess"
+)
+
+// Debug returns the dump the session's daemon wrote to its log, and only
+// the latest.
+func TestDebug(t *testing.T) {
+	m := newManager(t)
+	num, err := m.Create(sess.CreateOptions{Command: []string{"sleep", "60"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Kill(num)
+
+	for i := 0; i < 2; i++ {
+		dump, err := m.Debug(num)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(dump, "=== sess daemon state of session "+num) || strings.Count(dump, "=== sess daemon state") != 1 {
+			t.Errorf("dump %d is not one dump of session %s:\n%s", i, num, dump)
+		}
+		if !strings.Contains(dump, "clients:    0\n") || !strings.Contains(dump, "goroutine ") {
+			t.Errorf("dump %d lacks the clients or goroutines:\n%s", i, dump)
+		}
+	}
+	if _, err := m.Debug("999"); err == nil {
+		t.Error("Debug of a missing session succeeded")
+	}
+}
@@ -0,0 +1,50 @@
+// Package sess is the supported programmatic interface to sess sessions.
+//
+// A Manager creates, lists, attaches to and kills sessions stored under the
+// user's sess directory (~/.sess). Each session is served by its own daemon
+// process, which is the sess binary re-executed with a "--daemon" argument.
+// Programs that embed this package and want to spawn daemons from their own
+// executable must hand such invocations to RunDaemon early in main:
+//
+//	func main() {
+//		if sess.IsDaemonInvocation(os.Args[1:]) {
+//			if err := sess.RunDaemon(os.Args[1:]); err != nil {
+//				os.Exit(1)
+//			}
+//			return
+//		}
+//		// ...
+//	}
+//
+// Alternatively set CreateOptions.Executable to the path of an installed
+// sess binary.
+//
+// Creating a session and attaching to it with custom streams:
+//
+//	m, err := sess.NewManager()
+//	if err != nil {
+//		return err
+//	}
+//	num, err := m.Create(sess.CreateOptions{Rows: 40, Cols: 120})
+//	if err != nil {
+//		return err
+//	}
+//	err = m.Attach(ctx, num, sess.AttachOptions{
+//		Stdin:  r,
+//		Stdout: w,
+//		Size:   func() (int, int, error) { return 40, 120, nil },
+//		Quiet:  true,
+//	})
+//
+// Attach returns once the session ends, ctx is cancelled, or the client is
+// detached. While attached, the calling process is recorded as the
+// session's current client; "sess -x" detaches it by sending SIGUSR1, so
+// callers that want to honor that should cancel ctx on SIGUSR1.
+//
+// Errors wrap the sentinel values declared in this package and can be
+// tested with errors.Is:
+//
+//	if _, err := m.Get("003"); errors.Is(err, sess.ErrSessionNotFound) {
+//		// ...
+//	}
+package sess
@@ -0,0 +1,26 @@
+package sess
+
+import "github.com/theMichaelB/sess/internal/utils"
+
+// Errors returned (wrapped) by Manager methods.
+var (
+	ErrSessionExists    = utils.ErrSessionExists
+	ErrSessionNotFound  = utils.ErrSessionNotFound
+	ErrSessionDead      = utils.ErrSessionDead
+	ErrSessionStale     = utils.ErrSessionStale
+	ErrSessionRemote    = utils.ErrSessionRemote
+	ErrKillFailed       = utils.ErrKillFailed
+	ErrCleanupFailed    = utils.ErrCleanupFailed
+	ErrAlreadyAttached  = utils.ErrAlreadyAttached
+	ErrSessionBusy      = utils.ErrSessionBusy
+	ErrSessionLocked    = utils.ErrSessionLocked
+	ErrNotInSession     = utils.ErrNotInSession
+	ErrNotAttached      = utils.ErrNotAttached
+	ErrInSession        = utils.ErrInSession
+	ErrConnectionFailed = utils.ErrConnectionFailed
+	ErrConnectionLost   = utils.ErrConnectionLost
+	ErrTimeout          = utils.ErrTimeout
+	ErrUnsupported      = utils.ErrUnsupported
+	ErrPermissionDenied = utils.ErrPermissionDenied
+	ErrNoRawMode        = utils.ErrNoRawMode
+)
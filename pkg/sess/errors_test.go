@@ -0,0 +1,85 @@
+package sess_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/theMichaelB/sess/pkg/sess"
+)
+
+// deadSession leaves behind the metadata of a session whose daemon is gone.
+func deadSession(t *testing.T, number string) {
+	t.Helper()
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	home, _ := os.UserHomeDir()
+	meta := filepath.Join(home, ".sess", "session-"+number+".meta")
+	data := fmt.Sprintf(`{"session_num":%q,"pid":%d,"command":"true"}`, number, cmd.Process.Pid)
+	if err := os.WriteFile(meta, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Remove(meta) })
+}
+
+// The sentinels the internal packages wrap must still match the ones
+// pkg/sess exports, however many layers of context are added on the way.
+func TestErrorIdentity(t *testing.T) {
+	m := newManager(t)
+	deadSession(t, "077")
+
+	tests := []struct {
+		name string
+		call func() error
+		want error
+	}{
+		{"get missing", func() error { _, err := m.Get("099"); return err }, sess.ErrSessionNotFound},
+		{"kill missing", func() error { return m.Kill("099") }, sess.ErrSessionNotFound},
+		{"get dead", func() error { _, err := m.Get("077"); return err }, sess.ErrSessionDead},
+		{"attach missing", func() error {
+			return m.Attach(context.Background(), "099", sess.AttachOptions{Stdin: strings.NewReader(""), Stdout: &strings.Builder{}, Quiet: true})
+		}, sess.ErrSessionNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.call()
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("error = %v; want %v", err, tt.want)
+			}
+			if wrapped := fmt.Errorf("outer: %w", err); !errors.Is(wrapped, tt.want) {
+				t.Errorf("%v lost its identity when wrapped", err)
+			}
+		})
+	}
+}
+
+func TestAttachExitErrorIdentity(t *testing.T) {
+	m := newManager(t)
+	num, err := m.Create(sess.CreateOptions{Shell: "/bin/sh", Rows: 24, Cols: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Kill(num)
+
+	err = m.Attach(context.Background(), num, sess.AttachOptions{
+		Stdin:  strings.NewReader(""),
+		Stdout: &strings.Builder{},
+		Size:   func() (int, int, error) { return 24, 80, nil },
+		Quiet:  true,
+		Exec:   []byte("exit 3\n"),
+	})
+	var ended *sess.ExitError
+	if !errors.As(fmt.Errorf("attach %s: %w", num, err), &ended) {
+		t.Fatalf("Attach = %v; want a *sess.ExitError", err)
+	}
+	if ended.Session != num || ended.Code() != 3 {
+		t.Errorf("ExitError = %+v, Code %d; want session %s, code 3", ended, ended.Code(), num)
+	}
+}
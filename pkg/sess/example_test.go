@@ -0,0 +1,115 @@
+package sess_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/theMichaelB/sess/pkg/sess"
+)
+
+// TestMain serves the daemons the examples start: Create re-executes the
+// test binary with a daemon command line. The examples keep their
+// sessions in a throwaway home directory.
+func TestMain(m *testing.M) {
+	if sess.IsDaemonInvocation(os.Args[1:]) {
+		if err := sess.RunDaemon(os.Args[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	home, err := os.MkdirTemp("", "sess-example-")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Setenv("HOME", home)
+	os.Setenv("XDG_CONFIG_HOME", home)
+	os.Unsetenv("SESS_NUM")
+	// Under -race, daemons would otherwise linger a second on exit, which
+	// Kill waits for.
+	os.Setenv("GORACE", "atexit_sleep_ms=0")
+	code := m.Run()
+	os.RemoveAll(home)
+	os.Exit(code)
+}
+
+// Creating, listing and killing a session.
+func Example() {
+	m, err := sess.NewManager()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	num, err := m.Create(sess.CreateOptions{Command: []string{"sleep", "60"}})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Println("created", num)
+
+	sessions, err := m.List()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	for _, s := range sessions {
+		fmt.Println(s.Number, s.Command)
+	}
+
+	if err := m.Kill(num); err != nil {
+		fmt.Println(err)
+	}
+	// Output:
+	// created 001
+	// 001 sleep 60
+}
+
+// Attaching to a session with custom streams and typing a command into it.
+// Attach returns once the session's shell exits.
+func ExampleManager_Attach() {
+	m, err := sess.NewManager()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	num, err := m.Create(sess.CreateOptions{Shell: "/bin/sh", Rows: 24, Cols: 80})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	var out bytes.Buffer
+	err = m.Attach(context.Background(), num, sess.AttachOptions{
+		Stdin:  strings.NewReader(""),
+		Stdout: &out,
+		Size:   func() (int, int, error) { return 24, 80, nil },
+		Quiet:  true,
+		Exec:   []byte("echo $((6 * 7)); exit\n"),
+	})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Println("saw 42:", strings.Contains(out.String(), "42"))
+	// Output:
+	// saw 42: true
+}
+
+// Telling a missing session from other failures.
+func ExampleManager_Get() {
+	m, err := sess.NewManager()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	_, err = m.Get("099")
+	fmt.Println(errors.Is(err, sess.ErrSessionNotFound))
+	// Output:
+	// true
+}
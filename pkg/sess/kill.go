@@ -0,0 +1,106 @@
+package sess
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/theMichaelB/sess/internal/client"
+	"github.com/theMichaelB/sess/internal/config"
+)
+
+// killJobs is how many sessions KillEach kills at once.
+const killJobs = 8
+
+// Kill terminates a session and removes its files, whether or not clients
+// are attached; they are first told it is being killed and disconnected.
+// Callers that should spare sessions in use can check Status first.
+func (m *Manager) Kill(number string) error {
+	number = m.NormalizeNumber(number)
+	// Clients are told why they are going before the session ends under
+	// them; a daemon that does not answer is killed all the same.
+	if _, err := m.m.GetSession(number); err == nil {
+		_ = client.DetachAll(m.m.GetSocketPath(number), "the session is being killed", statusTimeout)
+	}
+	cfg, err := config.Load()
+	if err != nil {
+		cfg = config.Default()
+	}
+	return m.m.KillSession(number, cfg.KillSequence())
+}
+
+// KillEach kills sessions, a few at a time, and returns each one's result
+// in the same order.
+func (m *Manager) KillEach(numbers []string) []error {
+	errs := make([]error, len(numbers))
+	sem := make(chan struct{}, killJobs)
+	var wg sync.WaitGroup
+	for i, number := range numbers {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int, number string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			errs[i] = m.Kill(number)
+		}(i, number)
+	}
+	wg.Wait()
+	return errs
+}
+
+// KillOrder returns the sessions to kill of those numbered, in order, to
+// kill them all from inside session current ("" outside any). current is
+// skipped, as skipped reports, unless includeCurrent; it is then killed
+// last, since it takes the shell running the caller with it. A current
+// session that is not among those numbered is never added.
+func KillOrder(numbers []string, current string, includeCurrent bool) (order []string, skipped bool) {
+	for _, number := range numbers {
+		if number == current {
+			skipped = !includeCurrent
+			continue
+		}
+		order = append(order, number)
+	}
+	if current != "" && includeCurrent && len(order) < len(numbers) {
+		order = append(order, current)
+	}
+	return order, skipped
+}
+
+// PurgeResult reports what Purge did.
+type PurgeResult struct {
+	// Killed lists the sessions that were running.
+	Killed []string
+	// Removed lists the paths of the files removed.
+	Removed []string
+	// Kept lists files in the directory that sess did not create.
+	Kept []string
+}
+
+// Purge kills every session and then removes all files sess owns from its
+// directory, and the directory too if nothing else is left in it. Files it
+// does not recognise as its own are never removed. A session that cannot
+// be killed stops the purge before any file is removed.
+func (m *Manager) Purge() (*PurgeResult, error) {
+	sessions, err := m.List()
+	if err != nil {
+		return nil, err
+	}
+	numbers := make([]string, len(sessions))
+	for i, s := range sessions {
+		numbers[i] = s.Number
+	}
+	res := &PurgeResult{}
+	var failed error
+	for i, err := range m.KillEach(numbers) {
+		if err != nil && !errors.Is(err, ErrSessionNotFound) && !errors.Is(err, ErrSessionDead) {
+			failed = errors.Join(failed, err)
+			continue
+		}
+		res.Killed = append(res.Killed, numbers[i])
+	}
+	if failed != nil {
+		return res, failed
+	}
+	res.Removed, res.Kept, err = m.m.Purge()
+	return res, err
+}
@@ -0,0 +1,142 @@
+package sess_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/theMichaelB/sess/pkg/sess"
+)
+
+// Kill moves on as soon as the session's command has gone, rather than
+// waiting out the grace period.
+func TestKillIdleSessionIsPrompt(t *testing.T) {
+	m := newManager(t)
+	num, err := m.Create(sess.CreateOptions{Command: []string{"sleep", "60"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if err := m.Kill(num); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Kill took %v", elapsed)
+	}
+	if _, err := m.Get(num); err == nil {
+		t.Errorf("session %s still listed after Kill", num)
+	}
+}
+
+// A command that ignores the gentler signals is killed by a later one, and
+// the session is gone, daemon and files, once Kill returns.
+func TestKillCommandIgnoringTerm(t *testing.T) {
+	configHome := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", configHome)
+	if err := os.MkdirAll(filepath.Join(configHome, "sess"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	config := "kill-signals = HUP, TERM, KILL\nkill-grace = 200ms\n"
+	if err := os.WriteFile(filepath.Join(configHome, "sess", "config"), []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	m := newManager(t)
+	num, err := m.Create(sess.CreateOptions{Command: []string{"sh", "-c", `trap "" HUP TERM; while :; do sleep 1; done`}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := m.Get(num)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.DaemonPID == 0 {
+		t.Fatal("metadata does not name the daemon")
+	}
+
+	start := time.Now()
+	if err := m.Kill(num); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("Kill took %v; want about two grace periods", elapsed)
+	}
+	// Kill counts an exited process as gone before its parent, this test
+	// for the daemon, has reaped it.
+	for _, pid := range []int{s.PID, s.DaemonPID} {
+		for deadline := time.Now().Add(time.Second); syscall.Kill(pid, 0) == nil && time.Now().Before(deadline); {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if syscall.Kill(pid, 0) == nil {
+			t.Errorf("pid %d still running", pid)
+		}
+	}
+	if _, err := os.Stat(m.SocketPath(num)); !os.IsNotExist(err) {
+		t.Errorf("socket left behind: %v", err)
+	}
+	if err := m.Kill(num); !errors.Is(err, sess.ErrSessionNotFound) {
+		t.Errorf("second Kill = %v; want ErrSessionNotFound", err)
+	}
+}
+
+// Kills running side by side each end their own session and nothing else.
+func TestKillConcurrently(t *testing.T) {
+	const n = 6
+	m := newManager(t)
+	numbers, errs := createConcurrently(t, n, sess.CreateOptions{Command: []string{"sleep", "60"}})
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("create %d: %v", i, err)
+		}
+	}
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i, num := range numbers {
+		wg.Add(1)
+		go func(i int, num string) {
+			defer wg.Done()
+			errs[i] = newManager(t).Kill(num)
+		}(i, num)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("kill %s: %v", numbers[i], err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("killing %d sessions took %v", n, elapsed)
+	}
+	if left, err := m.List(); err != nil || len(left) != 0 {
+		t.Errorf("List = %v, %v; want no sessions", left, err)
+	}
+}
+
+func TestKillOrder(t *testing.T) {
+	sessions := []string{"001", "002", "003"}
+	tests := []struct {
+		name           string
+		current        string
+		includeCurrent bool
+		order          []string
+		skipped        bool
+	}{
+		{"outside a session", "", false, []string{"001", "002", "003"}, false},
+		{"outside, include current", "", true, []string{"001", "002", "003"}, false},
+		{"inside a session", "002", false, []string{"001", "003"}, true},
+		{"inside, include current", "002", true, []string{"001", "003", "002"}, false},
+		{"inside a session not listed", "009", true, []string{"001", "002", "003"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			order, skipped := sess.KillOrder(sessions, tt.current, tt.includeCurrent)
+			if !reflect.DeepEqual(order, tt.order) || skipped != tt.skipped {
+				t.Errorf("KillOrder(%v, %q, %v) = %v, %v; want %v, %v", sessions, tt.current, tt.includeCurrent, order, skipped, tt.order, tt.skipped)
+			}
+		})
+	}
+}
@@ -0,0 +1,180 @@
+package sess_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/theMichaelB/sess/pkg/sess"
+)
+
+// LiveNumbers lists live sessions only, and leaves the directory as it
+// found it.
+func TestLiveNumbers(t *testing.T) {
+	m := newManager(t)
+	num, err := m.Create(sess.CreateOptions{Command: []string{"sleep", "60"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Kill(num)
+	// A session whose command is gone, as a SIGKILLed daemon leaves.
+	dead := filepath.Join(m.Dir(), "session-900.meta")
+	if err := os.WriteFile(dead, []byte(`{"session_num":"900","pid":999999999}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(dead)
+
+	before, _ := os.ReadDir(m.Dir())
+	numbers, err := sess.LiveNumbers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(numbers, []string{num}) {
+		t.Errorf("LiveNumbers = %q; want [%s]", numbers, num)
+	}
+	after, _ := os.ReadDir(m.Dir())
+	if len(after) != len(before) {
+		t.Errorf("directory changed: %d entries before, %d after", len(before), len(after))
+	}
+}
+
+func TestStats(t *testing.T) {
+	m := newManager(t)
+	num, err := m.Create(sess.CreateOptions{Command: []string{"sh", "-c", "echo stats-output; sleep 60"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Kill(num)
+	waitFor(t, "output in the scrollback", func() bool {
+		st, err := m.Status(num)
+		return err == nil && st.Scrollback > 0
+	})
+
+	st, err := m.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Dir != m.Dir() || st.DirSize == 0 {
+		t.Errorf("Stats directory %s using %d bytes", st.Dir, st.DirSize)
+	}
+	if st.Sessions != 1 || st.Attached != 0 || st.Detached != 1 {
+		t.Errorf("Stats sessions %d (%d attached, %d detached); want 1 detached", st.Sessions, st.Attached, st.Detached)
+	}
+	// sh and its sleep, where processes can be counted.
+	if st.Processes != -1 && st.Processes != 2 {
+		t.Errorf("Stats processes = %d; want 2", st.Processes)
+	}
+	if st.Scrollback == 0 {
+		t.Error("Stats counts no scrollback")
+	}
+	if st.Oldest == nil || time.Since(*st.Oldest) > time.Minute {
+		t.Errorf("Stats oldest = %v", st.Oldest)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	m := newManager(t)
+	var nums []string
+	for i := 0; i < 2; i++ {
+		num, err := m.Create(sess.CreateOptions{Command: []string{"sh", "-c", "echo metrics-output; sleep 60"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer m.Kill(num)
+		nums = append(nums, num)
+	}
+	for _, num := range nums {
+		waitFor(t, "output in the scrollback", func() bool {
+			st, err := m.Status(num)
+			return err == nil && st.Scrollback > 0
+		})
+	}
+
+	// A daemon that has stopped answering costs the scrape a short wait,
+	// not the others' metrics.
+	s, err := m.Get(nums[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Kill(s.DaemonPID, syscall.SIGSTOP); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Kill(s.DaemonPID, syscall.SIGCONT)
+
+	start := time.Now()
+	metrics, err := m.Metrics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if took := time.Since(start); took > 2*time.Second {
+		t.Errorf("Metrics took %v with a stopped daemon", took)
+	}
+	if len(metrics) != 2 {
+		t.Fatalf("Metrics = %+v; want 2 sessions", metrics)
+	}
+	up := metrics[0]
+	if up.Number != nums[0] || !up.Up || up.Attached || up.Clients != 0 {
+		t.Errorf("Metrics for the running session = %+v", up)
+	}
+	if up.BytesOut < uint64(len("metrics-output")) || up.Scrollback == 0 {
+		t.Errorf("Metrics count %d bytes out, %d of scrollback", up.BytesOut, up.Scrollback)
+	}
+	if down := metrics[1]; down.Number != nums[1] || down.Up {
+		t.Errorf("Metrics for the stopped session = %+v", down)
+	}
+}
+
+// Cwd goes by the directory the shell announces, and by the shell's own
+// until it has.
+func TestCwd(t *testing.T) {
+	m := newManager(t)
+	num, err := m.Create(sess.CreateOptions{Command: []string{"sh", "-c", `cd /; read line; printf '\033]7;file://localhost/tmp\007'; sleep 60`}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Kill(num)
+
+	waitFor(t, "the shell to change directory", func() bool {
+		cwd, err := m.Cwd(num)
+		return cwd == "/" || errors.Is(err, sess.ErrUnsupported)
+	})
+	m.Send(num, []byte("\n"))
+	waitFor(t, "the shell to announce its directory", func() bool {
+		cwd, _ := m.Cwd(num)
+		return cwd == "/tmp"
+	})
+}
+
+// Status reports the size of the session's terminal, and OutputLines its
+// last lines of output as plain text.
+func TestStatusSizeAndOutputLines(t *testing.T) {
+	m := newManager(t)
+	num, err := m.Create(sess.CreateOptions{
+		Command: []string{"sh", "-c", `printf 'one\ntwo\n\033[1mthree\033[m\nfour\nprompt$ '; sleep 60`},
+		Rows:    30, Cols: 100,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Kill(num)
+
+	st, err := m.Status(num)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Rows != 30 || st.Cols != 100 {
+		t.Errorf("Status size = %dx%d; want 30x100", st.Rows, st.Cols)
+	}
+	var lines []string
+	waitFor(t, "the prompt", func() bool {
+		lines, err = m.OutputLines(num, 3)
+		return err == nil && len(lines) == 3 && lines[2] == "prompt$ "
+	})
+	if want := []string{"three", "four", "prompt$ "}; !reflect.DeepEqual(lines, want) {
+		t.Errorf("OutputLines = %q; want %q", lines, want)
+	}
+}
@@ -0,0 +1,63 @@
+package sess
+
+import (
+	"sync"
+	"time"
+
+	"github.com/theMichaelB/sess/internal/client"
+)
+
+// metricsTimeout bounds each daemon's answer to a metrics scrape. Daemons
+// are asked together, so a wedged one costs the scrape this much at most.
+const metricsTimeout = 250 * time.Millisecond
+
+// SessionMetrics is what a monitoring scrape learns of one session.
+type SessionMetrics struct {
+	Number string
+	// Up is set if the session's daemon answered; the rest is zero
+	// otherwise.
+	Up bool
+	// Attached is set while an interactive client is attached; Clients
+	// counts every client connected, peeks included.
+	Attached bool
+	Clients  int
+	// BytesOut counts the output the session's programs have written
+	// since it started, and Scrollback the bytes of it held in memory.
+	BytesOut   uint64
+	Scrollback int64
+}
+
+// Metrics asks every live session's daemon for its counters, all at once
+// and each for a short while, for monitoring. A daemon that does not
+// answer in time is reported down rather than failing the scrape. The
+// result is in session order.
+func (m *Manager) Metrics() ([]SessionMetrics, error) {
+	sessions, err := m.List()
+	if err != nil {
+		return nil, err
+	}
+	metrics := make([]SessionMetrics, len(sessions))
+	var wg sync.WaitGroup
+	for i := range sessions {
+		metrics[i].Number = sessions[i].Number
+		wg.Add(1)
+		go func(sm *SessionMetrics) {
+			defer wg.Done()
+			st, err := client.QueryStatus(m.m.GetSocketPath(sm.Number), metricsTimeout)
+			if err != nil {
+				return
+			}
+			sm.Up = true
+			sm.Clients = len(st.Clients)
+			sm.BytesOut = st.BytesOut
+			sm.Scrollback = int64(st.Scrollback)
+			for _, c := range st.Clients {
+				if c.Mode == ModeAttach {
+					sm.Attached = true
+				}
+			}
+		}(&metrics[i])
+	}
+	wg.Wait()
+	return metrics, nil
+}
@@ -0,0 +1,73 @@
+package sess_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/theMichaelB/sess/pkg/sess"
+)
+
+func newManager(t *testing.T) *sess.Manager {
+	t.Helper()
+	m, err := sess.NewManager()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestInSessionLiveSession(t *testing.T) {
+	m := newManager(t)
+	num, err := m.Create(sess.CreateOptions{Command: []string{"sleep", "60"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Kill(num)
+
+	t.Setenv("SESS_NUM", num)
+	t.Setenv("SESS_SOCKET", m.SocketPath(num))
+	inner := newManager(t)
+	if got, ok := inner.InSession(); !ok || got != num {
+		t.Errorf("InSession() = %q, %v; want %q, true", got, ok, num)
+	}
+	if _, stale := inner.StaleSession(); stale {
+		t.Error("a live session is reported stale")
+	}
+}
+
+func TestInSessionStaleEnvironment(t *testing.T) {
+	m := newManager(t)
+	t.Setenv("SESS_NUM", "042")
+	t.Setenv("SESS_SOCKET", m.SocketPath("042"))
+
+	m = newManager(t)
+	if got, ok := m.InSession(); ok {
+		t.Errorf("InSession() = %q, true for a session that is gone", got)
+	}
+	if got, stale := m.StaleSession(); !stale || got != "042" {
+		t.Errorf("StaleSession() = %q, %v; want 042, true", got, stale)
+	}
+}
+
+func TestInSessionOtherStateDirectory(t *testing.T) {
+	// SESS_NUM inherited from a session of another sess directory, such
+	// as another user's or one on the far side of an SSH connection.
+	t.Setenv("SESS_NUM", "001")
+	t.Setenv("SESS_SOCKET", filepath.Join(t.TempDir(), ".sess", "session-001.sock"))
+
+	m := newManager(t)
+	if got, ok := m.InSession(); ok {
+		t.Errorf("InSession() = %q, true for another directory's session", got)
+	}
+	if got, stale := m.StaleSession(); stale {
+		t.Errorf("StaleSession() = %q, true for another directory's session", got)
+	}
+}
+
+func TestInSessionWithoutEnvironment(t *testing.T) {
+	t.Setenv("SESS_NUM", "")
+	m := newManager(t)
+	if got, ok := m.InSession(); ok {
+		t.Errorf("InSession() = %q, true with no SESS_NUM", got)
+	}
+}
@@ -0,0 +1,19 @@
+package sess_test
+
+import (
+	"testing"
+
+	"github.com/theMichaelB/sess/pkg/protocol/protocoltest"
+	"github.com/theMichaelB/sess/pkg/sess"
+)
+
+// The daemon speaks the protocol other clients are written against.
+func TestDaemonConformance(t *testing.T) {
+	m := newManager(t)
+	num, err := m.Create(sess.CreateOptions{Command: []string{"sh", "-c", "echo ready; sleep 60"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Kill(num)
+	protocoltest.Conformance(t, m.SocketPath(num))
+}
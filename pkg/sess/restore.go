@@ -0,0 +1,121 @@
+package sess
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/theMichaelB/sess/internal/platform"
+	"github.com/theMichaelB/sess/internal/session"
+)
+
+// RestoreSpec is how a session lost to a reboot was created; see
+// RestoreSpecs.
+type RestoreSpec = session.RestoreSpec
+
+// RestoreSpecs returns the sessions lost to a reboot, or to a crash taking
+// the machine down, which Restore can start again. Create keeps a spec of
+// each session it starts, other than transient ones, until the session is
+// killed or its command ends by itself; one shut down with the machine
+// leaves it behind. Only specs written before the current boot are
+// returned.
+func (m *Manager) RestoreSpecs() ([]RestoreSpec, error) {
+	return m.m.RestoreSpecs()
+}
+
+// Restore starts again, detached, the session spec describes: its command,
+// in the same directory, with the same variables given, size and settings.
+// It takes the old number if that is free, and the next free one
+// otherwise, which it returns; the spec is then the new session's.
+// Variables pushed with SetEnv are not restored, and neither is a copied
+// environment: the copy is made afresh from the caller's. A spec another
+// Restore has taken, as when two run at once, is an error.
+func (m *Manager) Restore(spec RestoreSpec) (string, error) {
+	opts := CreateOptions{
+		Number:           spec.Number,
+		Command:          spec.Argv,
+		Dir:              spec.Dir,
+		Env:              spec.Env,
+		Rows:             spec.Rows,
+		Cols:             spec.Cols,
+		Log:              spec.Log,
+		LogInput:         spec.LogInput,
+		Termios:          spec.Termios,
+		Rlimits:          spec.Rlimits,
+		NoOOMProtect:     spec.NoOOMProtect,
+		ThrottleDetached: spec.ThrottleDetached,
+		Timeout:          spec.Timeout,
+		Respawn:          spec.Respawn,
+		Definition:       spec.Definition,
+	}
+	switch mode := spec.EnvMode; {
+	case mode == "clean":
+		opts.CleanEnv = true
+	case mode == "copy":
+		opts.CopyEnv = true
+	case strings.HasPrefix(mode, "copy:"):
+		opts.CopyEnvOnly = strings.Split(strings.TrimPrefix(mode, "copy:"), ",")
+	}
+	release, err := m.m.TakeRestoreSpec(spec.Number, spec.CreatedAt)
+	if err != nil {
+		return "", fmt.Errorf("session %s has already been restored or discarded", spec.Number)
+	}
+	number, err := m.Create(opts)
+	if errors.Is(err, ErrSessionExists) {
+		opts.Number = ""
+		number, err = m.Create(opts)
+	}
+	release(err == nil)
+	return number, err
+}
+
+// DiscardRestore drops spec, so the session is no longer offered for
+// restoring.
+func (m *Manager) DiscardRestore(spec RestoreSpec) error {
+	return m.m.DropRestoreSpec(spec.Number, spec.CreatedAt)
+}
+
+// writeRestoreSpec records how session number was created, for Restore.
+// It is best effort: a session without a spec is merely not restorable.
+func (m *Manager) writeRestoreSpec(number string, opts CreateOptions, argv []string, envMode string) {
+	s, err := m.m.GetSession(number)
+	if err != nil {
+		return
+	}
+	dir := opts.Dir
+	if dir == "" {
+		if dir, err = os.Getwd(); err != nil {
+			return
+		}
+	}
+	spec := RestoreSpec{
+		Number:           number,
+		CreatedAt:        s.CreatedAt,
+		Argv:             argv,
+		Dir:              dir,
+		Env:              opts.Env,
+		EnvMode:          envMode,
+		Rows:             opts.Rows,
+		Cols:             opts.Cols,
+		Log:              opts.Log,
+		LogInput:         opts.LogInput,
+		Termios:          opts.Termios,
+		Rlimits:          opts.Rlimits,
+		NoOOMProtect:     opts.NoOOMProtect,
+		ThrottleDetached: opts.ThrottleDetached,
+		Timeout:          opts.Timeout,
+		Respawn:          opts.Respawn,
+		Definition:       opts.Definition,
+	}
+	spec.BootID, _ = platform.BootID()
+	path := session.RestoreSpecPath(m.m.GetMetaPath(number))
+	if session.WriteRestoreSpec(path, &spec) != nil {
+		return
+	}
+	// A daemon removes the spec after the metadata, so if the metadata is
+	// still there it will see this one; if not, the session has ended.
+	if _, err := m.m.GetSession(number); err != nil {
+		os.Remove(path)
+	}
+}
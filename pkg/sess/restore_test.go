@@ -0,0 +1,127 @@
+package sess_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/theMichaelB/sess/pkg/sess"
+)
+
+// specPath returns where session number's restore spec is kept.
+func specPath(m *sess.Manager, number string) string {
+	return filepath.Join(m.Dir(), fmt.Sprintf("session-%s.restore", number))
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func TestRestoreSpecDroppedWhenSessionEnds(t *testing.T) {
+	m := newManager(t)
+	killed, err := m.Create(sess.CreateOptions{Command: []string{"sleep", "60"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists(specPath(m, killed)) {
+		t.Fatal("no restore spec was written")
+	}
+	if err := m.Kill(killed); err != nil {
+		t.Fatal(err)
+	}
+	if exists(specPath(m, killed)) {
+		t.Error("the restore spec of a killed session was kept")
+	}
+
+	exited, err := m.Create(sess.CreateOptions{Command: []string{"sleep", "0.5"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the session to end", func() bool {
+		_, err := m.Get(exited)
+		return err != nil
+	})
+	waitFor(t, "the restore spec to go", func() bool { return !exists(specPath(m, exited)) })
+}
+
+func TestRestoreAfterReboot(t *testing.T) {
+	m := newManager(t)
+	dir := t.TempDir()
+	num, err := m.Create(sess.CreateOptions{
+		Command: []string{"sh", "-c", "echo $RESTORE_TEST >> out; exec sleep 60"},
+		Dir:     dir,
+		Env:     []string{"RESTORE_TEST=restored"},
+		Rows:    30, Cols: 100,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Kill(num)
+	s, err := m.Get(num)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Shut the daemon down as the system would, then make its spec look
+	// as if it was written before a reboot.
+	if err := syscall.Kill(s.DaemonPID, syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the daemon to shut down", func() bool {
+		_, err := m.Get(num)
+		return err != nil
+	})
+	path := specPath(m, num)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("the spec of a session shut down by a signal is gone: %v", err)
+	}
+	var raw map[string]interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		t.Fatal(err)
+	}
+	raw["boot_id"] = "an-earlier-boot"
+	data, _ = json.Marshal(raw)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The lost number is kept for the session.
+	other, err := m.Create(sess.CreateOptions{Command: []string{"sleep", "60"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Kill(other)
+	if other == num {
+		t.Fatalf("a new session took number %s, awaiting restore", num)
+	}
+
+	specs, err := m.RestoreSpecs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(specs) != 1 || specs[0].Number != num || specs[0].Dir != dir || specs[0].Rows != 30 {
+		t.Fatalf("RestoreSpecs = %+v; want session %s's", specs, num)
+	}
+	restored, err := m.Restore(specs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored != num {
+		t.Errorf("restored as session %s; want %s", restored, num)
+	}
+	waitFor(t, "the command to run again", func() bool {
+		data, _ := os.ReadFile(filepath.Join(dir, "out"))
+		return string(data) == "restored\nrestored\n"
+	})
+	if _, err := m.Restore(specs[0]); err == nil {
+		t.Error("the same spec was restored twice")
+	}
+	if specs, err := m.RestoreSpecs(); err != nil || len(specs) != 0 {
+		t.Errorf("after restoring, RestoreSpecs = %+v, %v", specs, err)
+	}
+}
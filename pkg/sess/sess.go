@@ -0,0 +1,1267 @@
+package sess
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/theMichaelB/sess/internal/client"
+	"github.com/theMichaelB/sess/internal/config"
+	"github.com/theMichaelB/sess/internal/daemon"
+	"github.com/theMichaelB/sess/internal/linescan"
+	"github.com/theMichaelB/sess/internal/session"
+	"github.com/theMichaelB/sess/internal/utils"
+	"github.com/theMichaelB/sess/pkg/protocol"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	daemonStartAttempts = 20
+	daemonStartInterval = 100 * time.Millisecond
+	statusTimeout       = 1 * time.Second
+	inputTimeout        = 2 * time.Second
+	// upgradeTimeout covers checking the new binary and its taking the
+	// session over.
+	upgradeTimeout = 10 * time.Second
+	// debugTimeout is how long Debug waits for a daemon sent SIGUSR2 to
+	// write its dump.
+	debugTimeout = 5 * time.Second
+	// reregisterTimeout is how long Reregister waits for a daemon to put
+	// its state back.
+	reregisterTimeout = 5 * time.Second
+	resourceInterval  = 200 * time.Millisecond
+	// nestedDetachKey is the default detach key for an attach made from
+	// inside another session, so Ctrl-X keeps detaching the outer one.
+	nestedDetachKey = "C-]"
+)
+
+// Version is the build of sess this program is, such as "v1.2.0". The
+// daemons it starts record it in their metadata, and attaches warn when a
+// session was started by a different build. Programs set it before use;
+// empty means unknown, and is never warned about.
+var Version string
+
+// Session describes a live session as recorded in its metadata.
+type Session = session.Session
+
+// Record is a session as ListAll reports it: live, exited or stale.
+type Record = session.Record
+
+// ExitInfo is how an exited session's command ended.
+type ExitInfo = session.ExitInfo
+
+// LogRetention bounds the output logs kept from ended sessions.
+type LogRetention = session.LogRetention
+
+// States of a Record.
+const (
+	StateLive   = session.StateLive
+	StateExited = session.StateExited
+	StateStale  = session.StateStale
+	StateRemote = session.StateRemote
+)
+
+// Status is a daemon's live view of its session.
+type Status = protocol.StatusPayload
+
+// Resources is the CPU and memory use of a session's process tree.
+type Resources = session.Resources
+
+// SharedUser is another user a session is shared with.
+type SharedUser = protocol.SharedUser
+
+// ShareStatus is who a session is shared with, and the socket they attach
+// through.
+type ShareStatus = protocol.ShareStatus
+
+// ExitError is returned by Attach when the session's command ends while
+// attached, with a non-zero status or by a signal.
+type ExitError = client.ExitError
+
+// ClientInfo describes a client connected to a session.
+type ClientInfo = protocol.ClientInfo
+
+// Client modes reported in ClientInfo.
+const (
+	ModeAttach = protocol.ModeAttach
+	ModePeek   = protocol.ModePeek
+)
+
+// Manager creates and controls sessions in the user's sess directory.
+type Manager struct {
+	m *session.Manager
+
+	envOnce   sync.Once
+	envNumber string // session named by SESS_NUM, if it belongs here
+	envLive   bool   // whether that session's daemon answered
+}
+
+// CreateOptions configures a new session.
+type CreateOptions struct {
+	// Number requests a specific session number ("7" or "007"), which
+	// Create fails with ErrSessionExists if it is live or being created.
+	// When empty the next free number is used: one past the highest in
+	// use, so numbers go on upwards from one given here.
+	Number string
+	// Command is the argv run inside the session. When empty, Shell is
+	// run instead.
+	Command []string
+	// Shell is the program run inside the session when Command is empty.
+	// Defaults to $SHELL, falling back to /bin/sh.
+	Shell string
+	// Rows and Cols set the initial PTY size; zero leaves the default.
+	// XPixel and YPixel are the size in pixels that goes with it, which
+	// programs drawing images size them by; zero leaves it unknown.
+	Rows, Cols     int
+	XPixel, YPixel int
+	// Executable is the program started as the session daemon. Defaults to
+	// the running executable, which must then call RunDaemon.
+	Executable string
+	// Transient sessions end as soon as their interactive client leaves,
+	// even if it is killed outright. Peek clients do not count.
+	Transient bool
+	// Log records the session's output to a file in the sess directory,
+	// kept after the session ends; see Session.Log.
+	Log bool
+	// LogInput records what is typed into the session, by any client or
+	// Send, to a file readable only by the owner, except input typed at
+	// password prompts. It is kept after the session ends and never
+	// pruned; see Session.InputLog.
+	LogInput bool
+	// RecordScript records the session's output to this file as script(1)
+	// does, and RecordTiming, if set too, the timing scriptreplay(1) needs
+	// to replay it. Both are created afresh. Resizes cannot be expressed
+	// in the format, so a replay keeps the size the session started at.
+	RecordScript string
+	RecordTiming string
+	// Termios sets up the session's terminal before its command starts,
+	// e.g. "ixon=off,erase=^?": flags such as ixon, icrnl or echo take on
+	// or off, and special characters such as erase or intr take a
+	// character, ^X, ^? or undef. Unknown settings are an error.
+	Termios string
+	// Rlimits are resource limits for the session's command and what it
+	// starts, such as "nofile=4096", "core=0" or "as=8G", each setting
+	// the soft and hard limit, or "nofile=1024:4096" for each. Names are
+	// those of prlimit(1) the system has; sizes take K, M and G, and cpu
+	// takes seconds or a duration. A limit that is unknown, malformed or
+	// cannot be set, such as a hard limit raised without root, fails the
+	// Create.
+	Rlimits []string
+	// NoOOMProtect leaves the daemon's Linux OOM score alone, instead of
+	// lowering it as the oom-score-adj setting says (by 500 unless set)
+	// so that the OOM killer picks the program eating the memory rather
+	// than the daemon and the whole session with it.
+	NoOOMProtect bool
+	// CopyEnv starts the session's command with the environment of the
+	// process calling Create, as it is then, rather than with whatever the
+	// daemon inherited. CopyEnvOnly copies only the variables it names,
+	// and implies CopyEnv. CleanEnv instead starts the command with just
+	// PATH, HOME and TERM from it. SESS_NUM and the other SESS_ variables
+	// are set either way; the session's metadata records which was used.
+	CopyEnv     bool
+	CopyEnvOnly []string
+	CleanEnv    bool
+	// ThrottleDetached has the daemon stop reading the session's output
+	// while no client is connected, nothing records it and the scrollback
+	// is full, so a program flooding it is held up writing instead of
+	// running on; see Status.Throttled. A program that blocks on its
+	// terminal may then not get to handle a signal until a client
+	// attaches.
+	ThrottleDetached bool
+	// Timeout, if positive, ends the session that long after it starts:
+	// its command is sent SIGTERM, then SIGKILL after the kill grace
+	// period, and its exit is recorded with the reason "expired
+	// (timeout)". SetTimeout moves it.
+	Timeout time.Duration
+	// Dir is the directory the command starts in; empty is the caller's.
+	Dir string
+	// Env holds KEY=VALUE variables set in the command's environment over
+	// the one it would otherwise start with.
+	Env []string
+	// Respawn, RespawnAlways or RespawnOnFailure, runs the command again
+	// each time it exits, or only when it fails, after a delay that grows
+	// while it keeps exiting soon after starting. The session then lasts
+	// until it is killed or, with RespawnOnFailure, its command succeeds.
+	Respawn string
+	// Definition records the sessions.toml entry the session is started
+	// from, as Up does; see Session.Definition.
+	Definition string
+}
+
+// AttachOptions configures an attach. Zero values attach the process's own
+// standard streams.
+type AttachOptions struct {
+	// Stdin supplies input for the session; a terminal is put into raw mode
+	// unless Cooked. Attach returns an error wrapping ErrNoRawMode, with
+	// the terminal as it was, if that fails.
+	Stdin io.Reader
+	// Stdout receives session output.
+	Stdout io.Writer
+	// Size reports the size (rows, cols) to apply to the session. When nil
+	// the size of a terminal Stdin is used. A Raw attach applies it once,
+	// and otherwise leaves the size alone.
+	Size func() (rows, cols int, err error)
+	// Resize causes Size to be consulted again each time it receives.
+	Resize <-chan struct{}
+	// DisableCtrlX turns off the detach key and its other bindings.
+	DisableCtrlX bool
+	// DetachKey replaces Ctrl-X as the detach key. It is a single key such
+	// as "C-]" or a screen-style prefix and action such as "C-a d". When
+	// empty, the session's own preference (see SetDetachKey) applies, and
+	// attaches from inside another session default to C-].
+	DetachKey string
+	// KeyTimeout is how long a DetachKey prefix waits for its action key
+	// before being sent to the session; zero uses a default of one second.
+	KeyTimeout time.Duration
+	// Quiet suppresses the attach/detach banners.
+	Quiet bool
+	// NoResize keeps the session at its current size instead of resizing
+	// it to the attaching terminal; larger content is clipped.
+	NoResize bool
+	// NoRedraw skips nudging the session's foreground program to repaint
+	// after attaching.
+	NoRedraw bool
+	// RedrawCtrlL also types Ctrl-L when nudging a repaint, for programs
+	// that ignore SIGWINCH. It is never sent to the shell itself.
+	RedrawCtrlL bool
+	// DetachOnEOF detaches, exactly as the detach key does, once Stdin
+	// reaches end of file. Otherwise the attach lasts until the user
+	// detaches or the session ends, whatever happens to Stdin.
+	DetachOnEOF bool
+	// Cooked attaches without raw mode, for terminals that cannot enter
+	// it: a terminal Stdin keeps its line editing and echo, and each line
+	// is sent when Enter is pressed. The detach key takes effect once its
+	// line is sent, and Ctrl-D on an empty line detaches.
+	Cooked bool
+	// Interrupt types Ctrl-C into the session each time it receives. A
+	// Cooked terminal turns the key into SIGINT, which the caller can
+	// relay here.
+	Interrupt <-chan struct{}
+	// NoInput attaches output-only, for capturing output or watching from
+	// a process supervisor: Stdin is not read and need not be a terminal.
+	// The attach lasts until ctx is cancelled, Duration passes or the
+	// session ends.
+	NoInput bool
+	// Duration detaches, as cancelling ctx does, once the attach has
+	// lasted this long. Zero means no limit.
+	Duration time.Duration
+	// Force attaches to a session even though it is locked (see Lock).
+	// Only the session's owner may.
+	Force bool
+	// Tee also receives the session's output while attached, e.g. a file
+	// to keep a record of an incident in. It is written through a buffer
+	// flushed when the attach ends; if a write fails the attach carries on
+	// and the user is told the copy stopped.
+	Tee io.Writer
+	// TeeTimestamps starts each line written to Tee with the time it
+	// arrived, for building timelines.
+	TeeTimestamps bool
+	// NoScreenReset leaves the terminal's screen modes as the session left
+	// them. Otherwise, when the attachment ends other than by detaching (the
+	// session ended or its daemon died), the cursor is shown, the alternate
+	// screen left, attributes reset and line wrap turned back on.
+	NoScreenReset bool
+	// NoAltScreen keeps the terminal on the screen it is on. Otherwise
+	// attaching to a session a full-screen program has on the alternate
+	// screen switches the terminal to it, and detaching switches back and
+	// shows the cursor, leaving the shell as it was before the attach.
+	NoAltScreen bool
+	// Raw attaches as a plain byte pipe between Stdin and Stdout and the
+	// session, the stable interface for programs that drive a session as
+	// expect does. The terminal's mode is left alone, nothing but the
+	// session's output is written, no key detaches and the session's size
+	// is changed only to Size. The attach ends, leaving the session
+	// running, when Stdin reaches end of file, ctx is cancelled or
+	// Duration passes, and returns nil; the session's command ending
+	// returns what it does for other attaches, and the daemon
+	// disconnecting the client an error wrapping ErrConnectionLost. Of the
+	// other options only ReadOnly, NoInput, Size, Duration and Force
+	// apply, and the attach is not recorded as the session's current
+	// client.
+	Raw bool
+	// ReadOnly attaches as a peek client alongside any interactive one:
+	// output is shown, input other than the detach key is discarded, and
+	// the client is not recorded as the session's current client.
+	ReadOnly bool
+	// DropOutput, when positive, is how many bytes of output may wait for
+	// a Stdout too slow to keep up, such as a terminal on a serial console
+	// or a poor link. Past it the output in between is skipped, leaving
+	// the latest, a "[sess: skipped N KB]" line marks the gap and the
+	// session is asked to repaint, so what is shown stays current and
+	// typing stays responsive. Tee still receives everything.
+	DropOutput int
+	// Predict shows what is typed at once, underlined, before the session
+	// echoes it, as mosh does, for links where each keystroke takes long
+	// to come back. The echo replaces the prediction; output other than
+	// the echo expected, keys other than printable ones and backspace,
+	// and the alternate screen take predictions back, and after that
+	// nothing is shown until an echo arrives again, so password prompts
+	// stay blank. PredictAfter instead predicts only once echoes take at
+	// least that long, as measured while typing. Either applies only
+	// when Stdin is a terminal, and not with ReadOnly or DropOutput.
+	Predict      bool
+	PredictAfter time.Duration
+	// Exec is typed into the session right after attaching, e.g. the
+	// output of TranslateKeys. Ignored for read-only attaches.
+	Exec []byte
+	// Direct has the daemon lend the session's terminal to the attach,
+	// which then reads and writes it without the daemon relaying each
+	// byte, as dtach does. The daemon keeps relaying when it needs the
+	// output itself: when the session is logged or recorded, spills or
+	// keeps its scrollback, is shared or has other clients. Output shown
+	// directly does not reach the session's scrollback, and while the
+	// terminal is lent nobody can peek at the session and it cannot be
+	// upgraded. Ignored for read-only attaches.
+	Direct bool
+}
+
+// NewManager returns a Manager for the current user's sess directory,
+// creating the directory if needed.
+func NewManager() (*Manager, error) {
+	m, err := session.NewManager()
+	if err != nil {
+		return nil, err
+	}
+	return &Manager{m: m}, nil
+}
+
+// NormalizeNumber converts a user-supplied session number such as "1" into
+// its canonical form "001".
+func (m *Manager) NormalizeNumber(number string) string {
+	return m.m.NormalizeSessionNumber(number)
+}
+
+// LiveNumbers returns the numbers of live sessions, in order, without a
+// Manager: it takes no lock and changes nothing on disk.
+func LiveNumbers() ([]string, error) {
+	return session.LiveNumbers()
+}
+
+// List returns all live sessions ordered by number.
+func (m *Manager) List() ([]Session, error) {
+	return m.m.ListSessions()
+}
+
+// ListAll returns live sessions along with exited and stale ones, which
+// List leaves out. It removes nothing.
+func (m *Manager) ListAll() ([]Record, error) {
+	return m.m.ListAllSessions()
+}
+
+// Record returns the live session with the given number, or what is left
+// of it if it has ended.
+func (m *Manager) Record(number string) (*Record, error) {
+	return m.m.SessionRecord(m.NormalizeNumber(number))
+}
+
+// Clean removes the traces of exited and stale sessions and returns them.
+// Stale sessions whose shell still runs without a daemon are returned in
+// kept instead.
+func (m *Manager) Clean() (removed, kept []Record, err error) {
+	return m.m.Clean()
+}
+
+// PruneLogs removes the output logs of ended sessions that keep no longer
+// allows and returns their paths.
+func (m *Manager) PruneLogs(keep LogRetention) ([]string, error) {
+	return m.m.PruneLogs(keep)
+}
+
+// LogUsage returns the bytes used by session logs, running and preserved.
+func (m *Manager) LogUsage() (int64, error) {
+	return m.m.LogUsage()
+}
+
+// Get returns the live session with the given number.
+func (m *Manager) Get(number string) (*Session, error) {
+	return m.m.GetSession(m.NormalizeNumber(number))
+}
+
+// SocketPath returns the path of the unix socket a session's daemon
+// listens on.
+func (m *Manager) SocketPath(number string) string {
+	return m.m.GetSocketPath(m.NormalizeNumber(number))
+}
+
+// Dir returns the directory sess keeps its sockets and state in.
+func (m *Manager) Dir() string {
+	return m.m.Dir()
+}
+
+// Cwd returns the current working directory of the session's shell: the
+// one it last announced by OSC 7, which shells set up for it send at each
+// prompt, otherwise the shell process's own where the platform can tell.
+func (m *Manager) Cwd(number string) (string, error) {
+	number = m.NormalizeNumber(number)
+	if st, err := m.Status(number); err == nil && st.Cwd != "" {
+		return st.Cwd, nil
+	}
+	return m.m.SessionCwd(number)
+}
+
+// Env returns the environment of the session's shell as KEY=VALUE entries.
+func (m *Manager) Env(number string) ([]string, error) {
+	return m.m.SessionEnv(m.NormalizeNumber(number))
+}
+
+// Status queries the session's daemon for its live state, including the
+// clients connected to it.
+func (m *Manager) Status(number string) (*Status, error) {
+	number = m.NormalizeNumber(number)
+	if _, err := m.m.GetSession(number); err != nil {
+		return nil, err
+	}
+	st, err := client.QueryStatus(m.m.GetSocketPath(number), statusTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("%w: session %s: %v", ErrConnectionFailed, number, err)
+	}
+	return st, nil
+}
+
+// Debug has the session's daemon write a dump of its state to its log,
+// as SIGUSR2 does, and returns the dump: its command, terminal, scrollback
+// and clients, the control messages it handled last and the stacks of its
+// goroutines. A daemon too wedged to answer the request is sent SIGUSR2,
+// which it handles on a goroutine of its own.
+func (m *Manager) Debug(number string) (string, error) {
+	number = m.NormalizeNumber(number)
+	s, err := m.m.GetSession(number)
+	if err != nil {
+		return "", err
+	}
+	logPath := session.DaemonLogPath(m.m.GetMetaPath(number))
+	var from int64
+	if info, err := os.Stat(logPath); err == nil {
+		from = info.Size()
+	}
+	if err := client.RequestDump(m.m.GetSocketPath(number), statusTimeout); err != nil {
+		// Only a daemon that took the connection and then said nothing
+		// is signalled: one that answered, if with an error, predates
+		// dumps and would die of SIGUSR2.
+		if !errors.Is(err, os.ErrDeadlineExceeded) || s.DaemonPID <= 0 {
+			return "", fmt.Errorf("%w: session %s: %v", ErrConnectionFailed, number, err)
+		}
+		if err := syscall.Kill(s.DaemonPID, syscall.SIGUSR2); err != nil {
+			return "", fmt.Errorf("%w: session %s: %v", ErrConnectionFailed, number, err)
+		}
+	}
+	deadline := time.Now().Add(debugTimeout)
+	for {
+		if dump, ok := lastDump(logPath, from); ok {
+			return dump, nil
+		}
+		if time.Now().After(deadline) {
+			return "", fmt.Errorf("%w: session %s wrote no dump to %s", ErrTimeout, number, logPath)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// lastDump returns the last complete dump written to the daemon log at
+// path past offset from.
+func lastDump(path string, from int64) (string, bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", false
+	}
+	defer f.Close()
+	data, err := io.ReadAll(io.NewSectionReader(f, from, 1<<62))
+	if err != nil {
+		return "", false
+	}
+	start := bytes.LastIndex(data, []byte(daemon.DumpHeader))
+	if start < 0 {
+		return "", false
+	}
+	end := bytes.Index(data[start:], []byte(daemon.DumpEnd+"\n"))
+	if end < 0 {
+		return "", false
+	}
+	return string(data[start : start+end+len(daemon.DumpEnd)+1]), true
+}
+
+// Orphan is a daemon running a session that sess can no longer reach,
+// because its metadata or socket is gone or another session's.
+type Orphan = session.Orphan
+
+// Orphans finds the daemons of sessions sess can no longer reach, as
+// after the state directory was removed from under them, by scanning the
+// running processes. Daemons put their state back themselves where they
+// can watch the directory; elsewhere, or with state-lost = exit set
+// after the fact, Reregister or KillOrphan deals with them. It returns
+// ErrUnsupported where processes' arguments cannot be read.
+func (m *Manager) Orphans() ([]Orphan, error) {
+	return m.m.FindOrphans()
+}
+
+// Reregister has an orphaned daemon put its socket and metadata back, so
+// the session can be listed and attached to again.
+func (m *Manager) Reregister(o Orphan) error {
+	return m.m.Reregister(o, reregisterTimeout)
+}
+
+// KillOrphan ends an orphaned daemon and the session it runs.
+func (m *Manager) KillOrphan(o Orphan) error {
+	cfg, err := config.Load()
+	if err != nil {
+		cfg = config.Default()
+	}
+	return m.m.KillOrphan(o, cfg.KillSequence().OrDefault().Grace)
+}
+
+// Send types data into a session as if entered at its terminal, without
+// attaching. Use TranslateKeys to build data from key names.
+func (m *Manager) Send(number string, data []byte) error {
+	number = m.NormalizeNumber(number)
+	if _, err := m.m.GetSession(number); err != nil {
+		return err
+	}
+	if err := client.SendInput(m.m.GetSocketPath(number), data, inputTimeout); err != nil {
+		return fmt.Errorf("%w: session %s: %v", ErrConnectionFailed, number, err)
+	}
+	return nil
+}
+
+// Signal delivers sig to the session's foreground job, as pressing the
+// matching key while attached would, or to its shell when shell is set.
+func (m *Manager) Signal(number string, sig syscall.Signal, shell bool) error {
+	number = m.NormalizeNumber(number)
+	if _, err := m.m.GetSession(number); err != nil {
+		return err
+	}
+	if err := client.SendSignal(m.m.GetSocketPath(number), sig, shell, inputTimeout); err != nil {
+		return fmt.Errorf("session %s: %w", number, err)
+	}
+	return nil
+}
+
+// Upgrade hands a session over to the sess binary this program is: its
+// daemon re-executes that binary in place, and the session's command,
+// terminal, scrollback, logs and connected clients carry on under the new
+// code. Attached clients see output pause for a moment. If the new binary
+// cannot take the session over, it stays with the old one and the error
+// says why.
+func (m *Manager) Upgrade(number string) error {
+	number = m.NormalizeNumber(number)
+	if _, err := m.m.GetSession(number); err != nil {
+		return err
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if err := client.Upgrade(m.m.GetSocketPath(number), exe, upgradeTimeout); err != nil {
+		return fmt.Errorf("session %s: %w", number, err)
+	}
+	return nil
+}
+
+// ScrollbackOptions selects the output Scrollback returns: the last Lines
+// lines, else the last Bytes bytes, else everything held in memory. All
+// adds the history spilled to disk (see the scrollback-spill setting).
+type ScrollbackOptions struct {
+	Bytes int
+	Lines int
+	All   bool
+}
+
+// Scrollback writes a session's recent output to w and returns how many
+// bytes it wrote. A session that ended with the scrollback-keep setting on
+// left its scrollback on disk, spilled history included; it is read from
+// there, and All makes no difference.
+func (m *Manager) Scrollback(number string, opts ScrollbackOptions, w io.Writer) (int64, error) {
+	number = m.NormalizeNumber(number)
+	if _, err := m.m.GetSession(number); err != nil {
+		if r, rerr := m.m.SessionRecord(number); rerr == nil && r.State == StateExited {
+			n, kerr := session.CopyTail(w, session.ScrollbackPath(m.m.GetMetaPath(number)), opts.Bytes, opts.Lines)
+			if !errors.Is(kerr, os.ErrNotExist) {
+				return n, kerr
+			}
+		}
+		return 0, err
+	}
+	req := protocol.ScrollbackPayload{Bytes: opts.Bytes, Lines: opts.Lines, All: opts.All}
+	n, err := client.FetchScrollback(m.m.GetSocketPath(number), req, w, statusTimeout)
+	if err != nil {
+		return n, fmt.Errorf("session %s: %w", number, err)
+	}
+	return n, nil
+}
+
+// OutputLines returns the last n lines of a session's output as plain text,
+// with escape sequences and other control characters taken out, as Watch
+// matches them. The line the output has got to counts, so a prompt is
+// shown. What full-screen programs draw by moving the cursor about reads
+// only roughly this way.
+func (m *Manager) OutputLines(number string, n int) ([]string, error) {
+	var out bytes.Buffer
+	if _, err := m.Scrollback(number, ScrollbackOptions{Lines: n}, &out); err != nil {
+		return nil, err
+	}
+	var lines []string
+	var scanner linescan.Scanner
+	scanner.Write(out.Bytes(), func(line []byte) { lines = append(lines, string(line)) })
+	if pending := scanner.Pending(); len(pending) > 0 {
+		lines = append(lines, string(pending))
+	}
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return lines, nil
+}
+
+// SetEnv pushes variables into a session: set are exported and unset
+// removed. They are recorded in the session's env file, which shells in the
+// session can source (its path is in $SESS_ENV), and applied to the
+// daemon's own environment for anything it starts later.
+func (m *Manager) SetEnv(number string, set map[string]string, unset []string) error {
+	number = m.NormalizeNumber(number)
+	if err := m.m.SetEnv(number, set, unset); err != nil {
+		return err
+	}
+	if err := client.SendEnv(m.m.GetSocketPath(number), set, unset, inputTimeout); err != nil {
+		return fmt.Errorf("%w: session %s: %v", ErrConnectionFailed, number, err)
+	}
+	return nil
+}
+
+// ShareOptions configures Share.
+type ShareOptions struct {
+	// ReadOnly only lets the user attach read-only.
+	ReadOnly bool
+	// Socket is where shared users connect. It is used when the session is
+	// first shared; when empty, a socket under the temporary directory is
+	// used.
+	Socket string
+}
+
+// Share lets another user attach to a session, through a second socket
+// the daemon listens on while the session is shared. The daemon checks
+// every peer's credentials: only the owner, root and the users the session
+// is shared with get in, and shared users may only attach. It returns who
+// the session is shared with now.
+func (m *Manager) Share(number, username string, opts ShareOptions) (*ShareStatus, error) {
+	number = m.NormalizeNumber(number)
+	if _, err := m.m.GetSession(number); err != nil {
+		return nil, err
+	}
+	u, err := lookupUser(username)
+	if err != nil {
+		return nil, err
+	}
+	switch u.UID {
+	case os.Getuid():
+		return nil, fmt.Errorf("session %s is already yours", number)
+	case 0:
+		return nil, fmt.Errorf("root can attach to session %s without sharing", number)
+	}
+	u.ReadOnly = opts.ReadOnly
+	req := protocol.SharePayload{Grant: []SharedUser{u}, Socket: opts.Socket}
+	st, err := client.Share(m.m.GetSocketPath(number), req, statusTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("session %s: %w", number, err)
+	}
+	return st, nil
+}
+
+// Unshare revokes username's access to a session, or everyone's when
+// username is empty, disconnecting their clients. It returns who the
+// session is still shared with.
+func (m *Manager) Unshare(number, username string) (*ShareStatus, error) {
+	number = m.NormalizeNumber(number)
+	if _, err := m.m.GetSession(number); err != nil {
+		return nil, err
+	}
+	req := protocol.SharePayload{RevokeAll: username == ""}
+	if username != "" {
+		u, err := lookupUser(username)
+		if err != nil {
+			return nil, err
+		}
+		req.Revoke = []int{u.UID}
+	}
+	st, err := client.Share(m.m.GetSocketPath(number), req, statusTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("session %s: %w", number, err)
+	}
+	return st, nil
+}
+
+// lookupUser resolves a login name, or a numeric UID, to a SharedUser.
+func lookupUser(name string) (SharedUser, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		if u, err = user.LookupId(name); err != nil {
+			return SharedUser{}, fmt.Errorf("unknown user %s", name)
+		}
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return SharedUser{}, fmt.Errorf("user %s has no numeric UID", name)
+	}
+	return SharedUser{UID: uid, Name: u.Username}, nil
+}
+
+// ParseSignal parses a signal given by name ("INT", "SIGINT", "int") or
+// number ("2").
+func ParseSignal(s string) (syscall.Signal, error) {
+	if n, err := strconv.Atoi(s); err == nil {
+		if n <= 0 || unix.SignalName(syscall.Signal(n)) == "" {
+			return 0, fmt.Errorf("unknown signal %s", s)
+		}
+		return syscall.Signal(n), nil
+	}
+	name := strings.ToUpper(s)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	if sig := unix.SignalNum(name); sig != 0 {
+		return sig, nil
+	}
+	return 0, fmt.Errorf("unknown signal %s", s)
+}
+
+// TranslateKeys turns send-keys style arguments into the bytes Send types.
+// Arguments naming a key ("Enter", "Tab", "Escape", "Up", "C-c", "M-x")
+// become that key; others are text in which \n, \r, \t, \e, \xHH and
+// \\ are expanded.
+func TranslateKeys(args []string) ([]byte, error) {
+	return client.TranslateKeys(args)
+}
+
+// Resources measures the CPU and memory use of each session's process tree
+// (the shell and its descendants), keyed by session number. It takes a
+// short sampling interval to measure CPU and returns ErrUnsupported on
+// platforms without /proc.
+func (m *Manager) Resources(sessions []Session) (map[string]Resources, error) {
+	return m.m.SessionResources(sessions, resourceInterval)
+}
+
+// SetNote attaches a free-form note to a session; an empty note clears it.
+func (m *Manager) SetNote(number, note string) error {
+	return m.m.SetNote(m.NormalizeNumber(number), note)
+}
+
+// Lock makes the session refuse attaches, read-only ones included, until
+// Unlock; AttachOptions.Force overrides it for the owner. The daemon
+// enforces it, so dialling the socket directly does not get round it.
+// Killing and other requests are unaffected.
+func (m *Manager) Lock(number string) error {
+	return m.m.SetLocked(m.NormalizeNumber(number), true)
+}
+
+// Unlock releases a lock taken with Lock.
+func (m *Manager) Unlock(number string) error {
+	return m.m.SetLocked(m.NormalizeNumber(number), false)
+}
+
+// SetDetachKey stores a session's preferred detach key (as accepted by
+// AttachOptions.DetachKey), used by attaches that don't name one. An empty
+// key removes the preference. A change applies from the next attach.
+func (m *Manager) SetDetachKey(number, key string) error {
+	if key != "" {
+		if _, err := client.ParseKeys(key); err != nil {
+			return err
+		}
+	}
+	return m.m.SetDetachKey(m.NormalizeNumber(number), key)
+}
+
+// SetTimeout has a session expire d from now, as CreateOptions.Timeout
+// does, or with extend, d later than it would have (from now if it had no
+// timeout; a negative d brings it forward). A zero d without extend takes
+// the timeout away. It returns when the session now expires, nil for
+// never.
+func (m *Manager) SetTimeout(number string, d time.Duration, extend bool) (*time.Time, error) {
+	number = m.NormalizeNumber(number)
+	if _, err := m.m.GetSession(number); err != nil {
+		return nil, err
+	}
+	at, err := client.SetTimeout(m.m.GetSocketPath(number), protocol.TimeoutPayload{Timeout: d, Extend: extend}, inputTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("%w: session %s: %v", ErrConnectionFailed, number, err)
+	}
+	return at, nil
+}
+
+// InSession reports the session the calling process runs inside, if any.
+// The SESS_NUM environment variable is only trusted when that session's
+// daemon still answers; see StaleSession.
+func (m *Manager) InSession() (string, bool) {
+	m.checkEnvSession()
+	return m.envNumber, m.envLive
+}
+
+// StaleSession reports a session named by the environment that no longer
+// answers, as happens in shells that outlived their session or carried
+// SESS_NUM across su or sudo. Such a session is ignored by InSession.
+func (m *Manager) StaleSession() (string, bool) {
+	m.checkEnvSession()
+	return m.envNumber, m.envNumber != "" && !m.envLive
+}
+
+func (m *Manager) checkEnvSession() {
+	m.envOnce.Do(func() {
+		number, socketPath, ok := m.m.EnvSession()
+		if !ok {
+			return
+		}
+		m.envNumber = number
+		st, err := client.QueryStatus(socketPath, statusTimeout)
+		m.envLive = err == nil && st.Session == m.NormalizeNumber(number)
+	})
+}
+
+// Multiplexer is a terminal multiplexer, tmux or screen, that sess runs
+// inside.
+type Multiplexer = session.Multiplexer
+
+// OuterMultiplexer reports the tmux or screen session the calling process
+// runs inside, if any. As with InSession, the environment is only trusted
+// while the multiplexer it names is still running.
+func OuterMultiplexer() (Multiplexer, bool) {
+	return session.EnvMultiplexer()
+}
+
+// Current returns the number of the session a client is currently attached
+// to, or "" when there is none.
+func (m *Manager) Current() (string, error) {
+	return m.m.GetCurrentSession()
+}
+
+// Create starts a detached session and returns its number once the daemon
+// is accepting connections.
+func (m *Manager) Create(opts CreateOptions) (string, error) {
+	termios, err := daemon.ParseTermios(opts.Termios)
+	if err != nil {
+		return "", err
+	}
+	rlimits, err := daemon.ParseRlimits(opts.Rlimits...)
+	if err != nil {
+		return "", err
+	}
+	if opts.RecordTiming != "" && opts.RecordScript == "" {
+		return "", fmt.Errorf("a timing file needs a typescript to record to")
+	}
+	switch opts.Respawn {
+	case "", RespawnAlways, RespawnOnFailure:
+	default:
+		return "", fmt.Errorf("unknown respawn policy %q (want %s or %s)", opts.Respawn, RespawnAlways, RespawnOnFailure)
+	}
+	env, envMode, err := opts.environment()
+	if err != nil {
+		return "", err
+	}
+	// The daemon does not share the caller's working directory.
+	script, err := absPath(opts.RecordScript)
+	if err != nil {
+		return "", err
+	}
+	timing, err := absPath(opts.RecordTiming)
+	if err != nil {
+		return "", err
+	}
+
+	number := opts.Number
+	if number != "" {
+		if n, err := strconv.Atoi(number); err != nil || n < 1 {
+			return "", fmt.Errorf("invalid session number %q", number)
+		}
+		number = m.NormalizeNumber(number)
+	}
+	// Hold the number until the daemon serves it, so a concurrent Create
+	// for the same number fails instead of starting a second daemon.
+	number, err = m.m.ReserveSession(number)
+	if err != nil {
+		return "", err
+	}
+	defer m.m.ReleaseReservation(number)
+
+	argv := opts.Command
+	if len(argv) == 0 {
+		argv = []string{defaultShell(opts.Shell)}
+	}
+
+	exe := opts.Executable
+	if exe == "" {
+		path, err := os.Executable()
+		if err != nil {
+			return "", fmt.Errorf("failed to locate executable: %w", err)
+		}
+		exe = path
+	}
+
+	socketPath := m.m.GetSocketPath(number)
+	spec := daemonSpec{
+		version:    Version,
+		number:     number,
+		socketPath: socketPath,
+		metaPath:   m.m.GetMetaPath(number),
+		rows:       opts.Rows,
+		cols:       opts.Cols,
+		xpixel:     opts.XPixel,
+		ypixel:     opts.YPixel,
+		transient:  opts.Transient,
+		throttle:   opts.ThrottleDetached,
+		timeout:    opts.Timeout,
+		log:        opts.Log,
+		logInput:   opts.LogInput,
+		script:     script,
+		timing:     timing,
+		termios:    termios.String(),
+		rlimits:    rlimits.String(),
+		noOOM:      opts.NoOOMProtect,
+		respawn:    opts.Respawn,
+		definition: opts.Definition,
+		envMode:    envMode,
+		argv:       argv,
+	}
+
+	// The environment to start the command with goes on descriptor 3.
+	var extra []*os.File
+	if env != nil {
+		f, err := writeEnv(env)
+		if err != nil {
+			return "", fmt.Errorf("failed to pass the environment on: %w", err)
+		}
+		defer f.Close()
+		extra = append(extra, f)
+		spec.envFD = 3
+	}
+
+	// Fork daemon process (pass initial rows/cols)
+	cmd := exec.Command(exe, spec.args()...)
+	cmd.Dir = opts.Dir
+	cmd.ExtraFiles = extra
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setsid: true,
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		return "", fmt.Errorf("failed to fork daemon: %w", err)
+	}
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+
+	// Wait for the daemon to be ready. The session is ours only once the
+	// socket answers with our daemon's PID; a socket alone may belong to
+	// another daemon.
+	for i := 0; i < daemonStartAttempts; i++ {
+		select {
+		case <-exited:
+			if msg := strings.TrimSpace(stderr.String()); msg != "" {
+				return "", fmt.Errorf("daemon for session %s failed: %s", number, lastLine(msg))
+			}
+			return "", fmt.Errorf("daemon for session %s exited during startup", number)
+		default:
+		}
+		if st, err := client.QueryStatus(socketPath, statusTimeout); err == nil && st.PID == cmd.Process.Pid {
+			if !opts.Transient {
+				m.writeRestoreSpec(number, opts, argv, envMode)
+			}
+			return number, nil
+		}
+		time.Sleep(daemonStartInterval)
+	}
+	return "", fmt.Errorf("%w: daemon for session %s did not start", ErrTimeout, number)
+}
+
+// cleanEnvVars are the variables CreateOptions.CleanEnv keeps.
+var cleanEnvVars = []string{"PATH", "HOME", "TERM"}
+
+// environment returns the environment opts start the session's command
+// with and how the metadata describes it, or nil to inherit the daemon's.
+func (opts CreateOptions) environment() (env []string, mode string, err error) {
+	copyEnv := opts.CopyEnv || len(opts.CopyEnvOnly) > 0
+	switch {
+	case opts.CleanEnv && copyEnv:
+		return nil, "", fmt.Errorf("a clean environment cannot also be copied")
+	case opts.CleanEnv:
+		env, mode = pickEnv(cleanEnvVars), "clean"
+	case len(opts.CopyEnvOnly) > 0:
+		for _, name := range opts.CopyEnvOnly {
+			if name == "" || strings.ContainsAny(name, "=\x00") {
+				return nil, "", fmt.Errorf("invalid variable name %q", name)
+			}
+		}
+		env, mode = pickEnv(opts.CopyEnvOnly), "copy:"+strings.Join(opts.CopyEnvOnly, ",")
+	case copyEnv:
+		env, mode = os.Environ(), "copy"
+	}
+	if len(opts.Env) == 0 {
+		return env, mode, nil
+	}
+	for _, kv := range opts.Env {
+		if name, _, ok := strings.Cut(kv, "="); !ok || name == "" || strings.ContainsRune(kv, 0) {
+			return nil, "", fmt.Errorf("invalid variable %q: want KEY=VALUE", kv)
+		}
+	}
+	if env == nil {
+		// What the daemon would have inherited.
+		env = os.Environ()
+	}
+	return append(env, opts.Env...), mode, nil
+}
+
+// pickEnv returns the variables named that are set, as KEY=VALUE entries.
+// It is never nil.
+func pickEnv(names []string) []string {
+	env := []string{}
+	for _, name := range names {
+		if value, ok := os.LookupEnv(name); ok {
+			env = append(env, name+"="+value)
+		}
+	}
+	return env
+}
+
+// defaultShell returns shell, else $SHELL, else /bin/sh.
+func defaultShell(shell string) string {
+	if shell == "" {
+		shell = os.Getenv("SHELL")
+	}
+	if shell == "" {
+		shell = "/bin/sh"
+	}
+	return shell
+}
+
+// absPath returns path made absolute, or "" if it is empty.
+func absPath(path string) (string, error) {
+	if path == "" {
+		return "", nil
+	}
+	return filepath.Abs(path)
+}
+
+// lastLine returns the final line of s.
+func lastLine(s string) string {
+	if i := strings.LastIndexByte(s, '\n'); i >= 0 {
+		return s[i+1:]
+	}
+	return s
+}
+
+// Attach connects to a session and relays data between it and the given
+// streams. It blocks until the session ends, the client detaches, or ctx is
+// cancelled. A session whose command fails while attached returns an
+// *ExitError; a connection that breaks returns an error wrapping
+// ErrConnectionLost. A session whose daemon was killed outright, leaving
+// its socket refusing connections, returns an error wrapping
+// ErrSessionStale, and is turned into a tombstone unless its command
+// outlived the daemon.
+func (m *Manager) Attach(ctx context.Context, number string, opts AttachOptions) error {
+	number = m.NormalizeNumber(number)
+
+	if cur, ok := m.InSession(); ok && cur == number {
+		return fmt.Errorf("%w: %s", ErrAlreadyAttached, number)
+	}
+
+	s, err := m.m.GetSession(number)
+	if errors.Is(err, ErrSessionDead) {
+		if serr := m.m.ReapStale(number); serr != nil {
+			return serr
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	detachKey := opts.DetachKey
+	if detachKey == "" {
+		detachKey = s.DetachKey
+	}
+	keys, nested, err := m.detachKeys(detachKey)
+	if err != nil {
+		return err
+	}
+
+	// Refused before touching the current-session marker; the daemon
+	// checks again, as the lock may be taken meanwhile.
+	if s.Locked && !opts.Force {
+		return utils.LockedError(s.Number)
+	}
+
+	// A nested client leaves the current-session marker to the outer one,
+	// which is what sess -x should keep detaching.
+	track := !opts.ReadOnly && !opts.Raw && !nested
+	if track {
+		if err := m.m.SetCurrentSession(number); err != nil {
+			return fmt.Errorf("failed to set current session: %w", err)
+		}
+		defer m.m.ClearCurrentSession()
+	}
+
+	copts := clientOptions(opts, keys)
+	copts.PID = s.PID
+	copts.DaemonVersion = s.Version
+	copts.OnAttach = func(number string) {
+		if !track {
+			return
+		}
+		_ = m.m.SetCurrentSession(number)
+		_ = m.m.RecordAttach(number)
+	}
+	copts.Previous = m.switchTarget
+	err = client.New(s.Number, m.m.GetSocketPath(number), copts).Attach(ctx)
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		// A daemon killed outright leaves its socket behind.
+		if serr := m.m.ReapStale(number); serr != nil {
+			return serr
+		}
+	}
+	return err
+}
+
+// AttachShared attaches to a session another user shared with this one
+// (see Share), through the socket path they were given. It blocks like
+// Attach. The session is not this user's, so it is neither recorded as the
+// current session nor offered for switching.
+func (m *Manager) AttachShared(ctx context.Context, socketPath string, opts AttachOptions) error {
+	keys, _, err := m.detachKeys(opts.DetachKey)
+	if err != nil {
+		return err
+	}
+	return client.New("", socketPath, clientOptions(opts, keys)).Attach(ctx)
+}
+
+// detachKeys parses the detach key an attach uses: detachKey, or C-] when
+// attaching from inside another session so Ctrl-X still reaches the outer
+// one. It also reports whether the attach is nested.
+func (m *Manager) detachKeys(detachKey string) (keys client.Keys, nested bool, err error) {
+	_, nested = m.InSession()
+	if detachKey == "" && nested {
+		detachKey = nestedDetachKey
+	}
+	if detachKey != "" {
+		if keys, err = client.ParseKeys(detachKey); err != nil {
+			return keys, nested, err
+		}
+	}
+	return keys, nested, nil
+}
+
+// SwitchKeys describes the keys that switch the client attached to session
+// number to the previous session. The client's own --detach-key is not
+// recorded anywhere, so the session's stored detach key is assumed, else
+// the default for how the client is attached: a client not recorded as the
+// current one is taken to be nested.
+func (m *Manager) SwitchKeys(number string) string {
+	keys := client.DefaultKeys
+	detachKey := ""
+	if s, err := m.m.GetSession(number); err == nil {
+		detachKey = s.DetachKey
+	}
+	if info, err := m.m.GetCurrentSessionInfo(); detachKey == "" && (err != nil || info == nil || info.Number != number) {
+		detachKey = nestedDetachKey
+	}
+	if detachKey != "" {
+		if k, err := client.ParseKeys(detachKey); err == nil {
+			keys = k
+		}
+	}
+	return keys.SwitchKeys()
+}
+
+// clientOptions carries opts over to the attach client.
+func clientOptions(opts AttachOptions, keys client.Keys) client.Options {
+	return client.Options{
+		Stdin:         opts.Stdin,
+		Stdout:        opts.Stdout,
+		Size:          opts.Size,
+		Resize:        opts.Resize,
+		DisableCtrlX:  opts.DisableCtrlX,
+		Keys:          keys,
+		KeyTimeout:    opts.KeyTimeout,
+		Quiet:         opts.Quiet,
+		NoResize:      opts.NoResize,
+		NoRedraw:      opts.NoRedraw,
+		RedrawCtrlL:   opts.RedrawCtrlL,
+		DetachOnEOF:   opts.DetachOnEOF,
+		Cooked:        opts.Cooked,
+		Interrupt:     opts.Interrupt,
+		NoInput:       opts.NoInput,
+		Duration:      opts.Duration,
+		Force:         opts.Force,
+		Tee:           opts.Tee,
+		TeeTimestamps: opts.TeeTimestamps,
+		NoScreenReset: opts.NoScreenReset,
+		NoAltScreen:   opts.NoAltScreen,
+		Raw:           opts.Raw,
+		ReadOnly:      opts.ReadOnly,
+		DropOutput:    opts.DropOutput,
+		Predict:       opts.Predict,
+		PredictAfter:  opts.PredictAfter,
+		Exec:          opts.Exec,
+		Direct:        opts.Direct,
+		Version:       Version,
+	}
+}
+
+// Previous returns the session attached to before the most recently used
+// one, like cd -. Sessions that have since ended are skipped.
+func (m *Manager) Previous() (string, error) {
+	history, err := m.m.History()
+	if err != nil {
+		return "", err
+	}
+	if len(history) < 2 {
+		return "", fmt.Errorf("%w: no previous session", ErrSessionNotFound)
+	}
+	return history[1].Number, nil
+}
+
+// switchTarget picks the session Ctrl-X Ctrl-X moves to from current: the
+// most recently used other running session, never the one this process runs
+// inside, and the PID its metadata records.
+func (m *Manager) switchTarget(current string) (string, string, int, error) {
+	history, err := m.m.History()
+	if err != nil {
+		return "", "", 0, err
+	}
+	inside, _ := m.InSession()
+	for _, e := range history {
+		if e.Number == current || e.Number == inside {
+			continue
+		}
+		s, err := m.m.GetSession(e.Number)
+		if err != nil {
+			continue
+		}
+		return s.Number, m.m.GetSocketPath(s.Number), s.PID, nil
+	}
+	return "", "", 0, fmt.Errorf("no previous session")
+}
+
+// DetachCurrent detaches whichever client is currently attached, wherever
+// it runs, by signalling the client process recorded for the session.
+func (m *Manager) DetachCurrent() error {
+	info, err := m.m.GetCurrentSessionInfo()
+	if err != nil || info == nil || info.Number == "" || info.PID == 0 {
+		return ErrNotAttached
+	}
+	if err := syscall.Kill(info.PID, syscall.SIGUSR1); err != nil {
+		if err == syscall.ESRCH {
+			// Stale marker; clear and report
+			_ = m.m.ClearCurrentSession()
+			return ErrNotAttached
+		}
+		return fmt.Errorf("failed to detach: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package sess_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/theMichaelB/sess/pkg/sess"
+)
+
+// longDir returns a new directory whose path is too long for the sockets
+// of a state directory under it.
+func longDir(t *testing.T) string {
+	dir := filepath.Join(t.TempDir(), strings.Repeat("d", 60), strings.Repeat("e", 60))
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// Under a home directory too deep for a unix socket path, sockets are kept
+// in a directory of their own and sessions work as usual.
+func TestLongHomeDir(t *testing.T) {
+	t.Setenv("HOME", longDir(t))
+	t.Setenv("TMPDIR", t.TempDir())
+	m := newManager(t)
+	num, err := m.Create(sess.CreateOptions{Command: []string{"sleep", "60"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Kill(num)
+
+	socket := m.SocketPath(num)
+	if !strings.HasPrefix(socket, os.Getenv("TMPDIR")) {
+		t.Errorf("socket path %s is not under TMPDIR", socket)
+	}
+	s, err := m.Get(num)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Socket != socket {
+		t.Errorf("the metadata records the socket as %q; want %q", s.Socket, socket)
+	}
+	if _, err := m.Status(num); err != nil {
+		t.Errorf("the daemon does not answer: %v", err)
+	}
+	// The metadata is believed over where the sockets would go now.
+	t.Setenv("TMPDIR", t.TempDir())
+	if got := newManager(t).SocketPath(num); got != socket {
+		t.Errorf("with another TMPDIR the socket path is %s; want %s", got, socket)
+	}
+
+	if err := m.Kill(num); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(socket); !os.IsNotExist(err) {
+		t.Errorf("the socket was left behind: %v", err)
+	}
+}
+
+// Where no directory could hold the sockets, the error says why.
+func TestLongHomeAndTempDir(t *testing.T) {
+	t.Setenv("HOME", longDir(t))
+	t.Setenv("TMPDIR", longDir(t))
+	_, err := sess.NewManager()
+	if err == nil || !strings.Contains(err.Error(), "bytes a unix socket path may have") {
+		t.Errorf("NewManager = %v; want an error naming the limit", err)
+	}
+}
@@ -0,0 +1,103 @@
+package sess_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/theMichaelB/sess/pkg/sess"
+)
+
+// killDaemon kills session number's daemon outright, leaving its socket
+// behind, and returns the session as its metadata was.
+func killDaemon(t *testing.T, m *sess.Manager, number string) sess.Session {
+	t.Helper()
+	s, err := m.Get(number)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Kill(s.DaemonPID, syscall.SIGKILL); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the daemon to die", func() bool {
+		return syscall.Kill(s.DaemonPID, 0) != nil
+	})
+	return *s
+}
+
+func attachOnce(m *sess.Manager, number string) error {
+	return m.Attach(context.Background(), number, sess.AttachOptions{Stdin: strings.NewReader(""), Stdout: io.Discard, NoInput: true})
+}
+
+// sess -a on a session whose daemon was killed -9 reports it stale; sess -A
+// then creates a fresh session under the number.
+func TestAttachAfterDaemonKilled(t *testing.T) {
+	m := newManager(t)
+	num, err := m.Create(sess.CreateOptions{Command: []string{"sh", "-c", `trap "" HUP; exec sleep 60`}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Kill(num)
+	killDaemon(t, m, num)
+
+	// The command ignores the hangup, so it is left running, and alone.
+	err = attachOnce(m, num)
+	if !errors.Is(err, sess.ErrSessionStale) || !strings.Contains(err.Error(), "runs on without a terminal") {
+		t.Fatalf("attach = %v; want ErrSessionStale", err)
+	}
+	if _, err := m.Get(num); err != nil {
+		t.Errorf("the session with its command running was cleared away: %v", err)
+	}
+
+	// As sess -A does then.
+	if err := m.Kill(num); err != nil {
+		t.Fatal(err)
+	}
+	again, err := m.Create(sess.CreateOptions{Number: num, Command: []string{"sleep", "60"}})
+	if err != nil {
+		t.Fatalf("creating the session afresh: %v", err)
+	}
+	if again != num {
+		t.Errorf("created %s; want %s", again, num)
+	}
+	if _, err := m.Status(num); err != nil {
+		t.Errorf("the new session's daemon does not answer: %v", err)
+	}
+}
+
+// A session whose daemon was killed -9 along with its command is turned
+// into a tombstone, as sweeping would, and its number can be taken again.
+func TestAttachBuriesStaleSession(t *testing.T) {
+	m := newManager(t)
+	num, err := m.Create(sess.CreateOptions{Command: []string{"sleep", "60"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Kill(num)
+	s := killDaemon(t, m, num)
+	syscall.Kill(s.PID, syscall.SIGKILL)
+	waitFor(t, "the command to die", func() bool {
+		_, err := m.Get(num)
+		return err != nil
+	})
+
+	err = attachOnce(m, num)
+	if !errors.Is(err, sess.ErrSessionStale) || !strings.Contains(err.Error(), "cleared away") {
+		t.Fatalf("attach = %v; want ErrSessionStale", err)
+	}
+	r, err := m.Record(num)
+	if err != nil || r.State != sess.StateExited || r.Exit.Reason != "daemon crashed" {
+		t.Errorf("record = %+v, %v; want an exit by the daemon crashing", r, err)
+	}
+	if _, err := os.Stat(filepath.Join(m.Dir(), "session-"+num+".sock")); !os.IsNotExist(err) {
+		t.Errorf("the socket was left behind: %v", err)
+	}
+	if _, err := m.Create(sess.CreateOptions{Number: num, Command: []string{"sleep", "60"}}); err != nil {
+		t.Errorf("creating the session afresh: %v", err)
+	}
+}
@@ -0,0 +1,81 @@
+package sess
+
+import (
+	"errors"
+	"time"
+)
+
+// Stats is an overview of everything sess keeps: its sessions, what they
+// run and hold, and the space its directory takes.
+type Stats struct {
+	// Dir is the directory sess keeps its state in, and DirSize the bytes
+	// the files in it use.
+	Dir     string `json:"dir"`
+	DirSize int64  `json:"dir_size"`
+	// Sessions counts the live sessions; Attached those with an
+	// interactive client, Detached the rest.
+	Sessions int `json:"sessions"`
+	Attached int `json:"attached"`
+	Detached int `json:"detached"`
+	// Processes counts the sessions' commands and their descendants, or
+	// is -1 where processes cannot be inspected.
+	Processes int `json:"processes"`
+	// Scrollback is the output the sessions' daemons hold in memory, in
+	// bytes.
+	Scrollback int64 `json:"scrollback"`
+	// Logs is the space session logs use, running and preserved, and
+	// LogLimit the log-disk-limit they are pruned to, 0 without one.
+	Logs     int64 `json:"logs"`
+	LogLimit int64 `json:"log_limit,omitempty"`
+	// Oldest is when the longest-running session was created; nil with
+	// no sessions.
+	Oldest *time.Time `json:"oldest,omitempty"`
+}
+
+// Stats gathers an overview of the sessions and the sess directory. Each
+// daemon is asked for its status; a session whose daemon does not answer
+// counts as detached and holding no scrollback. Counting processes takes
+// a sampling interval.
+func (m *Manager) Stats() (*Stats, error) {
+	sessions, err := m.List()
+	if err != nil {
+		return nil, err
+	}
+	st := &Stats{Dir: m.Dir(), Sessions: len(sessions), Processes: -1}
+	for i := range sessions {
+		s := &sessions[i]
+		if st.Oldest == nil || s.CreatedAt.Before(*st.Oldest) {
+			st.Oldest = &s.CreatedAt
+		}
+		status, err := m.Status(s.Number)
+		if err != nil {
+			continue
+		}
+		st.Scrollback += int64(status.Scrollback)
+		for _, c := range status.Clients {
+			if c.Mode == ModeAttach {
+				st.Attached++
+				break
+			}
+		}
+	}
+	st.Detached = st.Sessions - st.Attached
+
+	usage, err := m.Resources(sessions)
+	switch {
+	case err == nil:
+		st.Processes = 0
+		for _, r := range usage {
+			st.Processes += r.Processes
+		}
+	case !errors.Is(err, ErrUnsupported):
+		return nil, err
+	}
+	if st.Logs, err = m.LogUsage(); err != nil {
+		return nil, err
+	}
+	if st.DirSize, err = m.m.DiskUsage(); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
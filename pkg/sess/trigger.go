@@ -0,0 +1,58 @@
+package sess
+
+import (
+	"fmt"
+
+	"github.com/theMichaelB/sess/internal/client"
+	"github.com/theMichaelB/sess/pkg/protocol"
+)
+
+// Trigger runs a command when a session prints a line that matches a
+// pattern. See AddTrigger.
+type Trigger = protocol.Trigger
+
+// AddTrigger has a session run t.Command whenever it prints a line
+// matching t.Pattern, a regular expression (Go's syntax) matched against
+// the output with escape sequences and other control characters removed.
+// The command runs through /bin/sh, in the background with no terminal,
+// and is killed if it runs for over a minute; SESS_NUM, SESS_TRIGGER_LINE
+// and SESS_TRIGGER_PATTERN say what it matched. Having run, it waits
+// t.Cooldown seconds (10 when zero) before it runs again, so output that
+// keeps matching does not run it over and over. The trigger is kept in
+// the session's metadata, numbered after its others, and returned.
+func (m *Manager) AddTrigger(number string, t Trigger) (Trigger, error) {
+	number = m.NormalizeNumber(number)
+	t, list, err := m.m.AddTrigger(number, t)
+	if err != nil {
+		return t, err
+	}
+	return t, m.sendTriggers(number, list)
+}
+
+// Triggers returns a session's triggers.
+func (m *Manager) Triggers(number string) ([]Trigger, error) {
+	s, err := m.m.GetSession(m.NormalizeNumber(number))
+	if err != nil {
+		return nil, err
+	}
+	return s.Triggers, nil
+}
+
+// RemoveTriggers removes the triggers numbered ids from a session, or all
+// its triggers when no ids are given.
+func (m *Manager) RemoveTriggers(number string, ids ...int) error {
+	number = m.NormalizeNumber(number)
+	list, err := m.m.RemoveTriggers(number, ids)
+	if err != nil {
+		return err
+	}
+	return m.sendTriggers(number, list)
+}
+
+// sendTriggers gives a session's daemon its triggers as they now are.
+func (m *Manager) sendTriggers(number string, list []Trigger) error {
+	if err := client.SetTriggers(m.m.GetSocketPath(number), list, inputTimeout); err != nil {
+		return fmt.Errorf("%w: session %s: %v", ErrConnectionFailed, number, err)
+	}
+	return nil
+}
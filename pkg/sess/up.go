@@ -0,0 +1,122 @@
+package sess
+
+import (
+	"github.com/theMichaelB/sess/internal/config"
+	"github.com/theMichaelB/sess/internal/session"
+)
+
+// Definition is a named session defined in sessions.toml; see
+// LoadDefinitions.
+type Definition = config.Definition
+
+// Respawn policies for CreateOptions.Respawn and Definition.Respawn.
+const (
+	RespawnAlways    = session.RespawnAlways
+	RespawnOnFailure = session.RespawnOnFailure
+)
+
+// DefinitionsPath returns where LoadDefinitions reads from:
+// $XDG_CONFIG_HOME/sess/sessions.toml, usually ~/.config/sess/sessions.toml.
+func DefinitionsPath() (string, error) {
+	return config.SessionsPath()
+}
+
+// LoadDefinitions reads the sessions defined in sessions.toml, in the order
+// it gives them. A missing file is an error wrapping os.ErrNotExist; one
+// that cannot be parsed says on which line, and in which entry.
+func LoadDefinitions() ([]Definition, error) {
+	return config.LoadDefinitions()
+}
+
+// UpResult is what Up did about a definition.
+type UpResult struct {
+	Name string
+	// Number is the session running the definition, if there is one.
+	Number string
+	// Created says Up started the session; otherwise it was running.
+	Created bool
+	// Err is why the session could not be started.
+	Err error
+}
+
+// Up starts a session for each of defs that has none running, and returns
+// what it did about each, in order. The sessions it starts record the
+// definition they came from (see Session.Definition), which is how those
+// already running are recognised, so running Up again starts only what has
+// since ended. Settings defs do not give are taken from base.
+func (m *Manager) Up(defs []Definition, base CreateOptions) ([]UpResult, error) {
+	running, err := m.definedSessions()
+	if err != nil {
+		return nil, err
+	}
+	results := make([]UpResult, 0, len(defs))
+	for _, def := range defs {
+		res := UpResult{Name: def.Name}
+		if number, ok := running[def.Name]; ok {
+			res.Number = number
+			results = append(results, res)
+			continue
+		}
+		opts := base
+		opts.Number = ""
+		opts.Command = def.Command
+		if def.Shell != "" {
+			opts.Command = ShellCommand(def.Shell)
+		}
+		opts.Dir = def.Dir
+		opts.Env = append(append([]string(nil), base.Env...), def.Env...)
+		opts.Respawn = def.Respawn
+		opts.Definition = def.Name
+		res.Number, res.Err = m.Create(opts)
+		res.Created = res.Err == nil
+		results = append(results, res)
+	}
+	return results, nil
+}
+
+// DownResult is what Down did about a session.
+type DownResult struct {
+	Name   string
+	Number string
+	// Err is why the session could not be killed.
+	Err error
+}
+
+// Down kills the live sessions Up started, those of the definitions named
+// in names or, if none are, all of them, whether or not sessions.toml
+// still defines them. It returns what it did about each, in order of
+// session number.
+func (m *Manager) Down(names []string) ([]DownResult, error) {
+	sessions, err := m.List()
+	if err != nil {
+		return nil, err
+	}
+	want := make(map[string]bool)
+	for _, name := range names {
+		want[name] = true
+	}
+	var results []DownResult
+	for _, s := range sessions {
+		if s.Definition == "" || len(want) > 0 && !want[s.Definition] {
+			continue
+		}
+		results = append(results, DownResult{Name: s.Definition, Number: s.Number, Err: m.Kill(s.Number)})
+	}
+	return results, nil
+}
+
+// definedSessions returns the live sessions Up started, by the name of
+// their definition.
+func (m *Manager) definedSessions() (map[string]string, error) {
+	sessions, err := m.List()
+	if err != nil {
+		return nil, err
+	}
+	running := make(map[string]string)
+	for _, s := range sessions {
+		if _, ok := running[s.Definition]; s.Definition != "" && !ok {
+			running[s.Definition] = s.Number
+		}
+	}
+	return running, nil
+}
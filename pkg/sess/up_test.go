@@ -0,0 +1,115 @@
+package sess_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/theMichaelB/sess/pkg/sess"
+)
+
+// defined returns the live sessions started from definitions, by name.
+func defined(t *testing.T, m *sess.Manager) map[string]sess.Session {
+	t.Helper()
+	sessions, err := m.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	byName := make(map[string]sess.Session)
+	for _, s := range sessions {
+		if s.Definition != "" {
+			byName[s.Definition] = s
+		}
+	}
+	return byName
+}
+
+func TestUpStartsWhatIsNotRunning(t *testing.T) {
+	m := newManager(t)
+	dir := t.TempDir()
+	out := filepath.Join(dir, "out")
+	defs := []sess.Definition{
+		{Name: "web", Shell: "pwd > out; echo $UP_TEST >> out; exec sleep 60", Dir: dir, Env: []string{"UP_TEST=from-env"}, Respawn: sess.RespawnAlways},
+		{Name: "worker", Command: []string{"sleep", "60"}},
+	}
+	results, err := m.Up(defs, sess.CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Down(nil)
+	for _, r := range results {
+		if r.Err != nil || !r.Created {
+			t.Fatalf("first up: %+v", r)
+		}
+	}
+	running := defined(t, m)
+	if len(running) != 2 || running["web"].Respawn != sess.RespawnAlways || running["worker"].Respawn != "" {
+		t.Fatalf("sessions after up: %+v", running)
+	}
+	waitFor(t, "web to write its directory and environment", func() bool {
+		data, _ := os.ReadFile(out)
+		return strings.Count(string(data), "\n") == 2
+	})
+	if data, _ := os.ReadFile(out); string(data) != dir+"\nfrom-env\n" {
+		t.Errorf("web ran with %q; want its cwd and env", data)
+	}
+
+	// Running up again starts nothing; once worker is gone, only worker.
+	results, err = m.Up(defs, sess.CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range results {
+		if r.Err != nil || r.Created || r.Number != running[r.Name].Number {
+			t.Errorf("second up: %+v", r)
+		}
+	}
+	if err := m.Kill(running["worker"].Number); err != nil {
+		t.Fatal(err)
+	}
+	results, err = m.Up(defs, sess.CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := results[0]; r.Created || r.Number != running["web"].Number {
+		t.Errorf("web after worker was killed: %+v", r)
+	}
+	if r := results[1]; !r.Created || r.Err != nil {
+		t.Errorf("worker after it was killed: %+v", r)
+	}
+
+	down, err := m.Down([]string{"worker"})
+	if err != nil || len(down) != 1 || down[0].Name != "worker" || down[0].Err != nil {
+		t.Fatalf("down --only worker = %+v, %v", down, err)
+	}
+	if running := defined(t, m); len(running) != 1 || running["web"].Number == "" {
+		t.Errorf("after down --only worker: %+v", running)
+	}
+	if down, err := m.Down(nil); err != nil || len(down) != 1 || down[0].Name != "web" {
+		t.Errorf("down = %+v, %v", down, err)
+	}
+	if running := defined(t, m); len(running) != 0 {
+		t.Errorf("after down: %+v", running)
+	}
+}
+
+func TestRespawnOnFailure(t *testing.T) {
+	m := newManager(t)
+	dir := t.TempDir()
+	runs := filepath.Join(dir, "runs")
+	// Fails once, then succeeds, which ends the session.
+	script := `echo run >> runs; [ "$(wc -l < runs)" -ge 2 ]`
+	num, err := m.Create(sess.CreateOptions{Command: []string{"sh", "-c", script}, Dir: dir, Respawn: sess.RespawnOnFailure})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Kill(num)
+	waitFor(t, "the command to succeed", func() bool {
+		_, err := m.Get(num)
+		return err != nil
+	})
+	if data, _ := os.ReadFile(runs); strings.Count(string(data), "run") != 2 {
+		t.Errorf("the command ran %d times; want 2", strings.Count(string(data), "run"))
+	}
+}
@@ -0,0 +1,128 @@
+package sess_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/theMichaelB/sess/pkg/sess"
+)
+
+// syncBuffer is a bytes.Buffer an attach can write to while the test reads.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// waitFor polls until cond holds, failing the test after a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// An upgrade re-executes the daemon in place, here as the test binary
+// again: the session keeps its command, its scrollback and the client
+// attached to it.
+func TestUpgradeKeepsSession(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("sessions are upgraded in place on Linux only")
+	}
+	m := newManager(t)
+	num, err := m.Create(sess.CreateOptions{Shell: "/bin/sh", Rows: 24, Cols: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Kill(num)
+	before, err := m.Get(num)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stdin, typing := io.Pipe()
+	defer typing.Close()
+	var out syncBuffer
+	attached := make(chan error, 1)
+	go func() {
+		attached <- m.Attach(context.Background(), num, sess.AttachOptions{
+			Stdin:       stdin,
+			Stdout:      &out,
+			Size:        func() (int, int, error) { return 24, 80, nil },
+			Quiet:       true,
+			DetachOnEOF: true,
+		})
+	}()
+	waitFor(t, "the client to attach", func() bool {
+		st, err := m.Status(num)
+		return err == nil && len(st.Clients) == 1
+	})
+	if err := m.Send(num, []byte("echo before-$((6*7))\n")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "output before the upgrade", func() bool { return strings.Contains(out.String(), "before-42") })
+
+	if err := m.Upgrade(num); err != nil {
+		t.Fatalf("Upgrade = %v", err)
+	}
+
+	after, err := m.Get(num)
+	if err != nil {
+		t.Fatalf("session gone after the upgrade: %v", err)
+	}
+	if after.PID != before.PID || after.DaemonPID != before.DaemonPID || !after.CreatedAt.Equal(before.CreatedAt) {
+		t.Errorf("after the upgrade the session is %+v; want it as before, %+v", after, before)
+	}
+	var scrollback bytes.Buffer
+	if _, err := m.Scrollback(num, sess.ScrollbackOptions{}, &scrollback); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(scrollback.String(), "before-42") {
+		t.Errorf("scrollback lost in the upgrade: %q", scrollback.String())
+	}
+
+	// The attached client was handed over: it still types into the
+	// session and sees what it prints.
+	if _, err := typing.Write([]byte("echo after-$((6*7))\n")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "output after the upgrade", func() bool { return strings.Contains(out.String(), "after-42") })
+	st, err := m.Status(num)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(st.Clients) != 1 {
+		t.Errorf("%d clients after the upgrade; want the one attached", len(st.Clients))
+	}
+
+	typing.Close()
+	select {
+	case err := <-attached:
+		if err != nil {
+			t.Errorf("Attach = %v; want a clean detach", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("attach did not end")
+	}
+}
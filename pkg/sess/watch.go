@@ -0,0 +1,142 @@
+package sess
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sync"
+
+	"github.com/theMichaelB/sess/internal/client"
+	"github.com/theMichaelB/sess/internal/linescan"
+	"github.com/theMichaelB/sess/pkg/protocol"
+)
+
+// WatchOptions configures Watch.
+type WatchOptions struct {
+	// Pattern is what a line of the session's output must match.
+	Pattern *regexp.Regexp
+	// Scrollback also matches the output the session held in memory
+	// when the watch started, rather than only what follows.
+	Scrollback bool
+}
+
+// Watch blocks until a line of a session's output matches opts.Pattern and
+// returns the line. Output is matched as triggers match it, with escape
+// sequences taken out, and the line the output has got to counts too, so
+// a prompt with no newline after it can be waited for. Watch connects as a
+// read-only client, leaving the session and anyone attached to it alone.
+// It returns an error wrapping ErrTimeout when ctx's deadline passes first,
+// and an error when the session ends first.
+func (m *Manager) Watch(ctx context.Context, number string, opts WatchOptions) (string, error) {
+	number = m.NormalizeNumber(number)
+	s, err := m.m.GetSession(number)
+	if err != nil {
+		return "", err
+	}
+	socket := m.m.GetSocketPath(number)
+
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+	w := &watcher{re: opts.Pattern, stop: stop}
+	copts := client.Options{
+		Raw:      true,
+		ReadOnly: true,
+		NoInput:  true,
+		PID:      s.PID,
+		Stdout:   w,
+	}
+	var fetchErr error
+	if opts.Scrollback {
+		// Fetched once the watch is connected, so no output falls between
+		// the two; the scrollback gets a scanner of its own, as the live
+		// output may repeat its end.
+		copts.OnAttach = func(string) {
+			held := &watcher{re: opts.Pattern, stop: stop}
+			req := protocol.ScrollbackPayload{}
+			if _, err := client.FetchScrollback(socket, req, held, statusTimeout); err != nil {
+				fetchErr = err
+				stop()
+				return
+			}
+			if line, ok := held.result(); ok {
+				w.found(line)
+			}
+		}
+	}
+
+	err = client.New(s.Number, socket, copts).Attach(ctx)
+	if line, ok := w.result(); ok {
+		return line, nil
+	}
+	if fetchErr != nil {
+		return "", fmt.Errorf("session %s: reading its scrollback: %w", number, fetchErr)
+	}
+	if ctx.Err() != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return "", fmt.Errorf("%w: session %s printed nothing matching %q", ErrTimeout, number, opts.Pattern)
+		}
+		return "", ctx.Err()
+	}
+	var ended *ExitError
+	switch {
+	case errors.As(err, &ended):
+		return "", fmt.Errorf("session %s ended before printing anything matching %q: %v", number, opts.Pattern, err)
+	case err != nil:
+		return "", err
+	}
+	return "", fmt.Errorf("session %s ended before printing anything matching %q", number, opts.Pattern)
+}
+
+// watcher is the output a Watch receives: it scans it for a line matching
+// re, and calls stop once it finds one.
+type watcher struct {
+	re   *regexp.Regexp
+	stop func()
+
+	mu    sync.Mutex
+	lines linescan.Scanner
+	match *string
+}
+
+func (w *watcher) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.match != nil {
+		return len(p), nil
+	}
+	w.lines.Write(p, func(line []byte) {
+		if w.match == nil && w.re.Match(line) {
+			s := string(line)
+			w.match = &s
+		}
+	})
+	if pending := w.lines.Pending(); w.match == nil && len(pending) > 0 && w.re.Match(pending) {
+		s := string(pending)
+		w.match = &s
+	}
+	if w.match != nil {
+		w.stop()
+	}
+	return len(p), nil
+}
+
+// found records a match made elsewhere.
+func (w *watcher) found(line string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.match == nil {
+		w.match = &line
+		w.stop()
+	}
+}
+
+// result returns the line that matched, if one has.
+func (w *watcher) result() (string, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.match == nil {
+		return "", false
+	}
+	return *w.match, true
+}
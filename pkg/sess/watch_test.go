@@ -0,0 +1,59 @@
+package sess_test
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/theMichaelB/sess/pkg/sess"
+)
+
+func TestWatch(t *testing.T) {
+	m := newManager(t)
+	num, err := m.Create(sess.CreateOptions{Command: []string{"sh", "-c", `stty -echo
+printf 'started\n'
+while read line; do printf 'Server \033[1mlisten'; sleep 0.1; printf 'ing\033[0m on %s\n' "$line"; done`}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Kill(num)
+	re := regexp.MustCompile(`listening on :\d+`)
+
+	// Output from before the watch counts only with Scrollback.
+	waitFor(t, "the session to start", func() bool {
+		var b strings.Builder
+		m.Scrollback(num, sess.ScrollbackOptions{}, &b)
+		return strings.Contains(b.String(), "started")
+	})
+	line, err := m.Watch(context.Background(), num, sess.WatchOptions{Pattern: regexp.MustCompile("started"), Scrollback: true})
+	if err != nil || line != "started" {
+		t.Fatalf("Watch with Scrollback = %q, %v; want the line already printed", line, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if _, err := m.Watch(ctx, num, sess.WatchOptions{Pattern: regexp.MustCompile("started")}); !errors.Is(err, sess.ErrTimeout) {
+		t.Fatalf("Watch of old output = %v; want a timeout", err)
+	}
+
+	// A match split across writes and escape sequences.
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		m.Send(num, []byte(":80\n"))
+	}()
+	line, err = m.Watch(context.Background(), num, sess.WatchOptions{Pattern: re})
+	if err != nil || line != "Server listening on :80" {
+		t.Fatalf("Watch = %q, %v; want the matching line", line, err)
+	}
+
+	// The session ending first.
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		m.Send(num, []byte{4})
+	}()
+	if _, err := m.Watch(context.Background(), num, sess.WatchOptions{Pattern: regexp.MustCompile("never")}); err == nil || errors.Is(err, sess.ErrTimeout) {
+		t.Fatalf("Watch = %v as the session ended; want an error", err)
+	}
+}
@@ -17,7 +17,7 @@ extract_first_session_num() {
 
 build() {
   log "Building sess binary"
-  go build -ldflags="-s -w" -o sess ./cmd/main.go
+  go build -ldflags="-s -w" -o sess ./cmd
 }
 
 assert_attached() {